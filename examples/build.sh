@@ -0,0 +1,40 @@
+#!/bin/bash
+
+# Builds static server and client binaries for several platforms into dist/
+# with the version embedded, eg.
+#
+#   examples/build.sh 1.4.0
+#
+# The version defaults to the latest git tag. The platforms can be overridden
+# with PLATFORMS="linux/amd64 darwin/arm64".
+
+set -e
+
+cd "$(dirname "$0")/.."
+
+version=${1:-$(git describe --tags --always 2>/dev/null || echo dev)}
+commit=$(git rev-parse --short HEAD 2>/dev/null || true)
+build_date=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+platforms=${PLATFORMS:-"linux/amd64 linux/arm64 linux/arm darwin/amd64 darwin/arm64 windows/amd64"}
+
+pkg="github.com/deepakkamesh/webtunnel/webtunnelcommon/version"
+ldflags="-s -w -X $pkg.Version=${version#v} -X $pkg.Commit=$commit -X $pkg.BuildDate=$build_date"
+
+for platform in $platforms; do
+  os=${platform%/*}
+  arch=${platform#*/}
+  out="dist/${os}_${arch}"
+  ext=""
+  if [[ "$os" == "windows" ]]; then
+    ext=".exe"
+  fi
+  mkdir -p "$out"
+  echo "Building $version for $platform"
+  # cgo is disabled for static binaries; the server only runs on linux.
+  if [[ "$os" == "linux" ]]; then
+    CGO_ENABLED=0 GOOS=$os GOARCH=$arch go build -trimpath -ldflags "$ldflags" \
+      -o "$out/server$ext" ./examples/servercli
+  fi
+  CGO_ENABLED=0 GOOS=$os GOARCH=$arch go build -trimpath -ldflags "$ldflags" \
+    -o "$out/webtunclient$ext" ./examples/webtunclient
+done
@@ -1,14 +1,18 @@
-// loadgen.go Runs multiple client connection to server to simulate multi client connections. Useful to test load
-// on server.
+// loadgen.go Runs multiple simulated clients against a server to validate gateway capacity and
+// soak test IP allocation and session handling. Clients use fake interfaces, so no OS
+// network configuration is changed.
 package main
 
 import (
 	"crypto/tls"
 	"flag"
 	"fmt"
+	"math/rand"
 	"net"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -21,91 +25,269 @@ import (
 	"github.com/songgao/water"
 )
 
-type fakeIterface struct {
-	SrcIP *net.IP
+var (
+	server   = flag.String("server", "192.168.1.117:8811", "IP:PORT of webtunnel server")
+	secure   = flag.Bool("secure", true, "Connect with websocket secure")
+	clients  = flag.Int("clients", 200, "Number of simulated clients")
+	rampUp   = flag.Duration("rampUp", time.Second, "Delay between starting clients")
+	pattern  = flag.String("pattern", "constant", "Traffic pattern: constant, burst or idle")
+	pps      = flag.Int("pps", 100, "Packets per second per client")
+	burst    = flag.Int("burst", 50, "Packets per burst for the burst pattern")
+	pktSize  = flag.Int("pktSize", 64, "UDP payload size of generated packets")
+	dstIP    = flag.String("dstIP", "192.168.0.1", "Destination IP of generated packets")
+	churn    = flag.Duration("churn", 0, "Reconnect each client after a random time up to this (0 disables)")
+	duration = flag.Duration("duration", 0, "Stop after this long (0 runs until interrupted)")
+	report   = flag.Duration("report", 10*time.Second, "Interval between stats reports")
+)
+
+// stats are the load generator counters.
+type stats struct {
+	connected  int64 // Clients currently connected.
+	starts     int64 // Successful client starts.
+	failures   int64 // Failed client starts.
+	errors     int64 // Errors reported by running clients.
+	txPackets  int64 // Packets sent to the server.
+	txBytes    int64 // Bytes sent to the server.
+	rxPackets  int64 // Packets received from the server.
+	rxBytes    int64 // Bytes received from the server.
+	reconnects int64 // Churn reconnects.
+}
+
+var st stats
+
+// fakeInterface generates traffic for a simulated client and counts received packets.
+type fakeInterface struct {
+	srcIP  net.IP
+	dstIP  net.IP
+	sent   int
+	done   chan struct{}
+	closed sync.Once
+}
+
+func newFakeInterface() *fakeInterface {
+	return &fakeInterface{dstIP: net.ParseIP(*dstIP).To4(), done: make(chan struct{})}
 }
 
-func (i *fakeIterface) Name() string {
+func (i *fakeInterface) Name() string {
 	return "fake0"
 }
-func (i *fakeIterface) IsTUN() bool {
+func (i *fakeInterface) IsTUN() bool {
 	return true
 }
-func (i *fakeIterface) IsTAP() bool {
+func (i *fakeInterface) IsTAP() bool {
 	return false
 }
-func (i *fakeIterface) Write(d []byte) (int, error) {
-	return 1, nil
+func (i *fakeInterface) Write(d []byte) (int, error) {
+	atomic.AddInt64(&st.rxPackets, 1)
+	atomic.AddInt64(&st.rxBytes, int64(len(d)))
+	return len(d), nil
 }
-func (i *fakeIterface) Read(d []byte) (int, error) {
-	// Generate a icmp packet for traffic
+
+// Read returns the next generated packet, pacing it according to the traffic pattern.
+func (i *fakeInterface) Read(d []byte) (int, error) {
+	if err := i.wait(); err != nil {
+		return 0, err
+	}
 	buf := gopacket.NewSerializeBuffer()
 	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
-	gopacket.SerializeLayers(buf, opts,
-		&layers.IPv4{
-			SrcIP:    *i.SrcIP, // net.IP{192, 168, 0, 2},
-			DstIP:    net.IP{192, 168, 0, 1},
-			Protocol: layers.IPProtocolICMPv4,
-			Version:  4,
-		},
-		&layers.ICMPv4{
-			TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0),
-		},
-	)
-	copy(d, buf.Bytes())
-	time.Sleep(10 * time.Millisecond)
-	return 1, nil
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 9}
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		SrcIP:    i.srcIP,
+		DstIP:    i.dstIP,
+		Protocol: layers.IPProtocolUDP,
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+	gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload(make([]byte, *pktSize)))
+	n := copy(d, buf.Bytes())
+	i.sent++
+	atomic.AddInt64(&st.txPackets, 1)
+	atomic.AddInt64(&st.txBytes, int64(n))
+	return n, nil
+}
+
+// wait blocks until the next packet is due or the interface is closed.
+func (i *fakeInterface) wait() error {
+	var delay time.Duration
+	switch *pattern {
+	case "burst":
+		if i.sent%*burst == 0 {
+			delay = time.Duration(*burst) * time.Second / time.Duration(*pps)
+		}
+	case "idle":
+		delay = time.Hour // Keepalives only.
+	default:
+		delay = time.Second / time.Duration(*pps)
+	}
+	select {
+	case <-i.done:
+		return fmt.Errorf("interface closed")
+	case <-time.After(delay):
+		return nil
+	}
 }
-func (i *fakeIterface) Close() error {
+
+func (i *fakeInterface) Close() error {
+	i.closed.Do(func() { close(i.done) })
 	return nil
 }
 
+// startLock serializes client starts, as the interface constructor is a package variable.
+var (
+	startLock sync.Mutex
+	nextIfce  *fakeInterface
+)
+
+// startClient starts a simulated client on a new fake interface.
+func startClient(dialer *websocket.Dialer) (*webtunnelclient.WebtunnelClient, *fakeInterface, error) {
+	startLock.Lock()
+	defer startLock.Unlock()
+
+	ifce := newFakeInterface()
+	nextIfce = ifce
+	initFunc := func(c *webtunnelclient.Interface) error {
+		ifce.srcIP = c.IP
+		return nil
+	}
+	client, err := webtunnelclient.NewWebtunnelClient(*server, dialer, false, initFunc, *secure, 30)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := client.Start(); err != nil {
+		ifce.Close()
+		return nil, nil, err
+	}
+	return client, ifce, nil
+}
+
+// runClient starts a simulated client and keeps it connected, reconnecting on errors
+// and on churn, until stop is closed.
+func runClient(id int, dialer *websocket.Dialer, stop chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		client, ifce, err := startClient(dialer)
+		if err != nil {
+			atomic.AddInt64(&st.failures, 1)
+			glog.Warningf("client %v failed to start: %v", id, err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Second):
+				continue
+			}
+		}
+		atomic.AddInt64(&st.starts, 1)
+		atomic.AddInt64(&st.connected, 1)
+
+		var churnC <-chan time.Time
+		if *churn > 0 {
+			churnC = time.After(time.Duration(rand.Int63n(int64(*churn))) + time.Second)
+		}
+		select {
+		case <-stop:
+		case <-churnC:
+			atomic.AddInt64(&st.reconnects, 1)
+		case err := <-client.Error:
+			atomic.AddInt64(&st.errors, 1)
+			glog.Warningf("client %v error: %v", id, err)
+		}
+		atomic.AddInt64(&st.connected, -1)
+		go drainErrors(client)
+		client.Stop()
+		ifce.Close() // Stop returns early if the connection is gone.
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+}
+
+// drainErrors discards errors of a stopped client so its goroutines can exit.
+func drainErrors(client *webtunnelclient.WebtunnelClient) {
+	for {
+		select {
+		case <-client.Error:
+		case <-time.After(10 * time.Second):
+			return
+		}
+	}
+}
+
+func printStats(elapsed time.Duration) {
+	secs := elapsed.Seconds()
+	glog.Infof("connected:%v starts:%v failures:%v errors:%v reconnects:%v tx:%v pkts (%.0f/s) rx:%v pkts (%.0f/s) tx:%.0f B/s rx:%.0f B/s",
+		atomic.LoadInt64(&st.connected), atomic.LoadInt64(&st.starts), atomic.LoadInt64(&st.failures),
+		atomic.LoadInt64(&st.errors), atomic.LoadInt64(&st.reconnects),
+		atomic.LoadInt64(&st.txPackets), float64(atomic.LoadInt64(&st.txPackets))/secs,
+		atomic.LoadInt64(&st.rxPackets), float64(atomic.LoadInt64(&st.rxPackets))/secs,
+		float64(atomic.LoadInt64(&st.txBytes))/secs, float64(atomic.LoadInt64(&st.rxBytes))/secs)
+}
+
 func main() {
 	flag.Parse()
+	if *pps <= 0 || *burst <= 0 {
+		glog.Exit("pps and burst must be positive")
+	}
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
-	glog.Infof("Starting WebTunnel Generator...")
+	// Fake interfaces and no OS configuration.
+	webtunnelclient.NewWaterInterface = func(water.Config) (wc.Interface, error) {
+		return nextIfce, nil
+	}
+	webtunnelclient.IsConfigured = func(string, string) bool { return true }
+	webtunnelclient.GetMacbyName = func(string) net.HardwareAddr {
+		return net.HardwareAddr{0x01, 0x01, 0x01, 0x01, 0x01, 0x01}
+	}
+	webtunnelclient.FlushDNSCache = func() error { return nil }
+	webtunnelclient.ListRoutes = func() ([]webtunnelclient.Route, error) { return nil, nil }
+	webtunnelclient.ListDNSServers = func() ([]webtunnelclient.DNSServer, error) { return nil, nil }
+	webtunnelclient.ListAddresses = func(string) ([]*net.IPNet, error) { return nil, nil }
+
+	glog.Infof("Starting WebTunnel Generator with %v clients...", *clients)
 	wsDialer := websocket.Dialer{}
 	wsDialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	var clients []*webtunnelclient.WebtunnelClient
 
-	for i := 0; i < 200; i++ {
-		SrcIP := make(net.IP, 1)
-		dummyInitFunc := func(c *webtunnelclient.Interface) error {
-			SrcIP = c.IP
-			return nil
-		}
-		webtunnelclient.NewWaterInterface = func(c water.Config) (wc.Interface, error) {
-			return &fakeIterface{
-				SrcIP: &SrcIP,
-			}, nil
-		}
-		webtunnelclient.IsConfigured = func(string, string) bool { return true }
-		webtunnelclient.GetMacbyName = func(string) net.HardwareAddr {
-			return net.HardwareAddr{0x01, 0x01, 0x01, 0x01, 0x01, 0x01}
+	start := time.Now()
+	stop := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < *clients; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			wg.Add(1)
+			go runClient(i, &wsDialer, stop, wg)
+			time.Sleep(*rampUp)
 		}
+	}()
 
-		client, err := webtunnelclient.NewWebtunnelClient("192.168.1.117:8811", &wsDialer,
-			false, dummyInitFunc, true, 30)
-		clients = append(clients, client)
-		if err != nil {
-			glog.Exitf("Failed to initialize client: %s", err)
-		}
-		if err := client.Start(); err != nil {
-			glog.Exit(err)
-		}
-		fmt.Println("New conn", i)
-		time.Sleep(1 * time.Second)
+	var done <-chan time.Time
+	if *duration > 0 {
+		done = time.After(*duration)
 	}
-	select {
-	case <-c:
-		for _, client := range clients {
-			client.Stop()
+	t := time.NewTicker(*report)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			printStats(time.Since(start))
+			continue
+		case <-c:
+		case <-done:
 		}
-		glog.Infoln("Shutting down WebTunnel")
-		//	case err := <-client.Error:
-		//	glog.Exitf("Client failure: %s", err)
+		break
 	}
-
+	glog.Infoln("Shutting down WebTunnel Generator")
+	close(stop)
+	wg.Wait()
+	printStats(time.Since(start))
 }
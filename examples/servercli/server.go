@@ -2,8 +2,12 @@
 package main
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -11,6 +15,8 @@ import (
 	"syscall"
 	"time"
 
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/deepakkamesh/webtunnel/webtunnelcommon/version"
 	"github.com/deepakkamesh/webtunnel/webtunnelserver"
 	"github.com/golang/glog"
 )
@@ -26,21 +32,146 @@ func SigNotify(c chan os.Signal) {
 	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGINT)
 }
 
+// agentTokens reads a JSON file of agent claims per token, eg.
+// {"<token>": {"subject": "ci", "allow": ["10.1.2.3:443"], "lease": "15m"}}.
+func agentTokens(file string) (webtunnelserver.AgentValidator, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var tokens map[string]struct {
+		Subject string   `json:"subject"`
+		Allow   []string `json:"allow"`
+		Lease   string   `json:"lease"`
+	}
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("error parsing agent tokens %w", err)
+	}
+	claims := make(map[string]*webtunnelserver.AgentClaims)
+	for token, c := range tokens {
+		var lease time.Duration
+		if c.Lease != "" {
+			if lease, err = time.ParseDuration(c.Lease); err != nil {
+				return nil, fmt.Errorf("invalid lease of agent %v %w", c.Subject, err)
+			}
+		}
+		claims[token] = &webtunnelserver.AgentClaims{Subject: c.Subject, Allow: c.Allow, Lease: lease}
+	}
+	return webtunnelserver.AgentTokenVerifier(func(token string) (*webtunnelserver.AgentClaims, error) {
+		return claims[token], nil
+	}), nil
+}
+
 func main() {
 	// Get some flags.
 	listenAddr := flag.String("listenAddr", ":8811", "Bind address:port")
 	httpsKeyFile := flag.String("httpsKeyFile", "localhost.key", "HTTPS Key file path")
 	httpsCertFile := flag.String("httpsCertFile", "localhost.crt", "HTTPS Cert file path")
+	acmeDomains := flag.String("acmeDomains", "", "Obtain the HTTPS certificate for these names separated by comma from an ACME CA instead of the key and cert files")
+	acmeEmail := flag.String("acmeEmail", "", "Contact email of the ACME account")
+	acmeCache := flag.String("acmeCache", "acme-cache", "Directory caching the ACME account and certificate")
+	acmeDirectory := flag.String("acmeDirectory", webtunnelserver.LetsEncryptURL, "ACME directory URL of the CA")
+	acmeChallenge := flag.String("acmeChallenge", webtunnelserver.ACMETLSALPN01, "ACME challenge: tls-alpn-01 or http-01")
+	acmeHTTPAddr := flag.String("acmeHTTPAddr", ":80", "Bind address:port for http-01 challenges")
+	acmeAcceptTOS := flag.Bool("acmeAcceptTOS", false, "Accept the terms of service of the ACME CA")
 
 	gwIP := flag.String("gwIP", "192.168.0.1", "Server GW IP for the VPN tunnel")
 	tunNetmask := flag.String("tunNetmask", "255.255.255.0", "Server GW IP for the VPN tunnel")
 	clientNetPrefix := flag.String("clientNetPrefix", "192.168.0.0/24", "Server GW IP for the VPN tunnel")
 	routePrefix := flag.String("routePrefix","172.16.0.1/30", "routes advertised by server separated by comma")
 
+	runAsUser := flag.String("runAsUser", "", "Drop privileges to this user after setup, refused with pool expansion, client subnets or NAT monitoring")
+	allowRoot := flag.Bool("allowRoot", false, "Allow the server to keep running as root")
+	rawIface := flag.String("rawIface", "", "Experimental: use a raw socket on this interface instead of TUN (needs -tags rawsock)")
+	rawNextHop := flag.String("rawNextHop", "", "MAC address of the next hop for the raw socket data path")
+	maxPPS := flag.Int("maxPPS", 0, "Per client packet per second limit (0 disables)")
+	ppsBurst := flag.Int("ppsBurst", 100, "Per client packet burst allowance above maxPPS")
+	sandbox := flag.Bool("sandbox", false, "Apply seccomp and landlock restrictions after setup (linux only), refused with pool expansion, client subnets or NAT monitoring")
+	seccompAction := flag.String("seccompAction", "errno", "Action on disallowed syscalls: errno, kill or log")
+	tls13Only := flag.Bool("tls13Only", false, "Reject clients below TLS 1.3")
+	requireSNI := flag.String("requireSNI", "", "Reject TLS clients without one of these server names separated by comma")
+	blockNested := flag.Bool("blockNestedTunnels", false, "Drop IPIP and GRE packets inside the tunnel")
+	banStrikes := flag.Int("banStrikes", 0, "Ban clients with this many auth failures, malformed or spoofed packets within -banWindow (0 disables)")
+	banWindow := flag.Duration("banWindow", time.Minute, "Time offences are counted over for -banStrikes")
+	banCooldown := flag.Duration("banCooldown", time.Hour, "How long misbehaving clients are banned")
+	banFile := flag.String("banFile", "", "Persist bans to this file across restarts")
+	upstream := flag.String("upstream", "", "Chain client traffic to this next gateway (eg. wss://egress.example.com/ws), which must accept this server as a site")
+	upstreamUser := flag.String("upstreamUser", "", "Username on the next gateway, the password is read from WEBTUNNEL_UPSTREAM_PASSWORD")
+	upstreamPrefixes := flag.String("upstreamPrefixes", "", "Destinations chained to the next gateway separated by comma, all if empty")
+	slaTracking := flag.Bool("slaTracking", false, "Track connected time and unplanned disconnects of clients for weekly SLA reports")
+	statsDir := flag.String("statsDir", "", "Store session traffic stats in this directory, served by the admin API on /api/v1/stats")
+	adminToken := flag.String("adminToken", "", "Serve the admin REST API on /api/v1 to requests with this bearer token (empty disables)")
+	adminAddr := flag.String("adminAddr", "", "Serve the admin REST API on this address instead of the client listener, eg. 127.0.0.1:8812")
+	agentTokensFile := flag.String("agentTokens", "", "JSON file of bearer tokens of automation agents restricted to their allowed destinations")
+	agentMaxLease := flag.Duration("agentMaxLease", time.Hour, "Close agent sessions after this long")
+	statsRetention := flag.Duration("statsRetention", 30*24*time.Hour, "Delete stored session stats older than this (0 keeps them)")
+	natMonitor := flag.Duration("natMonitor", 0, "Sample the egress NAT table of the OS this often for port exhaustion (0 disables)")
+	natWarning := flag.Float64("natWarning", 0.8, "Log a warning when this fraction of an egress IP port pool is bound (0 disables)")
+	pingInterval := flag.Duration("pingInterval", 60*time.Second, "Ping clients not negotiating a keepalive interval this often")
+	pongTimeout := flag.Duration("pongTimeout", 0, "Close the sessions of clients leaving a ping unanswered this long, releasing their IP (0 disables)")
+	ipLease := flag.Duration("ipLease", 0, "Close the sessions of clients not heard from this long, releasing their IP (0 disables)")
+	ipGrace := flag.Duration("ipGrace", 0, "Hold released IPs this long before handing them to another client")
+	ipReservations := flag.String("ipReservations", "", "JSON file of the tunnel IP reserved per username or \"cert:\" and client certificate common name")
+	tcpKeepAlive := flag.Duration("tcpKeepAlive", 0, "Idle time before TCP keepalive probes on client connections (0 OS default, negative disables)")
+	tcpKeepAliveInterval := flag.Duration("tcpKeepAliveInterval", 0, "Time between unanswered TCP keepalive probes (0 OS default)")
+	tcpKeepAliveCount := flag.Int("tcpKeepAliveCount", 0, "Unanswered TCP keepalive probes before dropping a client connection (0 OS default)")
+	tcpCongestion := flag.String("tcpCongestion", "", "TCP congestion control of client connections eg. bbr (Linux only, empty for the OS default)")
+	p2pAddr := flag.String("p2pAddr", "", "Let clients negotiate direct UDP paths, with the rendezvous listening on this address (eg. :4500)")
+	configLease := flag.Duration("configLease", 0, "Serve client configs out-of-band on /config, holding their IP this long (0 disables)")
+	antiReplay := flag.Bool("antiReplay", false, "Drop client data frames that may be replays (duplicate, too old or unsequenced)")
+	fragments := flag.String("fragments", "pass", "IPv4 fragment handling: pass, reassemble or drop")
+	clientSubnets := flag.String("clientSubnets", "", "Subnets behind clients as hostname=subnet separated by comma (eg. branch1=10.1.0.0/16)")
+	dnsRoutes := flag.String("dnsRoutes", "", "Split DNS map sent to clients as domain=server separated by comma, domains may be prefixes for reverse lookups (eg. corp.example.com=10.1.0.53,10.1.0.0/16=10.1.0.53)")
+	sitePolicy := flag.String("sitePolicy", "", "Enable site-to-site with the prefixes site gateways may advertise as hostname=subnet separated by comma (eg. branch1=10.1.0.0/16)")
+	siteDeadPeer := flag.Duration("siteDeadPeer", 30*time.Second, "Withdraw the routes of site gateways not answering keepalives for this long (0 disables)")
+	gobCodec := flag.Bool("gobCodec", false, "Let clients negotiate the gob control message codec, decoded before they authenticate")
+	minClientVersion := flag.String("minClientVersion", "", "Refuse clients older than this version (eg. 1.4.0)")
+	showVersion := flag.Bool("version", false, "Print the version and exit")
+	debugAddr := flag.String("debugAddr", "", "Serve expvar stats on /debug/vars and runtime profiles on /debug/pprof/ on this localhost address:port (eg. 127.0.0.1:6060)")
+	poolWarning := flag.Float64("poolWarning", 0.8, "Raise an alarm when this fraction of the client IP pool is allocated (0 disables)")
+	poolCritical := flag.Float64("poolCritical", 0.95, "Raise a critical alarm when this fraction of the client IP pool is allocated (0 disables)")
+	poolReject := flag.Bool("poolReject", false, "Refuse new sessions while the client IP pool is critical")
+	poolExpansion := flag.String("poolExpansion", "", "Secondary client network prefix brought online when the client IP pool fills up")
+	poolExpansionGW := flag.String("poolExpansionGW", "", "Gateway IP of clients in the secondary network, its first address if empty")
+	poolExpansionAt := flag.Float64("poolExpansionAt", 0.9, "Fraction of the client IP pool allocated bringing the secondary network online")
+	ipEventWebhook := flag.String("ipEventWebhook", "", "POST IP assignment and pool alarm events to this URL")
+	radiusAuth := flag.String("radiusAuth", "", "Authenticate clients against this RADIUS server host:port")
+	radiusAcct := flag.String("radiusAcct", "", "Send session accounting records to this RADIUS server host:port")
+	radiusInterim := flag.Duration("radiusInterim", 5*time.Minute, "Interval between RADIUS interim accounting records (0 disables)")
+	landingPage := flag.String("landingPage", "", "HTML file served on / instead of OK")
+	staticDir := flag.String("staticDir", "", "Directory of static files served on paths without a handler")
+	versionEndpoint := flag.Bool("versionEndpoint", false, "Serve the build information on /version")
+	redactPayload := flag.Bool("redactPayload", false, "Mask packet payloads and DNS names in logs")
+	anonymizeIPs := flag.Bool("anonymizeIPs", false, "Replace the addresses of logged packets and flows with pseudonyms")
+	impairLatency := flag.Duration("impairLatency", 0, "Staging only: delay added to client packets in each direction")
+	impairJitter := flag.Duration("impairJitter", 0, "Staging only: random extra delay up to this added to client packets")
+	impairLoss := flag.Float64("impairLoss", 0, "Staging only: fraction of client packets dropped in each direction")
+	impairPrefix := flag.String("impairPrefix", "", "Client IPs impaired by -impairLatency, -impairJitter and -impairLoss (default the whole client range)")
+	pacingDelay := flag.Duration("pacingDelay", 0, "Pace writes to clients at their estimated bandwidth, dropping bulk packets queued longer than this (0 disables)")
+
 	routes := strings.Split(*routePrefix,",")
 
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Println(version.Get())
+		return
+	}
+	wc.SetPrivacyPolicy(wc.PrivacyPolicy{RedactPayload: *redactPayload, AnonymizeIPs: *anonymizeIPs})
+	if *gobCodec {
+		wc.RegisterCodec(wc.GobCodec{})
+	}
+
+	if *rawIface != "" {
+		mac, err := net.ParseMAC(*rawNextHop)
+		if err != nil {
+			glog.Fatalf("invalid next hop MAC: %s", err)
+		}
+		if err := webtunnelserver.UseRawSocket(*rawIface, mac); err != nil {
+			glog.Fatalf("%s", err)
+		}
+	}
+
 	glog.Info("starting webtunnel server..")
 	server, err := webtunnelserver.NewWebTunnelServer(*listenAddr, *gwIP,
 		*tunNetmask, *clientNetPrefix, []string{"8.8.8.8", "8.8.1.1"},
@@ -49,11 +180,299 @@ func main() {
 		glog.Fatalf("%s", err)
 	}
 
+	landing := webtunnelserver.LandingPage{Dir: *staticDir, ShowVersion: *versionEndpoint}
+	if *landingPage != "" {
+		if landing.Content, err = os.ReadFile(*landingPage); err != nil {
+			glog.Exit(err)
+		}
+		landing.ContentType = "text/html; charset=utf-8"
+	}
+	if err := server.SetLandingPage(landing); err != nil {
+		glog.Exit(err)
+	}
+
 	// Set Custom HTTP Handlers if you want to handle any custom HTTP endpoints for additional functions.
 	if err := server.SetCustomHandler("/hello", new(myHandle)); err != nil {
 		glog.Exit(err)
 	}
 
+	if *acmeDomains != "" {
+		if err := server.SetACME(webtunnelserver.ACMEConfig{
+			Domains:      strings.Split(*acmeDomains, ","),
+			Email:        *acmeEmail,
+			AcceptTOS:    *acmeAcceptTOS,
+			CacheDir:     *acmeCache,
+			DirectoryURL: *acmeDirectory,
+			Challenge:    *acmeChallenge,
+			HTTPAddr:     *acmeHTTPAddr,
+		}); err != nil {
+			glog.Exit(err)
+		}
+	}
+
+	tlsOpts := webtunnelserver.TLSOptions{TicketRotation: 12 * time.Hour}
+	if *tls13Only {
+		tlsOpts.MinVersion = tls.VersionTLS13
+	}
+	if *requireSNI != "" {
+		tlsOpts.RequireSNI = strings.Split(*requireSNI, ",")
+	}
+	if err := server.SetTLSOptions(tlsOpts); err != nil {
+		glog.Exit(err)
+	}
+
+	server.SetBlockNestedTunnels(*blockNested)
+	server.SetAntiReplay(*antiReplay)
+	policies := map[string]webtunnelserver.FragmentPolicy{
+		"pass":       webtunnelserver.FragmentPass,
+		"reassemble": webtunnelserver.FragmentReassemble,
+		"drop":       webtunnelserver.FragmentDrop,
+	}
+	policy, ok := policies[*fragments]
+	if !ok {
+		glog.Exitf("invalid fragment policy %v", *fragments)
+	}
+	if err := server.SetFragmentPolicy(policy); err != nil {
+		glog.Exit(err)
+	}
+	if *clientSubnets != "" {
+		subnets := map[string][]string{}
+		for _, v := range strings.Split(*clientSubnets, ",") {
+			host, subnet, ok := strings.Cut(v, "=")
+			if !ok {
+				glog.Exitf("invalid client subnet %q", v)
+			}
+			subnets[host] = append(subnets[host], subnet)
+		}
+		server.SetClientSubnets(func(username, hostname string) []string {
+			return subnets[hostname]
+		})
+	}
+
+	if *dnsRoutes != "" {
+		var routes []wc.DNSRoute
+		for _, v := range strings.Split(*dnsRoutes, ",") {
+			domain, dns, ok := strings.Cut(v, "=")
+			if !ok {
+				glog.Exitf("invalid DNS route %q", v)
+			}
+			routes = append(routes, wc.DNSRoute{Domains: []string{domain}, Servers: []string{dns}})
+		}
+		if err := server.SetDNSRoutes(routes); err != nil {
+			glog.Exit(err)
+		}
+	}
+
+	if *sitePolicy != "" {
+		allowed := map[string][]*net.IPNet{}
+		for _, v := range strings.Split(*sitePolicy, ",") {
+			host, subnet, ok := strings.Cut(v, "=")
+			_, n, err := net.ParseCIDR(subnet)
+			if !ok || err != nil {
+				glog.Exitf("invalid site policy %q", v)
+			}
+			allowed[host] = append(allowed[host], n)
+		}
+		policy := func(username, hostname string, prefix *net.IPNet) bool {
+			ones, _ := prefix.Mask.Size()
+			for _, n := range allowed[hostname] {
+				if o, _ := n.Mask.Size(); n.Contains(prefix.IP) && ones >= o {
+					return true
+				}
+			}
+			return false
+		}
+		if err := server.SetSiteToSite(policy, *siteDeadPeer); err != nil {
+			glog.Exit(err)
+		}
+	}
+
+	if *minClientVersion != "" {
+		if err := server.SetMinClientVersion(*minClientVersion); err != nil {
+			glog.Exit(err)
+		}
+	}
+
+	if err := server.SetPoolThresholds(webtunnelserver.PoolThresholds{
+		Warning:    *poolWarning,
+		Critical:   *poolCritical,
+		Hysteresis: 0.05,
+		Reject:     *poolReject,
+	}); err != nil {
+		glog.Exit(err)
+	}
+	if *poolExpansion != "" {
+		if err := server.SetPoolExpansion(webtunnelserver.PoolExpansion{
+			Prefix:    *poolExpansion,
+			GWIp:      *poolExpansionGW,
+			Threshold: *poolExpansionAt,
+		}); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if *ipEventWebhook != "" {
+		server.AddIPEventListener(webtunnelserver.NewWebhookIPListener(*ipEventWebhook, 5*time.Second))
+	}
+
+	// The RADIUS shared secret is read from the environment to keep it off the command line.
+	secret := []byte(os.Getenv("WEBTUNNEL_RADIUS_SECRET"))
+	if *radiusAuth != "" {
+		server.SetAuthenticator(webtunnelserver.NewRADIUSAuthenticator(
+			&webtunnelserver.RADIUSClient{Addr: *radiusAuth, Secret: secret, NASID: *listenAddr, Retries: 2}))
+	}
+	if *radiusAcct != "" {
+		c := &webtunnelserver.RADIUSClient{Addr: *radiusAcct, Secret: secret, NASID: *listenAddr, Retries: 2}
+		if err := server.SetRADIUSAccounting(c, *radiusInterim); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if imp := (webtunnelserver.Impairment{Latency: *impairLatency, Jitter: *impairJitter, Loss: *impairLoss}); imp != (webtunnelserver.Impairment{}) {
+		prefix := *impairPrefix
+		if prefix == "" {
+			prefix = *clientNetPrefix
+		}
+		if err := server.SetImpairment(prefix, imp); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if *banStrikes > 0 {
+		p := webtunnelserver.BanPolicy{Strikes: *banStrikes, Window: *banWindow, Cooldown: *banCooldown, File: *banFile}
+		if err := server.SetBanPolicy(p); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if *upstream != "" {
+		cfg := webtunnelserver.UpstreamConfig{
+			URL:      *upstream,
+			Username: *upstreamUser,
+			Password: os.Getenv("WEBTUNNEL_UPSTREAM_PASSWORD"),
+		}
+		if *upstreamPrefixes != "" {
+			cfg.Prefixes = strings.Split(*upstreamPrefixes, ",")
+		}
+		if err := server.SetUpstream(cfg); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if *slaTracking {
+		server.SetSLATracking()
+	}
+	if *statsDir != "" {
+		if err := server.SetStatsStore(webtunnelserver.StatsPolicy{Dir: *statsDir, Retention: *statsRetention}); err != nil {
+			glog.Exit(err)
+		}
+		if *adminToken == "" {
+			glog.Warning("stats are only served by the admin API, set -adminToken to query them")
+		}
+	}
+	if *adminToken != "" {
+		auth := webtunnelserver.NewTokenAuthenticator(webtunnelserver.TokenVerifier(func(token string) (string, error) {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+				return "", fmt.Errorf("invalid admin token")
+			}
+			return "admin", nil
+		}))
+		if err := server.SetAdminAPI(webtunnelserver.AdminAPI{Addr: *adminAddr, Auth: auth}); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if *agentTokensFile != "" {
+		v, err := agentTokens(*agentTokensFile)
+		if err != nil {
+			glog.Exit(err)
+		}
+		if err := server.SetAgentPolicy(webtunnelserver.AgentPolicy{Validator: v, MaxLease: *agentMaxLease}); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if *natMonitor > 0 {
+		if err := server.SetNATMonitor(*natMonitor, *natWarning); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if err := server.SetDeadPeerDetection(*pingInterval, *pongTimeout); err != nil {
+		glog.Exit(err)
+	}
+	if *ipLease > 0 || *ipGrace > 0 {
+		if err := server.SetIPLease(*ipLease, *ipGrace); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if *ipReservations != "" {
+		if err := server.SetIPReservations(*ipReservations); err != nil {
+			glog.Exit(err)
+		}
+	}
+	tcpOpts := wc.TCPOptions{
+		KeepAlive:         *tcpKeepAlive,
+		KeepAliveInterval: *tcpKeepAliveInterval,
+		KeepAliveCount:    *tcpKeepAliveCount,
+		Congestion:        *tcpCongestion,
+	}
+	if tcpOpts != (wc.TCPOptions{}) {
+		if err := server.SetTCPOptions(tcpOpts); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if *p2pAddr != "" {
+		if err := server.SetPeerToPeer(*p2pAddr); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if *configLease > 0 {
+		if err := server.SetConfigEndpoint(*configLease); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if *pacingDelay > 0 {
+		if err := server.SetPacing(webtunnelserver.PacingPolicy{TargetDelay: *pacingDelay}); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if *maxPPS > 0 {
+		if err := server.SetPacketRateLimit(*maxPPS, *ppsBurst); err != nil {
+			glog.Exit(err)
+		}
+	}
+
+	// Bind the server socket and drop root privileges.
+	if err := server.Listen(); err != nil {
+		glog.Fatalf("%s", err)
+	}
+	if *runAsUser != "" {
+		if err := server.DropPrivileges(*runAsUser); err != nil {
+			glog.Fatalf("%s", err)
+		}
+	}
+	if webtunnelserver.RunningAsRoot() && !*allowRoot {
+		glog.Exit("refusing to run as root, use -runAsUser or -allowRoot")
+	}
+	if *sandbox {
+		opts, err := server.SandboxOptions(webtunnelserver.SandboxOptions{
+			Seccomp:       true,
+			SeccompAction: *seccompAction,
+			Landlock:      true,
+			ReadPaths:     []string{"/etc"},
+			WritePaths:    []string{os.TempDir()}, // glog output.
+		})
+		if err != nil {
+			glog.Fatalf("%s", err)
+		}
+		if err := webtunnelserver.ApplySandbox(opts); err != nil {
+			glog.Fatalf("%s", err)
+		}
+	}
+
+	// Serve runtime stats and profiles for debugging a live process.
+	if *debugAddr != "" {
+		if err := server.PublishExpvar("webtunnelserver"); err != nil {
+			glog.Exit(err)
+		}
+		if err := wc.ServeDebug(*debugAddr); err != nil {
+			glog.Exit(err)
+		}
+	}
+
 	// Start the server.
 	server.Start()
 
@@ -68,6 +487,9 @@ func main() {
 			<-t.C
 			m := server.GetMetrics()
 			glog.Infof("Metrics Users:%v, Bytes: %v/s, Packets:%v/s", m.Users, m.Bytes/30, m.Packets/30)
+			for prefix, rm := range server.GetRouteMetrics() {
+				glog.Infof("Route %v Bytes: %v/s, Packets:%v/s", prefix, rm.Bytes/30, rm.Packets/30)
+			}
 			server.ResetMetrics()
 		}
 	}()
@@ -3,21 +3,72 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/deepakkamesh/webtunnel/webtunnelclient"
+	"github.com/deepakkamesh/webtunnel/webtunnelclient/ipc"
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/deepakkamesh/webtunnel/webtunnelcommon/version"
 	"github.com/golang/glog"
 	"github.com/gorilla/websocket"
 )
 
 var webtunServer = flag.String("webtunServer", "192.168.1.117:8811", "IP:PORT of webtunnel server")
+var devFallback = flag.Bool("devFallback", false, "Fall back to the other device type (TUN/TAP) if interface creation fails")
+var ipcPath = flag.String("ipcPath", "", "Run as privileged helper controlled over this unix socket or pipe name")
+var statusAddr = flag.String("statusAddr", "", "Serve client status on this localhost address:port (eg. 127.0.0.1:8812)")
+var statusTokenFile = flag.String("statusTokenFile", "", "Write the bearer token of the status endpoint actions (pause, resume, reconnect) to this file")
+var debugAddr = flag.String("debugAddr", "", "Serve expvar stats on /debug/vars and runtime profiles on /debug/pprof/ on this localhost address:port (eg. 127.0.0.1:6061)")
+var stateFile = flag.String("stateFile", "", "Persist applied routes and DNS here to clean up after a crash")
+var mtuProbe = flag.Int("mtuProbe", 0, "Discover the tunnel MTU up to this size on connect (0 disables)")
+var dnsSuffixes = flag.String("dnsSuffixes", "", "Only resolve names under these suffixes separated by comma with the tunnel DNS (windows and darwin)")
+var registerDNS = flag.Bool("registerDNS", false, "Register the client hostname in the tunnel DNS (windows only)")
+var fallbacks = flag.String("fallbacks", "", "Connection fallbacks tried in order separated by comma as scheme:port[@proxyURL] (eg. wss:443,ws:80@http://proxy:3128)")
+var username = flag.String("username", "", "Authenticate to the server with this username and the password in WEBTUNNEL_PASSWORD")
+var tokenFile = flag.String("tokenFile", "", "Authenticate to the server with the bearer token in this file, read again on each connection")
+var ssoLogin = flag.String("ssoLogin", "", "Log in with single sign-on in the browser at this identity provider URL")
+var addrPref = flag.String("addrPref", "", "Race the server addresses preferring v6 or v4, or restrict to v6only or v4only (empty uses the system order)")
+var routeMonitor = flag.Duration("routeMonitor", 0, "Reinstall missing tunnel routes and address at this interval (0 disables)")
+var sitePrefixes = flag.String("sitePrefixes", "", "Run as site gateway advertising these local subnets separated by comma (eg. 10.1.0.0/16)")
+var siteDeadPeer = flag.Duration("siteDeadPeer", 30*time.Second, "Withdraw the tunnel routes if the server does not answer keepalives for this long in site mode (0 disables)")
+var keepaliveMin = flag.Duration("keepaliveMin", 25*time.Second, "Keepalive interval the adaptive keepalive starts from")
+var keepaliveMax = flag.Duration("keepaliveMax", 0, "Longest keepalive interval probed to save battery behind NAT (0 disables adaptive keepalive)")
+var idleAfter = flag.Duration("idleAfter", 0, "Save power after this long without traffic (0 disables)")
+var idleKeepaliveOnly = flag.Bool("idleKeepaliveOnly", false, "Suspend all background checks while idle, keeping only keepalives")
+var minServerVersion = flag.String("minServerVersion", "", "Refuse servers older than this version (eg. 1.4.0)")
+var showVersion = flag.Bool("version", false, "Print the version and exit")
+var redactPayload = flag.Bool("redactPayload", false, "Mask packet payloads in logs")
+var anonymizeIPs = flag.Bool("anonymizeIPs", false, "Replace the addresses of logged packets with pseudonyms")
+var antiReplay = flag.Bool("antiReplay", false, "Drop server data frames that may be replays (duplicate, too old or unsequenced)")
+var preflight = flag.Bool("preflight", false, "Check privileges, driver, routes, DNS and server reachability, then exit")
+var configTimeout = flag.Duration("configTimeout", 30*time.Second, "Time the server has to send the client config before reconnecting (0 waits forever)")
+var configRetries = flag.Int("configRetries", 2, "Reconnects after the config timed out before giving up")
+var oobConfig = flag.Bool("oobConfig", false, "Fetch the client config over HTTPS before opening the tunnel")
+var p2p = flag.Bool("p2p", false, "Send heavy traffic to other clients over direct UDP paths if the server allows it")
+var pingInterval = flag.Duration("pingInterval", 0, "Ping the server this often to detect a dead connection (0 disables)")
+var pongTimeout = flag.Duration("pongTimeout", 30*time.Second, "Reconnect if a ping to the server is unanswered this long")
+var tcpKeepAlive = flag.Duration("tcpKeepAlive", 0, "Idle time before TCP keepalive probes on the server connection (0 OS default, negative disables)")
+var tcpKeepAliveInterval = flag.Duration("tcpKeepAliveInterval", 0, "Time between unanswered TCP keepalive probes (0 OS default)")
+var tcpKeepAliveCount = flag.Int("tcpKeepAliveCount", 0, "Unanswered TCP keepalive probes before reconnecting (0 OS default)")
+var packetStream = flag.String("packetStream", "", "Exchange length prefixed IP packets over stdio or unix:PATH instead of a TUN/TAP device")
+var codecs = flag.String("codecs", "", "Control message codecs offered to the server in preference order (eg. webtunnel.gob,webtunnel.json)")
 
 func main() {
 	flag.Parse()
+	if *showVersion {
+		fmt.Println(version.Get())
+		return
+	}
+	wc.SetPrivacyPolicy(wc.PrivacyPolicy{RedactPayload: *redactPayload, AnonymizeIPs: *anonymizeIPs})
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 
@@ -35,17 +86,171 @@ func main() {
 		isTap = true
 		leaseTime = 3000
 	}
+	initFunc := InitializeOS
+	var stream *webtunnelclient.PacketStream
+	if *packetStream != "" {
+		// The tool on the other end of the stream applies the config.
+		var err error
+		if stream, err = openPacketStream(*packetStream); err != nil {
+			glog.Exit(err)
+		}
+		isTap = false
+		initFunc = logConfig
+	}
 	client, err := webtunnelclient.NewWebtunnelClient(*webtunServer, &wsDialer,
-		isTap, InitializeOS, true, leaseTime)
+		isTap, initFunc, true, leaseTime)
 	if err != nil {
 		glog.Exitf("Failed to initialize client: %s", err)
 	}
-	clientPlatformSpecifics(client)
-
-	// Start the client.
-	if err := client.Start(); err != nil {
+	if stream != nil {
+		client.SetExternalInterface(stream)
+	} else {
+		clientPlatformSpecifics(client)
+	}
+	client.SetDeviceFallback(*devFallback)
+	client.SetAntiReplay(*antiReplay)
+	if err := client.SetConfigTimeout(*configTimeout, *configRetries); err != nil {
+		glog.Exit(err)
+	}
+	client.SetOutOfBandConfig(*oobConfig)
+	client.SetPeerToPeer(*p2p)
+	tcpOpts := wc.TCPOptions{
+		KeepAlive:         *tcpKeepAlive,
+		KeepAliveInterval: *tcpKeepAliveInterval,
+		KeepAliveCount:    *tcpKeepAliveCount,
+	}
+	if tcpOpts != (wc.TCPOptions{}) {
+		if err := client.SetTCPOptions(tcpOpts); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if *pingInterval > 0 {
+		if err := client.SetDeadPeerDetection(*pingInterval, *pongTimeout); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if *mtuProbe > 0 {
+		if err := client.SetMTUProbe(0, *mtuProbe); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if *stateFile != "" {
+		client.SetStateFile(*stateFile)
+	}
+	// Darwin applies the suffixes in InitializeOS.
+	if *dnsSuffixes != "" && runtime.GOOS == "windows" {
+		if err := client.SetSplitDNS(strings.Split(*dnsSuffixes, ",")); err != nil {
+			glog.Exit(err)
+		}
+	}
+	client.SetDNSRegistration(*registerDNS)
+	if *fallbacks != "" {
+		strategies, err := parseFallbacks(*fallbacks)
+		if err != nil {
+			glog.Exit(err)
+		}
+		if err := client.SetFallbackStrategies(strategies); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if *username != "" {
+		client.SetCredentials(*username, os.Getenv("WEBTUNNEL_PASSWORD"))
+	}
+	if *tokenFile != "" {
+		client.SetTokenProvider(webtunnelclient.FileTokenProvider(*tokenFile))
+	}
+	if *ssoLogin != "" {
+		if err := client.SetSSOLogin(*ssoLogin, 0); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if *addrPref != "" {
+		prefs := map[string]webtunnelclient.AddressPreference{
+			"v6":     webtunnelclient.PreferIPv6,
+			"v4":     webtunnelclient.PreferIPv4,
+			"v6only": webtunnelclient.IPv6Only,
+			"v4only": webtunnelclient.IPv4Only,
+		}
+		pref, ok := prefs[*addrPref]
+		if !ok {
+			glog.Exitf("invalid address preference %v", *addrPref)
+		}
+		if err := client.SetHappyEyeballs(pref, 0); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if err := client.SetRouteMonitor(*routeMonitor, nil); err != nil {
 		glog.Exit(err)
 	}
+	if *sitePrefixes != "" {
+		if err := client.SetSiteToSite(strings.Split(*sitePrefixes, ","), *siteDeadPeer); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if *keepaliveMax > 0 {
+		if err := client.SetAdaptiveKeepalive(*keepaliveMin, *keepaliveMax); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if *idleAfter > 0 {
+		if err := client.SetPowerSaving(*idleAfter, *idleKeepaliveOnly); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if *minServerVersion != "" {
+		if err := client.SetMinServerVersion(*minServerVersion); err != nil {
+			glog.Exit(err)
+		}
+	}
+	if *codecs != "" {
+		// Gob is not registered by default.
+		wc.RegisterCodec(wc.GobCodec{})
+		client.SetCodecs(strings.Split(*codecs, ",")...)
+	}
+	if *preflight {
+		report := client.Preflight()
+		fmt.Print(report)
+		if !report.OK() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *ipcPath != "" {
+		// Helper mode: the unprivileged GUI starts and stops the tunnel.
+		l, err := ipc.Listen(*ipcPath, 0660)
+		if err != nil {
+			glog.Exit(err)
+		}
+		go ipc.NewHelper(client).Serve(l)
+	} else {
+		// Start the client.
+		if err := client.Start(); err != nil {
+			if errors.Is(err, wc.ErrConfigTimeout) {
+				glog.Exitf("Server %v accepted the connection but sent no config, check its logs: %v", *webtunServer, err)
+			}
+			glog.Exit(err)
+		}
+		glog.Infof("Using %v network interface", client.ActiveDeviceType())
+	}
+	if *statusAddr != "" {
+		if err := client.ServeStatus(*statusAddr); err != nil {
+			glog.Exit(err)
+		}
+		if *statusTokenFile != "" {
+			if err := os.WriteFile(*statusTokenFile, []byte(client.StatusToken()), 0600); err != nil {
+				glog.Exit(err)
+			}
+		}
+	}
+	if *debugAddr != "" {
+		if err := client.PublishExpvar("webtunnelclient"); err != nil {
+			glog.Exit(err)
+		}
+		if err := wc.ServeDebug(*debugAddr); err != nil {
+			glog.Exit(err)
+		}
+	}
 
 	select {
 	case <-c:
@@ -57,3 +262,35 @@ func main() {
 		glog.Exitf("Client failure: %s", err)
 	}
 }
+
+// openPacketStream opens the packet stream of the -packetStream flag.
+func openPacketStream(s string) (*webtunnelclient.PacketStream, error) {
+	if s == "stdio" {
+		return webtunnelclient.StdioPacketStream(), nil
+	}
+	if strings.HasPrefix(s, "unix:") {
+		return webtunnelclient.DialPacketStream(strings.TrimPrefix(s, "unix:"))
+	}
+	return nil, fmt.Errorf("invalid packet stream %q", s)
+}
+
+// logConfig logs the tunnel config of a packet stream.
+func logConfig(cfg *webtunnelclient.Interface) error {
+	glog.Infof("Tunnel config IP:%v Netmask:%v GW:%v DNS:%v Routes:%v", cfg.IP, cfg.Netmask, cfg.GWIP, cfg.DNS, cfg.RoutePrefix)
+	return nil
+}
+
+// parseFallbacks parses the -fallbacks flag.
+func parseFallbacks(s string) ([]webtunnelclient.Strategy, error) {
+	var strategies []webtunnelclient.Strategy
+	for _, f := range strings.Split(s, ",") {
+		spec, proxy, _ := strings.Cut(f, "@")
+		scheme, port, ok := strings.Cut(spec, ":")
+		p, err := strconv.Atoi(port)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid fallback %q", f)
+		}
+		strategies = append(strategies, webtunnelclient.Strategy{Name: f, Scheme: scheme, Port: p, Proxy: proxy})
+	}
+	return strategies, nil
+}
@@ -3,7 +3,9 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os/exec"
+	"strings"
 
 	"github.com/deepakkamesh/webtunnel/webtunnelclient"
 )
@@ -22,11 +24,22 @@ func InitializeOS(cfg *webtunnelclient.Interface) error {
 	}
 
 	for _, route := range cfg.RoutePrefix {
-		cmd := exec.Command("/sbin/route", "-n", "add", "-net", route.String(), "-interface", cfg.Name())
-		if out, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("error setting route on tun %s %s", err, out)
+		if err := webtunnelclient.AddInterfaceRoute(route, cfg.Name(), false); err != nil {
+			return err
 		}
 	}
+	// Scoped default route for applications bound to the tunnel interface.
+	if err := webtunnelclient.AddInterfaceRoute(&net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}, cfg.Name(), true); err != nil {
+		return err
+	}
+
+	var domains []string
+	if *dnsSuffixes != "" {
+		domains = strings.Split(*dnsSuffixes, ",")
+	}
+	if len(cfg.DNS) > 0 {
+		return webtunnelclient.SetSystemDNS(cfg, domains)
+	}
 	return nil
 }
 
@@ -6,6 +6,9 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"net"
+	"os/exec"
 
 	"github.com/deepakkamesh/webtunnel/webtunnelclient"
 	"github.com/golang/glog"
@@ -13,13 +16,47 @@ import (
 )
 
 var tunName = flag.String("tunName", "tun0901", "TUN iface name for OpenVPN version")
+var wintunName = flag.String("wintunName", "", "Use the Wintun driver with this adapter name instead of TAP")
 
 // InitializeOS assigns IP to tunnel and sets up routing via tunnel.
+// TAP interfaces are configured by DHCP, only Wintun (TUN) needs manual setup.
 func InitializeOS(cfg *webtunnelclient.Interface) error {
+	if !cfg.IsTUN() {
+		return nil
+	}
+
+	cmd := exec.Command("netsh", "interface", "ipv4", "set", "address", "name="+cfg.Name(),
+		"static", cfg.IP.String(), net.IP(cfg.Netmask).String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error setting ip on wintun %s %s", err, out)
+	}
+
+	for _, route := range cfg.RoutePrefix {
+		cmd := exec.Command("netsh", "interface", "ipv4", "add", "route", route.String(), cfg.Name(), cfg.GWIP.String())
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("error setting route on wintun %s %s", err, out)
+		}
+	}
+
+	// With split DNS the tunnel DNS servers are only used through NRPT rules.
+	if *dnsSuffixes != "" {
+		return nil
+	}
+	for i, dns := range cfg.DNS {
+		cmd := exec.Command("netsh", "interface", "ipv4", "add", "dnsservers", "name="+cfg.Name(),
+			"address="+dns.String(), fmt.Sprintf("index=%d", i+1))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("error setting dns on wintun %s %s", err, out)
+		}
+	}
 	return nil
 }
 
 func clientPlatformSpecifics(client *webtunnelclient.WebtunnelClient) {
+	if *wintunName != "" {
+		glog.V(1).Info("Using Wintun Interface")
+		client.SetWintun(*wintunName)
+	}
 	if *tunName != "tap0901" {
 		glog.V(1).Info("Overriding Tap Interface")
 		customTapParams := &water.PlatformSpecificParams{
@@ -0,0 +1,52 @@
+package ipam
+
+import "time"
+
+// EventType is the type of an IPAM event.
+type EventType string
+
+const (
+	Assigned     EventType = "assigned"      // IP marked in use by a client.
+	Released     EventType = "released"      // IP returned to the pool.
+	PoolAlarm    EventType = "pool_alarm"    // Pool utilization alarm level changed.
+	LeaseExpired EventType = "lease_expired" // Lease of an IP in use ran out, it is released next.
+	Expanded     EventType = "pool_expanded" // Secondary prefix brought online.
+)
+
+// Event is emitted by IPPam when a client IP is assigned, released or its lease expires,
+// or the pool utilization alarm level changes or the pool expands.
+type Event struct {
+	Type        EventType `json:"type"`
+	IP          string    `json:"ip"`
+	Username    string    `json:"username"`
+	Hostname    string    `json:"hostname"`
+	Tags        []string  `json:"tags,omitempty"`
+	Labels      Labels    `json:"labels,omitempty"`      // Labels of the user from the auth backend.
+	SessionID   string    `json:"sessionid,omitempty"`   // ID the session is logged under, set by the server.
+	Level       PoolLevel `json:"level,omitempty"`       // Alarm level of pool alarms.
+	Utilization float64   `json:"utilization,omitempty"` // Pool utilization of pool alarms and expansions.
+	Prefix      string    `json:"prefix,omitempty"`      // Prefix brought online by pool expansions.
+	Time        time.Time `json:"time"`
+}
+
+// Listener is called for every IPAM event. It is called synchronously from IPPam and
+// should not block.
+type Listener func(Event)
+
+// AddListener registers l to receive IP assigned, released, lease expired, pool alarm and
+// pool expansion events.
+func (i *IPPam) AddListener(l Listener) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.listeners = append(i.listeners, l)
+}
+
+// emit sends ev to all listeners. It must be called without holding the lock.
+func (i *IPPam) emit(ev Event) {
+	i.lock.Lock()
+	listeners := i.listeners
+	i.lock.Unlock()
+	for _, l := range listeners {
+		l(ev)
+	}
+}
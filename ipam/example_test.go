@@ -0,0 +1,132 @@
+package ipam_test
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/deepakkamesh/webtunnel/ipam"
+)
+
+func Example() {
+	pool, err := ipam.New("10.0.0.0/24")
+	if err != nil {
+		panic(err)
+	}
+	pool.AddListener(func(ev ipam.Event) {
+		fmt.Println(ev.Type, ev.IP, ev.Username)
+	})
+
+	// A client connects: acquire an IP, then mark it in use once configured.
+	ip, _ := pool.AcquireIP(nil)
+	pool.SetIPActiveWithUserInfo(ip, "alice", "laptop")
+
+	u, _ := pool.GetUserinfo(ip)
+	fmt.Println(u.Username, u.Hostname)
+
+	pool.ReleaseIP(ip)
+	// Output:
+	// assigned 10.0.0.1 alice
+	// alice laptop
+	// released 10.0.0.1 alice
+}
+
+func ExampleIPPam_Range() {
+	pool, _ := ipam.New("10.0.0.0/29")
+	for _, user := range []string{"alice", "bob"} {
+		ip, _ := pool.AcquireIP(nil)
+		pool.SetIPActiveWithUserInfo(ip, user, user+"-laptop")
+	}
+
+	pool.Range(func(a ipam.Allocation) bool {
+		if a.UserInfo != nil {
+			fmt.Println(a.IP, a.UserInfo.Username)
+		}
+		return true
+	})
+	// Output:
+	// 10.0.0.1 alice
+	// 10.0.0.2 bob
+}
+
+func ExampleIPPam_ByUser() {
+	pool, _ := ipam.New("10.0.0.0/29")
+	for _, host := range []string{"laptop", "phone"} {
+		ip, _ := pool.AcquireIP(nil)
+		pool.SetIPActiveWithUserInfo(ip, "alice", host)
+	}
+
+	pool.AcquireIP(nil) // Handshake in progress.
+
+	fmt.Println(len(pool.ByUser("alice")), "sessions")
+	fmt.Println(pool.ByStatus(ipam.StatusRequested))
+	// Output:
+	// 2 sessions
+	// [10.0.0.3]
+}
+
+func ExampleIPPam_SetThresholds() {
+	pool, _ := ipam.New("10.0.0.0/29") // 6 usable IPs.
+	pool.AddListener(func(ev ipam.Event) {
+		if ev.Type == ipam.PoolAlarm {
+			fmt.Printf("pool %v at %.0f%%\n", ev.Level, ev.Utilization*100)
+		}
+	})
+	pool.SetThresholds(ipam.PoolThresholds{Warning: 0.5, Critical: 0.8})
+	for i := 0; i < 5; i++ {
+		pool.AcquireIP(nil)
+	}
+	// Output:
+	// pool warning at 50%
+	// pool critical at 83%
+}
+
+func ExampleIPPam_SetExpansion() {
+	pool, _ := ipam.New("10.0.0.0/30") // 2 usable IPs.
+	pool.AddListener(func(ev ipam.Event) {
+		if ev.Type == ipam.Expanded {
+			fmt.Println("routing", ev.Prefix) // Eg. add a route to the tunnel interface.
+		}
+	})
+	pool.SetExpansion(ipam.Expansion{Prefix: "10.1.0.0/29", Threshold: 0.5, Reserved: []string{"10.1.0.1"}})
+	for i := 0; i < 3; i++ {
+		ip, _ := pool.AcquireIP(nil)
+		fmt.Println(ip)
+	}
+	fmt.Println(pool.Prefixes())
+	// Output:
+	// routing 10.1.0.0/29
+	// 10.0.0.1
+	// 10.0.0.2
+	// 10.1.0.2
+	// [10.0.0.0/30 10.1.0.0/29]
+}
+
+func ExampleIPPam_AcquireIPFor() {
+	pool, _ := ipam.New("10.0.0.0/29")
+	pool.Reserve("alice", "10.0.0.5")
+
+	bob, _ := pool.AcquireIPFor(nil, "bob")
+	alice, _ := pool.AcquireIPFor(nil, "alice")
+	fmt.Println(bob, alice)
+	// Output:
+	// 10.0.0.1 10.0.0.5
+}
+
+func ExampleManager() {
+	// Custom servers depend on Manager so the IPPam can be swapped, eg. for a client of
+	// an external IPAM.
+	var m ipam.Manager
+	m, _ = ipam.New("10.0.0.0/30") // 2 usable IPs.
+	for i := 0; i < 3; i++ {
+		ip, err := m.AcquireIP(nil)
+		if errors.Is(err, ipam.ErrPoolExhausted) {
+			fmt.Println("exhausted")
+			break
+		}
+		fmt.Println(ip)
+	}
+	// Output:
+	// 10.0.0.1
+	// 10.0.0.2
+	// exhausted
+}
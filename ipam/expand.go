@@ -0,0 +1,110 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Expansion is a secondary prefix brought online when the primary prefix fills up.
+type Expansion struct {
+	Prefix    string   // Secondary IPv4 prefix, must not overlap the primary one.
+	Threshold float64  // Utilization of the primary prefix bringing Prefix online (eg. 0.9).
+	Reserved  []string // Addresses of Prefix allocated when it is brought online, eg. a gateway.
+}
+
+// expansion is the secondary prefix state of IPPam.
+type expansion struct {
+	cfg    Expansion
+	ipnet  *net.IPNet
+	active bool // Prefix online.
+}
+
+// SetExpansion configures a secondary prefix. Once utilization of the primary prefix
+// reaches e.Threshold the secondary prefix is brought online: its network, broadcast and
+// reserved addresses are allocated, an Expanded event is sent to the listeners so routes
+// to it can be added, and its IPs are given out once the primary prefix is full. The
+// secondary prefix stays online until IPPam is discarded.
+func (i *IPPam) SetExpansion(e Expansion) error {
+	ip, ipnet, err := net.ParseCIDR(e.Prefix)
+	if err != nil || ip.To4() == nil {
+		return fmt.Errorf("invalid expansion prefix %q", e.Prefix)
+	}
+	if ipnet.Contains(i.ipnet.IP) || i.ipnet.Contains(ipnet.IP) {
+		return fmt.Errorf("expansion prefix %v overlaps %v", ipnet, i.ipnet)
+	}
+	if e.Threshold <= 0 || e.Threshold > 1 {
+		return fmt.Errorf("invalid expansion threshold %v", e.Threshold)
+	}
+	for _, r := range e.Reserved {
+		ip := net.ParseIP(r)
+		if ip == nil || !ipnet.Contains(ip) || ip.Equal(ipnet.IP) || ip.Equal(lastAddr(ipnet)) {
+			return fmt.Errorf("invalid reserved address %q of %v", r, ipnet)
+		}
+	}
+	i.lock.Lock()
+	if i.expansion != nil && i.expansion.active {
+		i.lock.Unlock()
+		return fmt.Errorf("pool already expanded to %v", i.expansion.ipnet)
+	}
+	i.expansion = &expansion{cfg: e, ipnet: ipnet}
+	i.lock.Unlock()
+	i.checkExpansion()
+	return nil
+}
+
+// Prefixes returns the prefixes IPs are allocated from, the primary one first.
+func (i *IPPam) Prefixes() []string {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	prefixes := []string{i.prefix}
+	if e := i.expansion; e != nil && e.active {
+		prefixes = append(prefixes, e.ipnet.String())
+	}
+	return prefixes
+}
+
+// checkExpansion brings the secondary prefix online once the primary prefix reaches the
+// expansion threshold. It must be called without holding the lock.
+func (i *IPPam) checkExpansion() {
+	i.lock.Lock()
+	e := i.expansion
+	if e == nil || e.active {
+		i.lock.Unlock()
+		return
+	}
+	u := i.prefixUtilization(i.ipnet)
+	if u < e.cfg.Threshold {
+		i.lock.Unlock()
+		return
+	}
+	e.active = true
+	i.allocations[e.ipnet.IP.String()] = &ipData{ipStatus: StatusInUse}
+	i.allocations[lastAddr(e.ipnet).String()] = &ipData{ipStatus: StatusInUse}
+	for _, r := range e.cfg.Reserved {
+		i.allocations[net.ParseIP(r).String()] = &ipData{ipStatus: StatusInUse}
+	}
+	prefix := e.ipnet.String()
+	i.lock.Unlock()
+
+	glog.Warningf("IP pool %v utilization %.1f%%, bringing %v online", i.prefix, u*100, prefix)
+	i.emit(Event{Type: Expanded, Prefix: prefix, Utilization: u, Time: time.Now()})
+}
+
+// prefixUtilization returns the fraction of the client IPs of n allocated. The lock must
+// be held.
+func (i *IPPam) prefixUtilization(n *net.IPNet) float64 {
+	size := poolSize(n)
+	if size <= 0 {
+		return 1
+	}
+	allocated := -2 // Network and broadcast addresses.
+	for ip := range i.allocations {
+		if n.Contains(net.ParseIP(ip)) {
+			allocated++
+		}
+	}
+	return float64(allocated) / float64(size)
+}
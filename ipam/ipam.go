@@ -0,0 +1,393 @@
+/*
+Package ipam manages the client IP addresses of a tunnel prefix. IPPam hands out free
+addresses, tracks the user information of each client session and reports assignments,
+releases and pool utilization alarms to listeners. It is used by webtunnelserver and can
+be used by custom servers through the Manager interface.
+*/
+package ipam
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+)
+
+// Errors returned by IPPam.
+var (
+	ErrPoolExhausted  = errors.New("IPs exhausted")    // No free IP in the client prefix.
+	ErrIPNotAllocated = errors.New("IP not allocated") // IP not allocated to a client.
+)
+
+// Status is the allocation status of an IP.
+type Status int
+
+const (
+	StatusRequested Status = 1 // IP requested.
+	StatusInUse     Status = 2 // IP in use.
+	StatusHeld      Status = 3 // IP released, held for the grace period before reuse.
+)
+
+// Labels are attributes of a user from an auth backend, eg. team or cost center.
+type Labels map[string]string
+
+// UserInfo represents the user information associated with an IP
+type UserInfo struct {
+	Username, Hostname string
+	SessionStart       time.Time
+	Session            string      // Session token given to the client.
+	Posture            *wc.Posture // Last verified device posture.
+	Tags               []string    // Admin tags of the session, including the user tags.
+	Note               string      // Admin note on the session.
+	Labels             Labels      // Attributes of the user from the auth backend.
+}
+
+// ipData represents data associated for each IP.
+type ipData struct {
+	ipStatus  Status
+	data      any       // This field will point to the Websocket Connection object mapped to the IP
+	userinfo  *UserInfo // This field will be associated to the UserInfo object mapped to the IP
+	renewed   time.Time // Last lease renewal of an IP in use.
+	heldUntil time.Time // End of the grace period of a held IP.
+}
+
+// IPPam represents a IP address mgmt struct
+type IPPam struct {
+	prefix      string
+	allocations map[string]*ipData
+	ip          net.IP
+	ipnet       *net.IPNet
+	net         net.IP
+	bcast       net.IP
+	lock        sync.Mutex
+	listeners   []Listener          // IP assigned/released event listeners.
+	userTags    map[string][]string // Admin tags per username, applied to their sessions.
+	alarm       poolAlarm           // Utilization alarm state.
+	lease       time.Duration       // Lease of IPs in use, 0 if they never expire.
+	grace       time.Duration       // Time released IPs are held before reuse, 0 to reuse them at once.
+	expansion   *expansion          // Secondary prefix, nil if the pool does not expand.
+
+	reservations     map[string]string // Reserved IP per identity.
+	reserved         map[string]string // Identity per reserved IP.
+	reservationsFile string            // File the reservations are saved to, empty to keep them in memory.
+}
+
+// New returns a new IPPam for the IPv4 prefix (eg. "192.168.0.0/24"). The network and
+// broadcast addresses are allocated.
+func New(prefix string) (*IPPam, error) {
+
+	ip, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("not an IPv4 prefix: %v", prefix)
+	}
+
+	// Get Network and broadcast addresses of prefix.
+	bcast := lastAddr(ipnet)
+	net := ip.Mask(ipnet.Mask)
+
+	ippam := &IPPam{
+		prefix:      prefix,
+		allocations: make(map[string]*ipData),
+		ip:          ip,
+		ipnet:       ipnet,
+		net:         net,
+		bcast:       bcast,
+		userTags:    make(map[string][]string),
+	}
+
+	// Allocate net and bcast addresses.
+	ippam.allocations[bcast.String()] = &ipData{ipStatus: StatusInUse}
+	ippam.allocations[net.String()] = &ipData{ipStatus: StatusInUse}
+
+	return ippam, nil
+}
+
+// Prefix returns the prefix the IPs are allocated from.
+func (i *IPPam) Prefix() string {
+	return i.prefix
+}
+
+// GetAllocatedCount returns the number of allocated IPs, including held ones.
+func (i *IPPam) GetAllocatedCount() int {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return len(i.allocations)
+}
+
+// Check if an IP requested is valid in the network
+func (i *IPPam) isValidIP(ipAddr string) bool {
+	ip := net.ParseIP(ipAddr)
+	if ip == nil {
+		return false // Invalid format
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if e := i.expansion; e != nil && e.active && e.ipnet.Contains(ip) {
+		return true
+	}
+	return i.ipnet.Contains(ip)
+}
+
+// AcquireIP gets a free IP and marks the status as requested. SetIPactive should be called
+// to make the IP active. data can be used to store any data associated with the IP. IPs of
+// the secondary prefix (see SetExpansion) are only given out once the primary one is full.
+// Reserved IPs (see Reserve) are skipped.
+func (i *IPPam) AcquireIP(data any) (string, error) {
+	i.lock.Lock()
+	nets := []*net.IPNet{i.ipnet}
+	if e := i.expansion; e != nil && e.active {
+		nets = append(nets, e.ipnet)
+	}
+	for _, n := range nets {
+		for ip := n.IP.Mask(n.Mask); n.Contains(ip); inc(ip) {
+			if _, exist := i.allocations[ip.String()]; !exist && i.reserved[ip.String()] == "" {
+				i.allocations[ip.String()] = &ipData{
+					ipStatus: StatusRequested,
+					data:     data,
+				}
+				i.lock.Unlock()
+				i.checkExpansion()
+				i.checkUtilization()
+				return ip.String(), nil
+			}
+		}
+	}
+	i.lock.Unlock()
+	return "", ErrPoolExhausted
+}
+
+// SetIPActiveWithUserInfo marks the IP as in use. IP is not considered active until this function is called.
+// Also adds the username and hostname information associated with the IP connection.
+func (i *IPPam) SetIPActiveWithUserInfo(ip, username, hostname string) error {
+	return i.SetIPActiveWithLabels(ip, username, hostname, nil)
+}
+
+// SetIPActiveWithLabels is SetIPActiveWithUserInfo also attaching the labels of the user
+// from the auth backend.
+func (i *IPPam) SetIPActiveWithLabels(ip, username, hostname string, labels Labels) error {
+	i.lock.Lock()
+	if v, exists := i.allocations[ip]; !exists || v.ipStatus == StatusHeld {
+		i.lock.Unlock()
+		return ErrIPNotAllocated
+	}
+	tags := append([]string(nil), i.userTags[username]...)
+	i.allocations[ip].ipStatus = StatusInUse
+	i.allocations[ip].renewed = time.Now()
+	i.allocations[ip].userinfo = &UserInfo{
+		Username:     username,
+		Hostname:     hostname,
+		SessionStart: time.Now(),
+		Tags:         tags,
+		Labels:       labels,
+	}
+	i.lock.Unlock()
+
+	i.emit(Event{Type: Assigned, IP: ip, Username: username, Hostname: hostname, Tags: tags, Labels: labels,
+		Time: time.Now()})
+	return nil
+}
+
+// SetSession sets the session token for the in use IP.
+func (i *IPPam) SetSession(ip, session string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if v, exists := i.allocations[ip]; !exists || v.userinfo == nil {
+		return fmt.Errorf("%w or not marked in use", ErrIPNotAllocated)
+	}
+	i.allocations[ip].userinfo.Session = session
+	return nil
+}
+
+// SetPosture sets the verified device posture for the in use IP.
+func (i *IPPam) SetPosture(ip string, p *wc.Posture) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if v, exists := i.allocations[ip]; !exists || v.userinfo == nil {
+		return fmt.Errorf("%w or not marked in use", ErrIPNotAllocated)
+	}
+	i.allocations[ip].userinfo.Posture = p
+	return nil
+}
+
+// GetData returns the data associated with the IP.
+func (i *IPPam) GetData(ip string) (any, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if _, exists := i.allocations[ip]; !exists {
+		return nil, ErrIPNotAllocated
+	}
+	if v := i.allocations[ip]; v.ipStatus != StatusInUse {
+		return nil, fmt.Errorf("%w: not marked in use", ErrIPNotAllocated)
+	}
+	return i.allocations[ip].data, nil
+}
+
+// SetData replaces the data associated with the in use IP.
+func (i *IPPam) SetData(ip string, data any) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if v, exists := i.allocations[ip]; !exists || v.ipStatus != StatusInUse {
+		return fmt.Errorf("%w or not marked in use", ErrIPNotAllocated)
+	}
+	i.allocations[ip].data = data
+	return nil
+}
+
+// ClaimIP sets the data of the IP acquired but not yet in use, eg. an IP held for a client
+// config lease and claimed by its connection.
+func (i *IPPam) ClaimIP(ip string, data any) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if v, exists := i.allocations[ip]; !exists || v.ipStatus != StatusRequested {
+		return fmt.Errorf("%w or already in use", ErrIPNotAllocated)
+	}
+	i.allocations[ip].data = data
+	return nil
+}
+
+// FindSession returns the in use IP holding the session token.
+func (i *IPPam) FindSession(session string) (string, bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	for ip, v := range i.allocations {
+		if v.ipStatus == StatusInUse && v.userinfo != nil && v.userinfo.Session == session {
+			return ip, true
+		}
+	}
+	return "", false
+}
+
+// GetUserinfo returns the UnserInfo associated with the IP.
+func (i *IPPam) GetUserinfo(ip string) (UserInfo, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if v, exists := i.allocations[ip]; !exists || v.ipStatus != StatusInUse || v.userinfo == nil {
+		return UserInfo{}, fmt.Errorf("%w or not marked in use", ErrIPNotAllocated)
+	}
+	return *i.allocations[ip].userinfo, nil
+}
+
+// MoveIP moves the user info of the in use oldIP, including the session token, to the
+// allocated newIP and marks it in use. oldIP keeps its data until released.
+func (i *IPPam) MoveIP(oldIP, newIP string) error {
+	i.lock.Lock()
+	o, exists := i.allocations[oldIP]
+	n, nExists := i.allocations[newIP]
+	if !exists || o.userinfo == nil || !nExists || n.ipStatus == StatusHeld {
+		i.lock.Unlock()
+		return fmt.Errorf("%w or not marked in use", ErrIPNotAllocated)
+	}
+	n.ipStatus = StatusInUse
+	n.renewed = o.renewed
+	n.userinfo = o.userinfo
+	o.userinfo = nil
+	u := *n.userinfo
+	i.lock.Unlock()
+
+	now := time.Now()
+	i.emit(Event{Type: Released, IP: oldIP, Username: u.Username, Hostname: u.Hostname, Tags: u.Tags,
+		Labels: u.Labels, Time: now})
+	i.emit(Event{Type: Assigned, IP: newIP, Username: u.Username, Hostname: u.Hostname, Tags: u.Tags,
+		Labels: u.Labels, Time: now})
+	return nil
+}
+
+// ReleaseIP returns IP address back to pool. With a grace period (see SetLease) the IP is
+// held and only reused once the period passed.
+func (i *IPPam) ReleaseIP(ip string) error {
+	i.lock.Lock()
+	if i.net.String() == ip || i.bcast.String() == ip {
+		i.lock.Unlock()
+		return fmt.Errorf("cannot release network or broadcast address")
+	}
+	v, exists := i.allocations[ip]
+	if !exists || v.ipStatus == StatusHeld {
+		i.lock.Unlock()
+		return ErrIPNotAllocated
+	}
+	if i.grace > 0 {
+		i.allocations[ip] = &ipData{ipStatus: StatusHeld, heldUntil: time.Now().Add(i.grace)}
+	} else {
+		delete(i.allocations, ip)
+	}
+	i.lock.Unlock()
+	i.checkUtilization()
+
+	// Only IPs assigned to a client are reported.
+	if v.userinfo != nil {
+		i.emit(Event{Type: Released, IP: ip, Username: v.userinfo.Username, Hostname: v.userinfo.Hostname,
+			Tags: v.userinfo.Tags, Labels: v.userinfo.Labels, Time: time.Now()})
+	}
+	return nil
+}
+
+// DumpAllocations returns a copy of the user information of each IP assigned to a client.
+func (i *IPPam) DumpAllocations() map[string]*UserInfo {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	allocations := make(map[string]*UserInfo)
+	for k, v := range i.allocations {
+		if v.userinfo == nil {
+			continue
+		}
+		d := *v.userinfo
+		allocations[k] = &d
+	}
+	return allocations
+}
+
+// AcquireSpecificIP acquires specific IP and marks it as in use. Reserved IPs (see Reserve)
+// are refused, they are only given out by AcquireIPFor.
+func (i *IPPam) AcquireSpecificIP(ip string, data any) error {
+	if ok := i.isValidIP(ip); !ok {
+		return fmt.Errorf("not a valid IP: %v", ip)
+	}
+	i.lock.Lock()
+	if _, exists := i.allocations[ip]; exists {
+		i.lock.Unlock()
+		return fmt.Errorf("IP already in use")
+	}
+	if id, ok := i.reserved[ip]; ok {
+		i.lock.Unlock()
+		return fmt.Errorf("IP reserved by %v", id)
+	}
+	i.allocations[ip] = &ipData{
+		data:     data,
+		ipStatus: StatusInUse,
+	}
+	i.lock.Unlock()
+	i.checkExpansion()
+	i.checkUtilization()
+	return nil
+}
+
+// inc increments an IP address
+func inc(ip net.IP) {
+	for j := len(ip) - 1; j >= 0; j-- {
+		ip[j]++
+		if ip[j] > 0 {
+			break
+		}
+	}
+}
+
+// lastAddr returns the broadcast address of n.
+func lastAddr(n *net.IPNet) net.IP {
+	ip := make(net.IP, len(n.IP.To4()))
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(n.IP.To4())|^binary.BigEndian.Uint32(net.IP(n.Mask).To4()))
+	return ip
+}
@@ -0,0 +1,354 @@
+package ipam
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIP(t *testing.T) {
+	ipAllocator, _ := New("10.0.0.0/24")
+
+	testCasesAquire := []struct {
+		ipAddr           string
+		expectErrorCheck bool
+		expectedCount    int // If not expecting error
+	}{
+		{"10.0.0.0", true, 0},   // Should not acquire network IP
+		{"10.0.0.255", true, 0}, // Should not acquire broadcast IP
+		{"10.0.0.1", false, 3},
+		{"10.0.0.1", true, 0}, // Cannot aquire same IP twice
+		{"10.0.0.25", false, 4},
+		{"192.168.0.1", true, 0}, // IP not in network
+		{"10.0.0", true, 0},      // Not a valid IP
+		{"10.0.0.300", true, 0},  // Not a valid IP
+		{"hello", true, 0},       // Not a valid IP
+	}
+
+	for _, tc := range testCasesAquire {
+		if tc.expectErrorCheck {
+			err := ipAllocator.AcquireSpecificIP(tc.ipAddr, struct{}{})
+			if err == nil {
+				t.Errorf("Expected error for IP %s, got nil", tc.ipAddr)
+			}
+		} else {
+			err := ipAllocator.AcquireSpecificIP(tc.ipAddr, struct{}{})
+			if err != nil {
+				t.Errorf("Unexpected error for IP %s: %s", tc.ipAddr, err)
+			}
+			if ipAllocator.GetAllocatedCount() != tc.expectedCount {
+				t.Errorf("Incorrect allocated count after acquiring %s", tc.ipAddr)
+			}
+		}
+	}
+
+	testCasesRelease := []struct {
+		ipAddr           string
+		expectErrorCheck bool
+		expectedCount    int // If not expecting error
+	}{
+		{"10.0.0.0", true, 0},   // Should not release network IP
+		{"10.0.0.255", true, 0}, // Should not release broadcast IP
+		{"10.0.0.1", false, 3},
+		{"10.0.0.1", true, 0}, // Should not release same IP twice
+		{"10.0.0.25", false, 2},
+	}
+
+	for _, tc := range testCasesRelease {
+		if tc.expectErrorCheck {
+			err := ipAllocator.ReleaseIP(tc.ipAddr)
+			if err == nil {
+				t.Errorf("Expected error for IP %s, got nil", tc.ipAddr)
+			}
+		} else {
+			err := ipAllocator.ReleaseIP(tc.ipAddr)
+			if err != nil {
+				t.Errorf("Unexpected error for IP %s: %s", tc.ipAddr, err)
+			}
+			if ipAllocator.GetAllocatedCount() != tc.expectedCount {
+				t.Errorf("Incorrect allocated count after acquiring %s", tc.ipAddr)
+			}
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	ipam, _ := New("10.0.0.0/24")
+	var events []Event
+	ipam.AddListener(func(ev Event) { events = append(events, ev) })
+
+	ip, err := ipam.AcquireIP(struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.SetIPActiveWithUserInfo(ip, "user", "host"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.ReleaseIP(ip); err != nil {
+		t.Fatal(err)
+	}
+	// IP never assigned to a client is not reported.
+	ipam.AcquireSpecificIP("10.0.0.50", struct{}{})
+	ipam.ReleaseIP("10.0.0.50")
+
+	want := []EventType{Assigned, Released}
+	if len(events) != len(want) {
+		t.Fatalf("Expected %v events, got %v", len(want), len(events))
+	}
+	for i, ev := range events {
+		if ev.Type != want[i] || ev.IP != ip || ev.Username != "user" || ev.Hostname != "host" {
+			t.Errorf("Unexpected event %+v", ev)
+		}
+	}
+}
+
+func TestIPErrors(t *testing.T) {
+	ipam, _ := New("10.0.0.0/30")
+	if _, err := ipam.GetData("10.0.0.1"); !errors.Is(err, ErrIPNotAllocated) {
+		t.Errorf("Expected ErrIPNotAllocated, got %v", err)
+	}
+	if _, err := ipam.AcquireIP(struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ipam.AcquireIP(struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ipam.AcquireIP(struct{}{}); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("Expected ErrPoolExhausted, got %v", err)
+	}
+}
+
+func TestQueries(t *testing.T) {
+	ipam, _ := New("10.0.0.0/29")
+	for _, u := range []string{"alice", "bob", "alice"} {
+		ip, err := ipam.AcquireIP(struct{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ipam.SetIPActiveWithUserInfo(ip, u, u+"-laptop")
+	}
+	ipam.AcquireIP(struct{}{}) // Handshake in progress.
+
+	if got := ipam.ByUser("alice"); len(got) != 2 || got["10.0.0.1"].Hostname != "alice-laptop" ||
+		got["10.0.0.3"].Username != "alice" {
+		t.Errorf("Unexpected sessions of alice %+v", got)
+	}
+	if got := ipam.ByUser("carol"); len(got) != 0 {
+		t.Errorf("Expected no sessions of carol, got %+v", got)
+	}
+	if got := ipam.ByStatus(StatusRequested); !reflect.DeepEqual(got, []string{"10.0.0.4"}) {
+		t.Errorf("Unexpected requested IPs %v", got)
+	}
+	want := []string{"10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.7"}
+	if got := ipam.ByStatus(StatusInUse); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected in use IPs %v, got %v", want, got)
+	}
+
+	// Range stops when f returns false and may call IPPam.
+	var ips []string
+	ipam.Range(func(a Allocation) bool {
+		if a.UserInfo == nil {
+			return true
+		}
+		ips = append(ips, a.IP)
+		ipam.ReleaseIP(a.IP)
+		return len(ips) < 2
+	})
+	if !reflect.DeepEqual(ips, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("Unexpected range %v", ips)
+	}
+	if got := ipam.GetAllocatedCount(); got != 4 {
+		t.Errorf("Expected 4 allocations after release, got %v", got)
+	}
+}
+
+func TestLeases(t *testing.T) {
+	ipam, _ := New("10.0.0.0/29")
+	if err := ipam.SetLease(50*time.Millisecond, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	var events []EventType
+	ipam.AddListener(func(ev Event) { events = append(events, ev.Type) })
+
+	active := func() string {
+		ip, err := ipam.AcquireIP(struct{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ipam.SetIPActiveWithUserInfo(ip, "user", "host"); err != nil {
+			t.Fatal(err)
+		}
+		return ip
+	}
+	stale, renewed := active(), active()
+	ipam.AcquireSpecificIP("10.0.0.6", struct{}{}) // Never expires, not a client.
+
+	time.Sleep(30 * time.Millisecond)
+	if err := ipam.Renew(renewed); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if got := ipam.Reap(); !reflect.DeepEqual(got, []string{stale}) {
+		t.Errorf("Expected %v reaped, got %v", stale, got)
+	}
+	if want := []EventType{Assigned, Assigned, LeaseExpired, Released}; !reflect.DeepEqual(events, want) {
+		t.Errorf("Expected events %v, got %v", want, events)
+	}
+
+	// The released IP is held for the grace period.
+	if a, ok := ipam.Lookup(stale); !ok || a.Status != StatusHeld || a.UserInfo != nil {
+		t.Errorf("Expected %v held, got %+v", stale, a)
+	}
+	if err := ipam.ReleaseIP(stale); !errors.Is(err, ErrIPNotAllocated) {
+		t.Errorf("Expected held IP not released again, got %v", err)
+	}
+	if err := ipam.Renew(stale); err == nil {
+		t.Error("Expected held IP not renewed")
+	}
+	if ip := active(); ip == stale {
+		t.Errorf("Expected held IP %v not handed out", stale)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	ipam.Reap()
+	if _, ok := ipam.Lookup(stale); ok {
+		t.Errorf("Expected %v back in the pool", stale)
+	}
+	if _, ok := ipam.Lookup("10.0.0.6"); !ok {
+		t.Error("Expected specific IP kept")
+	}
+
+	if err := ipam.SetLease(-time.Second, 0); err == nil {
+		t.Error("Expected invalid lease refused")
+	}
+}
+
+func TestExpansion(t *testing.T) {
+	ipam, _ := New("10.0.0.0/29")
+	for _, e := range []Expansion{
+		{Prefix: "10.0.0.0/28", Threshold: 0.5},
+		{Prefix: "10.1.0.0/30", Threshold: 0},
+		{Prefix: "10.1.0.0/30", Threshold: 0.5, Reserved: []string{"10.1.0.3"}},
+		{Prefix: "fd00::/64", Threshold: 0.5},
+	} {
+		if err := ipam.SetExpansion(e); err == nil {
+			t.Errorf("Expected invalid expansion %+v refused", e)
+		}
+	}
+	if err := ipam.SetExpansion(Expansion{Prefix: "10.1.0.0/30", Threshold: 0.5, Reserved: []string{"10.1.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	var expanded []Event
+	ipam.AddListener(func(ev Event) {
+		if ev.Type == Expanded {
+			expanded = append(expanded, ev)
+		}
+	})
+
+	if err := ipam.AcquireSpecificIP("10.1.0.2", struct{}{}); err == nil {
+		t.Error("Expected secondary IP refused while offline")
+	}
+	var ips []string
+	for {
+		ip, err := ipam.AcquireIP(struct{}{})
+		if errors.Is(err, ErrPoolExhausted) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ips = append(ips, ip)
+		if len(ips) == 2 && len(expanded) != 0 {
+			t.Error("Expected no expansion under the threshold")
+		}
+	}
+
+	// The primary prefix is used up before the secondary one.
+	want := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6", "10.1.0.2"}
+	if !reflect.DeepEqual(ips, want) {
+		t.Errorf("Expected IPs %v, got %v", want, ips)
+	}
+	if len(expanded) != 1 || expanded[0].Prefix != "10.1.0.0/30" || expanded[0].Utilization != 0.5 {
+		t.Errorf("Expected one expansion event, got %+v", expanded)
+	}
+	if got := ipam.Prefixes(); !reflect.DeepEqual(got, []string{"10.0.0.0/29", "10.1.0.0/30"}) {
+		t.Errorf("Unexpected prefixes %v", got)
+	}
+	if u, _ := ipam.Utilization(); u != 1 {
+		t.Errorf("Expected full pool, got %v", u)
+	}
+
+	// Online prefixes stay online.
+	for _, ip := range ips {
+		ipam.ReleaseIP(ip)
+	}
+	if got := ipam.Prefixes(); len(got) != 2 {
+		t.Errorf("Expected secondary prefix online, got %v", got)
+	}
+	if err := ipam.SetExpansion(Expansion{Prefix: "10.2.0.0/24", Threshold: 0.5}); err == nil {
+		t.Error("Expected expansion refused once expanded")
+	}
+}
+
+func TestReservations(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "reservations.json")
+	os.WriteFile(file, []byte(`{"alice": "10.0.0.5"}`), 0600)
+	ipam, _ := New("10.0.0.0/29")
+	if err := ipam.LoadReservations(file); err != nil {
+		t.Fatal(err)
+	}
+	for id, ip := range map[string]string{"bob": "10.0.0.7", "carol": "10.1.0.1", "dave": "10.0.0.5", "": "10.0.0.4"} {
+		if err := ipam.Reserve(id, ip); err == nil {
+			t.Errorf("Expected reservation of %v for %q refused", ip, id)
+		}
+	}
+	if err := ipam.Reserve("cert:bob", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.AcquireSpecificIP("10.0.0.1", struct{}{}); err == nil {
+		t.Error("Expected reserved IP refused to AcquireSpecificIP")
+	}
+
+	// Reserved IPs are skipped by dynamic allocation.
+	ip, _ := ipam.AcquireIP(struct{}{})
+	if ip != "10.0.0.2" {
+		t.Errorf("Expected first unreserved IP, got %v", ip)
+	}
+	if ip, _ := ipam.AcquireIPFor(struct{}{}, "cert:alice", "alice"); ip != "10.0.0.5" {
+		t.Errorf("Expected reserved IP of alice, got %v", ip)
+	}
+	// A second session of alice gets a dynamic IP.
+	if ip, _ := ipam.AcquireIPFor(struct{}{}, "alice"); ip != "10.0.0.3" {
+		t.Errorf("Expected dynamic IP, got %v", ip)
+	}
+
+	// Held reserved IPs are given back to their identity.
+	ipam.SetLease(0, time.Hour)
+	ipam.ReleaseIP("10.0.0.5")
+	if ip, _ := ipam.AcquireIPFor(struct{}{}, "alice"); ip != "10.0.0.5" {
+		t.Errorf("Expected held reserved IP of alice, got %v", ip)
+	}
+
+	// Reservations are persisted.
+	if err := ipam.Unreserve("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.Unreserve("alice"); err == nil {
+		t.Error("Expected unknown reservation refused")
+	}
+	loaded, _ := New("10.0.0.0/29")
+	if err := loaded.LoadReservations(file); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.Reservations(); !reflect.DeepEqual(got, map[string]string{"cert:bob": "10.0.0.1"}) {
+		t.Errorf("Unexpected reservations %v", got)
+	}
+
+	os.WriteFile(file, []byte(`{"alice": "10.0.0.5", "bob": "10.0.0.5"}`), 0600)
+	if err := loaded.LoadReservations(file); err == nil {
+		t.Error("Expected duplicate reservation refused")
+	}
+}
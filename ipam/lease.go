@@ -0,0 +1,99 @@
+package ipam
+
+import (
+	"fmt"
+	"time"
+)
+
+// SetLease enables expiry of IPs in use by clients. An IP not renewed within lease is
+// reported as LeaseExpired and released by Reap, a lease of 0 never expires. Released IPs
+// are held for grace before they are handed out again, so packets still in flight for
+// the old client do not reach a new one.
+func (i *IPPam) SetLease(lease, grace time.Duration) error {
+	if lease < 0 || grace < 0 {
+		return fmt.Errorf("invalid lease %v or grace period %v", lease, grace)
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.lease = lease
+	i.grace = grace
+	return nil
+}
+
+// Renew renews the lease of the in use IP, eg. on traffic or keepalives of its client.
+func (i *IPPam) Renew(ip string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if v, exists := i.allocations[ip]; !exists || v.ipStatus != StatusInUse {
+		return fmt.Errorf("%w or not marked in use", ErrIPNotAllocated)
+	}
+	i.allocations[ip].renewed = time.Now()
+	return nil
+}
+
+// Reap releases the client IPs whose lease expired and returns the held IPs whose grace
+// period passed to the pool. It returns the IPs released. Listeners get a LeaseExpired
+// event before the Released event of each expired IP, so the owner of the IP can close
+// its connection.
+func (i *IPPam) Reap() []string {
+	now := time.Now()
+	var expired []string
+	var freed bool
+	i.lock.Lock()
+	for ip, v := range i.allocations {
+		switch {
+		case v.ipStatus == StatusHeld && !now.Before(v.heldUntil):
+			delete(i.allocations, ip)
+			freed = true
+		case i.lease > 0 && v.ipStatus == StatusInUse && v.userinfo != nil && now.Sub(v.renewed) > i.lease:
+			expired = append(expired, ip)
+		}
+	}
+	i.lock.Unlock()
+	if freed {
+		i.checkUtilization()
+	}
+
+	var released []string
+	for _, ip := range expired {
+		u, err := i.GetUserinfo(ip)
+		if err != nil {
+			continue // Released meanwhile.
+		}
+		i.emit(Event{Type: LeaseExpired, IP: ip, Username: u.Username, Hostname: u.Hostname, Tags: u.Tags,
+			Labels: u.Labels, Time: now})
+		// A listener may already have released the IP.
+		if err := i.ReleaseIP(ip); err == nil || i.isReleased(ip) {
+			released = append(released, ip)
+		}
+	}
+	return released
+}
+
+// isReleased returns true if ip is free or held.
+func (i *IPPam) isReleased(ip string) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	v, exists := i.allocations[ip]
+	return !exists || v.ipStatus == StatusHeld
+}
+
+// RunReaper calls Reap every interval until stop is called, for users of IPPam without
+// their own housekeeping loop.
+func (i *IPPam) RunReaper(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				i.Reap()
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,63 @@
+package ipam
+
+import (
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+)
+
+// Manager is the client IP management used by a tunnel server. IPPam implements it; a
+// custom implementation, eg. backed by an external IPAM, must be safe for concurrent use
+// and emit the same events to its listeners.
+type Manager interface {
+	// Allocation.
+	AcquireIP(data any) (string, error)
+	AcquireIPFor(data any, identities ...string) (string, error)
+	AcquireSpecificIP(ip string, data any) error
+	ClaimIP(ip string, data any) error
+	MoveIP(oldIP, newIP string) error
+	ReleaseIP(ip string) error
+	GetAllocatedCount() int
+	Lookup(ip string) (Allocation, bool)
+
+	// Leases.
+	SetLease(lease, grace time.Duration) error
+	Renew(ip string) error
+	Reap() []string
+
+	// Reservations.
+	LoadReservations(file string) error
+	Reserve(identity, ip string) error
+	Unreserve(identity string) error
+	Reservations() map[string]string
+
+	// Sessions.
+	SetIPActiveWithUserInfo(ip, username, hostname string) error
+	SetIPActiveWithLabels(ip, username, hostname string, labels Labels) error
+	SetSession(ip, session string) error
+	SetPosture(ip string, p *wc.Posture) error
+	FindSession(session string) (string, bool)
+	GetData(ip string) (any, error)
+	SetData(ip string, data any) error
+	GetUserinfo(ip string) (UserInfo, error)
+
+	// Tags.
+	UpdateTags(ip string, add, remove []string) error
+	SetNote(ip, note string) error
+	UpdateUserTags(username string, add, remove []string)
+	GetUserTags(username string) []string
+
+	// Queries.
+	DumpAllocations() map[string]*UserInfo
+	ByUser(username string) map[string]UserInfo
+	ByStatus(status Status) []string
+	Range(f func(Allocation) bool)
+
+	// Events, utilization and expansion.
+	AddListener(l Listener)
+	SetThresholds(t PoolThresholds) error
+	SetExpansion(e Expansion) error
+	Prefixes() []string
+	Utilization() (float64, PoolLevel)
+	RejectSessions() bool
+}
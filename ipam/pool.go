@@ -0,0 +1,122 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// PoolLevel is the utilization alarm level of the client IP pool.
+type PoolLevel string
+
+const (
+	PoolNormal   PoolLevel = "normal"   // Utilization under the thresholds.
+	PoolWarning  PoolLevel = "warning"  // Utilization reached the warning threshold.
+	PoolCritical PoolLevel = "critical" // Utilization reached the critical threshold.
+)
+
+// PoolThresholds are the client IP pool utilization alarm thresholds, as fractions of
+// the pool (eg. 0.8 for 80%).
+type PoolThresholds struct {
+	Warning    float64 // Utilization raising the warning alarm, 0 disables.
+	Critical   float64 // Utilization raising the critical alarm, 0 disables.
+	Hysteresis float64 // How far under its threshold utilization must drop to clear an alarm.
+	Reject     bool    // Refuse new sessions while critical.
+}
+
+// poolAlarm is the utilization alarm state of IPPam.
+type poolAlarm struct {
+	thresholds PoolThresholds
+	level      PoolLevel
+}
+
+// SetThresholds enables utilization alarms. Each level change is sent to the listeners
+// as a PoolAlarm event. An alarm is raised when utilization reaches its threshold and
+// only cleared once utilization drops Hysteresis below it, so a pool hovering around a
+// threshold does not flap.
+func (i *IPPam) SetThresholds(t PoolThresholds) error {
+	if t.Warning < 0 || t.Critical < 0 || t.Warning > 1 || t.Critical > 1 || t.Hysteresis < 0 {
+		return fmt.Errorf("invalid pool thresholds %+v", t)
+	}
+	if t.Warning > 0 && t.Critical > 0 && t.Warning > t.Critical {
+		return fmt.Errorf("warning threshold %v above critical threshold %v", t.Warning, t.Critical)
+	}
+	i.lock.Lock()
+	i.alarm = poolAlarm{thresholds: t, level: PoolNormal}
+	i.lock.Unlock()
+	i.checkUtilization()
+	return nil
+}
+
+// Utilization returns the fraction of the pool allocated and the alarm level.
+func (i *IPPam) Utilization() (float64, PoolLevel) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	level := i.alarm.level
+	if level == "" {
+		level = PoolNormal
+	}
+	return i.utilization(), level
+}
+
+// RejectSessions returns true if new sessions are to be refused as the pool is critical.
+func (i *IPPam) RejectSessions() bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return i.alarm.thresholds.Reject && i.alarm.level == PoolCritical
+}
+
+// utilization returns the fraction of the pool allocated, including the secondary prefix
+// once online. The lock must be held.
+func (i *IPPam) utilization() float64 {
+	capacity, allocated := poolSize(i.ipnet), len(i.allocations)-2 // Network and broadcast addresses.
+	if e := i.expansion; e != nil && e.active {
+		capacity += poolSize(e.ipnet)
+		allocated -= 2
+	}
+	if capacity <= 0 {
+		return 1
+	}
+	return float64(allocated) / float64(capacity)
+}
+
+// poolSize returns the number of client IPs of n, without the network and broadcast
+// addresses.
+func poolSize(n *net.IPNet) int {
+	ones, bits := n.Mask.Size()
+	return (1 << (bits - ones)) - 2
+}
+
+// checkUtilization updates the alarm level and emits an event if it changed. It must be
+// called without holding the lock.
+func (i *IPPam) checkUtilization() {
+	i.lock.Lock()
+	t := i.alarm.thresholds
+	if t.Warning == 0 && t.Critical == 0 {
+		i.lock.Unlock()
+		return
+	}
+	u := i.utilization()
+	level := PoolNormal
+	switch {
+	case t.Critical > 0 && (u >= t.Critical || (i.alarm.level == PoolCritical && u > t.Critical-t.Hysteresis)):
+		level = PoolCritical
+	case t.Warning > 0 && (u >= t.Warning || (i.alarm.level != PoolNormal && u > t.Warning-t.Hysteresis)):
+		level = PoolWarning
+	}
+	changed := level != i.alarm.level
+	i.alarm.level = level
+	i.lock.Unlock()
+
+	if !changed {
+		return
+	}
+	if level == PoolNormal {
+		glog.Infof("IP pool utilization %.1f%% back to normal", u*100)
+	} else {
+		glog.Warningf("IP pool utilization %.1f%% is %v", u*100, level)
+	}
+	i.emit(Event{Type: PoolAlarm, Level: level, Utilization: u, Time: time.Now()})
+}
@@ -0,0 +1,82 @@
+package ipam
+
+import (
+	"bytes"
+	"net"
+	"sort"
+)
+
+// Allocation is an allocated IP as returned by Range and Lookup.
+type Allocation struct {
+	IP       string
+	Status   Status
+	Data     any       // Data associated with the IP.
+	UserInfo *UserInfo // Copy of the user information, nil if the IP is not assigned to a client.
+}
+
+// allocation returns the Allocation of ip. The lock must be held.
+func (v *ipData) allocation(ip string) Allocation {
+	a := Allocation{IP: ip, Status: v.ipStatus, Data: v.data}
+	if v.userinfo != nil {
+		u := *v.userinfo
+		a.UserInfo = &u
+	}
+	return a
+}
+
+// Lookup returns the allocation of ip whatever its status.
+func (i *IPPam) Lookup(ip string) (Allocation, bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	v, ok := i.allocations[ip]
+	if !ok {
+		return Allocation{}, false
+	}
+	return v.allocation(ip), true
+}
+
+// ByUser returns a copy of the user information of each IP in use by username.
+func (i *IPPam) ByUser(username string) map[string]UserInfo {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	m := make(map[string]UserInfo)
+	for ip, v := range i.allocations {
+		if v.userinfo != nil && v.userinfo.Username == username {
+			m[ip] = *v.userinfo
+		}
+	}
+	return m
+}
+
+// ByStatus returns the IPs with status in address order. The network and broadcast
+// addresses and IPs acquired with AcquireSpecificIP are StatusInUse.
+func (i *IPPam) ByStatus(status Status) []string {
+	var ips []string
+	i.Range(func(a Allocation) bool {
+		if a.Status == status {
+			ips = append(ips, a.IP)
+		}
+		return true
+	})
+	return ips
+}
+
+// Range calls f for each allocated IP in address order until f returns false. f is called
+// on a snapshot of the allocations without holding the lock, so it may call IPPam.
+func (i *IPPam) Range(f func(Allocation) bool) {
+	i.lock.Lock()
+	allocations := make([]Allocation, 0, len(i.allocations))
+	for ip, v := range i.allocations {
+		allocations = append(allocations, v.allocation(ip))
+	}
+	i.lock.Unlock()
+
+	sort.Slice(allocations, func(x, y int) bool {
+		return bytes.Compare(net.ParseIP(allocations[x].IP).To4(), net.ParseIP(allocations[y].IP).To4()) < 0
+	})
+	for _, a := range allocations {
+		if !f(a) {
+			return
+		}
+	}
+}
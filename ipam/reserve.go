@@ -0,0 +1,152 @@
+package ipam
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+)
+
+// LoadReservations loads the IP reservations of file, a JSON object of identity to IP, and
+// saves the reservations made with Reserve and Unreserve to it from now on. A missing file
+// holds no reservations.
+func (i *IPPam) LoadReservations(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error reading reservations %w", err)
+	}
+	res := map[string]string{}
+	if err == nil {
+		if err := json.Unmarshal(data, &res); err != nil {
+			return fmt.Errorf("error parsing reservations %w", err)
+		}
+	}
+	byIP := make(map[string]string, len(res))
+	for id, ip := range res {
+		if err := i.checkReservation(ip); err != nil {
+			return fmt.Errorf("reservation of %v: %w", id, err)
+		}
+		if other, ok := byIP[ip]; ok {
+			return fmt.Errorf("%v reserved by %v and %v", ip, other, id)
+		}
+		byIP[ip] = id
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.reservations = res
+	i.reserved = byIP
+	i.reservationsFile = file
+	return nil
+}
+
+// Reserve reserves ip of the primary prefix for identity (eg. a username), replacing its
+// previous reservation. Reserved IPs are only given out by AcquireIPFor to their identity.
+func (i *IPPam) Reserve(identity, ip string) error {
+	if identity == "" {
+		return fmt.Errorf("empty identity")
+	}
+	if err := i.checkReservation(ip); err != nil {
+		return err
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if other, ok := i.reserved[ip]; ok && other != identity {
+		return fmt.Errorf("%v already reserved by %v", ip, other)
+	}
+	res := i.copyReservations()
+	res[identity] = ip
+	return i.saveReservations(res)
+}
+
+// Unreserve removes the reservation of identity. The reserved IP stays allocated to its
+// client until released.
+func (i *IPPam) Unreserve(identity string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if _, ok := i.reservations[identity]; !ok {
+		return fmt.Errorf("no reservation for %v", identity)
+	}
+	res := i.copyReservations()
+	delete(res, identity)
+	return i.saveReservations(res)
+}
+
+// Reservations returns a copy of the reserved IP of each identity.
+func (i *IPPam) Reservations() map[string]string {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return i.copyReservations()
+}
+
+// AcquireIPFor acquires the IP reserved for the first of identities with a reservation and
+// marks the status as requested, like AcquireIP. A reserved IP held after its release is
+// given back at once. If none of identities has a free reserved IP a dynamic IP is
+// acquired instead.
+func (i *IPPam) AcquireIPFor(data any, identities ...string) (string, error) {
+	i.lock.Lock()
+	for _, id := range identities {
+		ip, ok := i.reservations[id]
+		if !ok {
+			continue
+		}
+		if v, exist := i.allocations[ip]; exist && v.ipStatus != StatusHeld {
+			continue // In use by another session of the identity.
+		}
+		i.allocations[ip] = &ipData{
+			ipStatus: StatusRequested,
+			data:     data,
+		}
+		i.lock.Unlock()
+		i.checkExpansion()
+		i.checkUtilization()
+		return ip, nil
+	}
+	i.lock.Unlock()
+	return i.AcquireIP(data)
+}
+
+// checkReservation returns an error if ip cannot be reserved.
+func (i *IPPam) checkReservation(ip string) error {
+	addr := net.ParseIP(ip)
+	if addr == nil || addr.To4() == nil || addr.String() != ip || !i.ipnet.Contains(addr) ||
+		addr.Equal(i.net) || addr.Equal(i.bcast) {
+		return fmt.Errorf("invalid reserved IP %q of %v", ip, i.prefix)
+	}
+	return nil
+}
+
+// copyReservations returns a copy of the reservations. The lock must be held.
+func (i *IPPam) copyReservations() map[string]string {
+	res := make(map[string]string, len(i.reservations))
+	for id, ip := range i.reservations {
+		res[id] = ip
+	}
+	return res
+}
+
+// saveReservations writes res to the reservations file, if any, and makes it the current
+// reservations. The lock must be held.
+func (i *IPPam) saveReservations(res map[string]string) error {
+	if i.reservationsFile != "" {
+		data, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error encoding reservations %w", err)
+		}
+		// Write and rename so a crash never leaves a partial file.
+		tmp := i.reservationsFile + ".tmp"
+		if err := os.WriteFile(tmp, data, 0600); err != nil {
+			return fmt.Errorf("error saving reservations %w", err)
+		}
+		if err := os.Rename(tmp, i.reservationsFile); err != nil {
+			return fmt.Errorf("error saving reservations %w", err)
+		}
+	}
+	i.reservations = res
+	i.reserved = make(map[string]string, len(res))
+	for id, ip := range res {
+		i.reserved[ip] = id
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package ipam
+
+import (
+	"fmt"
+	"sort"
+)
+
+// addTags returns the sorted union of tags and add.
+func addTags(tags []string, add ...string) []string {
+	set := map[string]bool{}
+	for _, t := range append(append([]string(nil), tags...), add...) {
+		if t != "" {
+			set[t] = true
+		}
+	}
+	out := make([]string, 0, len(set))
+	for t := range set {
+		out = append(out, t)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// removeTags returns tags without remove.
+func removeTags(tags []string, remove ...string) []string {
+	drop := map[string]bool{}
+	for _, t := range remove {
+		drop[t] = true
+	}
+	var out []string
+	for _, t := range tags {
+		if !drop[t] {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// UpdateTags adds and removes admin tags of the in use IP.
+func (i *IPPam) UpdateTags(ip string, add, remove []string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	v, exists := i.allocations[ip]
+	if !exists || v.userinfo == nil {
+		return fmt.Errorf("%w or not marked in use", ErrIPNotAllocated)
+	}
+	v.userinfo.Tags = removeTags(addTags(v.userinfo.Tags, add...), remove...)
+	return nil
+}
+
+// SetNote sets the admin note of the in use IP.
+func (i *IPPam) SetNote(ip, note string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	v, exists := i.allocations[ip]
+	if !exists || v.userinfo == nil {
+		return fmt.Errorf("%w or not marked in use", ErrIPNotAllocated)
+	}
+	v.userinfo.Note = note
+	return nil
+}
+
+// UpdateUserTags adds and removes admin tags of username. The change applies to the
+// current and future sessions of the user.
+func (i *IPPam) UpdateUserTags(username string, add, remove []string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	tags := removeTags(addTags(i.userTags[username], add...), remove...)
+	if len(tags) == 0 {
+		delete(i.userTags, username)
+	} else {
+		i.userTags[username] = tags
+	}
+	for _, v := range i.allocations {
+		if v.userinfo != nil && v.userinfo.Username == username {
+			v.userinfo.Tags = removeTags(addTags(v.userinfo.Tags, add...), remove...)
+		}
+	}
+}
+
+// GetUserTags returns the admin tags of username.
+func (i *IPPam) GetUserTags(username string) []string {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return append([]string(nil), i.userTags[username]...)
+}
@@ -0,0 +1,184 @@
+package webtunnelclient
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Default time to wait for the SSO login to complete in the browser.
+const defaultSSOTimeout = 5 * time.Minute
+
+// SetCredentials sets the username and password sent with HTTP basic auth in the
+// websocket handshake, for servers that authenticate clients (eg. against RADIUS).
+// Only use it with secure websockets. This should be called prior to Start.
+func (w *WebtunnelClient) SetCredentials(username, password string) {
+	w.authUser = username
+	w.authPass = password
+}
+
+// TokenProvider returns the bearer token sent in the websocket handshake, eg. from a
+// token file or a credentials helper. It is called on each connection attempt so tokens
+// can be refreshed before they expire.
+type TokenProvider interface {
+	Token() (string, error)
+}
+
+// TokenProviderFunc adapts a function to a TokenProvider.
+type TokenProviderFunc func() (string, error)
+
+// Token calls f().
+func (f TokenProviderFunc) Token() (string, error) {
+	return f()
+}
+
+// FileTokenProvider returns a TokenProvider reading the token from path, so an external
+// agent can rotate it.
+func FileTokenProvider(path string) TokenProvider {
+	return TokenProviderFunc(func() (string, error) {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		token := strings.TrimSpace(string(b))
+		if token == "" {
+			return "", fmt.Errorf("empty token file %v", path)
+		}
+		return token, nil
+	})
+}
+
+// SetTokenProvider sets the provider of the bearer token sent in the websocket
+// handshake, for servers that authenticate clients with tokens. It takes precedence over
+// SetCredentials. Only use it with secure websockets. This should be called prior to
+// Start.
+func (w *WebtunnelClient) SetTokenProvider(p TokenProvider) {
+	w.tokens = p
+}
+
+/*
+SetSSOLogin enables browser based single sign-on. Connecting opens loginURL, the login
+page of the identity provider, in the browser with redirect_uri and state query
+parameters. After login the browser must be redirected to redirect_uri, a callback on a
+localhost port, with the state and the resulting token in the "token" parameter or a
+SAML POST binding (SAMLResponse and RelayState form fields).
+
+The token is sent to the server as a bearer token in the websocket handshake and reused
+on reconnects until the server refuses it. timeout is the time to wait for the login,
+0 for the default. This should be called prior to Start.
+*/
+func (w *WebtunnelClient) SetSSOLogin(loginURL string, timeout time.Duration) error {
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return fmt.Errorf("invalid SSO login URL: %w", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return fmt.Errorf("invalid SSO login URL scheme %q", u.Scheme)
+	}
+	if timeout <= 0 {
+		timeout = defaultSSOTimeout
+	}
+	w.ssoURL = u
+	w.ssoTimeout = timeout
+	return nil
+}
+
+// setAuthHeader adds the configured credentials to the handshake header, logging in
+// with SSO first if there is no token.
+func (w *WebtunnelClient) setAuthHeader(header http.Header) error {
+	if w.ssoURL != nil {
+		if w.ssoToken == "" {
+			token, err := w.ssoLogin()
+			if err != nil {
+				return err
+			}
+			w.ssoToken = token
+		}
+		header.Set("Authorization", "Bearer "+w.ssoToken)
+		return nil
+	}
+	if w.tokens != nil {
+		token, err := w.tokens.Token()
+		if err != nil {
+			return fmt.Errorf("error getting token %w", err)
+		}
+		header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+	if w.authUser == "" {
+		return nil
+	}
+	cred := base64.StdEncoding.EncodeToString([]byte(w.authUser + ":" + w.authPass))
+	header.Set("Authorization", "Basic "+cred)
+	return nil
+}
+
+// ssoLogin opens the login page in the browser and returns the token received on the
+// localhost callback.
+func (w *WebtunnelClient) ssoLogin() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("error listening for SSO callback %w", err)
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	state := hex.EncodeToString(b)
+
+	tokens := make(chan string, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/callback", func(rw http.ResponseWriter, req *http.Request) {
+		// Query parameters or the form of a POST binding.
+		if err := req.ParseForm(); err != nil {
+			http.Error(rw, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if req.Form.Get("state") != state && req.Form.Get("RelayState") != state {
+			http.Error(rw, "Invalid state", http.StatusBadRequest)
+			return
+		}
+		token := req.Form.Get("token")
+		if token == "" {
+			token = req.Form.Get("SAMLResponse")
+		}
+		if token == "" {
+			http.Error(rw, "Missing token", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(rw, "Login complete, you can close this window.")
+		select {
+		case tokens <- token:
+		default:
+		}
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	u := *w.ssoURL
+	q := u.Query()
+	q.Set("redirect_uri", fmt.Sprintf("http://%v/callback", l.Addr()))
+	q.Set("state", state)
+	u.RawQuery = q.Encode()
+	glog.Infof("Log in at %v", u.String())
+	if err := OpenBrowser(u.String()); err != nil {
+		glog.Warningf("unable to open browser, open the login page manually: %v", err)
+	}
+
+	select {
+	case token := <-tokens:
+		return token, nil
+	case <-time.After(w.ssoTimeout):
+		return "", fmt.Errorf("SSO login not completed after %v", w.ssoTimeout)
+	}
+}
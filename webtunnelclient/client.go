@@ -5,16 +5,24 @@ See examples for client implementation.
 package webtunnelclient
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/user"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/deepakkamesh/webtunnel/webtunnelcommon/metrics"
+	"github.com/deepakkamesh/webtunnel/webtunnelcommon/version"
 	"github.com/golang/glog"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -31,6 +39,36 @@ var IsConfigured = wc.IsConfigured
 // GetMacbyName (Overridable) Get HW address.
 var GetMacbyName = wc.GetMacbyName
 
+// WaitInterfaceReady (Overridable) Block until the network interface is configured or timeout.
+var WaitInterfaceReady = waitInterfaceReady
+
+// NewWintunInterface (Overridable) Return new Wintun interface (Windows only).
+var NewWintunInterface = newWintunInterface
+
+// FlushDNSCache (Overridable) Flush the OS resolver cache after tunnel DNS changes.
+var FlushDNSCache = flushDNSCache
+
+// RenewDHCP (Overridable) Make the OS renew the DHCP lease of a TAP interface.
+var RenewDHCP = renewDHCP
+
+// SetInterfaceMTU (Overridable) Set the MTU of the network interface.
+var SetInterfaceMTU = setInterfaceMTU
+
+// AddNRPTRule (Overridable) Resolve names under a DNS suffix with the tunnel DNS servers (Windows only).
+var AddNRPTRule = addNRPTRule
+
+// RemoveNRPTRules (Overridable) Remove the split DNS rules added by the client.
+var RemoveNRPTRules = removeNRPTRules
+
+// RegisterDNSName (Overridable) Register the hostname in the tunnel DNS (Windows only).
+var RegisterDNSName = registerDNSName
+
+// OpenBrowser (Overridable) Open a URL in the default browser for SSO login.
+var OpenBrowser = openBrowser
+
+// Default time to wait for the network interface to be configured.
+const defaultIfReadyTimeout = 120 * time.Second
+
 // Default packet options
 var defaultPktOpts = gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
 
@@ -40,37 +78,107 @@ type Interface struct {
 	GWIP         net.IP           // Gateway IP.
 	Netmask      net.IP           // Netmask of the interface.
 	DNS          []net.IP         // IP of DNS servers.
+	DNSRoutes    []DNSRoute       // Domains resolved with other DNS servers than DNS.
 	RoutePrefix  []*net.IPNet     // Route prefix to send via tunnel.
 	LocalHWAddr  net.HardwareAddr // MAC address of network interface.
 	GWHWAddr     net.HardwareAddr // fake MAC address of gateway.
 	LeaseTime    uint32           // DHCP lease time.
+	MTU          int              // MTU discovered by probing, 0 if not probed.
 	wc.Interface                  // Interface to network.
 }
 
 // WebtunnelClient represents the client struct.
 type WebtunnelClient struct {
-	Error          chan error                    // Channel to handle errors from goroutines.
-	isWSReady      bool                          // true when Websocket is ready - used when reconnecting
-	isNetReady     bool                          // true when network interface is ready.
-	isStopped      bool                          // True when Stop() called.
-	wsconn         *websocket.Conn               // Websocket connection.
-	ifce           *Interface                    // Struct to hold interface configuration.
-	userInitFunc   func(*Interface) error        // User supplied callback for OS initialization.
-	wsWriteLock    sync.Mutex                    // Lock for Websocket Writes.
-	wsReadLock     sync.Mutex                    // Lock for Websocket Reads.
-	metricsLock    sync.Mutex                    // Lock for Metrics Writes.
-	ifReadLock     sync.Mutex                    // Lock for Interface Reads.
-	ifWriteLock    sync.Mutex                    // Lock for Interface Writes.
-	packetCnt      int                           // Count of packets.
-	bytesCnt       int                           // Count of bytes.
-	serverIPPort   string                        // Websocket serverIP:Port.
-	wsDialer       *websocket.Dialer             // websocket dialer with options.
-	devType        water.DeviceType              // TUN/TAP.
-	scheme         string                        // Websocket Scheme.
-	leaseTime      uint32                        // DHCP lease time.
-	session        string                        // Session Tracker from Server
-	useTap          bool                          // Is the webclient using a TAP interface - default is to use TUN type on creation some platforms may not support TUN and must have this flag set to true
-	customTapParam *water.PlatformSpecificParams // Tap driver specific parameters
+	Error            chan error                    // Channel to handle errors from goroutines.
+	isWSReady        atomic.Bool                   // true when Websocket is ready - used when reconnecting
+	isNetReady       atomic.Bool                   // true when network interface is ready.
+	isStopped        atomic.Bool                   // True when Stop() called.
+	wsconn           *websocket.Conn               // Websocket connection.
+	ifce             *Interface                    // Struct to hold interface configuration.
+	userInitFunc     func(*Interface) error        // User supplied callback for OS initialization.
+	wsWriter         *wc.WSWriter                  // Prioritized Websocket writer.
+	wsReadLock       sync.Mutex                    // Lock for Websocket Reads.
+	metricsLock      sync.Mutex                    // Lock for Metrics.
+	ifReadLock       sync.Mutex                    // Lock for Interface Reads.
+	ifWriteLock      sync.Mutex                    // Lock for Interface Writes.
+	statusLock       sync.Mutex                    // Lock for the connection and interface fields read by the status endpoint.
+	statusServer     *http.Server                  // Status endpoint, nil if not served.
+	statusToken      string                        // Bearer token of the status endpoint actions.
+	packetCnt        int                           // Count of packets.
+	bytesCnt         int                           // Count of bytes.
+	serverIPPort     string                        // Websocket serverIP:Port.
+	wsDialer         *websocket.Dialer             // websocket dialer with options.
+	devType          water.DeviceType              // TUN/TAP.
+	scheme           string                        // Websocket Scheme.
+	leaseTime        uint32                        // DHCP lease time.
+	session          string                        // Session Tracker from Server
+	useTap           bool                          // Is the webclient using a TAP interface - default is to use TUN type on creation some platforms may not support TUN and must have this flag set to true
+	customTapParam   *water.PlatformSpecificParams // Tap driver specific parameters
+	ifReadyTimeout   time.Duration                 // Time to wait for the network interface to be configured.
+	devFallback      bool                          // Try the other device type if interface creation fails.
+	wintunName       string                        // Wintun adapter name, empty if Wintun is not used.
+	isWintun         bool                          // True when the interface in use is Wintun.
+	configUpdateFunc func(*Interface) error        // User callback for config updates pushed by server.
+	postureCollector PostureCollector              // Device posture collector, nil if disabled.
+	isPaused         atomic.Bool                   // True when data forwarding is paused.
+	pauseFunc        func(*Interface) error        // User callback run on Pause.
+	resumeFunc       func(*Interface) error        // User callback run on Resume.
+	obfs             *wc.ObfuscationPolicy         // Data frame obfuscation, nil if disabled.
+	affinity         string                        // Gateway instance holding the session.
+	tracer           wc.Tracer                     // Tracer for handshake operations.
+	copyDSCP         bool                          // Copy inner DSCP to the websocket connection.
+	lastErrors       errorLog                      // Recent errors for the status endpoint.
+	resumeIP         net.IP                        // IP of an imported session to resume, nil if none.
+	codecs           []string                      // Control message codecs offered in preference order.
+	baseline         *osState                      // OS routes and DNS before the tunnel was configured.
+	applied          *TunnelConfig                 // OS state added for the tunnel.
+	teardown         *TeardownReport               // Result of the teardown check in the last Stop.
+	stateFile        string                        // Path persisting applied OS changes, empty if disabled.
+	loss             wc.SeqTracker                 // Loss stats of data frames from the server.
+	seqDedup         bool                          // Server continues sequences across reconnects.
+	quality          qualityAlert                  // Network quality alert, disabled if no callback.
+	mtuMin           int                           // Smallest MTU probed, assumed to work.
+	mtuMax           int                           // Largest MTU probed, 0 disables probing.
+	mtuProbeOK       bool                          // Server acknowledges MTU probes.
+	mtuAcks          chan int                      // Acknowledged probe sizes.
+	keepaliveOK      bool                          // Server accepts a keepalive interval.
+	keepalive        adaptiveKeepalive             // Adaptive keepalive, disabled if min is 0.
+	dhcpRenew        bool                          // Answer DHCP until the OS leases the new IP of a moved session.
+	power            powerSaving                   // Inactivity power saving, disabled if idleAfter is 0.
+	minServerVersion string                        // Oldest server version accepted, empty for any.
+	serverVersion    string                        // Version reported by the server.
+	sessionID        string                        // ID the server logs the session under.
+	configTimeout    time.Duration                 // Time the server has to send the config, 0 to wait forever.
+	configRetries    int                           // Config requests repeated on a new connection after a timeout.
+	oobConfig        bool                          // Fetch the config over HTTPS before connecting.
+	leased           *wc.ClientConfig              // Config fetched out-of-band and not yet claimed, nil if none.
+	chunks           wc.ChunkAssembler             // Reassembles chunked control messages.
+	dnsSuffixes      []string                      // Split DNS suffixes resolved via the tunnel.
+	dnsRoutesSet     bool                          // DNS routes from the server config were added to the OS.
+	registerDNS      bool                          // Register the hostname in the tunnel DNS.
+	external         wc.Interface                  // Interface supplied by the host application, nil if none.
+	exceptions       []Route                       // Host routes to the server outside the tunnel.
+	strategies       []Strategy                    // Fallbacks tried if connecting directly fails.
+	strategy         string                        // Strategy of the current connection.
+	authUser         string                        // Username for handshake authentication, empty if disabled.
+	authPass         string                        // Password for handshake authentication.
+	tokens           TokenProvider                 // Bearer token for handshake authentication, nil if disabled.
+	ssoURL           *url.URL                      // Identity provider login page, nil if SSO is disabled.
+	ssoTimeout       time.Duration                 // Time to wait for the SSO login in the browser.
+	ssoToken         string                        // Token from the last SSO login, empty if none.
+	eyeballs         bool                          // Race the server addresses when dialing.
+	addrPref         AddressPreference             // Address family tried first.
+	attemptDelay     time.Duration                 // Delay before racing the next address.
+	endpoints        []*Endpoint                   // Local endpoints sharing the session.
+	epLock           sync.Mutex                    // Lock for endpoints.
+	monitor          routeMonitor                  // Route monitor, disabled if the interval is 0.
+	site             *siteGateway                  // Site-to-site state, nil if disabled.
+	p2p              *peerToPeer                   // Direct paths to other clients, nil if disabled.
+	tcpOpts          *wc.TCPOptions                // Options of the websocket TCP connection, nil for OS defaults.
+	prom             *metrics.Tunnel               // Collectors served on /metrics of the status endpoint.
+	connectedAt      time.Time                     // Time the websocket connected, for the handshake latency.
+	peer             deadPeer                      // Dead peer detection, disabled if the interval is 0.
+	ctl              controlChannel                // Control messages of the connection.
 }
 
 /*
@@ -104,17 +212,20 @@ func NewWebtunnelClient(serverIPPort string, wsDialer *websocket.Dialer,
 	glog.V(2).Infof("DeviceType: %v", devType)
 
 	return &WebtunnelClient{
-		Error:        make(chan error),
-		isNetReady:   false,
-		isStopped:    false,
-		isWSReady:    false,
-		serverIPPort: serverIPPort,
-		wsDialer:     wsDialer,
-		devType:      devType,
-		scheme:       scheme,
-		leaseTime:    leaseTime,
-		userInitFunc: f,
-		useTap:        useTap,
+		Error:          make(chan error),
+		mtuAcks:        make(chan int, 1),
+		serverIPPort:   serverIPPort,
+		wsDialer:       wsDialer,
+		devType:        devType,
+		scheme:         scheme,
+		leaseTime:      leaseTime,
+		userInitFunc:   f,
+		useTap:         useTap,
+		ifReadyTimeout: defaultIfReadyTimeout,
+		configTimeout:  defaultConfigTimeout,
+		configRetries:  defaultConfigRetries,
+		tracer:         wc.NopTracer{},
+		prom:           metrics.NewTunnel(promNamespace),
 	}, nil
 }
 
@@ -124,6 +235,254 @@ func (w *WebtunnelClient) SetTapInterface(customTapParam *water.PlatformSpecific
 	w.customTapParam = customTapParam
 }
 
+// SetDeviceFallback enables falling back to the other device type (TUN <-> TAP) when the
+// network interface cannot be created with the requested type, eg. a missing driver.
+func (w *WebtunnelClient) SetDeviceFallback(enable bool) {
+	w.devFallback = enable
+}
+
+// SetWintun selects the Wintun driver (Windows only) with adapter name instead of the
+// TAP driver. Wintun is a layer 3 device so no DHCP/ARP emulation is done and the
+// user init function must configure IP and routes. An empty name disables Wintun.
+func (w *WebtunnelClient) SetWintun(name string) {
+	w.wintunName = name
+}
+
+// ActiveDeviceType returns the device type ("TUN", "TAP" or "WINTUN") in use by the
+// client. After Start this reflects any fallback that occurred.
+func (w *WebtunnelClient) ActiveDeviceType() string {
+	if w.isWintun {
+		return "WINTUN"
+	}
+	return deviceTypeName(w.devType)
+}
+
+// SetConfigUpdateFunc sets the callback run when the server pushes a config update
+// in-band (eg. full routes after leaving quarantine) so the OS routes can be updated.
+func (w *WebtunnelClient) SetConfigUpdateFunc(f func(*Interface) error) {
+	w.configUpdateFunc = f
+}
+
+// SetObfuscation sets the padding and timing obfuscation policy for data frames sent
+// to the server. The websocket buffers grow to hold padded frames whole. This should be
+// called prior to Start.
+func (w *WebtunnelClient) SetObfuscation(p *wc.ObfuscationPolicy) error {
+	if _, err := wc.FrameBufferSize(wc.MaxPacketSize, p); err != nil {
+		return fmt.Errorf("invalid obfuscation policy %w", err)
+	}
+	w.obfs = p
+	return nil
+}
+
+// SetCopyDSCP enables copying the DSCP of tunneled packets to the websocket TCP
+// connection for QoS-aware networks. This should be called prior to Start.
+func (w *WebtunnelClient) SetCopyDSCP(enable bool) {
+	w.copyDSCP = enable
+}
+
+// SetTCPOptions sets the keepalive timers and congestion control of the websocket TCP
+// connection. This should be called prior to Start.
+func (w *WebtunnelClient) SetTCPOptions(o wc.TCPOptions) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	w.tcpOpts = &o
+	return nil
+}
+
+// SetAntiReplay drops data frames from the server that may be replays, mirroring the
+// IPsec anti-replay window (see wc.SeqTracker.SetAntiReplay). Drops are counted in the
+// Replays field of the loss stats. This should be called prior to Start.
+func (w *WebtunnelClient) SetAntiReplay(enable bool) {
+	w.loss.SetAntiReplay(enable)
+}
+
+// SetTracer sets the tracer for the connect, config and reconnect operations. The
+// trace ID is propagated to the server in the handshake headers.
+func (w *WebtunnelClient) SetTracer(t wc.Tracer) {
+	w.tracer = t
+}
+
+// SetCodecs sets the control message codecs offered to the server by subprotocol name
+// (see webtunnelcommon.RegisterCodec) in preference order. JSON is used if the server
+// supports none of them. This should be called prior to Start.
+func (w *WebtunnelClient) SetCodecs(names ...string) {
+	w.codecs = names
+}
+
+// dial connects to the websocket server offering the configured codecs, sequence
+// numbered data frames and chunked control messages. It returns the handshake response
+// headers.
+func (w *WebtunnelClient) dial(url string, header http.Header) (*websocket.Conn, http.Header, error) {
+	d := *w.wsDialer
+	d.Subprotocols = w.codecs
+	if err := w.sizeBuffers(&d); err != nil {
+		return nil, nil, err
+	}
+	if w.eyeballs {
+		d.NetDialContext = w.eyeballsDialer(d.NetDialContext)
+	}
+	if w.tcpOpts != nil {
+		d.NetDialContext = tcpOptionsDialer(d.NetDialContext, *w.tcpOpts)
+	}
+	header.Set(wc.SeqHeader, "1")
+	header.Set(wc.SeqDedupHeader, "1")
+	header.Set(wc.ChunkHeader, "1")
+	header.Set(wc.ControlHeader, strconv.Itoa(wc.ControlVersion))
+	header.Set(version.Header, version.Version)
+	if err := w.setAuthHeader(header); err != nil {
+		return nil, nil, err
+	}
+	conn, resp, err := w.dialFallback(d, url, header)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			// Log in again on the next attempt.
+			w.ssoToken = ""
+			return nil, nil, fmt.Errorf("authentication refused by server: %w", err)
+		}
+		if resp != nil && resp.StatusCode == http.StatusUpgradeRequired {
+			return nil, nil, versionError(resp, err)
+		}
+		return nil, nil, err
+	}
+	if err := w.checkServerVersion(resp.Header); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, resp.Header, nil
+}
+
+// sizeBuffers grows the buffers of d to hold whole the largest data frame, or MTU probe
+// if larger, so it is not fragmented into continuation frames.
+func (w *WebtunnelClient) sizeBuffers(d *websocket.Dialer) error {
+	size, err := wc.FrameBufferSize(wc.MaxPacketSize, w.obfs)
+	if err != nil {
+		return err
+	}
+	if w.mtuMax > size {
+		size = w.mtuMax
+	}
+	if d.WriteBufferSize < size {
+		d.WriteBufferSize = size
+	}
+	if d.ReadBufferSize == 0 {
+		d.ReadBufferSize = size
+	}
+	return nil
+}
+
+// tcpOptionsDialer returns a dial function applying o to the connections of dial.
+func tcpOptionsDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error), o wc.TCPOptions) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := o.Apply(conn); err != nil {
+			glog.Warningf("error setting TCP options for %v: %v", addr, err)
+		}
+		return conn, nil
+	}
+}
+
+// setConn sets up the writer for a new websocket connection with the features the server
+// accepted in the handshake response headers.
+func (w *WebtunnelClient) setConn(conn *websocket.Conn, header http.Header) {
+	prev := w.wsWriter
+	w.statusLock.Lock()
+	w.wsconn = conn
+	w.statusLock.Unlock()
+	w.connectedAt = time.Now()
+	w.wsconn.SetReadLimit(wc.MaxMessageSize)
+	w.wsWriter = wc.NewWSWriter(conn, w.obfs)
+	if err := w.wsWriter.SetDSCPCopy(w.copyDSCP); err != nil {
+		glog.Warningf("unable to copy DSCP: %v", err)
+	}
+	w.wsWriter.SetSequencing(header.Get(wc.SeqHeader) == "1")
+	// The server drops frames of the previous connection sent again on this one.
+	w.seqDedup = header.Get(wc.SeqDedupHeader) == "1"
+	if w.seqDedup && prev != nil {
+		w.wsWriter.SetSequence(prev.Sequence())
+	}
+	w.mtuProbeOK = header.Get(wc.MTUProbeHeader) == "1"
+	w.keepaliveOK = header.Get(wc.KeepaliveHeader) == "1"
+	w.resetControl(header.Get(wc.ControlHeader))
+	if id := header.Get(wc.SessionIDHeader); id != "" {
+		w.sessionID = id
+		glog.Infof("connected to server, session %v", id)
+	}
+	w.wsconn.SetPingHandler(w.PingHandler(w.wsconn))
+	w.wsconn.SetPongHandler(w.pongHandler)
+	w.resetDeadPeer()
+	if !w.seqDedup {
+		w.loss.NewStream()
+	}
+	w.isWSReady.Store(true)
+}
+
+// setSessionID records the session ID from the server config, which differs from the
+// handshake one when the connection resumed an existing session.
+func (w *WebtunnelClient) setSessionID(id string) {
+	if id == "" || id == w.sessionID {
+		return
+	}
+	w.sessionID = id
+	glog.Infof("server session %v", id)
+}
+
+// continueStream keeps the receive window of the previous connection if the server
+// continued its sequence numbers, so frames it sends again are dropped as duplicates.
+func (w *WebtunnelClient) continueStream(cfg *wc.ClientConfig) {
+	if !w.seqDedup {
+		return
+	}
+	if cfg.ServerInfo != nil && cfg.ServerInfo.SeqContinued {
+		glog.V(1).Info("server continued the data frame sequence")
+		return
+	}
+	w.loss.NewStream()
+}
+
+// codec returns the control message codec negotiated with the server.
+func (w *WebtunnelClient) codec() wc.Codec {
+	if w.wsWriter == nil {
+		return wc.JSONCodec{}
+	}
+	return w.wsWriter.Codec()
+}
+
+// readConfig reads a config message encoded with the negotiated codec into cfg,
+// reassembling it if chunked.
+func (w *WebtunnelClient) readConfig(cfg *wc.ClientConfig) error {
+	w.wsReadLock.Lock()
+	defer w.wsReadLock.Unlock()
+	for {
+		_, b, err := w.wsconn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if !wc.IsChunk(b) {
+			return w.decodeConfig(b, cfg)
+		}
+		msg, err := w.chunks.Add(b)
+		if err != nil {
+			return err
+		}
+		if msg != nil {
+			return w.decodeConfig(msg, cfg)
+		}
+	}
+}
+
+// SetInterfaceReadyTimeout sets the maximum time to wait for the network interface
+// to be configured (by DHCP for TAP or the user init function for TUN) after Start.
+func (w *WebtunnelClient) SetInterfaceReadyTimeout(d time.Duration) {
+	w.ifReadyTimeout = d
+}
+
 // PingHandler will return the function to handle the Ping sent from the server.
 // It sends the time diff seen between the client and server.
 func (w *WebtunnelClient) PingHandler(wsConn *websocket.Conn) func(appStr string) error {
@@ -131,6 +490,7 @@ func (w *WebtunnelClient) PingHandler(wsConn *websocket.Conn) func(appStr string
 		bt := []byte(aStr)
 		val, _ := binary.Varint(bt)
 		glog.V(1).Infof("ping received from server, time value: %v", val)
+		w.keepalivePinged()
 		buf := make([]byte, binary.MaxVarintLen64)
 		tV := time.Now().UTC().UnixNano()
 		binary.PutVarint(buf, tV-val) // we will send the servertime - our time
@@ -143,56 +503,163 @@ func (w *WebtunnelClient) PingHandler(wsConn *websocket.Conn) func(appStr string
 
 // Start the client.
 func (w *WebtunnelClient) Start() error {
+	// New trace for the handshake, propagated to the server.
+	ctx := wc.ContextWithTraceID(context.Background(), wc.NewTraceID())
 
-	// Connect to websocket connection.
-	u := url.URL{Scheme: w.scheme, Host: w.serverIPPort, Path: "/ws"}
-	wsconn, _, err := w.wsDialer.Dial(u.String(), nil)
+	// Clean up after a previous run that did not stop cleanly.
+	w.repairStaleState()
+
+	// Claim the IP of a config fetched out-of-band.
+	lease, err := w.configLease()
 	if err != nil {
 		return err
 	}
-	w.wsconn = wsconn
-	w.isWSReady = true
 
-	// Set alternate tap parameter if provided
-	wtConfig := water.Config{
-		DeviceType: w.devType,
+	// Connect to websocket connection.
+	u := url.URL{Scheme: w.scheme, Host: w.serverIPPort, Path: "/ws"}
+	header := http.Header{}
+	header.Set(wc.TraceHeader, wc.FormatTraceParent(wc.TraceID(ctx)))
+	if lease != nil {
+		header.Set(wc.LeaseHeader, lease.ServerInfo.Session)
 	}
-	if w.useTap && (w.customTapParam != nil) {
-		glog.V(2).Infof("Overriding custom Tap Param with %v", *w.customTapParam)
-		wtConfig.PlatformSpecificParams = *w.customTapParam
+	w.setAffinity(&u, header)
+	_, span := w.tracer.Start(ctx, "connect")
+	span.SetAttribute("server", w.serverIPPort)
+	wsconn, respHeader, err := w.dial(u.String(), header)
+	span.End(err)
+	if err != nil {
+		return err
 	}
+	w.setConn(wsconn, respHeader)
 
 	// Start network interface.
-	glog.V(2).Info("Initialize TAP network interface")
-	handle, err := NewWaterInterface(wtConfig)
+	_, span = w.tracer.Start(ctx, "interface")
+	handle, err := w.newInterface()
+	span.End(err)
 	if err != nil {
-		return fmt.Errorf("error creating int %s", err)
+		return err
 	}
-	w.ifce = &Interface{
+	ifce := &Interface{
 		Interface: handle,
 		LeaseTime: w.leaseTime,
 	}
+	w.statusLock.Lock()
+	w.ifce = ifce
+	w.statusLock.Unlock()
 
 	// Configure network interface.
 	glog.V(2).Info("Configure network interface")
-	err = w.configureInterface()
+	_, span = w.tracer.Start(ctx, "config")
+	err = w.configureInterface(func() error {
+		// The lease was claimed by the timed out connection and released with it.
+		header.Del(wc.LeaseHeader)
+		return w.connect(u.String(), header)
+	})
+	span.End(err)
 	if err != nil {
 		return err
 	}
 
 	// isStopped is set true in Stop(). Used to gracefully exit packet processors.
-	w.isStopped = false
-
-	// Set Ping Handler
-	w.wsconn.SetPingHandler(w.PingHandler(w.wsconn))
+	w.isStopped.Store(false)
 
 	// Start packet processors.
 	go w.processNetPacket()
 	go w.processWSPacket()
 
+	// Discover the MTU in the background; the read loop delivers acknowledgements.
+	go w.discoverMTU()
+
+	// Reinstall tunnel routes removed by other software.
+	go w.processRouteMonitor()
+
+	// Detect a dead server in site-to-site mode.
+	go w.processSiteKeepalive()
+
+	// Detect NAT bindings dropped by the adaptive keepalive.
+	go w.processKeepalive()
+
+	// Detect a dead server or half-open connection.
+	go w.processDeadPeer()
+
+	// Go idle when no traffic flows.
+	go w.processPowerSaving()
+
+	// Punch and keep alive direct paths to other clients.
+	go w.processPeerToPeer()
+
 	return nil
 }
 
+// waterConfig returns the interface config for devType with any custom TAP parameter.
+func (w *WebtunnelClient) waterConfig(devType water.DeviceType) water.Config {
+	wtConfig := water.Config{
+		DeviceType: devType,
+	}
+	if devType == water.TAP && (w.customTapParam != nil) {
+		glog.V(2).Infof("Overriding custom Tap Param with %v", *w.customTapParam)
+		wtConfig.PlatformSpecificParams = *w.customTapParam
+	}
+	return wtConfig
+}
+
+// newInterface creates the network interface of the configured device type. If fallback
+// is enabled and creation fails, the other device type is tried before giving up.
+func (w *WebtunnelClient) newInterface() (wc.Interface, error) {
+	if w.external != nil {
+		w.devType = water.TUN
+		w.useTap = false
+		glog.Infof("Using external network interface %v", w.external.Name())
+		return w.external, nil
+	}
+	if w.wintunName != "" {
+		handle, err := NewWintunInterface(w.wintunName)
+		if err == nil {
+			w.isWintun = true
+			w.devType = water.TUN
+			w.useTap = false
+			glog.Infof("Using WINTUN network interface %v", w.wintunName)
+			return handle, nil
+		}
+		if !w.devFallback {
+			return nil, fmt.Errorf("error creating int %w", err)
+		}
+		glog.Warningf("error creating WINTUN int %s, falling back to %v", err, deviceTypeName(w.devType))
+	}
+
+	glog.V(2).Infof("Initialize %v network interface", deviceTypeName(w.devType))
+	handle, err := NewWaterInterface(w.waterConfig(w.devType))
+	if err == nil {
+		return handle, nil
+	}
+	if !w.devFallback {
+		return nil, fmt.Errorf("error creating int %w", err)
+	}
+
+	altType := water.DeviceType(water.TAP)
+	if w.devType == water.TAP {
+		altType = water.TUN
+	}
+	glog.Warningf("error creating %v int %s, falling back to %v",
+		deviceTypeName(w.devType), err, deviceTypeName(altType))
+	handle, altErr := NewWaterInterface(w.waterConfig(altType))
+	if altErr != nil {
+		return nil, fmt.Errorf("error creating int %w, fallback %v failed %s", err, deviceTypeName(altType), altErr)
+	}
+	w.devType = altType
+	w.useTap = altType == water.TAP
+	glog.Infof("Using %v network interface", deviceTypeName(w.devType))
+	return handle, nil
+}
+
+// deviceTypeName returns the printable name of the device type.
+func deviceTypeName(devType water.DeviceType) string {
+	if devType == water.TAP {
+		return "TAP"
+	}
+	return "TUN"
+}
+
 // SetServer changes the websocket connection end point.
 func (w *WebtunnelClient) SetServer(serverIPPort string, secure bool, wsDialer *websocket.Dialer) {
 	scheme := "ws"
@@ -221,76 +688,208 @@ func (w *WebtunnelClient) getUserInfo() (string, error) {
 }
 
 // configureInterface retrieves the client configuration from server and sends to Net daemon.
-func (w *WebtunnelClient) configureInterface() error {
+// reconnect replaces the connection if the config request times out.
+func (w *WebtunnelClient) configureInterface(reconnect func() error) error {
 	// Get configuration from server.
-	userinfo, err := w.getUserInfo()
+	var session string
+	if w.leased != nil {
+		session = w.leased.ServerInfo.Session
+	}
+	req, err := w.configRequest(session)
 	if err != nil {
 		return err
 	}
 
-	if err := w.wsconn.WriteMessage(websocket.TextMessage, []byte("getConfig"+" "+userinfo)); err != nil {
-		return err
+	// An imported session is taken over instead of requesting a new one.
+	if w.resumeIP != nil {
+		req = &wc.ConfigRequest{Session: w.session, Resume: true}
 	}
-	cfg := &wc.ClientConfig{}
-	if err := w.wsconn.ReadJSON(cfg); err != nil {
+	cfg, err := w.fetchConfig(req, reconnect)
+	if err != nil {
 		return err
 	}
+	if w.leased != nil && cfg.IP != w.leased.IP {
+		glog.Warningf("config lease of %v lost, server assigned %v", w.leased.IP, cfg.IP)
+	}
+	w.leased = nil
+	w.continueStream(cfg)
+	if w.resumeIP != nil && !net.IP.Equal(net.ParseIP(cfg.IP).To4(), w.resumeIP) {
+		return fmt.Errorf("resume mismatch on IP, client wants: %v but server gives: %v", w.resumeIP, cfg.IP)
+	}
+	w.resumeIP = nil
 	glog.V(1).Infof("Retrieved config from server %+v", *cfg)
 	glog.V(1).Infof("Retrieved config from server %+v", *cfg.ServerInfo)
 
-	var dnsIPs []net.IP
-	for _, v := range cfg.DNS {
-		dnsIPs = append(dnsIPs, net.ParseIP(v).To4())
+	dnsIPs, routes, err := parseDNSAndRoutes(cfg)
+	if err != nil {
+		return err
 	}
-	var routes []*net.IPNet
-	for _, v := range cfg.RoutePrefix {
-		_, n, err := net.ParseCIDR(v)
-		if err != nil {
-			return err
-		}
-		routes = append(routes, n)
+	dnsRoutes, err := parseDNSRoutes(cfg)
+	if err != nil {
+		return err
 	}
+	w.statusLock.Lock()
 	w.ifce.IP = net.ParseIP(cfg.IP).To4()
 	w.ifce.GWIP = net.ParseIP(cfg.GWIp).To4()
 	w.ifce.Netmask = net.ParseIP(cfg.Netmask).To4()
 	w.ifce.DNS = dnsIPs
+	w.ifce.DNSRoutes = dnsRoutes
 	w.ifce.RoutePrefix = routes
+	w.statusLock.Unlock()
 	w.ifce.GWHWAddr = wc.GenMACAddr()
 
 	w.session = cfg.ServerInfo.Session
+	w.affinity = cfg.ServerInfo.Instance
+	w.setSessionID(cfg.ServerInfo.SessionID)
+
+	if err := w.sendSiteAdvert(); err != nil {
+		return fmt.Errorf("error sending site prefixes %w", err)
+	}
+	if err := w.negotiateKeepalive(); err != nil {
+		return fmt.Errorf("error negotiating keepalive %w", err)
+	}
+	if err := w.registerP2P(); err != nil {
+		return fmt.Errorf("error registering for peer-to-peer %w", err)
+	}
 
 	// Call user supplied function for any OS initializations needed from cli.
 	// Depending on OS this might be bringing up OS or other network commands.
+	w.applied = nil
+	if w.external == nil {
+		w.baseline = snapshotOS(w.ifce.Name())
+	}
+	w.exceptions = nil
+	if err := w.preventRouteLoop(routes); err != nil {
+		return err
+	}
 	if err := w.userInitFunc(w.ifce); err != nil {
 		return err
 	}
+	w.recordApplied()
+	w.saveState()
+	w.applyDNSPolicy()
+	w.flushDNS()
 
 	return nil
 }
 
-// Retry the connection after a disconnection
-func (w *WebtunnelClient) Retry() error {
-	userinfo, err := w.getUserInfo()
+// flushDNS flushes the OS resolver cache so name resolution switches to the tunnel DNS
+// configuration immediately. Failures are not fatal.
+func (w *WebtunnelClient) flushDNS() {
+	if err := FlushDNSCache(); err != nil {
+		glog.Warningf("unable to flush DNS cache: %v", err)
+	}
+}
+
+// parseDNSAndRoutes returns the DNS IPs and route prefix from the server config.
+func parseDNSAndRoutes(cfg *wc.ClientConfig) ([]net.IP, []*net.IPNet, error) {
+	var dnsIPs []net.IP
+	for _, v := range cfg.DNS {
+		dnsIPs = append(dnsIPs, net.ParseIP(v).To4())
+	}
+	var routes []*net.IPNet
+	for _, v := range cfg.RoutePrefix {
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, nil, err
+		}
+		routes = append(routes, n)
+	}
+	return dnsIPs, routes, nil
+}
+
+// processConfigUpdate applies a config pushed in-band by the server (eg. on release from
+// quarantine). Only routes and DNS can change, unless the session is moved to a new IP;
+// the update callback is then invoked. TAP interfaces pick up the change on the next DHCP
+// renewal.
+func (w *WebtunnelClient) processConfigUpdate(msg []byte) error {
+	cfg := &wc.ClientConfig{}
+	if err := wc.DecodeControl(w.codec(), msg, cfg); err != nil {
+		return fmt.Errorf("error parsing config update %w", err)
+	}
+	if cfg.MovedFrom != "" {
+		return w.processReaddress(cfg)
+	}
+	if !net.IP.Equal(net.ParseIP(cfg.IP).To4(), w.ifce.IP) {
+		return fmt.Errorf("config update for wrong IP, want: %v got: %v", w.ifce.IP, cfg.IP)
+	}
+	dnsIPs, routes, err := parseDNSAndRoutes(cfg)
 	if err != nil {
 		return err
 	}
-	u := url.URL{Scheme: w.scheme, Host: w.serverIPPort, Path: "/ws"}
-	wsconn, _, err := w.wsDialer.Dial(u.String(), nil)
+	dnsRoutes, err := parseDNSRoutes(cfg)
 	if err != nil {
 		return err
 	}
-	w.wsconn = wsconn
-	w.isWSReady = true
+	glog.V(1).Infof("Retrieved config update from server %+v", *cfg)
+	if err := w.preventRouteLoop(routes); err != nil {
+		return err
+	}
+	w.statusLock.Lock()
+	w.ifce.DNS = dnsIPs
+	w.ifce.DNSRoutes = dnsRoutes
+	w.ifce.RoutePrefix = routes
+	w.statusLock.Unlock()
 
-	configString := "getConfig" + " " + userinfo + " " + w.session
-	if err := w.wsconn.WriteMessage(websocket.TextMessage, []byte(configString)); err != nil {
+	if w.configUpdateFunc != nil {
+		if err := w.configUpdateFunc(w.ifce); err != nil {
+			return err
+		}
+	}
+	w.recordApplied()
+	w.saveState()
+	w.applyDNSPolicy()
+	w.flushDNS()
+	return nil
+}
+
+// setAffinity adds the affinity token to the websocket request so load balancers route
+// it to the instance holding the session.
+func (w *WebtunnelClient) setAffinity(u *url.URL, header http.Header) {
+	if w.affinity == "" {
+		return
+	}
+	q := u.Query()
+	q.Set(wc.AffinityParam, w.affinity)
+	u.RawQuery = q.Encode()
+	header.Add("Cookie", (&http.Cookie{Name: wc.AffinityCookie, Value: w.affinity}).String())
+}
+
+// Retry the connection after a disconnection
+func (w *WebtunnelClient) Retry() (err error) {
+	ctx := wc.ContextWithTraceID(context.Background(), wc.NewTraceID())
+	_, span := w.tracer.Start(ctx, "reconnect")
+	span.SetAttribute("server", w.serverIPPort)
+	defer func() { span.End(err) }()
+
+	req, err := w.configRequest(w.session)
+	if err != nil {
 		return err
 	}
-	cfg := &wc.ClientConfig{}
-	if err := w.wsconn.ReadJSON(cfg); err != nil {
+	// Present the affinity token so load balancers route back to the same instance.
+	u := url.URL{Scheme: w.scheme, Host: w.serverIPPort, Path: "/ws"}
+	header := http.Header{}
+	header.Set(wc.TraceHeader, wc.FormatTraceParent(wc.TraceID(ctx)))
+	w.setAffinity(&u, header)
+	reconnect := func() error { return w.connect(u.String(), header) }
+	if err := reconnect(); err != nil {
 		return err
 	}
+
+	cfg, err := w.fetchConfig(req, reconnect)
+	if err != nil {
+		return err
+	}
+	w.continueStream(cfg)
+	w.setSessionID(cfg.ServerInfo.SessionID)
 	glog.V(1).Infof("retrieved config from server %v", *cfg)
+	// verify the load balancer routed us to the instance holding the session
+	if w.affinity != "" && cfg.ServerInfo.Instance != w.affinity {
+		return fmt.Errorf("reconnect landed on wrong instance, client wants: %v but got: %v",
+			w.affinity,
+			cfg.ServerInfo.Instance,
+		)
+	}
 	// verify session config from server matches current config
 	if cfg.ServerInfo.Session != w.session {
 		return fmt.Errorf("reconnect mismatch on session, client wants: %v but server gives: %v",
@@ -304,31 +903,50 @@ func (w *WebtunnelClient) Retry() error {
 			net.ParseIP(cfg.IP).To4(),
 		)
 	}
+	if err := w.sendSiteAdvert(); err != nil {
+		return fmt.Errorf("error sending site prefixes %w", err)
+	}
+	if err := w.negotiateKeepalive(); err != nil {
+		return fmt.Errorf("error negotiating keepalive %w", err)
+	}
+	if err := w.registerP2P(); err != nil {
+		return fmt.Errorf("error registering for peer-to-peer %w", err)
+	}
+	// The new path may have a different MTU.
+	go w.discoverMTU()
 	return nil
 }
 
 // Stop gracefully shutdowns the client after notifying the server.
 func (w *WebtunnelClient) Stop() error {
 
-	w.isNetReady = false
-	w.isStopped = true
+	w.isNetReady.Store(false)
+	w.isStopped.Store(true)
+	w.wakeUp()
+	w.prom.SetSessions(0)
+	w.closeStatus()
 
 	// If stop is called without start return.
 	if w.wsconn == nil || w.ifce == nil {
 		return nil
 	}
-	// Read Writes in websocket do not support concurrency.
-	w.wsWriteLock.Lock()
-	err := w.wsconn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-	w.wsWriteLock.Unlock()
+	// Close notice goes on the priority lane ahead of any queued data.
+	w.sendDisconnect("client stopped")
+	err := w.wsWriter.WriteControlMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 	if err != nil {
 		return err
 	}
 	// Wait for some time for server to terminate conn before closing on client end.
 	// Otherwise its seen as a abnormal closure and will result in error.
 	time.Sleep(time.Second)
+	w.wsWriter.Close()
 	w.wsconn.Close()
 	w.ifce.Close()
+	w.closeP2P()
+	w.removeDNSPolicy()
+	w.checkTeardown()
+	w.clearState()
+	w.flushDNS()
 	return nil
 }
 
@@ -337,6 +955,7 @@ func (w *WebtunnelClient) updateMetricsForPacket(n int) {
 	w.packetCnt++
 	w.bytesCnt += n
 	w.metricsLock.Unlock()
+	w.noteActivity()
 }
 
 // ResetMetrics reset the internal counters.
@@ -349,20 +968,24 @@ func (w *WebtunnelClient) ResetMetrics() {
 
 // GetMetrics returns the internal metrics.
 func (w *WebtunnelClient) GetMetrics() (int, int) {
+	w.metricsLock.Lock()
+	defer w.metricsLock.Unlock()
 	return w.packetCnt, w.bytesCnt
 }
 
 // IsInterfaceReady returns true when the network interface is ready and configured
 // with the right IP address.
 func (w *WebtunnelClient) IsInterfaceReady() bool {
-	return w.isNetReady
+	return w.isNetReady.Load()
 }
 
 // wrapPacketForTap wraps the packet in Ethernet - for use only if interface
-// is of TAP type.
+// is of TAP type. The IP packet is copied as is so the ToS/ECN bits and options
+// are preserved.
 func (w *WebtunnelClient) wrapWSPacketForTap(pkt []byte) ([]byte, error) {
-	packet := gopacket.NewPacket(pkt, layers.LayerTypeIPv4, gopacket.Default)
-	ipv4 := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if len(pkt) == 0 || pkt[0]>>4 != 4 {
+		return nil, fmt.Errorf("not an IPv4 packet")
+	}
 
 	ethl := &layers.Ethernet{
 		SrcMAC:       w.ifce.GWHWAddr,
@@ -370,7 +993,7 @@ func (w *WebtunnelClient) wrapWSPacketForTap(pkt []byte) ([]byte, error) {
 		EthernetType: layers.EthernetTypeIPv4,
 	}
 	buffer := gopacket.NewSerializeBuffer()
-	if err := gopacket.SerializeLayers(buffer, defaultPktOpts, ethl, ipv4, gopacket.Payload(ipv4.Payload)); err != nil {
+	if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{}, ethl, gopacket.Payload(pkt)); err != nil {
 		return nil, err
 	}
 	return buffer.Bytes(), nil
@@ -381,67 +1004,184 @@ func (w *WebtunnelClient) wrapWSPacketForTap(pkt []byte) ([]byte, error) {
 func (w *WebtunnelClient) processWSPacket() {
 
 	// Wait for tap/tun interface configuration to be complete by DHCP(TAP) or manual (TUN).
-	// Otherwise writing to network interface will fail.
-	for !IsConfigured(w.ifce.Name(), w.ifce.IP.String()) {
-		time.Sleep(2 * time.Second)
+	// Otherwise writing to network interface will fail. The host application configures
+	// an external interface.
+	if w.external == nil {
 		glog.V(1).Infof("Waiting for interface to be ready...")
+		if err := WaitInterfaceReady(w.ifce.Name(), w.ifce.IP.String(), w.ifReadyTimeout); err != nil {
+			if w.isStopped.Load() {
+				return
+			}
+			w.sendError(err)
+			return
+		}
 	}
 	// get the localHW addr only after network interface is configured.
 	w.ifce.LocalHWAddr = GetMacbyName(w.ifce.Name())
 	glog.V(1).Infof("Interface Ready.")
-	w.isNetReady = true
+	w.isNetReady.Store(true)
 
 	for {
 		// Skip if websocket is not ready - this means we are currently reconnecting
-		if !w.isWSReady {
+		if !w.isWSReady.Load() {
 			continue
 		}
-		// Read packet from websocket.
+		// Read message from websocket. Fragmented messages are reassembled and control
+		// frames (ping, pong, close) are handled by the connection handlers.
 		w.wsReadLock.Lock()
 		mt, pkt, err := w.wsconn.ReadMessage()
 		w.wsReadLock.Unlock()
 		if err != nil {
 			// Gracefully exit goroutine.
-			if w.isStopped {
+			if w.isStopped.Load() {
 				return
 			}
-			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
-				glog.Warning("Terminating after graceful closure from server")
+			w.prom.SetSessions(0)
+			if err := wsReadError(err); err != nil {
+				w.prom.WSError()
+				w.sendError(err)
+			}
+			return
+		}
+		if err := w.handleWSMessage(mt, pkt); err != nil {
+			// Gracefully exit goroutine.
+			if w.isStopped.Load() {
 				return
 			}
-			w.Error <- fmt.Errorf("error reading websocket %s", err)
+			w.sendError(err)
 			return
 		}
-		if mt != websocket.BinaryMessage {
-			glog.Warningf("Binary message type recvd from websocket")
-			continue
+	}
+}
+
+// wsReadError classifies a websocket read error. It returns nil if the server closed the
+// connection gracefully and an error describing the failure otherwise.
+func wsReadError(err error) error {
+	var ce *websocket.CloseError
+	switch {
+	case errors.As(err, &ce):
+		switch ce.Code {
+		case websocket.CloseNormalClosure, websocket.CloseGoingAway:
+			glog.Warningf("Terminating after graceful closure from server: %v", ce.Text)
+			return nil
+		case websocket.ClosePolicyViolation:
+			return fmt.Errorf("connection refused by server policy: %v: %w", ce.Text, err)
+		case websocket.CloseMessageTooBig:
+			return fmt.Errorf("server rejected message size: %w", err)
+		default:
+			return fmt.Errorf("websocket closed with code %v: %w", ce.Code, err)
 		}
-		wc.PrintPacketIPv4(pkt, "Client <- WebSocket")
+	case errors.Is(err, websocket.ErrReadLimit):
+		return fmt.Errorf("message from server exceeds %v bytes: %w", wc.MaxMessageSize, err)
+	default:
+		return fmt.Errorf("error reading websocket %w", err)
+	}
+}
 
-		// Wrap packet in Ethernet header before sending if TAP.
-		if w.ifce.IsTAP() {
-			pkt, err = w.wrapWSPacketForTap(pkt)
-			if err != nil {
-				glog.Warningf("error serializelayer %s", err)
-				continue
+// handleWSMessage processes a message read from the websocket. Text messages carry
+// config updates and binary messages carry packets for the network interface. It only
+// returns an error if writing to the network interface fails.
+func (w *WebtunnelClient) handleWSMessage(mt int, pkt []byte) error {
+	switch mt {
+	case websocket.TextMessage:
+		w.noteActivity()
+		if size, ok := wc.ParseMTUAck(pkt); ok {
+			w.mtuAcked(size)
+			return nil
+		}
+		if d, ok := wc.ParseKeepaliveAck(pkt); ok {
+			w.keepaliveAcked(d)
+			return nil
+		}
+		if bytes.HasPrefix(pkt, []byte(wc.SiteAckPrefix)) {
+			w.processSiteAck(pkt[len(wc.SiteAckPrefix):])
+			return nil
+		}
+		if bytes.HasPrefix(pkt, []byte(wc.P2PPrefix)) {
+			w.processP2P(pkt[len(wc.P2PPrefix):])
+			return nil
+		}
+		if wc.IsChunk(pkt) {
+			msg, err := w.chunks.Add(pkt)
+			if err != nil || msg == nil {
+				if err != nil {
+					glog.Warningf("error reassembling control message: %v", err)
+				}
+				return nil
 			}
+			pkt = msg
+		}
+		if wc.IsControlMessage(pkt) {
+			w.processControl(pkt)
+			return nil
+		}
+		if err := w.processConfigUpdate(pkt); err != nil {
+			glog.Warningf("error applying config update: %v", err)
+		}
+		return nil
+	case websocket.BinaryMessage:
+	default:
+		glog.Warningf("Unexpected message type %v recvd from websocket", mt)
+		return nil
+	}
 
+	if seq, frame, ok := wc.ParseSeqFrame(pkt); ok {
+		fresh := w.loss.Record(seq)
+		w.checkQuality()
+		if !fresh {
+			glog.V(2).Infof("dropping duplicate frame %v", seq)
+			return nil
 		}
+		pkt = frame
+	} else if !w.loss.Unsequenced() {
+		glog.V(2).Info("dropping unsequenced frame")
+		return nil
+	}
 
-		// Send packet to network interface.
-		w.ifWriteLock.Lock()
-		n, err := w.ifce.Write(pkt)
-		w.ifWriteLock.Unlock()
+	// Drop data while paused; the read loop keeps running to handle pings.
+	if w.isPaused.Load() {
+		return nil
+	}
+	// Remove obfuscation padding and drop dummy frames.
+	if pkt = wc.StripPadding(pkt); pkt == nil {
+		return nil
+	}
+	if len(pkt) == 0 {
+		glog.V(2).Info("Empty binary message recvd from websocket")
+		return nil
+	}
+	w.prom.CountPacket(metrics.In, len(pkt))
+	wc.PrintPacketIPv4(pkt, "Client <- WebSocket")
+	return w.writeTunnel(pkt)
+}
+
+// writeTunnel delivers the IP packet pkt from the server or a peer to the network interface.
+func (w *WebtunnelClient) writeTunnel(pkt []byte) error {
+	// Packets for local endpoints do not go to the network interface.
+	if w.deliverEndpoint(pkt) {
+		return nil
+	}
+
+	// Wrap packet in Ethernet header before sending if TAP.
+	if w.ifce.IsTAP() {
+		var err error
+		pkt, err = w.wrapWSPacketForTap(pkt)
 		if err != nil {
-			// Gracefully exit goroutine.
-			if w.isStopped {
-				return
-			}
-			w.Error <- fmt.Errorf("error writing to tunnel %s", err)
-			return
+			glog.Warningf("error serializelayer %s", err)
+			return nil
 		}
-		w.updateMetricsForPacket(n)
 	}
+
+	// Send packet to network interface.
+	w.ifWriteLock.Lock()
+	n, err := w.ifce.Write(pkt)
+	w.ifWriteLock.Unlock()
+	if err != nil {
+		w.prom.TUNWriteError()
+		return fmt.Errorf("error writing to tunnel %w", err)
+	}
+	w.updateMetricsForPacket(n)
+	return nil
 }
 
 // handleNetPacketForTap contains the logic to handle packets received
@@ -452,32 +1192,32 @@ func (w *WebtunnelClient) processWSPacket() {
 // DHCP and ARP have their owner function handlers
 // In regards to IP packet we just strip the Ethernet header and go on
 // with processing/sending
-func (w *WebtunnelClient) handleNetPacketForTap(pkt []byte) ([]byte, error){
+func (w *WebtunnelClient) handleNetPacketForTap(pkt []byte) ([]byte, error) {
 	packet := gopacket.NewPacket(pkt, layers.LayerTypeEthernet, gopacket.Default)
-			if _, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP); ok {
-				if err := w.handleArp(packet); err != nil {
-					return nil, fmt.Errorf("err sending arp %v", err)
-				}
-			}
-			if _, ok := packet.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4); ok {
-				if err := w.handleDHCP(packet); err != nil {
-					return nil, fmt.Errorf("err sending dhcp  %v", err)
-				}
-			}
-			// Only send IPv4 unicast packets to reduce noisy windows machines.
-			ipv4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
-			if !ok || ipv4.DstIP.IsMulticast() {
-				wc.PrintPacketIPv4(pkt, "Client  -> Websocket - droping non ipv4 packet")
-				return nil, nil
-			}
-			// Strip Ethernet header
-			return packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet).LayerPayload(), nil
+	if _, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP); ok {
+		if err := w.handleArp(packet); err != nil {
+			return nil, fmt.Errorf("err sending arp %w", err)
+		}
+	}
+	if _, ok := packet.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4); ok {
+		if err := w.handleDHCP(packet); err != nil {
+			return nil, fmt.Errorf("err sending dhcp  %w", err)
+		}
+	}
+	// Only send IPv4 unicast packets to reduce noisy windows machines.
+	ipv4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok || ipv4.DstIP.IsMulticast() {
+		wc.PrintPacketIPv4(pkt, "Client  -> Websocket - droping non ipv4 packet")
+		return nil, nil
+	}
+	// Strip Ethernet header
+	return packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet).LayerPayload(), nil
 }
 
 // processNetPacket processes the packet from the network interface and dispatches
 // to the websocket connection.
 func (w *WebtunnelClient) processNetPacket() {
-	pkt := make([]byte, 2048)
+	pkt := make([]byte, wc.MaxPacketSize)
 	var oPkt []byte
 
 	for {
@@ -487,10 +1227,11 @@ func (w *WebtunnelClient) processNetPacket() {
 		w.ifReadLock.Unlock()
 		if err != nil {
 			// Gracefully exit goroutine.
-			if w.isStopped {
+			if w.isStopped.Load() {
 				return
 			}
-			w.Error <- fmt.Errorf("error reading Tunnel %s. Sz:%v", err, n)
+			w.prom.TUNReadError()
+			w.sendError(fmt.Errorf("error reading Tunnel %w. Sz:%v", err, n))
 			return
 		}
 		oPkt = pkt[:n]
@@ -501,7 +1242,7 @@ func (w *WebtunnelClient) processNetPacket() {
 		if w.ifce.IsTAP() {
 			oPkt, err = w.handleNetPacketForTap(oPkt)
 			if err != nil {
-				w.Error <- err
+				w.sendError(err)
 				return
 			}
 			// no error but nil packet means we are dropping it
@@ -510,33 +1251,48 @@ func (w *WebtunnelClient) processNetPacket() {
 			}
 		}
 
+		if w.isPaused.Load() {
+			continue
+		}
+
+		// Traffic to other clients takes their direct path if there is one.
+		if w.sendDirect(oPkt) {
+			continue
+		}
+
 		wc.PrintPacketIPv4(oPkt, "Client  -> Websocket")
-		w.wsWriteLock.Lock()
-		err = w.wsconn.WriteMessage(websocket.BinaryMessage, oPkt)
-		w.wsWriteLock.Unlock()
+		err = w.wsWriter.WriteDataMessage(websocket.BinaryMessage, oPkt)
 		if err != nil {
 			// Gracefully exit goroutine.
-			if w.isStopped {
+			if w.isStopped.Load() {
 				w.Error <- nil
 				return
 			}
-			w.Error <- fmt.Errorf("error writing to websocket: %s", err)
+			w.prom.WSError()
+			w.sendError(fmt.Errorf("error writing to websocket: %w", err))
 			return
 		}
+		w.prom.CountPacket(metrics.Out, len(oPkt))
 	}
 }
 
+// maxDHCPOptionLen is the largest DHCP option value.
+const maxDHCPOptionLen = 255
+
 // buildDHCPopts builds the options for DHCP Response.
 func (w *WebtunnelClient) buildDHCPopts(leaseTime uint32, msgType layers.DHCPMsgType) layers.DHCPOptions {
 	var opt []layers.DHCPOption
 	tm := make([]byte, 4)
 	binary.BigEndian.PutUint32(tm, leaseTime)
 
-	var dnsbytes []byte
-	for _, s := range w.ifce.DNS {
-		dnsbytes = append(dnsbytes, s...)
+	// Tunnel DNS servers are only used for the split DNS suffixes if set.
+	if len(w.dnsSuffixes) == 0 {
+		var dnsbytes []byte
+		for _, s := range w.ifce.DNS {
+			dnsbytes = append(dnsbytes, s...)
+		}
+		opt = append(opt, layers.NewDHCPOption(layers.DHCPOptDNS, dnsbytes))
 	}
-	opt = append(opt, layers.NewDHCPOption(layers.DHCPOptDNS, dnsbytes))
 	opt = append(opt, layers.NewDHCPOption(layers.DHCPOptSubnetMask, w.ifce.Netmask))
 	opt = append(opt, layers.NewDHCPOption(layers.DHCPOptLeaseTime, tm))
 	opt = append(opt, layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(msgType)}))
@@ -545,6 +1301,8 @@ func (w *WebtunnelClient) buildDHCPopts(leaseTime uint32, msgType layers.DHCPMsg
 	// Construct the classless static route.
 	// format: {size of netmask, <route prefix>, <gateway> ...}
 	// The size of netmask dictates how to read the route prefix. (eg. 24 - read next 3 bytes or 25 read next 4 bytes)
+	// An option holds at most 255 bytes, so long route lists are split over several
+	// options at route boundaries and concatenated by the client (RFC 3396).
 	var route []byte
 	for _, n := range w.ifce.RoutePrefix {
 		netAddr := []byte(n.IP.To4())
@@ -555,6 +1313,10 @@ func (w *WebtunnelClient) buildDHCPopts(leaseTime uint32, msgType layers.DHCPMsg
 		}
 		// Add only the size of netmask.
 		netAddr = netAddr[:b]
+		if len(route)+1+b+len(w.ifce.GWIP) > maxDHCPOptionLen {
+			opt = append(opt, layers.NewDHCPOption(layers.DHCPOptClasslessStaticRoute, route))
+			route = nil
+		}
 		route = append(route, byte(mask))     // Add netmask size.
 		route = append(route, netAddr...)     // Add network.
 		route = append(route, w.ifce.GWIP...) // Add gateway.
@@ -566,7 +1328,7 @@ func (w *WebtunnelClient) buildDHCPopts(leaseTime uint32, msgType layers.DHCPMsg
 
 // handleDHCP handles the DHCP requests from kernel.
 func (w *WebtunnelClient) handleDHCP(packet gopacket.Packet) error {
-	if w.isNetReady {
+	if w.isNetReady.Load() && !w.dhcpRenew {
 		glog.Info("Skipping DHCP response since IP is assigned")
 		return nil
 	}
@@ -598,6 +1360,7 @@ func (w *WebtunnelClient) handleDHCP(packet gopacket.Packet) error {
 		// to start the discovery process again.
 		if net.IP.Equal(reqIP, w.ifce.IP) || net.IP.Equal(dhcp.ClientIP, w.ifce.IP) {
 			dhcpl.Options = w.buildDHCPopts(w.ifce.LeaseTime, layers.DHCPMsgTypeAck)
+			w.dhcpRenew = false
 		} else {
 			dhcpl.Options = w.buildDHCPopts(w.ifce.LeaseTime, layers.DHCPMsgTypeNak)
 		}
@@ -610,7 +1373,7 @@ func (w *WebtunnelClient) handleDHCP(packet gopacket.Packet) error {
 	err := w.sendDHCPReply(ipv4, udp, dhcpl)
 	if err != nil {
 		// Gracefully exit goroutine.
-		if w.isStopped {
+		if w.isStopped.Load() {
 			return nil
 		}
 		return err
@@ -651,11 +1414,11 @@ func (w *WebtunnelClient) sendDHCPReply(ipv4 *layers.IPv4, udp *layers.UDP, dhcp
 		DstPort: udp.SrcPort,
 	}
 	if err := udpl.SetNetworkLayerForChecksum(ipv4l); err != nil {
-		return fmt.Errorf("error checksum %s", err)
+		return fmt.Errorf("error checksum %w", err)
 	}
 	buffer := gopacket.NewSerializeBuffer()
 	if err := gopacket.SerializeLayers(buffer, defaultPktOpts, ethl, ipv4l, udpl, dhcpl); err != nil {
-		return fmt.Errorf("error serializelayer %s", err)
+		return fmt.Errorf("error serializelayer %w", err)
 	}
 	wc.PrintPacketEth(buffer.Bytes(), "DHCP Reply")
 	w.ifWriteLock.Lock()
@@ -694,7 +1457,7 @@ func (w *WebtunnelClient) handleArp(packet gopacket.Packet) error {
 	err := w.sendArpReply(arpl, ethl)
 	if err != nil {
 		// Gracefully exit goroutine.
-		if w.isStopped {
+		if w.isStopped.Load() {
 			return nil
 		}
 		return err
@@ -727,7 +1490,7 @@ func (w *WebtunnelClient) extractArpDetails(arp *layers.ARP, eth *layers.Etherne
 func (w *WebtunnelClient) sendArpReply(arpl *layers.ARP, ethl *layers.Ethernet) error {
 	buffer := gopacket.NewSerializeBuffer()
 	if err := gopacket.SerializeLayers(buffer, defaultPktOpts, ethl, arpl); err != nil {
-		return fmt.Errorf("error Serializelayer %s", err)
+		return fmt.Errorf("error Serializelayer %w", err)
 	}
 	wc.PrintPacketEth(buffer.Bytes(), "ARP Response")
 	w.ifWriteLock.Lock()
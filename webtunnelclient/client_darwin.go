@@ -0,0 +1,62 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+)
+
+// waitInterfaceReady blocks until interface ifName is configured with ip. It listens on a
+// routing socket for address and interface changes and rechecks on every message.
+func waitInterfaceReady(ifName, ip string, timeout time.Duration) error {
+	if IsConfigured(ifName, ip) {
+		return nil
+	}
+
+	fd, err := syscall.Socket(syscall.AF_ROUTE, syscall.SOCK_RAW, syscall.AF_UNSPEC)
+	if err != nil {
+		return fmt.Errorf("error opening routing socket %w", err)
+	}
+	defer syscall.Close(fd)
+
+	// Wake up periodically so the deadline is honored even without events.
+	tv := syscall.NsecToTimeval(time.Second.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return fmt.Errorf("error setting routing socket timeout %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		// Recheck after subscribing to avoid missing an event raised in between.
+		if IsConfigured(ifName, ip) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("interface %s %w with %s after %v", ifName, wc.ErrNotConfigured, ip, timeout)
+		}
+		if _, err := syscall.Read(fd, buf); err != nil && err != syscall.EAGAIN && err != syscall.EINTR {
+			return fmt.Errorf("error reading routing socket %w", err)
+		}
+	}
+}
+
+// setInterfaceMTU sets the MTU of interface ifName.
+func setInterfaceMTU(ifName string, mtu int) error {
+	if out, err := exec.Command("/sbin/ifconfig", ifName, "mtu", strconv.Itoa(mtu)).CombinedOutput(); err != nil {
+		return fmt.Errorf("error setting mtu %w %s", err, out)
+	}
+	return nil
+}
+
+// openBrowser opens url in the default browser.
+func openBrowser(url string) error {
+	if err := exec.Command("/usr/bin/open", url).Start(); err != nil {
+		return fmt.Errorf("error opening browser %w", err)
+	}
+	return nil
+}
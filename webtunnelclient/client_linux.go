@@ -0,0 +1,76 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+)
+
+// Netlink multicast groups (linux/rtnetlink.h) not exported by syscall.
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4Ifaddr = 0x10
+)
+
+// waitInterfaceReady blocks until interface ifName is configured with ip. It listens for
+// netlink link and address events instead of polling and rechecks on every event.
+func waitInterfaceReady(ifName, ip string, timeout time.Duration) error {
+	if IsConfigured(ifName, ip) {
+		return nil
+	}
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("error opening netlink socket %w", err)
+	}
+	defer syscall.Close(fd)
+
+	sa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4Ifaddr,
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return fmt.Errorf("error binding netlink socket %w", err)
+	}
+
+	// Wake up periodically so the deadline is honored even without events.
+	tv := syscall.NsecToTimeval(time.Second.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return fmt.Errorf("error setting netlink timeout %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		// Recheck after subscribing to avoid missing an event raised in between.
+		if IsConfigured(ifName, ip) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("interface %s %w with %s after %v", ifName, wc.ErrNotConfigured, ip, timeout)
+		}
+		if _, _, err := syscall.Recvfrom(fd, buf, 0); err != nil && err != syscall.EAGAIN && err != syscall.EINTR {
+			return fmt.Errorf("error reading netlink socket %w", err)
+		}
+	}
+}
+
+// setInterfaceMTU sets the MTU of interface ifName.
+func setInterfaceMTU(ifName string, mtu int) error {
+	if out, err := exec.Command("ip", "link", "set", "dev", ifName, "mtu", strconv.Itoa(mtu)).CombinedOutput(); err != nil {
+		return fmt.Errorf("error setting mtu %w %s", err, out)
+	}
+	return nil
+}
+
+// openBrowser opens url in the default browser.
+func openBrowser(url string) error {
+	if err := exec.Command("xdg-open", url).Start(); err != nil {
+		return fmt.Errorf("error opening browser %w", err)
+	}
+	return nil
+}
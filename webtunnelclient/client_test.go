@@ -2,14 +2,30 @@ package webtunnelclient
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/deepakkamesh/webtunnel/mocks"
 	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/deepakkamesh/webtunnel/webtunnelcommon/metrics"
+	"github.com/deepakkamesh/webtunnel/webtunnelcommon/version"
 	wts "github.com/deepakkamesh/webtunnel/webtunnelserver"
 	"github.com/golang/mock/gomock"
 	"github.com/google/gopacket"
@@ -84,6 +100,9 @@ func TestClient(t *testing.T) {
 		return mockClientIfce, nil
 	}
 	IsConfigured = func(string, string) bool { return true }
+	FlushDNSCache = func() error { return nil }
+	ListRoutes = func() ([]Route, error) { return nil, nil }
+	ListDNSServers = func() ([]DNSServer, error) { return nil, nil }
 	GetMacbyName = func(string) net.HardwareAddr {
 		return net.HardwareAddr{0x01, 0x01, 0x01, 0x01, 0x01, 0x01}
 	}
@@ -105,24 +124,1764 @@ func TestClient(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	mtu := make(chan int, 1)
+	SetInterfaceMTU = func(name string, n int) error {
+		mtu <- n
+		return nil
+	}
+	if err := client.SetMTUProbe(0, 1400); err != nil {
+		t.Fatal(err)
+	}
 	if err := client.Start(); err != nil {
 		t.Fatal(err)
 	}
+	select {
+	case n := <-mtu:
+		if n != 1400 {
+			t.Errorf("Expected MTU 1400, got %v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("MTU not discovered")
+	}
+	// Data frames are sequence numbered in both directions.
+	time.Sleep(500 * time.Millisecond)
+	if s, ok := server.GetLossStats()["192.168.0.2"]; !ok || s.Received == 0 {
+		t.Errorf("Expected sequenced frames on server, got %+v", s)
+	}
+	if s := client.GetLossStats(); s.Received == 0 || s.Lost != 0 {
+		t.Errorf("Expected sequenced frames without loss on client, got %+v", s)
+	}
+	// Both sides speak control messages.
+	if _, err := client.PingServer(5 * time.Second); err != nil {
+		t.Errorf("Expected ping reply: %v", err)
+	}
+	if err := server.RequestClientMetrics("192.168.0.2"); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if m, _, err := server.ClientMetrics("192.168.0.2"); err != nil || m["packets"] == 0 {
+		t.Errorf("Expected client metrics, got %v %v", m, err)
+	}
 	mockServerIfce.EXPECT().Close()
 	server.Stop()
 	// Some sleep to process the packets and stop gracefully
 	time.Sleep(3 * time.Second)
 }
 
+func TestDeviceFallback(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIfce := mocks.NewMockInterface(mockCtrl)
+
+	// TUN driver is missing, only TAP can be created.
+	NewWaterInterface = func(c water.Config) (wc.Interface, error) {
+		if c.DeviceType == water.TUN {
+			return nil, fmt.Errorf("driver not found")
+		}
+		return mockIfce, nil
+	}
+
+	client, err := NewWebtunnelClient("127.0.0.1:8811", websocket.DefaultDialer,
+		false, nil, false, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.newInterface(); err == nil {
+		t.Error("expected error without fallback")
+	}
+
+	client.SetDeviceFallback(true)
+	if _, err := client.newInterface(); err != nil {
+		t.Fatal(err)
+	}
+	if v := client.ActiveDeviceType(); v != "TAP" {
+		t.Errorf("device type want TAP, got %v", v)
+	}
+}
+
+func TestExternalInterface(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIfce := mocks.NewMockInterface(mockCtrl)
+	mockIfce.EXPECT().Name().Return("packetflow").AnyTimes()
+	NewWaterInterface = func(c water.Config) (wc.Interface, error) {
+		return nil, fmt.Errorf("utun not permitted")
+	}
+
+	client, err := NewWebtunnelClient("127.0.0.1:8811", websocket.DefaultDialer,
+		true, nil, false, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetExternalInterface(mockIfce)
+	ifce, err := client.newInterface()
+	if err != nil || ifce != mockIfce {
+		t.Fatalf("Expected external interface, got %v %v", ifce, err)
+	}
+	if v := client.ActiveDeviceType(); v != "TUN" {
+		t.Errorf("device type want TUN, got %v", v)
+	}
+	client.recordApplied()
+	if client.AppliedConfig() != nil {
+		t.Error("Expected no OS state recorded for an external interface")
+	}
+}
+
+func TestPacketStream(t *testing.T) {
+	tool, conn := net.Pipe()
+	defer tool.Close()
+	ps := NewPacketStream("pipe", conn, conn, conn)
+	if !ps.IsTUN() || ps.IsTAP() || ps.Name() != "pipe" {
+		t.Error("Expected a TUN stream named pipe")
+	}
+
+	// Packets are length prefixed both ways.
+	go tool.Write([]byte{0, 3, 1, 2, 3, 0, 4, 1, 2, 3, 4, 0, 1, 9})
+	buf := make([]byte, 3)
+	if n, err := ps.Read(buf); err != nil || !bytes.Equal(buf[:n], []byte{1, 2, 3}) {
+		t.Errorf("Got packet %v %v want [1 2 3]", buf[:n], err)
+	}
+	if _, err := ps.Read(buf); err != io.ErrShortBuffer {
+		t.Errorf("Expected short buffer for larger packet, got %v", err)
+	}
+	if n, err := ps.Read(buf); err != nil || !bytes.Equal(buf[:n], []byte{9}) {
+		t.Errorf("Expected packet after the discarded one, got %v %v", buf[:n], err)
+	}
+
+	go ps.Write([]byte{5, 6})
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(tool, got); err != nil || !bytes.Equal(got, []byte{0, 2, 5, 6}) {
+		t.Errorf("Got frame %v %v want [0 2 5 6]", got, err)
+	}
+	if _, err := ps.Write(make([]byte, 0x10000)); err == nil {
+		t.Error("Expected error for oversized packet")
+	}
+
+	ps.Close()
+	if _, err := ps.Read(buf); err == nil {
+		t.Error("Expected error after close")
+	}
+	if _, err := DialPacketStream(filepath.Join(t.TempDir(), "none")); err == nil {
+		t.Error("Expected error dialing missing socket")
+	}
+}
+
+func TestServerDiscovery(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+
+	// Gateway health endpoint.
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	}))
+	defer gw.Close()
+	gwAddr := strings.TrimPrefix(gw.URL, "http://")
+
+	servers := []wc.GatewayEndpoint{
+		{Address: "127.0.0.1:1", Region: "down"},
+		{Address: gwAddr, Region: "local"},
+	}
+	list, err := wc.SignServerList(servers, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(list)
+	}))
+	defer disc.Close()
+
+	got, err := FetchServerList(http.DefaultClient, disc.URL, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 servers, got %v", len(got))
+	}
+
+	// Tampered list fails verification.
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	if _, err := FetchServerList(http.DefaultClient, disc.URL, otherPub); err == nil {
+		t.Error("Expected signature verification error")
+	}
+
+	best, err := SelectServer(&http.Client{Timeout: time.Second}, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if best.Region != "local" {
+		t.Errorf("Expected local gateway, got %v", best.Region)
+	}
+}
+
+func TestWrapPacketForTapPreservesTOS(t *testing.T) {
+	w := &WebtunnelClient{ifce: &Interface{
+		GWHWAddr:    net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		LocalHWAddr: net.HardwareAddr{2, 0, 0, 0, 0, 2},
+	}}
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.IPv4{Version: 4, IHL: 5, TOS: 0xb9, TTL: 64, SrcIP: net.IP{1, 1, 1, 1}, DstIP: net.IP{192, 168, 0, 2}},
+		gopacket.Payload([]byte{1, 2, 3, 4}))
+	pkt := buf.Bytes()
+
+	eth, err := w.wrapWSPacketForTap(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(eth[14:14+len(pkt)], pkt) {
+		t.Errorf("IP packet modified: got %v want %v", eth[14:14+len(pkt)], pkt)
+	}
+	if _, err := w.wrapWSPacketForTap([]byte{0x60, 0, 0, 0}); err == nil {
+		t.Error("Expected error for non IPv4 packet")
+	}
+}
+
 func createIPv4Pkt(srcIP net.IP, dstIP net.IP) []byte {
 	buf := gopacket.NewSerializeBuffer()
-	opts := gopacket.SerializeOptions{}
+	opts := gopacket.SerializeOptions{FixLengths: true}
 	gopacket.SerializeLayers(buf, opts,
 		&layers.IPv4{
-			SrcIP: srcIP,
-			DstIP: dstIP,
+			Version:  4,
+			IHL:      5,
+			Protocol: layers.IPProtocolTCP,
+			SrcIP:    srcIP,
+			DstIP:    dstIP,
 		},
 		&layers.TCP{},
 		gopacket.Payload([]byte{1, 2, 3, 4}))
 	return buf.Bytes()
 }
+
+func TestStatus(t *testing.T) {
+	w := &WebtunnelClient{}
+	w.isPaused.Store(true)
+	w.isWSReady.Store(true)
+	w.lastErrors.add(fmt.Errorf("test error"))
+	s := w.GetStatus()
+	if s.State != "paused" {
+		t.Errorf("Expected paused state, got %v", s.State)
+	}
+	if len(s.LastErrors) != 1 || !strings.HasSuffix(s.LastErrors[0], "test error") {
+		t.Errorf("Expected last error recorded, got %v", s.LastErrors)
+	}
+
+	if err := w.ServeStatus("0.0.0.0:0"); err == nil {
+		t.Error("Expected error for non loopback status address")
+	}
+
+	if err := w.ServeStatus("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	srv := w.statusServer
+	// Actions require POST with the status token, browser requests are refused.
+	h := localOnly(w.statusAction(func() error { return nil }))
+	auth := "Bearer " + w.StatusToken()
+	for _, tc := range []struct {
+		method, host, auth, origin string
+		want                       int
+	}{
+		{http.MethodGet, "127.0.0.1:8812", auth, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "127.0.0.1:8812", "", "", http.StatusUnauthorized},
+		{http.MethodPost, "127.0.0.1:8812", "Bearer wrong", "", http.StatusUnauthorized},
+		{http.MethodPost, "127.0.0.1:8812", auth, "http://example.com", http.StatusForbidden},
+		{http.MethodPost, "rebind.example.com:8812", auth, "", http.StatusForbidden},
+		{http.MethodPost, "localhost:8812", auth, "", http.StatusOK},
+		{http.MethodPost, "127.0.0.1:8812", auth, "", http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, "/pause", nil)
+		req.Host = tc.host
+		req.Header.Set("Authorization", tc.auth)
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("Expected %v for %v host %v auth %q origin %q, got %v", tc.want, tc.method, tc.host, tc.auth, tc.origin, rec.Code)
+		}
+	}
+
+	// Stop closes the status endpoint.
+	w.Stop()
+	if w.statusServer != nil {
+		t.Error("Expected status endpoint cleared by Stop")
+	}
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		t.Errorf("Expected status endpoint closed, got %v", err)
+	}
+}
+
+func TestPause(t *testing.T) {
+	w := &WebtunnelClient{ifce: &Interface{}}
+	var paused, resumed int32
+	w.SetPauseFuncs(func(*Interface) error {
+		atomic.AddInt32(&paused, 1)
+		return nil
+	}, func(*Interface) error {
+		atomic.AddInt32(&resumed, 1)
+		return nil
+	})
+
+	// Concurrent calls run the callbacks once.
+	run := func(f func() error) {
+		done := make(chan struct{})
+		for i := 0; i < 10; i++ {
+			go func() {
+				f()
+				done <- struct{}{}
+			}()
+		}
+		for i := 0; i < 10; i++ {
+			<-done
+		}
+	}
+	run(w.Pause)
+	if !w.IsPaused() || atomic.LoadInt32(&paused) != 1 {
+		t.Errorf("Expected paused once, got paused %v calls %v", w.IsPaused(), paused)
+	}
+	run(w.Resume)
+	if w.IsPaused() || atomic.LoadInt32(&resumed) != 1 {
+		t.Errorf("Expected resumed once, got paused %v calls %v", w.IsPaused(), resumed)
+	}
+
+	// A failed pause leaves the tunnel running.
+	w.SetPauseFuncs(func(*Interface) error { return fmt.Errorf("route error") }, nil)
+	if err := w.Pause(); err == nil || w.IsPaused() {
+		t.Errorf("Expected failed pause to leave tunnel running, got %v %v", err, w.IsPaused())
+	}
+}
+
+func TestWSReadError(t *testing.T) {
+	testCases := []struct {
+		err   error
+		fatal bool
+	}{
+		{&websocket.CloseError{Code: websocket.CloseNormalClosure}, false},
+		{&websocket.CloseError{Code: websocket.CloseGoingAway}, false},
+		{&websocket.CloseError{Code: websocket.ClosePolicyViolation, Text: "posture denied"}, true},
+		{&websocket.CloseError{Code: websocket.CloseMessageTooBig}, true},
+		{&websocket.CloseError{Code: websocket.CloseAbnormalClosure}, true},
+		{websocket.ErrReadLimit, true},
+		{fmt.Errorf("network down"), true},
+	}
+	for _, tc := range testCases {
+		err := wsReadError(tc.err)
+		if (err != nil) != tc.fatal {
+			t.Errorf("wsReadError(%v) expected fatal %v, got %v", tc.err, tc.fatal, err)
+		}
+		if err != nil && !errors.Is(err, tc.err) {
+			t.Errorf("wsReadError(%v) does not wrap the read error: %v", tc.err, err)
+		}
+	}
+}
+
+func TestHandleWSMessage(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIfce := mocks.NewMockInterface(mockCtrl)
+	mockIfce.EXPECT().IsTAP().Return(false).AnyTimes()
+
+	w := &WebtunnelClient{ifce: &Interface{Interface: mockIfce, IP: net.IP{192, 168, 0, 2}}, prom: metrics.NewTunnel(promNamespace)}
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.IPv4{Version: 4, IHL: 5, TTL: 64, SrcIP: net.IP{1, 1, 1, 1}, DstIP: net.IP{192, 168, 0, 2}},
+		gopacket.Payload([]byte{1, 2, 3, 4}))
+	pkt := buf.Bytes()
+
+	// Only binary messages reach the interface.
+	mockIfce.EXPECT().Write(pkt).Return(len(pkt), nil).Times(1)
+	if err := w.handleWSMessage(websocket.BinaryMessage, pkt); err != nil {
+		t.Error(err)
+	}
+	for _, mt := range []int{websocket.PingMessage, websocket.PongMessage, websocket.CloseMessage, 0} {
+		if err := w.handleWSMessage(mt, pkt); err != nil {
+			t.Errorf("Unexpected error for message type %v: %v", mt, err)
+		}
+	}
+	if err := w.handleWSMessage(websocket.BinaryMessage, []byte{}); err != nil {
+		t.Error(err)
+	}
+	// Invalid config updates are not fatal.
+	if err := w.handleWSMessage(websocket.TextMessage, []byte("{")); err != nil {
+		t.Error(err)
+	}
+
+	// Interface write failures are.
+	mockIfce.EXPECT().Write(pkt).Return(0, fmt.Errorf("closed")).Times(1)
+	if err := w.handleWSMessage(websocket.BinaryMessage, pkt); err == nil {
+		t.Error("Expected error on interface write failure")
+	}
+
+	// Packets and failures are counted for /metrics.
+	if got := w.prom.Packets.Value(metrics.In); got != 2 {
+		t.Errorf("Expected 2 packets in, got %v", got)
+	}
+	if got := w.prom.Bytes.Value(metrics.In); got != float64(2*len(pkt)) {
+		t.Errorf("Expected %v bytes in, got %v", 2*len(pkt), got)
+	}
+	if got := w.prom.TUNWriteErrors.Value(); got != 1 {
+		t.Errorf("Expected 1 interface write error, got %v", got)
+	}
+}
+
+func TestTeardown(t *testing.T) {
+	_, tunRoute, _ := net.ParseCIDR("1.1.1.0/24")
+	_, lanRoute, _ := net.ParseCIDR("10.0.0.0/8")
+	gw := net.IP{192, 168, 0, 1}
+
+	// The LAN route and DNS predate the tunnel, the rest are leftovers.
+	before := []Route{{Dst: lanRoute, Gateway: gw, Iface: "eth0"}}
+	routes := append(before, Route{Dst: tunRoute, Gateway: gw, Iface: "eth0"}, Route{Dst: tunRoute, Iface: "virt0"})
+	servers := []DNSServer{{IP: net.IP{8, 8, 1, 1}, Iface: "virt0"}, {IP: net.IP{8, 8, 8, 8}}}
+	ListRoutes = func() ([]Route, error) { return routes, nil }
+	ListDNSServers = func() ([]DNSServer, error) { return servers, nil }
+
+	var deleted []Route
+	DeleteRoute = func(r Route) error {
+		deleted = append(deleted, r)
+		return nil
+	}
+	DeleteDNSServer = func(d DNSServer) error { return fmt.Errorf("not supported") }
+
+	cfg := &TunnelConfig{
+		Iface:  "virt0",
+		GWIP:   gw,
+		Routes: []*net.IPNet{tunRoute, lanRoute},
+		DNS:    []net.IP{{8, 8, 1, 1}, {8, 8, 8, 8}},
+	}
+	base := &osState{routes: before, dns: servers[1:]}
+	report := verifyTeardown(cfg, base)
+	if len(deleted) != 2 || len(report.Repaired) != 2 {
+		t.Errorf("Expected 2 routes removed, got %v", deleted)
+	}
+	if report.Clean() || len(report.Remaining) != 1 {
+		t.Errorf("Expected 1 DNS server remaining, got %v", report.Remaining)
+	}
+
+	// Without a baseline everything owned by the tunnel is a leftover.
+	deleted = nil
+	if report := VerifyTeardown(cfg); len(deleted) != 3 || len(report.Remaining) != 2 {
+		t.Errorf("Expected 3 routes removed and 2 DNS servers remaining, got %v %v", deleted, report.Remaining)
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	_, route, _ := net.ParseCIDR("1.1.1.0/24")
+	addr := &net.IPNet{IP: net.IP{192, 168, 0, 2}, Mask: net.CIDRMask(24, 32)}
+	cfg := &TunnelConfig{
+		Iface:  "virt0",
+		IP:     addr,
+		GWIP:   net.IP{192, 168, 0, 1},
+		Routes: []*net.IPNet{route},
+		DNS:    []net.IP{{8, 8, 1, 1}},
+	}
+	path := filepath.Join(t.TempDir(), "webtunnel.state")
+	if err := WriteStateFile(path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadStateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Iface != "virt0" || got.IP.String() != addr.String() || got.Routes[0].String() != route.String() {
+		t.Errorf("State file round trip failed, got %+v", got)
+	}
+
+	// Stale entries of a crashed run are removed on startup.
+	ListRoutes = func() ([]Route, error) { return []Route{{Dst: route, Iface: "virt0"}}, nil }
+	ListDNSServers = func() ([]DNSServer, error) { return nil, nil }
+	ListAddresses = func(string) ([]*net.IPNet, error) { return []*net.IPNet{addr}, nil }
+	var removed []string
+	DeleteRoute = func(r Route) error {
+		removed = append(removed, r.Dst.String())
+		return nil
+	}
+	DeleteAddress = func(iface string, a *net.IPNet) error {
+		removed = append(removed, a.String())
+		return nil
+	}
+	w := &WebtunnelClient{stateFile: path}
+	w.repairStaleState()
+	if len(removed) != 2 {
+		t.Errorf("Expected stale route and address removed, got %v", removed)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected state file removed, got %v", err)
+	}
+}
+
+func TestQualityAlert(t *testing.T) {
+	w := &WebtunnelClient{}
+	var alerts []bool
+	w.SetQualityAlert(0.1, 0.1, func(degraded bool, s wc.LossStats) {
+		alerts = append(alerts, degraded)
+	})
+	// Advance past the check interval.
+	check := func() {
+		w.quality.lastCheck = w.quality.lastCheck.Add(-qualityCheckInterval)
+		w.checkQuality()
+	}
+
+	w.loss.Record(1)
+	w.checkQuality()
+	for seq := uint32(2); seq <= 10; seq++ {
+		w.loss.Record(seq)
+	}
+	check()
+	// Half the frames of the next interval are lost.
+	for seq := uint32(12); seq <= 30; seq += 2 {
+		w.loss.Record(seq)
+	}
+	check()
+	for seq := uint32(31); seq <= 60; seq++ {
+		w.loss.Record(seq)
+	}
+	check()
+	if len(alerts) != 2 || !alerts[0] || alerts[1] {
+		t.Errorf("Expected degraded then recovered alerts, got %v", alerts)
+	}
+}
+
+func TestSplitDNS(t *testing.T) {
+	w := &WebtunnelClient{ifce: &Interface{DNS: []net.IP{{10, 0, 0, 53}}}}
+	if err := w.SetSplitDNS([]string{"corp.example.com", "bad suffix"}); err == nil {
+		t.Error("Expected error for invalid suffix")
+	}
+	if err := w.SetSplitDNS([]string{".Corp.Example.com", "lab."}); err != nil {
+		t.Fatal(err)
+	}
+
+	rules := map[string]string{}
+	AddNRPTRule = func(suffix string, servers []net.IP) error {
+		rules[suffix] = dnsServerList(servers)
+		return nil
+	}
+	RemoveNRPTRules = func() error {
+		rules = map[string]string{}
+		return nil
+	}
+	w.applyDNSPolicy()
+	want := map[string]string{".corp.example.com": "'10.0.0.53'", ".lab": "'10.0.0.53'"}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("Got rules %v want %v", rules, want)
+	}
+
+	// DHCP hands out no DNS servers with split DNS.
+	w.ifce.Netmask, w.ifce.GWIP = net.IP{255, 255, 255, 0}, net.IP{192, 168, 0, 1}
+	for _, o := range w.buildDHCPopts(300, layers.DHCPMsgTypeAck) {
+		if o.Type == layers.DHCPOptDNS {
+			t.Error("Expected no DNS option with split DNS")
+		}
+	}
+
+	w.removeDNSPolicy()
+	if len(rules) != 0 {
+		t.Errorf("Expected rules removed, got %v", rules)
+	}
+}
+
+func TestRouteLoop(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIfce := mocks.NewMockInterface(mockCtrl)
+	mockIfce.EXPECT().Name().Return("virt0").AnyTimes()
+
+	_, defRoute, _ := net.ParseCIDR("0.0.0.0/0")
+	_, lan, _ := net.ParseCIDR("203.0.113.0/24")
+	_, internal, _ := net.ParseCIDR("10.0.0.0/8")
+	LookupIP = func(host string) ([]net.IP, error) { return []net.IP{{203, 0, 113, 5}}, nil }
+	routes := []Route{
+		{Dst: defRoute, Gateway: net.IP{192, 168, 1, 1}, Iface: "eth0"},
+		{Dst: lan, Gateway: net.IP{192, 168, 1, 254}, Iface: "eth1"},
+		{Dst: defRoute, Gateway: net.IP{192, 168, 0, 1}, Iface: "virt0"},
+	}
+	ListRoutes = func() ([]Route, error) { return routes, nil }
+	var added []Route
+	AddRoute = func(r Route) error {
+		added = append(added, r)
+		return nil
+	}
+
+	w := &WebtunnelClient{serverIPPort: "vpn.example.com:443", ifce: &Interface{Interface: mockIfce}}
+	if err := w.preventRouteLoop([]*net.IPNet{internal}); err != nil || len(added) != 0 {
+		t.Fatalf("Expected no exception for routes not covering the server, got %v %v", added, err)
+	}
+	if err := w.preventRouteLoop([]*net.IPNet{internal, defRoute}); err != nil {
+		t.Fatal(err)
+	}
+	want := Route{Dst: &net.IPNet{IP: net.IP{203, 0, 113, 5}, Mask: net.CIDRMask(32, 32)}, Gateway: net.IP{192, 168, 1, 254}, Iface: "eth1"}
+	if len(added) != 1 || !reflect.DeepEqual(added[0], want) {
+		t.Fatalf("Expected exception %v, got %v", want, added)
+	}
+	// The exception is added once and removed on teardown.
+	w.preventRouteLoop([]*net.IPNet{defRoute})
+	if len(added) != 1 {
+		t.Errorf("Expected a single exception, got %v", added)
+	}
+	if cfg := (&TunnelConfig{Exceptions: w.exceptions}); !cfg.ownsRoute(want) {
+		t.Error("Expected exception owned by the tunnel config")
+	}
+
+	// Without a route outside the tunnel the config is refused.
+	w = &WebtunnelClient{serverIPPort: "vpn.example.com:443", ifce: &Interface{Interface: mockIfce}}
+	routes = routes[2:]
+	if err := w.preventRouteLoop([]*net.IPNet{defRoute}); err == nil {
+		t.Error("Expected error without a route to the server")
+	}
+}
+
+func TestFallbackStrategies(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if c, err := upgrader.Upgrade(rw, r, nil); err == nil {
+			c.Close()
+		}
+	}))
+	defer ts.Close()
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	client, err := NewWebtunnelClient("127.0.0.1:1", websocket.DefaultDialer, false, nil, true, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetFallbackStrategies([]Strategy{{Scheme: "https"}}); err == nil {
+		t.Error("Expected error for unsupported scheme")
+	}
+	p, _ := strconv.Atoi(port)
+	if err := client.SetFallbackStrategies([]Strategy{
+		{Name: "wss-alt", Port: p},
+		{Scheme: "ws", Port: p},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Direct and the TLS strategy fail, plain websocket on the alternate port works.
+	conn, _, err := client.dial("wss://127.0.0.1:1/ws", http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if s := client.ActiveStrategy(); s != "fallback2" {
+		t.Errorf("Expected strategy fallback2, got %v", s)
+	}
+	if s := client.GetStatus().Strategy; s != "fallback2" {
+		t.Errorf("Expected status strategy fallback2, got %v", s)
+	}
+}
+
+func TestSSOLogin(t *testing.T) {
+	valid := "Bearer token1"
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != valid {
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if c, err := upgrader.Upgrade(rw, r, nil); err == nil {
+			c.Close()
+		}
+	}))
+	defer ts.Close()
+
+	// The browser completes the login with a redirect, then with a SAML POST binding.
+	logins := 0
+	OpenBrowser = func(loginURL string) error {
+		u, err := url.Parse(loginURL)
+		if err != nil {
+			return err
+		}
+		q := u.Query()
+		if q.Get("app") != "vpn" {
+			t.Errorf("Expected login URL parameters kept, got %v", loginURL)
+		}
+		logins++
+		if logins == 1 {
+			_, err = http.Get(q.Get("redirect_uri") + "?token=token1&state=" + q.Get("state"))
+		} else {
+			_, err = http.PostForm(q.Get("redirect_uri"), url.Values{"SAMLResponse": {"token2"}, "RelayState": {q.Get("state")}})
+		}
+		return err
+	}
+
+	client, err := NewWebtunnelClient(ts.Listener.Addr().String(), websocket.DefaultDialer, false, nil, false, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetSSOLogin("ftp://idp.example.com", 0); err == nil {
+		t.Error("Expected error for invalid login URL")
+	}
+	if err := client.SetSSOLogin("https://idp.example.com/login?app=vpn", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	wsURL := "ws://" + ts.Listener.Addr().String() + "/ws"
+	conn, _, err := client.dial(wsURL, http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// The token is reused until the server refuses it.
+	conn, _, err = client.dial(wsURL, http.Header{})
+	if err != nil || logins != 1 {
+		t.Fatalf("Expected token reused, got %v logins err %v", logins, err)
+	}
+	conn.Close()
+	valid = "Bearer token2"
+	if _, _, err := client.dial(wsURL, http.Header{}); err == nil {
+		t.Fatal("Expected expired token refused")
+	}
+	conn, _, err = client.dial(wsURL, http.Header{})
+	if err != nil || logins != 2 {
+		t.Fatalf("Expected new login, got %v logins err %v", logins, err)
+	}
+	conn.Close()
+}
+
+func TestTokenProvider(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer rotated" {
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if c, err := (&websocket.Upgrader{}).Upgrade(rw, r, nil); err == nil {
+			c.Close()
+		}
+	}))
+	defer ts.Close()
+	wsURL := "ws://" + ts.Listener.Addr().String() + "/ws"
+
+	client, err := NewWebtunnelClient(ts.Listener.Addr().String(), websocket.DefaultDialer, false, nil, false, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetCredentials("alice", "secret")
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	client.SetTokenProvider(FileTokenProvider(tokenFile))
+	if _, _, err := client.dial(wsURL, http.Header{}); err == nil || !strings.Contains(err.Error(), "error getting token") {
+		t.Errorf("Expected missing token file error, got %v", err)
+	}
+
+	// The token is read again on each attempt.
+	os.WriteFile(tokenFile, []byte("expired\n"), 0600)
+	if _, _, err := client.dial(wsURL, http.Header{}); err == nil || !strings.Contains(err.Error(), "authentication refused") {
+		t.Errorf("Expected expired token refused, got %v", err)
+	}
+	os.WriteFile(tokenFile, []byte("rotated\n"), 0600)
+	conn, _, err := client.dial(wsURL, http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	v4, v4b, v6 := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("2001:db8::1")
+	testCases := []struct {
+		pref AddressPreference
+		want []net.IP
+	}{
+		{PreferIPv6, []net.IP{v6, v4, v4b}},
+		{PreferIPv4, []net.IP{v4, v6, v4b}},
+		{IPv6Only, []net.IP{v6}},
+		{IPv4Only, []net.IP{v4, v4b}},
+	}
+	for _, tc := range testCases {
+		if got := sortAddrs([]net.IP{v4, v4b, v6}, tc.pref); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("sortAddrs(%v) expected %v, got %v", tc.pref, tc.want, got)
+		}
+	}
+
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if c, err := upgrader.Upgrade(rw, r, nil); err == nil {
+			c.Close()
+		}
+	}))
+	defer ts.Close()
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	// The preferred IPv6 address is unreachable.
+	LookupIP = func(host string) ([]net.IP, error) { return []net.IP{v6, net.ParseIP("127.0.0.1")}, nil }
+	client, err := NewWebtunnelClient("vpn.example.com:"+port, websocket.DefaultDialer, false, nil, false, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetHappyEyeballs(PreferIPv6, -time.Second); err == nil {
+		t.Error("Expected error for negative delay")
+	}
+	if err := client.SetHappyEyeballs(PreferIPv6, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now()
+	conn, _, err := client.dial("ws://vpn.example.com:"+port+"/ws", http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(started); d > 2*time.Second {
+		t.Errorf("Expected IPv4 raced after the attempt delay, took %v", d)
+	}
+	if a := conn.RemoteAddr().(*net.TCPAddr); !a.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("Expected connection over IPv4, got %v", a)
+	}
+	conn.Close()
+
+	client.SetHappyEyeballs(IPv6Only, 0)
+	client.wsDialer = &websocket.Dialer{HandshakeTimeout: time.Second}
+	if _, _, err := client.dial("ws://vpn.example.com:"+port+"/ws", http.Header{}); err == nil {
+		t.Error("Expected IPv6 only dial to fail")
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIfce := mocks.NewMockInterface(mockCtrl)
+	mockIfce.EXPECT().IsTAP().Return(false).AnyTimes()
+
+	received := make(chan []byte, 1)
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(rw, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if _, msg, err := c.ReadMessage(); err == nil {
+			received <- msg
+		}
+	}))
+	defer ts.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+ts.Listener.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tunIP := net.IP{192, 168, 0, 2}
+	w := &WebtunnelClient{ifce: &Interface{Interface: mockIfce, IP: tunIP}, wsWriter: wc.NewWSWriter(conn, nil)}
+	w.isWSReady.Store(true)
+	udpPkt := func(src, dst net.IP, sport, dport layers.UDPPort) []byte {
+		buf := gopacket.NewSerializeBuffer()
+		gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+			&layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: src, DstIP: dst},
+			&layers.UDP{SrcPort: sport, DstPort: dport}, gopacket.Payload([]byte{1, 2, 3, 4}))
+		return buf.Bytes()
+	}
+
+	var delivered [][]byte
+	socks := &Endpoint{Name: "socks", MinPort: 40000, MaxPort: 40999, Deliver: func(pkt []byte) {
+		delivered = append(delivered, append([]byte(nil), pkt...))
+	}}
+	if err := w.AddEndpoint(socks); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddEndpoint(&Endpoint{Name: "dns", MinPort: 40999, MaxPort: 41000, Deliver: func([]byte) {}}); err == nil {
+		t.Error("Expected error for overlapping port range")
+	}
+
+	// Packets to the endpoint ports are demultiplexed from the interface traffic.
+	toSocks := udpPkt(net.IP{1, 1, 1, 1}, tunIP, 53, 40001)
+	toIfce := udpPkt(net.IP{1, 1, 1, 1}, tunIP, 53, 5353)
+	mockIfce.EXPECT().Write(toIfce).Return(len(toIfce), nil).Times(2)
+	for _, pkt := range [][]byte{toSocks, toIfce} {
+		if err := w.handleWSMessage(websocket.BinaryMessage, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(delivered) != 1 || !bytes.Equal(delivered[0], toSocks) {
+		t.Errorf("Expected packet delivered to endpoint, got %v", delivered)
+	}
+
+	if err := socks.Send(udpPkt(tunIP, net.IP{1, 1, 1, 1}, 5353, 53)); err == nil {
+		t.Error("Expected error sending from a port outside the endpoint")
+	}
+	fromSocks := udpPkt(tunIP, net.IP{1, 1, 1, 1}, 40001, 53)
+	if err := socks.Send(fromSocks); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received:
+		if !bytes.Equal(msg, fromSocks) {
+			t.Errorf("Unexpected packet from endpoint %v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for endpoint packet")
+	}
+
+	w.RemoveEndpoint(socks)
+	if err := socks.Send(fromSocks); err == nil {
+		t.Error("Expected error sending from removed endpoint")
+	}
+	mockIfce.EXPECT().Write(toSocks).Return(len(toSocks), nil).Times(1)
+	w.handleWSMessage(websocket.BinaryMessage, toSocks)
+	w.handleWSMessage(websocket.BinaryMessage, toIfce)
+}
+
+func TestRouteMonitor(t *testing.T) {
+	_, tunRoute, _ := net.ParseCIDR("1.1.1.0/24")
+	_, oldRoute, _ := net.ParseCIDR("1.1.2.0/24")
+	_, srvRoute, _ := net.ParseCIDR("203.0.113.5/32")
+	gw := net.IP{192, 168, 0, 1}
+	addr := &net.IPNet{IP: net.IP{192, 168, 0, 2}, Mask: net.CIDRMask(24, 32)}
+	exception := Route{Dst: srvRoute, Gateway: net.IP{10, 0, 0, 1}, Iface: "eth0"}
+
+	// A DHCP renewal wiped the tunnel address and route, the exception is intact.
+	var routes []Route
+	ListRoutes = func() ([]Route, error) { return append([]Route{exception}, routes...), nil }
+	ListAddresses = func(string) ([]*net.IPNet, error) { return nil, nil }
+	AddRoute = func(r Route) error {
+		routes = append(routes, r)
+		return nil
+	}
+	var added []*net.IPNet
+	AddAddress = func(iface string, a *net.IPNet, peer net.IP) error {
+		added = append(added, a)
+		return nil
+	}
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIfce := mocks.NewMockInterface(mockCtrl)
+	w := &WebtunnelClient{
+		ifce:    &Interface{Interface: mockIfce, RoutePrefix: []*net.IPNet{tunRoute}},
+		applied: &TunnelConfig{Iface: "virt0", IP: addr, GWIP: gw, Routes: []*net.IPNet{oldRoute, tunRoute}, Exceptions: []Route{exception}},
+	}
+	w.isWSReady.Store(true)
+	w.isNetReady.Store(true)
+	if err := w.SetRouteMonitor(-time.Second, nil); err == nil {
+		t.Error("Expected error for negative interval")
+	}
+	events := make(chan RepairEvent, 10)
+	w.SetRouteMonitor(10*time.Millisecond, func(ev RepairEvent) {
+		w.isStopped.Store(true) // One check only.
+		events <- ev
+	})
+	go w.processRouteMonitor()
+
+	select {
+	case ev := <-events:
+		if len(ev.Repaired) != 2 || len(ev.Failed) != 0 {
+			t.Errorf("Expected address and route repaired, got %v %v", ev.Repaired, ev.Failed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for repair")
+	}
+	// The route removed by a config update is not reinstalled.
+	if len(routes) != 1 || routes[0].Dst != tunRoute || !routes[0].Gateway.Equal(gw) || routes[0].Iface != "virt0" {
+		t.Errorf("Unexpected routes %v", routes)
+	}
+	if len(added) != 1 || added[0] != addr {
+		t.Errorf("Unexpected addresses %v", added)
+	}
+
+	// Nothing to repair while the address is present.
+	ListAddresses = func(string) ([]*net.IPNet, error) { return []*net.IPNet{addr}, nil }
+	if ev := repairTunnel(&TunnelConfig{Iface: "virt0", IP: addr, GWIP: gw, Routes: []*net.IPNet{tunRoute}}); len(ev.Repaired)+len(ev.Failed) != 0 {
+		t.Errorf("Expected no repairs, got %v %v", ev.Repaired, ev.Failed)
+	}
+}
+
+func TestSiteToSite(t *testing.T) {
+	// The server reads the advertisement but never answers keepalives.
+	upgrader := websocket.Upgrader{}
+	adverts := make(chan []byte, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(rw, r, nil)
+		if err != nil {
+			return
+		}
+		_, msg, _ := c.ReadMessage()
+		adverts <- msg
+	}))
+	defer ts.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIfce := mocks.NewMockInterface(mockCtrl)
+	mockIfce.EXPECT().Name().Return("tun0").AnyTimes()
+	_, srvNet, _ := net.ParseCIDR("172.16.0.0/16")
+	gw := net.IP{192, 168, 0, 1}
+	w := &WebtunnelClient{
+		ifce:     &Interface{Interface: mockIfce, RoutePrefix: []*net.IPNet{srvNet}, GWIP: gw},
+		wsconn:   conn,
+		wsWriter: wc.NewWSWriter(conn, nil),
+	}
+	w.isWSReady.Store(true)
+	if err := w.SetSiteToSite([]string{"10.1.0.0/16", "bogus"}, time.Second); err == nil {
+		t.Error("Expected error for invalid prefix")
+	}
+	if err := w.SetSiteToSite([]string{"10.1.0.0/16"}, 30*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.sendSiteAdvert(); err != nil {
+		t.Fatal(err)
+	}
+	advert := &wc.SiteAdvert{}
+	msg := <-adverts
+	if !strings.HasPrefix(string(msg), wc.SiteAdvertPrefix) || wc.DecodeControl(w.codec(), msg[len(wc.SiteAdvertPrefix):], advert) != nil {
+		t.Fatalf("Unexpected advertisement %q", msg)
+	}
+	if !reflect.DeepEqual(advert.Prefixes, []string{"10.1.0.0/16"}) {
+		t.Errorf("Expected advertised prefixes, got %v", advert.Prefixes)
+	}
+
+	b, _ := wc.EncodeControl(w.codec(), &wc.SiteAck{Accepted: []string{"10.1.0.0/16"}, Prefixes: []string{"172.16.0.0/16"}})
+	if err := w.handleWSMessage(websocket.TextMessage, append([]byte(wc.SiteAckPrefix), b...)); err != nil {
+		t.Fatal(err)
+	}
+	if s := w.SiteStatus(); s == nil || !reflect.DeepEqual(s.Accepted, []string{"10.1.0.0/16"}) {
+		t.Errorf("Unexpected site status %+v", s)
+	}
+
+	// Unanswered keepalives withdraw the tunnel routes.
+	withdrawn := make(chan Route, 1)
+	DeleteRoute = func(r Route) error {
+		w.isStopped.Store(true)
+		withdrawn <- r
+		return nil
+	}
+	go w.processSiteKeepalive()
+	select {
+	case r := <-withdrawn:
+		if r.Dst != srvNet || !r.Gateway.Equal(gw) || r.Iface != "tun0" || !w.site.withdrawn {
+			t.Errorf("Unexpected withdrawn route %v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for route withdrawal")
+	}
+
+	// Reconnecting reinstalls them.
+	var added []Route
+	AddRoute = func(r Route) error {
+		added = append(added, r)
+		return nil
+	}
+	w.sendSiteAdvert()
+	if len(added) != 1 || added[0].Dst != srvNet || w.site.withdrawn {
+		t.Errorf("Expected tunnel route reinstalled, got %v", added)
+	}
+}
+
+func TestDeadPeer(t *testing.T) {
+	// The first server answers pings, the second one is half-open.
+	var answer atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		c, err := (&websocket.Upgrader{}).Upgrade(rw, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if !answer.Load() {
+			c.SetPingHandler(func(string) error { return nil })
+		}
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+
+	w := &WebtunnelClient{}
+	if err := w.SetDeadPeerDetection(time.Second, time.Millisecond); err == nil {
+		t.Error("Expected error for pong timeout shorter than the interval")
+	}
+	w.SetDeadPeerDetection(20*time.Millisecond, 100*time.Millisecond)
+	go w.processDeadPeer()
+	defer func() { w.isStopped.Store(true) }()
+
+	for _, alive := range []bool{true, false} {
+		answer.Store(alive)
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.setConn(conn, http.Header{})
+		// Pongs are handled by the read loop.
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_, _, err = conn.ReadMessage()
+		var ne net.Error
+		if closed := !errors.As(err, &ne) || !ne.Timeout(); closed == alive {
+			t.Errorf("Server answering %v: got connection closed %v (%v)", alive, closed, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestAdaptiveKeepalive(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	msgs := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(rw, r, nil)
+		if err != nil {
+			return
+		}
+		for {
+			_, msg, err := c.ReadMessage()
+			if err != nil {
+				close(msgs)
+				return
+			}
+			msgs <- string(msg)
+		}
+	}))
+	defer ts.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	w := &WebtunnelClient{wsconn: conn, wsWriter: wc.NewWSWriter(conn, nil), keepaliveOK: true}
+	w.isWSReady.Store(true)
+	if err := w.SetAdaptiveKeepalive(time.Second, time.Minute); err == nil {
+		t.Error("Expected error for interval under the server minimum")
+	}
+	if err := w.SetAdaptiveKeepalive(20*time.Second, 40*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-msgs:
+			if got != want {
+				t.Errorf("Expected %q, got %q", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %q", want)
+		}
+	}
+	w.negotiateKeepalive()
+	expect("keepalive 20")
+
+	// Enough pings at an interval probe a longer one, up to the maximum.
+	for i := 0; i < keepaliveProbeCount; i++ {
+		w.keepalivePinged()
+	}
+	expect("keepalive 30")
+	for i := 0; i < keepaliveProbeCount; i++ {
+		w.keepalivePinged()
+	}
+	expect("keepalive 40")
+	w.handleWSMessage(websocket.TextMessage, wc.KeepaliveAckMessage(35*time.Second))
+	if d := w.KeepaliveInterval(); d != 35*time.Second {
+		t.Errorf("Expected server interval 35s, got %v", d)
+	}
+
+	// Reconnecting while probing backs off to the last good interval for good.
+	w.negotiateKeepalive()
+	expect("keepalive 30")
+	for i := 0; i < 2*keepaliveProbeCount; i++ {
+		w.keepalivePinged()
+	}
+	if d := w.KeepaliveInterval(); d != 30*time.Second {
+		t.Errorf("Expected settled interval 30s, got %v", d)
+	}
+	if s := w.GetStatus().Keepalive; s != "30s" {
+		t.Errorf("Expected status keepalive 30s, got %v", s)
+	}
+
+	// A late ping closes the connection.
+	w.keepalive.lastPing = time.Now().Add(-time.Hour)
+	keepaliveCheck = 10 * time.Millisecond
+	go w.processKeepalive()
+	for range msgs {
+	}
+}
+
+func TestPowerSaving(t *testing.T) {
+	w := &WebtunnelClient{}
+	w.isWSReady.Store(true)
+	if err := w.SetPowerSaving(0, false); err == nil {
+		t.Error("Expected error for zero idle period")
+	}
+	w.SetPowerSaving(50*time.Millisecond, true)
+	go w.processPowerSaving()
+
+	waitIdle := func(idle bool) {
+		t.Helper()
+		for start := time.Now(); w.IsIdle() != idle; time.Sleep(5 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("Timed out waiting for idle %v", idle)
+			}
+		}
+	}
+	waitIdle(true)
+	if !w.GetStatus().Idle {
+		t.Error("Expected idle status")
+	}
+
+	// Background checks are suspended until traffic wakes the client up.
+	done := make(chan struct{})
+	go func() {
+		w.idleSleep(time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Expected check suspended while idle")
+	case <-time.After(100 * time.Millisecond):
+	}
+	w.updateMetricsForPacket(100)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected check resumed on traffic")
+	}
+	if w.IsIdle() {
+		t.Error("Expected client active after traffic")
+	}
+
+	// Without keepalive only mode checks are slowed down instead.
+	waitIdle(true)
+	w.power.keepaliveOnly = false
+	start := time.Now()
+	w.idleSleep(20 * time.Millisecond)
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Errorf("Expected check slowed down while idle, slept %v", d)
+	}
+}
+
+func TestServerVersion(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(version.Header) != version.Version {
+			t.Errorf("Expected client version in handshake, got %q", r.Header.Get(version.Header))
+		}
+		if r.URL.Query().Get("old") != "" {
+			http.Error(rw, "server requires client >= 9.0.0, client is 1.0.0", http.StatusUpgradeRequired)
+			return
+		}
+		if c, err := upgrader.Upgrade(rw, r, http.Header{version.Header: []string{"1.2.0"}}); err == nil {
+			c.Close()
+		}
+	}))
+	defer ts.Close()
+	u := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	client, err := NewWebtunnelClient("127.0.0.1:1", websocket.DefaultDialer, false, nil, true, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetMinServerVersion("one"); err == nil {
+		t.Error("Expected error for invalid version")
+	}
+	conn, _, err := client.dial(u, http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if v := client.ServerVersion(); v != "1.2.0" {
+		t.Errorf("Expected server version 1.2.0, got %q", v)
+	}
+
+	client.SetMinServerVersion("1.3")
+	if _, _, err := client.dial(u, http.Header{}); err == nil || !strings.Contains(err.Error(), "client requires server >= 1.3.0, server is 1.2.0") {
+		t.Errorf("Expected server too old, got %v", err)
+	}
+	if _, _, err := client.dial(u+"?old=1", http.Header{}); err == nil || !strings.Contains(err.Error(), "server requires client >= 9.0.0") {
+		t.Errorf("Expected client too old, got %v", err)
+	}
+}
+
+func TestSeqDedup(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIfce := mocks.NewMockInterface(mockCtrl)
+	mockIfce.EXPECT().IsTAP().Return(false).AnyTimes()
+
+	w := &WebtunnelClient{ifce: &Interface{Interface: mockIfce, IP: net.IP{192, 168, 0, 2}}, seqDedup: true}
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.IPv4{Version: 4, IHL: 5, TTL: 64, SrcIP: net.IP{1, 1, 1, 1}, DstIP: net.IP{192, 168, 0, 2}},
+		gopacket.Payload([]byte{1, 2, 3, 4}))
+	pkt := buf.Bytes()
+	frame := func(seq byte) []byte {
+		return append([]byte{0x10, 0, 0, 0, seq}, pkt...)
+	}
+
+	// Frames sent again are delivered once.
+	mockIfce.EXPECT().Write(pkt).Return(len(pkt), nil).Times(2)
+	for _, seq := range []byte{1, 2, 2} {
+		if err := w.handleWSMessage(websocket.BinaryMessage, frame(seq)); err != nil {
+			t.Error(err)
+		}
+	}
+	if s := w.loss.Stats(); s.Duplicates != 1 {
+		t.Errorf("Expected 1 duplicate, got %+v", s)
+	}
+
+	// The window is kept if the server continued its sequence and reset otherwise.
+	w.continueStream(&wc.ClientConfig{ServerInfo: &wc.ServerInfo{SeqContinued: true}})
+	if err := w.handleWSMessage(websocket.BinaryMessage, frame(2)); err != nil {
+		t.Error(err)
+	}
+	w.continueStream(&wc.ClientConfig{ServerInfo: &wc.ServerInfo{}})
+	mockIfce.EXPECT().Write(pkt).Return(len(pkt), nil).Times(1)
+	if err := w.handleWSMessage(websocket.BinaryMessage, frame(1)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIfce := mocks.NewMockInterface(mockCtrl)
+	mockIfce.EXPECT().Close().Return(nil).Times(1)
+	NewWaterInterface = func(c water.Config) (wc.Interface, error) {
+		if c.DeviceType == water.TAP {
+			return nil, fmt.Errorf("driver not found")
+		}
+		return mockIfce, nil
+	}
+	IsPrivileged = func() bool { return true }
+	CheckDNSAccess = func() error { return fmt.Errorf("read-only resolv.conf") }
+	_, def, _ := net.ParseCIDR("0.0.0.0/0")
+	ListRoutes = func() ([]Route, error) {
+		return []Route{{Dst: def, Gateway: net.IP{10, 0, 0, 1}, Iface: "eth0"}}, nil
+	}
+	var added, deleted []Route
+	AddRoute = func(r Route) error { added = append(added, r); return nil }
+	DeleteRoute = func(r Route) error { deleted = append(deleted, r); return nil }
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	w, err := NewWebtunnelClient(strings.TrimPrefix(srv.URL, "http://"), websocket.DefaultDialer, false, nil, false, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := w.Preflight()
+	if report.OK() || len(report.Failures()) != 1 || report.Failures()[0].Name != CheckDNS {
+		t.Errorf("Expected only the DNS check failed, got\n%v", report)
+	}
+	if len(added) != 1 || !reflect.DeepEqual(added, deleted) || added[0].Dst.String() != "192.0.2.1/32" || added[0].Iface != "eth0" {
+		t.Errorf("Expected test route added and removed via the default gateway, got %v %v", added, deleted)
+	}
+
+	// Driver and reachability failures are reported, the device type is unchanged.
+	w, _ = NewWebtunnelClient("127.0.0.1:1", websocket.DefaultDialer, true, nil, false, 30)
+	w.SetDeviceFallback(true)
+	NewWaterInterface = func(c water.Config) (wc.Interface, error) {
+		return nil, fmt.Errorf("driver not found")
+	}
+	failed := map[string]bool{}
+	for _, c := range w.Preflight().Failures() {
+		failed[c.Name] = true
+	}
+	if !failed[CheckDriver] || !failed[CheckReachability] || failed[CheckRoutes] {
+		t.Errorf("Expected driver and server failures, got %v", failed)
+	}
+	if v := w.ActiveDeviceType(); v != "TAP" {
+		t.Errorf("Expected device type kept, got %v", v)
+	}
+}
+
+func TestConfigTimeout(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	conns := make(chan int, 10)
+	var n, answer int32 // Connections, and the one answering the config request or 0 for none.
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(rw, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		id := atomic.AddInt32(&n, 1)
+		conns <- int(id)
+		if _, _, err := c.ReadMessage(); err != nil {
+			return
+		}
+		if id == atomic.LoadInt32(&answer) {
+			c.WriteJSON(&wc.ClientConfig{IP: "192.168.0.2", ServerInfo: &wc.ServerInfo{}})
+		}
+		c.ReadMessage()
+	}))
+	defer ts.Close()
+	url := "ws://" + ts.Listener.Addr().String() + "/ws"
+
+	client, err := NewWebtunnelClient(ts.Listener.Addr().String(), websocket.DefaultDialer, false, nil, false, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetConfigTimeout(-time.Second, 0); err == nil {
+		t.Error("Expected error for negative timeout")
+	}
+	if err := client.SetConfigTimeout(200*time.Millisecond, 2); err != nil {
+		t.Fatal(err)
+	}
+	reconnect := func() error { return client.connect(url, http.Header{}) }
+
+	// The config arrives on the second connection after the first request timed out.
+	atomic.StoreInt32(&answer, 2)
+	if err := reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := client.fetchConfig(&wc.ConfigRequest{Username: "user", Hostname: "host"}, reconnect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.IP != "192.168.0.2" {
+		t.Errorf("Expected config for 192.168.0.2, got %v", cfg.IP)
+	}
+	if len(conns) != 2 {
+		t.Errorf("Expected 2 connections, got %v", len(conns))
+	}
+
+	// The server never answers, all attempts time out.
+	for len(conns) > 0 {
+		<-conns
+	}
+	atomic.StoreInt32(&answer, 0)
+	if err := reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := client.fetchConfig(&wc.ConfigRequest{Username: "user", Hostname: "host"}, reconnect); !errors.Is(err, wc.ErrConfigTimeout) {
+		t.Errorf("Expected ErrConfigTimeout, got %v", err)
+	}
+	if len(conns) != 3 {
+		t.Errorf("Expected 3 connections, got %v", len(conns))
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Expected to give up after 3 timeouts, took %v", d)
+	}
+}
+
+func TestFetchConfig(t *testing.T) {
+	expiry := time.Now().Add(time.Minute)
+	lease := &wc.ClientConfig{IP: "192.168.0.5", RoutePrefix: []string{"1.1.1.0/24"}, LeaseExpiry: &expiry,
+		ServerInfo: &wc.ServerInfo{Session: "token", Instance: "gw1"}}
+	var query url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		query = r.URL.Query()
+		json.NewEncoder(rw).Encode(lease)
+	}))
+	defer ts.Close()
+
+	client, err := NewWebtunnelClient(ts.Listener.Addr().String(), websocket.DefaultDialer, false, nil, false, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.FetchConfig(); !errors.Is(err, wc.ErrAuthFailed) {
+		t.Errorf("Expected ErrAuthFailed, got %v", err)
+	}
+	client.SetCredentials("user", "pass")
+	cfg, err := client.FetchConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.IP != lease.IP || query.Get("hostname") == "" {
+		t.Errorf("Expected lease of %v for the host, got %v with query %v", lease.IP, cfg.IP, query)
+	}
+	if client.affinity != "gw1" {
+		t.Errorf("Expected affinity to the leasing instance, got %q", client.affinity)
+	}
+	// The affinity token is added to the parameters of the handshake URL.
+	u := url.URL{Path: "/ws", RawQuery: "access_token=t0k3n"}
+	client.setAffinity(&u, http.Header{})
+	if q := u.Query(); q.Get("access_token") != "t0k3n" || q.Get(wc.AffinityParam) != "gw1" {
+		t.Errorf("Expected access token and affinity in the query, got %v", u.RawQuery)
+	}
+	if got, err := client.configLease(); err != nil || got != cfg {
+		t.Errorf("Expected fetched lease claimed on Start, got %v %v", got, err)
+	}
+
+	// Expired leases are not claimed, and fetched again if enabled.
+	expired := time.Now().Add(-time.Second)
+	cfg.LeaseExpiry = &expired
+	if got, err := client.configLease(); err != nil || got != nil {
+		t.Errorf("Expected no lease after expiry, got %v %v", got, err)
+	}
+	client.SetOutOfBandConfig(true)
+	if got, err := client.configLease(); err != nil || got == nil {
+		t.Errorf("Expected lease fetched on Start, got %v %v", got, err)
+	}
+
+	// Configs without lease are refused.
+	lease.LeaseExpiry = nil
+	if _, err := client.FetchConfig(); err == nil {
+		t.Error("Expected error for config without lease")
+	}
+}
+
+func TestDNSRoutes(t *testing.T) {
+	cfg := &wc.ClientConfig{DNSRoutes: []wc.DNSRoute{
+		{Domains: []string{"corp.example.com", "1.10.in-addr.arpa"}, Servers: []string{"10.1.0.53"}},
+	}}
+	routes, err := parseDNSRoutes(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DNSRoute{{Domains: []string{"corp.example.com", "1.10.in-addr.arpa"}, Servers: []net.IP{{10, 1, 0, 53}}}}
+	if !reflect.DeepEqual(routes, want) {
+		t.Errorf("Got DNS routes %+v want %+v", routes, want)
+	}
+	for _, bad := range []wc.DNSRoute{
+		{Domains: []string{"corp.example.com"}},
+		{Domains: []string{"bad domain"}, Servers: []string{"10.1.0.53"}},
+		{Domains: []string{"corp.example.com"}, Servers: []string{"dns"}},
+	} {
+		if _, err := parseDNSRoutes(&wc.ClientConfig{DNSRoutes: []wc.DNSRoute{bad}}); err == nil {
+			t.Errorf("Expected error for %+v", bad)
+		}
+	}
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIfce := mocks.NewMockInterface(mockCtrl)
+	mockIfce.EXPECT().Name().Return("tun0").AnyTimes()
+	defer func(add func(string, []DNSRoute) error, remove func(string) error) {
+		AddDNSRoutes, RemoveDNSRoutes = add, remove
+	}(AddDNSRoutes, RemoveDNSRoutes)
+	var added []DNSRoute
+	removed := 0
+	AddDNSRoutes = func(ifName string, routes []DNSRoute) error {
+		added = routes
+		return nil
+	}
+	RemoveDNSRoutes = func(ifName string) error {
+		removed++
+		return nil
+	}
+
+	// Updates replace the routes, Stop removes them.
+	w := &WebtunnelClient{ifce: &Interface{Interface: mockIfce, DNSRoutes: routes}}
+	w.applyDNSPolicy()
+	if !reflect.DeepEqual(added, routes) || removed != 0 {
+		t.Errorf("Expected routes added, got %v removed %v times", added, removed)
+	}
+	w.applyDNSPolicy()
+	if removed != 1 {
+		t.Errorf("Expected routes replaced, removed %v times", removed)
+	}
+	w.removeDNSPolicy()
+	w.removeDNSPolicy()
+	if removed != 2 {
+		t.Errorf("Expected routes removed once on stop, removed %v times", removed)
+	}
+}
+
+func TestPeerToPeer(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIfce := mocks.NewMockInterface(mockCtrl)
+	mockIfce.EXPECT().IsTAP().Return(false).AnyTimes()
+	written := make(chan []byte, 1)
+	mockIfce.EXPECT().Write(gomock.Any()).DoAndReturn(func(p []byte) (int, error) {
+		written <- append([]byte(nil), p...)
+		return len(p), nil
+	}).Times(2)
+
+	newPeer := func(ip net.IP) *WebtunnelClient {
+		w := &WebtunnelClient{ifce: &Interface{Interface: mockIfce, IP: ip, Netmask: net.IP{255, 255, 255, 0}, GWIP: net.IP{192, 168, 0, 1}}}
+		w.SetPeerToPeer(true)
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.p2p.conn = conn
+		go w.processP2PFrames(conn)
+		return w
+	}
+	a := newPeer(net.IP{192, 168, 0, 2})
+	defer a.closeP2P()
+	b := newPeer(net.IP{192, 168, 0, 3})
+	defer b.closeP2P()
+
+	key := make([]byte, 32)
+	offer := func(w *WebtunnelClient, peer string, addrs ...string) {
+		msg, _ := wc.EncodeControl(w.codec(), &wc.P2PMessage{Type: wc.P2POffer, Peer: peer, Addrs: addrs, Key: key})
+		w.processP2P(msg)
+	}
+	offer(a, "192.168.0.3", b.p2p.conn.LocalAddr().String())
+	offer(b, "192.168.0.2", a.p2p.conn.LocalAddr().String())
+
+	// Probes of either peer open the path both ways.
+	a.p2pTick(time.Now())
+	for i := 0; len(a.PeerPaths()) == 0 || len(b.PeerPaths()) == 0; i++ {
+		if i == 100 {
+			t.Fatalf("Expected direct path, got %v and %v", a.PeerPaths(), b.PeerPaths())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := b.PeerPaths()["192.168.0.2"]; got != a.p2p.conn.LocalAddr().String() {
+		t.Errorf("Expected path to A via %v, got %v", a.p2p.conn.LocalAddr(), got)
+	}
+
+	// Packets to the peer take the path, packets to the gateway and others are relayed.
+	pkt := createIPv4Pkt(net.IP{192, 168, 0, 2}, net.IP{192, 168, 0, 3})
+	if !a.sendDirect(pkt) {
+		t.Error("Expected packet sent directly")
+	}
+	select {
+	case got := <-written:
+		if !bytes.Equal(got, pkt) {
+			t.Errorf("Got packet %x want %x", got, pkt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected packet from peer")
+	}
+	for _, dst := range []net.IP{{192, 168, 0, 1}, {10, 0, 0, 1}, {192, 168, 0, 4}} {
+		if a.sendDirect(createIPv4Pkt(net.IP{192, 168, 0, 2}, dst)) {
+			t.Errorf("Expected packet to %v relayed", dst)
+		}
+	}
+
+	// Replayed frames are dropped and do not move the path, even from another address.
+	frame := a.p2p.peers["192.168.0.3"].cipher.Seal(wc.P2PFrameData, pkt)
+	a.p2p.conn.WriteToUDP(frame, b.p2p.conn.LocalAddr().(*net.UDPAddr))
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected packet from peer")
+	}
+	replayer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replayer.Close()
+	replayer.WriteToUDP(frame, b.p2p.conn.LocalAddr().(*net.UDPAddr))
+	select {
+	case <-written:
+		t.Error("Expected replayed frame dropped")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if got := b.PeerPaths()["192.168.0.2"]; got != a.p2p.conn.LocalAddr().String() {
+		t.Errorf("Expected path to A kept after a replay, got %v", got)
+	}
+
+	// Peers can't send packets from other sources.
+	spoofed := createIPv4Pkt(net.IP{192, 168, 0, 9}, net.IP{192, 168, 0, 3})
+	a.p2p.conn.WriteToUDP(a.p2p.peers["192.168.0.3"].cipher.Seal(wc.P2PFrameData, spoofed), b.p2p.conn.LocalAddr().(*net.UDPAddr))
+	time.Sleep(50 * time.Millisecond)
+
+	// Silent paths fall back to the relay.
+	a.p2pTick(time.Now().Add(P2PIdleTimeout + time.Second))
+	if len(a.PeerPaths()) != 0 || a.sendDirect(pkt) {
+		t.Errorf("Expected path dropped, got %v", a.PeerPaths())
+	}
+	if a.p2p.relayed["192.168.0.3"] != len(pkt) {
+		t.Errorf("Expected relayed bytes counted, got %v", a.p2p.relayed)
+	}
+
+	// Unreachable peers fall back to the relay after punching.
+	offer(a, "192.168.0.4", "127.0.0.1:9")
+	a.p2pTick(time.Now())
+	a.p2pTick(time.Now().Add(P2PPunchTimeout + time.Second))
+	if _, ok := a.p2p.peers["192.168.0.4"]; ok {
+		t.Error("Expected unreachable peer dropped")
+	}
+}
+
+func TestBufferSizes(t *testing.T) {
+	client, err := NewWebtunnelClient("127.0.0.1:1", websocket.DefaultDialer, false, nil, true, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := func() (int, int) {
+		d := *client.wsDialer
+		if err := client.sizeBuffers(&d); err != nil {
+			t.Fatal(err)
+		}
+		return d.ReadBufferSize, d.WriteBufferSize
+	}
+	if r, w := sizes(); r != wc.MaxPacketSize+5 || w != wc.MaxPacketSize+5 {
+		t.Errorf("Expected buffers for a sequenced packet, got %v %v", r, w)
+	}
+
+	// Padded frames and MTU probes are held whole.
+	if err := client.SetObfuscation(&wc.ObfuscationPolicy{PadMax: wc.MaxMessageSize}); err == nil {
+		t.Error("Expected error for frames over the message limit")
+	}
+	if err := client.SetObfuscation(&wc.ObfuscationPolicy{PadBucket: 512}); err != nil {
+		t.Fatal(err)
+	}
+	if _, w := sizes(); w != wc.MaxPacketSize+5+511 {
+		t.Errorf("Expected buffer for a padded packet, got %v", w)
+	}
+	client.SetMTUProbe(0, 9000)
+	if _, w := sizes(); w != 9000 {
+		t.Errorf("Expected buffer for the largest probe, got %v", w)
+	}
+
+	// Larger buffers of the caller are kept.
+	client.wsDialer = &websocket.Dialer{ReadBufferSize: 1024, WriteBufferSize: 16384}
+	if r, w := sizes(); r != 1024 || w != 16384 {
+		t.Errorf("Expected caller buffers kept, got %v %v", r, w)
+	}
+}
+
+func TestControlFallback(t *testing.T) {
+	// Servers offering control messages get an envelope, older servers the text command.
+	for _, offer := range []string{"1", ""} {
+		requests := make(chan []byte, 1)
+		ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			h := http.Header{}
+			if offer != "" {
+				h.Set(wc.ControlHeader, offer)
+			}
+			c, err := (&websocket.Upgrader{}).Upgrade(rw, r, h)
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			_, b, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			requests <- b
+			cfg := &wc.ClientConfig{IP: "192.168.0.2", ServerInfo: &wc.ServerInfo{}}
+			if offer == "" {
+				c.WriteJSON(cfg)
+			} else {
+				b, _ := wc.EncodeControlMessage(wc.JSONCodec{}, &wc.ControlMessage{Type: wc.CtlConfigResponse,
+					ConfigResponse: &wc.ConfigResponse{Config: cfg, Capabilities: []string{wc.CapDisconnect}}})
+				c.WriteMessage(websocket.TextMessage, b)
+			}
+			c.ReadMessage()
+		}))
+		client, err := NewWebtunnelClient(ts.Listener.Addr().String(), websocket.DefaultDialer, false, nil, false, 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.connect("ws://"+ts.Listener.Addr().String()+"/ws", http.Header{}); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := client.fetchConfig(&wc.ConfigRequest{Username: "user", Hostname: "host", Session: "token"}, nil)
+		if err != nil || cfg.IP != "192.168.0.2" {
+			t.Errorf("Expected config for 192.168.0.2, got %+v %v", cfg, err)
+		}
+		req := <-requests
+		if offer == "" {
+			if string(req) != "getConfig user host token" {
+				t.Errorf("Expected text config request, got %q", req)
+			}
+			if client.hasCapability(wc.CapDisconnect) {
+				t.Error("Expected no capabilities without control messages")
+			}
+		} else {
+			m, err := wc.ParseControlMessage(wc.JSONCodec{}, req)
+			if err != nil || m.ConfigRequest == nil || m.ConfigRequest.Session != "token" ||
+				!reflect.DeepEqual(m.ConfigRequest.Capabilities, clientCapabilities) {
+				t.Errorf("Unexpected config request %q %v", req, err)
+			}
+			if !client.hasCapability(wc.CapDisconnect) || client.hasCapability(wc.CapPing) {
+				t.Errorf("Expected only the disconnect capability, got %v", client.ctl.capabilities)
+			}
+			if _, err := client.PingServer(time.Second); err == nil {
+				t.Error("Expected error pinging without the ping capability")
+			}
+		}
+		client.wsWriter.Close()
+		client.wsconn.Close()
+		ts.Close()
+	}
+}
@@ -0,0 +1,122 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+)
+
+// AF_INET address family of the IP helper notifications.
+const afInet = 2
+
+var (
+	modIphlpapi                      = syscall.NewLazyDLL("iphlpapi.dll")
+	procNotifyIpInterfaceChange      = modIphlpapi.NewProc("NotifyIpInterfaceChange")
+	procNotifyUnicastIpAddressChange = modIphlpapi.NewProc("NotifyUnicastIpAddressChange")
+	procCancelMibChangeNotify2       = modIphlpapi.NewProc("CancelMibChangeNotify2")
+)
+
+// ifChange holds the waiters woken up by interface and address change notifications.
+// Callbacks are never released by the runtime, so a single one serves all waiters.
+var ifChange = struct {
+	callback uintptr
+	waiters  map[chan struct{}]bool
+	once     sync.Once
+	lock     sync.Mutex
+}{waiters: make(map[chan struct{}]bool)}
+
+// notifyInterfaceChanges returns a channel receiving a value after IPv4 interface or
+// address changes, until cancel is called.
+func notifyInterfaceChanges() (events <-chan struct{}, cancel func(), err error) {
+	if err := modIphlpapi.Load(); err != nil {
+		return nil, nil, fmt.Errorf("error loading iphlpapi %w", err)
+	}
+	ifChange.once.Do(func() {
+		ifChange.callback = syscall.NewCallback(func(ctx, row, typ uintptr) uintptr {
+			ifChange.lock.Lock()
+			defer ifChange.lock.Unlock()
+			for ch := range ifChange.waiters {
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+			return 0
+		})
+	})
+
+	ch := make(chan struct{}, 1)
+	ifChange.lock.Lock()
+	ifChange.waiters[ch] = true
+	ifChange.lock.Unlock()
+	var handles []uintptr
+	cancel = func() {
+		// Waits for running callbacks, which take the lock.
+		for _, h := range handles {
+			procCancelMibChangeNotify2.Call(h)
+		}
+		ifChange.lock.Lock()
+		delete(ifChange.waiters, ch)
+		ifChange.lock.Unlock()
+	}
+	for _, proc := range []*syscall.LazyProc{procNotifyIpInterfaceChange, procNotifyUnicastIpAddressChange} {
+		var h uintptr
+		if ret, _, _ := proc.Call(afInet, ifChange.callback, 0, 0, uintptr(unsafe.Pointer(&h))); ret != 0 {
+			cancel()
+			return nil, nil, fmt.Errorf("error registering for interface changes %w", syscall.Errno(ret))
+		}
+		handles = append(handles, h)
+	}
+	return ch, cancel, nil
+}
+
+// waitInterfaceReady blocks until interface ifName is configured with ip. It waits for IP
+// helper interface and address change notifications instead of polling and rechecks on
+// every change.
+func waitInterfaceReady(ifName, ip string, timeout time.Duration) error {
+	if IsConfigured(ifName, ip) {
+		return nil
+	}
+	events, cancel, err := notifyInterfaceChanges()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		// Recheck after subscribing to avoid missing a change raised in between.
+		if IsConfigured(ifName, ip) {
+			return nil
+		}
+		select {
+		case <-events:
+		case <-deadline.C:
+			return fmt.Errorf("interface %s %w with %s after %v", ifName, wc.ErrNotConfigured, ip, timeout)
+		}
+	}
+}
+
+// setInterfaceMTU sets the MTU of interface ifName until the next restart.
+func setInterfaceMTU(ifName string, mtu int) error {
+	cmd := exec.Command("netsh", "interface", "ipv4", "set", "subinterface", ifName, "mtu="+strconv.Itoa(mtu), "store=active")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error setting mtu %w %s", err, out)
+	}
+	return nil
+}
+
+// openBrowser opens url in the default browser.
+func openBrowser(url string) error {
+	if err := exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start(); err != nil {
+		return fmt.Errorf("error opening browser %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package webtunnelclient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+)
+
+// Defaults of the config fetch policy.
+const (
+	defaultConfigTimeout = 30 * time.Second
+	defaultConfigRetries = 2
+)
+
+/*
+SetConfigTimeout sets how long the server has to send the client config after it was
+requested, on connect and reconnect. A websocket connection that timed out can't be read
+again, so each of the retries dials the server again and repeats the request. Once all
+attempts timed out Start and Retry return an error wrapping wc.ErrConfigTimeout. A zero
+timeout waits for the config forever. This should be called prior to Start.
+*/
+func (w *WebtunnelClient) SetConfigTimeout(timeout time.Duration, retries int) error {
+	if timeout < 0 || retries < 0 {
+		return fmt.Errorf("invalid config timeout %v with %v retries", timeout, retries)
+	}
+	w.configTimeout = timeout
+	w.configRetries = retries
+	return nil
+}
+
+// connect dials the server and switches to the new connection.
+func (w *WebtunnelClient) connect(url string, header http.Header) error {
+	wsconn, respHeader, err := w.dial(url, header)
+	if err != nil {
+		return err
+	}
+	if w.wsWriter != nil {
+		w.wsWriter.Close()
+	}
+	w.setConn(wsconn, respHeader)
+	return nil
+}
+
+// fetchConfig sends req to the server and returns the config it answers with. If the
+// config doesn't arrive in time the connection is replaced by reconnect and req is sent
+// again, up to the configured retries.
+func (w *WebtunnelClient) fetchConfig(req *wc.ConfigRequest, reconnect func() error) (*wc.ClientConfig, error) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			glog.Warningf("no config from server within %v, retrying (%v/%v)", w.configTimeout, attempt, w.configRetries)
+			if err := reconnect(); err != nil {
+				return nil, err
+			}
+		}
+		cfg, err := w.requestConfig(req)
+		if err == nil {
+			w.prom.ObserveHandshake(time.Since(w.connectedAt))
+			w.prom.SetSessions(1)
+			return cfg, nil
+		}
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			return nil, err
+		}
+		if attempt >= w.configRetries {
+			return nil, fmt.Errorf("no config from server after %v attempts of %v: %w", attempt+1, w.configTimeout, wc.ErrConfigTimeout)
+		}
+	}
+}
+
+// requestConfig sends req on the current connection and reads the config answer within
+// the config timeout.
+func (w *WebtunnelClient) requestConfig(req *wc.ConfigRequest) (*wc.ClientConfig, error) {
+	if err := w.writeConfigRequest(req); err != nil {
+		return nil, err
+	}
+	if w.configTimeout > 0 {
+		w.wsconn.SetReadDeadline(time.Now().Add(w.configTimeout))
+		defer w.wsconn.SetReadDeadline(time.Time{})
+	}
+	cfg := &wc.ClientConfig{}
+	if err := w.readConfig(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
@@ -0,0 +1,197 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// Capabilities the client requests from servers speaking control messages.
+var clientCapabilities = []string{wc.CapPing, wc.CapMetrics, wc.CapDisconnect}
+
+// controlChannel is the control message state of the connection.
+type controlChannel struct {
+	version      int                      // Negotiated control protocol version, 0 for text commands.
+	capabilities []string                 // Capabilities the server accepted.
+	pings        map[uint64]chan struct{} // Pings waiting for their reply.
+	pingID       uint64                   // ID of the last ping sent.
+	lock         sync.Mutex               // Lock for capabilities and pings.
+}
+
+// configRequest returns the config request of the client, continuing session if not
+// empty.
+func (w *WebtunnelClient) configRequest(session string) (*wc.ConfigRequest, error) {
+	userinfo, err := w.getUserInfo()
+	if err != nil {
+		return nil, err
+	}
+	user, host, _ := strings.Cut(userinfo, " ")
+	return &wc.ConfigRequest{Username: user, Hostname: host, Session: session}, nil
+}
+
+// textConfigRequest returns req as the text command of servers without control messages.
+func textConfigRequest(req *wc.ConfigRequest) string {
+	if req.Resume {
+		return "resume " + req.Session
+	}
+	return "getConfig " + req.Username + " " + req.Hostname + " " + req.Session
+}
+
+// writeConfigRequest sends req, as a control message if the server speaks them.
+func (w *WebtunnelClient) writeConfigRequest(req *wc.ConfigRequest) error {
+	if w.ctl.version == 0 {
+		return w.wsWriter.WriteControlMessage(websocket.TextMessage, []byte(textConfigRequest(req)))
+	}
+	r := *req
+	r.Capabilities = clientCapabilities
+	// Reports are bound to the connection, signed again for each one.
+	if w.postureCollector != nil && !r.Resume {
+		report, err := w.postureReport()
+		if err != nil {
+			return fmt.Errorf("error reporting posture %w", err)
+		}
+		r.Posture = report
+	}
+	return w.wsWriter.WriteControl(&wc.ControlMessage{Type: wc.CtlConfigRequest, ConfigRequest: &r})
+}
+
+// decodeConfig decodes the config answer b into cfg. Servers speaking control messages
+// answer with a config response, or an error if the request was refused.
+func (w *WebtunnelClient) decodeConfig(b []byte, cfg *wc.ClientConfig) error {
+	if !wc.IsControlMessage(b) {
+		return wc.DecodeControl(w.codec(), b, cfg)
+	}
+	m, err := wc.ParseControlMessage(w.codec(), b)
+	if err != nil {
+		return err
+	}
+	switch {
+	case m.Type == wc.CtlConfigResponse && m.ConfigResponse != nil && m.ConfigResponse.Config != nil:
+		*cfg = *m.ConfigResponse.Config
+		w.ctl.lock.Lock()
+		w.ctl.capabilities = m.ConfigResponse.Capabilities
+		w.ctl.lock.Unlock()
+		return nil
+	case m.Type == wc.CtlError && m.Error != nil:
+		return fmt.Errorf("config request failed: %w", m.Error)
+	}
+	return fmt.Errorf("unexpected %v control message instead of config", m.Type)
+}
+
+// hasCapability returns true if the server accepted capability c.
+func (w *WebtunnelClient) hasCapability(c string) bool {
+	w.ctl.lock.Lock()
+	defer w.ctl.lock.Unlock()
+	return wc.HasCapability(w.ctl.capabilities, c)
+}
+
+// resetControl sets up the control messages of a new connection offering version in the
+// handshake response. Capabilities are negotiated again by the config request.
+func (w *WebtunnelClient) resetControl(version string) {
+	w.ctl.lock.Lock()
+	defer w.ctl.lock.Unlock()
+	w.ctl.version = wc.NegotiateControl(version)
+	w.ctl.capabilities = nil
+}
+
+// processControl processes a control message from the server after the config. Messages
+// the client does not know are answered with an error.
+func (w *WebtunnelClient) processControl(b []byte) {
+	m, err := wc.ParseControlMessage(w.codec(), b)
+	if err != nil {
+		glog.Warningf("error parsing control message: %v", err)
+		return
+	}
+	var reply *wc.ControlMessage
+	switch {
+	case m.Type == wc.CtlPing && m.Ping != nil && m.Ping.Reply:
+		w.ctl.lock.Lock()
+		if c, ok := w.ctl.pings[m.Ping.ID]; ok {
+			close(c)
+			delete(w.ctl.pings, m.Ping.ID)
+		}
+		w.ctl.lock.Unlock()
+	case m.Type == wc.CtlPing && m.Ping != nil:
+		p := *m.Ping
+		p.Reply = true
+		reply = &wc.ControlMessage{Type: wc.CtlPing, Ping: &p}
+	case m.Type == wc.CtlMetrics && len(m.Metrics) == 0:
+		reply = &wc.ControlMessage{Type: wc.CtlMetrics, Metrics: w.controlMetrics()}
+	case m.Type == wc.CtlDisconnect && m.Disconnect != nil:
+		glog.Warningf("server closing connection: %v", m.Disconnect.Reason)
+	case m.Type == wc.CtlError && m.Error != nil:
+		glog.Warningf("server refused %v: %v", m.Error.Type, m.Error.Message)
+	default:
+		glog.Warningf("refusing %v control message from server", m.Type)
+		reply = &wc.ControlMessage{Type: wc.CtlError,
+			Error: &wc.ControlError{Type: m.Type, Message: "unsupported or malformed message"}}
+	}
+	if reply == nil {
+		return
+	}
+	if err := w.wsWriter.WriteControl(reply); err != nil {
+		glog.Warningf("error answering %v control message: %v", m.Type, err)
+	}
+}
+
+// controlMetrics returns the metrics reported to the server.
+func (w *WebtunnelClient) controlMetrics() map[string]float64 {
+	packets, bytes := w.GetMetrics()
+	return map[string]float64{
+		"packets":           float64(packets),
+		"bytes":             float64(bytes),
+		"connected_seconds": time.Since(w.connectedAt).Seconds(),
+	}
+}
+
+// sendDisconnect tells the server the client is about to close the connection, if it
+// accepts disconnect messages.
+func (w *WebtunnelClient) sendDisconnect(reason string) {
+	if !w.hasCapability(wc.CapDisconnect) {
+		return
+	}
+	if err := w.wsWriter.WriteControl(&wc.ControlMessage{Type: wc.CtlDisconnect,
+		Disconnect: &wc.Disconnect{Reason: reason}}); err != nil {
+		glog.V(1).Infof("error sending disconnect: %v", err)
+	}
+}
+
+// PingServer returns the round trip time to the server through the control messages,
+// including the time queued behind other control messages. The server must have
+// accepted the ping capability.
+func (w *WebtunnelClient) PingServer(timeout time.Duration) (time.Duration, error) {
+	if !w.hasCapability(wc.CapPing) {
+		return 0, fmt.Errorf("server does not answer pings")
+	}
+	c := &w.ctl
+	c.lock.Lock()
+	if c.pings == nil {
+		c.pings = make(map[uint64]chan struct{})
+	}
+	c.pingID++
+	id := c.pingID
+	done := make(chan struct{})
+	c.pings[id] = done
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.pings, id)
+		c.lock.Unlock()
+	}()
+
+	start := time.Now()
+	if err := w.wsWriter.WriteControl(&wc.ControlMessage{Type: wc.CtlPing, Ping: &wc.Ping{ID: id, Sent: start}}); err != nil {
+		return 0, err
+	}
+	select {
+	case <-done:
+		return time.Since(start), nil
+	case <-time.After(timeout):
+		return 0, fmt.Errorf("no ping reply from server within %v", timeout)
+	}
+}
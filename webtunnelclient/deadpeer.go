@@ -0,0 +1,83 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// deadPeer pings the server to detect a dead or half-open connection.
+type deadPeer struct {
+	interval   time.Duration // Time between pings, 0 disables.
+	timeout    time.Duration // Time a ping may go unanswered before the server is dead.
+	unanswered time.Time     // First unanswered ping, zero if none.
+	lock       sync.Mutex
+}
+
+/*
+SetDeadPeerDetection pings the server every interval and closes the connection if no ping
+is answered for timeout, which reports an error on the Error channel so the application
+reconnects with Retry. Otherwise a half-open connection, eg. after the server or a NAT on
+the path lost its state, is only noticed when the OS times out the TCP connection. This
+should be called prior to Start.
+*/
+func (w *WebtunnelClient) SetDeadPeerDetection(interval, timeout time.Duration) error {
+	if interval <= 0 || timeout < interval {
+		return fmt.Errorf("invalid ping interval %v and pong timeout %v", interval, timeout)
+	}
+	w.peer = deadPeer{interval: interval, timeout: timeout}
+	return nil
+}
+
+// pongHandler records the answers to the pings of the client.
+func (w *WebtunnelClient) pongHandler(string) error {
+	w.resetDeadPeer()
+	if w.site != nil {
+		w.site.lastPong = time.Now()
+	}
+	return nil
+}
+
+// resetDeadPeer clears the unanswered ping, eg. of a previous connection.
+func (w *WebtunnelClient) resetDeadPeer() {
+	w.peer.lock.Lock()
+	w.peer.unanswered = time.Time{}
+	w.peer.lock.Unlock()
+}
+
+// processDeadPeer pings the server and closes the connection if it stops answering.
+func (w *WebtunnelClient) processDeadPeer() {
+	p := &w.peer
+	if p.interval == 0 {
+		return
+	}
+	for {
+		w.idleSleep(p.interval)
+		if w.isStopped.Load() {
+			glog.V(1).Info("Exiting dead peer routine")
+			return
+		}
+		if !w.isWSReady.Load() {
+			continue
+		}
+		p.lock.Lock()
+		dead := !p.unanswered.IsZero() && time.Since(p.unanswered) >= p.timeout
+		if dead {
+			p.unanswered = time.Time{}
+		} else if p.unanswered.IsZero() {
+			p.unanswered = time.Now()
+		}
+		p.lock.Unlock()
+		if dead {
+			glog.Warningf("server not answering pings for %v, closing connection", p.timeout)
+			w.wsconn.Close()
+			continue
+		}
+		if err := w.wsconn.WriteControl(websocket.PingMessage, nil, time.Now().Add(p.interval)); err != nil {
+			glog.Warningf("issue sending ping: %v", err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package webtunnelclient
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+)
+
+// FetchServerList retrieves the gateway list from the discovery endpoint url. If key is
+// not nil the list signature is verified.
+func FetchServerList(client *http.Client, url string, key ed25519.PublicKey) ([]wc.GatewayEndpoint, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching server list %v", resp.Status)
+	}
+	list := &wc.ServerList{}
+	if err := json.NewDecoder(resp.Body).Decode(list); err != nil {
+		return nil, fmt.Errorf("error decoding server list %w", err)
+	}
+	if key != nil {
+		if err := wc.VerifyServerList(list, key); err != nil {
+			return nil, err
+		}
+	}
+	return list.Servers, nil
+}
+
+// SelectServer probes the health endpoint of each gateway and returns the healthy one
+// with the lowest measured latency plus its latency hint.
+func SelectServer(client *http.Client, servers []wc.GatewayEndpoint) (wc.GatewayEndpoint, error) {
+	var best wc.GatewayEndpoint
+	bestScore := time.Duration(-1)
+	for _, s := range servers {
+		rtt, err := probeServer(client, s)
+		if err != nil {
+			glog.V(1).Infof("Gateway %v (%v) unhealthy: %v", s.Address, s.Region, err)
+			continue
+		}
+		score := rtt + time.Duration(s.LatencyMs)*time.Millisecond
+		glog.V(1).Infof("Gateway %v (%v) latency %v", s.Address, s.Region, score)
+		if bestScore < 0 || score < bestScore {
+			best, bestScore = s, score
+		}
+	}
+	if bestScore < 0 {
+		return best, fmt.Errorf("no healthy gateway found")
+	}
+	return best, nil
+}
+
+// probeServer returns the latency of the gateway health endpoint.
+func probeServer(client *http.Client, s wc.GatewayEndpoint) (time.Duration, error) {
+	scheme := "http"
+	if s.Secure {
+		scheme = "https"
+	}
+	u := url.URL{Scheme: scheme, Host: s.Address, Path: "/metrichealthz"}
+	start := time.Now()
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("health check returned %v", resp.Status)
+	}
+	return time.Since(start), nil
+}
@@ -0,0 +1,17 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// flushDNSCache flushes the directory services cache and restarts mDNSResponder.
+func flushDNSCache() error {
+	if out, err := exec.Command("/usr/bin/dscacheutil", "-flushcache").CombinedOutput(); err != nil {
+		return fmt.Errorf("error flushing DNS cache %w %s", err, out)
+	}
+	if out, err := exec.Command("/usr/bin/killall", "-HUP", "mDNSResponder").CombinedOutput(); err != nil {
+		return fmt.Errorf("error restarting mDNSResponder %w %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// flushDNSCache flushes the systemd-resolved cache. Systems without a local caching
+// resolver have nothing to flush.
+func flushDNSCache() error {
+	for _, cmd := range [][]string{
+		{"resolvectl", "flush-caches"},
+		{"systemd-resolve", "--flush-caches"},
+	} {
+		if _, err := exec.LookPath(cmd[0]); err != nil {
+			continue
+		}
+		if out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput(); err != nil {
+			return fmt.Errorf("error flushing DNS cache %w %s", err, out)
+		}
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// flushDNSCache flushes the DNS client service cache.
+func flushDNSCache() error {
+	if out, err := exec.Command("ipconfig", "/flushdns").CombinedOutput(); err != nil {
+		return fmt.Errorf("error flushing DNS cache %w %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+)
+
+// AddDNSRoutes (Overridable) Resolve the names under the domains of each route with its servers on interface ifName.
+var AddDNSRoutes = addDNSRoutes
+
+// RemoveDNSRoutes (Overridable) Remove the DNS routes added on interface ifName.
+var RemoveDNSRoutes = removeDNSRoutes
+
+// DNSRoute resolves the names under Domains with Servers instead of the tunnel DNS servers.
+type DNSRoute struct {
+	Domains []string // DNS suffixes, eg. corp.example.com or 10.in-addr.arpa.
+	Servers []net.IP // IPs of the DNS servers.
+}
+
+// parseDNSRoutes returns the split DNS map of the server config.
+func parseDNSRoutes(cfg *wc.ClientConfig) ([]DNSRoute, error) {
+	var routes []DNSRoute
+	for _, r := range cfg.DNSRoutes {
+		route := DNSRoute{}
+		for _, d := range r.Domains {
+			d = strings.ToLower(strings.Trim(d, "."))
+			if d == "" || strings.Trim(d, "abcdefghijklmnopqrstuvwxyz0123456789.-") != "" {
+				return nil, fmt.Errorf("invalid DNS route domain %q", d)
+			}
+			route.Domains = append(route.Domains, d)
+		}
+		for _, s := range r.Servers {
+			ip := net.ParseIP(s).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("invalid DNS route server %q", s)
+			}
+			route.Servers = append(route.Servers, ip)
+		}
+		if len(route.Domains) == 0 || len(route.Servers) == 0 {
+			return nil, fmt.Errorf("incomplete DNS route %+v", r)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// applyDNSRoutes replaces the DNS routes of the interface with the ones of the current
+// config. Failures are logged as names still resolve with the tunnel DNS servers.
+func (w *WebtunnelClient) applyDNSRoutes() {
+	if w.dnsRoutesSet {
+		if err := RemoveDNSRoutes(w.ifce.Name()); err != nil {
+			glog.Warningf("unable to remove DNS routes: %v", err)
+		}
+		w.dnsRoutesSet = false
+	}
+	if len(w.ifce.DNSRoutes) == 0 {
+		return
+	}
+	if err := AddDNSRoutes(w.ifce.Name(), w.ifce.DNSRoutes); err != nil {
+		glog.Warningf("unable to add DNS routes: %v", err)
+		w.lastErrors.add(err)
+	}
+	w.dnsRoutesSet = true
+}
+
+// clearDNSRoutes removes the DNS routes of the interface on Stop.
+func (w *WebtunnelClient) clearDNSRoutes() {
+	if !w.dnsRoutesSet {
+		return
+	}
+	if err := RemoveDNSRoutes(w.ifce.Name()); err != nil {
+		glog.Warningf("unable to remove DNS routes: %v", err)
+	}
+	w.dnsRoutesSet = false
+}
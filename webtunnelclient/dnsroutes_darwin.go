@@ -0,0 +1,62 @@
+package webtunnelclient
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// resolverDir holds the scoped resolver files of macOS, named after the domain they
+// resolve.
+var resolverDir = "/etc/resolver"
+
+// resolverMarker starts the resolver files owned by the client so they can be removed.
+const resolverMarker = "# webtunnel"
+
+// addDNSRoutes writes a scoped resolver file per domain. Resolver files of other
+// applications are left alone.
+func addDNSRoutes(ifName string, routes []DNSRoute) error {
+	if err := os.MkdirAll(resolverDir, 0755); err != nil {
+		return fmt.Errorf("error creating resolver directory %w", err)
+	}
+	for _, r := range routes {
+		content := resolverMarker + " " + ifName + "\n"
+		for _, s := range r.Servers {
+			content += "nameserver " + s.String() + "\n"
+		}
+		for _, d := range r.Domains {
+			file := filepath.Join(resolverDir, d)
+			if b, err := os.ReadFile(file); err == nil && !strings.HasPrefix(string(b), resolverMarker) {
+				return fmt.Errorf("resolver for %v already configured by another application", d)
+			}
+			if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+				return fmt.Errorf("error writing resolver for %v %w", d, err)
+			}
+		}
+	}
+	return nil
+}
+
+// removeDNSRoutes removes the resolver files written for interface ifName.
+func removeDNSRoutes(ifName string) error {
+	entries, err := os.ReadDir(resolverDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error listing resolvers %w", err)
+	}
+	for _, e := range entries {
+		file := filepath.Join(resolverDir, e.Name())
+		if b, err := os.ReadFile(file); err != nil || !strings.HasPrefix(string(b), resolverMarker+" "+ifName+"\n") {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			return fmt.Errorf("error removing resolver %v %w", e.Name(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+)
+
+// addDNSRoutes makes systemd-resolved resolve the domains of routes on link ifName.
+// Resolved has a single set of servers per link, so all domains use the servers of all
+// routes.
+func addDNSRoutes(ifName string, routes []DNSRoute) error {
+	dns := []string{"dns", ifName}
+	domains := []string{"domain", ifName}
+	seen := make(map[string]bool)
+	for _, r := range routes {
+		for _, s := range r.Servers {
+			if !seen[s.String()] {
+				seen[s.String()] = true
+				dns = append(dns, s.String())
+			}
+		}
+		for _, d := range r.Domains {
+			// Routing only domains, not added to the search list.
+			domains = append(domains, "~"+d)
+		}
+	}
+	for _, args := range [][]string{dns, domains} {
+		if out, err := exec.Command("resolvectl", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("error setting link %v %w %s", args[0], err, out)
+		}
+	}
+	return nil
+}
+
+// removeDNSRoutes reverts the resolved settings of link ifName. Links already removed
+// have nothing to revert.
+func removeDNSRoutes(ifName string) error {
+	if _, err := net.InterfaceByName(ifName); err != nil {
+		return nil
+	}
+	if out, err := exec.Command("resolvectl", "revert", ifName).CombinedOutput(); err != nil {
+		return fmt.Errorf("error reverting link DNS %w %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package webtunnelclient
+
+// addDNSRoutes adds a Name Resolution Policy Table rule per domain. The rules apply to
+// all interfaces.
+func addDNSRoutes(ifName string, routes []DNSRoute) error {
+	for _, r := range routes {
+		for _, d := range r.Domains {
+			if err := addNRPTRuleWithComment("."+d, r.Servers, nrptRouteComment); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeDNSRoutes removes the NRPT rules of the DNS routes.
+func removeDNSRoutes(ifName string) error {
+	return removeNRPTRulesWithComment(nrptRouteComment)
+}
@@ -0,0 +1,137 @@
+package webtunnelclient
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/gorilla/websocket"
+)
+
+// Endpoint is a local packet producer and consumer sharing the tunnel session with the
+// network interface, eg. a userspace SOCKS proxy. It owns the TCP and UDP packets from the
+// server addressed to its IP and port range; all other packets go to the interface.
+// Non-first IPv4 fragments carry no ports and always go to the interface.
+type Endpoint struct {
+	Name    string           // Name for logs and errors.
+	IP      net.IP           // Local IP, nil for the tunnel IP.
+	MinPort uint16           // First port of the endpoint.
+	MaxPort uint16           // Last port of the endpoint.
+	Deliver func(pkt []byte) // Receives packets for the endpoint. It must not block or keep pkt.
+	client  *WebtunnelClient // Client the endpoint is registered with.
+}
+
+// AddEndpoint registers e to share the tunnel session. The port ranges of endpoints
+// with the same IP must not overlap.
+func (w *WebtunnelClient) AddEndpoint(e *Endpoint) error {
+	if e.Deliver == nil {
+		return fmt.Errorf("endpoint %v has no deliver function", e.Name)
+	}
+	if e.MinPort == 0 || e.MinPort > e.MaxPort {
+		return fmt.Errorf("invalid port range %v-%v for endpoint %v", e.MinPort, e.MaxPort, e.Name)
+	}
+	if e.IP != nil && e.IP.To4() == nil {
+		return fmt.Errorf("endpoint %v IP %v is not IPv4", e.Name, e.IP)
+	}
+	w.epLock.Lock()
+	defer w.epLock.Unlock()
+	for _, o := range w.endpoints {
+		if o.IP.Equal(e.IP) && e.MinPort <= o.MaxPort && o.MinPort <= e.MaxPort {
+			return fmt.Errorf("endpoint %v ports overlap endpoint %v", e.Name, o.Name)
+		}
+	}
+	e.client = w
+	w.endpoints = append(w.endpoints, e)
+	return nil
+}
+
+// RemoveEndpoint unregisters e. Its packets go to the network interface again.
+func (w *WebtunnelClient) RemoveEndpoint(e *Endpoint) {
+	w.epLock.Lock()
+	defer w.epLock.Unlock()
+	for i, o := range w.endpoints {
+		if o == e {
+			w.endpoints = append(w.endpoints[:i], w.endpoints[i+1:]...)
+			e.client = nil
+			return
+		}
+	}
+}
+
+// Send sends an IPv4 packet from the endpoint through the tunnel. Its source IP and port
+// must belong to the endpoint.
+func (e *Endpoint) Send(pkt []byte) error {
+	w := e.client
+	if w == nil {
+		return fmt.Errorf("endpoint %v not registered", e.Name)
+	}
+	if w.ifce == nil || w.wsWriter == nil || !w.isWSReady.Load() {
+		return fmt.Errorf("tunnel not connected: %w", wc.ErrNotConfigured)
+	}
+	src, port, ok := packetAddr(pkt, false)
+	if !ok || !e.owns(src, port, w.ifce.IP) {
+		return fmt.Errorf("packet source is not endpoint %v", e.Name)
+	}
+	if w.isPaused.Load() {
+		return nil
+	}
+	if err := w.wsWriter.WriteDataMessage(websocket.BinaryMessage, pkt); err != nil {
+		return fmt.Errorf("error writing to websocket: %w", err)
+	}
+	w.updateMetricsForPacket(len(pkt))
+	return nil
+}
+
+// owns returns true if ip and port belong to the endpoint on a tunnel with tunIP.
+func (e *Endpoint) owns(ip net.IP, port uint16, tunIP net.IP) bool {
+	epIP := e.IP
+	if epIP == nil {
+		epIP = tunIP
+	}
+	return ip.Equal(epIP) && port >= e.MinPort && port <= e.MaxPort
+}
+
+// packetAddr returns the destination (or source if dst is false) IP and port of a TCP or
+// UDP IPv4 packet. ok is false for other packets and non-first fragments.
+func packetAddr(pkt []byte, dst bool) (net.IP, uint16, bool) {
+	if len(pkt) < 20 || pkt[0]>>4 != 4 {
+		return nil, 0, false
+	}
+	hdrLen := int(pkt[0]&0x0f) * 4
+	proto := pkt[9]
+	fragOffset := binary.BigEndian.Uint16(pkt[6:8]) & 0x1fff
+	if (proto != 6 && proto != 17) || fragOffset != 0 || len(pkt) < hdrLen+4 {
+		return nil, 0, false
+	}
+	if dst {
+		return net.IP(pkt[16:20]), binary.BigEndian.Uint16(pkt[hdrLen+2 : hdrLen+4]), true
+	}
+	return net.IP(pkt[12:16]), binary.BigEndian.Uint16(pkt[hdrLen : hdrLen+2]), true
+}
+
+// deliverEndpoint delivers a packet from the server to the endpoint owning its
+// destination. It returns false if no endpoint owns it.
+func (w *WebtunnelClient) deliverEndpoint(pkt []byte) bool {
+	w.epLock.Lock()
+	if len(w.endpoints) == 0 {
+		w.epLock.Unlock()
+		return false
+	}
+	var owner *Endpoint
+	if ip, port, ok := packetAddr(pkt, true); ok {
+		for _, e := range w.endpoints {
+			if e.owns(ip, port, w.ifce.IP) {
+				owner = e
+				break
+			}
+		}
+	}
+	w.epLock.Unlock()
+	if owner == nil {
+		return false
+	}
+	owner.Deliver(pkt)
+	w.updateMetricsForPacket(len(pkt))
+	return true
+}
@@ -0,0 +1,37 @@
+package webtunnelclient
+
+import (
+	"expvar"
+	"fmt"
+	"runtime"
+)
+
+// PublishExpvar publishes runtime and packet loop stats of the client as the expvar
+// variable name. They are served as JSON on /debug/vars of the debug endpoint (see
+// webtunnelcommon.ServeDebug), or of http.DefaultServeMux if the application serves it.
+func (w *WebtunnelClient) PublishExpvar(name string) error {
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("expvar %v already published", name)
+	}
+	expvar.Publish(name, expvar.Func(w.expvarStats))
+	return nil
+}
+
+// expvarStats returns the stats published by PublishExpvar.
+func (w *WebtunnelClient) expvarStats() any {
+	packets, bytes := w.GetMetrics()
+	stats := map[string]any{
+		"goroutines": runtime.NumGoroutine(),
+		"packets":    packets,
+		"bytes":      bytes,
+		"wsReady":    w.isWSReady.Load(),
+		"netReady":   w.isNetReady.Load(),
+		"stopped":    w.isStopped.Load(),
+		"deviceType": w.ActiveDeviceType(),
+		"loss":       w.loss.Stats(),
+	}
+	if w.wsWriter != nil {
+		stats["ctrlQueueDepth"], stats["dataQueueDepth"] = w.wsWriter.QueueLen()
+	}
+	return stats
+}
@@ -0,0 +1,153 @@
+package webtunnelclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// AddressPreference selects the address family of the outer transport tried first when
+// the server name resolves to IPv4 and IPv6 addresses.
+type AddressPreference int
+
+const (
+	PreferIPv6 AddressPreference = iota // Try IPv6 first (RFC 8305).
+	PreferIPv4                          // Try IPv4 first.
+	IPv6Only                            // Only connect over IPv6.
+	IPv4Only                            // Only connect over IPv4.
+)
+
+// Default delay before racing the next address (RFC 8305 Connection Attempt Delay).
+const defaultAttemptDelay = 250 * time.Millisecond
+
+// SetHappyEyeballs dials the server addresses in parallel, alternating address families
+// starting with pref, and uses the first connection established. Each further address is
+// tried after delay (0 for the default of 250ms) or as soon as an attempt fails, so broken
+// IPv6 networks do not slow down connecting. This should be called prior to Start.
+func (w *WebtunnelClient) SetHappyEyeballs(pref AddressPreference, delay time.Duration) error {
+	if pref < PreferIPv6 || pref > IPv4Only {
+		return fmt.Errorf("invalid address preference %v", pref)
+	}
+	if delay < 0 {
+		return fmt.Errorf("invalid attempt delay %v", delay)
+	}
+	if delay == 0 {
+		delay = defaultAttemptDelay
+	}
+	w.eyeballs = true
+	w.addrPref = pref
+	w.attemptDelay = delay
+	return nil
+}
+
+// sortAddrs returns the addresses allowed by pref, interleaving the families starting
+// with the preferred one.
+func sortAddrs(ips []net.IP, pref AddressPreference) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	primary, secondary := v6, v4
+	switch pref {
+	case PreferIPv4:
+		primary, secondary = v4, v6
+	case IPv6Only:
+		secondary = nil
+	case IPv4Only:
+		primary, secondary = v4, nil
+	}
+	var out []net.IP
+	for i := 0; i < len(primary) || i < len(secondary); i++ {
+		if i < len(primary) {
+			out = append(out, primary[i])
+		}
+		if i < len(secondary) {
+			out = append(out, secondary[i])
+		}
+	}
+	return out
+}
+
+// eyeballsDialer returns a dial function racing the addresses of the host with dial,
+// the dialer of the websocket connection.
+func (w *WebtunnelClient) eyeballsDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips := []net.IP{net.ParseIP(host)}
+		if ips[0] == nil {
+			if ips, err = LookupIP(host); err != nil {
+				return nil, err
+			}
+		}
+		addrs := sortAddrs(ips, w.addrPref)
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("no usable addresses for %v", host)
+		}
+
+		type result struct {
+			conn net.Conn
+			err  error
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		results := make(chan result, len(addrs))
+		pending, next := 0, 0
+		start := func() {
+			a := net.JoinHostPort(addrs[next].String(), port)
+			pending++
+			next++
+			go func() {
+				c, err := dial(ctx, network, a)
+				results <- result{c, err}
+			}()
+		}
+
+		start()
+		var firstErr error
+		for pending > 0 {
+			var attempt <-chan time.Time
+			if next < len(addrs) {
+				attempt = time.After(w.attemptDelay)
+			}
+			select {
+			case res := <-results:
+				pending--
+				if res.err == nil {
+					glog.V(1).Infof("connected to %v via %v", host, res.conn.RemoteAddr())
+					// Close connections of attempts still in flight.
+					go func(n int) {
+						for ; n > 0; n-- {
+							if r := <-results; r.conn != nil {
+								r.conn.Close()
+							}
+						}
+					}(pending)
+					return res.conn, nil
+				}
+				if firstErr == nil {
+					firstErr = res.err
+				}
+				// Try the next address right away instead of waiting for the delay.
+				if next < len(addrs) {
+					start()
+				}
+			case <-attempt:
+				start()
+			}
+		}
+		return nil, firstErr
+	}
+}
@@ -0,0 +1,108 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// Strategy is an alternate way of reaching the server, tried when connecting with the
+// configured scheme and port fails (eg. on networks blocking the port or websockets).
+type Strategy struct {
+	Name   string // Name reported when the strategy succeeds.
+	Scheme string // ws or wss, empty keeps the configured scheme.
+	Port   int    // Server port, 0 keeps the configured port.
+	Proxy  string // HTTP proxy URL, empty keeps the dialer proxy setting.
+}
+
+// Name of the strategy using the configured scheme, port and dialer.
+const directStrategy = "direct"
+
+// SetFallbackStrategies sets the strategies tried in order if connecting directly fails.
+// WebTransport is not supported as the standard library has no HTTP/3 implementation.
+// This should be called prior to Start.
+func (w *WebtunnelClient) SetFallbackStrategies(strategies []Strategy) error {
+	for i, s := range strategies {
+		if s.Scheme != "" && s.Scheme != "ws" && s.Scheme != "wss" {
+			return fmt.Errorf("unsupported scheme %q in strategy %v", s.Scheme, s.Name)
+		}
+		if s.Port < 0 || s.Port > 65535 {
+			return fmt.Errorf("invalid port %v in strategy %v", s.Port, s.Name)
+		}
+		if s.Proxy != "" {
+			if _, err := url.Parse(s.Proxy); err != nil {
+				return fmt.Errorf("invalid proxy in strategy %v %w", s.Name, err)
+			}
+		}
+		if s.Name == "" {
+			strategies[i].Name = fmt.Sprintf("fallback%d", i+1)
+		}
+	}
+	w.strategies = strategies
+	return nil
+}
+
+// ActiveStrategy returns the name of the strategy of the current connection, "direct"
+// if no fallback was needed.
+func (w *WebtunnelClient) ActiveStrategy() string {
+	return w.strategy
+}
+
+// apply returns the websocket url and dialer for the strategy.
+func (s Strategy) apply(rawURL string, d websocket.Dialer) (string, websocket.Dialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", d, err
+	}
+	if s.Scheme != "" {
+		u.Scheme = s.Scheme
+	}
+	if s.Port != 0 {
+		host := u.Host
+		if h, _, err := net.SplitHostPort(u.Host); err == nil {
+			host = h
+		}
+		u.Host = net.JoinHostPort(host, strconv.Itoa(s.Port))
+	}
+	if s.Proxy != "" {
+		p, err := url.Parse(s.Proxy)
+		if err != nil {
+			return "", d, err
+		}
+		d.Proxy = http.ProxyURL(p)
+	}
+	return u.String(), d, nil
+}
+
+// dialFallback connects trying the direct url first and then each fallback strategy.
+func (w *WebtunnelClient) dialFallback(d websocket.Dialer, rawURL string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	conn, resp, err := d.Dial(rawURL, header)
+	// Fallbacks do not help if the server refused the credentials or the client version.
+	if err == nil || len(w.strategies) == 0 || (resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusUpgradeRequired)) {
+		w.strategy = directStrategy
+		return conn, resp, err
+	}
+	glog.Warningf("unable to connect to %v: %v, trying fallback strategies", rawURL, err)
+	firstErr := err
+	for _, s := range w.strategies {
+		u, sd, err := s.apply(rawURL, d)
+		if err != nil {
+			glog.Warningf("strategy %v: %v", s.Name, err)
+			continue
+		}
+		conn, resp, err := sd.Dial(u, header)
+		if err != nil {
+			glog.Warningf("strategy %v (%v) failed: %v", s.Name, u, err)
+			continue
+		}
+		glog.Infof("Connected with strategy %v (%v)", s.Name, u)
+		w.strategy = s.Name
+		return conn, resp, nil
+	}
+	return nil, nil, fmt.Errorf("all connection strategies failed, direct: %w", firstErr)
+}
@@ -0,0 +1,48 @@
+package ipc
+
+import (
+	"encoding/json"
+
+	"github.com/deepakkamesh/webtunnel/webtunnelclient"
+)
+
+// NewHelper returns a server exposing the standard methods for the client w, which is
+// owned by the privileged helper process.
+func NewHelper(w *webtunnelclient.WebtunnelClient) *Server {
+	s := NewServer()
+	s.Handle(MethodStart, func(json.RawMessage) (any, error) { return nil, w.Start() })
+	s.Handle(MethodStop, func(json.RawMessage) (any, error) { return nil, w.Stop() })
+	s.Handle(MethodStatus, func(json.RawMessage) (any, error) { return w.GetStatus(), nil })
+	s.Handle(MethodPause, func(json.RawMessage) (any, error) { return nil, w.Pause() })
+	s.Handle(MethodResume, func(json.RawMessage) (any, error) { return nil, w.Resume() })
+	return s
+}
+
+// Start connects the tunnel in the helper.
+func (c *Client) Start() error {
+	return c.Call(MethodStart, nil, nil)
+}
+
+// Stop disconnects the tunnel in the helper.
+func (c *Client) Stop() error {
+	return c.Call(MethodStop, nil, nil)
+}
+
+// Status returns the tunnel status from the helper.
+func (c *Client) Status() (*webtunnelclient.Status, error) {
+	s := &webtunnelclient.Status{}
+	if err := c.Call(MethodStatus, nil, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Pause pauses data forwarding in the helper.
+func (c *Client) Pause() error {
+	return c.Call(MethodPause, nil, nil)
+}
+
+// Resume resumes data forwarding in the helper.
+func (c *Client) Resume() error {
+	return c.Call(MethodResume, nil, nil)
+}
@@ -0,0 +1,180 @@
+/*
+Package ipc implements the protocol between an unprivileged client process (eg. a GUI or
+tray app) and a privileged helper that owns the TUN device and routes.
+
+Requests and responses are newline delimited JSON objects exchanged over a unix socket or,
+on Windows, a named pipe. See NewHelper for the helper side and Client for the GUI side.
+*/
+package ipc
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Methods served by the helper.
+const (
+	MethodStart  = "start"  // Connect the tunnel.
+	MethodStop   = "stop"   // Disconnect the tunnel.
+	MethodStatus = "status" // Get the tunnel status.
+	MethodPause  = "pause"  // Pause data forwarding.
+	MethodResume = "resume" // Resume data forwarding.
+)
+
+// Request is a call from the client to the helper.
+type Request struct {
+	ID     uint64          // Request ID echoed in the response.
+	Method string          // Method name.
+	Params json.RawMessage `json:",omitempty"` // Method parameters.
+}
+
+// Response is the helper reply to a Request.
+type Response struct {
+	ID     uint64          // ID of the request.
+	Result json.RawMessage `json:",omitempty"` // Method result.
+	Error  string          `json:",omitempty"` // Error message if the call failed.
+}
+
+// HandlerFunc serves a method. params may be empty.
+type HandlerFunc func(params json.RawMessage) (any, error)
+
+// Server dispatches requests received on a listener to method handlers.
+type Server struct {
+	handlers map[string]HandlerFunc
+	lock     sync.Mutex
+}
+
+// NewServer returns a server with no methods registered.
+func NewServer() *Server {
+	return &Server{handlers: make(map[string]HandlerFunc)}
+}
+
+// Handle registers the handler for method.
+func (s *Server) Handle(method string, h HandlerFunc) {
+	s.lock.Lock()
+	s.handlers[method] = h
+	s.lock.Unlock()
+}
+
+// Serve accepts connections on l until it is closed. Requests on a connection are served
+// in order.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn serves requests on conn until it is closed.
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	enc := json.NewEncoder(conn)
+	for {
+		var req Request
+		if err := dec.Decode(&req); err != nil {
+			glog.V(1).Infof("ipc connection closed: %v", err)
+			return
+		}
+		if err := enc.Encode(s.dispatch(&req)); err != nil {
+			glog.Warningf("error writing ipc response: %v", err)
+			return
+		}
+	}
+}
+
+// dispatch runs the handler for req.
+func (s *Server) dispatch(req *Request) *Response {
+	resp := &Response{ID: req.ID}
+	s.lock.Lock()
+	h, ok := s.handlers[req.Method]
+	s.lock.Unlock()
+	if !ok {
+		resp.Error = fmt.Sprintf("unknown method %v", req.Method)
+		return resp
+	}
+	result, err := h(req.Params)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	if result != nil {
+		b, err := json.Marshal(result)
+		if err != nil {
+			resp.Error = fmt.Sprintf("error encoding result %s", err)
+			return resp
+		}
+		resp.Result = b
+	}
+	return resp
+}
+
+// Client calls methods on a helper.
+type Client struct {
+	conn   net.Conn
+	dec    *json.Decoder
+	enc    *json.Encoder
+	nextID uint64
+	lock   sync.Mutex
+}
+
+// Dial connects to the helper on path, a unix socket path or a Windows pipe name.
+func Dial(path string) (*Client, error) {
+	conn, err := dial(path)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to helper %w", err)
+	}
+	return &Client{
+		conn: conn,
+		dec:  json.NewDecoder(bufio.NewReader(conn)),
+		enc:  json.NewEncoder(conn),
+	}, nil
+}
+
+// Call invokes method with params and decodes the result into result, if not nil.
+func (c *Client) Call(method string, params, result any) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.nextID++
+	req := &Request{ID: c.nextID, Method: method}
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return fmt.Errorf("error encoding params %w", err)
+		}
+		req.Params = b
+	}
+	if err := c.enc.Encode(req); err != nil {
+		return fmt.Errorf("error sending request %w", err)
+	}
+	var resp Response
+	if err := c.dec.Decode(&resp); err != nil {
+		return fmt.Errorf("error reading response %w", err)
+	}
+	if resp.ID != req.ID {
+		return fmt.Errorf("response ID mismatch want %v got %v", req.ID, resp.ID)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%v", resp.Error)
+	}
+	if result != nil && resp.Result != nil {
+		if err := json.Unmarshal(resp.Result, result); err != nil {
+			return fmt.Errorf("error decoding result %w", err)
+		}
+	}
+	return nil
+}
+
+// Close closes the connection to the helper.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
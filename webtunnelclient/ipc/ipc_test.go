@@ -0,0 +1,47 @@
+package ipc
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestIPC(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "helper.sock")
+	l, err := Listen(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := NewServer()
+	s.Handle("echo", func(params json.RawMessage) (any, error) {
+		var v string
+		if err := json.Unmarshal(params, &v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	})
+	s.Handle("fail", func(json.RawMessage) (any, error) {
+		return nil, fmt.Errorf("failed")
+	})
+	go s.Serve(l)
+
+	c, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var got string
+	if err := c.Call("echo", "hello", &got); err != nil || got != "hello" {
+		t.Errorf("Expected echo hello, got %q %v", got, err)
+	}
+	if err := c.Call("fail", nil, nil); err == nil || err.Error() != "failed" {
+		t.Errorf("Expected handler error, got %v", err)
+	}
+	if err := c.Call("unknown", nil, nil); err == nil {
+		t.Error("Expected unknown method error")
+	}
+}
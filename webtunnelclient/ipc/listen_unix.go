@@ -0,0 +1,31 @@
+//go:build !windows
+
+package ipc
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// Listen creates the helper unix socket at path, replacing a stale socket, with file
+// permissions perm (eg. 0660 with the GUI users group owning the socket).
+func Listen(path string, perm os.FileMode) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error removing stale socket %w", err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on %v %w", path, err)
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("error setting socket permissions %w", err)
+	}
+	return l, nil
+}
+
+// dial connects to the unix socket at path.
+func dial(path string) (net.Conn, error) {
+	return net.Dial("unix", path)
+}
@@ -0,0 +1,141 @@
+package ipc
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32                                 = syscall.NewLazyDLL("kernel32.dll")
+	advapi32                                 = syscall.NewLazyDLL("advapi32.dll")
+	procCreateNamedPipeW                     = kernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe                     = kernel32.NewProc("ConnectNamedPipe")
+	procDisconnectNamedPipe                  = kernel32.NewProc("DisconnectNamedPipe")
+	procConvertStringSecurityDescriptorToSDW = advapi32.NewProc("ConvertStringSecurityDescriptorToSecurityDescriptorW")
+)
+
+const (
+	pipeAccessDuplex          = 0x3
+	pipeUnlimitedInstances    = 255
+	pipeBufferSize            = 65536
+	errorPipeConnected        = 535
+	sddlRevision1             = 1
+	pipeSecurityDescriptor    = "D:P(A;;GA;;;SY)(A;;GA;;;BA)(A;;GRGW;;;IU)" // System, admins and interactive users.
+	fileFlagFirstPipeInstance = 0x00080000
+)
+
+// pipeAddr is the net.Addr of a named pipe.
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeConn is a connected named pipe instance. I/O is synchronous, which suits the
+// strict request/response protocol.
+type pipeConn struct {
+	*os.File
+	addr pipeAddr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.addr }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.addr }
+
+// pipeListener accepts connections on a named pipe.
+type pipeListener struct {
+	name   string
+	sa     *syscall.SecurityAttributes
+	first  bool
+	closed bool
+	lock   sync.Mutex
+}
+
+// Listen creates the helper named pipe path (eg. \\.\pipe\webtunnel). perm is ignored;
+// the pipe is accessible to SYSTEM, administrators and interactive users.
+func Listen(path string, perm os.FileMode) (net.Listener, error) {
+	sddl, err := syscall.UTF16PtrFromString(pipeSecurityDescriptor)
+	if err != nil {
+		return nil, err
+	}
+	var sd uintptr
+	if r, _, err := procConvertStringSecurityDescriptorToSDW.Call(uintptr(unsafe.Pointer(sddl)),
+		sddlRevision1, uintptr(unsafe.Pointer(&sd)), 0); r == 0 {
+		return nil, fmt.Errorf("error creating pipe security descriptor %w", err)
+	}
+	sa := &syscall.SecurityAttributes{SecurityDescriptor: sd}
+	sa.Length = uint32(unsafe.Sizeof(*sa))
+	return &pipeListener{name: path, sa: sa, first: true}, nil
+}
+
+// Accept creates a pipe instance and waits for a client to connect to it.
+func (l *pipeListener) Accept() (net.Conn, error) {
+	name, err := syscall.UTF16PtrFromString(l.name)
+	if err != nil {
+		return nil, err
+	}
+	l.lock.Lock()
+	if l.closed {
+		l.lock.Unlock()
+		return nil, net.ErrClosed
+	}
+	mode := uintptr(pipeAccessDuplex)
+	if l.first {
+		// Fail if another process already owns the pipe name.
+		mode |= fileFlagFirstPipeInstance
+		l.first = false
+	}
+	l.lock.Unlock()
+
+	h, _, err := procCreateNamedPipeW.Call(uintptr(unsafe.Pointer(name)), mode, 0,
+		pipeUnlimitedInstances, pipeBufferSize, pipeBufferSize, 0, uintptr(unsafe.Pointer(l.sa)))
+	if syscall.Handle(h) == syscall.InvalidHandle {
+		return nil, fmt.Errorf("error creating pipe %w", err)
+	}
+	if r, _, err := procConnectNamedPipe.Call(h, 0); r == 0 && err != syscall.Errno(errorPipeConnected) {
+		syscall.CloseHandle(syscall.Handle(h))
+		return nil, fmt.Errorf("error connecting pipe %w", err)
+	}
+
+	l.lock.Lock()
+	closed := l.closed
+	l.lock.Unlock()
+	if closed {
+		procDisconnectNamedPipe.Call(h)
+		syscall.CloseHandle(syscall.Handle(h))
+		return nil, net.ErrClosed
+	}
+	return &pipeConn{File: os.NewFile(h, l.name), addr: pipeAddr(l.name)}, nil
+}
+
+// Close stops the listener, unblocking a pending Accept.
+func (l *pipeListener) Close() error {
+	l.lock.Lock()
+	if l.closed {
+		l.lock.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.lock.Unlock()
+	// Connect to the pending instance to unblock ConnectNamedPipe.
+	if f, err := os.OpenFile(l.name, os.O_RDWR, 0); err == nil {
+		f.Close()
+	}
+	return nil
+}
+
+// Addr returns the pipe name.
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr(l.name)
+}
+
+// dial connects to the named pipe path.
+func dial(path string) (net.Conn, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &pipeConn{File: f, addr: pipeAddr(path)}, nil
+}
@@ -0,0 +1,170 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// Pings received at an interval before a longer one is probed.
+const keepaliveProbeCount = 3
+
+// Shortest keepalive interval accepted by servers.
+const minKeepalive = 10 * time.Second
+
+// Delay of a server ping tolerated before the connection is considered dropped.
+var keepaliveGrace = 10 * time.Second
+
+// Interval between checks for missing server pings.
+var keepaliveCheck = time.Second
+
+// adaptiveKeepalive is the keepalive interval probing state.
+type adaptiveKeepalive struct {
+	min       time.Duration // Conservative interval probing starts from, 0 if disabled.
+	max       time.Duration // Longest interval probed.
+	interval  time.Duration // Interval negotiated with the server.
+	good      time.Duration // Longest interval that kept the connection, 0 if none yet.
+	settled   bool          // Probing stopped after a drop.
+	received  int           // Pings received at interval.
+	lastPing  time.Time     // Time of the last server ping.
+	connected bool          // An interval was negotiated before.
+	lock      sync.Mutex
+}
+
+/*
+SetAdaptiveKeepalive negotiates how often the server pings the client to keep NAT
+bindings alive, using as few pings as possible to save battery and bandwidth on mobile
+clients. The interval starts at min and grows by half each time a few pings arrived, up
+to max. If a ping does not arrive in time, or the connection drops while probing a longer
+interval, the NAT binding is assumed to have timed out: the connection is closed, which
+reports an error on the Error channel, and the interval backs off to the longest one that
+worked and stays there. min must be at least 10s. This should be called prior to Start.
+*/
+func (w *WebtunnelClient) SetAdaptiveKeepalive(min, max time.Duration) error {
+	if min < minKeepalive || max < min {
+		return fmt.Errorf("invalid keepalive range %v-%v", min, max)
+	}
+	w.keepalive = adaptiveKeepalive{min: min, max: max, interval: min}
+	return nil
+}
+
+// KeepaliveInterval returns the negotiated keepalive interval, 0 if disabled.
+func (w *WebtunnelClient) KeepaliveInterval() time.Duration {
+	w.keepalive.lock.Lock()
+	defer w.keepalive.lock.Unlock()
+	return w.keepalive.interval
+}
+
+// negotiateKeepalive requests the current keepalive interval on a new connection.
+func (w *WebtunnelClient) negotiateKeepalive() error {
+	k := &w.keepalive
+	if k.min == 0 {
+		return nil
+	}
+	if !w.keepaliveOK {
+		glog.Warning("server does not negotiate keepalives")
+		return nil
+	}
+	k.lock.Lock()
+	// Losing the connection while probing an untested interval counts as a NAT timeout.
+	if k.connected && !k.settled && k.interval > k.good {
+		k.backOff()
+	}
+	k.connected = true
+	k.received = 0
+	k.lastPing = time.Now()
+	interval := k.interval
+	k.lock.Unlock()
+	return w.wsWriter.WriteControlMessage(websocket.TextMessage, wc.KeepaliveMessage(interval))
+}
+
+// backOff settles on the longest interval that worked. The lock must be held.
+func (k *adaptiveKeepalive) backOff() {
+	k.settled = true
+	if k.good > 0 {
+		k.interval = k.good
+	}
+	glog.Warningf("keepalive interval too long for the network path, settling on %v", k.interval)
+}
+
+// keepalivePinged records a ping from the server and probes a longer interval after
+// enough pings at the current one.
+func (w *WebtunnelClient) keepalivePinged() {
+	k := &w.keepalive
+	k.lock.Lock()
+	if k.min == 0 || !w.keepaliveOK {
+		k.lock.Unlock()
+		return
+	}
+	k.lastPing = time.Now()
+	k.received++
+	if k.settled || k.received < keepaliveProbeCount {
+		k.lock.Unlock()
+		return
+	}
+	k.good = k.interval
+	k.received = 0
+	if k.interval >= k.max {
+		k.settled = true
+		k.lock.Unlock()
+		glog.V(1).Infof("keepalive interval settled on the maximum %v", k.good)
+		return
+	}
+	k.interval += k.interval / 2
+	if k.interval > k.max {
+		k.interval = k.max
+	}
+	interval := k.interval
+	k.lock.Unlock()
+
+	glog.V(1).Infof("probing keepalive interval %v", interval)
+	if err := w.wsWriter.WriteControlMessage(websocket.TextMessage, wc.KeepaliveMessage(interval)); err != nil {
+		glog.Warningf("error negotiating keepalive: %v", err)
+	}
+}
+
+// keepaliveAcked applies the interval used by the server, which may clamp the request.
+func (w *WebtunnelClient) keepaliveAcked(d time.Duration) {
+	k := &w.keepalive
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if d != k.interval {
+		glog.V(1).Infof("server keepalive interval %v instead of %v", d, k.interval)
+		k.interval = d
+	}
+}
+
+// processKeepalive closes the connection if the server pings stop arriving.
+func (w *WebtunnelClient) processKeepalive() {
+	k := &w.keepalive
+	if k.min == 0 {
+		return
+	}
+	for {
+		w.idleSleep(keepaliveCheck)
+		if w.isStopped.Load() {
+			glog.V(1).Info("Exiting keepalive routine")
+			return
+		}
+		if !w.isWSReady.Load() || !w.keepaliveOK {
+			continue
+		}
+		k.lock.Lock()
+		late := time.Since(k.lastPing) > k.interval+keepaliveGrace
+		if late {
+			glog.Warningf("no server ping for %v", k.interval+keepaliveGrace)
+			if !k.settled {
+				k.backOff()
+			}
+			k.lastPing = time.Now()
+		}
+		k.lock.Unlock()
+		if late {
+			w.wsconn.Close()
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/golang/glog"
+)
+
+// LookupIP (Overridable) Resolve the server host name.
+var LookupIP = net.LookupIP
+
+// serverIPs returns the IPv4 addresses of the server host in hostPort.
+func serverIPs(hostPort string) ([]net.IP, error) {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip.To4()}, nil
+	}
+	addrs, err := LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, a := range addrs {
+		if a.To4() != nil {
+			ips = append(ips, a.To4())
+		}
+	}
+	return ips, nil
+}
+
+// currentRoute returns the most specific route to ip in routes that does not use the
+// tunnel interface iface.
+func currentRoute(routes []Route, ip net.IP, iface string) (Route, bool) {
+	var best Route
+	bestBits := -1
+	for _, r := range routes {
+		if r.Dst == nil || r.Iface == iface || !r.Dst.Contains(ip) {
+			continue
+		}
+		if bits, _ := r.Dst.Mask.Size(); bits > bestBits {
+			best, bestBits = r, bits
+		}
+	}
+	return best, bestBits >= 0
+}
+
+// preventRouteLoop checks that none of the tunnel routes captures the server itself,
+// which would send the tunnel traffic through the tunnel. For each captured server
+// address a host route via the current gateway is added. The configuration is refused if
+// no such route can be added.
+func (w *WebtunnelClient) preventRouteLoop(routes []*net.IPNet) error {
+	ips, err := serverIPs(w.serverIPPort)
+	if err != nil {
+		return fmt.Errorf("error resolving server %w", err)
+	}
+	var osRoutes []Route
+	for _, ip := range ips {
+		var captured *net.IPNet
+		for _, r := range routes {
+			if r.Contains(ip) {
+				captured = r
+				break
+			}
+		}
+		if captured == nil || w.hasException(ip) {
+			continue
+		}
+		if osRoutes == nil {
+			if osRoutes, err = ListRoutes(); err != nil {
+				return fmt.Errorf("route %v captures server %v, unable to list routes %w", captured, ip, err)
+			}
+		}
+		cur, ok := currentRoute(osRoutes, ip, w.ifce.Name())
+		if !ok {
+			return fmt.Errorf("route %v captures server %v and there is no route to add an exception", captured, ip)
+		}
+		exception := Route{Dst: &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}, Gateway: cur.Gateway, Iface: cur.Iface}
+		if err := AddRoute(exception); err != nil {
+			return fmt.Errorf("route %v captures server %v, unable to add exception %w", captured, ip, err)
+		}
+		glog.Warningf("route %v captures server %v, added host route via %v dev %v", captured, ip, cur.Gateway, cur.Iface)
+		w.exceptions = append(w.exceptions, exception)
+	}
+	return nil
+}
+
+// hasException returns true if a host route exception for ip was added.
+func (w *WebtunnelClient) hasException(ip net.IP) bool {
+	for _, e := range w.exceptions {
+		if e.Dst.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
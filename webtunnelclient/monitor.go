@@ -0,0 +1,127 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// RepairEvent is the result of a route monitor check that found tunnel state missing.
+type RepairEvent struct {
+	Time     time.Time // Time of the check.
+	Repaired []string  // Routes and addresses reinstalled.
+	Failed   []string  // Routes and addresses that could not be reinstalled, with the reason.
+}
+
+// routeMonitor is the route monitor configuration.
+type routeMonitor struct {
+	interval time.Duration     // Interval between checks, 0 if disabled.
+	repaired func(RepairEvent) // User callback, nil if not set.
+}
+
+// SetRouteMonitor checks every interval that the tunnel address, the routes via the tunnel
+// and the server exception routes are still installed (other VPN clients or DHCP renewals
+// may remove them) and reinstalls missing ones. repaired, which may be nil, is called
+// after each check that found something missing. Checks are skipped while disconnected or
+// paused. This should be called prior to Start.
+func (w *WebtunnelClient) SetRouteMonitor(interval time.Duration, repaired func(RepairEvent)) error {
+	if interval < 0 {
+		return fmt.Errorf("invalid route monitor interval %v", interval)
+	}
+	w.monitor = routeMonitor{interval: interval, repaired: repaired}
+	return nil
+}
+
+// processRouteMonitor routinely repairs the tunnel routes and address.
+func (w *WebtunnelClient) processRouteMonitor() {
+	if w.monitor.interval == 0 {
+		return
+	}
+	for {
+		w.idleSleep(w.monitor.interval)
+		if w.isStopped.Load() {
+			glog.V(1).Info("Exiting route monitor routine")
+			return
+		}
+		if !w.isWSReady.Load() || !w.isNetReady.Load() || w.isPaused.Load() || w.applied == nil {
+			continue
+		}
+		// Routes removed by config updates stay removed.
+		cfg := *w.applied
+		cfg.Routes = w.ifce.RoutePrefix
+		ev := repairTunnel(&cfg)
+		if len(ev.Repaired) == 0 && len(ev.Failed) == 0 {
+			continue
+		}
+		for _, v := range ev.Repaired {
+			glog.Warningf("reinstalled missing %v", v)
+		}
+		for _, v := range ev.Failed {
+			glog.Errorf("unable to reinstall %v", v)
+			w.lastErrors.add(fmt.Errorf("unable to reinstall %v", v))
+		}
+		if w.monitor.repaired != nil {
+			w.monitor.repaired(ev)
+		}
+	}
+}
+
+// repairTunnel reinstalls the address and routes of cfg missing from the OS.
+func repairTunnel(cfg *TunnelConfig) RepairEvent {
+	ev := RepairEvent{Time: time.Now()}
+
+	if cfg.IP != nil {
+		addrs, err := ListAddresses(cfg.Iface)
+		if err != nil {
+			ev.Failed = append(ev.Failed, fmt.Sprintf("unable to list addresses: %v", err))
+		}
+		found := false
+		for _, a := range addrs {
+			if a.IP.Equal(cfg.IP.IP) {
+				found = true
+			}
+		}
+		if err == nil && !found {
+			desc := fmt.Sprintf("address %v dev %v", cfg.IP, cfg.Iface)
+			if err := AddAddress(cfg.Iface, cfg.IP, cfg.GWIP); err != nil {
+				ev.Failed = append(ev.Failed, fmt.Sprintf("%v: %v", desc, err))
+			} else {
+				ev.Repaired = append(ev.Repaired, desc)
+			}
+		}
+	}
+
+	routes, err := ListRoutes()
+	if err != nil {
+		ev.Failed = append(ev.Failed, fmt.Sprintf("unable to list routes: %v", err))
+		return ev
+	}
+	present := map[string]bool{}
+	for _, r := range routes {
+		if cfg.ownsRoute(r) {
+			present[r.Dst.String()] = true
+		}
+	}
+	var missing []Route
+	for _, p := range cfg.Routes {
+		if !present[p.String()] {
+			missing = append(missing, Route{Dst: p, Gateway: cfg.GWIP, Iface: cfg.Iface})
+			present[p.String()] = true // Listed once if advertised again in an update.
+		}
+	}
+	for _, e := range cfg.Exceptions {
+		if !present[e.Dst.String()] {
+			missing = append(missing, e)
+		}
+	}
+	for _, r := range missing {
+		desc := fmt.Sprintf("route %v via %v dev %v", r.Dst, r.Gateway, r.Iface)
+		if err := AddRoute(r); err != nil {
+			ev.Failed = append(ev.Failed, fmt.Sprintf("%v: %v", desc, err))
+			continue
+		}
+		ev.Repaired = append(ev.Repaired, desc)
+	}
+	return ev
+}
@@ -0,0 +1,98 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// Default smallest MTU probed; every IPv4 path must carry it.
+const defaultMinMTU = 576
+
+// Time to wait for the acknowledgement of an MTU probe.
+var mtuProbeTimeout = 2 * time.Second
+
+// SetMTUProbe enables MTU discovery on connect between min and max bytes. The largest
+// probe size acknowledged by the server is applied to the interface and passed in
+// Interface.MTU. A min of 0 uses 576. This should be called prior to Start.
+func (w *WebtunnelClient) SetMTUProbe(min, max int) error {
+	if min == 0 {
+		min = defaultMinMTU
+	}
+	if min < defaultMinMTU || max < min || max > wc.MaxMessageSize {
+		return fmt.Errorf("invalid MTU probe range %v-%v", min, max)
+	}
+	w.mtuMin = min
+	w.mtuMax = max
+	return nil
+}
+
+// mtuAcked delivers a probe acknowledgement to the running discovery.
+func (w *WebtunnelClient) mtuAcked(size int) {
+	select {
+	case w.mtuAcks <- size:
+	default:
+	}
+}
+
+// probe sends a probe of size bytes and returns true if the server acknowledged it.
+func (w *WebtunnelClient) probe(size int) (bool, error) {
+	// Discard a late acknowledgement of an earlier probe.
+	select {
+	case <-w.mtuAcks:
+	default:
+	}
+	if err := w.wsWriter.WriteControlMessage(websocket.TextMessage, wc.MTUProbeMessage(size)); err != nil {
+		return false, err
+	}
+	timeout := time.After(mtuProbeTimeout)
+	for {
+		select {
+		case ack := <-w.mtuAcks:
+			if ack == size {
+				return true, nil
+			}
+		case <-timeout:
+			return false, nil
+		}
+	}
+}
+
+// discoverMTU binary searches the largest probe acknowledged by the server and applies
+// it to the interface. Failures are logged and leave the MTU unchanged.
+func (w *WebtunnelClient) discoverMTU() {
+	if w.mtuMax == 0 || w.ifce == nil {
+		return
+	}
+	if !w.mtuProbeOK {
+		glog.Warning("server does not support MTU probing")
+		return
+	}
+	lo, hi := w.mtuMin, w.mtuMax
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		ok, err := w.probe(mid)
+		if err != nil {
+			glog.Warningf("error probing MTU: %v", err)
+			return
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	glog.V(1).Infof("Discovered tunnel MTU %v", lo)
+	if lo == w.ifce.MTU {
+		return
+	}
+	if err := SetInterfaceMTU(w.ifce.Name(), lo); err != nil {
+		glog.Warningf("unable to set MTU: %v", err)
+		w.lastErrors.add(err)
+		return
+	}
+	w.ifce.MTU = lo
+}
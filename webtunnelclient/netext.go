@@ -0,0 +1,15 @@
+package webtunnelclient
+
+import (
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+)
+
+// SetExternalInterface runs the client on ifce, an interface created by the host
+// application instead of a TUN/TAP device (eg. the packet flow of a macOS Network
+// Extension, which cannot open utun devices). The user init function receives the tunnel
+// config to apply through the host (eg. as NEPacketTunnelNetworkSettings), the client
+// does not wait for the OS to configure the interface and OS teardown checks are skipped.
+// This should be called prior to Start.
+func (w *WebtunnelClient) SetExternalInterface(ifce wc.Interface) {
+	w.external = ifce
+}
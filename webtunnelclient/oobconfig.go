@@ -0,0 +1,116 @@
+package webtunnelclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+)
+
+// SetOutOfBandConfig makes Start fetch the config with FetchConfig before connecting,
+// unless an unexpired config was fetched already. The server must serve configs with
+// SetConfigEndpoint. This should be called prior to Start.
+func (w *WebtunnelClient) SetOutOfBandConfig(enable bool) {
+	w.oobConfig = enable
+}
+
+/*
+FetchConfig retrieves the client config (IP, routes and DNS) from the /config endpoint of
+the server over HTTPS, authenticated like the websocket handshake. The server holds the IP
+of the config until its LeaseExpiry and the next Start claims it for the tunnel, so
+callers can validate the config, cache it or provision the interface before connecting.
+*/
+func (w *WebtunnelClient) FetchConfig() (*wc.ClientConfig, error) {
+	userinfo, err := w.getUserInfo()
+	if err != nil {
+		return nil, err
+	}
+	user, host, _ := strings.Cut(userinfo, " ")
+	scheme := "http"
+	if w.scheme == "wss" {
+		scheme = "https"
+	}
+	u := url.URL{Scheme: scheme, Host: w.serverIPPort, Path: "/config",
+		RawQuery: url.Values{"username": {user}, "hostname": {host}}.Encode()}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.setAuthHeader(req.Header); err != nil {
+		return nil, err
+	}
+	resp, err := w.configHTTPClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching config %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		// Log in again on the next attempt.
+		w.ssoToken = ""
+		return nil, fmt.Errorf("authentication refused by server: %v: %w", resp.Status, wc.ErrAuthFailed)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching config %v", resp.Status)
+	}
+	cfg := &wc.ClientConfig{}
+	if err := json.NewDecoder(resp.Body).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("error decoding config %w", err)
+	}
+	if err := validateLease(cfg); err != nil {
+		return nil, err
+	}
+	glog.V(1).Infof("Fetched config from server %+v", *cfg)
+
+	// The handshake claiming the lease must reach the instance holding it.
+	w.leased = cfg
+	w.affinity = cfg.ServerInfo.Instance
+	return cfg, nil
+}
+
+// validateLease returns an error if the config fetched out-of-band is incomplete.
+func validateLease(cfg *wc.ClientConfig) error {
+	if net.ParseIP(cfg.IP).To4() == nil {
+		return fmt.Errorf("invalid IP %q in config", cfg.IP)
+	}
+	if cfg.ServerInfo == nil || cfg.ServerInfo.Session == "" || cfg.LeaseExpiry == nil {
+		return fmt.Errorf("config without lease")
+	}
+	if _, _, err := parseDNSAndRoutes(cfg); err != nil {
+		return fmt.Errorf("invalid routes in config %w", err)
+	}
+	if _, err := parseDNSRoutes(cfg); err != nil {
+		return fmt.Errorf("invalid DNS routes in config %w", err)
+	}
+	return nil
+}
+
+// configHTTPClient returns an HTTP client dialing like the websocket dialer.
+func (w *WebtunnelClient) configHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           w.wsDialer.Proxy,
+			DialContext:     w.wsDialer.NetDialContext,
+			TLSClientConfig: w.wsDialer.TLSClientConfig,
+		},
+		Timeout: w.configTimeout,
+	}
+}
+
+// configLease returns the unexpired config fetched out-of-band, fetching one first if
+// enabled, nil if there is none.
+func (w *WebtunnelClient) configLease() (*wc.ClientConfig, error) {
+	if w.leased != nil && time.Now().Before(*w.leased.LeaseExpiry) {
+		return w.leased, nil
+	}
+	w.leased = nil
+	if !w.oobConfig {
+		return nil, nil
+	}
+	return w.FetchConfig()
+}
@@ -0,0 +1,120 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Prefix of the dynamic store services holding the tunnel IPv4 and DNS configuration.
+const scServicePrefix = "State:/Network/Service/webtunnel."
+
+// AddInterfaceRoute adds a route to dst via interface ifName on a routing socket. A
+// scoped route is only used by sockets bound to the interface (eg. a scoped default
+// route lets applications bound to the tunnel reach any address through it).
+func AddInterfaceRoute(dst *net.IPNet, ifName string, scoped bool) error {
+	ifi, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return fmt.Errorf("error adding route %w", err)
+	}
+	fd, err := syscall.Socket(syscall.AF_ROUTE, syscall.SOCK_RAW, syscall.AF_UNSPEC)
+	if err != nil {
+		return fmt.Errorf("error opening routing socket %w", err)
+	}
+	defer syscall.Close(fd)
+	if _, err := syscall.Write(fd, routeMessage(syscall.RTM_ADD, dst, ifi.Index, scoped)); err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("error adding route %v %w", dst, err)
+	}
+	return nil
+}
+
+// routeMessage returns a routing socket message for a route to dst via interface index.
+func routeMessage(typ int, dst *net.IPNet, index int, scoped bool) []byte {
+	hdr := syscall.RtMsghdr{
+		Type:    uint8(typ),
+		Version: syscall.RTM_VERSION,
+		Index:   uint16(index),
+		Flags:   syscall.RTF_UP | syscall.RTF_STATIC,
+		Addrs:   syscall.RTA_DST | syscall.RTA_GATEWAY | syscall.RTA_NETMASK,
+		Pid:     int32(os.Getpid()),
+		Seq:     1,
+	}
+	if scoped {
+		hdr.Flags |= syscall.RTF_IFSCOPE
+	}
+	// The gateway of an interface route is the link address of the interface.
+	gw := make([]byte, syscall.SizeofSockaddrDatalink)
+	gw[0], gw[1] = syscall.SizeofSockaddrDatalink, syscall.AF_LINK
+	*(*uint16)(unsafe.Pointer(&gw[2])) = uint16(index)
+
+	msg := append((*[syscall.SizeofRtMsghdr]byte)(unsafe.Pointer(&hdr))[:], sockaddrInet4(dst.IP)...)
+	msg = append(msg, gw...)
+	msg = append(msg, sockaddrInet4(net.IP(dst.Mask))...)
+	*(*uint16)(unsafe.Pointer(&msg[0])) = uint16(len(msg))
+	return msg
+}
+
+// sockaddrInet4 returns a sockaddr_in for ip.
+func sockaddrInet4(ip net.IP) []byte {
+	sa := make([]byte, syscall.SizeofSockaddrInet4)
+	sa[0], sa[1] = syscall.SizeofSockaddrInet4, syscall.AF_INET
+	copy(sa[4:8], ip.To4())
+	return sa
+}
+
+// SetSystemDNS publishes the tunnel DNS servers in the SystemConfiguration dynamic store
+// for interface cfg. With domains only names under them use the tunnel DNS, otherwise
+// the tunnel service overrides the primary service for all names. The framework API
+// needs cgo so the store is updated with scutil.
+func SetSystemDNS(cfg *Interface, domains []string) error {
+	service := scServicePrefix + cfg.Name()
+	var servers []string
+	for _, s := range cfg.DNS {
+		servers = append(servers, s.String())
+	}
+	script := []string{
+		"d.init",
+		"d.add Addresses * " + cfg.IP.String(),
+		"d.add InterfaceName " + cfg.Name(),
+		"d.add Router " + cfg.GWIP.String(),
+	}
+	if len(domains) == 0 {
+		script = append(script, "d.add OverridePrimary # 1")
+	}
+	script = append(script,
+		"set "+service+"/IPv4",
+		"d.init",
+		"d.add ServerAddresses * "+strings.Join(servers, " "),
+	)
+	if len(domains) > 0 {
+		script = append(script, "d.add SupplementalMatchDomains * "+strings.Join(domains, " "))
+	}
+	script = append(script, "set "+service+"/DNS")
+	if err := scutil(script); err != nil {
+		return fmt.Errorf("error setting DNS %w", err)
+	}
+	return nil
+}
+
+// RemoveSystemDNS removes the tunnel DNS of interface ifName from the dynamic store.
+func RemoveSystemDNS(ifName string) error {
+	service := scServicePrefix + ifName
+	if err := scutil([]string{"remove " + service + "/DNS", "remove " + service + "/IPv4"}); err != nil {
+		return fmt.Errorf("error removing DNS %w", err)
+	}
+	return nil
+}
+
+// scutil runs commands in scutil.
+func scutil(cmds []string) error {
+	cmd := exec.Command("/usr/sbin/scutil")
+	cmd.Stdin = strings.NewReader(strings.Join(cmds, "\n") + "\nquit\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w %s", err, out)
+	}
+	return nil
+}
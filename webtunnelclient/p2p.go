@@ -0,0 +1,453 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// P2PThreshold (Overridable) Bytes sent to another client via the server after which a direct path is negotiated.
+var P2PThreshold = 1 << 20
+
+// P2PPunchTimeout (Overridable) Time peers probe each other before falling back to the relay.
+var P2PPunchTimeout = 5 * time.Second
+
+// P2PIdleTimeout (Overridable) Time without frames from a peer after which its direct path is dropped.
+var P2PIdleTimeout = 30 * time.Second
+
+// p2pTick is the interval of probes while punching and of unacknowledged registrations.
+const p2pTick = 200 * time.Millisecond
+
+// p2pRetry is the time after negotiating a path before another is negotiated automatically.
+const p2pRetry = 5 * time.Minute
+
+// p2pFastRegister is the number of registrations sent every tick until one is acknowledged.
+const p2pFastRegister = 10
+
+// p2pPeer is a direct path to another client.
+type p2pPeer struct {
+	cipher    *wc.P2PCipher  // Seals frames with the key of the path.
+	cands     []*net.UDPAddr // Addresses probed while punching.
+	addr      *net.UDPAddr   // Address of the established path, nil while punching.
+	deadline  time.Time      // End of hole punching.
+	lastRx    time.Time      // Last frame received from the peer.
+	lastTx    time.Time      // Last probe sent on the established path.
+	requested bool           // This client asked for the path and reports its outcome.
+}
+
+// peerToPeer is the peer-to-peer state of the client.
+type peerToPeer struct {
+	conn       *net.UDPConn         // Socket of the direct paths, nil until registered.
+	rendezvous *net.UDPAddr         // Server rendezvous learning the public address of the socket.
+	token      string               // Rendezvous token, empty until the server answered.
+	regSent    time.Time            // Last registration sent to the rendezvous.
+	regAcked   time.Time            // Last registration acknowledged by the rendezvous.
+	regTries   int                  // Registrations sent since the last acknowledgement.
+	peers      map[string]*p2pPeer  // Direct paths per peer IP.
+	requested  map[string]bool      // Peers a path was asked for and not yet offered.
+	relayed    map[string]int       // Bytes relayed per peer IP since the last negotiation.
+	attempts   map[string]time.Time // Last automatic negotiation per peer IP.
+	lock       sync.Mutex
+}
+
+/*
+SetPeerToPeer sends traffic to other clients of the tunnel subnet over direct encrypted
+UDP paths instead of relaying it via the server, which must enable it too. Once
+P2PThreshold bytes went to a client via the server (or after ConnectPeer) the server
+sends both clients the addresses of the other and a fresh key, and they probe each other
+to open their NATs. If no probe is answered within P2PPunchTimeout, or a path goes
+silent for P2PIdleTimeout, traffic is relayed via the server again. Peers whose public
+address is routed via the tunnel reach each other through the server anyway. This should
+be called prior to Start.
+*/
+func (w *WebtunnelClient) SetPeerToPeer(enable bool) {
+	if !enable {
+		w.p2p = nil
+		return
+	}
+	w.p2p = &peerToPeer{
+		peers:     make(map[string]*p2pPeer),
+		requested: make(map[string]bool),
+		relayed:   make(map[string]int),
+		attempts:  make(map[string]time.Time),
+	}
+}
+
+// ConnectPeer asks the server to negotiate a direct path to the client on ip.
+func (w *WebtunnelClient) ConnectPeer(ip net.IP) error {
+	if w.p2p == nil {
+		return fmt.Errorf("peer-to-peer not enabled")
+	}
+	if !w.isPeer(ip) {
+		return fmt.Errorf("%v is not a client of the tunnel subnet", ip)
+	}
+	w.p2p.lock.Lock()
+	w.p2p.requested[ip.String()] = true
+	w.p2p.lock.Unlock()
+	return w.sendP2P(&wc.P2PMessage{Type: wc.P2PConnect, Peer: ip.String()})
+}
+
+// PeerPaths returns the UDP address of the direct path per peer IP.
+func (w *WebtunnelClient) PeerPaths() map[string]string {
+	paths := make(map[string]string)
+	if w.p2p == nil {
+		return paths
+	}
+	w.p2p.lock.Lock()
+	defer w.p2p.lock.Unlock()
+	for ip, p := range w.p2p.peers {
+		if p.addr != nil {
+			paths[ip] = p.addr.String()
+		}
+	}
+	return paths
+}
+
+// registerP2P opens the peer-to-peer socket and registers its local addresses with the
+// server, which answers with a rendezvous token.
+func (w *WebtunnelClient) registerP2P() error {
+	if w.p2p == nil {
+		return nil
+	}
+	w.p2p.lock.Lock()
+	if w.p2p.conn == nil {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+		if err != nil {
+			w.p2p.lock.Unlock()
+			return err
+		}
+		w.p2p.conn = conn
+	}
+	w.p2p.token = ""
+	port := w.p2p.conn.LocalAddr().(*net.UDPAddr).Port
+	w.p2p.lock.Unlock()
+
+	var addrs []string
+	ifAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, a := range ifAddrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || n.IP.To4() == nil || n.IP.IsLoopback() || n.IP.Equal(w.ifce.IP) {
+			continue
+		}
+		addrs = append(addrs, (&net.UDPAddr{IP: n.IP, Port: port}).String())
+	}
+	return w.sendP2P(&wc.P2PMessage{Type: wc.P2PRegister, Addrs: addrs})
+}
+
+// processP2P handles a peer-to-peer control message from the server.
+func (w *WebtunnelClient) processP2P(msg []byte) {
+	m := &wc.P2PMessage{}
+	if err := wc.DecodeControl(w.codec(), msg, m); err != nil {
+		glog.Warningf("invalid peer-to-peer message: %v", err)
+		return
+	}
+	if w.p2p == nil {
+		return
+	}
+	switch m.Type {
+	case wc.P2PToken:
+		host, _, err := net.SplitHostPort(w.serverIPPort)
+		if err != nil || len(m.Addrs) == 0 {
+			glog.Warningf("invalid rendezvous %v: %v", m.Addrs, err)
+			return
+		}
+		_, port, err := net.SplitHostPort(m.Addrs[0])
+		if err != nil {
+			glog.Warningf("invalid rendezvous %v: %v", m.Addrs, err)
+			return
+		}
+		addr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(host, port))
+		if err != nil {
+			glog.Warningf("unable to resolve rendezvous: %v", err)
+			return
+		}
+		w.p2p.lock.Lock()
+		w.p2p.token = m.Token
+		w.p2p.rendezvous = addr
+		w.p2p.regSent = time.Time{}
+		w.p2p.regTries = 0
+		w.p2p.lock.Unlock()
+
+	case wc.P2POffer:
+		peer := net.ParseIP(m.Peer).To4()
+		c, err := wc.NewP2PCipher(m.Key, w.ifce.IP)
+		if peer == nil || err != nil {
+			glog.Warningf("invalid peer-to-peer offer for %v: %v", m.Peer, err)
+			return
+		}
+		p := &p2pPeer{cipher: c, deadline: time.Now().Add(P2PPunchTimeout)}
+		for _, a := range m.Addrs {
+			if addr, err := net.ResolveUDPAddr("udp4", a); err == nil {
+				p.cands = append(p.cands, addr)
+			}
+		}
+		w.p2p.lock.Lock()
+		p.requested = w.p2p.requested[m.Peer]
+		delete(w.p2p.requested, m.Peer)
+		w.p2p.peers[m.Peer] = p
+		w.p2p.lock.Unlock()
+		glog.V(1).Infof("Punching direct path to %v via %v", m.Peer, m.Addrs)
+
+	case wc.P2PFailed:
+		w.p2p.lock.Lock()
+		delete(w.p2p.requested, m.Peer)
+		w.p2p.lock.Unlock()
+		glog.V(1).Infof("Server refused direct path to %v, relaying", m.Peer)
+	}
+}
+
+// sendP2P sends a peer-to-peer control message to the server.
+func (w *WebtunnelClient) sendP2P(m *wc.P2PMessage) error {
+	b, err := wc.EncodeControl(w.codec(), m)
+	if err != nil {
+		return err
+	}
+	return w.wsWriter.WriteControlMessage(websocket.TextMessage, append([]byte(wc.P2PPrefix), b...))
+}
+
+// isPeer returns true if ip is another client of the tunnel subnet.
+func (w *WebtunnelClient) isPeer(ip net.IP) bool {
+	n := &net.IPNet{IP: w.ifce.IP.Mask(net.IPMask(w.ifce.Netmask)), Mask: net.IPMask(w.ifce.Netmask)}
+	return n.Contains(ip) && !ip.Equal(w.ifce.IP) && !ip.Equal(w.ifce.GWIP)
+}
+
+// sendDirect sends the IP packet pkt over the direct path to its destination and returns
+// true, or false if it has to be relayed via the server.
+func (w *WebtunnelClient) sendDirect(pkt []byte) bool {
+	if w.p2p == nil || len(pkt) < 20 || pkt[0]>>4 != 4 {
+		return false
+	}
+	dst := net.IP(pkt[16:20])
+	if !w.isPeer(dst) {
+		return false
+	}
+	key := dst.String()
+
+	w.p2p.lock.Lock()
+	if p := w.p2p.peers[key]; p != nil {
+		if p.addr == nil {
+			w.p2p.lock.Unlock()
+			return false
+		}
+		frame, addr, conn := p.cipher.Seal(wc.P2PFrameData, pkt), p.addr, w.p2p.conn
+		w.p2p.lock.Unlock()
+		if _, err := conn.WriteToUDP(frame, addr); err != nil {
+			glog.V(2).Infof("error sending to %v directly: %v", key, err)
+			return false
+		}
+		return true
+	}
+	w.p2p.relayed[key] += len(pkt)
+	negotiate := w.p2p.relayed[key] >= P2PThreshold && w.p2p.token != "" &&
+		time.Since(w.p2p.attempts[key]) > p2pRetry
+	if negotiate {
+		w.p2p.attempts[key] = time.Now()
+		w.p2p.relayed[key] = 0
+	}
+	w.p2p.lock.Unlock()
+
+	if negotiate {
+		glog.V(1).Infof("Heavy traffic to %v, negotiating direct path", key)
+		if err := w.ConnectPeer(dst); err != nil {
+			glog.Warningf("error negotiating direct path to %v: %v", key, err)
+		}
+	}
+	return false
+}
+
+// processP2PFrames reads the frames of the rendezvous and the direct paths.
+func (w *WebtunnelClient) processP2PFrames(conn *net.UDPConn) {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if !w.isStopped.Load() {
+				glog.Warningf("error reading peer-to-peer socket: %v", err)
+			}
+			return
+		}
+		typ, payload, ok := wc.ParseP2PFrame(buf[:n])
+		if !ok {
+			continue
+		}
+		if err := w.handleP2PFrame(typ, payload, addr); err != nil {
+			w.sendError(err)
+			return
+		}
+	}
+}
+
+// handleP2PFrame processes the frame of type typ from addr.
+func (w *WebtunnelClient) handleP2PFrame(typ byte, payload []byte, addr *net.UDPAddr) error {
+	if typ == wc.P2PFrameRegister {
+		w.p2p.lock.Lock()
+		if w.p2p.token != "" && string(payload) == w.p2p.token {
+			w.p2p.regAcked = time.Now()
+			w.p2p.regTries = 0
+		}
+		w.p2p.lock.Unlock()
+		return nil
+	}
+	sender := wc.P2PSender(payload)
+	if sender == nil {
+		return nil
+	}
+	key := sender.String()
+	w.p2p.lock.Lock()
+	p := w.p2p.peers[key]
+	w.p2p.lock.Unlock()
+	if p == nil {
+		return nil
+	}
+	plain, newest, err := p.cipher.Open(typ, payload)
+	if err != nil {
+		glog.V(2).Infof("dropping peer-to-peer frame from %v: %v", addr, err)
+		return nil
+	}
+
+	w.p2p.lock.Lock()
+	p.lastRx = time.Now()
+	up := false
+	switch {
+	case p.addr == nil && (typ == wc.P2PFrameProbe || typ == wc.P2PFrameProbeAck):
+		p.addr = addr
+		up = p.requested
+		glog.Infof("Direct path to %v via %v", key, addr)
+	case newest && p.addr != nil && p.addr.String() != addr.String():
+		// The NAT of the peer rebound the path. Late frames from the old address do not
+		// move it back.
+		p.addr = addr
+	}
+	conn := w.p2p.conn
+	w.p2p.lock.Unlock()
+	if up {
+		if err := w.sendP2P(&wc.P2PMessage{Type: wc.P2PUp, Peer: key}); err != nil {
+			glog.Warningf("error reporting direct path to %v: %v", key, err)
+		}
+	}
+
+	switch typ {
+	case wc.P2PFrameProbe:
+		if conn != nil {
+			conn.WriteToUDP(p.cipher.Seal(wc.P2PFrameProbeAck, nil), addr)
+		}
+	case wc.P2PFrameData:
+		// A peer may only send its own packets.
+		if len(plain) < 20 || plain[0]>>4 != 4 || !net.IP(plain[12:16]).Equal(sender) {
+			glog.V(2).Infof("dropping spoofed packet from peer %v", key)
+			return nil
+		}
+		if w.isPaused.Load() {
+			return nil
+		}
+		wc.PrintPacketIPv4(plain, "Client <- Peer")
+		return w.writeTunnel(plain)
+	}
+	return nil
+}
+
+// processPeerToPeer registers with the rendezvous, punches and keeps the direct paths
+// alive and falls back to the relay for peers that can't be reached.
+func (w *WebtunnelClient) processPeerToPeer() {
+	if w.p2p == nil {
+		return
+	}
+	w.p2p.lock.Lock()
+	conn := w.p2p.conn
+	w.p2p.lock.Unlock()
+	if conn == nil {
+		return
+	}
+	go w.processP2PFrames(conn)
+	for {
+		time.Sleep(p2pTick)
+		if w.isStopped.Load() {
+			glog.V(1).Info("Exiting peer-to-peer routine")
+			return
+		}
+		for _, m := range w.p2pTick(time.Now()) {
+			if err := w.sendP2P(m); err != nil {
+				glog.Warningf("error reporting %v direct path to %v: %v", m.Type, m.Peer, err)
+			}
+		}
+	}
+}
+
+// p2pTick sends the registrations and probes due at now and returns the reports of
+// failed paths for the server.
+func (w *WebtunnelClient) p2pTick(now time.Time) []*wc.P2PMessage {
+	s := w.p2p
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	if s.token != "" {
+		interval := P2PIdleTimeout / 3
+		if s.regAcked.Before(s.regSent) && s.regTries < p2pFastRegister {
+			interval = p2pTick
+		}
+		if now.Sub(s.regSent) >= interval {
+			s.conn.WriteToUDP(wc.P2PFrame(wc.P2PFrameRegister, []byte(s.token)), s.rendezvous)
+			s.regSent = now
+			s.regTries++
+		}
+	}
+
+	var reports []*wc.P2PMessage
+	for ip, p := range s.peers {
+		switch {
+		case p.addr == nil && now.After(p.deadline):
+			glog.Infof("No direct path to %v, relaying via server", ip)
+			delete(s.peers, ip)
+			if p.requested {
+				reports = append(reports, &wc.P2PMessage{Type: wc.P2PFailed, Peer: ip})
+			}
+		case p.addr == nil:
+			probe := p.cipher.Seal(wc.P2PFrameProbe, nil)
+			for _, c := range p.cands {
+				s.conn.WriteToUDP(probe, c)
+			}
+		case now.Sub(p.lastRx) > P2PIdleTimeout:
+			glog.Infof("Direct path to %v lost, relaying via server", ip)
+			delete(s.peers, ip)
+		case now.Sub(p.lastTx) > P2PIdleTimeout/3:
+			s.conn.WriteToUDP(p.cipher.Seal(wc.P2PFrameProbe, nil), p.addr)
+			p.lastTx = now
+		}
+	}
+	return reports
+}
+
+// dropPeers falls back to the relay for all peers, eg. after the tunnel IP changed.
+func (w *WebtunnelClient) dropPeers() {
+	if w.p2p == nil {
+		return
+	}
+	w.p2p.lock.Lock()
+	w.p2p.peers = make(map[string]*p2pPeer)
+	w.p2p.lock.Unlock()
+}
+
+// closeP2P closes the peer-to-peer socket on Stop.
+func (w *WebtunnelClient) closeP2P() {
+	if w.p2p == nil {
+		return
+	}
+	w.p2p.lock.Lock()
+	defer w.p2p.lock.Unlock()
+	if w.p2p.conn != nil {
+		w.p2p.conn.Close()
+		w.p2p.conn = nil
+	}
+	w.p2p.token = ""
+	w.p2p.peers = make(map[string]*p2pPeer)
+}
@@ -0,0 +1,108 @@
+package webtunnelclient
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// Length of the packet length header of a packet stream.
+const packetStreamHeaderLen = 2
+
+// PacketStream is a TUN-like interface exchanging raw IP packets over a byte stream, for
+// tooling without a TUN device such as network simulators, userspace stacks and tests.
+// Each packet is preceded by its length as a 16 bit big endian integer. Run the client
+// on it with SetExternalInterface.
+type PacketStream struct {
+	name   string
+	r      io.Reader
+	w      io.Writer
+	c      io.Closer
+	header [packetStreamHeaderLen]byte
+	rLock  sync.Mutex
+	wLock  sync.Mutex
+}
+
+// NewPacketStream returns a packet stream named name reading packets from r and writing
+// packets to w. Close closes c if not nil.
+func NewPacketStream(name string, r io.Reader, w io.Writer, c io.Closer) *PacketStream {
+	return &PacketStream{name: name, r: r, w: w, c: c}
+}
+
+// StdioPacketStream returns a packet stream over the standard input and output. Nothing
+// else must write to the standard output.
+func StdioPacketStream() *PacketStream {
+	return NewPacketStream("stdio", os.Stdin, os.Stdout, nil)
+}
+
+// DialPacketStream returns a packet stream over a connection to the unix socket path.
+func DialPacketStream(path string) (*PacketStream, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to packet socket %w", err)
+	}
+	return NewPacketStream(path, conn, conn, conn), nil
+}
+
+// Read reads the next packet into b. A packet larger than b is discarded and
+// io.ErrShortBuffer returned.
+func (p *PacketStream) Read(b []byte) (int, error) {
+	p.rLock.Lock()
+	defer p.rLock.Unlock()
+	if _, err := io.ReadFull(p.r, p.header[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(p.header[:]))
+	if n > len(b) {
+		if _, err := io.CopyN(io.Discard, p.r, int64(n)); err != nil {
+			return 0, err
+		}
+		return 0, io.ErrShortBuffer
+	}
+	if _, err := io.ReadFull(p.r, b[:n]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Write writes the packet b.
+func (p *PacketStream) Write(b []byte) (int, error) {
+	if len(b) > 0xffff {
+		return 0, fmt.Errorf("packet of %v bytes too large for a packet stream", len(b))
+	}
+	frame := make([]byte, packetStreamHeaderLen+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[packetStreamHeaderLen:], b)
+	p.wLock.Lock()
+	defer p.wLock.Unlock()
+	if _, err := p.w.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the underlying stream.
+func (p *PacketStream) Close() error {
+	if p.c == nil {
+		return nil
+	}
+	return p.c.Close()
+}
+
+// IsTUN returns true, packet streams carry IP packets.
+func (p *PacketStream) IsTUN() bool {
+	return true
+}
+
+// IsTAP returns false.
+func (p *PacketStream) IsTAP() bool {
+	return false
+}
+
+// Name returns the name of the stream.
+func (p *PacketStream) Name() string {
+	return p.name
+}
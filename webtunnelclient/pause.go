@@ -0,0 +1,55 @@
+package webtunnelclient
+
+import (
+	"fmt"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+)
+
+// SetPauseFuncs sets optional user callbacks run on Pause and Resume, eg. to remove and
+// reinstall the routes via the tunnel so traffic uses the default path while paused.
+func (w *WebtunnelClient) SetPauseFuncs(pause, resume func(*Interface) error) {
+	w.pauseFunc = pause
+	w.resumeFunc = resume
+}
+
+// Pause stops forwarding data packets in both directions. The websocket connection and
+// keepalives stay up so Resume does not need a reconnect.
+func (w *WebtunnelClient) Pause() error {
+	if w.ifce == nil {
+		return fmt.Errorf("client not started: %w", wc.ErrNotConfigured)
+	}
+	// Only the call flipping the flag runs the callback.
+	if !w.isPaused.CompareAndSwap(false, true) {
+		return nil
+	}
+	if w.pauseFunc != nil {
+		if err := w.pauseFunc(w.ifce); err != nil {
+			w.isPaused.Store(false)
+			return fmt.Errorf("error pausing %w", err)
+		}
+	}
+	glog.Info("Tunnel paused")
+	return nil
+}
+
+// Resume restarts forwarding data packets after Pause.
+func (w *WebtunnelClient) Resume() error {
+	if !w.isPaused.CompareAndSwap(true, false) {
+		return nil
+	}
+	if w.resumeFunc != nil {
+		if err := w.resumeFunc(w.ifce); err != nil {
+			w.isPaused.Store(true)
+			return fmt.Errorf("error resuming %w", err)
+		}
+	}
+	glog.Info("Tunnel resumed")
+	return nil
+}
+
+// IsPaused returns true while data forwarding is paused.
+func (w *WebtunnelClient) IsPaused() bool {
+	return w.isPaused.Load()
+}
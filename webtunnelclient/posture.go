@@ -0,0 +1,62 @@
+package webtunnelclient
+
+import (
+	"crypto"
+	"crypto/tls"
+	"fmt"
+	"runtime"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+)
+
+// PostureCollector collects the device posture reported to the server in the handshake.
+type PostureCollector interface {
+	Collect() (*wc.Posture, error)
+}
+
+// BasicPostureCollector reports only the operating system. It is a starting point for
+// collectors that add platform specific checks (disk encryption, AV status etc).
+type BasicPostureCollector struct{}
+
+// Collect returns the posture with the operating system set.
+func (BasicPostureCollector) Collect() (*wc.Posture, error) {
+	return &wc.Posture{OS: runtime.GOOS}, nil
+}
+
+/*
+SetPostureCollector sets the collector of the device posture reported to the server in
+config requests. Reports are signed with the private key of the first client certificate
+of the TLS config of the websocket dialer and bound to the TLS connection, so the server
+verifies them against the certificate the device presented. The server gates the config on the
+report; servers without control messages don't receive it. This should be called prior
+to Start.
+*/
+func (w *WebtunnelClient) SetPostureCollector(c PostureCollector) {
+	w.postureCollector = c
+}
+
+// postureReport collects the device posture and signs it for the current connection.
+func (w *WebtunnelClient) postureReport() (*wc.PostureReport, error) {
+	tlsCfg := w.wsDialer.TLSClientConfig
+	if tlsCfg == nil || len(tlsCfg.Certificates) == 0 {
+		return nil, fmt.Errorf("posture requires a client certificate")
+	}
+	key, ok := tlsCfg.Certificates[0].PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported client certificate key %T", tlsCfg.Certificates[0].PrivateKey)
+	}
+	conn, ok := w.wsconn.UnderlyingConn().(*tls.Conn)
+	if !ok {
+		return nil, fmt.Errorf("posture requires a TLS connection")
+	}
+	cs := conn.ConnectionState()
+	binding, err := wc.PostureBinding(&cs)
+	if err != nil {
+		return nil, err
+	}
+	p, err := w.postureCollector.Collect()
+	if err != nil {
+		return nil, err
+	}
+	return wc.SignPosture(p, key, binding)
+}
@@ -0,0 +1,128 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Factor by which background checks slow down while idle.
+const idleSlowdown = 4
+
+// powerSaving is the inactivity power saving state.
+type powerSaving struct {
+	idleAfter     time.Duration // Inactivity before going idle, 0 if disabled.
+	keepaliveOnly bool          // Suspend background checks entirely while idle.
+	idle          atomic.Bool   // True while idle.
+	wake          chan struct{} // Closed when waking up, nil while active.
+	lastActivity  time.Time     // Time of the last packet.
+	lock          sync.Mutex
+}
+
+/*
+SetPowerSaving puts the client in an idle mode when no packets flow in either direction
+for idleAfter, eg. to save battery on laptops. While idle the route monitor and keepalive
+checks run at a quarter of their rate; with keepaliveOnly they are suspended and only the
+websocket keepalives remain. The first packet from the interface or the websocket wakes
+the client up instantly. This should be called prior to Start.
+*/
+func (w *WebtunnelClient) SetPowerSaving(idleAfter time.Duration, keepaliveOnly bool) error {
+	if idleAfter <= 0 {
+		return fmt.Errorf("invalid idle period %v", idleAfter)
+	}
+	w.power.idleAfter = idleAfter
+	w.power.keepaliveOnly = keepaliveOnly
+	return nil
+}
+
+// IsIdle returns true while the client is idle to save power.
+func (w *WebtunnelClient) IsIdle() bool {
+	return w.power.idle.Load()
+}
+
+// noteActivity records traffic and wakes the client up if idle.
+func (w *WebtunnelClient) noteActivity() {
+	p := &w.power
+	if p.idleAfter == 0 {
+		return
+	}
+	p.lock.Lock()
+	p.lastActivity = time.Now()
+	p.lock.Unlock()
+	w.wakeUp()
+}
+
+// wakeUp leaves idle mode.
+func (w *WebtunnelClient) wakeUp() {
+	p := &w.power
+	if !p.idle.CompareAndSwap(true, false) {
+		return
+	}
+	p.lock.Lock()
+	close(p.wake)
+	p.wake = nil
+	p.lock.Unlock()
+	glog.V(1).Info("Tunnel active, leaving power saving")
+}
+
+// idleSleep sleeps d, then waits longer while idle: until woken up in keepalive only mode,
+// or for a slowed down interval otherwise.
+func (w *WebtunnelClient) idleSleep(d time.Duration) {
+	time.Sleep(d)
+	p := &w.power
+	p.lock.Lock()
+	wake := p.wake
+	p.lock.Unlock()
+	if wake == nil {
+		return
+	}
+	if p.keepaliveOnly {
+		<-wake
+		return
+	}
+	select {
+	case <-wake:
+	case <-time.After(d * (idleSlowdown - 1)):
+	}
+}
+
+// processPowerSaving puts the client in idle mode after a period without traffic.
+func (w *WebtunnelClient) processPowerSaving() {
+	p := &w.power
+	if p.idleAfter == 0 {
+		return
+	}
+	p.lock.Lock()
+	p.lastActivity = time.Now()
+	p.lock.Unlock()
+	for {
+		p.lock.Lock()
+		wait := time.Until(p.lastActivity.Add(p.idleAfter))
+		wake := p.wake
+		p.lock.Unlock()
+		if wake != nil {
+			<-wake
+			continue
+		}
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+		if w.isStopped.Load() {
+			glog.V(1).Info("Exiting power saving routine")
+			return
+		}
+		p.lock.Lock()
+		if !w.isWSReady.Load() {
+			// Idle time counts from the reconnect.
+			p.lastActivity = time.Now()
+		} else if time.Since(p.lastActivity) >= p.idleAfter {
+			p.wake = make(chan struct{})
+			p.idle.Store(true)
+			glog.V(1).Infof("No traffic for %v, entering power saving", p.idleAfter)
+		}
+		p.lock.Unlock()
+	}
+}
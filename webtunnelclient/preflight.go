@@ -0,0 +1,165 @@
+package webtunnelclient
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// IsPrivileged (Overridable) Check if the process can configure network interfaces.
+var IsPrivileged = isPrivileged
+
+// CheckDNSAccess (Overridable) Check if the OS resolver configuration can be changed.
+var CheckDNSAccess = checkDNSAccess
+
+// Timeout of the server reachability check.
+const preflightDialTimeout = 5 * time.Second
+
+// Host route added and removed to check route table write access (TEST-NET-1, RFC 5737).
+var preflightRoute = &net.IPNet{IP: net.IP{192, 0, 2, 1}, Mask: net.CIDRMask(32, 32)}
+
+// Preflight check names.
+const (
+	CheckPrivileges   = "privileges"
+	CheckDriver       = "driver"
+	CheckRoutes       = "routes"
+	CheckDNS          = "dns"
+	CheckReachability = "server"
+)
+
+// PreflightCheck is the result of one preflight check.
+type PreflightCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"` // Why the check failed.
+}
+
+// PreflightReport is the result of Preflight.
+type PreflightReport struct {
+	Checks []PreflightCheck `json:"checks"`
+}
+
+// OK returns true if all checks passed.
+func (p *PreflightReport) OK() bool {
+	return len(p.Failures()) == 0
+}
+
+// Failures returns the checks that failed.
+func (p *PreflightReport) Failures() []PreflightCheck {
+	var failed []PreflightCheck
+	for _, c := range p.Checks {
+		if !c.OK {
+			failed = append(failed, c)
+		}
+	}
+	return failed
+}
+
+// String formats the report one check per line.
+func (p *PreflightReport) String() string {
+	var b strings.Builder
+	for _, c := range p.Checks {
+		if c.OK {
+			fmt.Fprintf(&b, "%-10s ok\n", c.Name)
+		} else {
+			fmt.Fprintf(&b, "%-10s FAILED: %v\n", c.Name, c.Error)
+		}
+	}
+	return b.String()
+}
+
+// add records the result of a check.
+func (p *PreflightReport) add(name string, err error) {
+	c := PreflightCheck{Name: name, OK: err == nil}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	p.Checks = append(p.Checks, c)
+}
+
+/*
+Preflight checks that the client can set up a tunnel without connecting: admin privileges,
+the TUN/TAP driver (an interface is created and closed), route table write access (a
+TEST-NET host route is added and removed), DNS configurability and server reachability
+(including the TLS handshake for secure servers). All checks run even if one fails. This
+should be called prior to Start.
+*/
+func (w *WebtunnelClient) Preflight() *PreflightReport {
+	report := &PreflightReport{}
+	var err error
+	if !IsPrivileged() {
+		err = fmt.Errorf("not running with administrator privileges")
+	}
+	report.add(CheckPrivileges, err)
+	report.add(CheckDriver, w.checkDriver())
+	report.add(CheckRoutes, checkRouteAccess())
+	report.add(CheckDNS, CheckDNSAccess())
+	report.add(CheckReachability, w.checkReachability())
+	return report
+}
+
+// checkDriver creates and closes the network interface, keeping the configured type.
+func (w *WebtunnelClient) checkDriver() error {
+	devType, useTap, isWintun := w.devType, w.useTap, w.isWintun
+	defer func() { w.devType, w.useTap, w.isWintun = devType, useTap, isWintun }()
+	if w.external != nil {
+		return nil
+	}
+	handle, err := w.newInterface()
+	if err != nil {
+		return err
+	}
+	return handle.Close()
+}
+
+// checkRouteAccess adds and removes a host route via the default gateway.
+func checkRouteAccess() error {
+	routes, err := ListRoutes()
+	if err != nil {
+		return fmt.Errorf("unable to read routes: %w", err)
+	}
+	var def *Route
+	for i, r := range routes {
+		if ones, _ := r.Dst.Mask.Size(); ones == 0 {
+			def = &routes[i]
+			break
+		}
+	}
+	if def == nil {
+		return fmt.Errorf("no default route")
+	}
+	r := Route{Dst: preflightRoute, Gateway: def.Gateway, Iface: def.Iface}
+	if err := AddRoute(r); err != nil {
+		return fmt.Errorf("unable to add routes: %w", err)
+	}
+	if err := DeleteRoute(r); err != nil {
+		return fmt.Errorf("unable to remove test route %v: %w", preflightRoute, err)
+	}
+	return nil
+}
+
+// checkReachability connects to the server, with a TLS handshake for secure servers.
+func (w *WebtunnelClient) checkReachability() error {
+	d := &net.Dialer{Timeout: preflightDialTimeout}
+	if w.scheme != "wss" {
+		conn, err := d.Dial("tcp", w.serverIPPort)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	cfg := &tls.Config{}
+	if w.wsDialer.TLSClientConfig != nil {
+		cfg = w.wsDialer.TLSClientConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(w.serverIPPort)
+	}
+	conn, err := tls.DialWithDialer(d, "tcp", w.serverIPPort, cfg)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,24 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// isPrivileged returns true if the process runs as root.
+func isPrivileged() bool {
+	return os.Geteuid() == 0
+}
+
+// checkDNSAccess checks scutil, used to change the resolver configuration, is available
+// to a root process.
+func checkDNSAccess() error {
+	if _, err := exec.LookPath("/usr/sbin/scutil"); err != nil {
+		return fmt.Errorf("scutil not available: %w", err)
+	}
+	if !isPrivileged() {
+		return fmt.Errorf("changing DNS servers needs root")
+	}
+	return nil
+}
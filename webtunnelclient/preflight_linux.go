@@ -0,0 +1,20 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"os"
+)
+
+// isPrivileged returns true if the process runs as root.
+func isPrivileged() bool {
+	return os.Geteuid() == 0
+}
+
+// checkDNSAccess opens the resolver configuration for writing without changing it.
+func checkDNSAccess() error {
+	f, err := os.OpenFile(resolvConf, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("unable to write %v: %w", resolvConf, err)
+	}
+	return f.Close()
+}
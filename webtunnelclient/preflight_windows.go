@@ -0,0 +1,29 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// isPrivileged returns true if the process runs elevated. Opening a physical drive is
+// only allowed to administrators.
+func isPrivileged() bool {
+	f, err := os.Open(`\\.\PHYSICALDRIVE0`)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// checkDNSAccess checks netsh, used to change DNS servers, is available to an elevated process.
+func checkDNSAccess() error {
+	if _, err := exec.LookPath("netsh"); err != nil {
+		return fmt.Errorf("netsh not available: %w", err)
+	}
+	if !isPrivileged() {
+		return fmt.Errorf("changing DNS servers needs administrator privileges")
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+package webtunnelclient
+
+import "github.com/deepakkamesh/webtunnel/webtunnelcommon/metrics"
+
+// Namespace of the client metrics served on /metrics.
+const promNamespace = "webtunnel_client"
+
+// PrometheusMetrics returns the collectors served on /metrics of the status endpoint, eg.
+// to serve them elsewhere or add the metrics of the host application.
+func (w *WebtunnelClient) PrometheusMetrics() *metrics.Tunnel {
+	return w.prom
+}
@@ -0,0 +1,84 @@
+package webtunnelclient
+
+import (
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+)
+
+// Interval over which the network quality is evaluated.
+const qualityCheckInterval = 10 * time.Second
+
+// qualityAlert tracks the network quality against the alert thresholds.
+type qualityAlert struct {
+	maxLossRate    float64                             // Loss rate above which quality is degraded.
+	maxReorderRate float64                             // Reorder rate above which quality is degraded.
+	alert          func(degraded bool, s wc.LossStats) // User callback, nil if disabled.
+	last           wc.LossStats                        // Counts at the last check.
+	lastCheck      time.Time                           // Time of the last check.
+	degraded       bool                                // True while quality is degraded.
+}
+
+// SetQualityAlert calls alert when the loss or reorder rate of data frames received from
+// the server over a 10s interval exceeds the maximums (degraded true), and again when it
+// recovers. The stats passed are those of the interval. It requires a server that
+// supports sequence numbers. This should be called prior to Start.
+func (w *WebtunnelClient) SetQualityAlert(maxLossRate, maxReorderRate float64, alert func(degraded bool, s wc.LossStats)) {
+	w.quality = qualityAlert{maxLossRate: maxLossRate, maxReorderRate: maxReorderRate, alert: alert}
+}
+
+// GetLossStats returns the loss, reorder and duplication stats of data frames received
+// from the server since the client was created.
+func (w *WebtunnelClient) GetLossStats() wc.LossStats {
+	return w.loss.Stats()
+}
+
+// checkQuality evaluates the network quality once per interval and calls the alert
+// callback on changes.
+func (w *WebtunnelClient) checkQuality() {
+	q := &w.quality
+	if q.alert == nil {
+		return
+	}
+	now := time.Now()
+	if q.lastCheck.IsZero() {
+		q.lastCheck = now
+		q.last = w.loss.Stats()
+		return
+	}
+	if now.Sub(q.lastCheck) < qualityCheckInterval {
+		return
+	}
+	cur := w.loss.Stats()
+	s := wc.LossStats{
+		Received:   cur.Received - q.last.Received,
+		Lost:       cur.Lost - q.last.Lost,
+		Reordered:  cur.Reordered - q.last.Reordered,
+		Duplicates: cur.Duplicates - q.last.Duplicates,
+	}
+	if cur.Lost < q.last.Lost { // Late frames reduced the lost count.
+		s.Lost = 0
+	}
+	if expected := s.Received - s.Duplicates + s.Lost; expected > 0 {
+		s.LossRate = float64(s.Lost) / float64(expected)
+	}
+	if s.Received > 0 {
+		s.ReorderRate = float64(s.Reordered) / float64(s.Received)
+		s.DuplicateRate = float64(s.Duplicates) / float64(s.Received)
+	}
+	q.last = cur
+	q.lastCheck = now
+
+	degraded := s.LossRate > q.maxLossRate || s.ReorderRate > q.maxReorderRate
+	if degraded == q.degraded {
+		return
+	}
+	q.degraded = degraded
+	if degraded {
+		glog.Warningf("network quality degraded, loss: %.2f%% reorder: %.2f%%", s.LossRate*100, s.ReorderRate*100)
+	} else {
+		glog.Infof("network quality recovered")
+	}
+	q.alert(degraded, s)
+}
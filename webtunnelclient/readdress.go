@@ -0,0 +1,75 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"net"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// processReaddress moves the interface to the new IP of a config update moving the session
+// (eg. when the server renumbers its pool) and acknowledges it, so the server releases the
+// old IP. TUN interfaces are re-addressed directly and TAP interfaces through a DHCP
+// renewal; the update callback is then invoked.
+func (w *WebtunnelClient) processReaddress(cfg *wc.ClientConfig) error {
+	if !net.IP.Equal(net.ParseIP(cfg.MovedFrom).To4(), w.ifce.IP) {
+		return fmt.Errorf("readdress from wrong IP, want: %v got: %v", w.ifce.IP, cfg.MovedFrom)
+	}
+	ip := net.ParseIP(cfg.IP).To4()
+	netmask := net.ParseIP(cfg.Netmask).To4()
+	gwIP := net.ParseIP(cfg.GWIp).To4()
+	if ip == nil || netmask == nil || gwIP == nil {
+		return fmt.Errorf("invalid readdress config %+v", *cfg)
+	}
+	dnsIPs, routes, err := parseDNSAndRoutes(cfg)
+	if err != nil {
+		return err
+	}
+	dnsRoutes, err := parseDNSRoutes(cfg)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Moving interface from %v to %v", w.ifce.IP, ip)
+
+	old := &net.IPNet{IP: w.ifce.IP, Mask: net.IPMask(w.ifce.Netmask)}
+	w.statusLock.Lock()
+	w.ifce.IP = ip
+	w.ifce.Netmask = netmask
+	w.ifce.GWIP = gwIP
+	w.ifce.DNS = dnsIPs
+	w.ifce.DNSRoutes = dnsRoutes
+	w.ifce.RoutePrefix = routes
+	w.statusLock.Unlock()
+	// Direct paths are keyed to the old IP.
+	w.dropPeers()
+
+	// The host application configures an external interface in the update callback.
+	switch {
+	case w.external != nil:
+	case w.ifce.IsTAP():
+		w.dhcpRenew = true
+		if err := RenewDHCP(w.ifce.Name()); err != nil {
+			return err
+		}
+	default:
+		if err := AddAddress(w.ifce.Name(), &net.IPNet{IP: ip, Mask: net.IPMask(netmask)}, gwIP); err != nil {
+			return fmt.Errorf("error adding address %w", err)
+		}
+		if err := DeleteAddress(w.ifce.Name(), old); err != nil {
+			glog.Warningf("unable to remove old address %v: %v", old, err)
+		}
+	}
+	if w.configUpdateFunc != nil {
+		if err := w.configUpdateFunc(w.ifce); err != nil {
+			return err
+		}
+	}
+	w.recordApplied()
+	w.saveState()
+	w.applyDNSPolicy()
+	w.flushDNS()
+
+	return w.wsWriter.WriteControlMessage(websocket.TextMessage, []byte(wc.ReaddressAckPrefix+cfg.IP))
+}
@@ -0,0 +1,14 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// renewDHCP restarts DHCP on iface.
+func renewDHCP(iface string) error {
+	if out, err := exec.Command("/usr/sbin/ipconfig", "set", iface, "DHCP").CombinedOutput(); err != nil {
+		return fmt.Errorf("error renewing DHCP lease %w %s", err, out)
+	}
+	return nil
+}
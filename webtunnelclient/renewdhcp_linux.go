@@ -0,0 +1,23 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// renewDHCP renews the lease of iface with the first available DHCP client.
+func renewDHCP(iface string) error {
+	for _, cmd := range [][]string{
+		{"networkctl", "renew", iface},
+		{"dhclient", "-1", iface},
+	} {
+		if _, err := exec.LookPath(cmd[0]); err != nil {
+			continue
+		}
+		if out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput(); err != nil {
+			return fmt.Errorf("error renewing DHCP lease %w %s", err, out)
+		}
+		return nil
+	}
+	return fmt.Errorf("no DHCP client found")
+}
@@ -0,0 +1,14 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// renewDHCP renews the DHCP lease of the adapter iface.
+func renewDHCP(iface string) error {
+	if out, err := exec.Command("ipconfig", "/renew", iface).CombinedOutput(); err != nil {
+		return fmt.Errorf("error renewing DHCP lease %w %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package webtunnelclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+)
+
+// SessionState is the negotiated session of a client, handed to a replacement client
+// process (eg. a new binary version) with ExportSession and ImportSession.
+type SessionState struct {
+	Server   string `json:"server"`   // Websocket serverIP:Port.
+	Session  string `json:"session"`  // Session token from the server.
+	Affinity string `json:"affinity"` // Gateway instance holding the session.
+	IP       string `json:"ip"`       // Tunnel IP of the session.
+}
+
+// ExportSession serializes the negotiated session so a replacement client process on the
+// same host can take it over. The server closes this client's connection once the new
+// process resumes the session.
+func (w *WebtunnelClient) ExportSession() ([]byte, error) {
+	if w.ifce == nil || w.session == "" {
+		return nil, fmt.Errorf("no session to export: %w", wc.ErrNotConfigured)
+	}
+	return json.Marshal(&SessionState{
+		Server:   w.serverIPPort,
+		Session:  w.session,
+		Affinity: w.affinity,
+		IP:       w.ifce.IP.String(),
+	})
+}
+
+// ImportSession loads a session exported by another client process. The following Start
+// resumes it on the server, keeping the tunnel IP without a server visible disconnect, and
+// fails if the server no longer holds the session. This should be called prior to Start.
+func (w *WebtunnelClient) ImportSession(b []byte) error {
+	s := &SessionState{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return fmt.Errorf("error parsing session %w", err)
+	}
+	ip := net.ParseIP(s.IP).To4()
+	if s.Session == "" || ip == nil {
+		return fmt.Errorf("invalid session state")
+	}
+	if s.Server != "" {
+		w.serverIPPort = s.Server
+	}
+	w.session = s.Session
+	w.affinity = s.Affinity
+	w.resumeIP = ip
+	return nil
+}
@@ -0,0 +1,133 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// siteGateway is the site-to-site state of the client.
+type siteGateway struct {
+	prefixes  []string      // Local prefixes advertised to the server.
+	deadPeer  time.Duration // Time without keepalive answer after which the server is dead, 0 disables.
+	ack       *wc.SiteAck   // Last server response, nil if none.
+	lastPong  time.Time     // Time of the last keepalive answer.
+	withdrawn bool          // True while the tunnel routes are withdrawn.
+}
+
+/*
+SetSiteToSite runs the client as a site gateway (eg. on a branch router). After each
+connect the local prefixes are advertised to the server, which routes those it accepts
+to the session, so traffic for entire subnets is forwarded in both directions without
+NAT. The local prefixes of the server are the routes of the client config.
+
+Keepalives are sent to the server and if none is answered for deadPeer (0 disables) the
+tunnel routes are withdrawn, so traffic can fail over to another path, and the connection
+is closed, which reports an error on the Error channel. The routes are reinstalled once
+Retry reconnects. This should be called prior to Start.
+*/
+func (w *WebtunnelClient) SetSiteToSite(prefixes []string, deadPeer time.Duration) error {
+	for _, p := range prefixes {
+		if _, n, err := net.ParseCIDR(p); err != nil || n.IP.To4() == nil {
+			return fmt.Errorf("invalid site prefix %q", p)
+		}
+	}
+	if deadPeer < 0 {
+		return fmt.Errorf("invalid dead peer interval %v", deadPeer)
+	}
+	w.site = &siteGateway{prefixes: prefixes, deadPeer: deadPeer}
+	return nil
+}
+
+// SiteStatus returns the last server response to the prefix advertisement, nil if site
+// mode is disabled or no response was received.
+func (w *WebtunnelClient) SiteStatus() *wc.SiteAck {
+	if w.site == nil {
+		return nil
+	}
+	return w.site.ack
+}
+
+// sendSiteAdvert advertises the local prefixes to the server and restores withdrawn routes.
+func (w *WebtunnelClient) sendSiteAdvert() error {
+	if w.site == nil {
+		return nil
+	}
+	w.site.lastPong = time.Now()
+	if w.site.withdrawn {
+		w.site.withdrawn = false
+		for _, r := range w.tunnelRoutes() {
+			if err := AddRoute(r); err != nil {
+				glog.Warningf("unable to reinstall route %v: %v", r.Dst, err)
+			}
+		}
+	}
+	b, err := wc.EncodeControl(w.codec(), &wc.SiteAdvert{Prefixes: w.site.prefixes})
+	if err != nil {
+		return err
+	}
+	return w.wsWriter.WriteControlMessage(websocket.TextMessage, append([]byte(wc.SiteAdvertPrefix), b...))
+}
+
+// processSiteAck records the server response to the prefix advertisement.
+func (w *WebtunnelClient) processSiteAck(msg []byte) {
+	ack := &wc.SiteAck{}
+	if err := wc.DecodeControl(w.codec(), msg, ack); err != nil {
+		glog.Warningf("invalid site ack: %v", err)
+		return
+	}
+	if w.site == nil {
+		return
+	}
+	if len(ack.Rejected) > 0 {
+		glog.Warningf("server refused site prefixes %v", ack.Rejected)
+	}
+	glog.Infof("Site prefixes %v routed by server, server prefixes %v", ack.Accepted, ack.Prefixes)
+	w.site.ack = ack
+}
+
+// tunnelRoutes returns the routes via the tunnel.
+func (w *WebtunnelClient) tunnelRoutes() []Route {
+	var routes []Route
+	for _, p := range w.ifce.RoutePrefix {
+		routes = append(routes, Route{Dst: p, Gateway: w.ifce.GWIP, Iface: w.ifce.Name()})
+	}
+	return routes
+}
+
+// processSiteKeepalive sends keepalives to the server and withdraws the tunnel routes if
+// it stops answering.
+func (w *WebtunnelClient) processSiteKeepalive() {
+	if w.site == nil || w.site.deadPeer == 0 {
+		return
+	}
+	interval := w.site.deadPeer / 3
+	for {
+		w.idleSleep(interval)
+		if w.isStopped.Load() {
+			glog.V(1).Info("Exiting site keepalive routine")
+			return
+		}
+		if !w.isWSReady.Load() || w.site.withdrawn {
+			continue
+		}
+		if time.Since(w.site.lastPong) > w.site.deadPeer {
+			glog.Warningf("server not answering keepalives for %v, withdrawing tunnel routes", w.site.deadPeer)
+			w.site.withdrawn = true
+			for _, r := range w.tunnelRoutes() {
+				if err := DeleteRoute(r); err != nil {
+					glog.Warningf("unable to withdraw route %v: %v", r.Dst, err)
+				}
+			}
+			w.wsconn.Close()
+			continue
+		}
+		if err := w.wsconn.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+			glog.Warningf("issue sending keepalive: %v", err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// SetSplitDNS resolves only names under suffixes (eg. "corp.example.com") with the tunnel
+// DNS servers; other names keep using the local resolver. On Windows this installs Name
+// Resolution Policy Table rules. DHCP offers no DNS servers to the TAP interface while
+// enabled, so the user init function should not set interface DNS servers either. This
+// should be called prior to Start.
+func (w *WebtunnelClient) SetSplitDNS(suffixes []string) error {
+	var ns []string
+	for _, s := range suffixes {
+		s = strings.ToLower(strings.Trim(s, "."))
+		if s == "" || strings.Trim(s, "abcdefghijklmnopqrstuvwxyz0123456789.-") != "" {
+			return fmt.Errorf("invalid DNS suffix %q", s)
+		}
+		ns = append(ns, "."+s)
+	}
+	w.dnsSuffixes = ns
+	return nil
+}
+
+// SetDNSRegistration registers the client hostname with its tunnel address in the tunnel
+// DNS (dynamic DNS update by the OS resolver, Windows only). Failures are logged. This
+// should be called prior to Start.
+func (w *WebtunnelClient) SetDNSRegistration(enable bool) {
+	w.registerDNS = enable
+}
+
+// applyDNSPolicy installs the split DNS rules for the current tunnel DNS servers and the
+// DNS routes of the config, and registers the hostname if enabled. Failures are logged as
+// DNS still works unsplit.
+func (w *WebtunnelClient) applyDNSPolicy() {
+	if len(w.dnsSuffixes) > 0 {
+		if err := RemoveNRPTRules(); err != nil {
+			glog.Warningf("unable to remove split DNS rules: %v", err)
+		}
+		for _, s := range w.dnsSuffixes {
+			if err := AddNRPTRule(s, w.ifce.DNS); err != nil {
+				glog.Warningf("unable to add split DNS rule for %v: %v", s, err)
+				w.lastErrors.add(err)
+			}
+		}
+	}
+	w.applyDNSRoutes()
+	if w.registerDNS {
+		if err := RegisterDNSName(w.ifce.Name()); err != nil {
+			glog.Warningf("unable to register DNS name: %v", err)
+			w.lastErrors.add(err)
+		}
+	}
+}
+
+// removeDNSPolicy removes the split DNS rules and DNS routes on Stop.
+func (w *WebtunnelClient) removeDNSPolicy() {
+	w.clearDNSRoutes()
+	if len(w.dnsSuffixes) == 0 {
+		return
+	}
+	if err := RemoveNRPTRules(); err != nil {
+		glog.Warningf("unable to remove split DNS rules: %v", err)
+	}
+}
+
+// dnsServerList returns servers quoted for a PowerShell array.
+func dnsServerList(servers []net.IP) string {
+	var q []string
+	for _, s := range servers {
+		q = append(q, "'"+s.String()+"'")
+	}
+	return strings.Join(q, ",")
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package webtunnelclient
+
+import (
+	"fmt"
+	"net"
+)
+
+// addNRPTRule is only supported on Windows.
+func addNRPTRule(suffix string, servers []net.IP) error {
+	return fmt.Errorf("split DNS rules are only supported on windows")
+}
+
+// removeNRPTRules has nothing to remove outside Windows.
+func removeNRPTRules() error {
+	return nil
+}
+
+// registerDNSName is only supported on Windows.
+func registerDNSName(ifName string) error {
+	return fmt.Errorf("DNS registration is only supported on windows")
+}
@@ -0,0 +1,67 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// Comments marking the NRPT rules owned by the client so they can be removed: the split
+// DNS suffix rules and the DNS route rules from the server config.
+const (
+	nrptComment      = "webtunnel"
+	nrptRouteComment = "webtunnel-routes"
+)
+
+// powershell runs a PowerShell command.
+func powershell(cmd string) error {
+	out, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", cmd).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w %s", err, out)
+	}
+	return nil
+}
+
+// addNRPTRule sends queries for names under suffix to servers.
+func addNRPTRule(suffix string, servers []net.IP) error {
+	return addNRPTRuleWithComment(suffix, servers, nrptComment)
+}
+
+// addNRPTRuleWithComment adds an NRPT rule marked with comment.
+func addNRPTRuleWithComment(suffix string, servers []net.IP, comment string) error {
+	if len(servers) == 0 {
+		return fmt.Errorf("no DNS servers for %v", suffix)
+	}
+	cmd := fmt.Sprintf("Add-DnsClientNrptRule -Namespace '%s' -NameServers %s -Comment '%s'",
+		suffix, dnsServerList(servers), comment)
+	if err := powershell(cmd); err != nil {
+		return fmt.Errorf("error adding NRPT rule %w", err)
+	}
+	return nil
+}
+
+// removeNRPTRules removes the split DNS suffix NRPT rules added by the client.
+func removeNRPTRules() error {
+	return removeNRPTRulesWithComment(nrptComment)
+}
+
+// removeNRPTRulesWithComment removes the NRPT rules marked with comment.
+func removeNRPTRulesWithComment(comment string) error {
+	cmd := fmt.Sprintf("Get-DnsClientNrptRule | Where-Object { $_.Comment -eq '%s' } | Remove-DnsClientNrptRule -Force", comment)
+	if err := powershell(cmd); err != nil {
+		return fmt.Errorf("error removing NRPT rules %w", err)
+	}
+	return nil
+}
+
+// registerDNSName enables DNS registration on interface ifName and registers the
+// hostname with the DNS servers.
+func registerDNSName(ifName string) error {
+	name := strings.ReplaceAll(ifName, "'", "''")
+	cmd := fmt.Sprintf("Set-DnsClient -InterfaceAlias '%s' -RegisterThisConnectionsAddress $true; Register-DnsClient", name)
+	if err := powershell(cmd); err != nil {
+		return fmt.Errorf("error registering DNS name %w", err)
+	}
+	return nil
+}
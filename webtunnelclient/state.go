@@ -0,0 +1,157 @@
+package webtunnelclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+
+	"github.com/golang/glog"
+)
+
+// stateFile is the on-disk form of a TunnelConfig.
+type stateFile struct {
+	Iface      string       `json:"iface"`                // Tunnel interface name.
+	IP         string       `json:"ip,omitempty"`         // Tunnel address in CIDR notation.
+	GWIP       string       `json:"gwIP"`                 // Tunnel gateway IP.
+	Routes     []string     `json:"routes"`               // Routes via the tunnel.
+	DNS        []string     `json:"dns"`                  // DNS servers of the tunnel.
+	Exceptions []stateRoute `json:"exceptions,omitempty"` // Server host routes.
+}
+
+// stateRoute is the on-disk form of a Route.
+type stateRoute struct {
+	Dst     string `json:"dst"`
+	Gateway string `json:"gateway,omitempty"`
+	Iface   string `json:"iface"`
+}
+
+// SetStateFile persists the OS changes applied for the tunnel to path, so the next Start
+// after a crash removes the stale routes, DNS servers and addresses before connecting.
+// The file is removed after a clean Stop. This should be called prior to Start.
+func (w *WebtunnelClient) SetStateFile(path string) {
+	w.stateFile = path
+}
+
+// WriteStateFile writes the tunnel config to path, replacing any existing file.
+func WriteStateFile(path string, cfg *TunnelConfig) error {
+	s := &stateFile{Iface: cfg.Iface, GWIP: cfg.GWIP.String()}
+	if cfg.IP != nil {
+		s.IP = cfg.IP.String()
+	}
+	for _, r := range cfg.Routes {
+		s.Routes = append(s.Routes, r.String())
+	}
+	for _, d := range cfg.DNS {
+		s.DNS = append(s.DNS, d.String())
+	}
+	for _, e := range cfg.Exceptions {
+		r := stateRoute{Dst: e.Dst.String(), Iface: e.Iface}
+		if e.Gateway != nil {
+			r.Gateway = e.Gateway.String()
+		}
+		s.Exceptions = append(s.Exceptions, r)
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	// Write and rename so a crash never leaves a partial file.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ReadStateFile returns the tunnel config in path written by WriteStateFile.
+func ReadStateFile(path string) (*TunnelConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &stateFile{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("error parsing state file %w", err)
+	}
+	cfg := &TunnelConfig{Iface: s.Iface, GWIP: net.ParseIP(s.GWIP).To4()}
+	if s.IP != "" {
+		ip, n, err := net.ParseCIDR(s.IP)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing state file %w", err)
+		}
+		cfg.IP = &net.IPNet{IP: ip.To4(), Mask: n.Mask}
+	}
+	for _, v := range s.Routes {
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing state file %w", err)
+		}
+		cfg.Routes = append(cfg.Routes, n)
+	}
+	for _, v := range s.DNS {
+		if ip := net.ParseIP(v); ip != nil {
+			cfg.DNS = append(cfg.DNS, ip)
+		}
+	}
+	for _, v := range s.Exceptions {
+		_, n, err := net.ParseCIDR(v.Dst)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing state file %w", err)
+		}
+		cfg.Exceptions = append(cfg.Exceptions, Route{Dst: n, Gateway: net.ParseIP(v.Gateway).To4(), Iface: v.Iface})
+	}
+	return cfg, nil
+}
+
+// repairStaleState removes the OS changes recorded in the state file by a previous run
+// that did not stop cleanly. Failures are logged and do not prevent the client starting.
+func (w *WebtunnelClient) repairStaleState() {
+	if w.stateFile == "" {
+		return
+	}
+	cfg, err := ReadStateFile(w.stateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		glog.Warningf("unable to read state file: %v", err)
+		os.Remove(w.stateFile)
+		return
+	}
+	glog.Warningf("previous run did not stop cleanly, checking for stale tunnel config %v", w.stateFile)
+	report := VerifyTeardown(cfg)
+	for _, v := range report.Repaired {
+		glog.Warningf("removed stale %v", v)
+	}
+	for _, v := range report.Remaining {
+		glog.Errorf("unable to remove stale %v", v)
+		w.lastErrors.add(fmt.Errorf("stale %v", v))
+	}
+	if err := RemoveNRPTRules(); err != nil {
+		glog.Warningf("unable to remove stale split DNS rules: %v", err)
+	}
+	os.Remove(w.stateFile)
+}
+
+// saveState persists the applied tunnel config. Failures are logged.
+func (w *WebtunnelClient) saveState() {
+	if w.stateFile == "" || w.applied == nil {
+		return
+	}
+	if err := WriteStateFile(w.stateFile, w.applied); err != nil {
+		glog.Warningf("unable to write state file: %v", err)
+	}
+}
+
+// clearState removes the state file once the teardown left nothing behind.
+func (w *WebtunnelClient) clearState() {
+	if w.stateFile == "" || w.teardown == nil || !w.teardown.Clean() {
+		return
+	}
+	if err := os.Remove(w.stateFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		glog.Warningf("unable to remove state file: %v", err)
+	}
+}
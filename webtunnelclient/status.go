@@ -0,0 +1,235 @@
+package webtunnelclient
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/deepakkamesh/webtunnel/webtunnelcommon/version"
+	"github.com/golang/glog"
+)
+
+// Number of recent errors kept for the status endpoint.
+const maxLastErrors = 10
+
+// Status is the client state served by the local status endpoint.
+type Status struct {
+	State         string       // connecting, connected, paused, disconnected or stopped.
+	IP            string       // Assigned tunnel IP.
+	Routes        []string     // Routes via the tunnel.
+	DNS           []string     // DNS servers.
+	DeviceType    string       // TUN, TAP or WINTUN.
+	Packets       int          // Packets forwarded.
+	Bytes         int          // Bytes forwarded.
+	LastErrors    []string     // Most recent errors, oldest first.
+	Loss          wc.LossStats // Loss and reordering of data frames from the server.
+	Strategy      string       // Connection strategy, direct unless a fallback was needed.
+	ServerAddr    string       // Remote address of the websocket connection.
+	Keepalive     string       // Negotiated keepalive interval, empty if not adaptive.
+	Idle          bool         // True while idle to save power.
+	Version       string       // Client version.
+	ServerVersion string       // Server version, empty if not reported.
+	SessionID     string       // ID the server logs the session under, for support.
+}
+
+// errorLog keeps the most recent client errors.
+type errorLog struct {
+	errs []string
+	lock sync.Mutex
+}
+
+// add records err with a timestamp.
+func (l *errorLog) add(err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.errs = append(l.errs, fmt.Sprintf("%v %v", time.Now().Format(time.RFC3339), err))
+	if len(l.errs) > maxLastErrors {
+		l.errs = l.errs[len(l.errs)-maxLastErrors:]
+	}
+}
+
+// get returns a copy of the recorded errors.
+func (l *errorLog) get() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]string(nil), l.errs...)
+}
+
+// sendError records err for the status endpoint and sends it on the Error channel.
+func (w *WebtunnelClient) sendError(err error) {
+	w.lastErrors.add(err)
+	w.Error <- err
+}
+
+// GetStatus returns the current client status.
+func (w *WebtunnelClient) GetStatus() *Status {
+	packets, bytes := w.GetMetrics()
+	s := &Status{
+		DeviceType:    w.ActiveDeviceType(),
+		Packets:       packets,
+		Bytes:         bytes,
+		LastErrors:    w.lastErrors.get(),
+		Loss:          w.loss.Stats(),
+		Strategy:      w.strategy,
+		Idle:          w.IsIdle(),
+		Version:       version.Version,
+		ServerVersion: w.serverVersion,
+		SessionID:     w.sessionID,
+	}
+	switch {
+	case w.isStopped.Load():
+		s.State = "stopped"
+	case !w.isWSReady.Load():
+		s.State = "disconnected"
+	case w.isPaused.Load():
+		s.State = "paused"
+	case w.isNetReady.Load():
+		s.State = "connected"
+	default:
+		s.State = "connecting"
+	}
+	if d := w.KeepaliveInterval(); d > 0 {
+		s.Keepalive = d.String()
+	}
+	w.statusLock.Lock()
+	defer w.statusLock.Unlock()
+	if w.wsconn != nil {
+		s.ServerAddr = w.wsconn.RemoteAddr().String()
+	}
+	if w.ifce != nil {
+		s.IP = w.ifce.IP.String()
+		for _, r := range w.ifce.RoutePrefix {
+			s.Routes = append(s.Routes, r.String())
+		}
+		for _, d := range w.ifce.DNS {
+			s.DNS = append(s.DNS, d.String())
+		}
+	}
+	return s
+}
+
+// ServeStatus serves the client status as JSON on GET /status of addr, for tray apps and
+// scripts, along with the actions POST /pause, /resume and /reconnect. Reconnect closes the
+// websocket so the application retry logic reconnects. The Prometheus metrics of the
+// client are served on /metrics. addr must be a loopback address.
+// Actions require the header "Authorization: Bearer <StatusToken()>", and requests from
+// browsers (with an Origin header or a non loopback Host) are refused. The endpoint is
+// closed by Stop.
+func (w *WebtunnelClient) ServeStatus(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid status address %w", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("status endpoint must listen on localhost, got %v", host)
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return fmt.Errorf("error generating status token %w", err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error listening for status %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(w.GetStatus())
+	})
+	mux.Handle("/metrics", w.prom)
+	mux.HandleFunc("/pause", w.statusAction(w.Pause))
+	mux.HandleFunc("/resume", w.statusAction(w.Resume))
+	mux.HandleFunc("/reconnect", w.statusAction(func() error {
+		w.statusLock.Lock()
+		conn := w.wsconn
+		w.statusLock.Unlock()
+		if conn == nil {
+			return fmt.Errorf("client not started: %w", wc.ErrNotConfigured)
+		}
+		return conn.Close()
+	}))
+
+	srv := &http.Server{Handler: localOnly(mux)}
+	w.statusLock.Lock()
+	prev := w.statusServer
+	w.statusServer = srv
+	w.statusToken = hex.EncodeToString(token)
+	w.statusLock.Unlock()
+	if prev != nil {
+		prev.Close()
+	}
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			glog.Warningf("status endpoint stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// StatusToken returns the bearer token required by the actions of the status endpoint,
+// empty until ServeStatus is called. A new token is generated by each ServeStatus call.
+func (w *WebtunnelClient) StatusToken() string {
+	w.statusLock.Lock()
+	defer w.statusLock.Unlock()
+	return w.statusToken
+}
+
+// closeStatus closes the status endpoint if served.
+func (w *WebtunnelClient) closeStatus() {
+	w.statusLock.Lock()
+	srv := w.statusServer
+	w.statusServer = nil
+	w.statusLock.Unlock()
+	if srv != nil {
+		srv.Close()
+	}
+}
+
+// localOnly refuses requests sent by browsers, so web pages can't drive the endpoint
+// directly or through DNS rebinding.
+func localOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = req.Host
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			http.Error(rw, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if req.Header.Get("Origin") != "" {
+			http.Error(rw, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// statusAction returns a handler running action on POST with the status token.
+func (w *WebtunnelClient) statusAction(action func() error) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(rw, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		token := w.StatusToken()
+		got := req.Header.Get("Authorization")
+		if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) != 1 {
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := action(); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(rw, "OK")
+	}
+}
@@ -0,0 +1,285 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/golang/glog"
+)
+
+// Route is an IPv4 route in the OS routing table.
+type Route struct {
+	Dst     *net.IPNet // Destination prefix.
+	Gateway net.IP     // Next hop, nil if directly connected.
+	Iface   string     // Interface name.
+}
+
+// DNSServer is a DNS server in the OS resolver configuration.
+type DNSServer struct {
+	IP    net.IP // Server address.
+	Iface string // Interface name, empty if system wide.
+}
+
+// ListRoutes (Overridable) Return the OS IPv4 routing table.
+var ListRoutes = listRoutes
+
+// AddRoute (Overridable) Add a route to the OS routing table.
+var AddRoute = addRoute
+
+// DeleteRoute (Overridable) Remove a route from the OS routing table.
+var DeleteRoute = deleteRoute
+
+// ListDNSServers (Overridable) Return the DNS servers in the OS resolver configuration.
+var ListDNSServers = listDNSServers
+
+// DeleteDNSServer (Overridable) Remove a DNS server from the OS resolver configuration.
+var DeleteDNSServer = deleteDNSServer
+
+// ListAddresses (Overridable) Return the IPv4 addresses of an interface, none if it does
+// not exist.
+var ListAddresses = listAddresses
+
+// AddAddress (Overridable) Add an address to an interface, with the peer address of
+// point to point interfaces if not nil.
+var AddAddress = addAddress
+
+// DeleteAddress (Overridable) Remove an address from an interface.
+var DeleteAddress = deleteAddress
+
+// TunnelConfig is the OS state added for a tunnel, used to find leftovers after Stop.
+type TunnelConfig struct {
+	Iface      string       // Tunnel interface name.
+	IP         *net.IPNet   // Tunnel address, nil if assigned by DHCP.
+	GWIP       net.IP       // Tunnel gateway IP.
+	Routes     []*net.IPNet // Routes via the tunnel.
+	DNS        []net.IP     // DNS servers of the tunnel.
+	Exceptions []Route      // Host routes keeping the server reachable outside the tunnel.
+}
+
+// TeardownReport is the result of checking that tunnel routes and DNS servers were removed.
+type TeardownReport struct {
+	Repaired  []string // Leftovers that were removed.
+	Remaining []string // Leftovers that could not be removed, with the reason.
+}
+
+// Clean returns true if no leftovers remain.
+func (t *TeardownReport) Clean() bool {
+	return len(t.Remaining) == 0
+}
+
+// osState is a snapshot of the OS routes and DNS servers.
+type osState struct {
+	routes []Route
+	dns    []DNSServer
+	addrs  []*net.IPNet // Addresses of the tunnel interface.
+}
+
+// snapshotOS returns the current OS routes, DNS servers and addresses of iface. Errors are
+// logged and leave the respective list empty.
+func snapshotOS(iface string) *osState {
+	s := &osState{}
+	var err error
+	if s.addrs, err = ListAddresses(iface); err != nil {
+		glog.Warningf("unable to list addresses of %v: %v", iface, err)
+	}
+	if s.routes, err = ListRoutes(); err != nil {
+		glog.Warningf("unable to list routes: %v", err)
+	}
+	if s.dns, err = ListDNSServers(); err != nil {
+		glog.Warningf("unable to list DNS servers: %v", err)
+	}
+	return s
+}
+
+// VerifyTeardown checks the OS for routes and DNS servers of the tunnel config and removes
+// any that are left. It can be called at startup with the config of a previous run (see
+// AppliedConfig) to clean up after a crash.
+func VerifyTeardown(cfg *TunnelConfig) *TeardownReport {
+	return verifyTeardown(cfg, nil)
+}
+
+// verifyTeardown removes tunnel routes and DNS servers that were not present in base.
+func verifyTeardown(cfg *TunnelConfig, base *osState) *TeardownReport {
+	if base == nil {
+		base = &osState{}
+	}
+	report := &TeardownReport{}
+
+	if cfg.IP != nil {
+		addrs, err := ListAddresses(cfg.Iface)
+		if err != nil {
+			report.Remaining = append(report.Remaining, fmt.Sprintf("unable to list addresses: %v", err))
+		}
+		for _, a := range addrs {
+			if !a.IP.Equal(cfg.IP.IP) || base.hasAddr(a) {
+				continue
+			}
+			desc := fmt.Sprintf("address %v dev %v", a, cfg.Iface)
+			if err := DeleteAddress(cfg.Iface, a); err != nil {
+				report.Remaining = append(report.Remaining, fmt.Sprintf("%v: %v", desc, err))
+				continue
+			}
+			report.Repaired = append(report.Repaired, desc)
+		}
+	}
+
+	routes, err := ListRoutes()
+	if err != nil {
+		report.Remaining = append(report.Remaining, fmt.Sprintf("unable to list routes: %v", err))
+	}
+	for _, r := range routes {
+		if !cfg.ownsRoute(r) || base.hasRoute(r) {
+			continue
+		}
+		desc := fmt.Sprintf("route %v via %v dev %v", r.Dst, r.Gateway, r.Iface)
+		if err := DeleteRoute(r); err != nil {
+			report.Remaining = append(report.Remaining, fmt.Sprintf("%v: %v", desc, err))
+			continue
+		}
+		report.Repaired = append(report.Repaired, desc)
+	}
+
+	servers, err := ListDNSServers()
+	if err != nil {
+		report.Remaining = append(report.Remaining, fmt.Sprintf("unable to list DNS servers: %v", err))
+	}
+	for _, d := range servers {
+		if !cfg.ownsDNS(d) || base.hasDNS(d) {
+			continue
+		}
+		desc := fmt.Sprintf("DNS server %v on %q", d.IP, d.Iface)
+		if err := DeleteDNSServer(d); err != nil {
+			report.Remaining = append(report.Remaining, fmt.Sprintf("%v: %v", desc, err))
+			continue
+		}
+		report.Repaired = append(report.Repaired, desc)
+	}
+	return report
+}
+
+// ownsRoute returns true if r is a tunnel route, ie. a tunnel prefix via the tunnel
+// interface or gateway, or a server exception route.
+func (c *TunnelConfig) ownsRoute(r Route) bool {
+	for _, e := range c.Exceptions {
+		if r.Dst != nil && r.Dst.String() == e.Dst.String() && r.Iface == e.Iface && r.Gateway.Equal(e.Gateway) {
+			return true
+		}
+	}
+	viaTunnel := (c.Iface != "" && r.Iface == c.Iface) || (c.GWIP != nil && r.Gateway.Equal(c.GWIP))
+	if r.Dst == nil || !viaTunnel {
+		return false
+	}
+	for _, p := range c.Routes {
+		if p.IP.Equal(r.Dst.IP) && p.Mask.String() == r.Dst.Mask.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// ownsDNS returns true if d is a tunnel DNS server on the tunnel interface or system wide.
+func (c *TunnelConfig) ownsDNS(d DNSServer) bool {
+	if d.Iface != "" && d.Iface != c.Iface {
+		return false
+	}
+	for _, ip := range c.DNS {
+		if ip.Equal(d.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *osState) hasRoute(r Route) bool {
+	for _, v := range s.routes {
+		if v.Iface == r.Iface && v.Gateway.Equal(r.Gateway) && v.Dst.String() == r.Dst.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *osState) hasAddr(a *net.IPNet) bool {
+	for _, v := range s.addrs {
+		if v.String() == a.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *osState) hasDNS(d DNSServer) bool {
+	for _, v := range s.dns {
+		if v.Iface == d.Iface && v.IP.Equal(d.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// AppliedConfig returns the OS state the tunnel added, including routes and DNS servers
+// of earlier config updates, or nil before the interface is configured. Applications may
+// persist it to clean up with VerifyTeardown after a crash.
+func (w *WebtunnelClient) AppliedConfig() *TunnelConfig {
+	return w.applied
+}
+
+// recordApplied adds the current interface routes and DNS servers to the applied config.
+func (w *WebtunnelClient) recordApplied() {
+	if w.external != nil {
+		return
+	}
+	if w.applied == nil {
+		w.applied = &TunnelConfig{}
+	}
+	w.applied.Iface = w.ifce.Name()
+	if !w.ifce.IsTAP() {
+		w.applied.IP = &net.IPNet{IP: w.ifce.IP, Mask: net.IPMask(w.ifce.Netmask)}
+	}
+	w.applied.GWIP = w.ifce.GWIP
+	w.applied.Routes = append(w.applied.Routes, w.ifce.RoutePrefix...)
+	w.applied.DNS = append(w.applied.DNS, w.ifce.DNS...)
+	w.applied.Exceptions = w.exceptions
+}
+
+// checkTeardown verifies the tunnel routes and DNS servers were removed, repairing any
+// leftovers. Anything that could not be undone is logged and recorded in the status.
+func (w *WebtunnelClient) checkTeardown() {
+	if w.applied == nil {
+		return
+	}
+	report := verifyTeardown(w.applied, w.baseline)
+	for _, v := range report.Repaired {
+		glog.Warningf("removed leftover %v", v)
+	}
+	for _, v := range report.Remaining {
+		glog.Errorf("unable to remove leftover %v", v)
+		w.lastErrors.add(fmt.Errorf("leftover %v", v))
+	}
+	w.teardown = report
+}
+
+// listAddresses returns the IPv4 addresses of the interface name.
+func listAddresses(name string) ([]*net.IPNet, error) {
+	ifce, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, nil // Gone with the tunnel.
+	}
+	addrs, err := ifce.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var nets []*net.IPNet
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets, nil
+}
+
+// LastTeardown returns the result of the teardown check in the last Stop, nil if the
+// client has not been stopped.
+func (w *WebtunnelClient) LastTeardown() *TeardownReport {
+	return w.teardown
+}
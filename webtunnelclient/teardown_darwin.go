@@ -0,0 +1,149 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// listRoutes parses the IPv4 routing table from netstat.
+func listRoutes() ([]Route, error) {
+	out, err := exec.Command("/usr/sbin/netstat", "-rn", "-f", "inet").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error listing routes %w", err)
+	}
+	var routes []Route
+	for _, line := range strings.Split(string(out), "\n") {
+		// Destination Gateway Flags Netif [Expire]
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		dst, err := parseNetstatDst(fields[0])
+		if err != nil {
+			continue // Header, section titles or IPv6.
+		}
+		routes = append(routes, Route{Dst: dst, Gateway: net.ParseIP(fields[1]).To4(), Iface: fields[3]})
+	}
+	return routes, nil
+}
+
+// parseNetstatDst parses an abbreviated netstat destination (eg. default, 10/8, 192.168.1).
+func parseNetstatDst(s string) (*net.IPNet, error) {
+	if s == "default" {
+		return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}, nil
+	}
+	addr, bits, hasBits := strings.Cut(s, "/")
+	octets := strings.Split(addr, ".")
+	if len(octets) > 4 {
+		return nil, fmt.Errorf("invalid destination %q", s)
+	}
+	ones := 8 * len(octets)
+	if hasBits {
+		var err error
+		if ones, err = strconv.Atoi(bits); err != nil || ones > 32 {
+			return nil, fmt.Errorf("invalid destination %q", s)
+		}
+	}
+	for len(octets) < 4 {
+		octets = append(octets, "0")
+	}
+	ip := net.ParseIP(strings.Join(octets, ".")).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid destination %q", s)
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 32)}, nil
+}
+
+func addRoute(r Route) error {
+	args := []string{"-n", "add", "-net", r.Dst.String()}
+	if r.Gateway != nil {
+		args = append(args, r.Gateway.String())
+	} else {
+		args = append(args, "-interface", r.Iface)
+	}
+	if out, err := exec.Command("/sbin/route", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("error adding route %w %s", err, out)
+	}
+	return nil
+}
+
+func deleteRoute(r Route) error {
+	args := []string{"-n", "delete", "-net", r.Dst.String()}
+	if r.Gateway != nil {
+		args = append(args, r.Gateway.String())
+	} else {
+		args = append(args, "-interface", r.Iface)
+	}
+	if out, err := exec.Command("/sbin/route", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("error deleting route %w %s", err, out)
+	}
+	return nil
+}
+
+// listDNSServers returns the DNS servers of the system resolver configuration.
+func listDNSServers() ([]DNSServer, error) {
+	out, err := exec.Command("/usr/sbin/scutil", "--dns").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error listing DNS servers %w", err)
+	}
+	var servers []DNSServer
+	seen := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		// nameserver[0] : 8.8.8.8
+		key, val, ok := strings.Cut(line, ":")
+		if !ok || !strings.HasPrefix(strings.TrimSpace(key), "nameserver[") {
+			continue
+		}
+		ip := net.ParseIP(strings.TrimSpace(val))
+		if ip == nil || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		servers = append(servers, DNSServer{IP: ip})
+	}
+	return servers, nil
+}
+
+// deleteDNSServer removes the tunnel DNS services published with SetSystemDNS. DNS
+// servers of other network services are not changed.
+func deleteDNSServer(d DNSServer) error {
+	cmd := exec.Command("/usr/sbin/scutil")
+	cmd.Stdin = strings.NewReader("list " + scServicePrefix + ".*\nquit\n")
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("error listing DNS services %w", err)
+	}
+	var removes []string
+	for _, line := range strings.Split(string(out), "\n") {
+		// subKey [0] = State:/Network/Service/webtunnel.utun3/DNS
+		if _, key, ok := strings.Cut(line, " = "); ok {
+			removes = append(removes, "remove "+strings.TrimSpace(key))
+		}
+	}
+	if len(removes) == 0 {
+		return fmt.Errorf("not supported, reset the network service with networksetup -setdnsservers")
+	}
+	return scutil(removes)
+}
+
+func addAddress(iface string, addr *net.IPNet, peer net.IP) error {
+	args := []string{iface, "inet", addr.IP.String()}
+	if peer != nil {
+		args = append(args, peer.String())
+	}
+	args = append(args, "netmask", net.IP(addr.Mask).String(), "up")
+	if out, err := exec.Command("/sbin/ifconfig", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("error adding address %w %s", err, out)
+	}
+	return nil
+}
+
+func deleteAddress(iface string, addr *net.IPNet) error {
+	if out, err := exec.Command("/sbin/ifconfig", iface, "inet", addr.IP.String(), "-alias").CombinedOutput(); err != nil {
+		return fmt.Errorf("error deleting address %w %s", err, out)
+	}
+	return nil
+}
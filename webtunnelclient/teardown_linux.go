@@ -0,0 +1,132 @@
+package webtunnelclient
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// resolvConf is the resolver configuration holding system wide DNS servers.
+const resolvConf = "/etc/resolv.conf"
+
+// listRoutes parses the IPv4 routing table from /proc/net/route.
+func listRoutes() ([]Route, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var routes []Route
+	s := bufio.NewScanner(f)
+	s.Scan() // Header.
+	for s.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(s.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		dst, err1 := parseProcIP(fields[1])
+		gw, err2 := parseProcIP(fields[2])
+		mask, err3 := parseProcIP(fields[7])
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, fmt.Errorf("invalid route entry %q", s.Text())
+		}
+		r := Route{Dst: &net.IPNet{IP: dst, Mask: net.IPMask(mask)}, Iface: fields[0]}
+		if !gw.Equal(net.IPv4zero) {
+			r.Gateway = gw
+		}
+		routes = append(routes, r)
+	}
+	return routes, s.Err()
+}
+
+// parseProcIP parses a little endian hex IPv4 address from /proc/net/route.
+func parseProcIP(s string) (net.IP, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 4 {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(b))
+	return ip, nil
+}
+
+func addRoute(r Route) error {
+	args := []string{"route", "replace", r.Dst.String()}
+	if r.Gateway != nil {
+		args = append(args, "via", r.Gateway.String())
+	}
+	args = append(args, "dev", r.Iface)
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("error adding route %w %s", err, out)
+	}
+	return nil
+}
+
+func deleteRoute(r Route) error {
+	args := []string{"route", "del", r.Dst.String()}
+	if r.Gateway != nil {
+		args = append(args, "via", r.Gateway.String())
+	}
+	args = append(args, "dev", r.Iface)
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("error deleting route %w %s", err, out)
+	}
+	return nil
+}
+
+// listDNSServers returns the system wide DNS servers in /etc/resolv.conf.
+func listDNSServers() ([]DNSServer, error) {
+	b, err := os.ReadFile(resolvConf)
+	if err != nil {
+		return nil, err
+	}
+	var servers []DNSServer
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if ip := net.ParseIP(fields[1]); ip != nil {
+			servers = append(servers, DNSServer{IP: ip})
+		}
+	}
+	return servers, nil
+}
+
+// deleteDNSServer removes the nameserver line for d from /etc/resolv.conf.
+func deleteDNSServer(d DNSServer) error {
+	b, err := os.ReadFile(resolvConf)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" && d.IP.Equal(net.ParseIP(fields[1])) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return os.WriteFile(resolvConf, []byte(strings.Join(lines, "\n")), 0644)
+}
+
+func addAddress(iface string, addr *net.IPNet, peer net.IP) error {
+	if out, err := exec.Command("ip", "addr", "replace", addr.String(), "dev", iface).CombinedOutput(); err != nil {
+		return fmt.Errorf("error adding address %w %s", err, out)
+	}
+	return nil
+}
+
+func deleteAddress(iface string, addr *net.IPNet) error {
+	if out, err := exec.Command("ip", "addr", "del", addr.String(), "dev", iface).CombinedOutput(); err != nil {
+		return fmt.Errorf("error deleting address %w %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// listRoutes parses the IPv4 routing table from netsh.
+func listRoutes() ([]Route, error) {
+	out, err := exec.Command("netsh", "interface", "ipv4", "show", "route").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error listing routes %w", err)
+	}
+	var routes []Route
+	for _, line := range strings.Split(string(out), "\n") {
+		// Publish Type Met Prefix Idx Gateway/Interface Name
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		_, dst, err := net.ParseCIDR(fields[3])
+		if err != nil {
+			continue // Header.
+		}
+		r := Route{Dst: dst}
+		if idx, err := strconv.Atoi(fields[4]); err == nil {
+			if ifce, err := net.InterfaceByIndex(idx); err == nil {
+				r.Iface = ifce.Name
+			}
+		}
+		if gw := net.ParseIP(fields[5]).To4(); gw != nil {
+			r.Gateway = gw
+		} else if r.Iface == "" {
+			r.Iface = strings.Join(fields[5:], " ")
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+func addRoute(r Route) error {
+	args := []string{"interface", "ipv4", "add", "route", r.Dst.String(), r.Iface}
+	if r.Gateway != nil {
+		args = append(args, r.Gateway.String())
+	}
+	if out, err := exec.Command("netsh", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("error adding route %w %s", err, out)
+	}
+	return nil
+}
+
+func deleteRoute(r Route) error {
+	args := []string{"interface", "ipv4", "delete", "route", r.Dst.String(), r.Iface}
+	if r.Gateway != nil {
+		args = append(args, r.Gateway.String())
+	}
+	if out, err := exec.Command("netsh", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("error deleting route %w %s", err, out)
+	}
+	return nil
+}
+
+// listDNSServers returns the DNS servers configured on each interface.
+func listDNSServers() ([]DNSServer, error) {
+	out, err := exec.Command("netsh", "interface", "ipv4", "show", "dnsservers").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error listing DNS servers %w", err)
+	}
+	var servers []DNSServer
+	iface := ""
+	for _, line := range strings.Split(string(out), "\n") {
+		// Configuration for interface "Ethernet"
+		//     Statically Configured DNS Servers:    8.8.8.8
+		//                                           8.8.1.1
+		if i := strings.Index(line, "\""); i >= 0 && strings.HasSuffix(strings.TrimSpace(line), "\"") {
+			iface = strings.Trim(strings.TrimSpace(line[i:]), "\"")
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if ip := net.ParseIP(fields[len(fields)-1]); ip != nil && iface != "" {
+			servers = append(servers, DNSServer{IP: ip, Iface: iface})
+		}
+	}
+	return servers, nil
+}
+
+func deleteDNSServer(d DNSServer) error {
+	cmd := exec.Command("netsh", "interface", "ipv4", "delete", "dnsservers", "name="+d.Iface,
+		"address="+d.IP.String(), "validate=no")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error deleting dns server %w %s", err, out)
+	}
+	return nil
+}
+
+func addAddress(iface string, addr *net.IPNet, peer net.IP) error {
+	args := []string{"interface", "ipv4", "set", "address", "name=" + iface, "source=static",
+		"address=" + addr.IP.String(), "mask=" + net.IP(addr.Mask).String()}
+	if out, err := exec.Command("netsh", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("error adding address %w %s", err, out)
+	}
+	return nil
+}
+
+func deleteAddress(iface string, addr *net.IPNet) error {
+	cmd := exec.Command("netsh", "interface", "ipv4", "delete", "address", "name="+iface, "address="+addr.IP.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error deleting address %w %s", err, out)
+	}
+	return nil
+}
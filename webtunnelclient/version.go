@@ -0,0 +1,48 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/deepakkamesh/webtunnel/webtunnelcommon/version"
+)
+
+// SetMinServerVersion refuses to connect to servers older than min (eg. 1.4.0).
+// Development builds of the server are always accepted. This should be called prior to
+// Start.
+func (w *WebtunnelClient) SetMinServerVersion(min string) error {
+	if _, err := version.Parse(min); err != nil {
+		return err
+	}
+	w.minServerVersion = min
+	return nil
+}
+
+// ServerVersion returns the version reported by the server, empty before connecting or
+// if the server does not report it.
+func (w *WebtunnelClient) ServerVersion() string {
+	return w.serverVersion
+}
+
+// checkServerVersion records the server version from the handshake response and checks
+// it against the minimum.
+func (w *WebtunnelClient) checkServerVersion(header http.Header) error {
+	w.serverVersion = header.Get(version.Header)
+	return version.Check("client", "server", w.serverVersion, w.minServerVersion)
+}
+
+// versionError returns the reason the server refused the client version, from the body
+// of a 426 handshake response.
+func versionError(resp *http.Response, err error) error {
+	msg := ""
+	if resp.Body != nil {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		msg = strings.TrimSpace(string(b))
+	}
+	if msg == "" {
+		msg = "server requires a newer client"
+	}
+	return fmt.Errorf("%s, this client is %v: %w", msg, version.Version, err)
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package webtunnelclient
+
+import (
+	"fmt"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+)
+
+// newWintunInterface is only supported on Windows.
+func newWintunInterface(name string) (wc.Interface, error) {
+	return nil, fmt.Errorf("wintun is only supported on windows")
+}
@@ -0,0 +1,147 @@
+package webtunnelclient
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+)
+
+const (
+	wintunRingCapacity   = 0x400000 // Session ring buffer size (4 MiB).
+	wintunWaitTimeout    = 250      // Read wait timeout in ms, to notice Close.
+	errorNoMoreItems     = 259      // ERROR_NO_MORE_ITEMS: receive ring is empty.
+	errorHandleEOF       = 38       // ERROR_HANDLE_EOF: session is terminating.
+	waitObjectFailed     = 0xFFFFFFFF
+	wintunTunnelTypeName = "Webtunnel"
+)
+
+var (
+	modWintun                      = syscall.NewLazyDLL("wintun.dll")
+	procWintunCreateAdapter        = modWintun.NewProc("WintunCreateAdapter")
+	procWintunCloseAdapter         = modWintun.NewProc("WintunCloseAdapter")
+	procWintunStartSession         = modWintun.NewProc("WintunStartSession")
+	procWintunEndSession           = modWintun.NewProc("WintunEndSession")
+	procWintunGetReadWaitEvent     = modWintun.NewProc("WintunGetReadWaitEvent")
+	procWintunReceivePacket        = modWintun.NewProc("WintunReceivePacket")
+	procWintunReleaseReceivePacket = modWintun.NewProc("WintunReleaseReceivePacket")
+	procWintunAllocateSendPacket   = modWintun.NewProc("WintunAllocateSendPacket")
+	procWintunSendPacket           = modWintun.NewProc("WintunSendPacket")
+
+	modKernel32             = syscall.NewLazyDLL("kernel32.dll")
+	procWaitForSingleObject = modKernel32.NewProc("WaitForSingleObject")
+)
+
+// wintunInterface is a layer 3 network interface backed by the Wintun driver.
+type wintunInterface struct {
+	name      string
+	adapter   uintptr
+	session   uintptr
+	readEvent uintptr
+	closed    bool
+	lock      sync.Mutex // Serializes Close with Read/Write.
+}
+
+// newWintunInterface creates a Wintun adapter called name and starts a session on it.
+func newWintunInterface(name string) (wc.Interface, error) {
+	if err := modWintun.Load(); err != nil {
+		return nil, fmt.Errorf("wintun driver not available %w", err)
+	}
+	pName, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	pType, err := syscall.UTF16PtrFromString(wintunTunnelTypeName)
+	if err != nil {
+		return nil, err
+	}
+	adapter, _, err := procWintunCreateAdapter.Call(uintptr(unsafe.Pointer(pName)), uintptr(unsafe.Pointer(pType)), 0)
+	if adapter == 0 {
+		return nil, fmt.Errorf("error creating wintun adapter %w", err)
+	}
+	session, _, err := procWintunStartSession.Call(adapter, wintunRingCapacity)
+	if session == 0 {
+		procWintunCloseAdapter.Call(adapter)
+		return nil, fmt.Errorf("error starting wintun session %w", err)
+	}
+	readEvent, _, _ := procWintunGetReadWaitEvent.Call(session)
+
+	return &wintunInterface{
+		name:      name,
+		adapter:   adapter,
+		session:   session,
+		readEvent: readEvent,
+	}, nil
+}
+
+// Read reads one IP packet into p, blocking until one is available.
+func (t *wintunInterface) Read(p []byte) (int, error) {
+	for {
+		t.lock.Lock()
+		if t.closed {
+			t.lock.Unlock()
+			return 0, fmt.Errorf("wintun interface closed")
+		}
+		var size uint32
+		r, _, err := procWintunReceivePacket.Call(t.session, uintptr(unsafe.Pointer(&size)))
+		if r != 0 {
+			pkt := unsafe.Slice(*(**byte)(unsafe.Pointer(&r)), size)
+			n := copy(p, pkt)
+			procWintunReleaseReceivePacket.Call(t.session, r)
+			t.lock.Unlock()
+			return n, nil
+		}
+		t.lock.Unlock()
+
+		switch err.(syscall.Errno) {
+		case errorNoMoreItems:
+			if w, _, err := procWaitForSingleObject.Call(t.readEvent, wintunWaitTimeout); w == waitObjectFailed {
+				return 0, fmt.Errorf("error waiting for wintun packet %w", err)
+			}
+		case errorHandleEOF:
+			return 0, fmt.Errorf("wintun session terminated")
+		default:
+			return 0, fmt.Errorf("error reading wintun packet %w", err)
+		}
+	}
+}
+
+// Write sends one IP packet to the interface.
+func (t *wintunInterface) Write(p []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return 0, fmt.Errorf("wintun interface closed")
+	}
+	r, _, err := procWintunAllocateSendPacket.Call(t.session, uintptr(len(p)))
+	if r == 0 {
+		return 0, fmt.Errorf("error allocating wintun packet %w", err)
+	}
+	copy(unsafe.Slice(*(**byte)(unsafe.Pointer(&r)), len(p)), p)
+	procWintunSendPacket.Call(t.session, r)
+	return len(p), nil
+}
+
+// Close ends the session and removes the adapter.
+func (t *wintunInterface) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	procWintunEndSession.Call(t.session)
+	procWintunCloseAdapter.Call(t.adapter)
+	return nil
+}
+
+// IsTUN returns true; Wintun is a layer 3 device.
+func (t *wintunInterface) IsTUN() bool { return true }
+
+// IsTAP returns false; Wintun is a layer 3 device.
+func (t *wintunInterface) IsTAP() bool { return false }
+
+// Name returns the adapter name.
+func (t *wintunInterface) Name() string { return t.name }
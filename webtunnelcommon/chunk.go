@@ -0,0 +1,85 @@
+package webtunnelcommon
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ChunkHeader is the handshake header of clients that reassemble chunked control messages.
+const ChunkHeader = "X-Webtunnel-Chunked"
+
+// Prefix of a control message chunk: "chunk <id> <index> <total> <part>".
+const chunkPrefix = "chunk "
+
+// splitChunks splits msg into chunk messages with at most size bytes of payload each,
+// cutting on UTF-8 boundaries so every chunk is valid text.
+func splitChunks(id uint32, msg []byte, size int) [][]byte {
+	var parts [][]byte
+	for len(msg) > 0 {
+		n := size
+		if n >= len(msg) {
+			n = len(msg)
+		} else {
+			for n > 1 && !utf8.RuneStart(msg[n]) {
+				n--
+			}
+		}
+		parts = append(parts, msg[:n])
+		msg = msg[n:]
+	}
+	chunks := make([][]byte, len(parts))
+	for i, p := range parts {
+		chunks[i] = append([]byte(fmt.Sprintf("%s%d %d %d ", chunkPrefix, id, i, len(parts))), p...)
+	}
+	return chunks
+}
+
+// IsChunk returns true if msg is a control message chunk.
+func IsChunk(msg []byte) bool {
+	return strings.HasPrefix(string(msg), chunkPrefix)
+}
+
+// Limit on the chunks of a control message, bounding the reassembly buffer.
+const maxChunks = 64
+
+// ChunkAssembler reassembles chunked control messages. Only one message is reassembled
+// at a time; a chunk of a new message discards an incomplete one.
+type ChunkAssembler struct {
+	id    uint32
+	parts [][]byte
+	got   int
+}
+
+// Add adds a chunk and returns the reassembled message once all chunks are received.
+func (a *ChunkAssembler) Add(chunk []byte) ([]byte, error) {
+	f := strings.SplitN(string(chunk[len(chunkPrefix):]), " ", 4)
+	if len(f) != 4 {
+		return nil, fmt.Errorf("invalid chunk")
+	}
+	id, err1 := strconv.ParseUint(f[0], 10, 32)
+	index, err2 := strconv.Atoi(f[1])
+	total, err3 := strconv.Atoi(f[2])
+	if err1 != nil || err2 != nil || err3 != nil || total < 1 || total > maxChunks || index < 0 || index >= total {
+		return nil, fmt.Errorf("invalid chunk header")
+	}
+	if a.parts == nil || uint32(id) != a.id || len(a.parts) != total {
+		a.id = uint32(id)
+		a.parts = make([][]byte, total)
+		a.got = 0
+	}
+	if a.parts[index] == nil {
+		a.got++
+	}
+	a.parts[index] = []byte(f[3])
+	if a.got < total {
+		return nil, nil
+	}
+	var msg []byte
+	for _, p := range a.parts {
+		msg = append(msg, p...)
+	}
+	a.parts = nil
+	return msg, nil
+}
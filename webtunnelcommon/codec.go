@@ -0,0 +1,110 @@
+package webtunnelcommon
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"sync"
+)
+
+// Codec serializes config and control messages. The codec of a connection is negotiated
+// with the websocket subprotocol; JSON is used if none is negotiated.
+type Codec interface {
+	Name() string                    // Websocket subprotocol name.
+	Binary() bool                    // True if the encoding is not valid UTF-8 text.
+	Marshal(v any) ([]byte, error)   // Encode v.
+	Unmarshal(b []byte, v any) error // Decode b into v.
+}
+
+// JSONCodec is the default codec, compatible with peers that do not negotiate one.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string                    { return "webtunnel.json" }
+func (JSONCodec) Binary() bool                    { return false }
+func (JSONCodec) Marshal(v any) ([]byte, error)   { return json.Marshal(v) }
+func (JSONCodec) Unmarshal(b []byte, v any) error { return json.Unmarshal(b, v) }
+
+// GobCodec encodes with encoding/gob, which tolerates added and removed fields. It is not
+// registered by default since servers would decode gob from unauthenticated clients;
+// operators opt in with RegisterCodec(GobCodec{}).
+type GobCodec struct{}
+
+func (GobCodec) Name() string { return "webtunnel.gob" }
+func (GobCodec) Binary() bool { return true }
+
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(b []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+var (
+	codecs     = []Codec{JSONCodec{}} // Registered codecs in server preference order.
+	codecsLock sync.Mutex
+)
+
+// RegisterCodec adds a codec (eg. protobuf or CBOR) that peers may negotiate. A codec with
+// the same name is replaced.
+func RegisterCodec(c Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	for i, v := range codecs {
+		if v.Name() == c.Name() {
+			codecs[i] = c
+			return
+		}
+	}
+	codecs = append(codecs, c)
+}
+
+// CodecNames returns the subprotocol names of the registered codecs.
+func CodecNames() []string {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	var names []string
+	for _, c := range codecs {
+		names = append(names, c.Name())
+	}
+	return names
+}
+
+// CodecByName returns the registered codec for a negotiated subprotocol, or JSONCodec if
+// name is empty or unknown.
+func CodecByName(name string) Codec {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return JSONCodec{}
+}
+
+// EncodeControl encodes v for a text control message. Binary encodings are base64 encoded.
+func EncodeControl(c Codec, v any) ([]byte, error) {
+	b, err := c.Marshal(v)
+	if err != nil || !c.Binary() {
+		return b, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(b)), nil
+}
+
+// DecodeControl decodes a text control message encoded by EncodeControl into v.
+func DecodeControl(c Codec, b []byte, v any) error {
+	if c.Binary() {
+		d, err := base64.StdEncoding.DecodeString(string(b))
+		if err != nil {
+			return err
+		}
+		b = d
+	}
+	return c.Unmarshal(b, v)
+}
@@ -0,0 +1,160 @@
+package webtunnelcommon
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+/*
+ControlHeader is the handshake header carrying the control protocol version of the client
+and, in the response, the version the server speaks on the connection. Control messages
+are only sent to peers that negotiated a version; older peers use the text commands
+("getConfig", "resume") and receive the bare ClientConfig.
+*/
+const ControlHeader = "X-Webtunnel-Control"
+
+// ControlVersion is the highest control protocol version supported.
+const ControlVersion = 1
+
+// ControlPrefix starts each control message, followed by the ControlMessage encoded with
+// the connection codec.
+const ControlPrefix = "ctl "
+
+// ControlType is the type of a control message.
+type ControlType string
+
+const (
+	CtlConfigRequest  ControlType = "config_request"  // Client requests its config.
+	CtlConfigResponse ControlType = "config_response" // Server answers a config request.
+	CtlDisconnect     ControlType = "disconnect"      // Peer is about to close the connection.
+	CtlPing           ControlType = "ping"            // Round trip probe, echoed as a reply.
+	CtlMetrics        ControlType = "metrics"         // Metrics report, or a request for one if empty.
+	CtlError          ControlType = "error"           // A control message was refused.
+)
+
+// Capabilities negotiated by the config request and response.
+const (
+	CapPing       = "ping"       // Answers CtlPing.
+	CapMetrics    = "metrics"    // Answers CtlMetrics requests.
+	CapDisconnect = "disconnect" // Accepts CtlDisconnect.
+)
+
+// ControlMessage is the envelope of a control message. The body matching Type is set.
+// Receivers ignore fields they do not know and answer unknown types with CtlError,
+// so the protocol can grow without breaking older peers.
+type ControlMessage struct {
+	Version        int                `json:"v"`
+	Type           ControlType        `json:"type"`
+	ConfigRequest  *ConfigRequest     `json:"config_request,omitempty"`
+	ConfigResponse *ConfigResponse    `json:"config_response,omitempty"`
+	Disconnect     *Disconnect        `json:"disconnect,omitempty"`
+	Ping           *Ping              `json:"ping,omitempty"`
+	Metrics        map[string]float64 `json:"metrics,omitempty"`
+	Error          *ControlError      `json:"error,omitempty"`
+}
+
+// ConfigRequest requests the client config, starting or taking over a session.
+type ConfigRequest struct {
+	Username     string         `json:"username"`
+	Hostname     string         `json:"hostname"`
+	Session      string         `json:"session,omitempty"` // Session token of a reconnecting client.
+	Resume       bool           `json:"resume,omitempty"`  // Take over Session from its current connection.
+	Capabilities []string       `json:"capabilities,omitempty"`
+	Posture      *PostureReport `json:"posture,omitempty"` // Signed device posture of the client.
+}
+
+// ConfigResponse answers a ConfigRequest.
+type ConfigResponse struct {
+	Config       *ClientConfig `json:"config"`
+	Capabilities []string      `json:"capabilities,omitempty"` // Requested capabilities the server accepted.
+}
+
+// Disconnect announces the connection is closing.
+type Disconnect struct {
+	Reason string `json:"reason"`
+}
+
+// Ping is a round trip probe through the control lane.
+type Ping struct {
+	ID    uint64    `json:"id"`
+	Sent  time.Time `json:"sent"`
+	Reply bool      `json:"reply,omitempty"`
+}
+
+// ControlError reports a refused control message.
+type ControlError struct {
+	Type    ControlType `json:"type"` // Type of the refused message.
+	Message string      `json:"message"`
+}
+
+func (e *ControlError) Error() string {
+	return fmt.Sprintf("%v refused by peer: %v", e.Type, e.Message)
+}
+
+// NegotiateControl returns the control protocol version to use with a peer offering
+// offered in ControlHeader, 0 if the peer does not support control messages.
+func NegotiateControl(offered string) int {
+	v, err := strconv.Atoi(offered)
+	if err != nil || v <= 0 {
+		return 0
+	}
+	if v > ControlVersion {
+		return ControlVersion
+	}
+	return v
+}
+
+// NegotiateCapabilities returns the capabilities in both offered and supported.
+func NegotiateCapabilities(offered, supported []string) []string {
+	var caps []string
+	for _, c := range offered {
+		if HasCapability(supported, c) && !HasCapability(caps, c) {
+			caps = append(caps, c)
+		}
+	}
+	return caps
+}
+
+// HasCapability returns true if c is in caps.
+func HasCapability(caps []string, c string) bool {
+	for _, v := range caps {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
+
+// EncodeControlMessage encodes m with c as a text control message.
+func EncodeControlMessage(c Codec, m *ControlMessage) ([]byte, error) {
+	if m.Version == 0 {
+		m.Version = ControlVersion
+	}
+	b, err := EncodeControl(c, m)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(ControlPrefix), b...), nil
+}
+
+// IsControlMessage returns true if msg is a control message envelope.
+func IsControlMessage(msg []byte) bool {
+	return bytes.HasPrefix(msg, []byte(ControlPrefix))
+}
+
+// ParseControlMessage decodes the control message msg encoded with c.
+func ParseControlMessage(c Codec, msg []byte) (*ControlMessage, error) {
+	if !IsControlMessage(msg) {
+		return nil, fmt.Errorf("not a control message")
+	}
+	m := &ControlMessage{}
+	if err := DecodeControl(c, msg[len(ControlPrefix):], m); err != nil {
+		return nil, fmt.Errorf("error decoding control message %w", err)
+	}
+	if m.Version <= 0 || m.Type == "" {
+		return nil, fmt.Errorf("control message without version or type")
+	}
+	return m, nil
+}
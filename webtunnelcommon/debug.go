@@ -0,0 +1,72 @@
+package webtunnelcommon
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+/*
+ServeDebug serves the introspection endpoints of a live process on addr, which must be a
+loopback address:
+
+	GET /debug/vars               the expvar variables, eg. goroutines and queue depths
+	GET /debug/pprof/             the runtime profiles available
+	GET /debug/pprof/{profile}    a runtime profile (eg. goroutine, heap), ?debug=1 or 2 for text
+
+Profiles are read with go tool pprof, eg. go tool pprof http://127.0.0.1:6060/debug/pprof/heap.
+*/
+func ServeDebug(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid debug address %w", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("debug endpoint must listen on localhost, got %v", host)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error listening for debug %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/pprof/", profileEndpoint)
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			glog.Warningf("debug endpoint stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// profileEndpoint writes the runtime profile named by the request path, or the list of
+// profiles.
+func profileEndpoint(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/debug/pprof/")
+	if name == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, p := range pprof.Profiles() {
+			fmt.Fprintf(w, "%v %v\n", p.Name(), p.Count())
+		}
+		return
+	}
+	p := pprof.Lookup(name)
+	if p == nil {
+		http.Error(w, "Unknown Profile", http.StatusNotFound)
+		return
+	}
+	debug, _ := strconv.Atoi(req.URL.Query().Get("debug"))
+	if debug > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	p.WriteTo(w, debug)
+}
@@ -0,0 +1,52 @@
+package webtunnelcommon
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+// dscpMarker copies the DSCP of inner IPv4 packets to the outer TCP connection so
+// QoS-aware networks can classify tunnel traffic. ECN bits are left to TCP.
+type dscpMarker struct {
+	raw syscall.RawConn
+	tos int // Last TOS set on the socket, -1 if none.
+}
+
+func newDSCPMarker(conn net.Conn) (*dscpMarker, error) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("connection does not support socket options")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	return &dscpMarker{raw: raw, tos: -1}, nil
+}
+
+// mark sets the socket TOS to the DSCP of pkt if it changed.
+func (m *dscpMarker) mark(pkt []byte) {
+	if len(pkt) < ipv4HeaderLen || pkt[0]>>4 != 4 {
+		return
+	}
+	tos := int(pkt[1] &^ 0x3)
+	if tos == m.tos {
+		return
+	}
+	var err error
+	if cerr := m.raw.Control(func(fd uintptr) { err = setTOS(fd, tos) }); cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		glog.V(2).Infof("error setting DSCP %v: %v", tos>>2, err)
+		return
+	}
+	m.tos = tos
+}
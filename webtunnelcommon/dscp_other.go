@@ -0,0 +1,9 @@
+//go:build !windows
+
+package webtunnelcommon
+
+import "syscall"
+
+func setTOS(fd uintptr, tos int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+}
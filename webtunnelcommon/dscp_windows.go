@@ -0,0 +1,7 @@
+package webtunnelcommon
+
+import "syscall"
+
+func setTOS(fd uintptr, tos int) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+}
@@ -0,0 +1,11 @@
+package webtunnelcommon
+
+import "errors"
+
+// Sentinel errors shared by the client and server. Errors returned by webtunnel wrap
+// these so embedders can branch on them with errors.Is.
+var (
+	ErrAuthFailed    = errors.New("authentication failed")  // Signature or credential check failed.
+	ErrNotConfigured = errors.New("not configured")         // Client or interface not set up yet.
+	ErrConfigTimeout = errors.New("config fetch timed out") // Server did not send the client config in time.
+)
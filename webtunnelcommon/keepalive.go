@@ -0,0 +1,52 @@
+package webtunnelcommon
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// KeepaliveHeader is the handshake response header of servers that accept a keepalive
+// interval from the client.
+const KeepaliveHeader = "X-Webtunnel-Keepalive"
+
+// Prefixes of the keepalive negotiation control messages.
+const (
+	keepalivePrefix    = "keepalive "
+	keepaliveAckPrefix = "keepaliveack "
+)
+
+// KeepaliveMessage returns the request to ping the client every interval.
+func KeepaliveMessage(interval time.Duration) []byte {
+	return []byte(fmt.Sprintf("%s%d", keepalivePrefix, interval/time.Second))
+}
+
+// ParseKeepalive returns the interval requested by msg. ok is false if msg is not a
+// keepalive request.
+func ParseKeepalive(msg []byte) (interval time.Duration, ok bool) {
+	return parseSeconds(msg, keepalivePrefix)
+}
+
+// KeepaliveAckMessage returns the acknowledgement of the interval used by the server.
+func KeepaliveAckMessage(interval time.Duration) []byte {
+	return []byte(fmt.Sprintf("%s%d", keepaliveAckPrefix, interval/time.Second))
+}
+
+// ParseKeepaliveAck returns the interval acknowledged by msg. ok is false if msg is not
+// an acknowledgement.
+func ParseKeepaliveAck(msg []byte) (interval time.Duration, ok bool) {
+	return parseSeconds(msg, keepaliveAckPrefix)
+}
+
+// parseSeconds returns the positive number of seconds following prefix in msg.
+func parseSeconds(msg []byte, prefix string) (time.Duration, bool) {
+	if !bytes.HasPrefix(msg, []byte(prefix)) {
+		return 0, false
+	}
+	s, err := strconv.Atoi(string(msg[len(prefix):]))
+	if err != nil || s <= 0 {
+		return 0, false
+	}
+	return time.Duration(s) * time.Second, true
+}
@@ -0,0 +1,333 @@
+/*
+Package metrics implements counters, gauges and histograms exported in the Prometheus
+text exposition format, and the collectors shared by the webtunnel server and client.
+*/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets, in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// ContentType is the content type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// collector writes a metric family in the text format.
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds metric families and serves them in the text format on ServeHTTP.
+type Registry struct {
+	collectors []collector
+	names      map[string]bool
+	lock       sync.Mutex
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// register adds the family name. It panics if name is already registered, as this is a
+// programming error.
+func (r *Registry) register(name string, c collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metric %v already registered", name))
+	}
+	r.names[name] = true
+	r.collectors = append(r.collectors, c)
+}
+
+// NewCounter registers a counter with the label names labels.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{vec: newVec(name, help, "counter", labels)}
+	r.register(name, c)
+	return c
+}
+
+// NewGauge registers a gauge with the label names labels.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{vec: newVec(name, help, "gauge", labels)}
+	r.register(name, g)
+	return g
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by f when scraped.
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	r.register(name, &gaugeFunc{family: family{name: name, help: help, typ: "gauge"}, f: f})
+}
+
+// NewHistogram registers a histogram with the upper bounds buckets, sorted ascending, and
+// the label names labels.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		family:  family{name: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*histSeries),
+	}
+	r.register(name, h)
+	return h
+}
+
+// WriteText writes the metrics in the text format to w.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.lock.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.lock.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves the metrics in the text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, rcv *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteText(w)
+}
+
+// family is the name, help and label names of a metric.
+type family struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+// header writes the HELP and TYPE lines of the family.
+func (f *family) header(w *bufio.Writer) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(f.help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, help, f.name, f.typ)
+}
+
+// sample writes a sample of the family with the label values values and the extra label
+// pairs extra.
+func (f *family) sample(w *bufio.Writer, suffix string, values []string, extra []string, v float64) {
+	w.WriteString(f.name + suffix)
+	var pairs []string
+	for i, l := range f.labels {
+		pairs = append(pairs, l+`="`+escapeLabel(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) > 0 {
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+// key returns the series key of the label values, checking their number.
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %v has %v labels, got %v values", f.name, len(f.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// vec is the values of a counter or gauge per label values.
+type vec struct {
+	family
+	series map[string]*series
+	lock   sync.Mutex
+}
+
+// series is a value and its label values.
+type series struct {
+	values []string
+	v      float64
+}
+
+func newVec(name, help, typ string, labels []string) vec {
+	return vec{family: family{name: name, help: help, typ: typ, labels: labels}, series: make(map[string]*series)}
+}
+
+// update applies f to the value of the label values.
+func (v *vec) update(values []string, f func(float64) float64) {
+	k := v.key(values)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	s, ok := v.series[k]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		v.series[k] = s
+	}
+	s.v = f(s.v)
+}
+
+// Value returns the value of the label values, 0 if never set.
+func (v *vec) Value(values ...string) float64 {
+	k := v.key(values)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if s, ok := v.series[k]; ok {
+		return s.v
+	}
+	return 0
+}
+
+// Delete removes the series of the label values, eg. of a disconnected client.
+func (v *vec) Delete(values ...string) {
+	k := v.key(values)
+	v.lock.Lock()
+	delete(v.series, k)
+	v.lock.Unlock()
+}
+
+func (v *vec) write(w *bufio.Writer) {
+	v.header(w)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for _, k := range sortedKeys(v.series) {
+		s := v.series[k]
+		v.sample(w, "", s.values, nil, s.v)
+	}
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	vec
+}
+
+// Add adds d, which must not be negative, to the counter of the label values.
+func (c *Counter) Add(d float64, values ...string) {
+	if d < 0 {
+		panic(fmt.Sprintf("counter %v decreased by %v", c.name, d))
+	}
+	c.update(values, func(v float64) float64 { return v + d })
+}
+
+// Inc adds 1 to the counter of the label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct {
+	vec
+}
+
+// Set sets the gauge of the label values to v.
+func (g *Gauge) Set(v float64, values ...string) {
+	g.update(values, func(float64) float64 { return v })
+}
+
+// Add adds d to the gauge of the label values.
+func (g *Gauge) Add(d float64, values ...string) {
+	g.update(values, func(v float64) float64 { return v + d })
+}
+
+// gaugeFunc is an unlabelled gauge read when scraped.
+type gaugeFunc struct {
+	family
+	f func() float64
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	g.header(w)
+	g.sample(w, "", nil, nil, g.f())
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	family
+	buckets []float64
+	series  map[string]*histSeries
+	lock    sync.Mutex
+}
+
+// histSeries is the buckets of a histogram for label values.
+type histSeries struct {
+	values []string
+	counts []uint64 // Observations in each bucket, not cumulative.
+	count  uint64
+	sum    float64
+}
+
+// Observe adds v to the histogram of the label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	k := h.key(values)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s, ok := h.series[k]
+	if !ok {
+		s = &histSeries{values: append([]string(nil), values...), counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+// Count returns the number of observations of the label values.
+func (h *Histogram) Count(values ...string) uint64 {
+	k := h.key(values)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if s, ok := h.series[k]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.header(w)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, k := range sortedKeys(h.series) {
+		s := h.series[k]
+		var cum uint64
+		for i, b := range h.buckets {
+			cum += s.counts[i]
+			h.sample(w, "_bucket", s.values, []string{"le", formatFloat(b)}, float64(cum))
+		}
+		h.sample(w, "_bucket", s.values, []string{"le", "+Inf"}, float64(s.count))
+		h.sample(w, "_sum", s.values, nil, s.sum)
+		h.sample(w, "_count", s.values, nil, float64(s.count))
+	}
+}
+
+// sortedKeys returns the keys of m sorted, for a stable output.
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escapeLabel escapes a label value for the text format.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// formatFloat formats a sample value for the text format.
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
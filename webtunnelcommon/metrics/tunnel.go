@@ -0,0 +1,89 @@
+package metrics
+
+import "time"
+
+// Directions of the traffic counters, relative to the websocket.
+const (
+	In  = "in"  // Received from the websocket.
+	Out = "out" // Sent on the websocket.
+)
+
+// Tunnel is the collectors of a tunnel endpoint, the server or the client, named
+// <namespace>_<metric>. Its methods do nothing on a nil Tunnel, so endpoints without
+// metrics need no checks.
+type Tunnel struct {
+	*Registry
+	Bytes            *Counter   // Packet bytes by direction.
+	Packets          *Counter   // Packets by direction.
+	Sessions         *Gauge     // Active tunnel sessions.
+	WSErrors         *Counter   // Websocket read and write failures, excluding graceful closes.
+	TUNReadErrors    *Counter   // Failed reads from the TUN/TAP interface.
+	TUNWriteErrors   *Counter   // Failed writes to the TUN/TAP interface.
+	HandshakeLatency *Histogram // Seconds from the websocket connection to the tunnel config.
+}
+
+// NewTunnel returns the collectors of a tunnel endpoint registered in a new registry.
+func NewTunnel(namespace string) *Tunnel {
+	r := NewRegistry()
+	return &Tunnel{
+		Registry:         r,
+		Bytes:            r.NewCounter(namespace+"_bytes_total", "Packet bytes through the tunnel.", "direction"),
+		Packets:          r.NewCounter(namespace+"_packets_total", "Packets through the tunnel.", "direction"),
+		Sessions:         r.NewGauge(namespace+"_sessions", "Active tunnel sessions."),
+		WSErrors:         r.NewCounter(namespace+"_websocket_errors_total", "Websocket read and write failures."),
+		TUNReadErrors:    r.NewCounter(namespace+"_tun_read_errors_total", "Failed reads from the tunnel interface."),
+		TUNWriteErrors:   r.NewCounter(namespace+"_tun_write_errors_total", "Failed writes to the tunnel interface."),
+		HandshakeLatency: r.NewHistogram(namespace+"_handshake_latency_seconds", "Time from the websocket connection to the tunnel config.", DefBuckets),
+	}
+}
+
+// CountPacket counts a packet of n bytes in direction dir.
+func (t *Tunnel) CountPacket(dir string, n int) {
+	if t == nil {
+		return
+	}
+	t.Packets.Inc(dir)
+	t.Bytes.Add(float64(n), dir)
+}
+
+// AddSessions adds d to the active sessions.
+func (t *Tunnel) AddSessions(d int) {
+	if t != nil {
+		t.Sessions.Add(float64(d))
+	}
+}
+
+// SetSessions sets the active sessions to n.
+func (t *Tunnel) SetSessions(n int) {
+	if t != nil {
+		t.Sessions.Set(float64(n))
+	}
+}
+
+// WSError counts a websocket failure.
+func (t *Tunnel) WSError() {
+	if t != nil {
+		t.WSErrors.Inc()
+	}
+}
+
+// TUNReadError counts a failed interface read.
+func (t *Tunnel) TUNReadError() {
+	if t != nil {
+		t.TUNReadErrors.Inc()
+	}
+}
+
+// TUNWriteError counts a failed interface write.
+func (t *Tunnel) TUNWriteError() {
+	if t != nil {
+		t.TUNWriteErrors.Inc()
+	}
+}
+
+// ObserveHandshake records the latency of a completed handshake.
+func (t *Tunnel) ObserveHandshake(d time.Duration) {
+	if t != nil {
+		t.HandshakeLatency.Observe(d.Seconds())
+	}
+}
@@ -0,0 +1,55 @@
+package webtunnelcommon
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MTUProbeHeader is the handshake response header of servers that acknowledge MTU probes.
+const MTUProbeHeader = "X-Webtunnel-Mtu-Probe"
+
+// Prefixes of the MTU probe and acknowledgement control messages.
+const (
+	mtuProbePrefix = "mtuprobe "
+	mtuAckPrefix   = "mtuack "
+)
+
+// MTUProbeMessage returns a probe control message padded to size bytes.
+func MTUProbeMessage(size int) []byte {
+	b := []byte(fmt.Sprintf("%s%d ", mtuProbePrefix, size))
+	if pad := size - len(b); pad > 0 {
+		b = append(b, bytes.Repeat([]byte{'.'}, pad)...)
+	}
+	return b
+}
+
+// ParseMTUProbe returns the size of a probe message. ok is false if msg is not a probe,
+// or was truncated or padded in transit.
+func ParseMTUProbe(msg []byte) (size int, ok bool) {
+	if !bytes.HasPrefix(msg, []byte(mtuProbePrefix)) {
+		return 0, false
+	}
+	f := strings.SplitN(string(msg[len(mtuProbePrefix):]), " ", 2)
+	size, err := strconv.Atoi(f[0])
+	if err != nil || len(msg) != size {
+		return 0, false
+	}
+	return size, true
+}
+
+// MTUAckMessage returns the acknowledgement of a probe of size bytes.
+func MTUAckMessage(size int) []byte {
+	return []byte(fmt.Sprintf("%s%d", mtuAckPrefix, size))
+}
+
+// ParseMTUAck returns the probe size acknowledged by msg. ok is false if msg is not an
+// acknowledgement.
+func ParseMTUAck(msg []byte) (size int, ok bool) {
+	if !bytes.HasPrefix(msg, []byte(mtuAckPrefix)) {
+		return 0, false
+	}
+	size, err := strconv.Atoi(string(msg[len(mtuAckPrefix):]))
+	return size, err == nil
+}
@@ -0,0 +1,105 @@
+package webtunnelcommon
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"time"
+)
+
+// Minimum IPv4 header length; also the minimum size of a dummy frame.
+const ipv4HeaderLen = 20
+
+// ObfuscationPolicy configures padding and timing obfuscation of websocket data frames
+// to trade bandwidth for resistance to traffic analysis. The zero value disables it.
+type ObfuscationPolicy struct {
+	PadMin        int           // Minimum random padding added to each data frame in bytes.
+	PadMax        int           // Maximum random padding (uniform between PadMin and PadMax).
+	PadBucket     int           // If set, frames are padded up to a multiple of this size instead.
+	DummyInterval time.Duration // Mean interval between dummy frames (exponential), 0 disables.
+	DummySize     int           // Size of dummy frames in bytes (minimum 20).
+	MaxJitter     time.Duration // Maximum random delay before each data frame.
+	BurstSize     int           // Data frames sent back to back before pausing for BurstGap.
+	BurstGap      time.Duration // Pause after BurstSize frames, 0 disables burst shaping.
+}
+
+// pad returns pkt with padding appended per the policy.
+func (p *ObfuscationPolicy) pad(pkt []byte) []byte {
+	n := 0
+	switch {
+	case p.PadBucket > 0:
+		if r := len(pkt) % p.PadBucket; r > 0 {
+			n = p.PadBucket - r
+		}
+	case p.PadMax > 0:
+		n = p.PadMin
+		if p.PadMax > p.PadMin {
+			n += rand.Intn(p.PadMax - p.PadMin + 1)
+		}
+	}
+	if n == 0 {
+		return pkt
+	}
+	out := make([]byte, len(pkt)+n)
+	copy(out, pkt)
+	rand.Read(out[len(pkt):])
+	return out
+}
+
+// maxPad returns the largest padding added to a data frame.
+func (p *ObfuscationPolicy) maxPad() int {
+	switch {
+	case p.PadBucket > 0:
+		return p.PadBucket - 1
+	case p.PadMax > p.PadMin:
+		return p.PadMax
+	case p.PadMax > 0:
+		return p.PadMin
+	}
+	return 0
+}
+
+// delay returns the random delay before the next data frame.
+func (p *ObfuscationPolicy) delay() time.Duration {
+	if p.MaxJitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(p.MaxJitter)))
+}
+
+// nextDummy returns the interval until the next dummy frame or 0 if disabled.
+func (p *ObfuscationPolicy) nextDummy() time.Duration {
+	if p.DummyInterval <= 0 {
+		return 0
+	}
+	return time.Duration(rand.ExpFloat64() * float64(p.DummyInterval))
+}
+
+// dummyFrame returns a dummy frame. It starts with a zero byte (IP version 0) so the
+// receiver can tell it apart from IPv4 packets.
+func (p *ObfuscationPolicy) dummyFrame() []byte {
+	n := p.DummySize
+	if n < ipv4HeaderLen {
+		n = ipv4HeaderLen
+	}
+	b := make([]byte, n)
+	rand.Read(b[1:])
+	b[0] = 0
+	return b
+}
+
+// StripPadding removes obfuscation from a received data frame. It returns nil for dummy
+// frames and trims IPv4 packets to their total length. Short frames are left untouched.
+func StripPadding(pkt []byte) []byte {
+	if len(pkt) < ipv4HeaderLen {
+		return pkt
+	}
+	switch pkt[0] >> 4 {
+	case 0:
+		return nil
+	case 4:
+		if l := int(binary.BigEndian.Uint16(pkt[2:4])); l >= ipv4HeaderLen && l < len(pkt) {
+			return pkt[:l]
+		}
+	}
+	return pkt
+}
@@ -0,0 +1,190 @@
+package webtunnelcommon
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// P2PPrefix is the prefix of the peer-to-peer control messages.
+const P2PPrefix = "p2p "
+
+// Types of peer-to-peer control messages.
+const (
+	P2PRegister = "register" // Client takes part, with its local UDP addresses.
+	P2PToken    = "token"    // Server answer to register with the rendezvous token and port.
+	P2PConnect  = "connect"  // Client asks for a direct path to Peer.
+	P2POffer    = "offer"    // Server sends both peers the candidates and key of the path.
+	P2PUp       = "up"       // Client reached Peer directly.
+	P2PFailed   = "failed"   // Client could not reach Peer directly, traffic stays relayed.
+)
+
+// P2PMessage is a peer-to-peer control message.
+type P2PMessage struct {
+	Type  string   `json:"type"`
+	Peer  string   `json:"peer,omitempty"`  // Tunnel IP of the other client.
+	Token string   `json:"token,omitempty"` // Identifies the client to the rendezvous.
+	Addrs []string `json:"addrs,omitempty"` // UDP addresses; local ones, the rendezvous port or the candidates of Peer.
+	Key   []byte   `json:"key,omitempty"`   // AES-256-GCM key of the path.
+}
+
+// Types of peer-to-peer UDP frames.
+const (
+	P2PFrameRegister byte = 'R' // Client to rendezvous with the token, echoed back as acknowledgement.
+	P2PFrameProbe    byte = 'P' // Hole punching and keepalive between peers.
+	P2PFrameProbeAck byte = 'A' // Answer to a probe.
+	P2PFrameData     byte = 'D' // IP packet between peers.
+)
+
+// p2pMagic starts every peer-to-peer UDP frame.
+const p2pMagic = "WTP2"
+
+// p2pNonceSize is the size of the AES-GCM nonce: the tunnel IP of the sender and a counter.
+const p2pNonceSize = 12
+
+// Number of recent nonce counters of the peer remembered to drop replayed frames.
+const p2pReplayWindow = 1024
+
+// P2PFrame returns a UDP frame of type typ with payload.
+func P2PFrame(typ byte, payload []byte) []byte {
+	b := make([]byte, 0, len(p2pMagic)+1+len(payload))
+	b = append(b, p2pMagic...)
+	b = append(b, typ)
+	return append(b, payload...)
+}
+
+// ParseP2PFrame returns the type and payload of a UDP frame, false if b is no frame.
+func ParseP2PFrame(b []byte) (byte, []byte, bool) {
+	if len(b) <= len(p2pMagic) || !bytes.HasPrefix(b, []byte(p2pMagic)) {
+		return 0, nil, false
+	}
+	return b[len(p2pMagic)], b[len(p2pMagic)+1:], true
+}
+
+// P2PCipher seals the frames of a direct path between two peers. Nonces start with the
+// tunnel IP of the sender, so both peers can use the same key and receivers know which
+// peer sent a frame. Received frames are checked against a window of the nonce counters
+// of the peer, like the IPsec anti-replay window (RFC 4303), so captured frames cannot be
+// replayed.
+type P2PCipher struct {
+	aead    cipher.AEAD
+	local   [4]byte       // Tunnel IP of this end.
+	counter atomic.Uint64 // Nonce counter.
+	lock    sync.Mutex    // Guards the replay window.
+	highest uint64        // Highest nonce counter received from the peer.
+	seen    [p2pReplayWindow / 64]uint64
+}
+
+// NewP2PCipher returns a cipher for key sealing frames sent from tunnel IP local.
+func NewP2PCipher(key []byte, local net.IP) (*P2PCipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid peer-to-peer key size %v", len(key))
+	}
+	ip := local.To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid peer-to-peer IP %v", local)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c := &P2PCipher{aead: aead}
+	copy(c.local[:], ip)
+	return c, nil
+}
+
+// Seal returns a frame of type typ carrying the encrypted plaintext.
+func (c *P2PCipher) Seal(typ byte, plaintext []byte) []byte {
+	nonce := make([]byte, p2pNonceSize)
+	copy(nonce, c.local[:])
+	binary.BigEndian.PutUint64(nonce[4:], c.counter.Add(1))
+	return P2PFrame(typ, c.aead.Seal(nonce, nonce, plaintext, []byte{typ}))
+}
+
+// Open returns the plaintext of the payload of a frame of type typ. Replayed frames and
+// frames older than the replay window are rejected. newest is true if the frame is the
+// latest sent by the peer so far, eg. to follow the peer to a new address only on fresh
+// frames.
+func (c *P2PCipher) Open(typ byte, payload []byte) (plain []byte, newest bool, err error) {
+	if len(payload) < p2pNonceSize {
+		return nil, false, fmt.Errorf("short peer-to-peer frame")
+	}
+	if bytes.Equal(payload[:4], c.local[:]) {
+		return nil, false, fmt.Errorf("reflected peer-to-peer frame")
+	}
+	counter := binary.BigEndian.Uint64(payload[4:p2pNonceSize])
+	if !c.fresh(counter) {
+		return nil, false, fmt.Errorf("replayed peer-to-peer frame %v", counter)
+	}
+	plain, err = c.aead.Open(nil, payload[:p2pNonceSize], payload[p2pNonceSize:], []byte{typ})
+	if err != nil {
+		return nil, false, err
+	}
+	// Only authenticated frames move the window.
+	newest, ok := c.accept(counter)
+	if !ok {
+		return nil, false, fmt.Errorf("replayed peer-to-peer frame %v", counter)
+	}
+	return plain, newest, nil
+}
+
+// fresh returns false if counter was received or is behind the replay window.
+func (c *P2PCipher) fresh(counter uint64) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.freshLocked(counter)
+}
+
+func (c *P2PCipher) freshLocked(counter uint64) bool {
+	if counter == 0 {
+		return false // Seal never uses counter 0.
+	}
+	if counter > c.highest {
+		return true
+	}
+	if c.highest-counter >= p2pReplayWindow {
+		return false
+	}
+	return c.seen[(counter%p2pReplayWindow)/64]&(1<<(counter%64)) == 0
+}
+
+// accept records counter in the replay window. It returns false if the counter was
+// received meanwhile and newest if it is the highest so far.
+func (c *P2PCipher) accept(counter uint64) (newest, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.freshLocked(counter) {
+		return false, false
+	}
+	if counter > c.highest {
+		// Clear the slots of the counters skipped and reused by the advance.
+		if counter-c.highest >= p2pReplayWindow {
+			c.seen = [p2pReplayWindow / 64]uint64{}
+		} else {
+			for n := c.highest + 1; n < counter; n++ {
+				c.seen[(n%p2pReplayWindow)/64] &^= 1 << (n % 64)
+			}
+		}
+		c.highest = counter
+		newest = true
+	}
+	c.seen[(counter%p2pReplayWindow)/64] |= 1 << (counter % 64)
+	return newest, true
+}
+
+// P2PSender returns the tunnel IP of the peer that sealed payload, nil if too short.
+func P2PSender(payload []byte) net.IP {
+	if len(payload) < p2pNonceSize {
+		return nil
+	}
+	return net.IPv4(payload[0], payload[1], payload[2], payload[3]).To4()
+}
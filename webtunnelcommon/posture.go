@@ -0,0 +1,102 @@
+package webtunnelcommon
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// Label of the TLS keying material binding posture reports to their connection.
+const postureExporterLabel = "EXPORTER-webtunnel-posture"
+
+// Posture represents the device posture reported by a client.
+type Posture struct {
+	OS            string            `json:"os"`            // Operating system.
+	OSVersion     string            `json:"osversion"`     // Operating system version.
+	DiskEncrypted bool              `json:"diskencrypted"` // Disk encryption enabled.
+	AVRunning     bool              `json:"avrunning"`     // Antivirus running.
+	Extra         map[string]string `json:"extra"`         // Collector specific attributes.
+}
+
+// PostureReport is the posture sent by the client in its config request, signed with the
+// key of its TLS client certificate.
+type PostureReport struct {
+	Posture   *Posture `json:"posture"`   // Device posture.
+	Signature string   `json:"signature"` // Hex signature of posture and the connection binding.
+}
+
+// PostureBinding returns the keying material of the TLS connection cs that posture
+// reports sent on it are bound to, so they can't be replayed on another connection.
+func PostureBinding(cs *tls.ConnectionState) ([]byte, error) {
+	if cs == nil {
+		return nil, fmt.Errorf("posture requires a TLS connection")
+	}
+	return cs.ExportKeyingMaterial(postureExporterLabel, nil, 32)
+}
+
+// SignPosture returns a posture report for p bound to the connection binding and signed
+// with key, the private key of the client certificate.
+func SignPosture(p *Posture, key crypto.Signer, binding []byte) (*PostureReport, error) {
+	msg, err := postureMessage(p, binding)
+	if err != nil {
+		return nil, err
+	}
+	digest, opts := msg, crypto.SignerOpts(crypto.Hash(0))
+	if _, ok := key.Public().(ed25519.PublicKey); !ok {
+		sum := sha256.Sum256(msg)
+		digest, opts = sum[:], crypto.SHA256
+	}
+	sig, err := key.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error signing posture %w", err)
+	}
+	return &PostureReport{Posture: p, Signature: hex.EncodeToString(sig)}, nil
+}
+
+// VerifyPosture checks the report signature against pub, the public key of the client
+// certificate, and the binding of the connection it was received on.
+func VerifyPosture(r *PostureReport, pub crypto.PublicKey, binding []byte) error {
+	if r.Posture == nil {
+		return fmt.Errorf("posture missing: %w", ErrAuthFailed)
+	}
+	sig, err := hex.DecodeString(r.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid posture signature %w", err)
+	}
+	msg, err := postureMessage(r.Posture, binding)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(msg)
+	var ok bool
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(k, msg, sig)
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(k, sum[:], sig)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) == nil
+	default:
+		return fmt.Errorf("unsupported posture key %T: %w", pub, ErrAuthFailed)
+	}
+	if !ok {
+		return fmt.Errorf("posture signature mismatch: %w", ErrAuthFailed)
+	}
+	return nil
+}
+
+// postureMessage returns the signed message of p on the connection binding.
+func postureMessage(p *Posture, binding []byte) ([]byte, error) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(nil), binding...), b...), nil
+}
@@ -0,0 +1,102 @@
+package webtunnelcommon
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// PrivacyPolicy controls the packet details written to logs and audit records, eg. for
+// GDPR conscious deployments.
+type PrivacyPolicy struct {
+	RedactPayload bool // Mask packet payloads and DNS names, only headers are logged.
+	AnonymizeIPs  bool // Replace the addresses inside packets with pseudonyms.
+}
+
+var (
+	privacy     PrivacyPolicy
+	privacyKey  []byte // Pseudonym key, random per process so pseudonyms only correlate within a run.
+	privacyLock sync.RWMutex
+)
+
+// SetPrivacyPolicy applies p to the packet logs and audit records of the process.
+func SetPrivacyPolicy(p PrivacyPolicy) {
+	privacyLock.Lock()
+	defer privacyLock.Unlock()
+	privacy = p
+	if p.AnonymizeIPs && privacyKey == nil {
+		privacyKey = make([]byte, 32)
+		rand.Read(privacyKey)
+	}
+}
+
+// Privacy returns the privacy policy in effect.
+func Privacy() PrivacyPolicy {
+	privacyLock.RLock()
+	defer privacyLock.RUnlock()
+	return privacy
+}
+
+// LogIP returns an address seen inside a packet as it may appear in logs: unchanged, or a
+// pseudonym stable for the process if IPs are anonymized.
+func LogIP(ip net.IP) string {
+	privacyLock.RLock()
+	defer privacyLock.RUnlock()
+	if !privacy.AnonymizeIPs || ip == nil {
+		return ip.String()
+	}
+	mac := hmac.New(sha256.New, privacyKey)
+	mac.Write(ip.To16())
+	return "anon-" + hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+// LogName returns a name taken from a packet payload, eg. a DNS query, as it may appear
+// in logs.
+func LogName(name string) string {
+	if Privacy().RedactPayload {
+		return "[redacted]"
+	}
+	return name
+}
+
+// packetSummary formats the headers of a decoded packet according to the privacy policy.
+// The payload is hex encoded or masked.
+func packetSummary(packet gopacket.Packet) string {
+	var b strings.Builder
+	if eth, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); ok {
+		fmt.Fprintf(&b, "Ethernet %v -> %v %v ", eth.SrcMAC, eth.DstMAC, eth.EthernetType)
+	}
+	if arp, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP); ok {
+		fmt.Fprintf(&b, "ARP op %v %v -> %v ", arp.Operation,
+			LogIP(net.IP(arp.SourceProtAddress)), LogIP(net.IP(arp.DstProtAddress)))
+	}
+	if ip, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+		fmt.Fprintf(&b, "IPv4 %v -> %v %v ttl %v len %v ", LogIP(ip.SrcIP), LogIP(ip.DstIP), ip.Protocol, ip.TTL, ip.Length)
+	}
+	switch t := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		fmt.Fprintf(&b, "TCP %v -> %v seq %v ack %v ", t.SrcPort, t.DstPort, t.Seq, t.Ack)
+	case *layers.UDP:
+		fmt.Fprintf(&b, "UDP %v -> %v ", t.SrcPort, t.DstPort)
+	}
+	var payload []byte
+	if tl := packet.TransportLayer(); tl != nil {
+		payload = tl.LayerPayload()
+	} else if nl := packet.NetworkLayer(); nl != nil {
+		payload = nl.LayerPayload()
+	}
+	if Privacy().RedactPayload {
+		fmt.Fprintf(&b, "payload %v bytes redacted", len(payload))
+	} else {
+		fmt.Fprintf(&b, "payload %x", payload)
+	}
+	return b.String()
+}
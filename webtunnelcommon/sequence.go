@@ -0,0 +1,168 @@
+package webtunnelcommon
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// SeqHeader is the handshake header offering (client request) and accepting (server
+// response) sequence numbered data frames.
+const SeqHeader = "X-Webtunnel-Seq"
+
+// SeqDedupHeader is the handshake header offering (client request) and accepting (server
+// response) sequence numbers that continue across the reconnects of a session, so each
+// side keeps its receive window and drops frames delivered twice.
+const SeqDedupHeader = "X-Webtunnel-Seq-Dedup"
+
+// A sequenced data frame is a 5 byte header followed by the packet. The header starts
+// with version nibble 1 so it is never mistaken for an IPv4 packet or a dummy frame.
+const (
+	seqFrameMarker = 0x10
+	seqHeaderLen   = 5
+)
+
+// Number of recent sequence numbers remembered to detect reordering and duplicates.
+const seqWindow = 1024
+
+// addSeq returns pkt prefixed with the sequence header for seq.
+func addSeq(seq uint32, pkt []byte) []byte {
+	out := make([]byte, seqHeaderLen+len(pkt))
+	out[0] = seqFrameMarker
+	binary.BigEndian.PutUint32(out[1:seqHeaderLen], seq)
+	copy(out[seqHeaderLen:], pkt)
+	return out
+}
+
+// ParseSeqFrame returns the sequence number and packet of a sequenced data frame. ok is
+// false for frames without a sequence header, which are returned unchanged.
+func ParseSeqFrame(frame []byte) (seq uint32, pkt []byte, ok bool) {
+	if len(frame) < seqHeaderLen || frame[0] != seqFrameMarker {
+		return 0, frame, false
+	}
+	return binary.BigEndian.Uint32(frame[1:seqHeaderLen]), frame[seqHeaderLen:], true
+}
+
+// LossStats are the loss, reorder and duplication counts of received data frames.
+type LossStats struct {
+	Received      uint64  // Frames received.
+	Lost          uint64  // Frames missing from the sequence.
+	Reordered     uint64  // Frames received after a later frame.
+	Duplicates    uint64  // Frames received more than once.
+	Replays       uint64  // Frames dropped by the anti-replay window.
+	LossRate      float64 // Lost / expected frames.
+	ReorderRate   float64 // Reordered / received frames.
+	DuplicateRate float64 // Duplicates / received frames.
+}
+
+// SeqTracker computes LossStats from the sequence numbers of received frames. Counts
+// accumulate across streams (ie. reconnects).
+type SeqTracker struct {
+	stats      LossStats
+	started    bool                   // True once the first frame of the stream is seen.
+	max        uint32                 // Highest sequence number seen in the stream.
+	seen       [seqWindow / 64]uint64 // Bitmap of received numbers within seqWindow of max.
+	antiReplay bool                   // Drop frames that may be replays instead of accepting them.
+	lock       sync.Mutex
+}
+
+/*
+SetAntiReplay validates received frames like the IPsec anti-replay window (RFC 4303):
+besides duplicates, frames older than the window and unsequenced frames once the stream
+is sequenced are dropped, so captured frames cannot be re-injected. Drops are counted in
+LossStats.Replays. Late frames older than the window are lost on links reordering that
+much.
+*/
+func (t *SeqTracker) SetAntiReplay(enable bool) {
+	t.lock.Lock()
+	t.antiReplay = enable
+	t.lock.Unlock()
+}
+
+// NewStream resets the sequence state for a new connection, keeping the counts.
+func (t *SeqTracker) NewStream() {
+	t.lock.Lock()
+	t.started = false
+	t.seen = [seqWindow / 64]uint64{}
+	t.lock.Unlock()
+}
+
+// Record records the receipt of the frame numbered seq. It returns false if the frame
+// was already received and should be dropped.
+func (t *SeqTracker) Record(seq uint32) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.stats.Received++
+
+	switch {
+	case !t.started:
+		t.started = true
+		t.max = seq
+		t.seen = [seqWindow / 64]uint64{}
+	// Sequence numbers wrap around on long sessions and are compared with serial number
+	// arithmetic (RFC 1982): seq is newer if it is less than half the space ahead of max.
+	case int32(seq-t.max) > 0:
+		gap := seq - t.max - 1
+		t.stats.Lost += uint64(gap)
+		if gap >= seqWindow {
+			t.seen = [seqWindow / 64]uint64{}
+		} else {
+			for s := t.max + 1; s != seq; s++ {
+				t.clear(s)
+			}
+		}
+		t.max = seq
+	case t.max-seq >= seqWindow:
+		if t.antiReplay {
+			t.stats.Replays++
+			return false
+		}
+		// Too old to tell apart from a duplicate; count it as reordered.
+		t.stats.Reordered++
+		return true
+	case t.isSet(seq):
+		t.stats.Duplicates++
+		if t.antiReplay {
+			t.stats.Replays++
+		}
+		return false
+	default:
+		// A frame counted as lost arrived late.
+		t.stats.Reordered++
+		if t.stats.Lost > 0 {
+			t.stats.Lost--
+		}
+	}
+	t.set(seq)
+	return true
+}
+
+// Unsequenced records the receipt of a frame without sequence number. It returns false if
+// the frame should be dropped, ie. anti-replay is enabled and the stream is sequenced.
+func (t *SeqTracker) Unsequenced() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.antiReplay && t.started {
+		t.stats.Replays++
+		return false
+	}
+	return true
+}
+
+func (t *SeqTracker) set(seq uint32)        { t.seen[(seq%seqWindow)/64] |= 1 << (seq % 64) }
+func (t *SeqTracker) clear(seq uint32)      { t.seen[(seq%seqWindow)/64] &^= 1 << (seq % 64) }
+func (t *SeqTracker) isSet(seq uint32) bool { return t.seen[(seq%seqWindow)/64]&(1<<(seq%64)) != 0 }
+
+// Stats returns the current counts and rates.
+func (t *SeqTracker) Stats() LossStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s := t.stats
+	if expected := s.Received - s.Duplicates + s.Lost; expected > 0 {
+		s.LossRate = float64(s.Lost) / float64(expected)
+	}
+	if s.Received > 0 {
+		s.ReorderRate = float64(s.Reordered) / float64(s.Received)
+		s.DuplicateRate = float64(s.Duplicates) / float64(s.Received)
+	}
+	return s
+}
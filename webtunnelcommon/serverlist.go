@@ -0,0 +1,50 @@
+package webtunnelcommon
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// GatewayEndpoint describes a webtunnel gateway advertised by the discovery endpoint.
+type GatewayEndpoint struct {
+	Address   string `json:"address"`   // IP:Port of the websocket server.
+	Secure    bool   `json:"secure"`    // Websocket secure.
+	Region    string `json:"region"`    // Region name, eg. us-east.
+	LatencyMs int    `json:"latencyms"` // Latency hint added to the measured latency.
+}
+
+// ServerList is the payload of the discovery endpoint.
+type ServerList struct {
+	Servers   []GatewayEndpoint `json:"servers"`   // Available gateways.
+	Signature string            `json:"signature"` // Base64 ed25519 signature of Servers, optional.
+}
+
+// SignServerList returns the server list signed with key.
+func SignServerList(servers []GatewayEndpoint, key ed25519.PrivateKey) (*ServerList, error) {
+	b, err := json.Marshal(servers)
+	if err != nil {
+		return nil, err
+	}
+	return &ServerList{
+		Servers:   servers,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, b)),
+	}, nil
+}
+
+// VerifyServerList checks the server list signature with key.
+func VerifyServerList(l *ServerList, key ed25519.PublicKey) error {
+	sig, err := base64.StdEncoding.DecodeString(l.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid server list signature %w", err)
+	}
+	b, err := json.Marshal(l.Servers)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, b, sig) {
+		return fmt.Errorf("server list signature mismatch: %w", ErrAuthFailed)
+	}
+	return nil
+}
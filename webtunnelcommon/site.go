@@ -0,0 +1,19 @@
+package webtunnelcommon
+
+// Prefixes of the site-to-site control messages.
+const (
+	SiteAdvertPrefix = "site "    // Prefix advertisement from a site gateway client.
+	SiteAckPrefix    = "siteack " // Server response to an advertisement.
+)
+
+// SiteAdvert lists the local prefixes of a site gateway client.
+type SiteAdvert struct {
+	Prefixes []string `json:"prefixes"` // Subnets behind the client.
+}
+
+// SiteAck is the server response to a SiteAdvert.
+type SiteAck struct {
+	Accepted []string `json:"accepted"` // Client prefixes routed to the session.
+	Rejected []string `json:"rejected"` // Client prefixes refused by policy or conflicts.
+	Prefixes []string `json:"prefixes"` // Server local prefixes, routed via the tunnel by the client.
+}
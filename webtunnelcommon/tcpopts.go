@@ -0,0 +1,91 @@
+package webtunnelcommon
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// TCPOptions tunes the TCP connection carrying the websocket. Zero values keep the OS
+// defaults.
+type TCPOptions struct {
+	KeepAlive         time.Duration // Idle time before keepalive probes, negative disables keepalives.
+	KeepAliveInterval time.Duration // Time between unanswered probes.
+	KeepAliveCount    int           // Unanswered probes before the connection is dropped.
+	Congestion        string        // Congestion control algorithm eg. bbr, Linux only.
+}
+
+// Validate returns an error if the options are invalid or not supported by the OS.
+func (o TCPOptions) Validate() error {
+	if o.KeepAlive < 0 && (o.KeepAliveInterval != 0 || o.KeepAliveCount != 0) {
+		return fmt.Errorf("keepalive timers set with keepalives disabled")
+	}
+	if (o.KeepAlive > 0 && o.KeepAlive < time.Second) || o.KeepAliveInterval < 0 || (o.KeepAliveInterval > 0 && o.KeepAliveInterval < time.Second) {
+		return fmt.Errorf("keepalive timers must be at least 1s")
+	}
+	if o.KeepAliveCount < 0 {
+		return fmt.Errorf("invalid keepalive count %v", o.KeepAliveCount)
+	}
+	if o.Congestion != "" {
+		return checkCongestion(o.Congestion)
+	}
+	return nil
+}
+
+// keepAlive returns true if the options change the keepalives of the OS.
+func (o TCPOptions) keepAlive() bool {
+	return o.KeepAlive != 0 || o.KeepAliveInterval != 0 || o.KeepAliveCount != 0
+}
+
+// Apply sets the options on the TCP connection under conn.
+func (o TCPOptions) Apply(conn net.Conn) error {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("connection does not support socket options")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	cerr := raw.Control(func(fd uintptr) {
+		if o.keepAlive() {
+			if err = setKeepAlive(fd, o); err != nil {
+				err = fmt.Errorf("error setting keepalive %w", err)
+				return
+			}
+		}
+		if o.Congestion != "" {
+			if err = setCongestion(fd, o.Congestion); err != nil {
+				err = fmt.Errorf("error setting congestion control %v %w", o.Congestion, err)
+			}
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// TCPOptionsListener is a listener applying options to the accepted connections.
+type TCPOptionsListener struct {
+	net.Listener
+	Options TCPOptions
+	OnError func(net.Conn, error) // Called when the options could not be applied, nil to ignore.
+}
+
+// Accept returns the next connection with the options applied.
+func (l *TCPOptionsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err := l.Options.Apply(conn); err != nil && l.OnError != nil {
+		l.OnError(conn, err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,43 @@
+package webtunnelcommon
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Keepalive socket options missing in syscall.
+const (
+	tcpKeepIntvl = 0x101
+	tcpKeepCnt   = 0x102
+)
+
+func setKeepAlive(fd uintptr, o TCPOptions) error {
+	if o.KeepAlive < 0 {
+		return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 0)
+	}
+	if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1); err != nil {
+		return err
+	}
+	if o.KeepAlive > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPALIVE, int(o.KeepAlive.Seconds())); err != nil {
+			return err
+		}
+	}
+	if o.KeepAliveInterval > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpKeepIntvl, int(o.KeepAliveInterval.Seconds())); err != nil {
+			return err
+		}
+	}
+	if o.KeepAliveCount > 0 {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpKeepCnt, o.KeepAliveCount)
+	}
+	return nil
+}
+
+func setCongestion(fd uintptr, name string) error {
+	return checkCongestion(name)
+}
+
+func checkCongestion(name string) error {
+	return fmt.Errorf("congestion control not supported on darwin")
+}
@@ -0,0 +1,51 @@
+package webtunnelcommon
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Congestion control algorithms loaded in the kernel.
+const availableCongestion = "/proc/sys/net/ipv4/tcp_available_congestion_control"
+
+func setKeepAlive(fd uintptr, o TCPOptions) error {
+	if o.KeepAlive < 0 {
+		return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 0)
+	}
+	if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1); err != nil {
+		return err
+	}
+	if o.KeepAlive > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, int(o.KeepAlive.Seconds())); err != nil {
+			return err
+		}
+	}
+	if o.KeepAliveInterval > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, int(o.KeepAliveInterval.Seconds())); err != nil {
+			return err
+		}
+	}
+	if o.KeepAliveCount > 0 {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, o.KeepAliveCount)
+	}
+	return nil
+}
+
+func setCongestion(fd uintptr, name string) error {
+	return syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, name)
+}
+
+func checkCongestion(name string) error {
+	b, err := os.ReadFile(availableCongestion)
+	if err != nil {
+		return fmt.Errorf("error reading congestion control algorithms %w", err)
+	}
+	for _, a := range strings.Fields(string(b)) {
+		if a == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("congestion control %v not available (have %v), the tcp_%v module may need loading", name, strings.TrimSpace(string(b)), name)
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !darwin && !windows
+
+package webtunnelcommon
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func setKeepAlive(fd uintptr, o TCPOptions) error {
+	return fmt.Errorf("keepalive timers not supported on %v", runtime.GOOS)
+}
+
+func setCongestion(fd uintptr, name string) error {
+	return checkCongestion(name)
+}
+
+func checkCongestion(name string) error {
+	return fmt.Errorf("congestion control not supported on %v", runtime.GOOS)
+}
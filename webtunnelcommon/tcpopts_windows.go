@@ -0,0 +1,53 @@
+package webtunnelcommon
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Default keepalive timers of Windows, SIO_KEEPALIVE_VALS sets both.
+const (
+	defaultKeepAliveIdle     = 2 * time.Hour
+	defaultKeepAliveInterval = time.Second
+)
+
+// tcpKeepCnt is the TCP_KEEPCNT socket option, missing in syscall.
+const tcpKeepCnt = 16
+
+func setKeepAlive(fd uintptr, o TCPOptions) error {
+	h := syscall.Handle(fd)
+	if o.KeepAlive < 0 {
+		return syscall.SetsockoptInt(h, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 0)
+	}
+	idle, intvl := o.KeepAlive, o.KeepAliveInterval
+	if idle == 0 {
+		idle = defaultKeepAliveIdle
+	}
+	if intvl == 0 {
+		intvl = defaultKeepAliveInterval
+	}
+	ka := syscall.TCPKeepalive{
+		OnOff:    1,
+		Time:     uint32(idle / time.Millisecond),
+		Interval: uint32(intvl / time.Millisecond),
+	}
+	var ret uint32
+	if err := syscall.WSAIoctl(h, syscall.SIO_KEEPALIVE_VALS, (*byte)(unsafe.Pointer(&ka)), uint32(unsafe.Sizeof(ka)),
+		nil, 0, &ret, nil, 0); err != nil {
+		return err
+	}
+	if o.KeepAliveCount > 0 {
+		return syscall.SetsockoptInt(h, syscall.IPPROTO_TCP, tcpKeepCnt, o.KeepAliveCount)
+	}
+	return nil
+}
+
+func setCongestion(fd uintptr, name string) error {
+	return checkCongestion(name)
+}
+
+func checkCongestion(name string) error {
+	return fmt.Errorf("congestion control not supported on windows")
+}
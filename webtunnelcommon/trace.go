@@ -0,0 +1,103 @@
+package webtunnelcommon
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// TraceHeader is the W3C trace context header used to propagate the trace ID in the handshake.
+const TraceHeader = "traceparent"
+
+// Span is a traced operation.
+type Span interface {
+	SetAttribute(key string, value any) // Annotate the span.
+	End(err error)                      // Finish the span with its result.
+}
+
+// Tracer starts spans for the handshake and control operations. Implementations can wrap
+// an OpenTelemetry tracer; the trace ID of the context is available with TraceID.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+type traceIDKey struct{}
+
+// ContextWithTraceID returns a context carrying the trace ID.
+func ContextWithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, traceID)
+}
+
+// TraceID returns the trace ID carried by ctx or empty string.
+func TraceID(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey{}).(string)
+	return id
+}
+
+// NewTraceID returns a random 16 byte trace ID in hex.
+func NewTraceID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// FormatTraceParent returns the traceparent header value for traceID.
+func FormatTraceParent(traceID string) string {
+	span := make([]byte, 8)
+	rand.Read(span)
+	return fmt.Sprintf("00-%s-%s-01", traceID, hex.EncodeToString(span))
+}
+
+// ParseTraceParent returns the trace ID of a traceparent header value.
+func ParseTraceParent(v string) (string, error) {
+	parts := strings.Split(v, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 {
+		return "", fmt.Errorf("invalid traceparent %q", v)
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil {
+		return "", fmt.Errorf("invalid traceparent %q", v)
+	}
+	return parts[1], nil
+}
+
+// NopTracer discards all spans.
+type NopTracer struct{}
+
+// Start returns ctx and a span that does nothing.
+func (NopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(string, any) {}
+func (nopSpan) End(error)                {}
+
+// LogTracer logs each span with its trace ID and duration.
+type LogTracer struct{}
+
+// Start returns ctx and a span logged when it ends.
+func (LogTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, &logSpan{name: name, traceID: TraceID(ctx), start: time.Now()}
+}
+
+type logSpan struct {
+	name    string
+	traceID string
+	start   time.Time
+	attrs   []string
+}
+
+func (s *logSpan) SetAttribute(key string, value any) {
+	s.attrs = append(s.attrs, fmt.Sprintf("%s=%v", key, value))
+}
+
+func (s *logSpan) End(err error) {
+	glog.V(1).Infof("trace:%s span:%s duration:%v %s err:%v",
+		s.traceID, s.name, time.Since(s.start), strings.Join(s.attrs, " "), err)
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/google/gopacket"
@@ -12,36 +13,82 @@ import (
 	"github.com/songgao/water"
 )
 
+// Load balancer affinity cookie and URL query parameter carrying the gateway instance ID.
+const (
+	AffinityCookie = "webtunnel_affinity"
+	AffinityParam  = "affinity"
+)
+
 // ServerInfo represents the struct provided to the client for debuging purpose
 type ServerInfo struct {
-	Hostname string `json:"hostname"` // for now only provide gw hostname to client
-	Session  string `json:"session"`  // session tracker from server
+	Hostname     string `json:"hostname"`               // for now only provide gw hostname to client
+	Session      string `json:"session"`                // session tracker from server
+	Instance     string `json:"instance"`               // gateway instance ID for load balancer affinity
+	Version      string `json:"version"`                // server version
+	SeqContinued bool   `json:"seqcontinued,omitempty"` // data frame numbering continues from the previous connection of the session
+	SessionID    string `json:"sessionid,omitempty"`    // session ID in server logs, for support
 }
 
+// SessionIDHeader is the handshake response header with the ID the server logs the
+// session under, so a client issue can be correlated with the server side events.
+const SessionIDHeader = "X-Webtunnel-Session-Id"
+
+// LeaseHeader is the handshake request header with the session token of a config fetched
+// out-of-band, claiming its IP for the connection.
+const LeaseHeader = "X-Webtunnel-Lease"
+
 // ClientConfig represents the struct to pass config from server to client.
 type ClientConfig struct {
-	IP          string      `json:"ip"`          // IP address of client.
-	Netmask     string      `json:"netmask"`     // Netmask of interface.
-	RoutePrefix []string    `json:"routeprefix"` // Network prefix to route.
-	GWIp        string      `json:"gwip"`        // Gateway IP address.
-	DNS         []string    `json:"dns"`         // DNS IPs
-	ServerInfo  *ServerInfo `json:"serverinfo"`  // Server Information for debug or troubleshooting
+	IP          string      `json:"ip"`                    // IP address of client.
+	Netmask     string      `json:"netmask"`               // Netmask of interface.
+	RoutePrefix []string    `json:"routeprefix"`           // Network prefix to route.
+	GWIp        string      `json:"gwip"`                  // Gateway IP address.
+	DNS         []string    `json:"dns"`                   // DNS IPs
+	ServerInfo  *ServerInfo `json:"serverinfo"`            // Server Information for debug or troubleshooting
+	MovedFrom   string      `json:"movedfrom,omitempty"`   // Current IP of a live session moved to IP.
+	LeaseExpiry *time.Time  `json:"leaseexpiry,omitempty"` // Time an out-of-band config must be claimed by, nil for in-band configs.
+	DNSRoutes   []DNSRoute  `json:"dnsroutes,omitempty"`   // Split DNS map, names not matched use DNS.
 }
 
-// PrintPacketIPv4 prints the IPv4 packet.
+// DNSRoute resolves the names under Domains with Servers instead of the default DNS.
+type DNSRoute struct {
+	Domains []string `json:"domains"` // DNS suffixes without dots at either end, eg. corp.example.com or 10.in-addr.arpa.
+	Servers []string `json:"servers"` // IPs of the DNS servers.
+}
+
+// ReaddressAckPrefix prefixes the client acknowledgement of a config moving its session to
+// a new IP, followed by the new IP.
+const ReaddressAckPrefix = "readdressed "
+
+// PrintPacketIPv4 prints the IPv4 packet, redacted according to the privacy policy.
 func PrintPacketIPv4(pkt []byte, tag string) {
+	if !glog.V(2) {
+		return
+	}
 	packet := gopacket.NewPacket(pkt, layers.LayerTypeIPv4, gopacket.Default)
 	if _, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
-		glog.V(2).Infof("%s: %v", tag, packet)
+		printPacket(packet, tag)
 	}
 }
 
-// PrintPacketEth prints the Ethernet packet.
+// PrintPacketEth prints the Ethernet packet, redacted according to the privacy policy.
 func PrintPacketEth(pkt []byte, tag string) {
+	if !glog.V(2) {
+		return
+	}
 	packet := gopacket.NewPacket(pkt, layers.LayerTypeEthernet, gopacket.Default)
 	if _, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); ok {
+		printPacket(packet, tag)
+	}
+}
+
+// printPacket logs a full packet dump, or a summary if the privacy policy hides details.
+func printPacket(packet gopacket.Packet, tag string) {
+	if Privacy() == (PrivacyPolicy{}) {
 		glog.V(2).Infof("%s: %v", tag, packet)
+		return
 	}
+	glog.V(2).Infof("%s: %s", tag, packetSummary(packet))
 }
 
 // GetIntCfg returns the hardware address and IPs for the interface.
@@ -0,0 +1,124 @@
+/*
+Package version holds the build version of the webtunnel binaries and checks the
+compatibility of peers.
+
+The version is set at build time, eg.
+
+	go build -ldflags "-X github.com/deepakkamesh/webtunnel/webtunnelcommon/version.Version=1.4.0 \
+		-X github.com/deepakkamesh/webtunnel/webtunnelcommon/version.Commit=$(git rev-parse --short HEAD)"
+
+Binaries built without it report the version "dev", which is compatible with any peer.
+*/
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Header is the handshake header carrying the version of the client in the request and
+// of the server in the response.
+const Header = "X-Webtunnel-Version"
+
+// Build information, set with -ldflags -X.
+var (
+	Version   = "dev" // Semantic version, eg. 1.4.0.
+	Commit    = ""    // Source revision.
+	BuildDate = ""    // Build time, eg. RFC 3339.
+)
+
+// Info is the build information of a binary.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"builddate,omitempty"`
+	GoVersion string `json:"goversion"`
+	Platform  string `json:"platform"` // GOOS/GOARCH.
+}
+
+// Get returns the build information of the running binary.
+func Get() Info {
+	return Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
+
+// String returns the version with the commit, if known.
+func (i Info) String() string {
+	if i.Commit == "" {
+		return i.Version
+	}
+	return i.Version + " (" + i.Commit + ")"
+}
+
+// Semver is a parsed semantic version. Pre-release and build suffixes are ignored.
+type Semver struct {
+	Major, Minor, Patch int
+}
+
+// Parse parses versions like v1.4, 1.4.2 or 1.4.2-rc1.
+func Parse(s string) (Semver, error) {
+	var v Semver
+	core, _, _ := strings.Cut(strings.TrimPrefix(s, "v"), "-")
+	core, _, _ = strings.Cut(core, "+")
+	parts := strings.Split(core, ".")
+	if len(parts) > 3 {
+		return v, fmt.Errorf("invalid version %q", s)
+	}
+	nums := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+		*nums[i] = n
+	}
+	return v, nil
+}
+
+// Less returns true if v is older than o.
+func (v Semver) Less(o Semver) bool {
+	if v.Major != o.Major {
+		return v.Major < o.Major
+	}
+	if v.Minor != o.Minor {
+		return v.Minor < o.Minor
+	}
+	return v.Patch < o.Patch
+}
+
+// String returns the version as major.minor.patch.
+func (v Semver) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Check returns an actionable error if the peer version does not satisfy min, eg.
+// "server requires client >= 1.4.0, client is 1.2.0". self and peer name the two sides.
+// An empty min or a dev build always pass. A peer not reporting its version predates the
+// version exchange and is too old for any min.
+func Check(self, peer, peerVersion, min string) error {
+	if min == "" || peerVersion == "dev" {
+		return nil
+	}
+	m, err := Parse(min)
+	if err != nil {
+		return err
+	}
+	if peerVersion == "" {
+		return fmt.Errorf("%s requires %s >= %v, %s is older", self, peer, m, peer)
+	}
+	v, err := Parse(peerVersion)
+	if err != nil {
+		return fmt.Errorf("%s sent invalid version: %w", peer, err)
+	}
+	if v.Less(m) {
+		return fmt.Errorf("%s requires %s >= %v, %s is %v", self, peer, m, peer, v)
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package webtunnelcommon
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// MaxMessageSize is the largest websocket message accepted by the client and server, a
+// maximum size IP packet plus obfuscation padding.
+const MaxMessageSize = 1 << 17
+
+// MaxPacketSize is the largest IP packet read from the tunnel interfaces and sent in a
+// data frame.
+const MaxPacketSize = 2048
+
+/*
+FrameBufferSize returns the websocket read and write buffer size holding a whole data
+frame carrying a packet of up to mtu bytes, with the sequence header and the largest
+padding or dummy frame of obfs (may be nil). A message larger than the write buffer is
+fragmented by the client into continuation frames and written in pieces by the server,
+so the buffers of the upgrader and dialer must be at least this size. An error is
+returned if the frame exceeds MaxMessageSize, as the peer would drop it.
+*/
+func FrameBufferSize(mtu int, obfs *ObfuscationPolicy) (int, error) {
+	size := mtu + seqHeaderLen
+	if obfs != nil {
+		size += obfs.maxPad()
+		if obfs.DummyInterval > 0 && obfs.DummySize+seqHeaderLen > size {
+			size = obfs.DummySize + seqHeaderLen
+		}
+	}
+	if size > MaxMessageSize {
+		return 0, fmt.Errorf("data frames of %v bytes exceed the %v bytes message limit", size, MaxMessageSize)
+	}
+	return size, nil
+}
+
+// Depth of the outbound control and data queues.
+const (
+	ctrlQueueLen = 16
+	dataQueueLen = 64
+)
+
+// wsMessage is a queued outbound websocket message.
+type wsMessage struct {
+	msgType int
+	data    []byte
+	result  chan error
+}
+
+// WSWriter serializes writes to a websocket connection. Control messages (config,
+// commands, close) are queued on a dedicated lane that is always drained before the
+// data lane so they are never starved behind bulk packets.
+type WSWriter struct {
+	conn  *websocket.Conn
+	ctrl  chan *wsMessage
+	data  chan *wsMessage
+	done  chan struct{}
+	once  sync.Once
+	obfs  *ObfuscationPolicy // Data frame obfuscation, nil if disabled.
+	burst int                // Data frames sent in the current burst.
+	dscp  *dscpMarker        // Copies inner DSCP to the connection, nil if disabled.
+	codec Codec              // Codec for control messages.
+	seq   uint32             // Sequence number of the last data frame.
+	seqOn atomic.Bool        // Prefix data frames with sequence numbers.
+	chunk int                // Largest encoded control message sent unchunked, 0 disables.
+	msgID uint32             // ID of the last chunked control message.
+	cLock sync.Mutex         // Keeps the chunks of a message together.
+}
+
+// NewWSWriter returns a WSWriter for conn and starts its write loop. obfs is the
+// obfuscation policy applied to data frames and may be nil.
+func NewWSWriter(conn *websocket.Conn, obfs *ObfuscationPolicy) *WSWriter {
+	w := &WSWriter{
+		conn:  conn,
+		ctrl:  make(chan *wsMessage, ctrlQueueLen),
+		data:  make(chan *wsMessage, dataQueueLen),
+		done:  make(chan struct{}),
+		obfs:  obfs,
+		codec: CodecByName(conn.Subprotocol()),
+	}
+	go w.run()
+	return w
+}
+
+// Conn returns the underlying websocket connection.
+func (w *WSWriter) Conn() *websocket.Conn {
+	return w.conn
+}
+
+// SetDSCPCopy enables copying the DSCP of inner packets to the outer connection. It
+// must be called before any data is written.
+func (w *WSWriter) SetDSCPCopy(enable bool) error {
+	if !enable {
+		w.dscp = nil
+		return nil
+	}
+	m, err := newDSCPMarker(w.conn.UnderlyingConn())
+	if err != nil {
+		return err
+	}
+	w.dscp = m
+	return nil
+}
+
+// SetSequencing enables sequence numbers on data frames so the peer can measure loss
+// and reordering. Only enable it if the peer accepted SeqHeader in the handshake. It
+// must be called before any data is written; dummy frames sent before are unsequenced.
+func (w *WSWriter) SetSequencing(enable bool) {
+	w.seqOn.Store(enable)
+}
+
+// Sequence returns the sequence number of the last data frame written.
+func (w *WSWriter) Sequence() uint32 {
+	return atomic.LoadUint32(&w.seq)
+}
+
+// SetSequence continues the data frame numbering after seq, eg. from the writer of the
+// previous connection of a session. It must be called before any data is written.
+func (w *WSWriter) SetSequence(seq uint32) {
+	atomic.StoreUint32(&w.seq, seq)
+}
+
+// SetChunking splits control messages written with WriteEncoded that are larger than
+// size bytes into chunks. Only enable it if the peer offered ChunkHeader in the handshake.
+func (w *WSWriter) SetChunking(size int) {
+	w.chunk = size
+}
+
+// QueueLen returns the number of control and data messages waiting to be written.
+func (w *WSWriter) QueueLen() (int, int) {
+	return len(w.ctrl), len(w.data)
+}
+
+// WriteControlMessage writes a message on the priority lane and waits for completion.
+func (w *WSWriter) WriteControlMessage(msgType int, data []byte) error {
+	return w.write(w.ctrl, msgType, data)
+}
+
+// WriteDataMessage writes a message on the data lane and waits for completion.
+func (w *WSWriter) WriteDataMessage(msgType int, data []byte) error {
+	return w.write(w.data, msgType, data)
+}
+
+// Codec returns the control message codec negotiated for the connection.
+func (w *WSWriter) Codec() Codec {
+	return w.codec
+}
+
+// WriteEncoded writes v encoded with the connection codec as a text message on the
+// priority lane.
+func (w *WSWriter) WriteEncoded(v any) error {
+	b, err := EncodeControl(w.codec, v)
+	if err != nil {
+		return err
+	}
+	return w.writeText(b)
+}
+
+// WriteControl writes the control message m, encoded with the connection codec, on the
+// priority lane.
+func (w *WSWriter) WriteControl(m *ControlMessage) error {
+	b, err := EncodeControlMessage(w.codec, m)
+	if err != nil {
+		return err
+	}
+	return w.writeText(b)
+}
+
+// writeText writes the text control message b, split into chunks if enabled.
+func (w *WSWriter) writeText(b []byte) error {
+	if w.chunk <= 0 || len(b) <= w.chunk {
+		return w.WriteControlMessage(websocket.TextMessage, b)
+	}
+	w.cLock.Lock()
+	defer w.cLock.Unlock()
+	w.msgID++
+	for _, c := range splitChunks(w.msgID, b, w.chunk) {
+		if err := w.WriteControlMessage(websocket.TextMessage, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes v as a JSON text message on the priority lane.
+func (w *WSWriter) WriteJSON(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return w.WriteControlMessage(websocket.TextMessage, b)
+}
+
+// Close stops the write loop. Pending and future writes return an error.
+func (w *WSWriter) Close() {
+	w.once.Do(func() { close(w.done) })
+}
+
+func (w *WSWriter) write(lane chan *wsMessage, msgType int, data []byte) error {
+	m := &wsMessage{msgType: msgType, data: data, result: make(chan error, 1)}
+	select {
+	case lane <- m:
+	case <-w.done:
+		return fmt.Errorf("websocket writer closed")
+	}
+	select {
+	case err := <-m.result:
+		return err
+	case <-w.done:
+		return fmt.Errorf("websocket writer closed")
+	}
+}
+
+func (w *WSWriter) run() {
+	// Dummy traffic timer; a nil channel never fires when disabled.
+	var dummy <-chan time.Time
+	if w.obfs != nil && w.obfs.DummyInterval > 0 {
+		dummy = time.After(w.obfs.nextDummy())
+	}
+
+	for {
+		// Drain the control lane first.
+		select {
+		case m := <-w.ctrl:
+			m.result <- w.conn.WriteMessage(m.msgType, m.data)
+			continue
+		default:
+		}
+
+		select {
+		case m := <-w.ctrl:
+			m.result <- w.conn.WriteMessage(m.msgType, m.data)
+		case m := <-w.data:
+			m.result <- w.writeData(m)
+		case <-dummy:
+			// Dummy frames are sequenced like data frames so anti-replay receivers accept them.
+			w.conn.WriteMessage(websocket.BinaryMessage, w.sequence(w.obfs.dummyFrame()))
+			dummy = time.After(w.obfs.nextDummy())
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// writeData writes a data message applying the obfuscation policy.
+func (w *WSWriter) writeData(m *wsMessage) error {
+	if w.dscp != nil && m.msgType == websocket.BinaryMessage {
+		w.dscp.mark(m.data)
+	}
+	if m.msgType != websocket.BinaryMessage {
+		return w.conn.WriteMessage(m.msgType, m.data)
+	}
+	if w.obfs == nil {
+		return w.conn.WriteMessage(m.msgType, w.sequence(m.data))
+	}
+	if d := w.obfs.delay(); d > 0 {
+		time.Sleep(d)
+	}
+	if w.obfs.BurstGap > 0 && w.obfs.BurstSize > 0 {
+		if w.burst >= w.obfs.BurstSize {
+			time.Sleep(w.obfs.BurstGap)
+			w.burst = 0
+		}
+		w.burst++
+	}
+	return w.conn.WriteMessage(m.msgType, w.sequence(w.obfs.pad(m.data)))
+}
+
+// sequence prefixes a data frame with the next sequence number if enabled.
+func (w *WSWriter) sequence(frame []byte) []byte {
+	if !w.seqOn.Load() {
+		return frame
+	}
+	return addSeq(atomic.AddUint32(&w.seq, 1), frame)
+}
@@ -0,0 +1,576 @@
+package webtunnelserver
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ACME challenge types.
+const (
+	ACMEHTTP01    = "http-01"     // Token served over HTTP on ACMEConfig.HTTPAddr, usually port 80.
+	ACMETLSALPN01 = "tls-alpn-01" // Certificate served to the acme-tls/1 protocol on the HTTPS port.
+)
+
+// LetsEncryptURL is the ACME directory of the Let's Encrypt production CA.
+const LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+const (
+	acmeALPNProto     = "acme-tls/1"
+	acmeChallengePath = "/.well-known/acme-challenge/"
+	acmeAccountFile   = "acme_account.key"
+	acmePollAttempts  = 60
+	defaultACMERenew  = 30 * 24 * time.Hour
+)
+
+// ACMEPollInterval (Overridable) is the interval between polls of pending authorizations
+// and orders.
+var ACMEPollInterval = 2 * time.Second
+
+// ACMERetryInterval (Overridable) is the wait after a failed certificate order, keeping
+// within the rate limits of the CA.
+var ACMERetryInterval = 10 * time.Minute
+
+// idPeACMEIdentifier is the extension of TLS-ALPN-01 challenge certificates (RFC 8737).
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// ACMEConfig configures a certificate obtained and renewed from an ACME CA such as
+// Let's Encrypt.
+type ACMEConfig struct {
+	Domains      []string      // Names on the certificate, the first names the cache files.
+	Email        string        // Account contact for expiry notices, optional.
+	AcceptTOS    bool          // Agree to the terms of service of the CA, required.
+	CacheDir     string        // Directory keeping the account key and certificate across restarts.
+	DirectoryURL string        // ACME directory of the CA, Let's Encrypt if empty.
+	Challenge    string        // ACMETLSALPN01 if empty, or ACMEHTTP01.
+	HTTPAddr     string        // Listen address for HTTP-01 challenges, ":80" if empty.
+	RenewBefore  time.Duration // Renew when the certificate expires within this, 30 days if zero.
+	Client       *http.Client  // Client for the CA, http.DefaultClient if nil.
+}
+
+// acmeProblem is an ACME error document.
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("%v: %v", p.Type, p.Detail)
+}
+
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type acmeOrder struct {
+	Status         string       `json:"status"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *acmeProblem `json:"error"`
+}
+
+type acmeChallenge struct {
+	Type  string `json:"type"`
+	URL   string `json:"url"`
+	Token string `json:"token"`
+}
+
+type acmeAuthz struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+// acmeManager obtains and renews the certificate and answers the CA challenges.
+type acmeManager struct {
+	cfg      ACMEConfig
+	certs    *certStore
+	listener net.Listener                // HTTP-01 challenge listener, nil for TLS-ALPN-01.
+	key      *ecdsa.PrivateKey           // Account key.
+	kid      string                      // Account URL.
+	dir      acmeDirectory               // Endpoints of the CA.
+	nonce    string                      // Replay nonce for the next request.
+	tokens   map[string]string           // HTTP-01 key authorizations by token.
+	alpn     map[string]*tls.Certificate // TLS-ALPN-01 certificates by domain.
+	lock     sync.Mutex
+}
+
+/*
+SetACME makes the server obtain its HTTPS certificate from an ACME CA such as Let's
+Encrypt and renew it before expiry, instead of loading the key and cert files. The
+certificate and account key are kept in cfg.CacheDir so restarts don't hit the CA rate
+limits. Zero fields of cfg take defaults. This should be called prior to Start.
+*/
+func (r *WebTunnelServer) SetACME(cfg ACMEConfig) error {
+	if len(cfg.Domains) == 0 {
+		return fmt.Errorf("no ACME domains")
+	}
+	if !cfg.AcceptTOS {
+		return fmt.Errorf("the terms of service of the ACME CA must be accepted")
+	}
+	if cfg.CacheDir == "" {
+		return fmt.Errorf("no ACME cache directory")
+	}
+	if cfg.DirectoryURL == "" {
+		cfg.DirectoryURL = LetsEncryptURL
+	}
+	switch cfg.Challenge {
+	case "":
+		cfg.Challenge = ACMETLSALPN01
+	case ACMETLSALPN01, ACMEHTTP01:
+	default:
+		return fmt.Errorf("unsupported ACME challenge %v", cfg.Challenge)
+	}
+	if cfg.HTTPAddr == "" {
+		cfg.HTTPAddr = ":80"
+	}
+	if cfg.RenewBefore == 0 {
+		cfg.RenewBefore = defaultACMERenew
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	if err := os.MkdirAll(cfg.CacheDir, 0700); err != nil {
+		return fmt.Errorf("error creating ACME cache %w", err)
+	}
+
+	m := &acmeManager{
+		cfg:    cfg,
+		certs:  &certStore{},
+		tokens: make(map[string]string),
+		alpn:   make(map[string]*tls.Certificate),
+	}
+	if cert, err := tls.LoadX509KeyPair(m.cacheFile(".crt"), m.cacheFile(".key")); err == nil {
+		m.certs.set(cert)
+		glog.Infof("loaded cached certificate for %v, expires %v", cfg.Domains, m.certs.expiry())
+	}
+	r.acme = m
+	return nil
+}
+
+// processACME obtains the certificate and renews it before expiry.
+func (r *WebTunnelServer) processACME() {
+	m := r.acme
+	if m == nil {
+		return
+	}
+	if m.listener != nil {
+		go func() {
+			glog.Errorf("ACME challenge listener stopped: %v", http.Serve(m.listener, m))
+		}()
+	}
+	for {
+		if r.isStopped.Load() {
+			glog.V(1).Info("Exiting ACME routine")
+			return
+		}
+		wait := CertCheckInterval
+		if m.due() {
+			if err := m.obtain(); err != nil {
+				glog.Errorf("unable to obtain certificate for %v: %v", m.cfg.Domains, err)
+				wait = ACMERetryInterval
+			}
+		}
+		r.checkCertExpiry(m.certs, m.cfg.Domains[0])
+		time.Sleep(wait)
+	}
+}
+
+// cacheFile returns the path of the cached certificate file with ext.
+func (m *acmeManager) cacheFile(ext string) string {
+	return filepath.Join(m.cfg.CacheDir, m.cfg.Domains[0]+ext)
+}
+
+// due returns true if there is no certificate for the domains or it is due for renewal.
+func (m *acmeManager) due() bool {
+	m.certs.lock.Lock()
+	cert := m.certs.cert
+	m.certs.lock.Unlock()
+	if cert == nil || cert.Leaf == nil {
+		return true
+	}
+	for _, d := range m.cfg.Domains {
+		if cert.Leaf.VerifyHostname(d) != nil {
+			return true
+		}
+	}
+	return time.Until(cert.Leaf.NotAfter) < m.cfg.RenewBefore
+}
+
+// getCertificate implements tls.Config.GetCertificate, answering TLS-ALPN-01 challenges.
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acmeALPNProto {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		if cert, ok := m.alpn[hello.ServerName]; ok {
+			return cert, nil
+		}
+		return nil, fmt.Errorf("no ACME challenge for %q", hello.ServerName)
+	}
+	return m.certs.getCertificate(hello)
+}
+
+// ServeHTTP answers HTTP-01 challenges.
+func (m *acmeManager) ServeHTTP(w http.ResponseWriter, rcv *http.Request) {
+	if !strings.HasPrefix(rcv.URL.Path, acmeChallengePath) {
+		http.NotFound(w, rcv)
+		return
+	}
+	m.lock.Lock()
+	keyAuth, ok := m.tokens[strings.TrimPrefix(rcv.URL.Path, acmeChallengePath)]
+	m.lock.Unlock()
+	if !ok {
+		http.NotFound(w, rcv)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, keyAuth)
+}
+
+// obtain orders a certificate for the domains and caches it.
+func (m *acmeManager) obtain() error {
+	if err := m.register(); err != nil {
+		return err
+	}
+	var ids []map[string]string
+	for _, d := range m.cfg.Domains {
+		ids = append(ids, map[string]string{"type": "dns", "value": d})
+	}
+	order := acmeOrder{}
+	orderURL, err := m.post(m.dir.NewOrder, map[string]any{"identifiers": ids}, &order)
+	if err != nil {
+		return fmt.Errorf("error creating order %w", err)
+	}
+	for _, a := range order.Authorizations {
+		if err := m.authorize(a); err != nil {
+			return err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.cfg.Domains[0]},
+		DNSNames: m.cfg.Domains,
+	}, key)
+	if err != nil {
+		return err
+	}
+	if _, err := m.post(order.Finalize, map[string]string{"csr": b64(csr)}, &order); err != nil {
+		return fmt.Errorf("error finalizing order %w", err)
+	}
+	for i := 0; order.Status != "valid"; i++ {
+		if order.Status == "invalid" || i == acmePollAttempts {
+			return fmt.Errorf("order %v: %v", order.Status, order.Error)
+		}
+		time.Sleep(ACMEPollInterval)
+		if _, err := m.post(orderURL, nil, &order); err != nil {
+			return err
+		}
+	}
+	chain, _, err := m.postRaw(order.Certificate, nil)
+	if err != nil {
+		return fmt.Errorf("error downloading certificate %w", err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	cert, err := tls.X509KeyPair(chain, keyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid certificate from CA %w", err)
+	}
+	if err := os.WriteFile(m.cacheFile(".key"), keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(m.cacheFile(".crt"), chain, 0600); err != nil {
+		return err
+	}
+	m.certs.set(cert)
+	m.certs.lock.Lock()
+	m.certs.reloads++
+	m.certs.lock.Unlock()
+	glog.Infof("obtained certificate for %v, expires %v", m.cfg.Domains, m.certs.expiry())
+	return nil
+}
+
+// register loads or creates the account key and registers the account with the CA.
+func (m *acmeManager) register() error {
+	if m.key == nil {
+		key, err := loadOrCreateKey(filepath.Join(m.cfg.CacheDir, acmeAccountFile))
+		if err != nil {
+			return err
+		}
+		m.key = key
+	}
+	if m.dir.NewOrder == "" {
+		resp, err := m.cfg.Client.Get(m.cfg.DirectoryURL)
+		if err != nil {
+			return fmt.Errorf("error fetching ACME directory %w", err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(&m.dir); err != nil {
+			return fmt.Errorf("invalid ACME directory %w", err)
+		}
+	}
+	if m.kid != "" {
+		return nil
+	}
+	acct := map[string]any{"termsOfServiceAgreed": true}
+	if m.cfg.Email != "" {
+		acct["contact"] = []string{"mailto:" + m.cfg.Email}
+	}
+	kid, err := m.post(m.dir.NewAccount, acct, nil)
+	if err != nil {
+		return fmt.Errorf("error registering ACME account %w", err)
+	}
+	m.kid = kid
+	return nil
+}
+
+// authorize completes the authorization at url with the configured challenge.
+func (m *acmeManager) authorize(url string) error {
+	authz := acmeAuthz{}
+	if _, err := m.post(url, nil, &authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	var chal *acmeChallenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == m.cfg.Challenge {
+			chal = &authz.Challenges[i]
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no %v challenge for %v", m.cfg.Challenge, authz.Identifier.Value)
+	}
+
+	keyAuth := chal.Token + "." + jwkThumbprint(&m.key.PublicKey)
+	domain := authz.Identifier.Value
+	m.lock.Lock()
+	if chal.Type == ACMEHTTP01 {
+		m.tokens[chal.Token] = keyAuth
+	} else {
+		cert, err := alpnCert(domain, keyAuth)
+		if err != nil {
+			m.lock.Unlock()
+			return err
+		}
+		m.alpn[domain] = cert
+	}
+	m.lock.Unlock()
+	defer func() {
+		m.lock.Lock()
+		delete(m.tokens, chal.Token)
+		delete(m.alpn, domain)
+		m.lock.Unlock()
+	}()
+
+	if _, err := m.post(chal.URL, struct{}{}, nil); err != nil {
+		return fmt.Errorf("error accepting challenge %w", err)
+	}
+	for i := 0; i < acmePollAttempts; i++ {
+		time.Sleep(ACMEPollInterval)
+		if _, err := m.post(url, nil, &authz); err != nil {
+			return err
+		}
+		switch authz.Status {
+		case "valid":
+			return nil
+		case "pending", "processing":
+		default:
+			return fmt.Errorf("authorization for %v %v", authz.Identifier.Value, authz.Status)
+		}
+	}
+	return fmt.Errorf("authorization for %v timed out", authz.Identifier.Value)
+}
+
+// post sends a signed request and decodes the response into out if not nil. A nil
+// payload is a POST-as-GET. It returns the Location header.
+func (m *acmeManager) post(url string, payload, out any) (string, error) {
+	b, loc, err := m.postRaw(url, payload)
+	if err != nil {
+		return "", err
+	}
+	if out != nil {
+		if err := json.Unmarshal(b, out); err != nil {
+			return "", fmt.Errorf("invalid response from %v %w", url, err)
+		}
+	}
+	return loc, nil
+}
+
+// postRaw sends a signed request, retrying once on a stale nonce, and returns the body
+// and Location header.
+func (m *acmeManager) postRaw(url string, payload any) ([]byte, string, error) {
+	for retry := 0; ; retry++ {
+		jws, err := m.sign(url, payload)
+		if err != nil {
+			return nil, "", err
+		}
+		resp, err := m.cfg.Client.Post(url, "application/jose+json", bytes.NewReader(jws))
+		if err != nil {
+			return nil, "", err
+		}
+		b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		if err != nil {
+			return nil, "", err
+		}
+		m.nonce = resp.Header.Get("Replay-Nonce")
+		if resp.StatusCode >= 400 {
+			p := &acmeProblem{}
+			if json.Unmarshal(b, p) != nil || p.Type == "" {
+				return nil, "", fmt.Errorf("%v from %v", resp.Status, url)
+			}
+			if p.Type == "urn:ietf:params:acme:error:badNonce" && retry == 0 {
+				continue
+			}
+			return nil, "", p
+		}
+		return b, resp.Header.Get("Location"), nil
+	}
+}
+
+// sign returns the flattened JWS of payload for url, signed with the account key.
+func (m *acmeManager) sign(url string, payload any) ([]byte, error) {
+	if m.nonce == "" {
+		resp, err := m.cfg.Client.Head(m.dir.NewNonce)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching nonce %w", err)
+		}
+		resp.Body.Close()
+		m.nonce = resp.Header.Get("Replay-Nonce")
+	}
+	protected := map[string]any{"alg": "ES256", "nonce": m.nonce, "url": url}
+	if m.kid != "" {
+		protected["kid"] = m.kid
+	} else {
+		protected["jwk"] = jwk(&m.key.PublicKey)
+	}
+	m.nonce = ""
+
+	p64 := ""
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		p64 = b64(b)
+	}
+	h, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	h64 := b64(h)
+	sum := sha256.Sum256([]byte(h64 + "." + p64))
+	sr, ss, err := ecdsa.Sign(rand.Reader, m.key, sum[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	sr.FillBytes(sig[:32])
+	ss.FillBytes(sig[32:])
+	return json.Marshal(map[string]string{"protected": h64, "payload": p64, "signature": b64(sig)})
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// jwk returns the JSON web key of a P-256 public key.
+func jwk(pub *ecdsa.PublicKey) map[string]string {
+	x, y := make([]byte, 32), make([]byte, 32)
+	pub.X.FillBytes(x)
+	pub.Y.FillBytes(y)
+	return map[string]string{"crv": "P-256", "kty": "EC", "x": b64(x), "y": b64(y)}
+}
+
+// jwkThumbprint returns the RFC 7638 thumbprint of a P-256 public key.
+func jwkThumbprint(pub *ecdsa.PublicKey) string {
+	// Maps are marshalled with sorted keys as the thumbprint requires.
+	b, _ := json.Marshal(jwk(pub))
+	sum := sha256.Sum256(b)
+	return b64(sum[:])
+}
+
+// alpnCert returns the TLS-ALPN-01 challenge certificate for domain.
+func alpnCert(domain, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	ext, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: domain},
+		DNSNames:        []string{domain},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: idPeACMEIdentifier, Critical: true, Value: ext}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// loadOrCreateKey loads the EC key in file, creating it if missing.
+func loadOrCreateKey(file string) (*ecdsa.PrivateKey, error) {
+	if b, err := os.ReadFile(file); err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("invalid key in %v", file)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, fmt.Errorf("error saving account key %w", err)
+	}
+	return key, nil
+}
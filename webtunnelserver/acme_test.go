@@ -0,0 +1,232 @@
+package webtunnelserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCA is a minimal ACME CA validating HTTP-01 challenges on challengeAddr.
+type fakeCA struct {
+	*httptest.Server
+	key           *ecdsa.PrivateKey
+	challengeAddr string
+	thumbprint    string // Of the registered account key.
+	validated     bool
+	chain         []byte
+	lock          sync.Mutex
+}
+
+func newFakeCA(t *testing.T) *fakeCA {
+	ca := &fakeCA{}
+	ca.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	mux := http.NewServeMux()
+	ca.Server = httptest.NewServer(mux)
+	t.Cleanup(ca.Close)
+
+	// payload decodes the JWS of a request, returning its protected header and payload.
+	payload := func(rcv *http.Request) (map[string]any, []byte) {
+		jws := map[string]string{}
+		json.NewDecoder(rcv.Body).Decode(&jws)
+		h, _ := base64.RawURLEncoding.DecodeString(jws["protected"])
+		p, _ := base64.RawURLEncoding.DecodeString(jws["payload"])
+		protected := map[string]any{}
+		json.Unmarshal(h, &protected)
+		return protected, p
+	}
+	reply := func(w http.ResponseWriter, v any) {
+		w.Header().Set("Replay-Nonce", fmt.Sprint(time.Now().UnixNano()))
+		json.NewEncoder(w).Encode(v)
+	}
+	order := func() map[string]any {
+		ca.lock.Lock()
+		defer ca.lock.Unlock()
+		o := map[string]any{"status": "pending", "authorizations": []string{ca.URL + "/authz"}, "finalize": ca.URL + "/finalize"}
+		if ca.chain != nil {
+			o["status"], o["certificate"] = "valid", ca.URL+"/cert"
+		}
+		return o
+	}
+
+	mux.HandleFunc("/dir", func(w http.ResponseWriter, rcv *http.Request) {
+		reply(w, map[string]string{"newNonce": ca.URL + "/nonce", "newAccount": ca.URL + "/account", "newOrder": ca.URL + "/order"})
+	})
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, rcv *http.Request) { reply(w, nil) })
+	mux.HandleFunc("/account", func(w http.ResponseWriter, rcv *http.Request) {
+		protected, _ := payload(rcv)
+		key := protected["jwk"].(map[string]any)
+		x, _ := base64.RawURLEncoding.DecodeString(key["x"].(string))
+		y, _ := base64.RawURLEncoding.DecodeString(key["y"].(string))
+		ca.thumbprint = jwkThumbprint(&ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)})
+		w.Header().Set("Location", ca.URL+"/account/1")
+		reply(w, map[string]string{"status": "valid"})
+	})
+	mux.HandleFunc("/order", func(w http.ResponseWriter, rcv *http.Request) {
+		payload(rcv)
+		w.Header().Set("Location", ca.URL+"/order")
+		reply(w, order())
+	})
+	mux.HandleFunc("/authz", func(w http.ResponseWriter, rcv *http.Request) {
+		payload(rcv)
+		status := "pending"
+		if ca.validated {
+			status = "valid"
+		}
+		reply(w, map[string]any{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": "vpn.example.com"},
+			"challenges": []map[string]string{{"type": ACMEHTTP01, "url": ca.URL + "/chal", "token": "tok"}},
+		})
+	})
+	mux.HandleFunc("/chal", func(w http.ResponseWriter, rcv *http.Request) {
+		payload(rcv)
+		resp, err := http.Get("http://" + ca.challengeAddr + acmeChallengePath + "tok")
+		if err != nil {
+			t.Errorf("challenge fetch failed: %v", err)
+			return
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		ca.validated = string(b) == "tok."+ca.thumbprint
+		reply(w, map[string]string{"status": "processing"})
+	})
+	mux.HandleFunc("/finalize", func(w http.ResponseWriter, rcv *http.Request) {
+		_, p := payload(rcv)
+		req := map[string]string{}
+		json.Unmarshal(p, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req["csr"])
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Errorf("invalid CSR: %v", err)
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}
+		cert, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, csr.PublicKey, ca.key)
+		ca.lock.Lock()
+		ca.chain = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+		ca.lock.Unlock()
+		reply(w, order())
+	})
+	mux.HandleFunc("/cert", func(w http.ResponseWriter, rcv *http.Request) {
+		payload(rcv)
+		w.Header().Set("Replay-Nonce", "n")
+		w.Write(ca.chain)
+	})
+	return ca
+}
+
+func TestACME(t *testing.T) {
+	ACMEPollInterval = time.Millisecond
+	ca := newFakeCA(t)
+	dir := t.TempDir()
+	cfg := ACMEConfig{
+		Domains:      []string{"vpn.example.com"},
+		CacheDir:     dir,
+		DirectoryURL: ca.URL + "/dir",
+		Challenge:    ACMEHTTP01,
+		HTTPAddr:     "127.0.0.1:0",
+	}
+
+	r := &WebTunnelServer{secure: true, serverIPPort: "127.0.0.1:0"}
+	if err := r.SetACME(cfg); err == nil {
+		t.Error("Expected error without accepting the terms of service")
+	}
+	cfg.AcceptTOS = true
+	if err := r.SetACME(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.listener.Close()
+	defer r.acme.listener.Close()
+	ca.challengeAddr = r.acme.listener.Addr().String()
+	go http.Serve(r.acme.listener, r.acme)
+
+	// Handshakes fail until the certificate is obtained.
+	if _, err := handshake(r.tlsConfig, "vpn.example.com", 0); err == nil {
+		t.Error("Expected handshake to fail without a certificate")
+	}
+	if !r.acme.due() {
+		t.Error("Expected certificate due")
+	}
+	if err := r.acme.obtain(); err != nil {
+		t.Fatal(err)
+	}
+	state, err := handshake(r.tlsConfig, "vpn.example.com", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := state.PeerCertificates[0].Subject.CommonName; cn != "vpn.example.com" || r.acme.due() {
+		t.Errorf("Expected issued certificate not due, got %v", cn)
+	}
+
+	// The certificate and account are cached for restarts.
+	for _, f := range []string{acmeAccountFile, "vpn.example.com.crt", "vpn.example.com.key"} {
+		if _, err := os.Stat(dir + "/" + f); err != nil {
+			t.Errorf("Expected %v cached: %v", f, err)
+		}
+	}
+	r2 := &WebTunnelServer{}
+	if err := r2.SetACME(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if r2.acme.due() {
+		t.Error("Expected cached certificate not due")
+	}
+	cfg.Domains = append(cfg.Domains, "other.example.com")
+	r2.SetACME(cfg)
+	if !r2.acme.due() {
+		t.Error("Expected cached certificate missing a domain due")
+	}
+}
+
+func TestACMETLSALPN(t *testing.T) {
+	r := &WebTunnelServer{}
+	if err := r.SetACME(ACMEConfig{Domains: []string{"vpn.example.com"}, AcceptTOS: true, CacheDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := r.buildTLSConfig(tls.Certificate{})
+	if len(cfg.NextProtos) != 1 || cfg.NextProtos[0] != acmeALPNProto {
+		t.Errorf("Expected acme-tls/1 protocol offered, got %v", cfg.NextProtos)
+	}
+	cert, err := alpnCert("vpn.example.com", "tok.thumb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.acme.alpn["vpn.example.com"] = cert
+
+	// Only the acme-tls/1 protocol gets the challenge certificate.
+	c, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "vpn.example.com", SupportedProtos: []string{acmeALPNProto}})
+	if err != nil || c != cert {
+		t.Errorf("Expected challenge certificate, got %v", err)
+	}
+	if _, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "vpn.example.com"}); err == nil {
+		t.Error("Expected no certificate before it is obtained")
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if len(leaf.Extensions) == 0 || !leaf.Extensions[len(leaf.Extensions)-1].Id.Equal(idPeACMEIdentifier) {
+		t.Error("Expected acmeIdentifier extension")
+	}
+}
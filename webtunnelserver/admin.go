@@ -0,0 +1,573 @@
+package webtunnelserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepakkamesh/webtunnel/webtunnelcommon/version"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// AdminPrefix is the path prefix of the admin REST API.
+const AdminPrefix = "/api/v1/"
+
+// Close reason sent to the connection of a session disconnected by an admin.
+const closeReasonAdmin = "disconnected by admin"
+
+// AdminAPI configures the admin REST API.
+type AdminAPI struct {
+	Addr string        // Address of a separate admin listener (eg. "127.0.0.1:8812"), empty to serve the API with the clients.
+	Auth Authenticator // Authenticates admins on every request, eg. NewTokenAuthenticator.
+}
+
+// AdminSession is a client session as listed by the admin API.
+type AdminSession struct {
+	IP         string    `json:"ip"`
+	SessionID  string    `json:"sessionid,omitempty"`
+	Username   string    `json:"username"`
+	Hostname   string    `json:"hostname"`
+	Version    string    `json:"version,omitempty"` // Client version.
+	Tags       []string  `json:"tags,omitempty"`
+	Start      time.Time `json:"start"`
+	Uptime     float64   `json:"uptime"`     // Seconds since the session started.
+	BytesIn    uint64    `json:"bytesIn"`    // Bytes received from the client.
+	BytesOut   uint64    `json:"bytesOut"`   // Bytes sent to the client.
+	PacketsIn  uint64    `json:"packetsIn"`  // Packets received from the client.
+	PacketsOut uint64    `json:"packetsOut"` // Packets sent to the client.
+}
+
+// AdminHealth is the server health as reported by the admin API.
+type AdminHealth struct {
+	Status          string    `json:"status"` // "ok", or why the server refuses new sessions.
+	Version         string    `json:"version"`
+	Uptime          float64   `json:"uptime"` // Seconds since Start.
+	Users           int       `json:"users"`
+	MaxUsers        int       `json:"maxUsers"`
+	PoolUtilization float64   `json:"poolUtilization"`
+	PoolLevel       PoolLevel `json:"poolLevel"`
+	UpstreamIP      string    `json:"upstreamIP,omitempty"`
+	CertExpiry      time.Time `json:"certExpiry,omitempty"`
+}
+
+// AdminTags changes admin tags with the admin API. Note replaces the note of a session if
+// set.
+type AdminTags struct {
+	Tags   []string `json:"tags,omitempty"`   // Current tags, in responses.
+	Add    []string `json:"add,omitempty"`    // Tags to add.
+	Remove []string `json:"remove,omitempty"` // Tags to remove.
+	Note   *string  `json:"note,omitempty"`   // Admin note of a session.
+}
+
+// AdminBan bans a source IP address or username with the admin API.
+type AdminBan struct {
+	Key      string `json:"key"`
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"` // Go duration, eg. "1h".
+}
+
+// adminAPI serves the admin REST API and counts the traffic of sessions for it.
+type adminAPI struct {
+	cfg     AdminAPI
+	server  *http.Server             // Separate admin listener, nil if served with the clients.
+	started time.Time                // Start of the server.
+	traffic map[string]*AdminSession // Traffic of the session by client IP.
+	lock    sync.Mutex               // Lock for traffic.
+}
+
+/*
+SetAdminAPI serves the admin REST API on a.Addr, or under AdminPrefix on the client
+listener if a.Addr is empty. Every request is authenticated with a.Auth. The API answers
+with JSON:
+
+	GET    /api/v1/sessions             active sessions with their traffic and uptime
+	GET    /api/v1/sessions/{id}        the session on a client IP or with a session ID
+	DELETE /api/v1/sessions/{id}        disconnect the session (see DisconnectSession)
+	GET    /api/v1/sessions/{id}/flows  the flow table of the session (see SetConnTracking)
+	GET    /api/v1/sessions/{id}/tags   the admin tags and note of the session
+	POST   /api/v1/sessions/{id}/tags   change them, eg. {"add": ["incident-1234"], "note": "..."}
+	GET    /api/v1/users/{name}/tags    the admin tags of a user
+	POST   /api/v1/users/{name}/tags    change them, eg. {"add": ["vip"], "remove": ["trial"]}
+	GET    /api/v1/allocations          the IP allocations (see DumpAllocations)
+	GET    /api/v1/health               the server health, 503 if refusing new sessions
+	GET    /api/v1/bans                 the active bans (see SetBanPolicy)
+	POST   /api/v1/bans                 ban, eg. {"key": "10.0.0.1", "reason": "abuse", "duration": "1h"}
+	DELETE /api/v1/bans/{key}           lift a ban
+	GET    /api/v1/sla?by=user          the weekly SLA summaries by user or network (see SetSLATracking)
+	GET    /api/v1/nat                  the egress NAT table (see SetNATMonitor)
+	GET    /api/v1/routes               the route overlap analysis (see RouteAnalysis)
+	GET    /api/v1/stats/top            the top talkers (see SetStatsStore)
+	GET    /api/v1/stats/user           the traffic history of a user (see SetStatsStore)
+
+This should be called prior to Start.
+*/
+func (r *WebTunnelServer) SetAdminAPI(a AdminAPI) error {
+	if a.Auth == nil {
+		return fmt.Errorf("admin API without authenticator")
+	}
+	if a.Addr != "" {
+		if _, _, err := net.SplitHostPort(a.Addr); err != nil {
+			return fmt.Errorf("invalid admin address %w", err)
+		}
+	}
+	first := r.admin == nil
+	r.admin = &adminAPI{cfg: a, traffic: make(map[string]*AdminSession)}
+	if first {
+		r.AddIPEventListener(func(ev IPEvent) { r.admin.ipEvent(ev) })
+	}
+	return nil
+}
+
+// Sessions returns the active client sessions sorted by IP. Traffic is only counted with
+// the admin API enabled.
+func (r *WebTunnelServer) Sessions() []AdminSession {
+	now := time.Now()
+	versions := r.clientVersionSnapshot()
+	var sessions []AdminSession
+	for ip, u := range r.ipam.DumpAllocations() {
+		s := AdminSession{IP: ip, Username: u.Username, Hostname: u.Hostname, Version: versions[ip], Tags: u.Tags,
+			Start: u.SessionStart, Uptime: now.Sub(u.SessionStart).Seconds()}
+		s.SessionID, _ = r.SessionID(ip)
+		r.admin.addTraffic(&s)
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(sessions[i].IP).To4(), net.ParseIP(sessions[j].IP).To4()) < 0
+	})
+	return sessions
+}
+
+// DisconnectSession closes the session on ip, telling the client reason. Its IP is
+// released once the connection is closed; the client may reconnect unless banned (see
+// Ban).
+func (r *WebTunnelServer) DisconnectSession(ip, reason string) error {
+	r.connMapLock.Lock()
+	ws, ok := r.conns[ip]
+	r.connMapLock.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: no connection for %v", ErrIPNotAllocated, ip)
+	}
+	if reason == "" {
+		reason = closeReasonAdmin
+	}
+	glog.Warningf("Session %v on %v disconnected: %v", r.sessionID(ip), ip, reason)
+	r.sendDisconnect(ws, ip, reason)
+	ws.WriteControlMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, withSessionID(reason, r.sessionID(ip))))
+	ws.Conn().Close()
+	return nil
+}
+
+// startAdmin records the start of the server and serves the admin API on its listener.
+func (r *WebTunnelServer) startAdmin() {
+	if r.admin == nil {
+		return
+	}
+	r.admin.started = time.Now()
+	if r.admin.cfg.Addr == "" {
+		return
+	}
+	r.admin.server = &http.Server{Addr: r.admin.cfg.Addr, Handler: r.adminHandler()}
+	go func(srv *http.Server) {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			r.Error <- fmt.Errorf("admin API listener failed %w", err)
+		}
+	}(r.admin.server)
+}
+
+// stopAdmin shuts the admin listener down.
+func (r *WebTunnelServer) stopAdmin(ctx context.Context) {
+	if r.admin == nil || r.admin.server == nil {
+		return
+	}
+	if err := r.admin.server.Shutdown(ctx); err != nil {
+		glog.Warningf("error shutting down admin API: %v", err)
+	}
+}
+
+// ipEvent starts counting the traffic of sessions as client IPs are assigned.
+func (a *adminAPI) ipEvent(ev IPEvent) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	switch ev.Type {
+	case IPAssigned:
+		a.traffic[ev.IP] = &AdminSession{}
+	case IPReleased:
+		delete(a.traffic, ev.IP)
+	}
+}
+
+// count adds a packet of n bytes to the session of ip.
+func (a *adminAPI) count(ip string, dir Direction, n int) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	t, ok := a.traffic[ip]
+	if !ok {
+		return
+	}
+	if dir == FromClient {
+		t.BytesIn += uint64(n)
+		t.PacketsIn++
+	} else {
+		t.BytesOut += uint64(n)
+		t.PacketsOut++
+	}
+}
+
+// addTraffic sets the traffic counters of s.
+func (a *adminAPI) addTraffic(s *AdminSession) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if t, ok := a.traffic[s.IP]; ok {
+		s.BytesIn, s.BytesOut, s.PacketsIn, s.PacketsOut = t.BytesIn, t.BytesOut, t.PacketsIn, t.PacketsOut
+	}
+}
+
+// health returns the server health.
+func (r *WebTunnelServer) health() AdminHealth {
+	m := r.GetMetrics()
+	h := AdminHealth{
+		Status:          "ok",
+		Version:         version.Version,
+		Users:           m.Users,
+		MaxUsers:        m.MaxUsers,
+		PoolUtilization: m.PoolUtilization,
+		PoolLevel:       m.PoolLevel,
+		UpstreamIP:      m.UpstreamIP,
+		CertExpiry:      m.CertExpiry,
+	}
+	if r.admin != nil && !r.admin.started.IsZero() {
+		h.Uptime = time.Since(r.admin.started).Seconds()
+	}
+	switch {
+	case r.isStopped.Load():
+		h.Status = "stopped"
+	case m.Users >= m.MaxUsers:
+		h.Status = "max users reached"
+	case r.ipam.RejectSessions():
+		h.Status = "IP pool critical"
+	default:
+		if reason := r.overloadReason(); reason != "" {
+			h.Status = "overloaded: " + reason
+		}
+	}
+	return h
+}
+
+// adminHandler returns the handler of the admin API.
+func (r *WebTunnelServer) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(AdminPrefix+"sessions", r.adminSessionsEndpoint)
+	mux.HandleFunc(AdminPrefix+"sessions/", r.adminSessionEndpoint)
+	mux.HandleFunc(AdminPrefix+"allocations", r.adminAllocationsEndpoint)
+	mux.HandleFunc(AdminPrefix+"health", r.adminHealthEndpoint)
+	mux.HandleFunc(AdminPrefix+"users/", r.adminUserTagsEndpoint)
+	mux.HandleFunc(AdminPrefix+"bans", r.adminBansEndpoint)
+	mux.HandleFunc(AdminPrefix+"bans/", r.adminBansEndpoint)
+	mux.HandleFunc(AdminPrefix+"sla", r.adminSLAEndpoint)
+	mux.HandleFunc(AdminPrefix+"nat", r.adminNATEndpoint)
+	mux.HandleFunc(AdminPrefix+"routes", r.adminRoutesEndpoint)
+	if r.stats != nil {
+		mux.HandleFunc(AdminPrefix+"stats/top", r.statsTopEndpoint)
+		mux.HandleFunc(AdminPrefix+"stats/user", r.statsUserEndpoint)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, rcv *http.Request) {
+		admin, err := r.admin.cfg.Auth.Authenticate(rcv)
+		if err != nil {
+			glog.Warningf("admin API request %v %v from %v refused: %v", rcv.Method, rcv.URL.Path, rcv.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="webtunnel admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		glog.V(1).Infof("admin API request %v %v by %q", rcv.Method, rcv.URL.Path, admin)
+		mux.ServeHTTP(w, rcv)
+	})
+}
+
+// adminSessionsEndpoint lists the active sessions.
+func (r *WebTunnelServer) adminSessionsEndpoint(w http.ResponseWriter, rcv *http.Request) {
+	if !allowMethods(w, rcv, http.MethodGet) {
+		return
+	}
+	sessions := r.Sessions()
+	if sessions == nil {
+		sessions = []AdminSession{}
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// adminSessionEndpoint shows or disconnects the session on a client IP or with a session
+// ID, or serves one of its resources.
+func (r *WebTunnelServer) adminSessionEndpoint(w http.ResponseWriter, rcv *http.Request) {
+	id, resource, _ := strings.Cut(strings.TrimPrefix(rcv.URL.Path, AdminPrefix+"sessions/"), "/")
+	methods := []string{http.MethodGet, http.MethodDelete}
+	switch resource {
+	case "":
+	case "tags":
+		methods = []string{http.MethodGet, http.MethodPost}
+	default:
+		methods = []string{http.MethodGet}
+	}
+	if !allowMethods(w, rcv, methods...) {
+		return
+	}
+	ip := id
+	if net.ParseIP(id) == nil {
+		var ok bool
+		if ip, ok = r.FindSessionID(id); !ok {
+			http.Error(w, fmt.Sprintf("no session %q", id), http.StatusNotFound)
+			return
+		}
+	}
+	var session *AdminSession
+	for _, s := range r.Sessions() {
+		if s.IP == ip {
+			session = &s
+			break
+		}
+	}
+	if session == nil {
+		http.Error(w, fmt.Sprintf("no session on %q", ip), http.StatusNotFound)
+		return
+	}
+	switch resource {
+	case "":
+	case "flows":
+		if r.connTrack == nil {
+			http.Error(w, "connection tracking disabled", http.StatusNotFound)
+			return
+		}
+		flows := r.Flows(ip)
+		if flows == nil {
+			flows = []Flow{}
+		}
+		writeJSON(w, http.StatusOK, flows)
+		return
+	case "tags":
+		r.adminSessionTags(w, rcv, ip)
+		return
+	default:
+		http.NotFound(w, rcv)
+		return
+	}
+	if rcv.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, session)
+		return
+	}
+	if err := r.DisconnectSession(ip, rcv.URL.Query().Get("reason")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminSessionTags shows or changes the admin tags and note of the session on ip.
+func (r *WebTunnelServer) adminSessionTags(w http.ResponseWriter, rcv *http.Request, ip string) {
+	if rcv.Method == http.MethodPost {
+		var req AdminTags
+		if !readJSON(w, rcv, &req) {
+			return
+		}
+		if err := r.TagSession(ip, req.Add...); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := r.UntagSession(ip, req.Remove...); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Note != nil {
+			if err := r.SetSessionNote(ip, *req.Note); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	tags, note, err := r.SessionTags(ip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, AdminTags{Tags: tags, Note: &note})
+}
+
+// adminUserTagsEndpoint shows or changes the admin tags of a user.
+func (r *WebTunnelServer) adminUserTagsEndpoint(w http.ResponseWriter, rcv *http.Request) {
+	name, resource, _ := strings.Cut(strings.TrimPrefix(rcv.URL.Path, AdminPrefix+"users/"), "/")
+	if name == "" || resource != "tags" {
+		http.NotFound(w, rcv)
+		return
+	}
+	if !allowMethods(w, rcv, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if rcv.Method == http.MethodPost {
+		var req AdminTags
+		if !readJSON(w, rcv, &req) {
+			return
+		}
+		r.TagUser(name, req.Add...)
+		r.UntagUser(name, req.Remove...)
+	}
+	writeJSON(w, http.StatusOK, AdminTags{Tags: r.UserTags(name)})
+}
+
+// adminBansEndpoint lists, adds and lifts bans.
+func (r *WebTunnelServer) adminBansEndpoint(w http.ResponseWriter, rcv *http.Request) {
+	key := strings.TrimPrefix(strings.TrimPrefix(rcv.URL.Path, AdminPrefix+"bans"), "/")
+	methods := []string{http.MethodGet, http.MethodPost}
+	if key != "" {
+		methods = []string{http.MethodDelete}
+	}
+	if !allowMethods(w, rcv, methods...) {
+		return
+	}
+	if r.bans == nil {
+		http.Error(w, "ban list not enabled", http.StatusNotFound)
+		return
+	}
+	switch rcv.Method {
+	case http.MethodPost:
+		var req AdminBan
+		if !readJSON(w, rcv, &req) {
+			return
+		}
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid duration %q", req.Duration), http.StatusBadRequest)
+			return
+		}
+		if err := r.Ban(req.Key, req.Reason, d); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := r.Unban(key); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		bans := r.Bans()
+		if bans == nil {
+			bans = []Ban{}
+		}
+		writeJSON(w, http.StatusOK, bans)
+	}
+}
+
+// adminSLAEndpoint reports the weekly SLA summaries.
+func (r *WebTunnelServer) adminSLAEndpoint(w http.ResponseWriter, rcv *http.Request) {
+	if !allowMethods(w, rcv, http.MethodGet) {
+		return
+	}
+	if r.sla == nil {
+		http.Error(w, "SLA tracking not enabled", http.StatusNotFound)
+		return
+	}
+	by := SLAGrouping(rcv.URL.Query().Get("by"))
+	if by == "" {
+		by = SLAByUser
+	}
+	report, err := r.SLAReport(by)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if report == nil {
+		report = []SLASummary{}
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// adminNATEndpoint serves the last egress NAT table snapshot.
+func (r *WebTunnelServer) adminNATEndpoint(w http.ResponseWriter, rcv *http.Request) {
+	if !allowMethods(w, rcv, http.MethodGet) {
+		return
+	}
+	if r.nat == nil {
+		http.Error(w, "NAT monitoring not enabled", http.StatusNotFound)
+		return
+	}
+	table := r.NATTable()
+	if table == nil {
+		http.Error(w, "no NAT table sample yet", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, table)
+}
+
+// adminRoutesEndpoint serves the route overlap analysis.
+func (r *WebTunnelServer) adminRoutesEndpoint(w http.ResponseWriter, rcv *http.Request) {
+	if !allowMethods(w, rcv, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, r.RouteAnalysis())
+}
+
+// adminAllocationsEndpoint dumps the IP allocations.
+func (r *WebTunnelServer) adminAllocationsEndpoint(w http.ResponseWriter, rcv *http.Request) {
+	if !allowMethods(w, rcv, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, r.DumpAllocations())
+}
+
+// adminHealthEndpoint reports the server health.
+func (r *WebTunnelServer) adminHealthEndpoint(w http.ResponseWriter, rcv *http.Request) {
+	if !allowMethods(w, rcv, http.MethodGet) {
+		return
+	}
+	h := r.health()
+	code := http.StatusOK
+	if h.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, h)
+}
+
+// allowMethods answers 405 and returns false if the method of rcv is not one of methods.
+func allowMethods(w http.ResponseWriter, rcv *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if rcv.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// readJSON decodes the JSON body of rcv into v. It answers 400 and returns false if the
+// body is invalid.
+func readJSON(w http.ResponseWriter, rcv *http.Request, v any) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, rcv.Body, 1<<16)).Decode(v); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// writeJSON writes v as JSON with status code.
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.V(1).Infof("error writing JSON response: %v", err)
+	}
+}
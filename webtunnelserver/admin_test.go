@@ -0,0 +1,215 @@
+package webtunnelserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/gorilla/websocket"
+)
+
+func TestAdminAPI(t *testing.T) {
+	r, err := NewWebTunnelServer("127.0.0.1:0", "192.168.0.1", "255.255.255.0", "192.168.0.0/24",
+		nil, []string{"1.1.1.0/24"}, false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetAdminAPI(AdminAPI{}); err == nil {
+		t.Error("Expected admin API without authenticator refused")
+	}
+	auth := NewTokenAuthenticator(TokenVerifier(func(token string) (string, error) {
+		if token != "secret" {
+			return "", fmt.Errorf("invalid token")
+		}
+		return "ops", nil
+	}))
+	if err := r.SetAdminAPI(AdminAPI{Auth: auth}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetCustomHandler(AdminPrefix+"health", http.NotFoundHandler()); err == nil {
+		t.Error("Expected admin API handler override refused")
+	}
+	r.startAdmin()
+	srv := httptest.NewServer(http.HandlerFunc(r.wsEndpoint))
+	defer srv.Close()
+
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.WriteMessage(websocket.TextMessage, []byte("getConfig alice laptop")); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &wc.ClientConfig{}
+	if err := c.ReadJSON(cfg); err != nil {
+		t.Fatal(err)
+	}
+	r.admin.count(cfg.IP, FromClient, 100)
+	r.admin.count(cfg.IP, ToClient, 1000)
+
+	h := r.adminHandler()
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		rcv := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			rcv.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, rcv)
+		return rec
+	}
+	if rec := do(http.MethodGet, AdminPrefix+"sessions", "forged"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected unauthorized, got %v", rec.Code)
+	}
+
+	var sessions []AdminSession
+	if err := json.NewDecoder(do(http.MethodGet, AdminPrefix+"sessions", "secret").Body).Decode(&sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].IP != cfg.IP || sessions[0].Username != "alice" ||
+		sessions[0].BytesIn != 100 || sessions[0].BytesOut != 1000 || sessions[0].SessionID == "" {
+		t.Fatalf("Unexpected sessions %+v", sessions)
+	}
+	var session AdminSession
+	if err := json.NewDecoder(do(http.MethodGet, AdminPrefix+"sessions/"+sessions[0].SessionID, "secret").Body).Decode(&session); err != nil || session.IP != cfg.IP {
+		t.Errorf("Unexpected session by ID %+v %v", session, err)
+	}
+	var allocations map[string]*UserInfo
+	if err := json.NewDecoder(do(http.MethodGet, AdminPrefix+"allocations", "secret").Body).Decode(&allocations); err != nil || allocations[cfg.IP] == nil {
+		t.Errorf("Unexpected allocations %v %v", allocations, err)
+	}
+	var health AdminHealth
+	rec := do(http.MethodGet, AdminPrefix+"health", "secret")
+	if err := json.NewDecoder(rec.Body).Decode(&health); err != nil || rec.Code != http.StatusOK || health.Status != "ok" ||
+		health.Users != 1 {
+		t.Errorf("Unexpected health %v %+v %v", rec.Code, health, err)
+	}
+	r.SetConnTracking(0)
+	r.trackPacket(cfg.IP, FromClient, createTCPPkt(net.ParseIP(cfg.IP).To4(), net.IP{172, 16, 0, 1}, 40000, 80, false))
+	var flows []Flow
+	if err := json.NewDecoder(do(http.MethodGet, AdminPrefix+"sessions/"+cfg.IP+"/flows", "secret").Body).Decode(&flows); err != nil ||
+		len(flows) != 1 || flows[0].Key.DstPort != 80 {
+		t.Errorf("Unexpected flows %+v %v", flows, err)
+	}
+	if rec := do(http.MethodDelete, AdminPrefix+"sessions/"+cfg.IP+"/flows", "secret"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected method not allowed on flows, got %v", rec.Code)
+	}
+	for path, code := range map[string]int{
+		AdminPrefix + "sessions/" + cfg.IP + "/unknown": http.StatusNotFound,
+		AdminPrefix + "sessions/192.168.0.99":           http.StatusNotFound,
+		AdminPrefix + "sessions/unknown":                http.StatusNotFound,
+		AdminPrefix + "unknown":                         http.StatusNotFound,
+	} {
+		if rec := do(http.MethodGet, path, "secret"); rec.Code != code {
+			t.Errorf("Expected %v for %v, got %v", code, path, rec.Code)
+		}
+	}
+	if rec := do(http.MethodPost, AdminPrefix+"health", "secret"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected method not allowed, got %v", rec.Code)
+	}
+
+	// Disconnected sessions are closed and their IP released.
+	if rec := do(http.MethodDelete, AdminPrefix+"sessions/"+cfg.IP+"?reason=maintenance", "secret"); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected session disconnected, got %v", rec.Code)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := c.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !strings.Contains(err.Error(), "maintenance") {
+			t.Errorf("Expected disconnect reason, got %v", err)
+		}
+		break
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.Sessions()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := r.Sessions(); len(s) != 0 {
+		t.Errorf("Expected no session after disconnect, got %+v", s)
+	}
+	if err := r.DisconnectSession(cfg.IP, ""); err == nil {
+		t.Error("Expected disconnect of closed session refused")
+	}
+}
+
+func TestAdminAPIResources(t *testing.T) {
+	r, err := NewWebTunnelServer("127.0.0.1:0", "192.168.0.1", "255.255.255.0", "192.168.0.0/24",
+		nil, []string{"1.1.1.0/24"}, false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetAdminAPI(AdminAPI{Auth: NewTokenAuthenticator(TokenVerifier(func(string) (string, error) { return "ops", nil }))}); err != nil {
+		t.Fatal(err)
+	}
+	h := r.adminHandler()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rcv := httptest.NewRequest(method, path, strings.NewReader(body))
+		rcv.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, rcv)
+		return rec
+	}
+
+	// Features not enabled are not found.
+	for _, path := range []string{"bans", "sla", "nat"} {
+		if rec := do(http.MethodGet, AdminPrefix+path, ""); rec.Code != http.StatusNotFound {
+			t.Errorf("Expected %v not found while disabled, got %v", path, rec.Code)
+		}
+	}
+	if err := r.SetBanPolicy(BanPolicy{Strikes: 3, Window: time.Minute, Cooldown: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	r.SetSLATracking()
+
+	if rec := do(http.MethodPost, AdminPrefix+"bans", `{"key": "10.0.0.1", "reason": "abuse", "duration": "1h"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected ban added, got %v %v", rec.Code, rec.Body)
+	}
+	var bans []Ban
+	if err := json.NewDecoder(do(http.MethodGet, AdminPrefix+"bans", "").Body).Decode(&bans); err != nil ||
+		len(bans) != 1 || bans[0].Key != "10.0.0.1" || bans[0].Reason != "abuse" {
+		t.Errorf("Unexpected bans %+v %v", bans, err)
+	}
+	if rec := do(http.MethodPost, AdminPrefix+"bans", `{"key": "10.0.0.2", "duration": "forever"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected invalid ban refused, got %v", rec.Code)
+	}
+	if rec := do(http.MethodDelete, AdminPrefix+"bans/10.0.0.1", ""); rec.Code != http.StatusNoContent || r.isBanned("10.0.0.1") {
+		t.Errorf("Expected ban lifted, got %v", rec.Code)
+	}
+	if rec := do(http.MethodDelete, AdminPrefix+"bans/10.0.0.1", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected unknown ban not found, got %v", rec.Code)
+	}
+
+	var tags AdminTags
+	if err := json.NewDecoder(do(http.MethodPost, AdminPrefix+"users/alice/tags", `{"add": ["vip", "trial"], "remove": ["trial"]}`).Body).Decode(&tags); err != nil ||
+		len(tags.Tags) != 1 || tags.Tags[0] != "vip" {
+		t.Errorf("Unexpected user tags %+v %v", tags, err)
+	}
+	ip, _ := r.ipam.AcquireIP(nil)
+	r.ipam.SetIPActiveWithUserInfo(ip, "alice", "laptop")
+	tags = AdminTags{}
+	if err := json.NewDecoder(do(http.MethodPost, AdminPrefix+"sessions/"+ip+"/tags", `{"add": ["incident-1"], "note": "slow"}`).Body).Decode(&tags); err != nil ||
+		tags.Note == nil || *tags.Note != "slow" || len(tags.Tags) != 2 {
+		t.Errorf("Unexpected session tags %+v %v", tags, err)
+	}
+
+	var sla []SLASummary
+	if err := json.NewDecoder(do(http.MethodGet, AdminPrefix+"sla?by=network", "").Body).Decode(&sla); err != nil {
+		t.Errorf("Unexpected SLA report %v", err)
+	}
+	if rec := do(http.MethodGet, AdminPrefix+"sla?by=host", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected invalid SLA grouping refused, got %v", rec.Code)
+	}
+	var routes RouteAnalysis
+	if err := json.NewDecoder(do(http.MethodGet, AdminPrefix+"routes", "").Body).Decode(&routes); err != nil || routes.ClientNet != "192.168.0.0/24" {
+		t.Errorf("Unexpected route analysis %+v %v", routes, err)
+	}
+}
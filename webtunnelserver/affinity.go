@@ -0,0 +1,32 @@
+package webtunnelserver
+
+import (
+	"net/http"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+)
+
+// SetInstanceID sets the ID of this gateway instance used as the load balancer affinity
+// token. It defaults to the hostname. This should be called prior to Start.
+func (r *WebTunnelServer) SetInstanceID(id string) {
+	r.instanceID = id
+}
+
+// affinityHeader returns the response header setting the affinity cookie so L7 load
+// balancers can pin reconnects to this instance. A client presenting the token of
+// another instance has landed on the wrong gateway and is logged.
+func (r *WebTunnelServer) affinityHeader(rcv *http.Request) http.Header {
+	token := rcv.URL.Query().Get(wc.AffinityParam)
+	if c, err := rcv.Cookie(wc.AffinityCookie); err == nil {
+		token = c.Value
+	}
+	if token != "" && token != r.instanceID {
+		glog.Warningf("client %v expected instance %v, landed on %v", rcv.RemoteAddr, token, r.instanceID)
+	}
+
+	h := http.Header{}
+	cookie := &http.Cookie{Name: wc.AffinityCookie, Value: r.instanceID, Path: "/", HttpOnly: true}
+	h.Add("Set-Cookie", cookie.String())
+	return h
+}
@@ -0,0 +1,319 @@
+package webtunnelserver
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Close reason sent to an agent session whose lease expired.
+const closeReasonAgentLease = "agent session lease expired"
+
+// Longest agent session if the policy sets none.
+const defaultAgentLease = time.Hour
+
+// IP protocol numbers of the agent grants.
+const (
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+)
+
+// AgentClaims are the claims of an automation agent token, eg. of a CI runner.
+type AgentClaims struct {
+	Subject string        // Username of the agent session.
+	Allow   []string      // Destinations the agent may reach (eg. "10.1.2.3:443", "udp/10.1.0.0/24:53", "10.1.2.4:*").
+	Lease   time.Duration // Duration of the session, AgentPolicy.MaxLease if 0 or longer.
+}
+
+// AgentValidator validates the bearer token of a handshake and returns its agent claims,
+// nil if the token is not an agent token.
+type AgentValidator interface {
+	ValidateAgentToken(token string) (*AgentClaims, error)
+}
+
+// AgentTokenVerifier adapts a function to an AgentValidator.
+type AgentTokenVerifier func(token string) (*AgentClaims, error)
+
+// ValidateAgentToken calls f(token).
+func (f AgentTokenVerifier) ValidateAgentToken(token string) (*AgentClaims, error) {
+	return f(token)
+}
+
+// AgentPolicy configures restricted sessions for headless automation agents.
+type AgentPolicy struct {
+	Validator AgentValidator // Recognizes agent tokens and returns their claims.
+	MaxLease  time.Duration  // Longest agent session, defaultAgentLease if 0.
+}
+
+// agentGrant is a destination an agent session may reach.
+type agentGrant struct {
+	proto  uint8      // IP protocol, 0 for TCP and UDP or any protocol if all ports.
+	ipnet  *net.IPNet // Destination address or prefix.
+	lo, hi uint16     // Destination port range.
+	all    bool       // Any port, and any protocol if proto is 0.
+}
+
+// agentSession is the restriction of an agent session.
+type agentSession struct {
+	ip      string       // Client IP, updated as the session moves.
+	subject string       // Username of the agent.
+	grants  []agentGrant // Destinations the agent may reach.
+	routes  []string     // Route prefixes advertised to the agent.
+	lease   time.Duration
+	timer   *time.Timer // Closes the session at the end of its lease.
+}
+
+// agentPolicy holds the restricted sessions of agents.
+type agentPolicy struct {
+	policy   AgentPolicy
+	sessions map[string]*agentSession // Agent sessions by client IP.
+	lock     sync.Mutex
+}
+
+// agentKey is the context key of the restriction of an agent connection.
+type agentKey struct{}
+
+/*
+SetAgentPolicy enables restricted sessions for automation agents, eg. CI runners that
+need one internal service rather than full VPN access. Bearer tokens of handshakes are
+passed to p.Validator first; agent tokens authenticate the session as their subject and
+restrict it to their claims:
+
+  - packets from the agent are only forwarded to the destinations in Allow, and packets
+    to it only from them; others are dropped and counted in Metrics.AgentDenied.
+  - only the allowed destinations are advertised as routes, and no DNS servers or DNS
+    routes are pushed.
+  - the session is closed after its lease, at most p.MaxLease.
+
+Other tokens are passed to the authenticator (see SetAuthenticator). This should be
+called prior to Start.
+*/
+func (r *WebTunnelServer) SetAgentPolicy(p AgentPolicy) error {
+	if p.Validator == nil {
+		return fmt.Errorf("agent policy without validator")
+	}
+	if p.MaxLease < 0 {
+		return fmt.Errorf("invalid agent lease %v", p.MaxLease)
+	}
+	if p.MaxLease == 0 {
+		p.MaxLease = defaultAgentLease
+	}
+	r.agents = &agentPolicy{policy: p, sessions: make(map[string]*agentSession)}
+	return nil
+}
+
+// authenticateAgent returns ctx with the restriction of the agent token of rcv, if any.
+// ok is false if rcv carries no agent token.
+func (r *WebTunnelServer) authenticateAgent(ctx context.Context, rcv *http.Request) (context.Context, bool, error) {
+	if r.agents == nil {
+		return ctx, false, nil
+	}
+	token, err := bearerToken(rcv)
+	if err != nil {
+		return ctx, false, nil
+	}
+	claims, err := r.agents.policy.Validator.ValidateAgentToken(token)
+	if err != nil || claims == nil {
+		return ctx, false, err
+	}
+	s, err := r.agents.compile(claims)
+	if err != nil {
+		return ctx, false, fmt.Errorf("invalid claims of agent %v: %w", claims.Subject, err)
+	}
+	ctx = context.WithValue(ctx, authUserKey{}, claims.Subject)
+	return context.WithValue(ctx, agentKey{}, s), true, nil
+}
+
+// compile returns the session restriction of claims.
+func (a *agentPolicy) compile(claims *AgentClaims) (*agentSession, error) {
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("no subject")
+	}
+	if len(claims.Allow) == 0 {
+		return nil, fmt.Errorf("no allowed destination")
+	}
+	s := &agentSession{subject: claims.Subject, lease: claims.Lease}
+	if s.lease <= 0 || s.lease > a.policy.MaxLease {
+		s.lease = a.policy.MaxLease
+	}
+	seen := map[string]bool{}
+	for _, allow := range claims.Allow {
+		g, err := parseAgentGrant(allow)
+		if err != nil {
+			return nil, err
+		}
+		s.grants = append(s.grants, g)
+		if route := g.ipnet.String(); !seen[route] {
+			seen[route] = true
+			s.routes = append(s.routes, route)
+		}
+	}
+	return s, nil
+}
+
+// parseAgentGrant parses an allowed destination of the form [tcp/|udp/]IP[/bits]:port,
+// where port is a number, a range (eg. 8000-8099) or * for any port and protocol.
+func parseAgentGrant(s string) (agentGrant, error) {
+	var g agentGrant
+	dest := s
+	switch {
+	case strings.HasPrefix(dest, "tcp/"):
+		g.proto, dest = ipProtoTCP, dest[len("tcp/"):]
+	case strings.HasPrefix(dest, "udp/"):
+		g.proto, dest = ipProtoUDP, dest[len("udp/"):]
+	}
+	i := strings.LastIndexByte(dest, ':')
+	if i < 0 {
+		return g, fmt.Errorf("no port in destination %q", s)
+	}
+	host, port := dest[:i], dest[i+1:]
+	if !strings.Contains(host, "/") {
+		host += "/32"
+	}
+	ip, ipnet, err := net.ParseCIDR(host)
+	if err != nil || ip.To4() == nil {
+		return g, fmt.Errorf("invalid address in destination %q", s)
+	}
+	g.ipnet = ipnet
+	if port == "*" {
+		g.all, g.hi = true, 65535
+		return g, nil
+	}
+	lo, hi, found := strings.Cut(port, "-")
+	if !found {
+		hi = lo
+	}
+	l, err1 := strconv.ParseUint(lo, 10, 16)
+	h, err2 := strconv.ParseUint(hi, 10, 16)
+	if err1 != nil || err2 != nil || l == 0 || l > h {
+		return g, fmt.Errorf("invalid port in destination %q", s)
+	}
+	g.lo, g.hi = uint16(l), uint16(h)
+	return g, nil
+}
+
+// agentRestriction returns the restriction of the agent connection of ctx, nil if none.
+func agentRestriction(ctx context.Context) *agentSession {
+	s, _ := ctx.Value(agentKey{}).(*agentSession)
+	return s
+}
+
+// startAgentSession restricts the session on ip to s and closes it at the end of its
+// lease.
+func (r *WebTunnelServer) startAgentSession(ip string, s *agentSession) {
+	a := r.agents
+	// A restriction belongs to one session; reconnects of the agent start another.
+	s = &agentSession{ip: ip, subject: s.subject, grants: s.grants, routes: s.routes, lease: s.lease}
+	a.lock.Lock()
+	if old, ok := a.sessions[ip]; ok {
+		old.timer.Stop()
+	}
+	a.sessions[ip] = s
+	s.timer = time.AfterFunc(s.lease, func() { r.expireAgentSession(s) })
+	a.lock.Unlock()
+	glog.Infof("Agent %v on %v restricted to %v for %v", s.subject, ip, s.routes, s.lease)
+}
+
+// expireAgentSession closes the agent session s at the end of its lease.
+func (r *WebTunnelServer) expireAgentSession(s *agentSession) {
+	a := r.agents
+	a.lock.Lock()
+	ip := s.ip
+	current := a.sessions[ip] == s
+	a.lock.Unlock()
+	if !current {
+		return
+	}
+	if err := r.DisconnectSession(ip, closeReasonAgentLease); err != nil {
+		glog.V(1).Infof("agent session on %v not closed: %v", ip, err)
+	}
+}
+
+// agentSession returns the restriction of the agent session on ip, nil if none.
+func (r *WebTunnelServer) agentSession(ip string) *agentSession {
+	a := r.agents
+	if a == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.sessions[ip]
+}
+
+// agentAllows returns false if the packet to or from the agent session on ip is not to or
+// from one of its allowed destinations.
+func (r *WebTunnelServer) agentAllows(ip string, dir Direction, pkt []byte) bool {
+	s := r.agentSession(ip)
+	if s == nil {
+		return true
+	}
+	// Packets are validated IPv4 packets.
+	hdrLen := int(pkt[0]&0x0f) * 4
+	proto := pkt[9]
+	peer := net.IP(pkt[16:20])
+	portOffset := 2 // Destination port from the agent.
+	if dir == ToClient {
+		peer = net.IP(pkt[12:16])
+		portOffset = 0 // Source port to the agent.
+	}
+	// Only the first fragment carries the ports.
+	first := binary.BigEndian.Uint16(pkt[6:8])&ipv4FragOffset == 0
+	ported := (proto == ipProtoTCP || proto == ipProtoUDP) && len(pkt) >= hdrLen+4
+	var port uint16
+	if ported && first {
+		port = binary.BigEndian.Uint16(pkt[hdrLen+portOffset:])
+	}
+	for _, g := range s.grants {
+		if !g.ipnet.Contains(peer) {
+			continue
+		}
+		if g.proto != 0 && g.proto != proto {
+			continue
+		}
+		if g.all || (ported && (!first || port >= g.lo && port <= g.hi)) {
+			return true
+		}
+	}
+	r.metricsLock.Lock()
+	r.metrics.AgentDenied++
+	r.metricsLock.Unlock()
+	glog.V(2).Infof("dropping packet of agent %v on %v to or from %v", s.subject, ip, peer)
+	return false
+}
+
+// moveAgentSession moves the restriction of the agent session on oldIP to newIP.
+func (r *WebTunnelServer) moveAgentSession(oldIP, newIP string) {
+	a := r.agents
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if s, ok := a.sessions[oldIP]; ok {
+		s.ip = newIP
+		a.sessions[newIP] = s
+		delete(a.sessions, oldIP)
+	}
+}
+
+// releaseAgentSession lifts the restriction of a disconnected agent session.
+func (r *WebTunnelServer) releaseAgentSession(ip string) {
+	a := r.agents
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if s, ok := a.sessions[ip]; ok {
+		s.timer.Stop()
+		delete(a.sessions, ip)
+	}
+}
@@ -0,0 +1,170 @@
+package webtunnelserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/gorilla/websocket"
+)
+
+func TestParseAgentGrant(t *testing.T) {
+	for s, want := range map[string]agentGrant{
+		"10.1.2.3:443":       {ipnet: &net.IPNet{IP: net.IP{10, 1, 2, 3}, Mask: net.CIDRMask(32, 32)}, lo: 443, hi: 443},
+		"udp/10.1.0.0/24:53": {proto: ipProtoUDP, ipnet: &net.IPNet{IP: net.IP{10, 1, 0, 0}, Mask: net.CIDRMask(24, 32)}, lo: 53, hi: 53},
+		"tcp/10.1.2.3:80-90": {proto: ipProtoTCP, ipnet: &net.IPNet{IP: net.IP{10, 1, 2, 3}, Mask: net.CIDRMask(32, 32)}, lo: 80, hi: 90},
+		"10.1.2.0/30:*":      {ipnet: &net.IPNet{IP: net.IP{10, 1, 2, 0}, Mask: net.CIDRMask(30, 32)}, hi: 65535, all: true},
+	} {
+		g, err := parseAgentGrant(s)
+		if err != nil {
+			t.Fatalf("Error parsing %q: %v", s, err)
+		}
+		g.ipnet.IP = g.ipnet.IP.To4()
+		if !reflect.DeepEqual(g, want) {
+			t.Errorf("Expected %q parsed as %+v, got %+v", s, want, g)
+		}
+	}
+	for _, s := range []string{"10.1.2.3", "10.1.2.3:0", "10.1.2.3:90-80", "10.1.2.3:http", "host:443", "[fd00::1]:443", "icmp/10.1.2.3:*"} {
+		if _, err := parseAgentGrant(s); err == nil {
+			t.Errorf("Expected %q refused", s)
+		}
+	}
+}
+
+func createUDPPktTo(srcIP, dstIP net.IP, srcPort, dstPort int) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: srcIP, DstIP: dstIP},
+		&layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)},
+		gopacket.Payload([]byte{1, 2, 3, 4}))
+	return buf.Bytes()
+}
+
+func TestAgentSessions(t *testing.T) {
+	r, err := NewWebTunnelServer("127.0.0.1:0", "192.168.0.1", "255.255.255.0", "192.168.0.0/24",
+		[]string{"10.1.0.53"}, []string{"10.1.0.0/16"}, false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetAgentPolicy(AgentPolicy{}); err == nil {
+		t.Error("Expected agent policy without validator refused")
+	}
+	err = r.SetAgentPolicy(AgentPolicy{MaxLease: time.Hour, Validator: AgentTokenVerifier(func(token string) (*AgentClaims, error) {
+		switch token {
+		case "ci-token":
+			return &AgentClaims{Subject: "ci", Allow: []string{"10.1.2.3:443", "udp/10.1.0.0/24:53"}, Lease: 300 * time.Millisecond}, nil
+		case "bad-claims":
+			return &AgentClaims{Subject: "ci", Allow: []string{"10.1.2.3"}}, nil
+		case "expired":
+			return nil, fmt.Errorf("token expired")
+		}
+		return nil, nil
+	})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetAuthenticator(NewTokenAuthenticator(TokenVerifier(func(token string) (string, error) {
+		if token != "user-token" {
+			return "", fmt.Errorf("invalid token")
+		}
+		return "alice", nil
+	})))
+	srv := httptest.NewServer(http.HandlerFunc(r.wsEndpoint))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	connect := func(token string) (*websocket.Conn, *wc.ClientConfig, error) {
+		c, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer " + token}})
+		if err != nil {
+			return nil, nil, err
+		}
+		t.Cleanup(func() { c.Close() })
+		if err := c.WriteMessage(websocket.TextMessage, []byte("getConfig claimed host")); err != nil {
+			t.Fatal(err)
+		}
+		cfg := &wc.ClientConfig{}
+		if err := c.ReadJSON(cfg); err != nil {
+			t.Fatal(err)
+		}
+		return c, cfg, nil
+	}
+	for _, token := range []string{"bad-claims", "expired", "forged"} {
+		if _, _, err := connect(token); err == nil {
+			t.Errorf("Expected handshake with %q refused", token)
+		}
+	}
+
+	// Users keep full access.
+	_, user, err := connect("user-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(user.RoutePrefix, []string{"10.1.0.0/16"}) || len(user.DNS) != 1 {
+		t.Errorf("Unexpected user config %+v", user)
+	}
+
+	// Agents only get routes to their destinations and no DNS.
+	c, agent, err := connect("ci-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(agent.RoutePrefix, []string{"10.1.2.3/32", "10.1.0.0/24"}) || len(agent.DNS) != 0 {
+		t.Errorf("Unexpected agent config %+v", agent)
+	}
+	if u, _ := r.ipam.GetUserinfo(agent.IP); u.Username != "ci" {
+		t.Errorf("Expected agent session of ci, got %v", u.Username)
+	}
+
+	// Packets are only allowed to and from the destinations of the agent.
+	ip := net.ParseIP(agent.IP).To4()
+	for i, tc := range []struct {
+		ip    string
+		dir   Direction
+		pkt   []byte
+		allow bool
+	}{
+		{agent.IP, FromClient, createTCPPkt(ip, net.IP{10, 1, 2, 3}, 40000, 443, false), true},
+		{agent.IP, FromClient, createTCPPkt(ip, net.IP{10, 1, 2, 3}, 40000, 22, false), false},
+		{agent.IP, FromClient, createTCPPkt(ip, net.IP{10, 1, 2, 4}, 40000, 443, false), false},
+		{agent.IP, FromClient, createUDPPktTo(ip, net.IP{10, 1, 0, 53}, 40000, 53), true},
+		{agent.IP, FromClient, createTCPPkt(ip, net.IP{10, 1, 0, 53}, 40000, 53, false), false},
+		{agent.IP, ToClient, createTCPPkt(net.IP{10, 1, 2, 3}, ip, 443, 40000, false), true},
+		{agent.IP, ToClient, createTCPPkt(net.IP{10, 1, 2, 3}, ip, 22, 40000, false), false},
+		{user.IP, FromClient, createTCPPkt(net.ParseIP(user.IP).To4(), net.IP{10, 1, 9, 9}, 40000, 22, false), true},
+	} {
+		if got := r.agentAllows(tc.ip, tc.dir, tc.pkt); got != tc.allow {
+			t.Errorf("%v: expected allowed %v, got %v", i, tc.allow, got)
+		}
+	}
+	if m := r.GetMetrics(); m.AgentDenied != 4 {
+		t.Errorf("Expected 4 denied agent packets, got %v", m.AgentDenied)
+	}
+
+	// The session is closed at the end of its lease.
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := c.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !strings.Contains(err.Error(), closeReasonAgentLease) {
+			t.Errorf("Expected agent lease expiry, got %v", err)
+		}
+		break
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for r.agentSession(agent.IP) != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r.agentSession(agent.IP) != nil {
+		t.Error("Expected agent restriction lifted after the session")
+	}
+}
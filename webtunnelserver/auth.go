@@ -0,0 +1,162 @@
+package webtunnelserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/deepakkamesh/webtunnel/ipam"
+	"github.com/golang/glog"
+)
+
+// Authenticator verifies the credentials of a websocket handshake request (eg. HTTP basic
+// auth or a bearer token) and returns the authenticated username.
+type Authenticator interface {
+	Authenticate(r *http.Request) (username string, err error)
+}
+
+// AuthenticatorFunc adapts a function to an Authenticator.
+type AuthenticatorFunc func(r *http.Request) (string, error)
+
+// Authenticate calls f(r).
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (string, error) {
+	return f(r)
+}
+
+// Labels are attributes of a user from the auth backend, eg. department, cost center or
+// device type.
+type Labels = ipam.Labels
+
+// LabelAuthenticator is an Authenticator that also returns the labels of the user. They
+// are attached to the session in metrics, IP events and audit records, so usage can be
+// broken down along organizational lines.
+type LabelAuthenticator interface {
+	Authenticator
+	AuthenticateLabels(r *http.Request) (username string, labels Labels, err error)
+}
+
+// LabelAuthenticatorFunc adapts a function to a LabelAuthenticator.
+type LabelAuthenticatorFunc func(r *http.Request) (string, Labels, error)
+
+// Authenticate calls f(r) and drops the labels.
+func (f LabelAuthenticatorFunc) Authenticate(r *http.Request) (string, error) {
+	username, _, err := f(r)
+	return username, err
+}
+
+// AuthenticateLabels calls f(r).
+func (f LabelAuthenticatorFunc) AuthenticateLabels(r *http.Request) (string, Labels, error) {
+	return f(r)
+}
+
+// TokenQueryParam is the query parameter of the handshake URL carrying the bearer token
+// of clients that cannot set headers, eg. browsers.
+const TokenQueryParam = "access_token"
+
+// TokenValidator validates a bearer token, eg. against an identity provider, a token
+// introspection endpoint or a local key, and returns the username it was issued to.
+type TokenValidator interface {
+	ValidateToken(token string) (username string, err error)
+}
+
+// TokenVerifier adapts a function to a TokenValidator, eg. one checking a SAML assertion
+// or an identity provider token obtained by the client with SSO.
+type TokenVerifier func(token string) (username string, err error)
+
+// ValidateToken calls f(token).
+func (f TokenVerifier) ValidateToken(token string) (string, error) {
+	return f(token)
+}
+
+// NewTokenAuthenticator returns an Authenticator that checks the bearer token of the
+// handshake with v. The token is taken from the Authorization header, or the
+// TokenQueryParam query parameter if there is none.
+func NewTokenAuthenticator(v TokenValidator) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (string, error) {
+		token, err := bearerToken(r)
+		if err != nil {
+			return "", err
+		}
+		return v.ValidateToken(token)
+	})
+}
+
+// bearerToken returns the bearer token of the Authorization header of r, or the
+// TokenQueryParam query parameter if there is none.
+func bearerToken(r *http.Request) (string, error) {
+	h := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(h, "Bearer ")
+	if h == "" {
+		token = r.URL.Query().Get(TokenQueryParam)
+	} else if token == h {
+		return "", fmt.Errorf("no bearer token")
+	}
+	if token == "" {
+		return "", fmt.Errorf("no bearer token")
+	}
+	return token, nil
+}
+
+// authUserKey is the context key of the authenticated username.
+type authUserKey struct{}
+
+// authLabelsKey is the context key of the labels of the authenticated user.
+type authLabelsKey struct{}
+
+// SetAuthenticator requires clients to authenticate in the websocket handshake. Refused
+// handshakes get a 401 response and the authenticated username replaces the username
+// claimed by the client in its config request. If a is a LabelAuthenticator the labels it
+// returns are attached to the session. This should be called prior to Start.
+func (r *WebTunnelServer) SetAuthenticator(a Authenticator) {
+	r.auth = a
+}
+
+// authenticate verifies the handshake request rcv and returns ctx with the authenticated
+// username. ok is false if the request was refused and a response was written to w.
+func (r *WebTunnelServer) authenticate(ctx context.Context, w http.ResponseWriter, rcv *http.Request) (context.Context, bool) {
+	// Agent tokens restrict the session to their claims.
+	ctx, agent, err := r.authenticateAgent(ctx, rcv)
+	if err != nil {
+		r.refuseAuth(w, rcv, err)
+		return ctx, false
+	}
+	if agent || r.auth == nil {
+		return ctx, true
+	}
+	var username string
+	var labels Labels
+	if la, ok := r.auth.(LabelAuthenticator); ok {
+		username, labels, err = la.AuthenticateLabels(rcv)
+	} else {
+		username, err = r.auth.Authenticate(rcv)
+	}
+	if err != nil {
+		r.refuseAuth(w, rcv, err)
+		return ctx, false
+	}
+	if len(labels) > 0 {
+		ctx = context.WithValue(ctx, authLabelsKey{}, labels)
+	}
+	return context.WithValue(ctx, authUserKey{}, username), true
+}
+
+// refuseAuth answers a handshake request rcv that failed authentication with 401.
+func (r *WebTunnelServer) refuseAuth(w http.ResponseWriter, rcv *http.Request, err error) {
+	glog.Warningf("authentication from %v failed: %v", rcv.RemoteAddr, err)
+	r.strike(OffenceAuth, rcv.RemoteAddr, "")
+	w.Header().Set("WWW-Authenticate", `Basic realm="webtunnel"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// authUser returns the authenticated username of ctx, empty if not authenticated.
+func authUser(ctx context.Context) string {
+	u, _ := ctx.Value(authUserKey{}).(string)
+	return u
+}
+
+// authLabels returns the labels of the authenticated user of ctx, nil if none.
+func authLabels(ctx context.Context) Labels {
+	l, _ := ctx.Value(authLabelsKey{}).(Labels)
+	return l
+}
@@ -0,0 +1,103 @@
+package webtunnelserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	r := &WebTunnelServer{}
+	req := httptest.NewRequest("GET", "/ws", nil)
+	if _, ok := r.authenticate(context.Background(), httptest.NewRecorder(), req); !ok {
+		t.Fatal("Expected handshake allowed without authenticator")
+	}
+
+	r.SetAuthenticator(NewTokenAuthenticator(TokenVerifier(func(token string) (string, error) {
+		if token != "assertion" {
+			return "", fmt.Errorf("invalid token")
+		}
+		return "alice", nil
+	})))
+	for _, h := range []string{"", "Bearer ", "Bearer forged", "Basic YWxpY2U6eA=="} {
+		req.Header.Set("Authorization", h)
+		w := httptest.NewRecorder()
+		if _, ok := r.authenticate(context.Background(), w, req); ok || w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected %q refused with 401, got %v", h, w.Code)
+		}
+	}
+	req.Header.Set("Authorization", "Bearer assertion")
+	ctx, ok := r.authenticate(context.Background(), httptest.NewRecorder(), req)
+	if !ok || authUser(ctx) != "alice" {
+		t.Errorf("Expected alice authenticated, got %v %q", ok, authUser(ctx))
+	}
+}
+
+// staticTokens is a TokenValidator of fixed tokens.
+type staticTokens map[string]string
+
+func (s staticTokens) ValidateToken(token string) (string, error) {
+	if u, ok := s[token]; ok {
+		return u, nil
+	}
+	return "", fmt.Errorf("unknown token")
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	r := &WebTunnelServer{}
+	r.SetAuthenticator(NewTokenAuthenticator(staticTokens{"t0k3n": "bob"}))
+	for target, want := range map[string]string{
+		"/ws?access_token=t0k3n": "bob",
+		"/ws?access_token=bad":   "",
+		"/ws":                    "",
+	} {
+		ctx, ok := r.authenticate(context.Background(), httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+		if ok != (want != "") || authUser(ctx) != want {
+			t.Errorf("%v: expected user %q, got %v %q", target, want, ok, authUser(ctx))
+		}
+	}
+
+	// The header takes precedence over the query parameter.
+	req := httptest.NewRequest("GET", "/ws?access_token=t0k3n", nil)
+	req.Header.Set("Authorization", "Basic Ym9iOng=")
+	if _, ok := r.authenticate(context.Background(), httptest.NewRecorder(), req); ok {
+		t.Error("Expected basic auth refused")
+	}
+}
+
+func TestAuthenticateLabels(t *testing.T) {
+	r, err := NewWebTunnelServer("127.0.0.1:0", "192.168.0.1", "255.255.255.0", "192.168.0.0/24",
+		nil, []string{"1.1.1.0/24"}, false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []IPEvent
+	r.AddIPEventListener(func(ev IPEvent) { events = append(events, ev) })
+	r.SetAuthenticator(LabelAuthenticatorFunc(func(*http.Request) (string, Labels, error) {
+		return "alice", Labels{"department": "finance", "device": "laptop"}, nil
+	}))
+
+	req := httptest.NewRequest("GET", "/ws", nil)
+	ctx, ok := r.authenticate(context.Background(), httptest.NewRecorder(), req)
+	if !ok {
+		t.Fatal("Expected handshake allowed")
+	}
+	ip, _ := r.ipam.AcquireIP(nil)
+	if err := r.ipam.SetIPActiveWithLabels(ip, authUser(ctx), "host", authLabels(ctx)); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := r.SessionLabels(ip)
+	if err != nil || l["department"] != "finance" {
+		t.Errorf("Expected session labels, got %v %v", l, err)
+	}
+	if m := r.GetMetrics(); m.Labels[ip]["device"] != "laptop" {
+		t.Errorf("Expected labels in metrics, got %v", m.Labels)
+	}
+	r.ipam.ReleaseIP(ip)
+	if len(events) != 2 || events[0].Labels["department"] != "finance" || events[1].Labels["department"] != "finance" {
+		t.Errorf("Expected labels in IP events, got %+v", events)
+	}
+}
@@ -0,0 +1,369 @@
+package webtunnelserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// Close reason sent to the connections of a banned client.
+const closeReasonBanned = "banned"
+
+// Defaults of the ban policy.
+const (
+	defaultBanStrikes  = 10
+	defaultBanWindow   = time.Minute
+	defaultBanCooldown = time.Hour
+)
+
+// Number of offenders tracked above which offences older than the window are pruned.
+const banPruneSize = 1024
+
+// Offence is a misbehaviour counted towards a ban.
+type Offence string
+
+const (
+	OffenceAuth      Offence = "auth"      // Failed handshake authentication.
+	OffenceMalformed Offence = "malformed" // Malformed packet from the client.
+	OffenceSpoofing  Offence = "spoofing"  // Packet from the client with a source address not routed to it.
+)
+
+// BanPolicy bans the source address and identity of clients that misbehave repeatedly.
+type BanPolicy struct {
+	Strikes  int           // Offences within Window that ban the client.
+	Window   time.Duration // Time offences are counted over.
+	Cooldown time.Duration // How long the client is banned.
+	File     string        // File the bans are persisted to across restarts, empty to keep them in memory.
+}
+
+// Ban is a banned source address or username.
+type Ban struct {
+	Key    string    `json:"key"`    // Source IP address or username.
+	Reason string    `json:"reason"` // Offence, or why an admin banned it.
+	Until  time.Time `json:"until"`  // End of the cooldown.
+}
+
+// banList holds the offences and bans of misbehaving clients.
+type banList struct {
+	policy   BanPolicy
+	strikes  map[string][]time.Time // Recent offence times per source address or username.
+	bans     map[string]Ban         // Active bans per source address or username.
+	sessions map[string]string      // Source address of the connection per client IP.
+	lock     sync.Mutex
+}
+
+/*
+SetBanPolicy enables the ban list. Clients failing authentication, sending malformed
+packets or packets with a source address other than their IP or routed subnets collect
+offences; Strikes offences within Window ban their source address and, once known, their
+username for Cooldown. Banned clients are disconnected and their handshakes refused with
+403. Packets with spoofed source addresses are dropped. Zero fields of p take defaults.
+Bans are loaded from and saved to p.File if set. This should be called prior to Start.
+*/
+func (r *WebTunnelServer) SetBanPolicy(p BanPolicy) error {
+	if p.Strikes < 0 || p.Window < 0 || p.Cooldown < 0 {
+		return fmt.Errorf("invalid ban policy %+v", p)
+	}
+	if p.Strikes == 0 {
+		p.Strikes = defaultBanStrikes
+	}
+	if p.Window == 0 {
+		p.Window = defaultBanWindow
+	}
+	if p.Cooldown == 0 {
+		p.Cooldown = defaultBanCooldown
+	}
+	b := &banList{
+		policy:   p,
+		strikes:  make(map[string][]time.Time),
+		bans:     make(map[string]Ban),
+		sessions: make(map[string]string),
+	}
+	if p.File != "" {
+		if err := b.load(); err != nil {
+			return err
+		}
+	}
+	r.bans = b
+	return nil
+}
+
+// load reads the unexpired bans of the ban file.
+func (b *banList) load() error {
+	data, err := os.ReadFile(b.policy.File)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading ban file %w", err)
+	}
+	var bans []Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return fmt.Errorf("error parsing ban file %w", err)
+	}
+	now := time.Now()
+	for _, ban := range bans {
+		if ban.Until.After(now) {
+			b.bans[ban.Key] = ban
+		}
+	}
+	return nil
+}
+
+// save writes the bans to the ban file. Must be called with the lock held.
+func (b *banList) save() {
+	if b.policy.File == "" {
+		return
+	}
+	data, err := json.Marshal(b.list())
+	if err != nil {
+		glog.Warningf("error encoding bans: %v", err)
+		return
+	}
+	// Write and rename so a crash never leaves a partial file.
+	tmp := b.policy.File + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		glog.Warningf("error saving bans: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, b.policy.File); err != nil {
+		glog.Warningf("error saving bans: %v", err)
+	}
+}
+
+// list returns the unexpired bans sorted by key. Must be called with the lock held.
+func (b *banList) list() []Ban {
+	now := time.Now()
+	bans := []Ban{}
+	for k, ban := range b.bans {
+		if !ban.Until.After(now) {
+			delete(b.bans, k)
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Key < bans[j].Key })
+	return bans
+}
+
+// banned returns true if any of keys is banned.
+func (b *banList) banned(keys ...string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	for _, k := range keys {
+		if ban, ok := b.bans[k]; ok && ban.Until.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// strike records an offence of keys. It returns the keys that reached the ban threshold.
+func (b *banList) strike(offence Offence, keys ...string) []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	if len(b.strikes) > banPruneSize {
+		for k, s := range b.strikes {
+			if now.Sub(s[len(s)-1]) > b.policy.Window {
+				delete(b.strikes, k)
+			}
+		}
+	}
+
+	var banned []string
+	for _, k := range keys {
+		if k == "" {
+			continue
+		}
+		s := append(b.strikes[k], now)
+		for len(s) > 0 && now.Sub(s[0]) > b.policy.Window {
+			s = s[1:]
+		}
+		if len(s) < b.policy.Strikes {
+			b.strikes[k] = s
+			continue
+		}
+		delete(b.strikes, k)
+		b.bans[k] = Ban{Key: k, Reason: string(offence), Until: now.Add(b.policy.Cooldown)}
+		banned = append(banned, k)
+	}
+	if len(banned) > 0 {
+		b.save()
+	}
+	return banned
+}
+
+// Ban bans key, a source IP address or username, for d and disconnects its sessions.
+func (r *WebTunnelServer) Ban(key, reason string, d time.Duration) error {
+	if r.bans == nil {
+		return fmt.Errorf("ban list not enabled")
+	}
+	if key == "" || d <= 0 {
+		return fmt.Errorf("invalid ban of %q for %v", key, d)
+	}
+	r.bans.lock.Lock()
+	r.bans.bans[key] = Ban{Key: key, Reason: reason, Until: time.Now().Add(d)}
+	r.bans.save()
+	r.bans.lock.Unlock()
+	glog.Warningf("%v banned for %v: %v", key, d, reason)
+	r.disconnectBanned(key)
+	return nil
+}
+
+// Unban lifts the ban of key and forgets its offences.
+func (r *WebTunnelServer) Unban(key string) error {
+	if r.bans == nil {
+		return fmt.Errorf("ban list not enabled")
+	}
+	r.bans.lock.Lock()
+	defer r.bans.lock.Unlock()
+	delete(r.bans.strikes, key)
+	if _, ok := r.bans.bans[key]; !ok {
+		return fmt.Errorf("%v not banned", key)
+	}
+	delete(r.bans.bans, key)
+	r.bans.save()
+	glog.Infof("%v unbanned", key)
+	return nil
+}
+
+// Bans returns the active bans.
+func (r *WebTunnelServer) Bans() []Ban {
+	if r.bans == nil {
+		return nil
+	}
+	r.bans.lock.Lock()
+	defer r.bans.lock.Unlock()
+	return r.bans.list()
+}
+
+// remoteHost returns the IP address of the host:port remote address.
+func remoteHost(remote string) string {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return remote
+	}
+	return host
+}
+
+// isBanned returns true and counts the refusal if any of keys is banned.
+func (r *WebTunnelServer) isBanned(keys ...string) bool {
+	if r.bans == nil || !r.bans.banned(keys...) {
+		return false
+	}
+	r.metricsLock.Lock()
+	r.metrics.Banned++
+	r.metricsLock.Unlock()
+	return true
+}
+
+// strike records an offence of the client at the remote address, with username if known.
+func (r *WebTunnelServer) strike(offence Offence, remote, username string) {
+	if r.bans == nil {
+		return
+	}
+	for _, k := range r.bans.strike(offence, remoteHost(remote), username) {
+		glog.Warningf("%v banned for %v after repeated %v offences", k, r.bans.policy.Cooldown, offence)
+		r.disconnectBanned(k)
+	}
+}
+
+// strikeSession records an offence of the client on ip.
+func (r *WebTunnelServer) strikeSession(offence Offence, ip string) {
+	if r.bans == nil {
+		return
+	}
+	r.bans.lock.Lock()
+	remote, ok := r.bans.sessions[ip]
+	r.bans.lock.Unlock()
+	if !ok {
+		return
+	}
+	var username string
+	if u, err := r.ipam.GetUserinfo(ip); err == nil {
+		username = u.Username
+	}
+	r.strike(offence, remote, username)
+}
+
+// trackSession records the remote address of the connection of the client on ip.
+func (r *WebTunnelServer) trackSession(ip, remote string) {
+	r.slaRemote(ip, remote)
+	if r.bans == nil {
+		return
+	}
+	r.bans.lock.Lock()
+	r.bans.sessions[ip] = remoteHost(remote)
+	r.bans.lock.Unlock()
+}
+
+// releaseBanSession forgets the remote address of a disconnected client.
+func (r *WebTunnelServer) releaseBanSession(ip string) {
+	if r.bans == nil {
+		return
+	}
+	r.bans.lock.Lock()
+	delete(r.bans.sessions, ip)
+	r.bans.lock.Unlock()
+}
+
+// checkSource returns false for packets from the client on ip with a source address other
+// than ip or a subnet routed to it. Spoofed packets are only checked with the ban list.
+func (r *WebTunnelServer) checkSource(ip string, pkt []byte) bool {
+	if r.bans == nil {
+		return true
+	}
+	src := net.IP(pkt[12:16])
+	if src.String() == ip {
+		return true
+	}
+	if owner, ok := r.subnets.lookup(src); ok && owner == ip {
+		return true
+	}
+	glog.V(2).Infof("dropping packet from %v with spoofed source %v", ip, src)
+	r.strikeSession(OffenceSpoofing, ip)
+	return false
+}
+
+// disconnectBanned closes the connections of the sessions from or of key.
+func (r *WebTunnelServer) disconnectBanned(key string) {
+	r.bans.lock.Lock()
+	remotes := make(map[string]string, len(r.bans.sessions))
+	for ip, remote := range r.bans.sessions {
+		remotes[ip] = remote
+	}
+	r.bans.lock.Unlock()
+
+	for ip, u := range r.ipam.DumpAllocations() {
+		if u.Username != key && remotes[ip] != key {
+			continue
+		}
+		data, err := r.ipam.GetData(ip)
+		if err != nil {
+			continue
+		}
+		if ws, ok := data.(*wc.WSWriter); ok {
+			glog.Infof("Disconnecting banned %s@%s on %v", u.Username, u.Hostname, ip)
+			closeBanned(ws, r.sessionID(ip))
+		}
+	}
+}
+
+// closeBanned closes the connection of the banned client of session id.
+func closeBanned(ws *wc.WSWriter, id string) {
+	ws.WriteControlMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, withSessionID(closeReasonBanned, id)))
+	ws.Conn().Close()
+}
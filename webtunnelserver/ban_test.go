@@ -0,0 +1,90 @@
+package webtunnelserver
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestBanList(t *testing.T) {
+	r, err := NewWebTunnelServer("127.0.0.1:0", "192.168.0.1", "255.255.255.0", "192.168.0.0/24",
+		nil, []string{"1.1.1.0/24"}, false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "bans.json")
+	if err := r.SetBanPolicy(BanPolicy{Strikes: 3, Window: time.Minute, Cooldown: time.Hour, File: file}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Auth failures ban the source address.
+	for i := 0; i < 2; i++ {
+		r.strike(OffenceAuth, "10.0.0.1:1234", "")
+	}
+	if r.isBanned("10.0.0.1") {
+		t.Error("Expected 10.0.0.1 not banned below the strikes")
+	}
+	r.strike(OffenceAuth, "10.0.0.1:4321", "")
+	if !r.isBanned("10.0.0.1") {
+		t.Error("Expected 10.0.0.1 banned")
+	}
+
+	// Spoofed packets ban the source address and username of the session.
+	ws, client := wsPair(t)
+	defer ws.Close()
+	defer client.Close()
+	ip, _ := r.ipam.AcquireIP(ws)
+	r.ipam.SetIPActiveWithUserInfo(ip, "mallory", "host")
+	r.trackSession(ip, "10.0.0.2:5555")
+	if !r.checkSource(ip, createIPv4Pkt(net.ParseIP(ip).To4(), net.IPv4(1, 1, 1, 1).To4())) {
+		t.Error("Expected packet from the client IP allowed")
+	}
+	for i := 0; i < 3; i++ {
+		if r.checkSource(ip, createIPv4Pkt(net.IPv4(192, 168, 0, 99).To4(), net.IPv4(1, 1, 1, 1).To4())) {
+			t.Error("Expected spoofed packet dropped")
+		}
+	}
+	if !r.isBanned("mallory") || !r.isBanned("10.0.0.2") {
+		t.Errorf("Expected mallory and 10.0.0.2 banned, got %+v", r.Bans())
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := client.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("Expected banned session closed, got %v", err)
+	}
+
+	// Bans persist across restarts.
+	r2, _ := NewWebTunnelServer("127.0.0.1:0", "192.168.0.1", "255.255.255.0", "192.168.0.0/24",
+		nil, []string{"1.1.1.0/24"}, false, "", "")
+	if err := r2.SetBanPolicy(BanPolicy{File: file}); err != nil {
+		t.Fatal(err)
+	}
+	if bans := r2.Bans(); len(bans) != 3 || bans[2].Key != "mallory" || bans[2].Reason != string(OffenceSpoofing) {
+		t.Errorf("Expected 3 bans loaded, got %+v", bans)
+	}
+	if err := r2.Unban("mallory"); err != nil || r2.isBanned("mallory") {
+		t.Errorf("Expected mallory unbanned, got %v", err)
+	}
+	if err := r2.Unban("mallory"); err == nil {
+		t.Error("Expected error unbanning twice")
+	}
+
+	// Handshakes from banned addresses are refused.
+	srv := httptest.NewServer(http.HandlerFunc(r2.wsEndpoint))
+	defer srv.Close()
+	if err := r2.Ban("127.0.0.1", "test", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected handshake refused with 403, got %v", err)
+	}
+	if m := r2.GetMetrics(); m.Banned != 1 {
+		t.Errorf("Expected 1 banned refusal, got %v", m.Banned)
+	}
+}
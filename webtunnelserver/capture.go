@@ -0,0 +1,275 @@
+package webtunnelserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	captureQueueLen = 256 // Packets queued per capture before dropping.
+	linkTypeRaw     = 101 // pcap LINKTYPE_RAW, packets start with the IP header.
+)
+
+// DialCaptureSink (Overridable) connects to a capture sink, eg. a pcap-over-TCP listener
+// like `nc -l 5000 | wireshark -k -i -`.
+var DialCaptureSink = dialCaptureSink
+
+func dialCaptureSink(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, 5*time.Second)
+}
+
+// CaptureOptions limits what a session capture sends to its sink.
+type CaptureOptions struct {
+	Snaplen  int           // Bytes kept per packet, 0 keeps whole packets.
+	Rate     int           // Packets per second sent to the sink, 0 is unlimited. Excess is dropped.
+	Duration time.Duration // Capture stops after this long, 0 runs until stopped or disconnect.
+}
+
+// CaptureAction is the action recorded in a CaptureEvent.
+type CaptureAction string
+
+const (
+	CaptureStart CaptureAction = "capture_start" // Mirroring enabled.
+	CaptureStop  CaptureAction = "capture_stop"  // Mirroring stopped.
+)
+
+// CaptureEvent is the audit record of a session capture.
+type CaptureEvent struct {
+	Action    CaptureAction `json:"action"`
+	Admin     string        `json:"admin"`               // Who started or stopped the capture, empty if the server did.
+	IP        string        `json:"ip"`                  // Tunnel IP of the captured session.
+	Sink      string        `json:"sink"`                // Capture sink address.
+	Reason    string        `json:"reason,omitempty"`    // Why the server stopped the capture.
+	Labels    Labels        `json:"labels,omitempty"`    // Auth backend labels of the captured session.
+	SessionID string        `json:"sessionid,omitempty"` // ID the captured session is logged under.
+	Time      time.Time     `json:"time"`
+}
+
+// CaptureInfo is the state of a running session capture.
+type CaptureInfo struct {
+	Admin   string         `json:"admin"`
+	Sink    string         `json:"sink"`
+	Options CaptureOptions `json:"options"`
+	Started time.Time      `json:"started"`
+	Packets int            `json:"packets"` // Packets sent to the sink.
+	Dropped int            `json:"dropped"` // Packets dropped by the rate limit or a slow sink.
+}
+
+// sessionCapture mirrors the packets of one session to a sink.
+type sessionCapture struct {
+	info   CaptureInfo
+	conn   net.Conn
+	queue  chan []byte  // pcap records for the sink.
+	bucket *tokenBucket // Rate limit state, nil if unlimited.
+	timer  *time.Timer  // Duration limit, nil if unlimited.
+}
+
+// captureTable holds the running session captures.
+type captureTable struct {
+	sessions map[string]*sessionCapture // Capture per client IP.
+	audit    func(CaptureEvent)         // Audit listener, nil to only log.
+	lock     sync.Mutex
+}
+
+// SetCaptureAudit passes the audit record of each session capture started or stopped to
+// listener, in addition to logging it. This should be called prior to Start.
+func (r *WebTunnelServer) SetCaptureAudit(listener func(CaptureEvent)) {
+	r.captures.audit = listener
+}
+
+/*
+StartCapture streams a copy of the packets of the session on ip, in both directions, to
+sink for live troubleshooting. The sink is a TCP host:port receiving a pcap stream (raw
+IPv4 link type). admin identifies who enabled it in the audit log (see SetCaptureAudit).
+
+The capture stops with StopCapture, when opts.Duration elapses, when the session ends or
+when the sink fails. Packets are truncated to opts.Snaplen and limited to opts.Rate per
+second; packets over the limit or not keeping up with the sink are dropped and never slow
+down the tunnel.
+*/
+func (r *WebTunnelServer) StartCapture(admin, ip, sink string, opts CaptureOptions) error {
+	if opts.Snaplen < 0 || opts.Rate < 0 || opts.Duration < 0 {
+		return fmt.Errorf("invalid capture options %+v", opts)
+	}
+	if opts.Snaplen == 0 {
+		opts.Snaplen = 65535
+	}
+	if _, err := r.ipam.GetUserinfo(ip); err != nil {
+		return fmt.Errorf("no session on %v: %w", ip, err)
+	}
+	r.captures.lock.Lock()
+	_, running := r.captures.sessions[ip]
+	r.captures.lock.Unlock()
+	if running {
+		return fmt.Errorf("session %v is already captured", ip)
+	}
+
+	conn, err := DialCaptureSink(sink)
+	if err != nil {
+		return fmt.Errorf("unable to connect to capture sink %v: %w", sink, err)
+	}
+	if _, err := conn.Write(pcapHeader(opts.Snaplen)); err != nil {
+		conn.Close()
+		return fmt.Errorf("unable to write to capture sink %v: %w", sink, err)
+	}
+	c := &sessionCapture{
+		info:  CaptureInfo{Admin: admin, Sink: sink, Options: opts, Started: time.Now()},
+		conn:  conn,
+		queue: make(chan []byte, captureQueueLen),
+	}
+	if opts.Rate > 0 {
+		c.bucket = &tokenBucket{tokens: float64(opts.Rate), last: c.info.Started}
+	}
+
+	r.captures.lock.Lock()
+	if _, running := r.captures.sessions[ip]; running {
+		r.captures.lock.Unlock()
+		conn.Close()
+		return fmt.Errorf("session %v is already captured", ip)
+	}
+	if r.captures.sessions == nil {
+		r.captures.sessions = make(map[string]*sessionCapture)
+	}
+	r.captures.sessions[ip] = c
+	if opts.Duration > 0 {
+		c.timer = time.AfterFunc(opts.Duration, func() { r.stopCapture(c, ip, "", "duration elapsed") })
+	}
+	r.captures.lock.Unlock()
+
+	r.captureEvent(CaptureEvent{Action: CaptureStart, Admin: admin, IP: ip, Sink: sink})
+	go r.writeCapture(c, ip)
+	return nil
+}
+
+// StopCapture stops the capture of the session on ip. admin identifies who stopped it in
+// the audit log.
+func (r *WebTunnelServer) StopCapture(admin, ip string) error {
+	if !r.stopCapture(nil, ip, admin, "") {
+		return fmt.Errorf("session %v is not captured", ip)
+	}
+	return nil
+}
+
+// Captures returns the running captures keyed by client IP.
+func (r *WebTunnelServer) Captures() map[string]CaptureInfo {
+	r.captures.lock.Lock()
+	defer r.captures.lock.Unlock()
+	m := make(map[string]CaptureInfo)
+	for ip, c := range r.captures.sessions {
+		m[ip] = c.info
+	}
+	return m
+}
+
+// stopCapture stops the capture on ip if it is c (or any capture if c is nil) and returns
+// false if there was none.
+func (r *WebTunnelServer) stopCapture(c *sessionCapture, ip, admin, reason string) bool {
+	r.captures.lock.Lock()
+	cur, ok := r.captures.sessions[ip]
+	if !ok || (c != nil && c != cur) {
+		r.captures.lock.Unlock()
+		return false
+	}
+	delete(r.captures.sessions, ip)
+	if cur.timer != nil {
+		cur.timer.Stop()
+	}
+	close(cur.queue)
+	r.captures.lock.Unlock()
+
+	r.captureEvent(CaptureEvent{Action: CaptureStop, Admin: admin, IP: ip, Sink: cur.info.Sink, Reason: reason})
+	return true
+}
+
+// captureEvent logs a capture audit record and passes it to the listener.
+func (r *WebTunnelServer) captureEvent(ev CaptureEvent) {
+	ev.Time = time.Now()
+	ev.SessionID = r.sessionID(ev.IP)
+	if u, err := r.ipam.GetUserinfo(ev.IP); err == nil && len(u.Labels) > 0 {
+		ev.Labels = copyLabels(u.Labels)
+	}
+	glog.Infof("session capture %v of %v session %v to %v by %q %v", ev.Action, ev.IP, ev.SessionID, ev.Sink, ev.Admin, ev.Reason)
+	if r.captures.audit != nil {
+		r.captures.audit(ev)
+	}
+}
+
+// capturePacket queues a copy of pkt for the capture of the session on ip, if any.
+func (r *WebTunnelServer) capturePacket(ip string, pkt []byte) {
+	r.captures.lock.Lock()
+	defer r.captures.lock.Unlock()
+	c, ok := r.captures.sessions[ip]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if b := c.bucket; b != nil {
+		rate := float64(c.info.Options.Rate)
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > rate {
+			b.tokens = rate
+		}
+		b.last = now
+		if b.tokens < 1 {
+			c.info.Dropped++
+			return
+		}
+		b.tokens--
+	}
+	select {
+	case c.queue <- pcapRecord(now, pkt, c.info.Options.Snaplen):
+		c.info.Packets++
+	default:
+		c.info.Dropped++
+	}
+}
+
+// writeCapture sends the queued records of c to its sink until the capture stops.
+func (r *WebTunnelServer) writeCapture(c *sessionCapture, ip string) {
+	defer c.conn.Close()
+	for rec := range c.queue {
+		if _, err := c.conn.Write(rec); err != nil {
+			glog.Warningf("error writing capture of %v: %v", ip, err)
+			r.stopCapture(c, ip, "", fmt.Sprintf("sink error: %v", err))
+			for range c.queue {
+			}
+			return
+		}
+	}
+}
+
+// releaseCapture stops the capture of a disconnected client.
+func (r *WebTunnelServer) releaseCapture(ip string) {
+	r.stopCapture(nil, ip, "", "session closed")
+}
+
+// pcapHeader returns the pcap file header for raw IP packets truncated to snaplen.
+func pcapHeader(snaplen int) []byte {
+	b := make([]byte, 24)
+	binary.LittleEndian.PutUint32(b[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(b[4:], 2)
+	binary.LittleEndian.PutUint16(b[6:], 4)
+	binary.LittleEndian.PutUint32(b[16:], uint32(snaplen))
+	binary.LittleEndian.PutUint32(b[20:], linkTypeRaw)
+	return b
+}
+
+// pcapRecord returns the pcap record of pkt captured at t, truncated to snaplen.
+func pcapRecord(t time.Time, pkt []byte, snaplen int) []byte {
+	n := len(pkt)
+	if n > snaplen {
+		n = snaplen
+	}
+	b := make([]byte, 16+n)
+	binary.LittleEndian.PutUint32(b[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(b[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(b[8:], uint32(n))
+	binary.LittleEndian.PutUint32(b[12:], uint32(len(pkt)))
+	copy(b[16:], pkt[:n])
+	return b
+}
@@ -0,0 +1,79 @@
+package webtunnelserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCapture(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	sinks := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			sinks <- c
+		}
+	}()
+
+	ipam, _ := NewIPPam("192.168.0.0/24")
+	ip, _ := ipam.AcquireIP(nil)
+	r := &WebTunnelServer{ipam: ipam}
+	var events []CaptureEvent
+	r.SetCaptureAudit(func(ev CaptureEvent) { events = append(events, ev) })
+
+	if err := r.StartCapture("alice", ip, ln.Addr().String(), CaptureOptions{}); err == nil {
+		t.Error("Expected error capturing a session without config")
+	}
+	ipam.SetIPActiveWithUserInfo(ip, "bob", "laptop")
+	if err := r.StartCapture("alice", ip, ln.Addr().String(), CaptureOptions{Snaplen: 20, Rate: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.StartCapture("alice", ip, ln.Addr().String(), CaptureOptions{}); err == nil {
+		t.Error("Expected error capturing a session twice")
+	}
+	sink := <-sinks
+	defer sink.Close()
+
+	// The rate limit allows a burst of 2, packets are truncated to the snaplen.
+	pkt := bytes.Repeat([]byte{0x45}, 60)
+	for i := 0; i < 5; i++ {
+		r.capturePacket(ip, pkt)
+	}
+	r.capturePacket("192.168.0.99", pkt)
+	if info := r.Captures()[ip]; info.Packets != 2 || info.Dropped != 3 || info.Admin != "alice" {
+		t.Errorf("Unexpected capture info %+v", info)
+	}
+
+	sink.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 24+2*(16+20))
+	if _, err := io.ReadFull(sink, buf); err != nil {
+		t.Fatal(err)
+	}
+	if magic := binary.LittleEndian.Uint32(buf); magic != 0xa1b2c3d4 || binary.LittleEndian.Uint32(buf[20:]) != linkTypeRaw {
+		t.Errorf("Invalid pcap header %x", buf[:24])
+	}
+	rec := buf[24:]
+	if incl, orig := binary.LittleEndian.Uint32(rec[8:]), binary.LittleEndian.Uint32(rec[12:]); incl != 20 || orig != 60 {
+		t.Errorf("Expected record truncated from 60 to 20 bytes, got %v %v", orig, incl)
+	}
+
+	// The session ending stops the capture and closes the sink.
+	r.releaseCapture(ip)
+	if err := r.StopCapture("alice", ip); err == nil {
+		t.Error("Expected error stopping a stopped capture")
+	}
+	if _, err := sink.Read(buf); err != io.EOF {
+		t.Errorf("Expected sink closed, got %v", err)
+	}
+	if len(events) != 2 || events[0].Action != CaptureStart || events[1].Action != CaptureStop || events[1].Reason != "session closed" {
+		t.Errorf("Unexpected audit events %+v", events)
+	}
+}
@@ -0,0 +1,149 @@
+package webtunnelserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// CertCheckInterval (Overridable) is how often the certificate files are checked for
+// renewal and the certificate for expiry.
+var CertCheckInterval = time.Minute
+
+// CertExpiryWarning (Overridable) is the remaining validity below which expiry is
+// logged, eg. when renewals are failing.
+var CertExpiryWarning = 14 * 24 * time.Hour
+
+// certStore serves the HTTPS certificate and swaps in renewed ones.
+type certStore struct {
+	cert    *tls.Certificate
+	staple  []byte    // OCSP response stapled to the certificate.
+	modTime time.Time // Latest modification time of the certificate files.
+	reloads int       // Certificates replaced since start.
+	lock    sync.Mutex
+}
+
+// newCertStore returns a store serving cert, parsing its leaf for the expiry.
+func newCertStore(cert tls.Certificate, staple []byte) *certStore {
+	s := &certStore{staple: staple}
+	s.set(cert)
+	return s
+}
+
+func (s *certStore) set(cert tls.Certificate) {
+	if cert.Leaf == nil && len(cert.Certificate) > 0 {
+		cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	if s.staple != nil {
+		cert.OCSPStaple = s.staple
+	}
+	s.lock.Lock()
+	s.cert = &cert
+	s.lock.Unlock()
+}
+
+// getCertificate implements tls.Config.GetCertificate.
+func (s *certStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.cert == nil {
+		return nil, fmt.Errorf("no certificate yet")
+	}
+	return s.cert, nil
+}
+
+// expiry returns the expiry of the certificate, zero if unknown.
+func (s *certStore) expiry() time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.cert == nil || s.cert.Leaf == nil {
+		return time.Time{}
+	}
+	return s.cert.Leaf.NotAfter
+}
+
+// certModTime returns the latest modification time of the certificate files.
+func certModTime(files ...string) (time.Time, error) {
+	var t time.Time
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return t, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
+
+/*
+ReloadCertificate loads the HTTPS key and cert files if they changed since they were last
+loaded, eg. after a Let's Encrypt renewal. New TLS handshakes use the new certificate
+while established connections are kept. The files are also checked every
+CertCheckInterval, so calling it is only needed to pick up a renewal immediately. It
+returns an error and keeps the current certificate if the files fail to load.
+*/
+func (r *WebTunnelServer) ReloadCertificate() error {
+	if r.certs == nil {
+		return fmt.Errorf("certificate not loaded from files")
+	}
+	mod, err := certModTime(r.httpsCertFile, r.httpsKeyFile)
+	if err != nil {
+		return fmt.Errorf("error checking certificate files %w", err)
+	}
+	r.certs.lock.Lock()
+	changed := mod.After(r.certs.modTime)
+	r.certs.lock.Unlock()
+	if !changed {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.httpsCertFile, r.httpsKeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate %w", err)
+	}
+	r.certs.set(cert)
+	r.certs.lock.Lock()
+	r.certs.modTime = mod
+	r.certs.reloads++
+	r.certs.lock.Unlock()
+	glog.Infof("loaded renewed certificate from %v, expires %v", r.httpsCertFile, r.certs.expiry())
+	return nil
+}
+
+// checkCertExpiry logs a warning if the certificate in s expires within CertExpiryWarning.
+func (r *WebTunnelServer) checkCertExpiry(s *certStore, name string) {
+	exp := s.expiry()
+	if exp.IsZero() {
+		return
+	}
+	if left := time.Until(exp); left < 0 {
+		glog.Errorf("certificate %v expired on %v", name, exp)
+	} else if left < CertExpiryWarning {
+		glog.Warningf("certificate %v expires in %v on %v", name, left.Round(time.Hour), exp)
+	}
+}
+
+// processCertReload picks up renewed certificate files and warns before expiry.
+func (r *WebTunnelServer) processCertReload() {
+	if r.certs == nil {
+		return
+	}
+	for {
+		if r.isStopped.Load() {
+			glog.V(1).Info("Exiting certificate reload routine")
+			return
+		}
+		// Files may be mid-write, a failed load is retried on the next check.
+		if err := r.ReloadCertificate(); err != nil {
+			glog.Warning(err)
+		}
+		r.checkCertExpiry(r.certs, r.httpsCertFile)
+		time.Sleep(CertCheckInterval)
+	}
+}
@@ -0,0 +1,72 @@
+package webtunnelserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	r := &WebTunnelServer{httpsCertFile: filepath.Join(dir, "cert.pem"), httpsKeyFile: filepath.Join(dir, "key.pem")}
+	if err := r.ReloadCertificate(); err == nil {
+		t.Error("Expected error without a certificate loaded from files")
+	}
+	writeCert := func(name string, mod time.Time) {
+		cert := testCert(t, name)
+		key, _ := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+		os.WriteFile(r.httpsCertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+		os.WriteFile(r.httpsKeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600)
+		os.Chtimes(r.httpsCertFile, mod, mod)
+		os.Chtimes(r.httpsKeyFile, mod, mod)
+	}
+	servedName := func() string {
+		state, err := handshake(r.tlsConfig, "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state.PeerCertificates[0].Subject.CommonName
+	}
+
+	start := time.Now().Add(-time.Minute)
+	writeCert("old.example.com", start)
+	r.secure = true
+	r.serverIPPort = "127.0.0.1:0"
+	if err := r.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.listener.Close()
+	r.Stop()
+	if got := servedName(); got != "old.example.com" {
+		t.Errorf("Expected old certificate, got %v", got)
+	}
+	if exp := r.certs.expiry(); time.Until(exp) > time.Hour || time.Until(exp) < 0 {
+		t.Errorf("Expected expiry within the hour, got %v", exp)
+	}
+
+	// Unchanged files are not reloaded, renewed ones are served to new handshakes.
+	if err := r.ReloadCertificate(); err != nil || r.certs.reloads != 0 {
+		t.Errorf("Expected no reload of unchanged files, got %v %v", r.certs.reloads, err)
+	}
+	writeCert("new.example.com", start.Add(time.Second))
+	if err := r.ReloadCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedName(); got != "new.example.com" || r.certs.reloads != 1 {
+		t.Errorf("Expected renewed certificate, got %v after %v reloads", got, r.certs.reloads)
+	}
+
+	// A broken renewal keeps the current certificate.
+	os.WriteFile(r.httpsKeyFile, []byte("garbage"), 0600)
+	os.Chtimes(r.httpsKeyFile, start.Add(2*time.Second), start.Add(2*time.Second))
+	if err := r.ReloadCertificate(); err == nil {
+		t.Error("Expected error loading broken files")
+	}
+	if got := servedName(); got != "new.example.com" {
+		t.Errorf("Expected current certificate kept, got %v", got)
+	}
+}
@@ -0,0 +1,179 @@
+package webtunnelserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+)
+
+// configLease is a client config fetched out-of-band, holding its IP until a connection
+// claims it.
+type configLease struct {
+	ip       string
+	username string      // Authenticated user the lease was issued to, empty without authentication.
+	timer    *time.Timer // Releases the IP if the lease is not claimed in time.
+}
+
+// configLeases holds the unclaimed config leases keyed by session token.
+type configLeases struct {
+	leaseTime time.Duration
+	pending   map[string]*configLease
+	lock      sync.Mutex
+}
+
+/*
+SetConfigEndpoint serves client configs out-of-band on /config, so clients can fetch and
+validate their IP, routes and DNS over HTTPS before opening the websocket, eg. to
+pre-provision their interface. Requests are authenticated like websocket handshakes. The
+IP of a config is held for leaseTime and claimed by the handshake presenting the session
+token of the config in wc.LeaseHeader; IPs not claimed in time are released. This should
+be called prior to Start.
+*/
+func (r *WebTunnelServer) SetConfigEndpoint(leaseTime time.Duration) error {
+	if leaseTime <= 0 {
+		return fmt.Errorf("invalid config lease time %v", leaseTime)
+	}
+	r.leases = &configLeases{
+		leaseTime: leaseTime,
+		pending:   make(map[string]*configLease),
+	}
+	return nil
+}
+
+// configEndpoint leases a client config. The hostname query parameter names the client host
+// and, without authentication, the username parameter its user.
+func (r *WebTunnelServer) configEndpoint(w http.ResponseWriter, rcv *http.Request) {
+	if r.leases == nil {
+		http.NotFound(w, rcv)
+		return
+	}
+	if rcv.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.ipam.RejectSessions() {
+		glog.Warningf("refused config lease to %v, IP pool critical", rcv.RemoteAddr)
+		http.Error(w, "IP Pool Exhausted", http.StatusServiceUnavailable)
+		return
+	}
+	if r.isBanned(remoteHost(rcv.RemoteAddr)) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	ctx, ok := r.authenticate(rcv.Context(), w, rcv)
+	if !ok {
+		return
+	}
+	ctx = withIdentities(ctx, rcv)
+	// The restriction of agent sessions is applied to their in-band config.
+	if agentRestriction(ctx) != nil {
+		http.Error(w, "Config Leases Not Available To Agents", http.StatusForbidden)
+		return
+	}
+
+	username := rcv.URL.Query().Get("username")
+	hostname := rcv.URL.Query().Get("hostname")
+	if username == "" || hostname == "" {
+		username = "guest"
+		hostname = "workstation"
+	}
+	if u := authUser(ctx); u != "" {
+		username = u
+	}
+	if r.isBanned(username) {
+		glog.Warningf("refused config lease to banned %v from %v", username, rcv.RemoteAddr)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !r.inAccessWindow(username, hostname, time.Now()) {
+		glog.Warningf("refused config lease to %s@%s outside access window", username, hostname)
+		http.Error(w, "Outside Access Window", http.StatusForbidden)
+		return
+	}
+
+	ip, err := r.ipam.AcquireIPFor(nil, connIdentities(ctx)...)
+	if err != nil {
+		glog.Errorf("Error acquiring IP for config lease: %v", err)
+		http.Error(w, "IP Pool Exhausted", http.StatusServiceUnavailable)
+		return
+	}
+	routes := r.routePrefix
+	if r.quarantine != nil {
+		routes = r.quarantine.routePrefix
+	}
+	cfg, err := r.clientConfig(ip, routes)
+	if err != nil {
+		r.ipam.ReleaseIP(ip)
+		glog.Errorf("Error creating config lease: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	session := newSessionToken()
+	expiry := time.Now().Add(r.leases.leaseTime)
+	cfg.ServerInfo.Session = session
+	cfg.LeaseExpiry = &expiry
+
+	r.leases.lock.Lock()
+	r.leases.pending[session] = &configLease{
+		ip:       ip,
+		username: authUser(ctx),
+		timer:    time.AfterFunc(r.leases.leaseTime, func() { r.expireLease(session) }),
+	}
+	r.leases.lock.Unlock()
+	// The connection claiming the lease continues its token.
+	r.tokens.issue(session, owner(ctx, username), expiry)
+	glog.Infof("Config lease of %v to %s@%s until %v", ip, username, hostname, expiry.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(cfg)
+}
+
+// valid returns true if token is an unclaimed lease issued to username.
+func (l *configLeases) valid(token, username string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	lease, ok := l.pending[token]
+	return ok && lease.username == username
+}
+
+// claimLease hands the IP of the lease token over to the connection ws of username and
+// returns it.
+func (r *WebTunnelServer) claimLease(ws *wc.WSWriter, token, username string) (string, error) {
+	if r.leases == nil {
+		return "", fmt.Errorf("config leases not enabled")
+	}
+	r.leases.lock.Lock()
+	lease, ok := r.leases.pending[token]
+	if !ok || lease.username != username {
+		r.leases.lock.Unlock()
+		return "", fmt.Errorf("unknown or expired config lease")
+	}
+	lease.timer.Stop()
+	delete(r.leases.pending, token)
+	r.leases.lock.Unlock()
+
+	if err := r.ipam.ClaimIP(lease.ip, ws); err != nil {
+		r.ipam.ReleaseIP(lease.ip)
+		return "", err
+	}
+	return lease.ip, nil
+}
+
+// expireLease releases the IP of the lease token if it was not claimed in time.
+func (r *WebTunnelServer) expireLease(token string) {
+	r.leases.lock.Lock()
+	lease, ok := r.leases.pending[token]
+	delete(r.leases.pending, token)
+	r.leases.lock.Unlock()
+	if !ok {
+		return
+	}
+	r.ipam.ReleaseIP(lease.ip)
+	glog.V(1).Infof("Config lease of %v expired unclaimed", lease.ip)
+}
@@ -0,0 +1,92 @@
+package webtunnelserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/gorilla/websocket"
+)
+
+func TestConfigLease(t *testing.T) {
+	r, err := NewWebTunnelServer("127.0.0.1:0", "192.168.0.1", "255.255.255.0", "192.168.0.0/24",
+		nil, []string{"1.1.1.0/24"}, false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(r.ServeMux())
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	fetch := func() *wc.ClientConfig {
+		resp, err := http.Get(srv.URL + "/config?username=user&hostname=host")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected config, got %v", resp.Status)
+		}
+		cfg := &wc.ClientConfig{}
+		if err := json.NewDecoder(resp.Body).Decode(cfg); err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+
+	// Disabled by default.
+	if resp, err := http.Get(srv.URL + "/config"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 without config endpoint, got %v %v", resp, err)
+	}
+	if err := r.SetConfigEndpoint(0); err == nil {
+		t.Error("Expected error for zero lease time")
+	}
+	if err := r.SetConfigEndpoint(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second lease doesn't get the IP held by the first.
+	lease := fetch()
+	if lease.LeaseExpiry == nil || lease.ServerInfo.Session == "" {
+		t.Fatalf("Expected lease, got %+v", lease)
+	}
+	if other := fetch(); other.IP == lease.IP {
+		t.Errorf("Expected leases on different IPs, got %v", other.IP)
+	}
+
+	// The handshake presenting the lease gets its IP and session.
+	c, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{wc.LeaseHeader: {lease.ServerInfo.Session}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.WriteMessage(websocket.TextMessage, []byte("getConfig user host "+lease.ServerInfo.Session))
+	cfg := &wc.ClientConfig{}
+	if err := c.ReadJSON(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.IP != lease.IP || cfg.ServerInfo.Session != lease.ServerInfo.Session {
+		t.Errorf("Expected config of lease %v %v, got %v %v", lease.IP, lease.ServerInfo.Session, cfg.IP, cfg.ServerInfo.Session)
+	}
+
+	// Leases are claimed once.
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{wc.LeaseHeader: {lease.ServerInfo.Session}})
+	if err == nil || resp.StatusCode != http.StatusGone {
+		t.Errorf("Expected 410 for claimed lease, got %v", err)
+	}
+
+	// Unclaimed leases release their IP.
+	r.leases.leaseTime = 100 * time.Millisecond
+	expiring := fetch()
+	time.Sleep(300 * time.Millisecond)
+	if _, err := r.claimLease(nil, expiring.ServerInfo.Session, ""); err == nil {
+		t.Error("Expected expired lease")
+	}
+	if again := fetch(); again.IP != expiring.IP {
+		t.Errorf("Expected released IP %v leased again, got %v", expiring.IP, again.IP)
+	}
+}
@@ -0,0 +1,223 @@
+package webtunnelserver
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Idle time after which a flow is removed from the flow table.
+const defaultFlowTimeout = 5 * time.Minute
+
+// MaxFlowsPerSession (Overridable) is the size of the flow table of a session. A new flow
+// of a full table evicts the least recently seen flow, closed flows first, so a client
+// opening flows quickly can't grow the server memory.
+var MaxFlowsPerSession = 4096
+
+// FlowState is the connection tracking state of a flow.
+type FlowState string
+
+const (
+	FlowNew         FlowState = "new"         // Packets seen in one direction only.
+	FlowEstablished FlowState = "established" // Packets seen in both directions.
+	FlowClosed      FlowState = "closed"      // TCP FIN or RST seen.
+)
+
+// FlowKey is the 5-tuple of a flow, as seen from the client.
+type FlowKey struct {
+	Proto   string // Protocol name eg. TCP, UDP, ICMPv4.
+	SrcIP   string // Client tunnel IP.
+	SrcPort uint16 // Client port.
+	DstIP   string // Remote IP.
+	DstPort uint16 // Remote port.
+}
+
+// String returns the flow key in proto src:port->dst:port form.
+func (k FlowKey) String() string {
+	return fmt.Sprintf("%v %v:%v->%v:%v", k.Proto, k.SrcIP, k.SrcPort, k.DstIP, k.DstPort)
+}
+
+// Flow is an entry in a session flow table.
+type Flow struct {
+	Key       FlowKey   // Flow 5-tuple.
+	State     FlowState // Connection state.
+	FirstSeen time.Time // Time of the first packet.
+	LastSeen  time.Time // Time of the last packet.
+	BytesOut  int       // Bytes sent by the client.
+	BytesIn   int       // Bytes received by the client.
+	Packets   int       // Packets in both directions.
+}
+
+// Age returns the time since the first packet of the flow.
+func (f Flow) Age() time.Duration {
+	return time.Since(f.FirstSeen)
+}
+
+// connTrack holds the flow tables of all sessions.
+type connTrack struct {
+	timeout   time.Duration                // Idle timeout of flows.
+	flows     map[string]map[FlowKey]*Flow // Flow table per client IP.
+	lastPrune map[string]time.Time         // Last expiry run per client IP.
+	lock      sync.Mutex
+}
+
+// SetConnTracking enables per session connection tracking. Flows idle for longer than
+// timeout are expired (0 uses the default). This should be called prior to Start.
+func (r *WebTunnelServer) SetConnTracking(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultFlowTimeout
+	}
+	r.connTrack = &connTrack{
+		timeout:   timeout,
+		flows:     make(map[string]map[FlowKey]*Flow),
+		lastPrune: make(map[string]time.Time),
+	}
+}
+
+// Flows returns a snapshot of the flow table of the client on ip, oldest flow first.
+// It is served by the admin API (see SetAdminAPI) for diagnosing stuck connections. Addresses
+// are anonymized if the privacy policy requires it (see webtunnelcommon.SetPrivacyPolicy).
+func (r *WebTunnelServer) Flows(ip string) []Flow {
+	ct := r.connTrack
+	if ct == nil {
+		return nil
+	}
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	ct.prune(ip, time.Now())
+	var flows []Flow
+	anonymize := wc.Privacy().AnonymizeIPs
+	for _, f := range ct.flows[ip] {
+		flow := *f
+		if anonymize {
+			flow.Key.SrcIP = wc.LogIP(net.ParseIP(flow.Key.SrcIP))
+			flow.Key.DstIP = wc.LogIP(net.ParseIP(flow.Key.DstIP))
+		}
+		flows = append(flows, flow)
+	}
+	sort.Slice(flows, func(i, j int) bool { return flows[i].FirstSeen.Before(flows[j].FirstSeen) })
+	return flows
+}
+
+// trackPacket updates the flow table of the client on ip with an IPv4 packet.
+func (r *WebTunnelServer) trackPacket(ip string, dir Direction, pkt []byte) {
+	ct := r.connTrack
+	if ct == nil {
+		return
+	}
+	packet := gopacket.NewPacket(pkt, layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		return
+	}
+	// Only the first fragment carries the ports; later fragments are not tracked.
+	if ip4.FragOffset != 0 {
+		return
+	}
+	transport := packet.TransportLayer()
+	if ip4.Flags&layers.IPv4MoreFragments != 0 {
+		transport = gopacket.NewPacket(ip4.Payload, ip4.Protocol.LayerType(), gopacket.DecodeOptions{Lazy: true, NoCopy: true}).TransportLayer()
+	}
+	key := FlowKey{Proto: ip4.Protocol.String()}
+	var srcPort, dstPort uint16
+	var closed, syn bool
+	switch l := transport.(type) {
+	case *layers.TCP:
+		srcPort, dstPort = uint16(l.SrcPort), uint16(l.DstPort)
+		closed = l.FIN || l.RST
+		syn = l.SYN && !l.ACK
+	case *layers.UDP:
+		srcPort, dstPort = uint16(l.SrcPort), uint16(l.DstPort)
+	}
+	// Normalize the key to the client side of the flow.
+	if dir == FromClient {
+		key.SrcIP, key.SrcPort, key.DstIP, key.DstPort = ip4.SrcIP.String(), srcPort, ip4.DstIP.String(), dstPort
+	} else {
+		key.SrcIP, key.SrcPort, key.DstIP, key.DstPort = ip4.DstIP.String(), dstPort, ip4.SrcIP.String(), srcPort
+	}
+	now := time.Now()
+
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	table, ok := ct.flows[ip]
+	if !ok {
+		table = make(map[FlowKey]*Flow)
+		ct.flows[ip] = table
+	}
+	f, ok := table[key]
+	if !ok && len(table) >= MaxFlowsPerSession {
+		ct.prune(ip, now)
+		ct.evict(table)
+	}
+	// A SYN on a closed flow reuses its ports for a new connection.
+	if !ok || (syn && f.State == FlowClosed) {
+		f = &Flow{Key: key, State: FlowNew, FirstSeen: now}
+		table[key] = f
+	}
+	if dir == FromClient {
+		f.BytesOut += len(pkt)
+	} else {
+		f.BytesIn += len(pkt)
+	}
+	f.Packets++
+	f.LastSeen = now
+	switch {
+	case closed:
+		f.State = FlowClosed
+	case f.State == FlowNew && f.BytesOut > 0 && f.BytesIn > 0:
+		f.State = FlowEstablished
+	}
+	if now.Sub(ct.lastPrune[ip]) > ct.timeout {
+		ct.prune(ip, now)
+	}
+}
+
+// prune expires idle flows of the client on ip. Must be called with the lock held.
+func (ct *connTrack) prune(ip string, now time.Time) {
+	for k, f := range ct.flows[ip] {
+		if now.Sub(f.LastSeen) > ct.timeout {
+			delete(ct.flows[ip], k)
+		}
+	}
+	ct.lastPrune[ip] = now
+}
+
+// evict removes flows of a full table, closed flows first and then the least recently
+// seen. Must be called with the lock held.
+func (ct *connTrack) evict(table map[FlowKey]*Flow) {
+	for len(table) > 0 && len(table) >= MaxFlowsPerSession {
+		var victim *Flow
+		for _, f := range table {
+			if victim == nil || evictsBefore(f, victim) {
+				victim = f
+			}
+		}
+		delete(table, victim.Key)
+	}
+}
+
+// evictsBefore returns true if flow a is evicted before flow b.
+func evictsBefore(a, b *Flow) bool {
+	if ac, bc := a.State == FlowClosed, b.State == FlowClosed; ac != bc {
+		return ac
+	}
+	return a.LastSeen.Before(b.LastSeen)
+}
+
+// releaseConnTrack removes the flow table of a disconnected client.
+func (r *WebTunnelServer) releaseConnTrack(ip string) {
+	ct := r.connTrack
+	if ct == nil {
+		return
+	}
+	ct.lock.Lock()
+	delete(ct.flows, ip)
+	delete(ct.lastPrune, ip)
+	ct.lock.Unlock()
+}
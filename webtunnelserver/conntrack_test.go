@@ -0,0 +1,120 @@
+package webtunnelserver
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func createTCPPkt(srcIP, dstIP net.IP, srcPort, dstPort int, fin bool) []byte {
+	return createTCPFlagsPkt(srcIP, dstIP, srcPort, dstPort, &layers.TCP{FIN: fin})
+}
+
+func createTCPFlagsPkt(srcIP, dstIP net.IP, srcPort, dstPort int, tcp *layers.TCP) []byte {
+	tcp.SrcPort, tcp.DstPort = layers.TCPPort(srcPort), layers.TCPPort(dstPort)
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: srcIP, DstIP: dstIP},
+		tcp, gopacket.Payload([]byte{1, 2, 3, 4}))
+	return buf.Bytes()
+}
+
+func TestConnTrack(t *testing.T) {
+	r := &WebTunnelServer{}
+	client, remote := net.IP{192, 168, 0, 2}, net.IP{172, 16, 0, 1}
+	r.trackPacket("192.168.0.2", FromClient, createTCPPkt(client, remote, 40000, 80, false))
+	if f := r.Flows("192.168.0.2"); f != nil {
+		t.Fatalf("Expected no flows with tracking disabled, got %v", f)
+	}
+
+	r.SetConnTracking(0)
+	out := createTCPPkt(client, remote, 40000, 80, false)
+	r.trackPacket("192.168.0.2", FromClient, out)
+	flows := r.Flows("192.168.0.2")
+	if len(flows) != 1 || flows[0].State != FlowNew {
+		t.Fatalf("Expected 1 new flow, got %v", flows)
+	}
+	want := FlowKey{Proto: "TCP", SrcIP: "192.168.0.2", SrcPort: 40000, DstIP: "172.16.0.1", DstPort: 80}
+	if flows[0].Key != want {
+		t.Errorf("Expected key %v, got %v", want, flows[0].Key)
+	}
+
+	in := createTCPPkt(remote, client, 80, 40000, false)
+	r.trackPacket("192.168.0.2", ToClient, in)
+	flows = r.Flows("192.168.0.2")
+	if len(flows) != 1 || flows[0].State != FlowEstablished {
+		t.Fatalf("Expected 1 established flow, got %v", flows)
+	}
+	if flows[0].BytesOut != len(out) || flows[0].BytesIn != len(in) || flows[0].Packets != 2 {
+		t.Errorf("Unexpected flow counters %+v", flows[0])
+	}
+
+	r.trackPacket("192.168.0.2", FromClient, createTCPPkt(client, remote, 40000, 80, true))
+	if flows = r.Flows("192.168.0.2"); flows[0].State != FlowClosed {
+		t.Errorf("Expected closed flow, got %v", flows[0].State)
+	}
+
+	// A SYN reusing the ports of the closed flow starts a new connection.
+	r.trackPacket("192.168.0.2", FromClient, createTCPFlagsPkt(client, remote, 40000, 80, &layers.TCP{SYN: true}))
+	if flows = r.Flows("192.168.0.2"); len(flows) != 1 || flows[0].State != FlowNew || flows[0].Packets != 1 {
+		t.Errorf("Expected new flow after SYN, got %+v", flows)
+	}
+
+	r.releaseConnTrack("192.168.0.2")
+	if flows = r.Flows("192.168.0.2"); len(flows) != 0 {
+		t.Errorf("Expected empty flow table after release, got %v", flows)
+	}
+}
+
+func TestConnTrackLimit(t *testing.T) {
+	defer func(n int) { MaxFlowsPerSession = n }(MaxFlowsPerSession)
+	MaxFlowsPerSession = 3
+	r := &WebTunnelServer{}
+	r.SetConnTracking(0)
+	client, remote := net.IP{192, 168, 0, 2}, net.IP{172, 16, 0, 1}
+	for port := 1; port <= 3; port++ {
+		r.trackPacket("192.168.0.2", FromClient, createTCPPkt(client, remote, 40000+port, 80, port == 2))
+	}
+	// The closed flow is evicted first, then the least recently seen.
+	for port := 4; port <= 5; port++ {
+		r.trackPacket("192.168.0.2", FromClient, createTCPPkt(client, remote, 40000+port, 80, false))
+	}
+	flows := r.Flows("192.168.0.2")
+	if len(flows) != 3 {
+		t.Fatalf("Expected 3 flows, got %v", flows)
+	}
+	for i, port := range []uint16{40003, 40004, 40005} {
+		if flows[i].Key.SrcPort != port {
+			t.Errorf("Expected flow from port %v kept, got %v", port, flows[i].Key)
+		}
+	}
+}
+
+func TestPrivacyPolicy(t *testing.T) {
+	defer wc.SetPrivacyPolicy(wc.PrivacyPolicy{})
+	remote := net.IP{172, 16, 0, 1}
+	if wc.LogIP(remote) != "172.16.0.1" || wc.LogName("example.com") != "example.com" {
+		t.Error("Expected details logged without a privacy policy")
+	}
+
+	wc.SetPrivacyPolicy(wc.PrivacyPolicy{RedactPayload: true, AnonymizeIPs: true})
+	anon := wc.LogIP(remote)
+	if !strings.HasPrefix(anon, "anon-") || anon != wc.LogIP(net.IP{172, 16, 0, 1}) || anon == wc.LogIP(net.IP{172, 16, 0, 2}) {
+		t.Errorf("Expected stable distinct pseudonyms, got %v", anon)
+	}
+	if wc.LogName("example.com") == "example.com" {
+		t.Error("Expected DNS name redacted")
+	}
+
+	r := &WebTunnelServer{}
+	r.SetConnTracking(0)
+	r.trackPacket("192.168.0.2", FromClient, createTCPPkt(net.IP{192, 168, 0, 2}, remote, 40000, 80, false))
+	flows := r.Flows("192.168.0.2")
+	if len(flows) != 1 || flows[0].Key.DstIP != anon || flows[0].Key.DstPort != 80 {
+		t.Errorf("Expected flow with anonymized address, got %v", flows)
+	}
+}
@@ -0,0 +1,150 @@
+package webtunnelserver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+)
+
+// Capabilities the server accepts from clients speaking control messages.
+var serverCapabilities = []string{wc.CapPing, wc.CapMetrics, wc.CapDisconnect}
+
+// clientReport is the last metrics report of a client.
+type clientReport struct {
+	metrics map[string]float64
+	time    time.Time
+}
+
+// textVerb returns the command of the text message, the type of ctl if it is a control
+// message.
+func textVerb(message []byte, ctl *wc.ControlMessage) string {
+	if ctl != nil {
+		return string(ctl.Type)
+	}
+	verb, _, _ := strings.Cut(string(message), " ")
+	return verb
+}
+
+// configRequest returns the config request of the text message, nil if it is not one.
+// Clients without control messages send "getConfig <user> <host> [session]" or
+// "resume <session>".
+func configRequest(message []byte, ctl *wc.ControlMessage) *wc.ConfigRequest {
+	if ctl != nil {
+		if ctl.Type != wc.CtlConfigRequest {
+			return nil
+		}
+		return ctl.ConfigRequest
+	}
+	msg := strings.Split(string(message), " ")
+	switch msg[0] {
+	case "resume":
+		return &wc.ConfigRequest{Session: strings.TrimPrefix(string(message), "resume "), Resume: true}
+	case "getConfig":
+		req := &wc.ConfigRequest{}
+		if len(msg) >= 3 {
+			req.Username, req.Hostname = msg[1], msg[2]
+		}
+		if len(msg) > 3 {
+			req.Session = msg[3]
+		}
+		return req
+	}
+	return nil
+}
+
+// writeConfig answers req with cfg, in a control message if the request was one. The
+// capabilities accepted for the client are kept for the session on ip.
+func (r *WebTunnelServer) writeConfig(ws *wc.WSWriter, ip string, cfg *wc.ClientConfig, req *wc.ConfigRequest, ctl bool) error {
+	if !ctl {
+		return ws.WriteEncoded(cfg)
+	}
+	caps := wc.NegotiateCapabilities(req.Capabilities, serverCapabilities)
+	r.connMapLock.Lock()
+	if r.capabilities == nil {
+		r.capabilities = make(map[string][]string)
+	}
+	r.capabilities[ip] = caps
+	r.connMapLock.Unlock()
+	return ws.WriteControl(&wc.ControlMessage{Type: wc.CtlConfigResponse,
+		ConfigResponse: &wc.ConfigResponse{Config: cfg, Capabilities: caps}})
+}
+
+// hasCapability returns true if the client on ip accepted capability c.
+func (r *WebTunnelServer) hasCapability(ip, c string) bool {
+	r.connMapLock.Lock()
+	defer r.connMapLock.Unlock()
+	return wc.HasCapability(r.capabilities[ip], c)
+}
+
+// processControl processes a control message from the client on ip other than a config
+// request. Messages the server does not know are answered with an error.
+func (r *WebTunnelServer) processControl(ws *wc.WSWriter, ip string, m *wc.ControlMessage) {
+	switch {
+	case m.Type == wc.CtlPing && m.Ping != nil && !m.Ping.Reply:
+		reply := *m.Ping
+		reply.Reply = true
+		if err := ws.WriteControl(&wc.ControlMessage{Type: wc.CtlPing, Ping: &reply}); err != nil {
+			glog.Warningf("error answering ping of %v: %v", ip, err)
+		}
+	case m.Type == wc.CtlMetrics:
+		r.connMapLock.Lock()
+		if r.clientReports == nil {
+			r.clientReports = make(map[string]clientReport)
+		}
+		r.clientReports[ip] = clientReport{metrics: m.Metrics, time: time.Now()}
+		r.connMapLock.Unlock()
+	case m.Type == wc.CtlDisconnect && m.Disconnect != nil:
+		glog.Infof("Client on %v disconnecting: %v", ip, m.Disconnect.Reason)
+	case m.Type == wc.CtlError && m.Error != nil:
+		glog.Warningf("Client on %v refused %v: %v", ip, m.Error.Type, m.Error.Message)
+	default:
+		glog.Warningf("refusing %v control message from %v", m.Type, ip)
+		ws.WriteControl(&wc.ControlMessage{Type: wc.CtlError,
+			Error: &wc.ControlError{Type: m.Type, Message: "unsupported or malformed message"}})
+	}
+}
+
+// sendDisconnect tells the client on ip why its connection is about to be closed, if it
+// accepts disconnect messages.
+func (r *WebTunnelServer) sendDisconnect(ws *wc.WSWriter, ip, reason string) {
+	if !r.hasCapability(ip, wc.CapDisconnect) {
+		return
+	}
+	if err := ws.WriteControl(&wc.ControlMessage{Type: wc.CtlDisconnect, Disconnect: &wc.Disconnect{Reason: reason}}); err != nil {
+		glog.V(1).Infof("error sending disconnect to %v: %v", ip, err)
+	}
+}
+
+// RequestClientMetrics asks the client on ip to report its metrics, returned by
+// ClientMetrics once they arrive. The client must have accepted the metrics capability.
+func (r *WebTunnelServer) RequestClientMetrics(ip string) error {
+	if !r.hasCapability(ip, wc.CapMetrics) {
+		return fmt.Errorf("client on %v does not report metrics", ip)
+	}
+	r.connMapLock.Lock()
+	ws, ok := r.conns[ip]
+	r.connMapLock.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: no connection for %v", ErrIPNotAllocated, ip)
+	}
+	return ws.WriteControl(&wc.ControlMessage{Type: wc.CtlMetrics})
+}
+
+// ClientMetrics returns the last metrics reported by the client on ip and when they
+// were reported.
+func (r *WebTunnelServer) ClientMetrics(ip string) (map[string]float64, time.Time, error) {
+	r.connMapLock.Lock()
+	defer r.connMapLock.Unlock()
+	rep, ok := r.clientReports[ip]
+	if !ok {
+		return nil, time.Time{}, fmt.Errorf("no metrics reported by client on %v", ip)
+	}
+	m := make(map[string]float64, len(rep.metrics))
+	for k, v := range rep.metrics {
+		m[k] = v
+	}
+	return m, rep.time, nil
+}
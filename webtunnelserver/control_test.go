@@ -0,0 +1,134 @@
+package webtunnelserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/gorilla/websocket"
+)
+
+func TestControlMessages(t *testing.T) {
+	r, err := NewWebTunnelServer("127.0.0.1:0", "192.168.0.1", "255.255.255.0", "192.168.0.0/24",
+		nil, []string{"1.1.1.0/24"}, false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(r.wsEndpoint))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	// Servers only speak the version both sides support.
+	header := http.Header{}
+	header.Set(wc.ControlHeader, "7")
+	c, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v := resp.Header.Get(wc.ControlHeader); v != "1" {
+		t.Errorf("Expected control version 1, got %q", v)
+	}
+	write := func(m *wc.ControlMessage) {
+		t.Helper()
+		b, err := wc.EncodeControlMessage(wc.JSONCodec{}, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.WriteMessage(websocket.TextMessage, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func() *wc.ControlMessage {
+		t.Helper()
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, b, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := wc.ParseControlMessage(wc.JSONCodec{}, b)
+		if err != nil {
+			t.Fatalf("Expected control message, got %q: %v", b, err)
+		}
+		return m
+	}
+
+	// Config request with capability negotiation.
+	write(&wc.ControlMessage{Type: wc.CtlConfigRequest, ConfigRequest: &wc.ConfigRequest{Username: "user",
+		Hostname: "host", Capabilities: []string{wc.CapMetrics, "teleport", wc.CapPing}}})
+	m := read()
+	if m.Type != wc.CtlConfigResponse || m.ConfigResponse == nil || m.ConfigResponse.Config == nil {
+		t.Fatalf("Expected config response, got %+v", m)
+	}
+	ip := m.ConfigResponse.Config.IP
+	if caps := m.ConfigResponse.Capabilities; !reflect.DeepEqual(caps, []string{wc.CapMetrics, wc.CapPing}) {
+		t.Errorf("Unexpected capabilities %v", caps)
+	}
+	if u, err := r.ipam.GetUserinfo(ip); err != nil || u.Username != "user" || u.Hostname != "host" ||
+		u.Session != m.ConfigResponse.Config.ServerInfo.Session {
+		t.Errorf("Unexpected session of %v: %+v %v", ip, u, err)
+	}
+
+	// Pings are echoed.
+	write(&wc.ControlMessage{Type: wc.CtlPing, Ping: &wc.Ping{ID: 42}})
+	if m := read(); m.Type != wc.CtlPing || m.Ping == nil || m.Ping.ID != 42 || !m.Ping.Reply {
+		t.Errorf("Expected ping reply, got %+v", m)
+	}
+
+	// Metrics are requested from the client and kept.
+	if err := r.RequestClientMetrics(ip); err != nil {
+		t.Fatal(err)
+	}
+	if m := read(); m.Type != wc.CtlMetrics || len(m.Metrics) != 0 {
+		t.Errorf("Expected metrics request, got %+v", m)
+	}
+	write(&wc.ControlMessage{Type: wc.CtlMetrics, Metrics: map[string]float64{"packets": 3}})
+	time.Sleep(100 * time.Millisecond)
+	if got, _, err := r.ClientMetrics(ip); err != nil || got["packets"] != 3 {
+		t.Errorf("Expected reported metrics, got %v %v", got, err)
+	}
+
+	// Unknown messages of newer clients are refused without closing the connection.
+	write(&wc.ControlMessage{Version: 2, Type: "teleport"})
+	if m := read(); m.Type != wc.CtlError || m.Error == nil || m.Error.Type != "teleport" {
+		t.Errorf("Expected error, got %+v", m)
+	}
+	write(&wc.ControlMessage{Type: wc.CtlPing, Ping: &wc.Ping{ID: 43}})
+	if m := read(); m.Ping == nil || m.Ping.ID != 43 {
+		t.Errorf("Expected ping reply, got %+v", m)
+	}
+
+	// The disconnect capability was not accepted, no notice on shutdown.
+	if r.hasCapability(ip, wc.CapDisconnect) {
+		t.Error("Expected disconnect capability not negotiated")
+	}
+	r.releaseIP(ip)
+	if _, _, err := r.ClientMetrics(ip); err == nil {
+		t.Error("Expected metrics dropped with the session")
+	}
+	if err := r.RequestClientMetrics(ip); err == nil {
+		t.Error("Expected error requesting metrics of a released session")
+	}
+}
+
+func TestConfigRequest(t *testing.T) {
+	for _, tc := range []struct {
+		msg  string
+		want *wc.ConfigRequest
+	}{
+		{"getConfig user host", &wc.ConfigRequest{Username: "user", Hostname: "host"}},
+		{"getConfig user host token", &wc.ConfigRequest{Username: "user", Hostname: "host", Session: "token"}},
+		{"getConfig user host ", &wc.ConfigRequest{Username: "user", Hostname: "host"}},
+		{"getConfig", &wc.ConfigRequest{}},
+		{"resume token", &wc.ConfigRequest{Session: "token", Resume: true}},
+		{"keepalive 30", nil},
+	} {
+		if got := configRequest([]byte(tc.msg), nil); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: expected %+v, got %+v", tc.msg, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package webtunnelserver
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+)
+
+// SetServerList sets the gateways advertised on the /servers discovery endpoint. If key
+// is not nil the list is signed so clients can verify it. This should be called prior to Start.
+func (r *WebTunnelServer) SetServerList(servers []wc.GatewayEndpoint, key ed25519.PrivateKey) error {
+	list := &wc.ServerList{Servers: servers}
+	if key != nil {
+		var err error
+		if list, err = wc.SignServerList(servers, key); err != nil {
+			return err
+		}
+	}
+	r.serverList = list
+	return nil
+}
+
+// serversEndpoint serves the discovery server list as JSON.
+func (r *WebTunnelServer) serversEndpoint(w http.ResponseWriter, rcv *http.Request) {
+	if r.serverList == nil {
+		http.NotFound(w, rcv)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.serverList)
+}
@@ -1,9 +1,13 @@
 package webtunnelserver
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"sync"
+	"time"
 
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
 	"github.com/golang/glog"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -11,8 +15,11 @@ import (
 
 // DNSForwarder represents a DNS forwarder.
 type DNSForwarder struct {
-	handle *net.UDPConn
-	stop   bool
+	handle    *net.UDPConn
+	stopping  chan struct{}  // Closed by Stop.
+	stopOnce  sync.Once      // Closes stopping.
+	queries   sync.WaitGroup // Read loop and queries in flight.
+	upstreams *dnsUpstreams  // Upstream servers queries are forwarded to, nil to resolve locally.
 }
 
 // NewDNSForwarder returns a new initialized DNS forwarder.
@@ -24,30 +31,59 @@ func NewDNSForwarder(ip string, port int) (*DNSForwarder, error) {
 	}
 
 	return &DNSForwarder{
-		handle: h,
-		stop:   false,
+		handle:   h,
+		stopping: make(chan struct{}),
 	}, nil
 }
 
 // Start starts the dns forwarder.
 func (d *DNSForwarder) Start() {
+	d.queries.Add(1)
 	go d.listenServ()
 }
 
-// Stop stops the dns forwarder.
-func (d *DNSForwarder) Stop() {
-	d.stop = true
+// Stop stops reading queries, waits for the queries in flight to be answered until ctx
+// is done and closes the socket. It returns ctx.Err() if queries were abandoned.
+func (d *DNSForwarder) Stop(ctx context.Context) error {
+	d.stopOnce.Do(func() {
+		close(d.stopping)
+		// Unblocks the read loop; answers are still written.
+		d.handle.SetReadDeadline(time.Now())
+	})
+	drained := make(chan struct{})
+	go func() {
+		d.queries.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	d.handle.Close()
+	return err
+}
+
+// stopped returns true once Stop was called.
+func (d *DNSForwarder) stopped() bool {
+	select {
+	case <-d.stopping:
+		return true
+	default:
+		return false
+	}
 }
 
 func (d *DNSForwarder) listenServ() {
+	defer d.queries.Done()
 	pkt := make([]byte, 2048)
 	for {
-		if d.stop {
-			d.handle.Close()
+		n, peerAddr, err := d.handle.ReadFrom(pkt)
+		if d.stopped() {
+			glog.V(1).Info("Exiting DNS forwarder routine")
 			return
 		}
-
-		_, peerAddr, err := d.handle.ReadFrom(pkt)
 		if err != nil {
 			glog.Errorf("error reading from net %v", err)
 			return
@@ -67,7 +103,17 @@ func (d *DNSForwarder) listenServ() {
 		}
 
 		hostname := string(dnsReq.Questions[0].Name)
-		glog.Infof("Got from %v name resolution for %v", peerAddr, hostname)
+		glog.Infof("Got from %v name resolution for %v", peerAddr, wc.LogName(hostname))
+
+		// Upstreams answer all query types, concurrently so a slow query doesn't hold others.
+		if d.upstreams != nil {
+			d.queries.Add(1)
+			go func(query []byte) {
+				defer d.queries.Done()
+				d.forward(query, dnsReq, peerAddr)
+			}(append([]byte(nil), pkt[:n]...))
+			continue
+		}
 
 		// Only respond for support use cases.
 		if err := validateReq(dnsReq); err != nil {
@@ -82,7 +128,7 @@ func (d *DNSForwarder) listenServ() {
 		// Try to lookup hostname.
 		ips, err := net.LookupHost(hostname)
 		if err != nil {
-			glog.Warningf("Unable to resolve %v", hostname)
+			glog.Warningf("Unable to resolve %v", wc.LogName(hostname))
 			if err := d.sendResponse(dnsReq, peerAddr, nil, layers.DNSResponseCodeNXDomain); err != nil {
 				glog.Errorf("Error sending DNS response %v", err)
 				return
@@ -152,11 +198,11 @@ func (d *DNSForwarder) sendResponse(req *layers.DNS, peerAddr net.Addr, ips []st
 	buff := gopacket.NewSerializeBuffer()
 	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
 	if err := dns.SerializeTo(buff, opts); err != nil {
-		return fmt.Errorf("error serializing DNS response %v", err)
+		return fmt.Errorf("error serializing DNS response %w", err)
 	}
 
 	if _, err := d.handle.WriteTo(buff.Bytes(), peerAddr); err != nil {
-		return fmt.Errorf("error writing response to interface %v", err)
+		return fmt.Errorf("error writing response to interface %w", err)
 	}
 
 	return nil
@@ -1,6 +1,7 @@
 package webtunnelserver
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strconv"
@@ -18,7 +19,7 @@ func TestListenServ(t *testing.T) {
 	}
 
 	dnsForwarder.Start()
-	defer dnsForwarder.Stop()
+	defer dnsForwarder.Stop(context.Background())
 
 	time.Sleep(10 * time.Millisecond)
 
@@ -0,0 +1,80 @@
+package webtunnelserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+)
+
+/*
+SetDNSRoutes sends clients a split DNS map in their config: names under the domains of a
+route are resolved with its servers, other names with the default DNS servers. A domain
+may also be an IPv4 prefix (eg. 10.1.0.0/16), mapped to the in-addr.arpa zones covering
+it so reverse lookups of addresses behind the tunnel reach the resolver knowing them.
+Clients apply the map with the resolver of their platform. This should be called prior
+to Start.
+*/
+func (r *WebTunnelServer) SetDNSRoutes(routes []wc.DNSRoute) error {
+	var dnsRoutes []wc.DNSRoute
+	for _, rt := range routes {
+		if len(rt.Servers) == 0 {
+			return fmt.Errorf("no DNS servers for %v", rt.Domains)
+		}
+		for _, s := range rt.Servers {
+			if net.ParseIP(s).To4() == nil {
+				return fmt.Errorf("invalid DNS server %q", s)
+			}
+		}
+		var domains []string
+		for _, d := range rt.Domains {
+			if _, n, err := net.ParseCIDR(d); err == nil {
+				zones, err := reverseZones(n)
+				if err != nil {
+					return err
+				}
+				domains = append(domains, zones...)
+				continue
+			}
+			d = strings.ToLower(strings.Trim(d, "."))
+			if d == "" || strings.Trim(d, "abcdefghijklmnopqrstuvwxyz0123456789.-") != "" {
+				return fmt.Errorf("invalid DNS domain %q", d)
+			}
+			domains = append(domains, d)
+		}
+		if len(domains) == 0 {
+			return fmt.Errorf("no domains for DNS servers %v", rt.Servers)
+		}
+		dnsRoutes = append(dnsRoutes, wc.DNSRoute{Domains: domains, Servers: rt.Servers})
+	}
+	r.dnsRoutes = dnsRoutes
+	return nil
+}
+
+// reverseZones returns the in-addr.arpa zones covering the IPv4 prefix n, its length
+// rounded up to a whole octet, ie. at most 128 zones.
+func reverseZones(n *net.IPNet) ([]string, error) {
+	ones, bits := n.Mask.Size()
+	if bits != 32 {
+		return nil, fmt.Errorf("reverse zones of %v not supported, IPv4 only", n)
+	}
+	octets := (ones + 7) / 8
+	if octets == 0 {
+		return nil, fmt.Errorf("prefix %v too broad for reverse zones", n)
+	}
+	count := 1 << (octets*8 - ones)
+	base := binary.BigEndian.Uint32(n.IP.To4())
+	var zones []string
+	for i := 0; i < count; i++ {
+		ip := base + uint32(i)<<(32-octets*8)
+		var labels []string
+		for o := octets - 1; o >= 0; o-- {
+			labels = append(labels, strconv.Itoa(int(ip>>(24-8*o)&0xff)))
+		}
+		zones = append(zones, strings.Join(labels, ".")+".in-addr.arpa")
+	}
+	return zones, nil
+}
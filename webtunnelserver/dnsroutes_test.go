@@ -0,0 +1,58 @@
+package webtunnelserver
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+)
+
+func TestDNSRoutes(t *testing.T) {
+	r, err := NewWebTunnelServer("127.0.0.1:0", "192.168.0.1", "255.255.255.0", "192.168.0.0/24",
+		nil, []string{"1.1.1.0/24"}, false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range [][]wc.DNSRoute{
+		{{Domains: []string{"corp.example.com"}}},
+		{{Domains: []string{"corp.example.com"}, Servers: []string{"dns.example.com"}}},
+		{{Domains: []string{"bad domain"}, Servers: []string{"10.0.0.53"}}},
+		{{Domains: []string{"0.0.0.0/0"}, Servers: []string{"10.0.0.53"}}},
+		{{Servers: []string{"10.0.0.53"}}},
+	} {
+		if err := r.SetDNSRoutes(bad); err == nil {
+			t.Errorf("Expected error for %+v", bad)
+		}
+	}
+
+	if err := r.SetDNSRoutes([]wc.DNSRoute{
+		{Domains: []string{".Corp.Example.com.", "10.1.0.0/16"}, Servers: []string{"10.1.0.53"}},
+		{Domains: []string{"172.16.0.0/14"}, Servers: []string{"172.16.0.53", "172.16.0.54"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := r.clientConfig("192.168.0.2", r.routePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []wc.DNSRoute{
+		{Domains: []string{"corp.example.com", "1.10.in-addr.arpa"}, Servers: []string{"10.1.0.53"}},
+		{Domains: []string{"16.172.in-addr.arpa", "17.172.in-addr.arpa", "18.172.in-addr.arpa", "19.172.in-addr.arpa"},
+			Servers: []string{"172.16.0.53", "172.16.0.54"}},
+	}
+	if !reflect.DeepEqual(cfg.DNSRoutes, want) {
+		t.Errorf("Got DNS routes %+v want %+v", cfg.DNSRoutes, want)
+	}
+
+	for prefix, zone := range map[string]string{
+		"10.0.0.0/8":     "10.in-addr.arpa",
+		"192.168.1.0/24": "1.168.192.in-addr.arpa",
+		"192.168.1.7/32": "7.1.168.192.in-addr.arpa",
+	} {
+		_, n, _ := net.ParseCIDR(prefix)
+		if zones, err := reverseZones(n); err != nil || len(zones) != 1 || zones[0] != zone {
+			t.Errorf("Expected %v for %v, got %v %v", zone, prefix, zones, err)
+		}
+	}
+}
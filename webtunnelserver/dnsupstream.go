@@ -0,0 +1,218 @@
+package webtunnelserver
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// DNSUpstreamTimeout (Overridable) is how long an upstream DNS server has to answer a query.
+var DNSUpstreamTimeout = 2 * time.Second
+
+// UpstreamStats are the query statistics of an upstream DNS server.
+type UpstreamStats struct {
+	Addr     string        // Upstream host:port.
+	Queries  int           // Queries sent.
+	Answers  int           // Valid answers received.
+	Failures int           // Queries timed out, failed or answered with SERVFAIL or REFUSED.
+	Wins     int           // Answers relayed to the client, ie. first valid in racing mode.
+	Latency  time.Duration // Smoothed answer latency, failures count as DNSUpstreamTimeout.
+	Primary  bool          // Currently the fastest upstream, queried first without racing.
+}
+
+// dnsUpstreams holds the upstream servers and their statistics.
+type dnsUpstreams struct {
+	race  bool
+	stats []*UpstreamStats // In configured order.
+	lock  sync.Mutex
+}
+
+/*
+SetUpstreams forwards the client queries to the upstream DNS servers (host:port) instead
+of resolving them locally, which also forwards query types other than A. Without race
+queries go to the primary, the upstream with the lowest smoothed latency, and fall back
+to the next fastest on failure. With race every query is sent to all upstreams in
+parallel and the first valid answer is relayed, trading upstream load for lower tail
+latency. The latency of every answer updates the statistics returned by UpstreamStats.
+This should be called prior to Start.
+*/
+func (d *DNSForwarder) SetUpstreams(servers []string, race bool) error {
+	if len(servers) == 0 {
+		return fmt.Errorf("no upstream DNS servers")
+	}
+	u := &dnsUpstreams{race: race}
+	for _, s := range servers {
+		if _, err := net.ResolveUDPAddr("udp", s); err != nil {
+			return fmt.Errorf("invalid upstream DNS server %v: %w", s, err)
+		}
+		u.stats = append(u.stats, &UpstreamStats{Addr: s})
+	}
+	d.upstreams = u
+	return nil
+}
+
+// UpstreamStats returns the statistics of the upstream DNS servers in configured order.
+func (d *DNSForwarder) UpstreamStats() []UpstreamStats {
+	u := d.upstreams
+	if u == nil {
+		return nil
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	primary := u.ranked()[0]
+	var s []UpstreamStats
+	for _, st := range u.stats {
+		c := *st
+		c.Primary = st == primary
+		s = append(s, c)
+	}
+	return s
+}
+
+// ranked returns the upstreams fastest first. Upstreams without answers yet rank first
+// so they get measured. Must be called with the lock held.
+func (u *dnsUpstreams) ranked() []*UpstreamStats {
+	r := append([]*UpstreamStats(nil), u.stats...)
+	sort.SliceStable(r, func(i, j int) bool { return r[i].Latency < r[j].Latency })
+	return r
+}
+
+// record updates the statistics of s with the outcome of a query.
+func (u *dnsUpstreams) record(s *UpstreamStats, latency time.Duration, ok bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if ok {
+		s.Answers++
+	} else {
+		s.Failures++
+		latency = DNSUpstreamTimeout
+	}
+	if s.Answers+s.Failures == 1 {
+		s.Latency = latency
+		return
+	}
+	s.Latency += (latency - s.Latency) / 8
+}
+
+// forward resolves req with the upstream servers and relays the answer to peerAddr,
+// SERVFAIL if no upstream answered.
+func (d *DNSForwarder) forward(query []byte, req *layers.DNS, peerAddr net.Addr) {
+	u := d.upstreams
+	u.lock.Lock()
+	servers := u.ranked()
+	u.lock.Unlock()
+
+	var resp []byte
+	if u.race {
+		resp = d.race(query, req.ID, servers)
+	} else {
+		for _, s := range servers {
+			if resp = d.query(query, req.ID, s); resp != nil {
+				break
+			}
+		}
+	}
+
+	if resp == nil {
+		glog.Warningf("No upstream DNS server answered for %v", peerAddr)
+		if err := d.sendResponse(req, peerAddr, nil, layers.DNSResponseCodeServFail); err != nil {
+			glog.Errorf("Error sending DNS response %v", err)
+		}
+		return
+	}
+	if _, err := d.handle.WriteTo(resp, peerAddr); err != nil {
+		glog.Errorf("Error sending DNS response %v", err)
+	}
+}
+
+// upstreamAnswer is the answer of an upstream, nil if it failed.
+type upstreamAnswer struct {
+	resp     []byte
+	upstream *UpstreamStats
+}
+
+// race sends query to all servers in parallel and returns the first valid answer.
+func (d *DNSForwarder) race(query []byte, id uint16, servers []*UpstreamStats) []byte {
+	answers := make(chan upstreamAnswer, len(servers))
+	for _, s := range servers {
+		go func(s *UpstreamStats) {
+			answers <- upstreamAnswer{d.exchange(query, id, s), s}
+		}(s)
+	}
+	for range servers {
+		if a := <-answers; a.resp != nil {
+			d.upstreams.win(a.upstream)
+			return a.resp
+		}
+	}
+	return nil
+}
+
+// query sends query to s and returns its answer, nil if it failed.
+func (d *DNSForwarder) query(query []byte, id uint16, s *UpstreamStats) []byte {
+	resp := d.exchange(query, id, s)
+	if resp != nil {
+		d.upstreams.win(s)
+	}
+	return resp
+}
+
+// win counts the answer of s relayed to the client.
+func (u *dnsUpstreams) win(s *UpstreamStats) {
+	u.lock.Lock()
+	s.Wins++
+	u.lock.Unlock()
+}
+
+// exchange sends query to s and returns its answer if valid, ie. a response to the query
+// id other than SERVFAIL or REFUSED, nil otherwise.
+func (d *DNSForwarder) exchange(query []byte, id uint16, s *UpstreamStats) []byte {
+	u := d.upstreams
+	u.lock.Lock()
+	s.Queries++
+	u.lock.Unlock()
+
+	start := time.Now()
+	resp, err := exchangeUDP(query, id, s.Addr)
+	if err != nil {
+		glog.V(1).Infof("Upstream DNS %v failed: %v", s.Addr, err)
+	}
+	u.record(s, time.Since(start), err == nil)
+	return resp
+}
+
+// exchangeUDP sends query to addr from a new socket and waits for the response to id.
+func exchangeUDP(query []byte, id uint16, addr string) ([]byte, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(DNSUpstreamTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp, ok := gopacket.NewPacket(buf[:n], layers.LayerTypeDNS, gopacket.Default).Layer(layers.LayerTypeDNS).(*layers.DNS)
+		// Ignore stray or spoofed packets not answering this query.
+		if !ok || !resp.QR || resp.ID != id {
+			continue
+		}
+		if resp.ResponseCode == layers.DNSResponseCodeServFail || resp.ResponseCode == layers.DNSResponseCodeRefused {
+			return nil, fmt.Errorf("response code %v", resp.ResponseCode)
+		}
+		return buf[:n], nil
+	}
+}
@@ -0,0 +1,154 @@
+package webtunnelserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// fakeUpstream answers A queries with ip after delay, or with rcode if ip is nil.
+func fakeUpstream(t *testing.T, ip net.IP, rcode layers.DNSResponseCode, delay time.Duration) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		pkt := make([]byte, 2048)
+		for {
+			n, peer, err := conn.ReadFrom(pkt)
+			if err != nil {
+				return
+			}
+			req := gopacket.NewPacket(pkt[:n], layers.LayerTypeDNS, gopacket.Default).Layer(layers.LayerTypeDNS).(*layers.DNS)
+			resp := layers.DNS{ID: req.ID, QR: true, ResponseCode: rcode, Questions: req.Questions}
+			if ip != nil {
+				resp.Answers = []layers.DNSResourceRecord{{
+					Name: req.Questions[0].Name, Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 60, IP: ip,
+				}}
+			}
+			buf := gopacket.NewSerializeBuffer()
+			resp.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true})
+			go func() {
+				time.Sleep(delay)
+				conn.WriteTo(buf.Bytes(), peer)
+			}()
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestDNSUpstreams(t *testing.T) {
+	DNSUpstreamTimeout = 300 * time.Millisecond
+	slow := fakeUpstream(t, net.IPv4(10, 0, 0, 1), layers.DNSResponseCodeNoErr, 100*time.Millisecond)
+	fast := fakeUpstream(t, net.IPv4(10, 0, 0, 2), layers.DNSResponseCodeNoErr, 0)
+	failing := fakeUpstream(t, nil, layers.DNSResponseCodeServFail, 0)
+	dead := fakeUpstream(t, nil, layers.DNSResponseCodeNoErr, time.Hour)
+
+	tests := []struct {
+		name      string
+		servers   []string
+		race      bool
+		want      string
+		wantWins  []int
+		wantPrime int
+	}{
+		{"race", []string{slow, failing, fast}, true, "10.0.0.2", []int{0, 0, 3}, 2},
+		{"primary", []string{slow, fast}, false, "10.0.0.2", []int{1, 2}, 1},
+		{"fallback", []string{dead, failing, slow}, false, "10.0.0.1", []int{0, 0, 3}, 2},
+	}
+	for _, tc := range tests {
+		d, err := NewDNSForwarder("127.0.0.1", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.SetUpstreams(tc.servers, tc.race); err != nil {
+			t.Fatal(err)
+		}
+		d.Start()
+		conn, err := net.Dial("udp", d.handle.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			conn.Write(buildDNSRequest())
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			ip, err := readDNSReply(conn)
+			if err != nil {
+				t.Errorf("%v: %v", tc.name, err)
+			}
+			// Without racing upstreams are measured in turn before the fastest sticks.
+			if i == 2 && ip.String() != tc.want {
+				t.Errorf("%v: expected answer %v, got %v %v", tc.name, tc.want, ip, err)
+			}
+		}
+		conn.Close()
+		d.Stop(context.Background())
+		time.Sleep(200 * time.Millisecond) // Let the losing upstreams answer.
+
+		for i, s := range d.UpstreamStats() {
+			if s.Wins != tc.wantWins[i] {
+				t.Errorf("%v: expected %v wins for %v, got %+v", tc.name, tc.wantWins[i], s.Addr, s)
+			}
+			if s.Primary != (i == tc.wantPrime) {
+				t.Errorf("%v: expected primary %v, got %+v", tc.name, i == tc.wantPrime, s)
+			}
+		}
+	}
+
+	d, _ := NewDNSForwarder("127.0.0.1", 0)
+	if err := d.SetUpstreams([]string{"not an address"}, false); err == nil {
+		t.Error("Expected error for invalid upstream")
+	}
+}
+
+func TestDNSForwarderStop(t *testing.T) {
+	slow := fakeUpstream(t, net.IPv4(10, 0, 0, 1), layers.DNSResponseCodeNoErr, 200*time.Millisecond)
+	d, err := NewDNSForwarder("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetUpstreams([]string{slow}, false)
+	r := &WebTunnelServer{metrics: &Metrics{}}
+	r.SetDNSForwarder(d)
+	d.Start()
+
+	conn, err := net.Dial("udp", d.handle.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(buildDNSRequest())
+	time.Sleep(50 * time.Millisecond)
+
+	// The query in flight is answered before the socket closes.
+	r.Stop()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if ip, err := readDNSReply(conn); err != nil || !ip.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("Expected answer drained, got %v %v", ip, err)
+	}
+	if r.dns != nil {
+		t.Error("Expected forwarder unregistered")
+	}
+	if _, err := d.handle.WriteTo([]byte{0}, conn.LocalAddr()); err == nil {
+		t.Error("Expected socket closed")
+	}
+
+	// Queries abandoned at the deadline are reported.
+	d, _ = NewDNSForwarder("127.0.0.1", 0)
+	d.SetUpstreams([]string{fakeUpstream(t, nil, layers.DNSResponseCodeNoErr, time.Hour)}, false)
+	d.Start()
+	conn2, _ := net.Dial("udp", d.handle.LocalAddr().String())
+	defer conn2.Close()
+	conn2.Write(buildDNSRequest())
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := d.Stop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package webtunnelserver
+
+import (
+	"expvar"
+	"fmt"
+	"runtime"
+)
+
+// PublishExpvar publishes runtime and packet loop stats of the server as the expvar
+// variable name, served as JSON on /debug/vars of the debug endpoint (see
+// webtunnelcommon.ServeDebug) for debugging a live process.
+func (r *WebTunnelServer) PublishExpvar(name string) error {
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("expvar %v already published", name)
+	}
+	expvar.Publish(name, expvar.Func(r.expvarStats))
+	return nil
+}
+
+// expvarStats returns the stats published by PublishExpvar.
+func (r *WebTunnelServer) expvarStats() any {
+	m := r.GetMetrics()
+
+	var ctrlQueue, dataQueue int
+	r.connMapLock.Lock()
+	conns := len(r.conns)
+	for _, ws := range r.conns {
+		c, d := ws.QueueLen()
+		ctrlQueue += c
+		dataQueue += d
+	}
+	r.connMapLock.Unlock()
+
+	return map[string]any{
+		"goroutines":     runtime.NumGoroutine(),
+		"users":          m.Users,
+		"maxUsers":       m.MaxUsers,
+		"packets":        m.Packets,
+		"bytes":          m.Bytes,
+		"conns":          conns,
+		"ctrlQueueDepth": ctrlQueue,
+		"dataQueueDepth": dataQueue,
+		"stopped":        r.isStopped.Load(),
+		"latency":        m.Latency,
+		"loss":           m.Loss,
+		"tags":           m.Tags,
+		"labels":         m.Labels,
+	}
+}
@@ -0,0 +1,198 @@
+package webtunnelserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FragmentPolicy is how IPv4 fragments traversing the tunnel are handled.
+type FragmentPolicy int
+
+const (
+	FragmentPass       FragmentPolicy = iota // Forward fragments unchanged (default).
+	FragmentReassemble                       // Reassemble datagrams at the gateway.
+	FragmentDrop                             // Drop all fragments.
+)
+
+// Reassembly limits.
+const (
+	defaultFragTimeout = 30 * time.Second // Time to receive all fragments of a datagram.
+	defaultFragMax     = 1024             // Datagrams reassembled at once.
+	maxDatagramLen     = 65535            // Largest reassembled IPv4 datagram.
+)
+
+// fragKey identifies the fragments of a datagram (RFC 791).
+type fragKey struct {
+	src, dst [4]byte
+	id       uint16
+	proto    uint8
+}
+
+// fragPart is a received fragment payload at its offset in the datagram.
+type fragPart struct {
+	offset int
+	data   []byte
+}
+
+// fragBuffer holds the fragments of a datagram being reassembled.
+type fragBuffer struct {
+	header  []byte     // IP header of the first fragment, nil until received.
+	parts   []fragPart // Fragment payloads.
+	total   int        // Payload length, 0 until the last fragment is received.
+	size    int        // Payload bytes received.
+	started time.Time  // Arrival of the first received fragment.
+}
+
+// fragReassembler reassembles fragmented IPv4 datagrams.
+type fragReassembler struct {
+	timeout   time.Duration
+	max       int
+	buffers   map[fragKey]*fragBuffer
+	lastPrune time.Time
+	lock      sync.Mutex
+}
+
+func newFragReassembler(timeout time.Duration, max int) *fragReassembler {
+	return &fragReassembler{timeout: timeout, max: max, buffers: make(map[fragKey]*fragBuffer)}
+}
+
+// SetFragmentPolicy sets the handling of IPv4 fragments in both directions. Reassembled
+// datagrams are counted in Metrics.FragsReassembled and fragments dropped by the policy,
+// a timeout or the reassembly limits in Metrics.FragsDropped. This should be called
+// prior to Start.
+func (r *WebTunnelServer) SetFragmentPolicy(p FragmentPolicy) error {
+	switch p {
+	case FragmentPass, FragmentDrop:
+		r.frags = nil
+	case FragmentReassemble:
+		r.frags = newFragReassembler(defaultFragTimeout, defaultFragMax)
+	default:
+		return fmt.Errorf("invalid fragment policy %v", p)
+	}
+	r.fragPolicy = p
+	return nil
+}
+
+// add adds a validated fragment with a header of hdrLen bytes. It returns the datagram
+// once complete, or nil. dropped is the number of fragments discarded by the call.
+func (f *fragReassembler) add(pkt []byte, hdrLen int, now time.Time) (datagram []byte, dropped int) {
+	var k fragKey
+	copy(k.src[:], pkt[12:16])
+	copy(k.dst[:], pkt[16:20])
+	k.id = binary.BigEndian.Uint16(pkt[4:6])
+	k.proto = pkt[9]
+	frag := binary.BigEndian.Uint16(pkt[6:8])
+	offset := int(frag&ipv4FragOffset) * 8
+	payload := pkt[hdrLen:]
+	end := offset + len(payload)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if now.Sub(f.lastPrune) > time.Second {
+		dropped += f.prune(now)
+		f.lastPrune = now
+	}
+
+	b, ok := f.buffers[k]
+	if !ok {
+		if len(f.buffers) >= f.max {
+			return nil, dropped + 1
+		}
+		b = &fragBuffer{started: now}
+		f.buffers[k] = b
+	}
+	// Non final fragments must be multiples of 8 bytes and nothing may extend past
+	// the end of the datagram.
+	if end > maxDatagramLen-hdrLen || (frag&ipv4FlagMF != 0 && len(payload)%8 != 0) ||
+		(b.total > 0 && end > b.total) {
+		delete(f.buffers, k)
+		return nil, dropped + len(b.parts) + 1
+	}
+	if frag&ipv4FlagMF == 0 {
+		b.total = end
+	}
+	if offset == 0 {
+		b.header = append([]byte(nil), pkt[:hdrLen]...)
+	}
+	for _, p := range b.parts {
+		// Overlapping fragments are a known evasion technique; drop the datagram.
+		if offset < p.offset+len(p.data) && p.offset < end {
+			delete(f.buffers, k)
+			return nil, dropped + len(b.parts) + 1
+		}
+	}
+	b.parts = append(b.parts, fragPart{offset, append([]byte(nil), payload...)})
+	b.size += len(payload)
+
+	if b.header == nil || b.total == 0 || b.size != b.total {
+		return nil, dropped
+	}
+	delete(f.buffers, k)
+	return b.assemble(), dropped
+}
+
+// assemble returns the complete datagram with the header of the first fragment.
+func (b *fragBuffer) assemble() []byte {
+	sort.Slice(b.parts, func(i, j int) bool { return b.parts[i].offset < b.parts[j].offset })
+	hdrLen := len(b.header)
+	out := make([]byte, hdrLen+b.total)
+	copy(out, b.header)
+	for _, p := range b.parts {
+		copy(out[hdrLen+p.offset:], p.data)
+	}
+	binary.BigEndian.PutUint16(out[2:4], uint16(len(out)))
+	// Clear more fragments and offset, keeping don't fragment.
+	binary.BigEndian.PutUint16(out[6:8], binary.BigEndian.Uint16(out[6:8])&^(ipv4FlagMF|ipv4FragOffset))
+	out[10], out[11] = 0, 0
+	binary.BigEndian.PutUint16(out[10:12], ipv4Checksum(out[:hdrLen]))
+	return out
+}
+
+// prune removes datagrams not completed within the timeout and returns the number of
+// fragments discarded.
+func (f *fragReassembler) prune(now time.Time) int {
+	dropped := 0
+	for k, b := range f.buffers {
+		if now.Sub(b.started) > f.timeout {
+			dropped += len(b.parts)
+			delete(f.buffers, k)
+		}
+	}
+	return dropped
+}
+
+// ipv4Checksum returns the checksum of an IPv4 header with a zero checksum field.
+func ipv4Checksum(hdr []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// handleFragment applies the fragment policy to a validated fragment. It returns the
+// packet to forward or false if there is nothing to forward yet.
+func (r *WebTunnelServer) handleFragment(pkt []byte, hdrLen int) ([]byte, bool) {
+	var dropped int
+	switch r.fragPolicy {
+	case FragmentDrop:
+		pkt, dropped = nil, 1
+	case FragmentReassemble:
+		pkt, dropped = r.frags.add(pkt, hdrLen, time.Now())
+	}
+	if dropped > 0 || (pkt != nil && r.fragPolicy == FragmentReassemble) {
+		r.metricsLock.Lock()
+		r.metrics.FragsDropped += dropped
+		if pkt != nil && r.fragPolicy == FragmentReassemble {
+			r.metrics.FragsReassembled++
+		}
+		r.metricsLock.Unlock()
+	}
+	return pkt, pkt != nil
+}
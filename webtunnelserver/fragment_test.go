@@ -0,0 +1,109 @@
+package webtunnelserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// fragmentPkt splits an IPv4 packet without options into fragments of up to size
+// payload bytes.
+func fragmentPkt(pkt []byte, size int) [][]byte {
+	var frags [][]byte
+	payload := pkt[ipv4HeaderLen:]
+	for off := 0; off < len(payload); off += size {
+		end := off + size
+		flags := uint16(ipv4FlagMF)
+		if end >= len(payload) {
+			end, flags = len(payload), 0
+		}
+		f := append(append([]byte(nil), pkt[:ipv4HeaderLen]...), payload[off:end]...)
+		binary.BigEndian.PutUint16(f[2:4], uint16(len(f)))
+		binary.BigEndian.PutUint16(f[6:8], flags|uint16(off/8))
+		f[10], f[11] = 0, 0
+		binary.BigEndian.PutUint16(f[10:12], ipv4Checksum(f[:ipv4HeaderLen]))
+		frags = append(frags, f)
+	}
+	return frags
+}
+
+func createUDPPkt(n int) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Id: 7, Protocol: layers.IPProtocolUDP,
+		SrcIP: net.IP{192, 168, 0, 2}, DstIP: net.IP{172, 16, 0, 1}}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		ip, udp, gopacket.Payload(bytes.Repeat([]byte{0xab}, n)))
+	return buf.Bytes()
+}
+
+func TestFragmentPolicy(t *testing.T) {
+	pkt := createUDPPkt(100)
+	frags := fragmentPkt(pkt, 40)
+	if len(frags) != 3 {
+		t.Fatalf("Expected 3 fragments, got %v", len(frags))
+	}
+
+	// Pass through forwards fragments unchanged.
+	r := &WebTunnelServer{metrics: &Metrics{}}
+	for _, f := range frags {
+		if out, ok := r.checkIPv4("192.168.0.2", f); !ok || !bytes.Equal(out, f) {
+			t.Error("Expected fragment passed through")
+		}
+	}
+
+	// Reassembly returns the original datagram once all fragments arrived in any order.
+	if err := r.SetFragmentPolicy(FragmentReassemble); err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range [][]byte{frags[2], frags[0], frags[1]} {
+		out, ok := r.checkIPv4("192.168.0.2", f)
+		if i < 2 && ok {
+			t.Fatalf("Expected fragment %v held for reassembly", i)
+		}
+		if i == 2 && (!ok || !bytes.Equal(out, pkt)) {
+			t.Errorf("Reassembled datagram mismatch\ngot  %x\nwant %x", out, pkt)
+		}
+	}
+	if r.metrics.FragsReassembled != 1 || r.metrics.Fragments != 6 {
+		t.Errorf("Unexpected fragment counters %+v", *r.metrics)
+	}
+
+	// Overlapping fragments drop the datagram.
+	r.checkIPv4("192.168.0.2", frags[0])
+	r.checkIPv4("192.168.0.2", frags[0])
+	if r.metrics.FragsDropped != 2 || len(r.frags.buffers) != 0 {
+		t.Errorf("Expected 2 dropped fragments, got %v with %v pending", r.metrics.FragsDropped, len(r.frags.buffers))
+	}
+
+	// Incomplete datagrams time out.
+	now := time.Now()
+	r.frags.add(frags[0], ipv4HeaderLen, now)
+	if _, dropped := r.frags.add(frags[1], ipv4HeaderLen, now.Add(defaultFragTimeout/2)); dropped != 0 {
+		t.Errorf("Expected no drops before timeout, got %v", dropped)
+	}
+	other := fragmentPkt(createUDPPkt(10), 8)
+	if _, dropped := r.frags.add(other[0], ipv4HeaderLen, now.Add(2*defaultFragTimeout)); dropped != 2 {
+		t.Errorf("Expected 2 fragments dropped on timeout, got %v", dropped)
+	}
+
+	// Drop discards all fragments.
+	r.SetFragmentPolicy(FragmentDrop)
+	for _, f := range frags {
+		if _, ok := r.checkIPv4("192.168.0.2", f); ok {
+			t.Error("Expected fragment dropped")
+		}
+	}
+	if _, ok := r.checkIPv4("192.168.0.2", pkt); !ok {
+		t.Error("Expected unfragmented packet forwarded")
+	}
+	if err := r.SetFragmentPolicy(FragmentPolicy(9)); err == nil {
+		t.Error("Expected error for invalid policy")
+	}
+}
@@ -0,0 +1,83 @@
+package webtunnelserver
+
+import (
+	"fmt"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// Control messages refused before a connection is closed for violating the handshake.
+const maxHandshakeViolations = 10
+
+// Close reason sent to a connection closed for violating the handshake.
+const closeReasonHandshake = "handshake violation"
+
+// Time allowed between the upgrade and the config request. Connections that never
+// activate their IP are closed and the IP released.
+var handshakeTimeout = 30 * time.Second
+
+// handshakeState is the handshake progress of a connection.
+type handshakeState int
+
+const (
+	handshakeNew        handshakeState = iota // Upgraded, waiting for getConfig or resume.
+	handshakeConfigured                       // Config sent, tunnel active.
+)
+
+// connHandshake tracks the handshake of one connection.
+type connHandshake struct {
+	state      handshakeState
+	violations int // Control messages refused so far.
+}
+
+// isConfigRequest returns true for the commands that complete the handshake.
+func isConfigRequest(verb string) bool {
+	return verb == "getConfig" || verb == "resume" || verb == string(wc.CtlConfigRequest)
+}
+
+// check returns an error if a message of type mt with command verb is out of order for
+// the handshake state.
+func (h *connHandshake) check(mt int, verb string) error {
+	switch {
+	case mt == websocket.TextMessage && isConfigRequest(verb):
+		if h.state != handshakeNew {
+			return fmt.Errorf("repeated %v", verb)
+		}
+	case h.state == handshakeNew && mt == websocket.BinaryMessage:
+		return fmt.Errorf("packet before config")
+	case h.state == handshakeNew:
+		return fmt.Errorf("%q before config", verb)
+	}
+	return nil
+}
+
+// configured moves the connection to the active state and lifts the handshake timeout.
+func (h *connHandshake) configured(ws *wc.WSWriter) {
+	h.state = handshakeConfigured
+	ws.Conn().SetReadDeadline(time.Time{})
+}
+
+// refuse drops a message out of order for the handshake and closes the connection after
+// too many violations. Packets sent by reconnecting clients
+// before their config request are dropped without counting as violations.
+func (r *WebTunnelServer) refuse(h *connHandshake, ws *wc.WSWriter, ip string, mt int, err error) {
+	r.metricsLock.Lock()
+	r.metrics.HandshakeRefused++
+	r.metricsLock.Unlock()
+	if mt == websocket.BinaryMessage {
+		glog.V(2).Infof("dropping message from %v: %v", ip, err)
+		return
+	}
+	glog.Warningf("refusing message from %v: %v", ip, err)
+	h.violations++
+	if h.violations < maxHandshakeViolations {
+		return
+	}
+	glog.Warningf("closing connection of %v after %v handshake violations", ip, h.violations)
+	ws.WriteControlMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, withSessionID(closeReasonHandshake, r.sessionID(ip))))
+	ws.Conn().Close()
+}
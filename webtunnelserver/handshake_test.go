@@ -0,0 +1,92 @@
+package webtunnelserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/gorilla/websocket"
+)
+
+func TestHandshake(t *testing.T) {
+	defer func(d time.Duration) { handshakeTimeout = d }(handshakeTimeout)
+	handshakeTimeout = 300 * time.Millisecond
+
+	r, err := NewWebTunnelServer("127.0.0.1:0", "192.168.0.1", "255.255.255.0", "192.168.0.0/24",
+		nil, []string{"1.1.1.0/24"}, false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(r.wsEndpoint))
+	defer srv.Close()
+	dial := func() *websocket.Conn {
+		c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	closeReason := func(c *websocket.Conn) string {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, _, err := c.ReadMessage()
+			if ce, ok := err.(*websocket.CloseError); ok {
+				return ce.Text
+			}
+			if err != nil {
+				return err.Error()
+			}
+		}
+	}
+
+	// Control messages before the config request are refused, then the connection closed.
+	c := dial()
+	defer c.Close()
+	c.WriteMessage(websocket.BinaryMessage, []byte{0x45})
+	for i := 0; i < maxHandshakeViolations; i++ {
+		c.WriteMessage(websocket.TextMessage, wc.KeepaliveMessage(time.Minute))
+	}
+	if reason := closeReason(c); !strings.HasPrefix(reason, closeReasonHandshake) {
+		t.Errorf("Expected close with %q, got %q", closeReasonHandshake, reason)
+	}
+	if n := r.GetMetrics().HandshakeRefused; n != maxHandshakeViolations+1 {
+		t.Errorf("Expected %v refused messages, got %v", maxHandshakeViolations+1, n)
+	}
+
+	// A repeated config request is refused without a second config.
+	c = dial()
+	defer c.Close()
+	c.WriteMessage(websocket.TextMessage, []byte("getConfig user host"))
+	cfg := &wc.ClientConfig{}
+	if err := c.ReadJSON(cfg); err != nil {
+		t.Fatal(err)
+	}
+	c.WriteMessage(websocket.TextMessage, []byte("getConfig user host"))
+	c.WriteMessage(websocket.TextMessage, wc.KeepaliveMessage(time.Minute))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, msg, err := c.ReadMessage(); err != nil || !strings.HasPrefix(string(msg), "keepaliveack ") {
+		t.Errorf("Expected only the keepalive ack, got %q %v", msg, err)
+	}
+
+	// Configured connections outlive the handshake timeout.
+	time.Sleep(2 * handshakeTimeout)
+	if users := r.GetMetrics().Users; users != 1 {
+		t.Errorf("Expected configured session kept, got %v users", users)
+	}
+
+	// Connections that never request their config release their IP.
+	idle := dial()
+	defer idle.Close()
+	time.Sleep(100 * time.Millisecond)
+	if n := r.ipam.GetAllocatedCount(); n != 5 {
+		t.Errorf("Expected 5 allocated IPs, got %v", n)
+	}
+	closeReason(idle)
+	time.Sleep(100 * time.Millisecond)
+	if n := r.ipam.GetAllocatedCount(); n != 4 {
+		t.Errorf("Expected idle IP released, got %v allocated IPs", n)
+	}
+}
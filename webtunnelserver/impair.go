@@ -0,0 +1,144 @@
+package webtunnelserver
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Impairment degrades the traffic of sessions so applications can be tested over a poor
+// VPN link. It is meant for staging and QA gateways.
+type Impairment struct {
+	Latency time.Duration // Delay added to packets in each direction.
+	Jitter  time.Duration // Random extra delay up to this, packets may be reordered.
+	Loss    float64       // Fraction of packets dropped in each direction.
+}
+
+// poolImpairment is the impairment of sessions with a tunnel IP in a prefix.
+type poolImpairment struct {
+	prefix *net.IPNet
+	imp    Impairment
+}
+
+// impairments holds the configured traffic impairments.
+type impairments struct {
+	pools    []poolImpairment      // Impairments per prefix, most specific first.
+	sessions map[string]Impairment // Overrides per client IP.
+	lock     sync.Mutex
+}
+
+// validate returns an error if the impairment is out of range.
+func (imp Impairment) validate() error {
+	if imp.Latency < 0 || imp.Jitter < 0 || imp.Loss < 0 || imp.Loss > 1 {
+		return fmt.Errorf("invalid impairment %+v", imp)
+	}
+	return nil
+}
+
+/*
+SetImpairment adds latency, jitter and loss to the traffic of every session with a tunnel
+IP in prefix, eg. the whole client IP range of a staging gateway or a /32 for one client.
+The most specific prefix applies. Packets are delayed without slowing down other sessions.
+This should be called prior to Start.
+*/
+func (r *WebTunnelServer) SetImpairment(prefix string, imp Impairment) error {
+	_, n, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return fmt.Errorf("invalid impairment prefix: %w", err)
+	}
+	if err := imp.validate(); err != nil {
+		return err
+	}
+	r.impair.lock.Lock()
+	defer r.impair.lock.Unlock()
+	r.impair.pools = append(r.impair.pools, poolImpairment{prefix: n, imp: imp})
+	sort.SliceStable(r.impair.pools, func(i, j int) bool {
+		oi, _ := r.impair.pools[i].prefix.Mask.Size()
+		oj, _ := r.impair.pools[j].prefix.Mask.Size()
+		return oi > oj
+	})
+	glog.Warningf("traffic to %v impaired with %+v", prefix, imp)
+	return nil
+}
+
+// ImpairSession overrides the impairment of the session on ip until it ends. A nil imp
+// returns the session to the prefix impairments.
+func (r *WebTunnelServer) ImpairSession(ip string, imp *Impairment) error {
+	if _, err := r.ipam.GetUserinfo(ip); err != nil {
+		return fmt.Errorf("no session on %v: %w", ip, err)
+	}
+	r.impair.lock.Lock()
+	defer r.impair.lock.Unlock()
+	if imp == nil {
+		delete(r.impair.sessions, ip)
+		return nil
+	}
+	if err := imp.validate(); err != nil {
+		return err
+	}
+	if r.impair.sessions == nil {
+		r.impair.sessions = make(map[string]Impairment)
+	}
+	r.impair.sessions[ip] = *imp
+	glog.Warningf("traffic of session %v impaired with %+v", ip, *imp)
+	return nil
+}
+
+// impairment returns the impairment of the session on ip, ok is false if none.
+func (r *WebTunnelServer) impairment(ip string) (imp Impairment, ok bool) {
+	r.impair.lock.Lock()
+	defer r.impair.lock.Unlock()
+	if imp, ok := r.impair.sessions[ip]; ok {
+		return imp, true
+	}
+	if len(r.impair.pools) == 0 {
+		return Impairment{}, false
+	}
+	addr := net.ParseIP(ip)
+	for _, p := range r.impair.pools {
+		if p.prefix.Contains(addr) {
+			return p.imp, true
+		}
+	}
+	return Impairment{}, false
+}
+
+// impairPacket applies the impairment of the session on ip to pkt. It returns false if
+// the session is not impaired and pkt should be sent as usual. Otherwise pkt is dropped
+// or passed to send, after the delay if any, and must not be used by the caller.
+func (r *WebTunnelServer) impairPacket(ip string, pkt []byte, send func([]byte)) bool {
+	imp, ok := r.impairment(ip)
+	if !ok {
+		return false
+	}
+	if imp.Loss > 0 && rand.Float64() < imp.Loss {
+		r.metricsLock.Lock()
+		r.metrics.ImpairDropped++
+		r.metricsLock.Unlock()
+		return true
+	}
+	delay := imp.Latency
+	if imp.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(imp.Jitter)))
+	}
+	if delay == 0 {
+		send(pkt)
+		return true
+	}
+	cp := make([]byte, len(pkt))
+	copy(cp, pkt)
+	time.AfterFunc(delay, func() { send(cp) })
+	return true
+}
+
+// releaseImpairment removes the impairment override of a disconnected client.
+func (r *WebTunnelServer) releaseImpairment(ip string) {
+	r.impair.lock.Lock()
+	delete(r.impair.sessions, ip)
+	r.impair.lock.Unlock()
+}
@@ -0,0 +1,54 @@
+package webtunnelserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestImpairment(t *testing.T) {
+	ipam, _ := NewIPPam("192.168.0.0/24")
+	ip, _ := ipam.AcquireIP(nil)
+	r := &WebTunnelServer{ipam: ipam, metrics: &Metrics{}}
+
+	if err := r.SetImpairment("192.168.0.0/24", Impairment{Loss: 2}); err == nil {
+		t.Error("Expected error for loss over 1")
+	}
+	if err := r.SetImpairment("bogus", Impairment{}); err == nil {
+		t.Error("Expected error for invalid prefix")
+	}
+	sent := make(chan time.Time, 10)
+	send := func(pkt []byte) { sent <- time.Now() }
+	if r.impairPacket(ip, []byte{1}, send) {
+		t.Error("Expected packets sent as usual without impairment")
+	}
+
+	// The most specific prefix applies.
+	r.SetImpairment(ip+"/32", Impairment{Latency: 50 * time.Millisecond, Jitter: 10 * time.Millisecond})
+	r.SetImpairment("192.168.0.0/24", Impairment{Loss: 1})
+	start := time.Now()
+	if !r.impairPacket(ip, []byte{1}, send) {
+		t.Fatal("Expected packet impaired")
+	}
+	if d := (<-sent).Sub(start); d < 50*time.Millisecond || d > time.Second {
+		t.Errorf("Expected packet delayed by 50-60ms, got %v", d)
+	}
+	if !r.impairPacket("192.168.0.99", []byte{1}, send) || len(sent) != 0 || r.metrics.ImpairDropped != 1 {
+		t.Errorf("Expected packet dropped by the pool impairment, dropped %v", r.metrics.ImpairDropped)
+	}
+
+	// Session overrides need a session and end with it.
+	if err := r.ImpairSession(ip, &Impairment{}); err == nil {
+		t.Error("Expected error impairing an IP without session")
+	}
+	ipam.SetIPActiveWithUserInfo(ip, "user", "host")
+	if err := r.ImpairSession(ip, &Impairment{Loss: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if r.impairPacket(ip, []byte{1}, send); r.metrics.ImpairDropped != 2 {
+		t.Error("Expected packet dropped by the session impairment")
+	}
+	r.releaseImpairment(ip)
+	if imp, _ := r.impairment(ip); imp.Latency != 50*time.Millisecond {
+		t.Errorf("Expected prefix impairment after the session ends, got %+v", imp)
+	}
+}
@@ -0,0 +1,67 @@
+package webtunnelserver
+
+import (
+	"io"
+
+	"github.com/golang/glog"
+)
+
+// Verdict is the decision of a PacketInspector on a tunneled packet.
+type Verdict int
+
+const (
+	VerdictAccept Verdict = iota // Forward the packet.
+	VerdictDrop                  // Drop the packet.
+	VerdictMirror                // Forward the packet and copy it to the mirror tap.
+)
+
+// Direction is the direction of a tunneled packet relative to the client.
+type Direction int
+
+const (
+	FromClient Direction = iota // Packet received from the client websocket.
+	ToClient                    // Packet read from the TUN interface for the client.
+)
+
+// PacketInspector is invoked on every tunneled IPv4 packet, eg. to plug in an IDS.
+// ip is the client tunnel IP. Inspect must not modify or retain pkt and is called
+// from the packet loops, so it should be fast.
+type PacketInspector interface {
+	Inspect(ip string, dir Direction, pkt []byte) Verdict
+}
+
+// InspectorFunc adapts a function to a PacketInspector.
+type InspectorFunc func(ip string, dir Direction, pkt []byte) Verdict
+
+// Inspect calls f(ip, dir, pkt).
+func (f InspectorFunc) Inspect(ip string, dir Direction, pkt []byte) Verdict {
+	return f(ip, dir, pkt)
+}
+
+// SetInspector sets the packet inspection hook. Packets with VerdictMirror are written to
+// mirror (eg. a UDP connection to an analysis tap), which may be nil if the inspector never
+// mirrors. This should be called prior to Start.
+func (r *WebTunnelServer) SetInspector(i PacketInspector, mirror io.Writer) {
+	r.inspector = i
+	r.mirror = mirror
+}
+
+// inspectPacket runs the inspection hook and returns false if the packet is to be dropped.
+func (r *WebTunnelServer) inspectPacket(ip string, dir Direction, pkt []byte) bool {
+	if r.inspector == nil {
+		return true
+	}
+	switch r.inspector.Inspect(ip, dir, pkt) {
+	case VerdictDrop:
+		glog.V(2).Infof("inspector dropped packet for %v", ip)
+		return false
+	case VerdictMirror:
+		if r.mirror == nil {
+			return true
+		}
+		if _, err := r.mirror.Write(pkt); err != nil {
+			glog.Warningf("error mirroring packet for %v: %v", ip, err)
+		}
+	}
+	return true
+}
@@ -0,0 +1,35 @@
+package webtunnelserver
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestInspectPacket(t *testing.T) {
+	r := &WebTunnelServer{}
+	if !r.inspectPacket("192.168.0.2", FromClient, []byte{1}) {
+		t.Error("Expected packet accepted with no inspector")
+	}
+
+	mirror := new(bytes.Buffer)
+	r.SetInspector(InspectorFunc(func(ip string, dir Direction, pkt []byte) Verdict {
+		return Verdict(pkt[0])
+	}), mirror)
+
+	testCases := []struct {
+		pkt    []byte
+		accept bool
+	}{
+		{[]byte{byte(VerdictAccept)}, true},
+		{[]byte{byte(VerdictDrop)}, false},
+		{[]byte{byte(VerdictMirror)}, true},
+	}
+	for _, tc := range testCases {
+		if v := r.inspectPacket("192.168.0.2", ToClient, tc.pkt); v != tc.accept {
+			t.Errorf("inspectPacket(%v) expected %v, got %v", tc.pkt, tc.accept, v)
+		}
+	}
+	if !bytes.Equal(mirror.Bytes(), []byte{byte(VerdictMirror)}) {
+		t.Errorf("Expected only mirrored packet on tap, got %v", mirror.Bytes())
+	}
+}
@@ -0,0 +1,63 @@
+package webtunnelserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/deepakkamesh/webtunnel/ipam"
+	"github.com/golang/glog"
+)
+
+// IPEventType is the type of an IPAM event.
+type IPEventType = ipam.EventType
+
+const (
+	IPAssigned     = ipam.Assigned     // IP marked in use by a client.
+	IPReleased     = ipam.Released     // IP returned to the pool.
+	IPPoolAlarm    = ipam.PoolAlarm    // Pool utilization alarm level changed.
+	IPLeaseExpired = ipam.LeaseExpired // Lease of an IP in use ran out, it is released next.
+	IPPoolExpanded = ipam.Expanded     // Secondary client network brought online.
+)
+
+// IPEvent is emitted by IPPam when a client IP is assigned, released or its lease expires,
+// or the pool utilization alarm level changes or the pool expands.
+type IPEvent = ipam.Event
+
+// IPEventListener is called for every IPAM event. It is called synchronously from
+// IPPam and should not block.
+type IPEventListener = ipam.Listener
+
+// AddIPEventListener registers l to receive IP assigned, released and pool alarm events
+// from IPAM, with the session ID of the client.
+func (r *WebTunnelServer) AddIPEventListener(l IPEventListener) {
+	r.ipam.AddListener(func(ev IPEvent) {
+		ev.SessionID = r.sessionID(ev.IP)
+		l(ev)
+	})
+}
+
+// NewWebhookIPListener returns a listener that POSTs each event as JSON to url. Requests
+// are sent in the background so IPAM is never blocked by a slow endpoint.
+func NewWebhookIPListener(url string, timeout time.Duration) IPEventListener {
+	client := &http.Client{Timeout: timeout}
+	return func(ev IPEvent) {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			glog.Warningf("error encoding IP event: %v", err)
+			return
+		}
+		go func() {
+			resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+			if err != nil {
+				glog.Warningf("IP event webhook failed for %v: %v", ev.IP, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				glog.Warningf("IP event webhook for %v returned %v", ev.IP, resp.Status)
+			}
+		}()
+	}
+}
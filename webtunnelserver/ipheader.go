@@ -0,0 +1,164 @@
+package webtunnelserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/golang/glog"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// IPv4 header fields used by the header checks.
+const (
+	ipv4FlagMF     = 0x2000 // More fragments flag in the flags/fragment offset field.
+	ipv4FragOffset = 0x1fff // Fragment offset mask.
+	ipProtoIPIP    = 4
+	ipProtoGRE     = 47
+	ipv6HeaderLen  = 40
+)
+
+// errNotIPv4 is returned by parseIPv4 for packets of other IP versions.
+var errNotIPv4 = errors.New("not IPv4")
+
+// ipv4Info describes the header of a validated IPv4 packet.
+type ipv4Info struct {
+	hdrLen   int  // Header length including options.
+	options  bool // Header carries options.
+	fragment bool // Packet is a fragment (more fragments set or non zero offset).
+	nested   bool // Payload is an IPIP or GRE tunnel.
+}
+
+// parseIPv4 validates the IPv4 header of pkt. It returns pkt trimmed to the total
+// length in the header, dropping link layer padding.
+func parseIPv4(pkt []byte) ([]byte, ipv4Info, error) {
+	var info ipv4Info
+	if len(pkt) < ipv4HeaderLen {
+		return nil, info, fmt.Errorf("packet too short: %v bytes", len(pkt))
+	}
+	if v := pkt[0] >> 4; v != 4 {
+		return nil, info, fmt.Errorf("%w: version %v", errNotIPv4, v)
+	}
+	info.hdrLen = int(pkt[0]&0x0f) * 4
+	if info.hdrLen < ipv4HeaderLen || info.hdrLen > len(pkt) {
+		return nil, info, fmt.Errorf("invalid header length %v", info.hdrLen)
+	}
+	total := int(binary.BigEndian.Uint16(pkt[2:4]))
+	if total < info.hdrLen || total > len(pkt) {
+		return nil, info, fmt.Errorf("invalid total length %v", total)
+	}
+	frag := binary.BigEndian.Uint16(pkt[6:8])
+	info.options = info.hdrLen > ipv4HeaderLen
+	info.fragment = frag&ipv4FlagMF != 0 || frag&ipv4FragOffset != 0
+	info.nested = pkt[9] == ipProtoIPIP || pkt[9] == ipProtoGRE
+	return pkt[:total], info, nil
+}
+
+// SetBlockNestedTunnels drops IPIP and GRE packets in both directions. Nested tunnels
+// hide the inner addresses from the quarantine ACL, inspection and flow tracking. They
+// are counted in Metrics.NestedTunnels either way. This should be called prior to Start.
+func (r *WebTunnelServer) SetBlockNestedTunnels(block bool) {
+	r.blockNested = block
+}
+
+// checkIPv4 validates a packet to or from the client on ip and counts unusual headers.
+// It returns the packet trimmed to its IPv4 length and false if it should be dropped.
+// Packets with options are forwarded unchanged and fragments as set by the fragment policy.
+// Packets of other IP versions are dropped without striking the client, as its stack may
+// send them (eg. IPv6 router solicitations) on its own.
+func (r *WebTunnelServer) checkIPv4(ip string, pkt []byte) ([]byte, bool) {
+	pkt, info, err := parseIPv4(pkt)
+	if errors.Is(err, errNotIPv4) {
+		glog.V(3).Infof("dropping packet for %v: %v", ip, err)
+		r.metricsLock.Lock()
+		r.metrics.NonIPv4++
+		r.metricsLock.Unlock()
+		return nil, false
+	}
+	if err != nil {
+		glog.V(2).Infof("dropping malformed packet for %v: %v", ip, err)
+		r.metricsLock.Lock()
+		r.metrics.Malformed++
+		r.metricsLock.Unlock()
+		r.strikeSession(OffenceMalformed, ip)
+		return nil, false
+	}
+	if !info.options && !info.fragment && !info.nested {
+		return pkt, true
+	}
+
+	r.metricsLock.Lock()
+	if info.options {
+		r.metrics.IPOptions++
+	}
+	if info.fragment {
+		r.metrics.Fragments++
+	}
+	if info.nested {
+		r.metrics.NestedTunnels++
+	}
+	r.metricsLock.Unlock()
+
+	if info.nested && r.blockNested {
+		glog.V(2).Infof("dropping nested tunnel packet for %v", ip)
+		return nil, false
+	}
+	if info.fragment {
+		return r.handleFragment(pkt, info.hdrLen)
+	}
+	return pkt, true
+}
+
+// ipHeader is the part of an IPv4 or IPv6 header read for each packet on the hot path.
+type ipHeader struct {
+	version int
+	tos     uint8  // IPv4 TOS or IPv6 traffic class.
+	proto   uint8  // IPv4 protocol or IPv6 next header.
+	src     net.IP // Source address, sharing the packet buffer.
+	dst     net.IP // Destination address, sharing the packet buffer.
+}
+
+// parseIPHeader reads the version, TOS, protocol and addresses of an IPv4 or IPv6 packet
+// without decoding layers or allocating. ok is false for packets it can't read, which
+// decodeIPHeader handles.
+func parseIPHeader(pkt []byte) (h ipHeader, ok bool) {
+	if len(pkt) == 0 {
+		return h, false
+	}
+	switch h.version = int(pkt[0] >> 4); h.version {
+	case 4:
+		if len(pkt) < ipv4HeaderLen || int(pkt[0]&0x0f)*4 < ipv4HeaderLen {
+			return h, false
+		}
+		h.tos, h.proto = pkt[1], pkt[9]
+		h.src, h.dst = net.IP(pkt[12:16]), net.IP(pkt[16:20])
+	case 6:
+		if len(pkt) < ipv6HeaderLen {
+			return h, false
+		}
+		h.tos = pkt[0]<<4 | pkt[1]>>4
+		h.proto = pkt[6]
+		h.src, h.dst = net.IP(pkt[8:24]), net.IP(pkt[24:40])
+	default:
+		return h, false
+	}
+	return h, true
+}
+
+// decodeIPHeader reads the header of pkt with gopacket, the slow path of parseIPHeader.
+func decodeIPHeader(pkt []byte) (h ipHeader, ok bool) {
+	if len(pkt) > 0 && pkt[0]>>4 == 6 {
+		packet := gopacket.NewPacket(pkt, layers.LayerTypeIPv6, gopacket.Default)
+		if ip, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+			return ipHeader{version: 6, tos: ip.TrafficClass, proto: uint8(ip.NextHeader), src: ip.SrcIP, dst: ip.DstIP}, true
+		}
+		return h, false
+	}
+	packet := gopacket.NewPacket(pkt, layers.LayerTypeIPv4, gopacket.Default)
+	if ip, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+		return ipHeader{version: 4, tos: ip.TOS, proto: uint8(ip.Protocol), src: ip.SrcIP, dst: ip.DstIP}, true
+	}
+	return h, false
+}
@@ -0,0 +1,170 @@
+package webtunnelserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// createHeaderPkt returns a serialized IPv4 packet from the header ip and payload.
+func createHeaderPkt(ip *layers.IPv4, payload []byte) []byte {
+	ip.Version, ip.TTL = 4, 64
+	ip.SrcIP, ip.DstIP = net.IP{192, 168, 0, 2}, net.IP{172, 16, 0, 1}
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ip, gopacket.Payload(payload))
+	return buf.Bytes()
+}
+
+func TestCheckIPv4(t *testing.T) {
+	udp := []byte{0x9c, 0x40, 0, 53, 0, 12, 0, 0, 1, 2, 3, 4}
+	routerAlert := []layers.IPv4Option{{OptionType: 0x94, OptionLength: 4, OptionData: []byte{0, 0}}}
+
+	plain := createHeaderPkt(&layers.IPv4{Protocol: layers.IPProtocolUDP}, udp)
+	padded := append(append([]byte{}, plain...), 0, 0, 0, 0)
+	options := createHeaderPkt(&layers.IPv4{Protocol: layers.IPProtocolUDP, Options: routerAlert}, udp)
+	firstFrag := createHeaderPkt(&layers.IPv4{Protocol: layers.IPProtocolUDP, Flags: layers.IPv4MoreFragments}, udp)
+	lastFrag := createHeaderPkt(&layers.IPv4{Protocol: layers.IPProtocolUDP, FragOffset: 100}, udp)
+	ipip := createHeaderPkt(&layers.IPv4{Protocol: layers.IPProtocolIPv4}, plain)
+	gre := createHeaderPkt(&layers.IPv4{Protocol: layers.IPProtocolGRE}, append([]byte{0, 0, 0x08, 0}, plain...))
+
+	badIHL := append([]byte{}, plain...)
+	badIHL[0] = 0x4f
+	badTotal := append([]byte{}, plain...)
+	badTotal[2], badTotal[3] = 0xff, 0xff
+	ipv6 := append([]byte{0x60}, make([]byte, 39)...)
+
+	tests := []struct {
+		name    string
+		pkt     []byte
+		ok      bool
+		wantLen int
+	}{
+		{"plain", plain, true, len(plain)},
+		{"padded", padded, true, len(plain)},
+		{"options", options, true, len(options)},
+		{"first fragment", firstFrag, true, len(firstFrag)},
+		{"last fragment", lastFrag, true, len(lastFrag)},
+		{"IPIP", ipip, true, len(ipip)},
+		{"GRE", gre, true, len(gre)},
+		{"short", plain[:10], false, 0},
+		{"header length", badIHL, false, 0},
+		{"total length", badTotal, false, 0},
+		{"IPv6", ipv6, false, 0},
+	}
+	r := &WebTunnelServer{metrics: &Metrics{}}
+	for _, tc := range tests {
+		pkt, ok := r.checkIPv4("192.168.0.2", tc.pkt)
+		if ok != tc.ok || len(pkt) != tc.wantLen {
+			t.Errorf("%v: got ok %v length %v, want ok %v length %v", tc.name, ok, len(pkt), tc.ok, tc.wantLen)
+		}
+	}
+	m := r.metrics
+	if m.Malformed != 3 || m.NonIPv4 != 1 || m.IPOptions != 1 || m.Fragments != 2 || m.NestedTunnels != 2 {
+		t.Errorf("Unexpected header counters %+v", *m)
+	}
+
+	r.SetBlockNestedTunnels(true)
+	for _, pkt := range [][]byte{ipip, gre} {
+		if _, ok := r.checkIPv4("192.168.0.2", pkt); ok {
+			t.Error("Expected nested tunnel packet dropped")
+		}
+	}
+	if _, ok := r.checkIPv4("192.168.0.2", plain); !ok {
+		t.Error("Expected plain packet forwarded with nested tunnels blocked")
+	}
+	if m.NestedTunnels != 4 {
+		t.Errorf("Expected 4 nested tunnel packets, got %v", m.NestedTunnels)
+	}
+}
+
+func TestConnTrackFragments(t *testing.T) {
+	udp := []byte{0x9c, 0x40, 0, 53, 0, 12, 0, 0, 1, 2, 3, 4}
+	r := &WebTunnelServer{}
+	r.SetConnTracking(0)
+	r.trackPacket("192.168.0.2", FromClient, createHeaderPkt(&layers.IPv4{Protocol: layers.IPProtocolUDP, Flags: layers.IPv4MoreFragments}, udp))
+	r.trackPacket("192.168.0.2", FromClient, createHeaderPkt(&layers.IPv4{Protocol: layers.IPProtocolUDP, FragOffset: 2}, udp))
+
+	flows := r.Flows("192.168.0.2")
+	if len(flows) != 1 || flows[0].Packets != 1 {
+		t.Fatalf("Expected 1 flow from the first fragment, got %v", flows)
+	}
+	want := FlowKey{Proto: "UDP", SrcIP: "192.168.0.2", SrcPort: 40000, DstIP: "172.16.0.1", DstPort: 53}
+	if flows[0].Key != want {
+		t.Errorf("Expected key %v, got %v", want, flows[0].Key)
+	}
+}
+
+func TestParseIPHeader(t *testing.T) {
+	routerAlert := []layers.IPv4Option{{OptionType: 0x94, OptionLength: 4, OptionData: []byte{0, 0}}}
+	v4 := createHeaderPkt(&layers.IPv4{Protocol: layers.IPProtocolUDP, TOS: 0xb8}, []byte{1, 2, 3, 4})
+	options := createHeaderPkt(&layers.IPv4{Protocol: layers.IPProtocolTCP, Options: routerAlert}, []byte{1, 2, 3, 4})
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, &layers.IPv6{
+		Version: 6, TrafficClass: 0x2e, NextHeader: layers.IPProtocolUDP, HopLimit: 64,
+		SrcIP: net.ParseIP("fd00::2"), DstIP: net.ParseIP("fd00::1"),
+	}, gopacket.Payload([]byte{1, 2, 3, 4}))
+	v6 := buf.Bytes()
+
+	for _, pkt := range [][]byte{v4, options, v6} {
+		fast, ok := parseIPHeader(pkt)
+		if !ok {
+			t.Fatalf("Expected header of %x parsed", pkt)
+		}
+		slow, _ := decodeIPHeader(pkt)
+		if fast.version != slow.version || fast.tos != slow.tos || fast.proto != slow.proto ||
+			!fast.src.Equal(slow.src) || !fast.dst.Equal(slow.dst) {
+			t.Errorf("Expected %+v, got %+v", slow, fast)
+		}
+	}
+	for _, pkt := range [][]byte{nil, v4[:12], v6[:30], {0x44, 0, 0, 20}, {0x15}} {
+		if _, ok := parseIPHeader(pkt); ok {
+			t.Errorf("Expected %x refused", pkt)
+		}
+	}
+}
+
+func BenchmarkParseIPHeader(b *testing.B) {
+	pkt := createHeaderPkt(&layers.IPv4{Protocol: layers.IPProtocolUDP}, make([]byte, 1400))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if h, ok := parseIPHeader(pkt); !ok || h.dst.String() == "" {
+			b.Fatal("parse failed")
+		}
+	}
+}
+
+func BenchmarkDecodeIPHeader(b *testing.B) {
+	pkt := createHeaderPkt(&layers.IPv4{Protocol: layers.IPProtocolUDP}, make([]byte, 1400))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if h, ok := decodeIPHeader(pkt); !ok || h.dst.String() == "" {
+			b.Fatal("decode failed")
+		}
+	}
+}
+
+func TestCheckIPv4Strikes(t *testing.T) {
+	r, err := NewWebTunnelServer("127.0.0.1:0", "192.168.0.1", "255.255.255.0", "192.168.0.0/24",
+		nil, []string{"1.1.1.0/24"}, false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetBanPolicy(BanPolicy{Strikes: 1, Window: time.Minute, Cooldown: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	r.trackSession("192.168.0.2", "10.0.0.2:5555")
+
+	// IPv6 packets from a dual stack client are dropped without a strike.
+	ipv6 := append([]byte{0x60}, make([]byte, 39)...)
+	if _, ok := r.checkIPv4("192.168.0.2", ipv6); ok || r.isBanned("10.0.0.2") {
+		t.Error("Expected IPv6 packet dropped without banning the client")
+	}
+	badIHL := createHeaderPkt(&layers.IPv4{Protocol: layers.IPProtocolUDP}, nil)
+	badIHL[0] = 0x4f
+	if _, ok := r.checkIPv4("192.168.0.2", badIHL); ok || !r.isBanned("10.0.0.2") {
+		t.Error("Expected malformed IPv4 packet dropped and the client banned")
+	}
+}
@@ -0,0 +1,81 @@
+package webtunnelserver
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// IPLeaseCheckInterval (Overridable) is how often expired IP leases and held IPs are reaped.
+var IPLeaseCheckInterval = 10 * time.Second
+
+/*
+SetIPLease expires the IP of a client not heard from for lease (0 never expires): its
+session is closed and the IP released. Any message or pong of the client renews the
+lease, so lease should be well above the ping interval. Released IPs are held for grace
+before they are handed to another client. Otherwise clients crashing without closing
+their connection may hold their IP until the server restarts. This should be called
+prior to Start.
+*/
+func (r *WebTunnelServer) SetIPLease(lease, grace time.Duration) error {
+	if err := r.ipam.SetLease(lease, grace); err != nil {
+		return err
+	}
+	if r.ipLeases {
+		return nil
+	}
+	r.ipLeases = true
+	r.ipam.AddListener(func(ev IPEvent) {
+		if ev.Type != IPLeaseExpired {
+			return
+		}
+		r.expireIPLease(ev.IP)
+	})
+	return nil
+}
+
+// expireIPLease closes the session of the client whose IP lease expired and releases its
+// IP.
+func (r *WebTunnelServer) expireIPLease(ip string) {
+	glog.Warningf("IP lease of %v session %v expired, closing session", ip, r.sessionID(ip))
+	r.metricsLock.Lock()
+	r.metrics.LeasesExpired++
+	r.metricsLock.Unlock()
+
+	r.connMapLock.Lock()
+	ws := r.conns[ip]
+	r.connMapLock.Unlock()
+	// The read loop of the connection no longer owns the IP once released.
+	r.releaseIP(ip)
+	if ws != nil {
+		ws.Conn().Close()
+	}
+}
+
+// renewIPLease renews the IP lease of the client on ip.
+func (r *WebTunnelServer) renewIPLease(ip string) {
+	if !r.ipLeases {
+		return
+	}
+	// IPs are only leased once in use.
+	r.ipam.Renew(ip)
+}
+
+// processIPLeases routinely releases the IPs of expired leases and returns held IPs to
+// the pool.
+func (r *WebTunnelServer) processIPLeases() {
+	if !r.ipLeases {
+		return
+	}
+	glog.Info("IP lease processing routine active")
+	for {
+		time.Sleep(IPLeaseCheckInterval)
+		if r.isStopped.Load() {
+			glog.V(1).Info("Exiting IP lease routine")
+			return
+		}
+		if ips := r.ipam.Reap(); len(ips) > 0 {
+			glog.V(1).Infof("Released expired IPs %v", ips)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package webtunnelserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepakkamesh/webtunnel/ipam"
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/gorilla/websocket"
+)
+
+func TestIPLease(t *testing.T) {
+	r, err := NewWebTunnelServer("127.0.0.1:0", "192.168.0.1", "255.255.255.0", "192.168.0.0/24",
+		nil, []string{"1.1.1.0/24"}, false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetIPLease(100*time.Millisecond, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(r.wsEndpoint))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	connect := func() (*websocket.Conn, string) {
+		t.Helper()
+		c, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.WriteMessage(websocket.TextMessage, []byte("getConfig user host")); err != nil {
+			t.Fatal(err)
+		}
+		cfg := &wc.ClientConfig{}
+		if err := c.ReadJSON(cfg); err != nil {
+			t.Fatal(err)
+		}
+		return c, cfg.IP
+	}
+	stale, staleIP := connect()
+	defer stale.Close()
+	live, liveIP := connect()
+	defer live.Close()
+
+	// Traffic renews the lease of the live client.
+	for i := 0; i < 4; i++ {
+		time.Sleep(40 * time.Millisecond)
+		if err := live.WriteMessage(websocket.TextMessage, wc.KeepaliveMessage(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := r.ipam.Reap(); len(got) != 1 || got[0] != staleIP {
+		t.Errorf("Expected %v reaped, got %v", staleIP, got)
+	}
+
+	// The session of the stale client is closed and its IP held.
+	stale.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := stale.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if a, ok := r.ipam.Lookup(staleIP); !ok || a.Status != ipam.StatusHeld {
+		t.Errorf("Expected %v held, got %+v", staleIP, a)
+	}
+	r.connMapLock.Lock()
+	_, ok := r.conns[staleIP]
+	r.connMapLock.Unlock()
+	if ok {
+		t.Errorf("Expected connection of %v removed", staleIP)
+	}
+	if _, err := r.ipam.GetUserinfo(liveIP); err != nil {
+		t.Errorf("Expected %v still in use: %v", liveIP, err)
+	}
+	if m := r.GetMetrics(); m.LeasesExpired != 1 {
+		t.Errorf("Expected 1 expired lease, got %v", m.LeasesExpired)
+	}
+
+	// The held IP is not handed to the next client.
+	next, nextIP := connect()
+	defer next.Close()
+	if nextIP == staleIP {
+		t.Errorf("Expected held IP %v not reused", staleIP)
+	}
+}
@@ -1,75 +1,12 @@
 package webtunnelserver
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"testing"
 )
 
-func TestIP(t *testing.T) {
-	ipAllocator, _ := NewIPPam("10.0.0.0/24")
-
-	testCasesAquire := []struct {
-		ipAddr           string
-		expectErrorCheck bool
-		expectedCount    int // If not expecting error
-	}{
-		{"10.0.0.0", true, 0},   // Should not acquire network IP
-		{"10.0.0.255", true, 0}, // Should not acquire broadcast IP
-		{"10.0.0.1", false, 3},
-		{"10.0.0.1", true, 0}, // Cannot aquire same IP twice
-		{"10.0.0.25", false, 4},
-		{"192.168.0.1", true, 0}, // IP not in network
-		{"10.0.0", true, 0},      // Not a valid IP
-		{"10.0.0.300", true, 0},  // Not a valid IP
-		{"hello", true, 0},       // Not a valid IP
-	}
-
-	for _, tc := range testCasesAquire {
-		if tc.expectErrorCheck {
-			err := ipAllocator.AcquireSpecificIP(tc.ipAddr, struct{}{})
-			if err == nil {
-				t.Errorf("Expected error for IP %s, got nil", tc.ipAddr)
-			}
-		} else {
-			err := ipAllocator.AcquireSpecificIP(tc.ipAddr, struct{}{})
-			if err != nil {
-				t.Errorf("Unexpected error for IP %s: %s", tc.ipAddr, err)
-			}
-			if ipAllocator.GetAllocatedCount() != tc.expectedCount {
-				t.Errorf("Incorrect allocated count after acquiring %s", tc.ipAddr)
-			}
-		}
-	}
-
-	testCasesRelease := []struct {
-		ipAddr           string
-		expectErrorCheck bool
-		expectedCount    int // If not expecting error
-	}{
-		{"10.0.0.0", true, 0},   // Should not release network IP
-		{"10.0.0.255", true, 0}, // Should not release broadcast IP
-		{"10.0.0.1", false, 3},
-		{"10.0.0.1", true, 0}, // Should not release same IP twice
-		{"10.0.0.25", false, 2},
-	}
-
-	for _, tc := range testCasesRelease {
-		if tc.expectErrorCheck {
-			err := ipAllocator.ReleaseIP(tc.ipAddr)
-			if err == nil {
-				t.Errorf("Expected error for IP %s, got nil", tc.ipAddr)
-			}
-		} else {
-			err := ipAllocator.ReleaseIP(tc.ipAddr)
-			if err != nil {
-				t.Errorf("Unexpected error for IP %s: %s", tc.ipAddr, err)
-			}
-			if ipAllocator.GetAllocatedCount() != tc.expectedCount {
-				t.Errorf("Incorrect allocated count after acquiring %s", tc.ipAddr)
-			}
-		}
-	}
-}
-
 func TestGetMaxUsers(t *testing.T) {
 	testMaxUsers := []struct {
 		network  string
@@ -86,3 +23,71 @@ func TestGetMaxUsers(t *testing.T) {
 		}
 	}
 }
+
+func TestPoolAlarms(t *testing.T) {
+	ipam, _ := NewIPPam("10.0.0.0/28") // 14 usable IPs.
+	var levels []PoolLevel
+	ipam.AddListener(func(ev IPEvent) {
+		if ev.Type == IPPoolAlarm {
+			levels = append(levels, ev.Level)
+		}
+	})
+	if err := ipam.SetThresholds(PoolThresholds{Warning: 0.9, Critical: 0.5}); err == nil {
+		t.Error("Expected error for warning above critical")
+	}
+	if err := ipam.SetThresholds(PoolThresholds{Warning: 0.5, Critical: 0.75, Hysteresis: 0.15, Reject: true}); err != nil {
+		t.Fatal(err)
+	}
+	var ips []string
+	acquire := func(n int) {
+		for ; n > 0; n-- {
+			ip, err := ipam.AcquireIP(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ips = append(ips, ip)
+		}
+	}
+	release := func(n int) {
+		for ; n > 0; n-- {
+			ipam.ReleaseIP(ips[len(ips)-1])
+			ips = ips[:len(ips)-1]
+		}
+	}
+	level := func(want PoolLevel) {
+		t.Helper()
+		if u, got := ipam.Utilization(); got != want {
+			t.Errorf("Expected level %v at %.2f, got %v", want, u, got)
+		}
+	}
+
+	acquire(7)
+	level(PoolWarning)
+	acquire(4)
+	level(PoolCritical)
+	if !ipam.RejectSessions() {
+		t.Error("Expected sessions rejected while critical")
+	}
+	r := &WebTunnelServer{ipam: ipam, metrics: &Metrics{}}
+	rec := httptest.NewRecorder()
+	r.wsEndpoint(rec, httptest.NewRequest(http.MethodGet, "/ws", nil))
+	if rec.Code != http.StatusServiceUnavailable || r.metrics.PoolRejected != 1 {
+		t.Errorf("Expected session refused, got %v %+v", rec.Code, r.metrics)
+	}
+
+	// Alarms only clear once utilization drops under the hysteresis band.
+	release(1)
+	level(PoolCritical)
+	release(2)
+	level(PoolWarning)
+	release(3)
+	level(PoolWarning)
+	release(2)
+	level(PoolNormal)
+	if ipam.RejectSessions() {
+		t.Error("Expected sessions accepted")
+	}
+	if !reflect.DeepEqual(levels, []PoolLevel{PoolWarning, PoolCritical, PoolWarning, PoolNormal}) {
+		t.Errorf("Unexpected alarm events %v", levels)
+	}
+}
@@ -0,0 +1,156 @@
+package webtunnelserver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultPingInterval = 60 * time.Second // Ping interval of clients not negotiating one.
+	minPingInterval     = 10 * time.Second // Shortest interval accepted from clients.
+	maxPingInterval     = 30 * time.Minute // Longest interval accepted from clients.
+)
+
+// keepaliveTable holds the ping intervals negotiated by clients.
+type keepaliveTable struct {
+	intervals  map[string]time.Duration // Interval per client IP.
+	next       map[string]time.Time     // Next ping per client IP.
+	unanswered map[string]time.Time     // First unanswered ping per client IP.
+	interval   time.Duration            // Interval of clients not negotiating one, defaultPingInterval if 0.
+	timeout    time.Duration            // Time a ping may go unanswered before the session is closed, 0 disables.
+	lock       sync.Mutex
+}
+
+/*
+SetDeadPeerDetection pings the clients not negotiating a keepalive interval every interval
+instead of defaultPingInterval, and closes the sessions of clients leaving a ping
+unanswered for timeout (0 disables), releasing their IP. Otherwise half-open connections,
+eg. of clients that lost their network, hold their IP and goroutines until the OS times
+out the TCP connection. This should be called prior to Start.
+*/
+func (r *WebTunnelServer) SetDeadPeerDetection(interval, timeout time.Duration) error {
+	if interval < minPingInterval || interval > maxPingInterval {
+		return fmt.Errorf("invalid ping interval %v", interval)
+	}
+	if timeout < 0 {
+		return fmt.Errorf("invalid pong timeout %v", timeout)
+	}
+	r.keepalives.interval = interval
+	r.keepalives.timeout = timeout
+	return nil
+}
+
+// processKeepalive sets the ping interval requested by the client on ip, clamped to the
+// accepted range, and acknowledges the interval used.
+func (r *WebTunnelServer) processKeepalive(ws *wc.WSWriter, ip string, msg []byte) {
+	d, ok := wc.ParseKeepalive(msg)
+	if !ok {
+		glog.Warningf("invalid keepalive request from %v: %q", ip, msg)
+		return
+	}
+	if d < minPingInterval {
+		d = minPingInterval
+	}
+	if d > maxPingInterval {
+		d = maxPingInterval
+	}
+	k := &r.keepalives
+	k.lock.Lock()
+	if k.intervals == nil {
+		k.intervals = make(map[string]time.Duration)
+		k.next = make(map[string]time.Time)
+	}
+	k.intervals[ip] = d
+	// A shorter interval applies now rather than after the pending ping.
+	if next := time.Now().Add(d); k.next[ip].IsZero() || next.Before(k.next[ip]) {
+		k.next[ip] = next
+	}
+	k.lock.Unlock()
+	glog.V(1).Infof("Pinging %v every %v", ip, d)
+
+	if err := ws.WriteControlMessage(websocket.TextMessage, wc.KeepaliveAckMessage(d)); err != nil {
+		glog.Warningf("error acknowledging keepalive of %v: %v", ip, err)
+	}
+}
+
+// pingDue returns true if the client on ip is due a ping at now and schedules the next one.
+func (r *WebTunnelServer) pingDue(ip string, now time.Time) bool {
+	k := &r.keepalives
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.next == nil {
+		k.intervals = make(map[string]time.Duration)
+		k.next = make(map[string]time.Time)
+	}
+	interval, ok := k.intervals[ip]
+	if !ok {
+		interval = defaultPingInterval
+		if k.interval > 0 {
+			interval = k.interval
+		}
+	}
+	next, ok := k.next[ip]
+	if !ok {
+		// Newly connected clients are first pinged after an interval.
+		k.next[ip] = now.Add(interval)
+		return false
+	}
+	if now.Before(next) {
+		return false
+	}
+	k.next[ip] = now.Add(interval)
+	return true
+}
+
+// keepalivePinged records a ping sent to the client on ip at now.
+func (r *WebTunnelServer) keepalivePinged(ip string, now time.Time) {
+	k := &r.keepalives
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.timeout == 0 {
+		return
+	}
+	if k.unanswered == nil {
+		k.unanswered = make(map[string]time.Time)
+	}
+	if _, ok := k.unanswered[ip]; !ok {
+		k.unanswered[ip] = now
+	}
+}
+
+// keepalivePonged records an answer from the client on ip.
+func (r *WebTunnelServer) keepalivePonged(ip string) {
+	k := &r.keepalives
+	k.lock.Lock()
+	delete(k.unanswered, ip)
+	k.lock.Unlock()
+}
+
+// peerDead returns true once if the client on ip left a ping unanswered for the pong
+// timeout at now.
+func (r *WebTunnelServer) peerDead(ip string, now time.Time) bool {
+	k := &r.keepalives
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	since, ok := k.unanswered[ip]
+	if !ok || k.timeout == 0 || now.Sub(since) < k.timeout {
+		return false
+	}
+	delete(k.unanswered, ip)
+	return true
+}
+
+// releaseKeepalive removes the ping schedule of a disconnected client.
+func (r *WebTunnelServer) releaseKeepalive(ip string) {
+	k := &r.keepalives
+	k.lock.Lock()
+	delete(k.intervals, ip)
+	delete(k.next, ip)
+	delete(k.unanswered, ip)
+	k.lock.Unlock()
+}
@@ -0,0 +1,92 @@
+package webtunnelserver
+
+import (
+	"testing"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+)
+
+func TestKeepalive(t *testing.T) {
+	ws, client := wsPair(t)
+	defer ws.Close()
+	defer client.Close()
+	r := &WebTunnelServer{}
+
+	// Clients without a negotiated interval are pinged at the default interval.
+	now := time.Now()
+	if r.pingDue("10.0.0.2", now) {
+		t.Error("Expected no ping to a new client")
+	}
+	if r.pingDue("10.0.0.2", now.Add(defaultPingInterval-time.Second)) || !r.pingDue("10.0.0.2", now.Add(defaultPingInterval)) {
+		t.Error("Expected ping after the default interval")
+	}
+
+	readAck := func() time.Duration {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, msg, err := client.ReadMessage()
+		d, ok := wc.ParseKeepaliveAck(msg)
+		if err != nil || !ok {
+			t.Fatalf("Expected keepalive ack, got %q %v", msg, err)
+		}
+		return d
+	}
+	// Requests are clamped to the accepted range.
+	r.processKeepalive(ws, "10.0.0.3", wc.KeepaliveMessage(time.Second))
+	if d := readAck(); d != minPingInterval {
+		t.Errorf("Expected interval clamped to %v, got %v", minPingInterval, d)
+	}
+	r.processKeepalive(ws, "10.0.0.3", wc.KeepaliveMessage(2*time.Hour))
+	if d := readAck(); d != maxPingInterval {
+		t.Errorf("Expected interval clamped to %v, got %v", maxPingInterval, d)
+	}
+	r.processKeepalive(ws, "10.0.0.3", []byte("keepalive x"))
+
+	// A shorter interval applies before the pending ping.
+	now = time.Now()
+	r.processKeepalive(ws, "10.0.0.4", wc.KeepaliveMessage(90*time.Second))
+	readAck()
+	r.processKeepalive(ws, "10.0.0.4", wc.KeepaliveMessage(20*time.Second))
+	readAck()
+	if r.pingDue("10.0.0.4", now.Add(19*time.Second)) || !r.pingDue("10.0.0.4", now.Add(21*time.Second)) {
+		t.Error("Expected ping after the shorter interval")
+	}
+	if r.pingDue("10.0.0.4", now.Add(40*time.Second)) || !r.pingDue("10.0.0.4", now.Add(42*time.Second)) {
+		t.Error("Expected pings at the negotiated interval")
+	}
+
+	r.releaseKeepalive("10.0.0.4")
+	if r.pingDue("10.0.0.4", now.Add(time.Hour)) {
+		t.Error("Expected schedule of released client reset")
+	}
+
+	// Dead peer detection.
+	if err := r.SetDeadPeerDetection(time.Second, time.Minute); err == nil {
+		t.Error("Expected error for ping interval under the minimum")
+	}
+	if err := r.SetDeadPeerDetection(15*time.Second, -time.Second); err == nil {
+		t.Error("Expected error for negative pong timeout")
+	}
+	r.SetDeadPeerDetection(15*time.Second, 40*time.Second)
+	r.pingDue("10.0.0.5", now)
+	if !r.pingDue("10.0.0.5", now.Add(15*time.Second)) {
+		t.Error("Expected ping after the configured interval")
+	}
+	// The timeout runs from the first unanswered ping.
+	r.keepalivePinged("10.0.0.5", now)
+	r.keepalivePinged("10.0.0.5", now.Add(15*time.Second))
+	if r.peerDead("10.0.0.5", now.Add(39*time.Second)) {
+		t.Error("Expected peer alive before the timeout")
+	}
+	r.keepalivePonged("10.0.0.5")
+	if r.peerDead("10.0.0.5", now.Add(time.Hour)) {
+		t.Error("Expected peer alive after answering")
+	}
+	r.keepalivePinged("10.0.0.5", now)
+	if !r.peerDead("10.0.0.5", now.Add(40*time.Second)) {
+		t.Error("Expected dead peer after the timeout")
+	}
+	if r.peerDead("10.0.0.5", now.Add(41*time.Second)) {
+		t.Error("Expected dead peer reported once")
+	}
+}
@@ -0,0 +1,107 @@
+package webtunnelserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/deepakkamesh/webtunnel/webtunnelcommon/version"
+)
+
+// LandingPage configures what the server answers on / and paths without a handler, eg.
+// to look like an ordinary web site or to publish a status page.
+type LandingPage struct {
+	Content     []byte // Body served on /, "OK" if nil.
+	ContentType string // Content type of Content, detected from it if empty.
+	Dir         string // Static files served on other paths, empty to serve Content on any path.
+	ShowVersion bool   // Serve the server build information as JSON on /version.
+}
+
+// builtinEndpoints are the paths served by the server itself.
+var builtinEndpoints = []string{"/ws", "/metrichealthz", "/metricvarz", "/servers", "/config", "/metrics"}
+
+// SetLandingPage sets the response to requests for / and paths without a handler. This
+// should be called prior to Start.
+func (r *WebTunnelServer) SetLandingPage(p LandingPage) error {
+	if p.Dir != "" {
+		if fi, err := os.Stat(p.Dir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("invalid landing page directory %q", p.Dir)
+		}
+	}
+	if p.ShowVersion && r.customHTTPHandlers["/version"] != nil {
+		return fmt.Errorf("/version already has a custom handler")
+	}
+	r.landing = p
+	return nil
+}
+
+// registerBuiltins adds the endpoints served by the server itself to its mux.
+func (r *WebTunnelServer) registerBuiltins() {
+	r.mux.HandleFunc("/ws", r.wsEndpoint)
+	r.mux.HandleFunc("/metrichealthz", r.healthEndpoint)
+	r.mux.HandleFunc("/metricvarz", r.metricEndpoint)
+	r.mux.HandleFunc("/servers", r.serversEndpoint)
+	r.mux.HandleFunc("/config", r.configEndpoint)
+	r.mux.HandleFunc("/metrics", r.prometheusEndpoint)
+}
+
+// registerHandlers adds the configured and custom handlers to the mux. Custom handlers
+// for /, or one registered directly on the mux, replace the landing page.
+func (r *WebTunnelServer) registerHandlers() {
+	if r.landing.ShowVersion {
+		r.mux.HandleFunc("/version", versionEndpoint)
+	}
+	if r.admin != nil && r.admin.cfg.Addr == "" {
+		r.mux.Handle(AdminPrefix, r.adminHandler())
+	}
+	for e, h := range r.customHTTPHandlers {
+		r.mux.Handle(e, h)
+	}
+	if _, pattern := r.mux.Handler(&http.Request{Method: http.MethodGet, URL: &url.URL{Path: "/"}}); pattern == "" {
+		r.mux.Handle("/", r.landingHandler())
+	}
+}
+
+// ServeMux returns the handlers of the server. Embedders may add handlers to it prior to
+// Start, as with SetCustomHandler; the built-in endpoints are already registered.
+func (r *WebTunnelServer) ServeMux() *http.ServeMux {
+	return r.mux
+}
+
+// HTTPServer returns the HTTP server serving clients, eg. to set timeouts, an error log
+// or wrap its Handler with middleware prior to Start. Its TLSConfig is set by Listen if
+// nil.
+func (r *WebTunnelServer) HTTPServer() *http.Server {
+	return r.httpServer
+}
+
+// landingHandler returns the handler for / and paths without a handler.
+func (r *WebTunnelServer) landingHandler() http.Handler {
+	p := r.landing
+	content := p.Content
+	if content == nil {
+		content = []byte("OK")
+	}
+	var static http.Handler
+	if p.Dir != "" {
+		static = http.FileServer(http.Dir(p.Dir))
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, rcv *http.Request) {
+		if static != nil && rcv.URL.Path != "/" {
+			static.ServeHTTP(w, rcv)
+			return
+		}
+		if p.ContentType != "" {
+			w.Header().Set("Content-Type", p.ContentType)
+		}
+		w.Write(content)
+	})
+}
+
+// versionEndpoint serves the build information as JSON.
+func versionEndpoint(w http.ResponseWriter, rcv *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(version.Get())
+}
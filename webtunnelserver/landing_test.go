@@ -0,0 +1,114 @@
+package webtunnelserver
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/deepakkamesh/webtunnel/webtunnelcommon/version"
+)
+
+func TestLandingPage(t *testing.T) {
+	get := func(r *WebTunnelServer, path string) (*http.Response, string) {
+		r.mux = http.NewServeMux()
+		r.registerBuiltins()
+		r.registerHandlers()
+		rec := httptest.NewRecorder()
+		r.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		b, _ := io.ReadAll(rec.Result().Body)
+		return rec.Result(), string(b)
+	}
+
+	// Without configuration any unknown path answers OK.
+	r := &WebTunnelServer{customHTTPHandlers: make(map[string]http.Handler)}
+	if _, body := get(r, "/anything"); body != "OK" {
+		t.Errorf("Expected OK, got %q", body)
+	}
+	if _, body := get(r, "/version"); body != "OK" {
+		t.Errorf("Expected no version endpoint by default, got %q", body)
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "style.css"), []byte("body{}"), 0644)
+	if err := r.SetLandingPage(LandingPage{Dir: filepath.Join(dir, "missing")}); err == nil {
+		t.Error("Expected error for a missing directory")
+	}
+	if err := r.SetLandingPage(LandingPage{Content: []byte("<h1>Welcome</h1>"), ContentType: "text/html", Dir: dir, ShowVersion: true}); err != nil {
+		t.Fatal(err)
+	}
+	if resp, body := get(r, "/"); body != "<h1>Welcome</h1>" || resp.Header.Get("Content-Type") != "text/html" {
+		t.Errorf("Expected landing page, got %q %v", body, resp.Header)
+	}
+	if _, body := get(r, "/style.css"); body != "body{}" {
+		t.Errorf("Expected static file, got %q", body)
+	}
+	if resp, _ := get(r, "/missing.js"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing file, got %v", resp.StatusCode)
+	}
+	_, body := get(r, "/version")
+	info := version.Info{}
+	if err := json.Unmarshal([]byte(body), &info); err != nil || info.Version != version.Version {
+		t.Errorf("Expected version info, got %q %v", body, err)
+	}
+
+	// Embedders add handlers without replacing the built-in ones.
+	for _, e := range []string{"/ws", "/metricvarz", "/version"} {
+		if err := r.SetCustomHandler(e, http.NotFoundHandler()); err == nil {
+			t.Errorf("Expected error overriding %v", e)
+		}
+	}
+	hello := http.HandlerFunc(func(w http.ResponseWriter, rcv *http.Request) { io.WriteString(w, "hello") })
+	if err := r.SetCustomHandler("/hello", hello); err != nil {
+		t.Fatal(err)
+	}
+	if _, body := get(r, "/hello"); body != "hello" {
+		t.Errorf("Expected custom handler, got %q", body)
+	}
+	r.SetCustomHandler("/", hello)
+	if _, body := get(r, "/"); body != "hello" {
+		t.Errorf("Expected custom handler to replace the landing page, got %q", body)
+	}
+}
+
+func TestServeMux(t *testing.T) {
+	newServer := func(name string) *WebTunnelServer {
+		r, err := NewWebTunnelServer("127.0.0.1:0", "192.168.0.1", "255.255.255.0", "192.168.0.0/24",
+			nil, []string{"1.1.1.0/24"}, false, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.SetCustomHandler("/name", http.HandlerFunc(func(w http.ResponseWriter, rcv *http.Request) { io.WriteString(w, name) }))
+		return r
+	}
+	get := func(r *WebTunnelServer, path string) string {
+		rec := httptest.NewRecorder()
+		r.HTTPServer().Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		b, _ := io.ReadAll(rec.Result().Body)
+		return string(b)
+	}
+
+	// Two servers in one process register the same endpoints on their own mux.
+	r1, r2 := newServer("one"), newServer("two")
+	r2.ServeMux().HandleFunc("/", func(w http.ResponseWriter, rcv *http.Request) { io.WriteString(w, "root") })
+	r1.registerHandlers()
+	r2.registerHandlers()
+	if got := get(r1, "/name"); got != "one" {
+		t.Errorf("Expected one, got %q", got)
+	}
+	if got := get(r2, "/name"); got != "two" {
+		t.Errorf("Expected two, got %q", got)
+	}
+	if got := get(r1, "/"); got != "OK" {
+		t.Errorf("Expected landing page, got %q", got)
+	}
+	if got := get(r2, "/"); got != "root" {
+		t.Errorf("Expected handler registered on the mux to replace the landing page, got %q", got)
+	}
+	if got := get(r1, "/metrichealthz"); got == "" {
+		t.Error("Expected built-in health endpoint")
+	}
+}
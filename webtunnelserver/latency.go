@@ -0,0 +1,137 @@
+package webtunnelserver
+
+import (
+	"sync"
+	"time"
+)
+
+// Upper bounds of the RTT histogram buckets. Samples above the last bound are counted
+// in an overflow bucket.
+var rttBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+}
+
+// LatencyStats is the RTT summary of a session measured with keepalive pings.
+type LatencyStats struct {
+	Samples int           // Number of RTT samples.
+	Last    time.Duration // Last RTT.
+	P50     time.Duration // Median RTT, estimated from the histogram bucket bounds.
+	P90     time.Duration // 90th percentile RTT.
+	P99     time.Duration // 99th percentile RTT.
+	Jitter  time.Duration // Smoothed RTT variation (RFC 3550).
+	Buckets []int         // Sample count per rttBuckets bound, plus overflow.
+}
+
+// rttTracker holds the ping send times and RTT stats of each session.
+type rttTracker struct {
+	sent  map[string]time.Time     // Send time of the outstanding ping per client IP.
+	stats map[string]*LatencyStats // RTT stats per client IP.
+	lock  sync.Mutex
+}
+
+// newRTTTracker returns an empty tracker.
+func newRTTTracker() *rttTracker {
+	return &rttTracker{
+		sent:  make(map[string]time.Time),
+		stats: make(map[string]*LatencyStats),
+	}
+}
+
+// pingSent records the send time of a ping to ip.
+func (t *rttTracker) pingSent(ip string, at time.Time) {
+	t.lock.Lock()
+	t.sent[ip] = at
+	t.lock.Unlock()
+}
+
+// pongReceived records an RTT sample for ip if a ping is outstanding.
+func (t *rttTracker) pongReceived(ip string, at time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	sent, ok := t.sent[ip]
+	if !ok {
+		return
+	}
+	delete(t.sent, ip)
+	t.add(ip, at.Sub(sent))
+}
+
+// add records rtt in the stats of ip. Must be called with the lock held.
+func (t *rttTracker) add(ip string, rtt time.Duration) {
+	s, ok := t.stats[ip]
+	if !ok {
+		s = &LatencyStats{Buckets: make([]int, len(rttBuckets)+1)}
+		t.stats[ip] = s
+	}
+	if s.Samples > 0 {
+		d := rtt - s.Last
+		if d < 0 {
+			d = -d
+		}
+		s.Jitter += (d - s.Jitter) / 16
+	}
+	s.Samples++
+	s.Last = rtt
+	i := 0
+	for i < len(rttBuckets) && rtt > rttBuckets[i] {
+		i++
+	}
+	s.Buckets[i]++
+	s.P50 = s.percentile(0.50)
+	s.P90 = s.percentile(0.90)
+	s.P99 = s.percentile(0.99)
+}
+
+// percentile returns the upper bound of the bucket holding the p quantile. Samples in
+// the overflow bucket report the last bound.
+func (s *LatencyStats) percentile(p float64) time.Duration {
+	want := int(p*float64(s.Samples) + 0.5)
+	if want < 1 {
+		want = 1
+	}
+	n := 0
+	for i, c := range s.Buckets {
+		n += c
+		if n >= want {
+			if i == len(rttBuckets) {
+				break
+			}
+			return rttBuckets[i]
+		}
+	}
+	return rttBuckets[len(rttBuckets)-1]
+}
+
+// release removes the stats of a disconnected client.
+func (t *rttTracker) release(ip string) {
+	t.lock.Lock()
+	delete(t.sent, ip)
+	delete(t.stats, ip)
+	t.lock.Unlock()
+}
+
+// snapshot returns a copy of the stats of all sessions.
+func (t *rttTracker) snapshot() map[string]LatencyStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	m := make(map[string]LatencyStats)
+	for ip, s := range t.stats {
+		c := *s
+		c.Buckets = append([]int(nil), s.Buckets...)
+		m[ip] = c
+	}
+	return m
+}
+
+// GetLatencyStats returns the RTT stats of each session keyed by client IP.
+func (r *WebTunnelServer) GetLatencyStats() map[string]LatencyStats {
+	return r.rtt.snapshot()
+}
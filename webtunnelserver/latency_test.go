@@ -0,0 +1,40 @@
+package webtunnelserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyStats(t *testing.T) {
+	rt := newRTTTracker()
+	now := time.Now()
+
+	// Pong without an outstanding ping is ignored.
+	rt.pongReceived("192.168.0.2", now)
+	if len(rt.snapshot()) != 0 {
+		t.Fatal("Expected no samples without ping")
+	}
+
+	for _, rtt := range []time.Duration{8, 8, 8, 8, 8, 8, 8, 8, 40, 3000} {
+		rt.pingSent("192.168.0.2", now)
+		rt.pongReceived("192.168.0.2", now.Add(rtt*time.Millisecond))
+	}
+	s := rt.snapshot()["192.168.0.2"]
+	if s.Samples != 10 || s.Last != 3*time.Second {
+		t.Errorf("Unexpected samples %v last %v", s.Samples, s.Last)
+	}
+	if s.P50 != 10*time.Millisecond || s.P90 != 50*time.Millisecond || s.P99 != 2*time.Second {
+		t.Errorf("Unexpected percentiles p50 %v p90 %v p99 %v", s.P50, s.P90, s.P99)
+	}
+	if s.Buckets[1] != 8 || s.Buckets[len(rttBuckets)] != 1 {
+		t.Errorf("Unexpected histogram %v", s.Buckets)
+	}
+	if s.Jitter <= 0 {
+		t.Errorf("Expected jitter, got %v", s.Jitter)
+	}
+
+	rt.release("192.168.0.2")
+	if len(rt.snapshot()) != 0 {
+		t.Error("Expected stats removed on release")
+	}
+}
@@ -0,0 +1,155 @@
+package webtunnelserver
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Interval between resource usage samples for load shedding.
+const defaultWatermarkInterval = time.Second
+
+// DSCP values dropped first while shedding traffic (best effort and CS1 scavenger).
+const (
+	dscpBestEffort = 0
+	dscpScavenger  = 8
+)
+
+// Watermarks are the resource thresholds above which the server sheds load. A zero
+// threshold is not checked.
+type Watermarks struct {
+	MaxHeapBytes    uint64 // Go heap in use.
+	MaxGoroutines   int    // Number of goroutines.
+	MaxQueueDepth   int    // Data messages queued across all client connections.
+	ShedLowPriority bool   // Also drop best effort and scavenger traffic to clients.
+}
+
+// ShedAction is the action taken while overloaded.
+type ShedAction string
+
+const (
+	ShedRejectSession ShedAction = "reject_session" // New session refused with 503.
+	ShedStart         ShedAction = "shed_start"     // Overload detected.
+	ShedStop          ShedAction = "shed_stop"      // Resource usage back under watermarks.
+)
+
+// ShedEvent is the audit record of a load shedding action.
+type ShedEvent struct {
+	Action ShedAction `json:"action"`
+	Reason string     `json:"reason"`
+	Remote string     `json:"remote,omitempty"`
+	Time   time.Time  `json:"time"`
+}
+
+// loadShedder holds the watermarks and the current overload state.
+type loadShedder struct {
+	marks    Watermarks
+	listener func(ShedEvent) // Audit listener, nil to only log.
+	reason   string          // Why the server is overloaded, empty if not.
+	lock     sync.Mutex
+}
+
+// SetWatermarks enables load shedding. While any watermark is exceeded new sessions are
+// refused with 503 and, if enabled, low priority traffic to clients is dropped. Each shed
+// action is logged and passed to listener, which may be nil. This should be called prior
+// to Start.
+func (r *WebTunnelServer) SetWatermarks(marks Watermarks, listener func(ShedEvent)) {
+	r.shedder = &loadShedder{marks: marks, listener: listener}
+}
+
+// overloadReason returns why the server is overloaded, or empty if it is not.
+func (r *WebTunnelServer) overloadReason() string {
+	if r.shedder == nil {
+		return ""
+	}
+	r.shedder.lock.Lock()
+	defer r.shedder.lock.Unlock()
+	return r.shedder.reason
+}
+
+// shedEvent records a shed action in the metrics and the audit log.
+func (r *WebTunnelServer) shedEvent(action ShedAction, reason, remote string) {
+	ev := ShedEvent{Action: action, Reason: reason, Remote: remote, Time: time.Now()}
+	glog.Warningf("load shedding %v: %v %v", action, reason, remote)
+	if action == ShedRejectSession {
+		r.metricsLock.Lock()
+		r.metrics.ShedSessions++
+		r.metricsLock.Unlock()
+	}
+	if r.shedder.listener != nil {
+		r.shedder.listener(ev)
+	}
+}
+
+// shedPacket returns true if a packet with dscp to a client should be dropped.
+func (r *WebTunnelServer) shedPacket(dscp uint8) bool {
+	if r.shedder == nil || !r.shedder.marks.ShedLowPriority || r.overloadReason() == "" {
+		return false
+	}
+	if dscp != dscpBestEffort && dscp != dscpScavenger {
+		return false
+	}
+	r.metricsLock.Lock()
+	r.metrics.ShedPackets++
+	r.metricsLock.Unlock()
+	return true
+}
+
+// checkWatermarks returns why resource usage exceeds the watermarks, or empty.
+func (r *WebTunnelServer) checkWatermarks() string {
+	m := r.shedder.marks
+	if m.MaxGoroutines > 0 {
+		if n := runtime.NumGoroutine(); n > m.MaxGoroutines {
+			return fmt.Sprintf("goroutines %v > %v", n, m.MaxGoroutines)
+		}
+	}
+	if m.MaxQueueDepth > 0 {
+		depth := 0
+		r.connMapLock.Lock()
+		for _, ws := range r.conns {
+			_, d := ws.QueueLen()
+			depth += d
+		}
+		r.connMapLock.Unlock()
+		if depth > m.MaxQueueDepth {
+			return fmt.Sprintf("queue depth %v > %v", depth, m.MaxQueueDepth)
+		}
+	}
+	if m.MaxHeapBytes > 0 {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		if ms.HeapInuse > m.MaxHeapBytes {
+			return fmt.Sprintf("heap %v > %v bytes", ms.HeapInuse, m.MaxHeapBytes)
+		}
+	}
+	return ""
+}
+
+// processWatermarks samples resource usage and updates the overload state.
+func (r *WebTunnelServer) processWatermarks() {
+	if r.shedder == nil {
+		return
+	}
+	for {
+		if r.isStopped.Load() {
+			glog.V(1).Info("Exiting watermark routine")
+			return
+		}
+		reason := r.checkWatermarks()
+		r.shedder.lock.Lock()
+		prev := r.shedder.reason
+		r.shedder.reason = reason
+		r.shedder.lock.Unlock()
+
+		switch {
+		case prev == "" && reason != "":
+			r.shedEvent(ShedStart, reason, "")
+		case prev != "" && reason == "":
+			r.shedEvent(ShedStop, prev, "")
+		}
+		time.Sleep(defaultWatermarkInterval)
+	}
+}
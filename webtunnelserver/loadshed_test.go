@@ -0,0 +1,45 @@
+package webtunnelserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+)
+
+func TestLoadShedding(t *testing.T) {
+	r := &WebTunnelServer{metrics: &Metrics{}, conns: make(map[string]*wc.WSWriter)}
+	if r.shedPacket(dscpBestEffort) {
+		t.Error("Expected no shedding with watermarks disabled")
+	}
+
+	var events []ShedEvent
+	r.SetWatermarks(Watermarks{MaxGoroutines: 1, ShedLowPriority: true}, func(ev ShedEvent) {
+		events = append(events, ev)
+	})
+	reason := r.checkWatermarks()
+	if reason == "" {
+		t.Fatal("Expected goroutine watermark exceeded")
+	}
+	r.shedder.reason = reason
+
+	if !r.shedPacket(dscpBestEffort) {
+		t.Error("Expected best effort packet shed")
+	}
+	if r.shedPacket(46) {
+		t.Error("Expected EF packet not shed")
+	}
+
+	rec := httptest.NewRecorder()
+	r.wsEndpoint(rec, httptest.NewRequest(http.MethodGet, "/ws", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while overloaded, got %v", rec.Code)
+	}
+	if len(events) != 1 || events[0].Action != ShedRejectSession {
+		t.Errorf("Expected reject session audit event, got %v", events)
+	}
+	if r.metrics.ShedSessions != 1 || r.metrics.ShedPackets != 1 {
+		t.Errorf("Unexpected shed metrics %+v", r.metrics)
+	}
+}
@@ -0,0 +1,182 @@
+package webtunnelserver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+)
+
+// Time the sequence state of a disconnected session is kept for the client to reconnect.
+const seqParkTime = 10 * time.Minute
+
+// parkedSeq is the sequence state of a disconnected session.
+type parkedSeq struct {
+	rx     *wc.SeqTracker // Receive window, nil if the client sent no sequenced frames.
+	tx     uint32         // Sequence number of the last frame sent.
+	parked time.Time
+}
+
+// lossTracker holds the sequence trackers of data frames received from each session.
+type lossTracker struct {
+	trackers   map[string]*wc.SeqTracker // Tracker per client IP.
+	parked     map[string]parkedSeq      // State of disconnected sessions per session token.
+	antiReplay bool                      // Drop replayed frames, see SetAntiReplay.
+	lock       sync.Mutex
+}
+
+// newLossTracker returns an empty tracker.
+func newLossTracker() *lossTracker {
+	return &lossTracker{trackers: make(map[string]*wc.SeqTracker), parked: make(map[string]parkedSeq)}
+}
+
+// record records the receipt of the frame numbered seq from ip. It returns false for
+// duplicate frames.
+func (t *lossTracker) record(ip string, seq uint32) bool {
+	return t.tracker(ip).Record(seq)
+}
+
+// unsequenced records the receipt of a frame without sequence number from ip. It returns
+// false if the frame should be dropped by anti-replay.
+func (t *lossTracker) unsequenced(ip string) bool {
+	if !t.antiReplay {
+		return true
+	}
+	t.lock.Lock()
+	s, ok := t.trackers[ip]
+	t.lock.Unlock()
+	return !ok || s.Unsequenced()
+}
+
+// tracker returns the tracker of ip, created if needed.
+func (t *lossTracker) tracker(ip string) *wc.SeqTracker {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s, ok := t.trackers[ip]
+	if !ok {
+		s = &wc.SeqTracker{}
+		s.SetAntiReplay(t.antiReplay)
+		t.trackers[ip] = s
+	}
+	return s
+}
+
+// newStream restarts the sequence of ip when its session moves to a new connection.
+func (t *lossTracker) newStream(ip string) {
+	t.lock.Lock()
+	s, ok := t.trackers[ip]
+	t.lock.Unlock()
+	if ok {
+		s.NewStream()
+	}
+}
+
+// release removes the tracker of a disconnected client.
+func (t *lossTracker) release(ip string) {
+	t.lock.Lock()
+	delete(t.trackers, ip)
+	t.lock.Unlock()
+}
+
+// park keeps the receive window of ip and tx, the last sequence number sent to it, for
+// session to continue on a new connection.
+func (t *lossTracker) park(ip, session string, tx uint32) {
+	now := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for k, p := range t.parked {
+		if now.Sub(p.parked) > seqParkTime {
+			delete(t.parked, k)
+		}
+	}
+	t.parked[session] = parkedSeq{rx: t.trackers[ip], tx: tx, parked: now}
+	delete(t.trackers, ip)
+}
+
+// unpark restores the parked state of session for ip and returns the last sequence number
+// sent. ok is false if nothing was parked.
+func (t *lossTracker) unpark(ip, session string) (tx uint32, ok bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	p, ok := t.parked[session]
+	if !ok || time.Since(p.parked) > seqParkTime {
+		return 0, false
+	}
+	delete(t.parked, session)
+	if p.rx != nil {
+		t.trackers[ip] = p.rx
+	}
+	return p.tx, true
+}
+
+// snapshot returns the stats of all sessions sending sequenced frames.
+func (t *lossTracker) snapshot() map[string]wc.LossStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	m := make(map[string]wc.LossStats)
+	for ip, s := range t.trackers {
+		m[ip] = s.Stats()
+	}
+	return m
+}
+
+// GetLossStats returns the loss, reorder and duplication stats of data frames received
+// from each session keyed by client IP. Only clients sending sequence numbers are included.
+func (r *WebTunnelServer) GetLossStats() map[string]wc.LossStats {
+	return r.loss.snapshot()
+}
+
+type seqDedupKey struct{}
+
+// withSeqDedup marks ctx as a connection whose client continues its sequence numbers
+// across reconnects.
+func withSeqDedup(ctx context.Context) context.Context {
+	return context.WithValue(ctx, seqDedupKey{}, true)
+}
+
+// seqDedup returns true if the client of ctx continues its sequence numbers across reconnects.
+func seqDedup(ctx context.Context) bool {
+	d, _ := ctx.Value(seqDedupKey{}).(bool)
+	return d
+}
+
+// parkSequence keeps the sequence state of the session on ip for the client to continue
+// it when reconnecting.
+func (r *WebTunnelServer) parkSequence(ip string) {
+	userinfo, err := r.ipam.GetUserinfo(ip)
+	if err != nil || userinfo.Session == "" {
+		return
+	}
+	var tx uint32
+	if data, err := r.ipam.GetData(ip); err == nil {
+		if ws, ok := data.(*wc.WSWriter); ok {
+			tx = ws.Sequence()
+		}
+	}
+	r.loss.park(ip, userinfo.Session, tx)
+}
+
+// continueSequence continues the parked sequence state of session on ws, the new
+// connection of a client reconnecting on ip. It returns false if there was none.
+func (r *WebTunnelServer) continueSequence(ws *wc.WSWriter, ip, session string) bool {
+	tx, ok := r.loss.unpark(ip, session)
+	if !ok {
+		return false
+	}
+	ws.SetSequence(tx)
+	glog.V(1).Infof("continuing data frame sequence of %v after %v", ip, tx)
+	return true
+}
+
+/*
+SetAntiReplay drops sequenced data frames from clients that may be replays, mirroring the
+IPsec anti-replay window: duplicates, frames older than the receive window and, once a
+client sends sequenced frames, unsequenced ones. Drops are counted per client in the
+Replays field of Metrics.Loss. Clients validate the server to client direction with
+their own SetAntiReplay. This should be called prior to Start.
+*/
+func (r *WebTunnelServer) SetAntiReplay(enable bool) {
+	r.loss.antiReplay = enable
+}
@@ -0,0 +1,145 @@
+package webtunnelserver
+
+import (
+	"testing"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+)
+
+func TestLossTracker(t *testing.T) {
+	l := newLossTracker()
+	// 3 and 6 are lost, 4 arrives late and 5 twice.
+	for _, seq := range []uint32{1, 2, 5, 4, 5, 7, 8} {
+		l.record("192.168.0.2", seq)
+	}
+	s := l.snapshot()["192.168.0.2"]
+	if s.Received != 7 || s.Lost != 2 || s.Reordered != 1 || s.Duplicates != 1 {
+		t.Errorf("Expected 7 received, 2 lost, 1 reordered, 1 duplicate, got %+v", s)
+	}
+	if s.LossRate != 0.25 {
+		t.Errorf("Expected loss rate 0.25, got %v", s.LossRate)
+	}
+
+	// A new connection restarts the sequence without counting loss.
+	l.newStream("192.168.0.2")
+	l.record("192.168.0.2", 1)
+	if s := l.snapshot()["192.168.0.2"]; s.Lost != 2 || s.Duplicates != 1 {
+		t.Errorf("Expected counts kept across streams, got %+v", s)
+	}
+
+	l.release("192.168.0.2")
+	if len(l.snapshot()) != 0 {
+		t.Error("Expected stats released")
+	}
+}
+
+func TestAntiReplay(t *testing.T) {
+	l := newLossTracker()
+	l.antiReplay = true
+	ip := "192.168.0.2"
+	if !l.unsequenced(ip) {
+		t.Error("Expected unsequenced frames accepted before the stream is sequenced")
+	}
+	// 2 is replayed, 3000 moves the window past 1 and 5 while 2990 is late but in window.
+	want := []bool{true, true, true, false, true, true, false, false}
+	for i, seq := range []uint32{1, 2, 5, 2, 3000, 2990, 1, 5} {
+		if got := l.record(ip, seq); got != want[i] {
+			t.Errorf("Expected frame %v accepted %v, got %v", seq, want[i], got)
+		}
+	}
+	if l.unsequenced(ip) {
+		t.Error("Expected unsequenced frame dropped in a sequenced stream")
+	}
+	if s := l.snapshot()[ip]; s.Replays != 4 || s.Duplicates != 1 {
+		t.Errorf("Expected 4 replays and 1 duplicate, got %+v", s)
+	}
+}
+
+func TestAntiReplayWraparound(t *testing.T) {
+	l := newLossTracker()
+	l.antiReplay = true
+	ip := "192.168.0.2"
+	// The sequence wraps from 0xFFFFFFFF to 0; 0xFFFFFFFE arrives late and 0 twice.
+	want := []bool{true, true, true, true, true, false, true}
+	for i, seq := range []uint32{0xFFFFFFFD, 0xFFFFFFFF, 0, 0xFFFFFFFE, 2, 0, 1} {
+		if got := l.record(ip, seq); got != want[i] {
+			t.Errorf("Expected frame %#x accepted %v, got %v", seq, want[i], got)
+		}
+	}
+	if s := l.snapshot()[ip]; s.Replays != 1 || s.Lost != 0 || s.Reordered != 2 {
+		t.Errorf("Expected 1 replay, no loss and 2 reordered across the wrap, got %+v", s)
+	}
+	// Frames a window behind the wrapped sequence are still replays.
+	if l.record(ip, 0xFFFFF000) {
+		t.Error("Expected frame older than the window dropped after the wrap")
+	}
+}
+
+func TestSequenceDedup(t *testing.T) {
+	ws, client := wsPair(t)
+	defer ws.Close()
+	defer client.Close()
+
+	ipam, _ := NewIPPam("192.168.0.0/24")
+	ip, _ := ipam.AcquireIP(ws)
+	ipam.SetIPActiveWithUserInfo(ip, "user", "host")
+	ipam.SetSession(ip, "token")
+	r := &WebTunnelServer{ipam: ipam, loss: newLossTracker()}
+
+	if !r.loss.record(ip, 1) || !r.loss.record(ip, 2) || r.loss.record(ip, 2) {
+		t.Error("Expected only the repeated frame reported as duplicate")
+	}
+
+	// The session state survives the disconnect for the client to continue it.
+	ws.SetSequence(41)
+	r.parkSequence(ip)
+	ipam.ReleaseIP(ip)
+	r.loss.release(ip)
+	if r.continueSequence(ws, ip, "other") {
+		t.Error("Expected no state for an unknown session")
+	}
+	ws2, client2 := wsPair(t)
+	defer ws2.Close()
+	defer client2.Close()
+	if !r.continueSequence(ws2, ip, "token") || ws2.Sequence() != 41 {
+		t.Errorf("Expected sequence continued after 41, got %v", ws2.Sequence())
+	}
+	if r.loss.record(ip, 2) || !r.loss.record(ip, 3) {
+		t.Error("Expected the receive window kept across connections")
+	}
+	if r.continueSequence(ws2, ip, "token") {
+		t.Error("Expected parked state used once")
+	}
+}
+
+func TestAntiReplayDummyFrames(t *testing.T) {
+	ws, client := wsPair(t)
+	defer ws.Close()
+	defer client.Close()
+	dw := wc.NewWSWriter(ws.Conn(), &wc.ObfuscationPolicy{DummyInterval: time.Millisecond, DummySize: 64})
+	defer dw.Close()
+	dw.SetSequencing(true)
+
+	// Dummy frames of an obfuscated sequenced stream pass the anti-replay window.
+	l := newLossTracker()
+	l.antiReplay = true
+	ip := "192.168.0.2"
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 5; i++ {
+		_, frame, err := client.ReadMessage()
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		seq, pkt, ok := wc.ParseSeqFrame(frame)
+		if !ok {
+			t.Fatal("Expected dummy frames sequenced, unsequenced frames are dropped by anti-replay")
+		}
+		if !l.record(ip, seq) {
+			t.Errorf("Expected dummy frame %v accepted", seq)
+		}
+		if wc.StripPadding(pkt) != nil {
+			t.Error("Expected a dummy frame")
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package webtunnelserver
+
+import (
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// processMTUProbe acknowledges an MTU probe from the client on ip that arrived intact.
+// Damaged probes are not acknowledged, so the client treats the size as too large.
+func (r *WebTunnelServer) processMTUProbe(ws *wc.WSWriter, ip string, msg []byte) {
+	size, ok := wc.ParseMTUProbe(msg)
+	if !ok {
+		glog.V(1).Infof("damaged MTU probe of %v bytes from %v", len(msg), ip)
+		return
+	}
+	if err := ws.WriteControlMessage(websocket.TextMessage, wc.MTUAckMessage(size)); err != nil {
+		glog.Warningf("error acknowledging MTU probe from %v: %v", ip, err)
+	}
+}
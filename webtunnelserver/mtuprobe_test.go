@@ -0,0 +1,24 @@
+package webtunnelserver
+
+import (
+	"testing"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+)
+
+func TestMTUProbeMessage(t *testing.T) {
+	msg := wc.MTUProbeMessage(1400)
+	if len(msg) != 1400 {
+		t.Fatalf("Expected 1400 byte probe, got %v", len(msg))
+	}
+	if size, ok := wc.ParseMTUProbe(msg); !ok || size != 1400 {
+		t.Errorf("Expected probe of 1400, got %v %v", size, ok)
+	}
+	// Truncated probes are not acknowledged.
+	if _, ok := wc.ParseMTUProbe(msg[:1000]); ok {
+		t.Error("Expected truncated probe rejected")
+	}
+	if size, ok := wc.ParseMTUAck(wc.MTUAckMessage(1400)); !ok || size != 1400 {
+		t.Errorf("Expected ack of 1400, got %v %v", size, ok)
+	}
+}
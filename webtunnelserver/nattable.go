@@ -0,0 +1,245 @@
+package webtunnelserver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ReadNATTable (Overridable) Returns the egress NAT bindings of the flows from clientNet, translated by the OS.
+var ReadNATTable = readNATTable
+
+// NATPortRange (Overridable) First and last source port the egress NAT allocates, for pool utilization.
+var NATPortRange = [2]int{1024, 65535}
+
+// NATBinding is an egress NAT binding of a client flow.
+type NATBinding struct {
+	Proto      string        // Protocol name eg. tcp, udp, icmp.
+	ClientIP   string        // Client tunnel IP.
+	ClientPort uint16        // Client port, ICMP echo ID for icmp.
+	DstIP      string        // Remote IP.
+	DstPort    uint16        // Remote port.
+	NATIP      string        // Translated source IP.
+	NATPort    uint16        // Translated source port, ICMP echo ID for icmp.
+	State      string        // TCP state, empty for other protocols.
+	Timeout    time.Duration // Time left before the binding expires.
+}
+
+// NATPool is the source port usage of an egress IP.
+type NATPool struct {
+	IP          string  // Translated source IP.
+	Proto       string  // Protocol name, ports are allocated per protocol.
+	Used        int     // Source ports bound.
+	Size        int     // Source ports in NATPortRange.
+	Utilization float64 // Fraction of the pool bound.
+}
+
+// NATTable is a snapshot of the egress NAT bindings of the clients.
+type NATTable struct {
+	Time     time.Time    // Time of the snapshot.
+	Bindings []NATBinding // Bindings sorted by client IP.
+	Pools    []NATPool    // Port pools sorted by utilization, highest first.
+}
+
+// natMonitor samples the egress NAT table.
+type natMonitor struct {
+	interval time.Duration
+	warning  float64   // Pool utilization logged as a warning, 0 disables.
+	table    *NATTable // Last snapshot, nil before the first.
+	warned   bool      // A pool is over the warning threshold.
+	lock     sync.Mutex
+}
+
+/*
+SetNATMonitor samples the egress NAT table of the OS every interval, so source port
+exhaustion of the egress IPs can be diagnosed: the bindings of client flows and the port
+pool utilization of each egress IP are returned by NATTable and summarized in the
+metrics, and a warning is logged when a pool reaches warning (0 disables). The server
+does not translate addresses itself; on Linux the bindings are read from the conntrack
+table of the masquerading kernel. This should be called prior to Start.
+*/
+func (r *WebTunnelServer) SetNATMonitor(interval time.Duration, warning float64) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid NAT sample interval %v", interval)
+	}
+	if warning < 0 || warning > 1 {
+		return fmt.Errorf("invalid NAT pool warning %v", warning)
+	}
+	r.nat = &natMonitor{interval: interval, warning: warning}
+	return nil
+}
+
+// NATTable returns the last snapshot of the egress NAT table, nil if NAT monitoring is
+// disabled or no sample was taken yet.
+func (r *WebTunnelServer) NATTable() *NATTable {
+	if r.nat == nil {
+		return nil
+	}
+	r.nat.lock.Lock()
+	defer r.nat.lock.Unlock()
+	return r.nat.table
+}
+
+// processNATMonitor samples the egress NAT table.
+func (r *WebTunnelServer) processNATMonitor() {
+	if r.nat == nil {
+		return
+	}
+	_, clientNet, err := net.ParseCIDR(r.clientNetPrefix)
+	if err != nil {
+		glog.Errorf("NAT monitor disabled, invalid client network %v", r.clientNetPrefix)
+		return
+	}
+	for {
+		if r.isStopped.Load() {
+			glog.V(1).Info("Exiting NAT monitor routine")
+			return
+		}
+		if err := r.sampleNAT(clientNet, time.Now()); err != nil {
+			glog.Warningf("error reading NAT table: %v", err)
+		}
+		time.Sleep(r.nat.interval)
+	}
+}
+
+// sampleNAT records the NAT table at now and warns about exhausted port pools.
+func (r *WebTunnelServer) sampleNAT(clientNet *net.IPNet, now time.Time) error {
+	bindings, err := ReadNATTable(clientNet)
+	if err != nil {
+		return err
+	}
+	t := &NATTable{Time: now, Bindings: bindings, Pools: natPools(bindings)}
+
+	r.nat.lock.Lock()
+	r.nat.table = t
+	over := r.nat.warning > 0 && len(t.Pools) > 0 && t.Pools[0].Utilization >= r.nat.warning
+	changed := over != r.nat.warned
+	r.nat.warned = over
+	r.nat.lock.Unlock()
+
+	switch {
+	case changed && over:
+		p := t.Pools[0]
+		glog.Warningf("NAT port pool of %v/%v %.1f%% used (%v of %v ports)", p.IP, p.Proto, p.Utilization*100, p.Used, p.Size)
+	case changed:
+		glog.Infof("NAT port pools back under %.1f%%", r.nat.warning*100)
+	}
+	return nil
+}
+
+// natSummary returns the number of bindings and the highest pool utilization.
+func (r *WebTunnelServer) natSummary() (int, float64) {
+	t := r.NATTable()
+	if t == nil || len(t.Pools) == 0 {
+		return 0, 0
+	}
+	return len(t.Bindings), t.Pools[0].Utilization
+}
+
+// natPools returns the port pools used by bindings, highest utilization first.
+func natPools(bindings []NATBinding) []NATPool {
+	type poolKey struct{ ip, proto string }
+	used := make(map[poolKey]map[uint16]bool)
+	for _, b := range bindings {
+		k := poolKey{b.NATIP, b.Proto}
+		if used[k] == nil {
+			used[k] = make(map[uint16]bool)
+		}
+		used[k][b.NATPort] = true
+	}
+	size := NATPortRange[1] - NATPortRange[0] + 1
+	var pools []NATPool
+	for k, ports := range used {
+		pools = append(pools, NATPool{IP: k.ip, Proto: k.proto, Used: len(ports), Size: size,
+			Utilization: float64(len(ports)) / float64(size)})
+	}
+	sort.Slice(pools, func(i, j int) bool {
+		if pools[i].Utilization != pools[j].Utilization {
+			return pools[i].Utilization > pools[j].Utilization
+		}
+		return pools[i].IP+pools[i].Proto < pools[j].IP+pools[j].Proto
+	})
+	return pools
+}
+
+/*
+parseConntrack returns the translated flows from clientNet in a conntrack table, as in
+/proc/net/nf_conntrack. Each line holds the protocol, the timeout in seconds, the TCP
+state and the original and reply tuples:
+
+	ipv4 2 tcp 6 431999 ESTABLISHED src=192.168.0.2 dst=1.1.1.1 sport=5000 dport=443 src=1.1.1.1 dst=203.0.113.5 sport=443 dport=5000 [ASSURED] mark=0 use=2
+
+The reply tuple is addressed to the translated source.
+*/
+func parseConntrack(rd io.Reader, clientNet *net.IPNet) ([]NATBinding, error) {
+	var bindings []NATBinding
+	s := bufio.NewScanner(rd)
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) > 0 && f[0] == "ipv4" {
+			f = f[2:]
+		}
+		if len(f) < 3 {
+			continue
+		}
+		secs, err := strconv.Atoi(f[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid conntrack entry %q", s.Text())
+		}
+		b := NATBinding{Proto: f[0], Timeout: time.Duration(secs) * time.Second}
+		var orig, reply map[string]string
+		for _, field := range f[3:] {
+			k, v, ok := strings.Cut(field, "=")
+			switch {
+			case !ok && !strings.HasPrefix(field, "["):
+				b.State = field
+			case !ok:
+			case k == "src" && orig == nil:
+				orig = map[string]string{k: v}
+			case k == "src":
+				reply = map[string]string{k: v}
+			case reply != nil:
+				reply[k] = v
+			case orig != nil:
+				orig[k] = v
+			}
+		}
+		if orig == nil || reply == nil {
+			continue
+		}
+		src := net.ParseIP(orig["src"])
+		if src == nil || !clientNet.Contains(src) {
+			continue
+		}
+		b.ClientIP, b.DstIP, b.NATIP = orig["src"], orig["dst"], reply["dst"]
+		if b.Proto == "icmp" {
+			b.ClientPort, b.NATPort = parsePort(orig["id"]), parsePort(reply["id"])
+		} else {
+			b.ClientPort, b.DstPort, b.NATPort = parsePort(orig["sport"]), parsePort(orig["dport"]), parsePort(reply["dport"])
+		}
+		// Flows not translated (eg. to routed networks) use no pool port.
+		if b.NATIP == b.ClientIP {
+			continue
+		}
+		bindings = append(bindings, b)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(bindings, func(i, j int) bool { return bindings[i].ClientIP < bindings[j].ClientIP })
+	return bindings, nil
+}
+
+// parsePort returns the port in s, 0 if invalid.
+func parsePort(s string) uint16 {
+	p, _ := strconv.ParseUint(s, 10, 16)
+	return uint16(p)
+}
@@ -0,0 +1,18 @@
+package webtunnelserver
+
+import (
+	"net"
+	"os"
+)
+
+// conntrackFile is the kernel connection tracking table, holding the NAT bindings.
+const conntrackFile = "/proc/net/nf_conntrack"
+
+func readNATTable(clientNet *net.IPNet) ([]NATBinding, error) {
+	f, err := os.Open(conntrackFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseConntrack(f, clientNet)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package webtunnelserver
+
+import (
+	"fmt"
+	"net"
+)
+
+func readNATTable(clientNet *net.IPNet) ([]NATBinding, error) {
+	return nil, fmt.Errorf("NAT table not supported on this platform")
+}
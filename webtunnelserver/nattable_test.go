@@ -0,0 +1,73 @@
+package webtunnelserver
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNATTable(t *testing.T) {
+	table := `ipv4     2 tcp      6 431999 ESTABLISHED src=192.168.0.2 dst=1.1.1.1 sport=5000 dport=443 src=1.1.1.1 dst=203.0.113.5 sport=443 dport=5000 [ASSURED] mark=0 zone=0 use=2
+ipv4     2 udp      17 29 src=192.168.0.3 dst=8.8.8.8 sport=5353 dport=53 [UNREPLIED] src=8.8.8.8 dst=203.0.113.5 sport=53 dport=61000 mark=0 zone=0 use=2
+ipv4     2 icmp     1 29 src=192.168.0.2 dst=1.1.1.1 type=8 code=0 id=77 src=1.1.1.1 dst=203.0.113.5 type=0 code=0 id=77 mark=0 zone=0 use=2
+ipv4     2 tcp      6 100 TIME_WAIT src=10.0.0.9 dst=1.1.1.1 sport=1 dport=443 src=1.1.1.1 dst=203.0.113.5 sport=443 dport=1 mark=0 zone=0 use=2
+ipv4     2 tcp      6 100 ESTABLISHED src=192.168.0.2 dst=192.168.0.3 sport=1 dport=22 src=192.168.0.3 dst=192.168.0.2 sport=22 dport=1 mark=0 zone=0 use=2
+`
+	_, clientNet, _ := net.ParseCIDR("192.168.0.0/24")
+	bindings, err := parseConntrack(strings.NewReader(table), clientNet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []NATBinding{
+		{Proto: "tcp", ClientIP: "192.168.0.2", ClientPort: 5000, DstIP: "1.1.1.1", DstPort: 443, NATIP: "203.0.113.5", NATPort: 5000, State: "ESTABLISHED", Timeout: 431999 * time.Second},
+		{Proto: "icmp", ClientIP: "192.168.0.2", ClientPort: 77, DstIP: "1.1.1.1", NATIP: "203.0.113.5", NATPort: 77, Timeout: 29 * time.Second},
+		{Proto: "udp", ClientIP: "192.168.0.3", ClientPort: 5353, DstIP: "8.8.8.8", DstPort: 53, NATIP: "203.0.113.5", NATPort: 61000, Timeout: 29 * time.Second},
+	}
+	if !reflect.DeepEqual(bindings, want) {
+		t.Errorf("Got bindings %+v want %+v", bindings, want)
+	}
+	if _, err := parseConntrack(strings.NewReader("ipv4 2 tcp 6 x\n"), clientNet); err == nil {
+		t.Error("Expected error for invalid timeout")
+	}
+
+	// Utilization is per egress IP and protocol.
+	defer func(r func(*net.IPNet) ([]NATBinding, error), p [2]int) { ReadNATTable, NATPortRange = r, p }(ReadNATTable, NATPortRange)
+	NATPortRange = [2]int{1000, 1003}
+	sample := []NATBinding{
+		{Proto: "udp", ClientIP: "192.168.0.2", NATIP: "203.0.113.5", NATPort: 1000},
+		{Proto: "udp", ClientIP: "192.168.0.3", NATIP: "203.0.113.5", NATPort: 1001},
+		{Proto: "udp", ClientIP: "192.168.0.3", NATIP: "203.0.113.5", NATPort: 1002},
+		{Proto: "tcp", ClientIP: "192.168.0.2", NATIP: "203.0.113.5", NATPort: 1000},
+	}
+	ReadNATTable = func(*net.IPNet) ([]NATBinding, error) { return sample, nil }
+
+	r := &WebTunnelServer{}
+	if r.NATTable() != nil {
+		t.Error("Expected no NAT table when disabled")
+	}
+	if err := r.SetNATMonitor(0, 0.5); err == nil {
+		t.Error("Expected error for zero interval")
+	}
+	r.SetNATMonitor(time.Second, 0.5)
+	if err := r.sampleNAT(clientNet, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	pools := r.NATTable().Pools
+	if len(pools) != 2 || pools[0] != (NATPool{IP: "203.0.113.5", Proto: "udp", Used: 3, Size: 4, Utilization: 0.75}) {
+		t.Errorf("Unexpected pools %+v", pools)
+	}
+	if !r.nat.warned {
+		t.Error("Expected pool warning")
+	}
+	if n, u := r.natSummary(); n != 4 || u != 0.75 {
+		t.Errorf("Expected 4 bindings at 75%%, got %v at %v", n, u)
+	}
+
+	sample = sample[:1]
+	r.sampleNAT(clientNet, time.Now())
+	if r.nat.warned {
+		t.Error("Expected pool warning cleared")
+	}
+}
@@ -0,0 +1,219 @@
+package webtunnelserver
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// p2pBroker negotiates direct paths between clients.
+type p2pBroker struct {
+	conn   *net.UDPConn        // Rendezvous socket learning the public UDP address of clients.
+	tokens map[string]string   // Client IP per rendezvous token.
+	public map[string]string   // Public UDP address per client IP, seen by the rendezvous.
+	local  map[string][]string // Local UDP addresses per client IP, reported by the client.
+	lock   sync.Mutex
+}
+
+/*
+SetPeerToPeer lets clients exchange traffic over direct UDP paths instead of relaying it
+via the server. Clients register with a rendezvous listening on addr, which learns their
+public UDP address, and ask for a path to another client. The server sends both the
+addresses of the other and a fresh key, the clients punch through their NATs and fall back
+to the relay if they can't reach each other. Traffic on direct paths bypasses the server,
+so quarantined clients are not offered paths. This should be called prior to Start.
+*/
+func (r *WebTunnelServer) SetPeerToPeer(addr string) error {
+	a, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return fmt.Errorf("invalid rendezvous address %w", err)
+	}
+	conn, err := net.ListenUDP("udp4", a)
+	if err != nil {
+		return fmt.Errorf("error listening for rendezvous %w", err)
+	}
+	r.p2p = &p2pBroker{
+		conn:   conn,
+		tokens: make(map[string]string),
+		public: make(map[string]string),
+		local:  make(map[string][]string),
+	}
+	return nil
+}
+
+// processRendezvous records the public UDP address of the clients registering with the
+// rendezvous and acknowledges the registrations.
+func (r *WebTunnelServer) processRendezvous() {
+	if r.p2p == nil {
+		return
+	}
+	pkt := make([]byte, 512)
+	for {
+		if r.isStopped.Load() {
+			glog.V(1).Info("Exiting rendezvous routine")
+			r.p2p.conn.Close()
+			return
+		}
+		r.p2p.conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := r.p2p.conn.ReadFromUDP(pkt)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			glog.Errorf("error reading rendezvous %v", err)
+			return
+		}
+		typ, token, ok := wc.ParseP2PFrame(pkt[:n])
+		if !ok || typ != wc.P2PFrameRegister {
+			continue
+		}
+		r.p2p.lock.Lock()
+		ip, ok := r.p2p.tokens[string(token)]
+		if ok && r.p2p.public[ip] != addr.String() {
+			r.p2p.public[ip] = addr.String()
+			glog.V(1).Infof("Client on %v registered for peer-to-peer from %v", ip, addr)
+		}
+		r.p2p.lock.Unlock()
+		if ok {
+			r.p2p.conn.WriteToUDP(pkt[:n], addr)
+		}
+	}
+}
+
+// processP2P handles a peer-to-peer control message from the client on ip.
+func (r *WebTunnelServer) processP2P(ws *wc.WSWriter, ip string, msg []byte) {
+	m := &wc.P2PMessage{}
+	if err := wc.DecodeControl(ws.Codec(), msg, m); err != nil {
+		glog.Warningf("invalid peer-to-peer message from %v: %v", ip, err)
+		return
+	}
+	if r.p2p == nil {
+		if m.Type == wc.P2PConnect {
+			sendP2P(ws, ip, &wc.P2PMessage{Type: wc.P2PFailed, Peer: m.Peer})
+		}
+		return
+	}
+	switch m.Type {
+	case wc.P2PRegister:
+		token := newSessionToken()
+		r.p2p.lock.Lock()
+		for t, i := range r.p2p.tokens {
+			if i == ip {
+				delete(r.p2p.tokens, t)
+			}
+		}
+		r.p2p.tokens[token] = ip
+		r.p2p.local[ip] = m.Addrs
+		r.p2p.lock.Unlock()
+		port := strconv.Itoa(r.p2p.conn.LocalAddr().(*net.UDPAddr).Port)
+		sendP2P(ws, ip, &wc.P2PMessage{Type: wc.P2PToken, Token: token, Addrs: []string{":" + port}})
+
+	case wc.P2PConnect:
+		if err := r.offerPath(ws, ip, m.Peer); err != nil {
+			glog.V(1).Infof("no peer-to-peer path from %v to %v: %v", ip, m.Peer, err)
+			r.metricsLock.Lock()
+			r.metrics.P2PFailures++
+			r.metricsLock.Unlock()
+			sendP2P(ws, ip, &wc.P2PMessage{Type: wc.P2PFailed, Peer: m.Peer})
+		}
+
+	case wc.P2PUp:
+		glog.Infof("Direct path between %v and %v established", ip, m.Peer)
+		r.metricsLock.Lock()
+		r.metrics.P2PPaths++
+		r.metricsLock.Unlock()
+
+	case wc.P2PFailed:
+		glog.Infof("Direct path between %v and %v failed, relaying", ip, m.Peer)
+		r.metricsLock.Lock()
+		r.metrics.P2PFailures++
+		r.metricsLock.Unlock()
+	}
+}
+
+// offerPath sends the clients on ip and peer the candidates and key of a direct path.
+func (r *WebTunnelServer) offerPath(ws *wc.WSWriter, ip, peer string) error {
+	if peer == ip {
+		return fmt.Errorf("path to self")
+	}
+	if r.IsQuarantined(ip) || r.IsQuarantined(peer) {
+		return fmt.Errorf("client quarantined")
+	}
+	r.connMapLock.Lock()
+	peerWS, ok := r.conns[peer]
+	r.connMapLock.Unlock()
+	if !ok {
+		return fmt.Errorf("peer not connected")
+	}
+	r.p2p.lock.Lock()
+	ipAddrs := r.p2p.candidates(ip)
+	peerAddrs := r.p2p.candidates(peer)
+	r.p2p.lock.Unlock()
+	if len(ipAddrs) == 0 || len(peerAddrs) == 0 {
+		return fmt.Errorf("client not registered")
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	if err := sendP2P(peerWS, peer, &wc.P2PMessage{Type: wc.P2POffer, Peer: ip, Addrs: ipAddrs, Key: key}); err != nil {
+		return err
+	}
+	if err := sendP2P(ws, ip, &wc.P2PMessage{Type: wc.P2POffer, Peer: peer, Addrs: peerAddrs, Key: key}); err != nil {
+		return err
+	}
+	r.metricsLock.Lock()
+	r.metrics.P2POffers++
+	r.metricsLock.Unlock()
+	glog.V(1).Infof("Offered direct path between %v %v and %v %v", ip, ipAddrs, peer, peerAddrs)
+	return nil
+}
+
+// candidates returns the UDP addresses the client on ip may be reachable at, public
+// first, none if it didn't register with the rendezvous. Must be called with the lock held.
+func (b *p2pBroker) candidates(ip string) []string {
+	public, ok := b.public[ip]
+	if !ok {
+		return nil
+	}
+	return append([]string{public}, b.local[ip]...)
+}
+
+// releaseP2P forgets the peer-to-peer registration of the client on ip.
+func (r *WebTunnelServer) releaseP2P(ip string) {
+	if r.p2p == nil {
+		return
+	}
+	r.p2p.lock.Lock()
+	defer r.p2p.lock.Unlock()
+	for t, i := range r.p2p.tokens {
+		if i == ip {
+			delete(r.p2p.tokens, t)
+		}
+	}
+	delete(r.p2p.public, ip)
+	delete(r.p2p.local, ip)
+}
+
+// sendP2P sends m to the client on ip.
+func sendP2P(ws *wc.WSWriter, ip string, m *wc.P2PMessage) error {
+	b, err := wc.EncodeControl(ws.Codec(), m)
+	if err != nil {
+		return err
+	}
+	if err := ws.WriteControlMessage(websocket.TextMessage, append([]byte(wc.P2PPrefix), b...)); err != nil {
+		glog.Warningf("error sending peer-to-peer %v to %v: %v", m.Type, ip, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package webtunnelserver
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/gorilla/websocket"
+)
+
+func TestPeerToPeer(t *testing.T) {
+	wsA, clientA := wsPair(t)
+	defer wsA.Close()
+	defer clientA.Close()
+	wsB, clientB := wsPair(t)
+	defer wsB.Close()
+	defer clientB.Close()
+
+	r := &WebTunnelServer{
+		metrics: &Metrics{},
+		conns:   map[string]*wc.WSWriter{"192.168.0.2": wsA, "192.168.0.3": wsB},
+	}
+	readMsg := func(client *websocket.Conn) *wc.P2PMessage {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, msg, err := client.ReadMessage()
+		if err != nil || !bytes.HasPrefix(msg, []byte(wc.P2PPrefix)) {
+			t.Fatalf("Expected peer-to-peer message, got %q %v", msg, err)
+		}
+		m := &wc.P2PMessage{}
+		if err := wc.DecodeControl(wsA.Codec(), msg[len(wc.P2PPrefix):], m); err != nil {
+			t.Fatalf("Invalid message: %v", err)
+		}
+		return m
+	}
+	send := func(ws *wc.WSWriter, ip string, m *wc.P2PMessage) {
+		b, _ := wc.EncodeControl(ws.Codec(), m)
+		r.processP2P(ws, ip, b)
+	}
+
+	// Peer-to-peer disabled.
+	send(wsA, "192.168.0.2", &wc.P2PMessage{Type: wc.P2PConnect, Peer: "192.168.0.3"})
+	if m := readMsg(clientA); m.Type != wc.P2PFailed || m.Peer != "192.168.0.3" {
+		t.Errorf("Expected path refused, got %+v", m)
+	}
+
+	if err := r.SetPeerToPeer("127.0.0.1:0"); err != nil {
+		t.Fatalf("SetPeerToPeer failed: %v", err)
+	}
+	go r.processRendezvous()
+	defer r.p2p.conn.Close()
+
+	// Unregistered clients are not offered paths.
+	send(wsA, "192.168.0.2", &wc.P2PMessage{Type: wc.P2PConnect, Peer: "192.168.0.3"})
+	if m := readMsg(clientA); m.Type != wc.P2PFailed {
+		t.Errorf("Expected path refused to unregistered peer, got %+v", m)
+	}
+
+	register := func(ws *wc.WSWriter, client *websocket.Conn, ip string) *net.UDPConn {
+		send(ws, ip, &wc.P2PMessage{Type: wc.P2PRegister, Addrs: []string{"10.0.0.1:4000"}})
+		m := readMsg(client)
+		if m.Type != wc.P2PToken || m.Token == "" || len(m.Addrs) != 1 {
+			t.Fatalf("Expected token, got %+v", m)
+		}
+		_, port, _ := net.SplitHostPort(m.Addrs[0])
+		rdv, _ := net.ResolveUDPAddr("udp4", net.JoinHostPort("127.0.0.1", port))
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.WriteToUDP(wc.P2PFrame(wc.P2PFrameRegister, []byte(m.Token)), rdv)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 512)
+		n, _, err := conn.ReadFromUDP(buf)
+		if typ, token, ok := wc.ParseP2PFrame(buf[:n]); err != nil || !ok || typ != wc.P2PFrameRegister || string(token) != m.Token {
+			t.Fatalf("Expected registration acknowledged, got %q %v", buf[:n], err)
+		}
+		return conn
+	}
+	udpA := register(wsA, clientA, "192.168.0.2")
+	defer udpA.Close()
+	udpB := register(wsB, clientB, "192.168.0.3")
+	defer udpB.Close()
+
+	// Both peers get the candidates of the other and the same key.
+	send(wsA, "192.168.0.2", &wc.P2PMessage{Type: wc.P2PConnect, Peer: "192.168.0.3"})
+	offerB := readMsg(clientB)
+	offerA := readMsg(clientA)
+	if offerA.Type != wc.P2POffer || offerA.Peer != "192.168.0.3" || len(offerA.Addrs) != 2 ||
+		offerA.Addrs[0] != udpB.LocalAddr().String() || offerA.Addrs[1] != "10.0.0.1:4000" {
+		t.Errorf("Unexpected offer to A %+v", offerA)
+	}
+	if offerB.Type != wc.P2POffer || offerB.Peer != "192.168.0.2" || offerB.Addrs[0] != udpA.LocalAddr().String() {
+		t.Errorf("Unexpected offer to B %+v", offerB)
+	}
+	if len(offerA.Key) != 32 || !bytes.Equal(offerA.Key, offerB.Key) {
+		t.Errorf("Expected same key for both peers, got %x %x", offerA.Key, offerB.Key)
+	}
+
+	// Paths to self or disconnected clients are refused.
+	send(wsA, "192.168.0.2", &wc.P2PMessage{Type: wc.P2PConnect, Peer: "192.168.0.2"})
+	if m := readMsg(clientA); m.Type != wc.P2PFailed {
+		t.Errorf("Expected path to self refused, got %+v", m)
+	}
+	r.releaseP2P("192.168.0.3")
+	send(wsA, "192.168.0.2", &wc.P2PMessage{Type: wc.P2PConnect, Peer: "192.168.0.3"})
+	if m := readMsg(clientA); m.Type != wc.P2PFailed {
+		t.Errorf("Expected path to released peer refused, got %+v", m)
+	}
+
+	send(wsA, "192.168.0.2", &wc.P2PMessage{Type: wc.P2PUp, Peer: "192.168.0.3"})
+	r.metricsLock.Lock()
+	defer r.metricsLock.Unlock()
+	if m := r.metrics; m.P2POffers != 1 || m.P2PPaths != 1 || m.P2PFailures != 3 {
+		t.Errorf("Unexpected metrics offers %v paths %v failures %v", m.P2POffers, m.P2PPaths, m.P2PFailures)
+	}
+}
@@ -0,0 +1,260 @@
+package webtunnelserver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/deepakkamesh/webtunnel/webtunnelcommon/metrics"
+)
+
+// Defaults of the pacing policy.
+const (
+	defaultPacingDelay   = 50 * time.Millisecond
+	defaultPacingMinRate = 16 << 10  // 128 kbit/s.
+	defaultPacingMaxRate = 125 << 20 // 1 Gbit/s.
+)
+
+const (
+	interactiveSize = 256                  // Packets up to this size, eg. ACKs, DNS and keystrokes, are interactive.
+	dscpCS5         = 40                   // Packets marked CS5 and above, eg. EF voice, are interactive.
+	pacingBlocked   = 2 * time.Millisecond // Writes taking longer found the connection send buffer full.
+	pacingBackoff   = 0.7                  // Estimate decrease on a failed write.
+	pacingQueueLen  = 1024                 // Depth of the bulk and interactive queues of each client.
+)
+
+// PacingPolicy paces the writes to each client at its estimated downstream bandwidth, so
+// packets are dropped at the gateway instead of queueing in the client's downlink.
+type PacingPolicy struct {
+	TargetDelay time.Duration // Queueing delay of bulk packets above which they are dropped.
+	MinRate     float64       // Lowest bandwidth estimate in bytes per second.
+	MaxRate     float64       // Initial and highest bandwidth estimate in bytes per second.
+}
+
+// pacedPacket is a packet queued for a client.
+type pacedPacket struct {
+	ws  *wc.WSWriter
+	pkt []byte
+}
+
+// pacer paces the packets to one client.
+type pacer struct {
+	policy PacingPolicy
+	rate   float64 // Estimated bandwidth in bytes per second.
+	queued int     // Bytes in the bulk queue.
+	bulk   chan pacedPacket
+	prio   chan pacedPacket
+	done   chan struct{}
+	prom   *metrics.Tunnel // Collectors of the sent packets.
+	lock   sync.Mutex
+}
+
+// pacers holds the pacing policy and the pacer of each client.
+type pacers struct {
+	policy  PacingPolicy
+	clients map[string]*pacer
+	lock    sync.Mutex
+}
+
+/*
+SetPacing paces server to client writes at the bandwidth of each client, estimated from
+the latency and failures of its websocket writes. Bulk packets that would queue longer
+than the target delay are dropped and counted in Metrics.PacingDropped, while small and
+CS5 and above marked packets skip the queue so interactive traffic stays responsive on
+a saturated downlink. Zero fields of p take defaults. This should be called prior to Start.
+*/
+func (r *WebTunnelServer) SetPacing(p PacingPolicy) error {
+	if p.TargetDelay < 0 || p.MinRate < 0 || p.MaxRate < 0 {
+		return fmt.Errorf("invalid pacing policy %+v", p)
+	}
+	if p.TargetDelay == 0 {
+		p.TargetDelay = defaultPacingDelay
+	}
+	if p.MinRate == 0 {
+		p.MinRate = defaultPacingMinRate
+	}
+	if p.MaxRate == 0 {
+		p.MaxRate = defaultPacingMaxRate
+	}
+	if p.MinRate > p.MaxRate {
+		return fmt.Errorf("pacing min rate %v above max rate %v", p.MinRate, p.MaxRate)
+	}
+	r.pacing = &pacers{policy: p, clients: make(map[string]*pacer)}
+	return nil
+}
+
+// sendClient writes a packet to the client on ipDest, paced if enabled.
+func (r *WebTunnelServer) sendClient(ws *wc.WSWriter, ipDest string, pkt []byte) {
+	if r.pacing == nil {
+		writeClient(ws, ipDest, pkt, r.prom)
+		return
+	}
+	r.pacing.lock.Lock()
+	p, ok := r.pacing.clients[ipDest]
+	if !ok {
+		p = newPacer(r.pacing.policy, r.prom)
+		r.pacing.clients[ipDest] = p
+		go p.run(ipDest)
+	}
+	r.pacing.lock.Unlock()
+
+	if !p.enqueue(ws, pkt) {
+		r.metricsLock.Lock()
+		r.metrics.PacingDropped++
+		r.metricsLock.Unlock()
+	}
+}
+
+// bandwidthSnapshot returns the estimated bandwidth of each paced client.
+func (r *WebTunnelServer) bandwidthSnapshot() map[string]float64 {
+	m := make(map[string]float64)
+	if r.pacing == nil {
+		return m
+	}
+	r.pacing.lock.Lock()
+	defer r.pacing.lock.Unlock()
+	for ip, p := range r.pacing.clients {
+		m[ip] = p.estimate()
+	}
+	return m
+}
+
+// releasePacing stops the pacer of a disconnected client.
+func (r *WebTunnelServer) releasePacing(ip string) {
+	if r.pacing == nil {
+		return
+	}
+	r.pacing.lock.Lock()
+	if p, ok := r.pacing.clients[ip]; ok {
+		close(p.done)
+		delete(r.pacing.clients, ip)
+	}
+	r.pacing.lock.Unlock()
+}
+
+func newPacer(policy PacingPolicy, prom *metrics.Tunnel) *pacer {
+	return &pacer{
+		policy: policy,
+		prom:   prom,
+		rate:   policy.MaxRate,
+		bulk:   make(chan pacedPacket, pacingQueueLen),
+		prio:   make(chan pacedPacket, pacingQueueLen),
+		done:   make(chan struct{}),
+	}
+}
+
+// isInteractive returns true for packets that skip the bulk queue.
+func isInteractive(pkt []byte) bool {
+	return len(pkt) <= interactiveSize || int(pkt[1]>>2) >= dscpCS5
+}
+
+// enqueue queues a copy of pkt. It returns false if the packet was dropped.
+func (p *pacer) enqueue(ws *wc.WSWriter, pkt []byte) bool {
+	pp := pacedPacket{ws: ws, pkt: append([]byte(nil), pkt...)}
+	if isInteractive(pkt) {
+		select {
+		case p.prio <- pp:
+			return true
+		default:
+			return false
+		}
+	}
+
+	p.lock.Lock()
+	delay := time.Duration(float64(p.queued+len(pkt)) / p.rate * float64(time.Second))
+	if delay > p.policy.TargetDelay {
+		p.lock.Unlock()
+		return false
+	}
+	p.queued += len(pkt)
+	p.lock.Unlock()
+
+	select {
+	case p.bulk <- pp:
+		return true
+	default:
+		p.lock.Lock()
+		p.queued -= len(pkt)
+		p.lock.Unlock()
+		return false
+	}
+}
+
+// run writes the queued packets until the pacer is released. Interactive packets are
+// written as they arrive, bulk packets no faster than the estimated bandwidth.
+func (p *pacer) run(ip string) {
+	next := time.Now()
+	for {
+		var pp pacedPacket
+		select {
+		case pp = <-p.prio:
+			p.write(ip, pp)
+			continue
+		default:
+		}
+		select {
+		case pp = <-p.prio:
+			p.write(ip, pp)
+			continue
+		case pp = <-p.bulk:
+		case <-p.done:
+			return
+		}
+
+		for wait := time.Until(next); wait > 0; wait = time.Until(next) {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case i := <-p.prio:
+				t.Stop()
+				p.write(ip, i)
+			case <-p.done:
+				t.Stop()
+				return
+			}
+		}
+		p.lock.Lock()
+		p.queued -= len(pp.pkt)
+		p.lock.Unlock()
+		rate := p.write(ip, pp)
+		if now := time.Now(); next.Before(now) {
+			next = now
+		}
+		next = next.Add(time.Duration(float64(len(pp.pkt)) / rate * float64(time.Second)))
+	}
+}
+
+// write sends a packet and updates the bandwidth estimate from the write latency. A
+// write that blocks measures the rate the connection drains, a fast one probes for more
+// bandwidth and a failed one backs off. It returns the new estimate.
+func (p *pacer) write(ip string, pp pacedPacket) float64 {
+	start := time.Now()
+	err := writeClient(pp.ws, ip, pp.pkt, p.prom)
+	d := time.Since(start)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	switch {
+	case err != nil:
+		p.rate *= pacingBackoff
+	case d > pacingBlocked:
+		p.rate = p.rate*7/8 + float64(len(pp.pkt))/d.Seconds()/8
+	default:
+		p.rate += p.rate / 16
+	}
+	if p.rate < p.policy.MinRate {
+		p.rate = p.policy.MinRate
+	}
+	if p.rate > p.policy.MaxRate {
+		p.rate = p.policy.MaxRate
+	}
+	return p.rate
+}
+
+// estimate returns the estimated bandwidth in bytes per second.
+func (p *pacer) estimate() float64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.rate
+}
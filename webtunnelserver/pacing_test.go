@@ -0,0 +1,68 @@
+package webtunnelserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacing(t *testing.T) {
+	r := &WebTunnelServer{metrics: &Metrics{}}
+	if err := r.SetPacing(PacingPolicy{TargetDelay: -time.Second}); err == nil {
+		t.Error("Expected error for negative target delay")
+	}
+	if err := r.SetPacing(PacingPolicy{MinRate: 2e6, MaxRate: 1e6}); err == nil {
+		t.Error("Expected error for min rate above max rate")
+	}
+	// 100KB/s paces 1000 byte packets 10ms apart with up to 5 queued.
+	if err := r.SetPacing(PacingPolicy{MinRate: 50e3, MaxRate: 100e3}); err != nil {
+		t.Fatal(err)
+	}
+
+	ip := "192.168.0.2"
+	ws, client := wsPair(t)
+	received := make(chan int, 100)
+	go func() {
+		for {
+			_, b, err := client.ReadMessage()
+			if err != nil {
+				return
+			}
+			received <- len(b)
+		}
+	}()
+
+	bulk := make([]byte, 1000)
+	bulk[0] = 0x45
+	for i := 0; i < 20; i++ {
+		r.sendClient(ws, ip, bulk)
+	}
+	interactive := []byte{0x45, 0, 0, 40}
+	r.sendClient(ws, ip, interactive)
+
+	// Bulk packets over the target delay are dropped and interactive ones skip the queue.
+	dropped := r.metrics.PacingDropped
+	if dropped == 0 || dropped >= 20 {
+		t.Errorf("Expected some bulk packets dropped, got %v", dropped)
+	}
+	sent := 21 - dropped
+	var got []int
+	for len(got) < sent {
+		select {
+		case n := <-received:
+			got = append(got, n)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected %v packets, got %v", sent, got)
+		}
+	}
+	if got[len(got)-1] != 1000 {
+		t.Errorf("Expected interactive packet ahead of bulk packets, got %v", got)
+	}
+
+	if bw := r.bandwidthSnapshot()[ip]; bw < 50e3 || bw > 100e3 {
+		t.Errorf("Expected estimate within the policy rates, got %v", bw)
+	}
+	r.releasePacing(ip)
+	if _, ok := r.bandwidthSnapshot()[ip]; ok {
+		t.Error("Expected pacer released")
+	}
+}
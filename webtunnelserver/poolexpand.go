@@ -0,0 +1,100 @@
+package webtunnelserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/deepakkamesh/webtunnel/ipam"
+	"github.com/golang/glog"
+)
+
+// PoolExpansion is a secondary client network brought online when the client network
+// fills up.
+type PoolExpansion struct {
+	Prefix    string  // Secondary client network prefix.
+	GWIp      string  // Gateway IP of the clients in Prefix, the first address of Prefix if empty.
+	Threshold float64 // Utilization of the client network bringing Prefix online, eg. 0.9.
+}
+
+// poolExpansion is the secondary client network of the server.
+type poolExpansion struct {
+	cfg     PoolExpansion
+	ipnet   *net.IPNet
+	netmask string // Netmask of the clients in the secondary network.
+}
+
+/*
+SetPoolExpansion brings the secondary client network e.Prefix online once utilization of
+the client network reaches e.Threshold, so unexpected growth is handled without
+restarting the server with a larger network. When it comes online the secondary network
+is routed to the tunnel interface, advertised to the next gateway (see SetUpstream) and
+added to the pool capacity in the metrics. Its IPs are given out once the client network
+is full, with e.GWIp as gateway. The secondary network must not overlap the client
+network or the route prefixes. This should be called prior to Start.
+*/
+func (r *WebTunnelServer) SetPoolExpansion(e PoolExpansion) error {
+	_, ipnet, err := net.ParseCIDR(e.Prefix)
+	if err != nil || ipnet.IP.To4() == nil {
+		return fmt.Errorf("invalid expansion prefix %q", e.Prefix)
+	}
+	for _, n := range r.routeNets {
+		if overlaps(n, ipnet) {
+			return fmt.Errorf("expansion prefix %v overlaps route %v", ipnet, n)
+		}
+	}
+	if e.GWIp == "" {
+		gw := make(net.IP, 4)
+		binary.BigEndian.PutUint32(gw, binary.BigEndian.Uint32(ipnet.IP.To4())+1)
+		e.GWIp = gw.String()
+	}
+	first := r.expansion == nil
+	r.expansion = &poolExpansion{cfg: e, ipnet: ipnet, netmask: net.IP(ipnet.Mask).String()}
+	// The listener must be in place if the network is already full.
+	if first {
+		r.ipam.AddListener(func(ev IPEvent) {
+			if ev.Type != IPPoolExpanded {
+				return
+			}
+			r.expandPool(ev.Prefix)
+		})
+	}
+	return r.ipam.SetExpansion(ipam.Expansion{Prefix: e.Prefix, Threshold: e.Threshold, Reserved: []string{e.GWIp}})
+}
+
+// expandPool routes the secondary client network prefix brought online by IPAM.
+func (r *WebTunnelServer) expandPool(prefix string) {
+	_, n, err := net.ParseCIDR(prefix)
+	if err != nil {
+		glog.Errorf("invalid expansion prefix %v: %v", prefix, err)
+		return
+	}
+	if err := AddTunnelRoute(r.ifce.Name(), n.String()); err != nil {
+		glog.Errorf("unable to route expansion prefix %v: %v", n, err)
+	}
+	r.advertiseUpstream(n)
+	r.metricsLock.Lock()
+	r.metrics.MaxUsers += getMaxUsers(n.String())
+	r.metricsLock.Unlock()
+	glog.Infof("Client network expanded to %v", n)
+}
+
+// clientNetmask returns the netmask and gateway IP of the client on ip.
+func (r *WebTunnelServer) clientNetmask(ip string) (string, string) {
+	if e := r.expansion; e != nil && e.ipnet.Contains(net.ParseIP(ip)) {
+		return e.netmask, e.cfg.GWIp
+	}
+	return r.tunNetmask, r.gwIP
+}
+
+// clientNets returns the client networks online.
+func (r *WebTunnelServer) clientNets() []*net.IPNet {
+	var nets []*net.IPNet
+	if _, n, err := net.ParseCIDR(r.clientNetPrefix); err == nil {
+		nets = append(nets, n)
+	}
+	if r.expansion != nil && len(r.ipam.Prefixes()) > 1 {
+		nets = append(nets, r.expansion.ipnet)
+	}
+	return nets
+}
@@ -0,0 +1,68 @@
+package webtunnelserver
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestPoolExpansion(t *testing.T) {
+	var routes []string
+	defer func(add func(string, string) error) { AddTunnelRoute = add }(AddTunnelRoute)
+	AddTunnelRoute = func(ifce, subnet string) error {
+		routes = append(routes, subnet)
+		return nil
+	}
+
+	r, err := NewWebTunnelServer("127.0.0.1:0", "192.168.0.1", "255.255.255.248", "192.168.0.0/29",
+		nil, []string{"1.1.1.0/24"}, false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetPoolExpansion(PoolExpansion{Prefix: "1.1.0.0/16", Threshold: 0.8}); err == nil {
+		t.Error("Expected expansion overlapping a route refused")
+	}
+	if err := r.SetPoolExpansion(PoolExpansion{Prefix: "10.9.0.0/29", Threshold: 0.8}); err != nil {
+		t.Fatal(err)
+	}
+	maxUsers := r.GetMetrics().MaxUsers
+
+	var ips []string
+	for i := 0; i < 6; i++ {
+		ip, err := r.ipam.AcquireIP(struct{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ips = append(ips, ip)
+	}
+	// The gateway and 4 clients reach the threshold, the client network is full after 5.
+	if !reflect.DeepEqual(routes, []string{"10.9.0.0/29"}) {
+		t.Errorf("Expected route to the expansion, got %v", routes)
+	}
+	if ips[5] != "10.9.0.2" {
+		t.Errorf("Expected first expansion IP after the gateway, got %v", ips[5])
+	}
+	m := r.GetMetrics()
+	if m.MaxUsers != maxUsers+5 || !reflect.DeepEqual(m.ClientNets, []string{"192.168.0.0/29", "10.9.0.0/29"}) {
+		t.Errorf("Unexpected metrics after expansion %v %v", m.MaxUsers, m.ClientNets)
+	}
+
+	// Clients in the expansion get its netmask and gateway.
+	for ip, want := range map[string][2]string{
+		ips[0]: {"255.255.255.248", "192.168.0.1"},
+		ips[5]: {"255.255.255.248", "10.9.0.1"},
+	} {
+		cfg, err := r.clientConfig(ip, r.routePrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Netmask != want[0] || cfg.GWIp != want[1] {
+			t.Errorf("Unexpected netmask %v and gateway %v of %v", cfg.Netmask, cfg.GWIp, ip)
+		}
+	}
+
+	// Subnets of clients may not overlap the expansion once online.
+	if err := r.routeSubnet(ips[0], &net.IPNet{IP: net.IPv4(10, 9, 0, 0), Mask: net.CIDRMask(24, 32)}); err == nil {
+		t.Error("Expected subnet overlapping the expansion refused")
+	}
+}
@@ -0,0 +1,118 @@
+package webtunnelserver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// PortForward is a reverse tunnel from a gateway port to a port on a client tunnel IP.
+type PortForward struct {
+	ListenAddr string // Gateway address:port accepting connections.
+	ClientIP   string // Tunnel IP of the client.
+	ClientPort int    // Port on the client.
+
+	listener net.Listener
+}
+
+// portForwards holds the active reverse tunnels keyed by bound listen address.
+type portForwards struct {
+	fwds map[string]*PortForward
+	lock sync.Mutex
+}
+
+// AddPortForward forwards TCP connections to listenAddr on the gateway to clientPort on
+// the tunnel IP of a connected client, letting support staff reach services behind NAT.
+// The forward is removed when the client disconnects.
+func (r *WebTunnelServer) AddPortForward(listenAddr, clientIP string, clientPort int) error {
+	if _, err := r.ipam.GetData(clientIP); err != nil {
+		return fmt.Errorf("client %v not connected: %w", clientIP, err)
+	}
+	if clientPort <= 0 || clientPort > 65535 {
+		return fmt.Errorf("invalid client port %v", clientPort)
+	}
+
+	r.forwards.lock.Lock()
+	defer r.forwards.lock.Unlock()
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("error listening for port forward %w", err)
+	}
+	fwd := &PortForward{
+		ListenAddr: l.Addr().String(),
+		ClientIP:   clientIP,
+		ClientPort: clientPort,
+		listener:   l,
+	}
+	if r.forwards.fwds == nil {
+		r.forwards.fwds = make(map[string]*PortForward)
+	}
+	r.forwards.fwds[fwd.ListenAddr] = fwd
+	glog.Infof("forwarding %v to %v:%v", fwd.ListenAddr, clientIP, clientPort)
+	go fwd.serve()
+	return nil
+}
+
+// RemovePortForward stops the reverse tunnel on listenAddr, as returned by PortForwards. Established connections
+// are not interrupted.
+func (r *WebTunnelServer) RemovePortForward(listenAddr string) error {
+	r.forwards.lock.Lock()
+	defer r.forwards.lock.Unlock()
+	fwd, ok := r.forwards.fwds[listenAddr]
+	if !ok {
+		return fmt.Errorf("no port forward on %v", listenAddr)
+	}
+	delete(r.forwards.fwds, listenAddr)
+	return fwd.listener.Close()
+}
+
+// PortForwards returns the active reverse tunnels.
+func (r *WebTunnelServer) PortForwards() []PortForward {
+	r.forwards.lock.Lock()
+	defer r.forwards.lock.Unlock()
+	var fwds []PortForward
+	for _, f := range r.forwards.fwds {
+		fwds = append(fwds, PortForward{ListenAddr: f.ListenAddr, ClientIP: f.ClientIP, ClientPort: f.ClientPort})
+	}
+	return fwds
+}
+
+// releasePortForwards removes the reverse tunnels to a disconnected client.
+func (r *WebTunnelServer) releasePortForwards(ip string) {
+	r.forwards.lock.Lock()
+	defer r.forwards.lock.Unlock()
+	for k, f := range r.forwards.fwds {
+		if f.ClientIP == ip {
+			f.listener.Close()
+			delete(r.forwards.fwds, k)
+		}
+	}
+}
+
+// serve accepts connections until the listener is closed and proxies them to the client.
+func (f *PortForward) serve() {
+	target := net.JoinHostPort(f.ClientIP, strconv.Itoa(f.ClientPort))
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			glog.V(1).Infof("port forward on %v stopped: %v", f.ListenAddr, err)
+			return
+		}
+		go func() {
+			defer conn.Close()
+			// The client tunnel IP is routed via the TUN interface.
+			c, err := net.Dial("tcp", target)
+			if err != nil {
+				glog.Warningf("port forward dial to %v failed: %v", target, err)
+				return
+			}
+			defer c.Close()
+			go io.Copy(c, conn)
+			io.Copy(conn, c)
+		}()
+	}
+}
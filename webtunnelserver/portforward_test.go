@@ -0,0 +1,67 @@
+package webtunnelserver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestPortForward(t *testing.T) {
+	ipam, err := NewIPPam("127.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ipam.AcquireSpecificIP("127.0.0.1", struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	r := &WebTunnelServer{ipam: ipam}
+
+	// Client side service.
+	svc, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+	go func() {
+		c, err := svc.Accept()
+		if err != nil {
+			return
+		}
+		fmt.Fprintln(c, "hello")
+		c.Close()
+	}()
+	port := svc.Addr().(*net.TCPAddr).Port
+
+	if err := r.AddPortForward("127.0.0.1:0", "127.0.0.2", port); err == nil {
+		t.Error("Expected error for client not connected")
+	}
+	if err := r.AddPortForward("127.0.0.1:0", "127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	fwds := r.PortForwards()
+	if len(fwds) != 1 {
+		t.Fatalf("Expected 1 port forward, got %v", fwds)
+	}
+
+	c, err := net.Dial("tcp", fwds[0].ListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(c).ReadString('\n')
+	c.Close()
+	if err != nil || line != "hello\n" {
+		t.Errorf("Expected hello via port forward, got %q %v", line, err)
+	}
+
+	if err := r.RemovePortForward(fwds[0].ListenAddr); err != nil {
+		t.Error(err)
+	}
+	if err := r.AddPortForward("127.0.0.1:0", "127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	r.releasePortForwards("127.0.0.1")
+	if fwds := r.PortForwards(); len(fwds) != 0 {
+		t.Errorf("Expected port forwards removed on release, got %v", fwds)
+	}
+}
@@ -0,0 +1,102 @@
+package webtunnelserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"net/http"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// Close reason sent to a client denied by the posture policy.
+const closeReasonPosture = "posture denied"
+
+// AccessLevel is the access granted to a client based on its device posture.
+type AccessLevel int
+
+const (
+	AccessFull       AccessLevel = iota // All advertised routes.
+	AccessQuarantine                    // Remediation routes only, denied without SetQuarantine.
+	AccessDeny                          // Connection is closed.
+)
+
+// PosturePolicy maps the verified posture reported by the client on ip to an access level.
+type PosturePolicy func(ip string, p *wc.Posture) AccessLevel
+
+/*
+SetPosturePolicy gates the config of new sessions on the device posture reported in their
+config request. Reports are verified against the client certificate of the connection
+verified by the TLS config (see SetTLSConfig) and bound to it, so posture requires
+client certificates. Clients
+with a verified report get the access level of policy; AccessFull skips quarantine.
+Clients without one are quarantined, or denied if quarantine is not enabled. Resumed
+sessions keep the access of the session. This should be called prior to Start.
+*/
+func (r *WebTunnelServer) SetPosturePolicy(policy PosturePolicy) {
+	r.posturePolicy = policy
+}
+
+// newSessionToken returns a random session token.
+func newSessionToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// tlsStateKey is the context key of the TLS state of a connection.
+type tlsStateKey struct{}
+
+// withTLSState returns ctx carrying the TLS state of rcv, if any, to verify the posture
+// reports of the connection.
+func withTLSState(ctx context.Context, rcv *http.Request) context.Context {
+	if rcv.TLS == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tlsStateKey{}, rcv.TLS)
+}
+
+// checkPosture verifies the posture report of the config request req of the client on ip
+// and returns the access level of the policy and the verified posture. Clients without a
+// report verified against their client certificate are quarantined if quarantine is
+// enabled and denied otherwise.
+func (r *WebTunnelServer) checkPosture(ctx context.Context, ip string, req *wc.ConfigRequest) (AccessLevel, *wc.Posture) {
+	unverified := AccessDeny
+	if r.quarantine != nil {
+		unverified = AccessQuarantine
+	}
+	if req.Posture == nil {
+		glog.Warningf("no posture report from %v", ip)
+		return unverified, nil
+	}
+	cs, _ := ctx.Value(tlsStateKey{}).(*tls.ConnectionState)
+	if cs == nil || len(cs.VerifiedChains) == 0 {
+		glog.Warningf("posture report from %v without verified client certificate", ip)
+		return unverified, nil
+	}
+	binding, err := wc.PostureBinding(cs)
+	if err == nil {
+		err = wc.VerifyPosture(req.Posture, cs.VerifiedChains[0][0].PublicKey, binding)
+	}
+	if err != nil {
+		glog.Warningf("posture report from %v rejected: %v", ip, err)
+		return unverified, nil
+	}
+	p := req.Posture.Posture
+	glog.V(1).Infof("Posture from %s@%s on %v: %+v", req.Username, req.Hostname, ip, *p)
+	level := r.posturePolicy(ip, p)
+	if level == AccessQuarantine && r.quarantine == nil {
+		level = AccessDeny
+	}
+	return level, p
+}
+
+// closePostureDenied closes the connection of a client denied by the posture policy.
+func closePostureDenied(ws *wc.WSWriter, id string) {
+	ws.WriteControlMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, withSessionID(closeReasonPosture, id)))
+	ws.Conn().Close()
+}
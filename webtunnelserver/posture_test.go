@@ -0,0 +1,102 @@
+package webtunnelserver
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/gorilla/websocket"
+)
+
+func TestPosturePolicy(t *testing.T) {
+	r, err := NewWebTunnelServer("127.0.0.1:0", "192.168.0.1", "255.255.255.0", "192.168.0.0/24",
+		nil, []string{"1.1.1.0/24"}, false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetPosturePolicy(func(ip string, p *wc.Posture) AccessLevel {
+		if p.DiskEncrypted {
+			return AccessFull
+		}
+		return AccessDeny
+	})
+	device, other := testCert(t, "laptop"), testCert(t, "laptop")
+	deviceKey, otherKey := device.PrivateKey.(crypto.Signer), other.PrivateKey.(crypto.Signer)
+	leaf, _ := x509.ParseCertificate(device.Certificate[0])
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(r.wsEndpoint))
+	srv.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: pool}
+	srv.StartTLS()
+	defer srv.Close()
+	url := "wss" + strings.TrimPrefix(srv.URL, "https")
+
+	// request sends a config request with posture p signed with key for the connection, or
+	// report if not nil, and returns the config or the error closing the connection.
+	var last *wc.PostureReport
+	request := func(key crypto.Signer, p *wc.Posture, report *wc.PostureReport) (*wc.ClientConfig, error) {
+		t.Helper()
+		dialer := websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{device}}}
+		header := http.Header{}
+		header.Set(wc.ControlHeader, "1")
+		c, _, err := dialer.Dial(url, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if report == nil {
+			cs := c.UnderlyingConn().(*tls.Conn).ConnectionState()
+			binding, err := wc.PostureBinding(&cs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report, err = wc.SignPosture(p, key, binding); err != nil {
+				t.Fatal(err)
+			}
+		}
+		last = report
+		b, _ := wc.EncodeControlMessage(wc.JSONCodec{}, &wc.ControlMessage{Type: wc.CtlConfigRequest,
+			ConfigRequest: &wc.ConfigRequest{Username: "user", Hostname: "host", Posture: report}})
+		c.WriteMessage(websocket.TextMessage, b)
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, b, err = c.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		m, err := wc.ParseControlMessage(wc.JSONCodec{}, b)
+		if err != nil || m.ConfigResponse == nil {
+			t.Fatalf("Expected config response, got %q: %v", b, err)
+		}
+		return m.ConfigResponse.Config, nil
+	}
+	denied := func(err error) bool {
+		return websocket.IsCloseError(err, websocket.ClosePolicyViolation)
+	}
+
+	// A verified compliant device gets its config, the posture is kept.
+	cfg, err := request(deviceKey, &wc.Posture{OS: "linux", DiskEncrypted: true}, nil)
+	if err != nil {
+		t.Fatalf("Expected config for compliant posture, got %v", err)
+	}
+	if p := r.DumpAllocations()[cfg.IP].Posture; p == nil || !p.DiskEncrypted {
+		t.Errorf("Expected posture kept, got %v", p)
+	}
+	replayed := last
+
+	// Non compliant, forged and replayed reports get no config.
+	if _, err := request(deviceKey, &wc.Posture{OS: "linux"}, nil); !denied(err) {
+		t.Errorf("Expected non compliant posture denied, got %v", err)
+	}
+	if _, err := request(otherKey, &wc.Posture{OS: "linux", DiskEncrypted: true}, nil); !denied(err) {
+		t.Errorf("Expected posture not signed by the device denied, got %v", err)
+	}
+	if _, err := request(deviceKey, nil, replayed); !denied(err) {
+		t.Errorf("Expected posture of another connection denied, got %v", err)
+	}
+}
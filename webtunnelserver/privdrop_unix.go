@@ -0,0 +1,104 @@
+//go:build !windows
+
+package webtunnelserver
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+/*
+DropPrivileges switches the process to the unprivileged user username after the TUN
+interface is set up and the server socket is bound (see Listen). The directories of the
+stats store and ACME cache are handed to the user, and the directories of the ban list
+and IP reservations files must be writable by it.
+
+Pool expansion, client subnets and the NAT monitor need root after Start and are
+refused.
+*/
+func (r *WebTunnelServer) DropPrivileges(username string) error {
+	if f := r.privilegedFeatures(); len(f) > 0 {
+		return fmt.Errorf("%v need root and can't run with dropped privileges", strings.Join(f, ", "))
+	}
+	u, err := user.Lookup(username)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("invalid uid %v", u.Uid)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("invalid gid %v", u.Gid)
+	}
+	if r.listener == nil {
+		if err := r.Listen(); err != nil {
+			return err
+		}
+	}
+
+	if err := r.prepareWritePaths(uid, gid); err != nil {
+		return err
+	}
+
+	// Group must be changed while still privileged.
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("error setting groups %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("error setting gid %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("error setting uid %w", err)
+	}
+	if RunningAsRoot() {
+		return fmt.Errorf("still running as root after privilege drop")
+	}
+	glog.Infof("Dropped privileges to %v (uid:%v gid:%v)", username, uid, gid)
+	return nil
+}
+
+// prepareWritePaths hands the data directories of the server to uid and gid and checks
+// the directories of its state files are writable by them.
+func (r *WebTunnelServer) prepareWritePaths(uid, gid int) error {
+	for _, dir := range r.dataDirs() {
+		if err := filepath.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(path, uid, gid)
+		}); err != nil {
+			return fmt.Errorf("error handing %v to uid %v %w", dir, uid, err)
+		}
+	}
+	for _, file := range r.stateFiles() {
+		if err := os.Lchown(file, uid, gid); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error handing %v to uid %v %w", file, uid, err)
+		}
+		dir := filepath.Dir(file)
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		mode := fi.Mode().Perm()
+		if !ok || !(int(st.Uid) == uid && mode&0300 == 0300 || int(st.Gid) == gid && mode&0030 == 0030 || mode&0003 == 0003) {
+			return fmt.Errorf("directory %v of %v not writable by uid %v", dir, file, uid)
+		}
+	}
+	return nil
+}
+
+// RunningAsRoot returns true if the process runs with root privileges.
+func RunningAsRoot() bool {
+	return os.Geteuid() == 0
+}
@@ -0,0 +1,55 @@
+//go:build !windows
+
+package webtunnelserver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDropPrivilegesChecks(t *testing.T) {
+	r := &WebTunnelServer{nat: &natMonitor{}, expansion: &poolExpansion{}}
+	if err := r.DropPrivileges("nobody"); err == nil || !strings.Contains(err.Error(), "pool expansion, NAT monitor") {
+		t.Errorf("Expected root only features refused, got %v", err)
+	}
+
+	// Data directories are handed to the user, state file directories must be writable.
+	dir := t.TempDir()
+	stats := filepath.Join(dir, "stats")
+	os.Mkdir(stats, 0700)
+	os.WriteFile(filepath.Join(stats, "2026-10-16.jsonl"), nil, 0600)
+	r = &WebTunnelServer{
+		stats: &statsStore{policy: StatsPolicy{Dir: stats}},
+		bans:  &banList{policy: BanPolicy{File: filepath.Join(dir, "bans.json")}},
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+	if err := r.prepareWritePaths(uid, gid); err != nil {
+		t.Errorf("Expected write paths prepared, got %v", err)
+	}
+	readOnly := filepath.Join(dir, "ro")
+	os.Mkdir(readOnly, 0500)
+	r.reservationsFile = filepath.Join(readOnly, "reservations.json")
+	if err := r.prepareWritePaths(uid, gid); err == nil {
+		t.Error("Expected read only directory of a state file refused")
+	}
+}
+
+func TestSandboxOptions(t *testing.T) {
+	r := &WebTunnelServer{expansion: &poolExpansion{}}
+	if _, err := r.SandboxOptions(SandboxOptions{Seccomp: true}); err == nil {
+		t.Error("Expected pool expansion refused in the sandbox")
+	}
+	r = &WebTunnelServer{
+		stats:            &statsStore{policy: StatsPolicy{Dir: "/var/lib/stats"}},
+		reservationsFile: "/etc/webtunnel/reservations.json",
+	}
+	opts, err := r.SandboxOptions(SandboxOptions{Landlock: true, WritePaths: []string{"/tmp"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(opts.WritePaths, " "); got != "/tmp /var/lib/stats /etc/webtunnel" {
+		t.Errorf("Expected data directories writable, got %v", got)
+	}
+}
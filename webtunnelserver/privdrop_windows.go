@@ -0,0 +1,13 @@
+package webtunnelserver
+
+import "fmt"
+
+// DropPrivileges is not supported on windows.
+func (r *WebTunnelServer) DropPrivileges(username string) error {
+	return fmt.Errorf("not implemented")
+}
+
+// RunningAsRoot returns false on windows.
+func RunningAsRoot() bool {
+	return false
+}
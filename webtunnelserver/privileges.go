@@ -0,0 +1,80 @@
+package webtunnelserver
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// privilegedFeatures returns the enabled features that need root after Start, as they
+// route subnets into the tunnel or read the conntrack table of the kernel.
+func (r *WebTunnelServer) privilegedFeatures() []string {
+	var features []string
+	if r.expansion != nil {
+		features = append(features, "pool expansion")
+	}
+	if r.clientSubnets != nil {
+		features = append(features, "client subnets")
+	}
+	if r.nat != nil {
+		features = append(features, "NAT monitor")
+	}
+	return features
+}
+
+// dataDirs returns the directories owned by the server that enabled features write to
+// after Start.
+func (r *WebTunnelServer) dataDirs() []string {
+	var dirs []string
+	if r.stats != nil {
+		dirs = append(dirs, r.stats.policy.Dir)
+	}
+	if r.acme != nil {
+		dirs = append(dirs, r.acme.cfg.CacheDir)
+	}
+	return dirs
+}
+
+// stateFiles returns the files enabled features replace after Start. They are written
+// to a temporary file in the same directory and renamed.
+func (r *WebTunnelServer) stateFiles() []string {
+	var files []string
+	if r.bans != nil && r.bans.policy.File != "" {
+		files = append(files, r.bans.policy.File)
+	}
+	if r.reservationsFile != "" {
+		files = append(files, r.reservationsFile)
+	}
+	return files
+}
+
+// writePaths returns the directories enabled features write to after Start.
+func (r *WebTunnelServer) writePaths() []string {
+	paths := r.dataDirs()
+	for _, f := range r.stateFiles() {
+		paths = append(paths, filepath.Dir(f))
+	}
+	return paths
+}
+
+/*
+SandboxOptions returns opts with the paths the enabled features use after Start added to
+the Landlock rules: the stats store, ACME cache, ban list and IP reservations directories
+are writable and the directories of reloaded certificate files readable. Pool expansion,
+client subnets and the NAT monitor run commands or read kernel tables denied by the
+sandbox and are refused with an error.
+*/
+func (r *WebTunnelServer) SandboxOptions(opts SandboxOptions) (SandboxOptions, error) {
+	if f := r.privilegedFeatures(); len(f) > 0 && (opts.Seccomp || opts.Landlock) {
+		return opts, fmt.Errorf("%v can't run in the sandbox", strings.Join(f, ", "))
+	}
+	if !opts.Landlock {
+		return opts, nil
+	}
+	opts.WritePaths = append(append([]string(nil), opts.WritePaths...), r.writePaths()...)
+	if r.certs != nil {
+		opts.ReadPaths = append(append([]string(nil), opts.ReadPaths...),
+			filepath.Dir(r.httpsCertFile), filepath.Dir(r.httpsKeyFile))
+	}
+	return opts, nil
+}
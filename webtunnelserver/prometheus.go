@@ -0,0 +1,42 @@
+package webtunnelserver
+
+import (
+	"net/http"
+
+	"github.com/deepakkamesh/webtunnel/webtunnelcommon/metrics"
+)
+
+// Namespace of the server metrics served on /metrics.
+const promNamespace = "webtunnel_server"
+
+// initPrometheus registers the collectors of the server.
+func (r *WebTunnelServer) initPrometheus() {
+	t := metrics.NewTunnel(promNamespace)
+	t.NewGaugeFunc(promNamespace+"_ips_allocated", "Client IPs allocated, including handshakes in progress.", func() float64 {
+		return float64(r.ipam.GetAllocatedCount() - 3) // 3 Ips are alllocated for net/gw/router
+	})
+	r.ipam.AddListener(func(ev IPEvent) {
+		switch ev.Type {
+		case IPAssigned:
+			t.AddSessions(1)
+		case IPReleased:
+			t.AddSessions(-1)
+		}
+	})
+	r.prom = t
+}
+
+// PrometheusMetrics returns the collectors served on /metrics, eg. to add the metrics of
+// the embedding application.
+func (r *WebTunnelServer) PrometheusMetrics() *metrics.Tunnel {
+	return r.prom
+}
+
+// prometheusEndpoint serves the metrics in the Prometheus text format.
+func (r *WebTunnelServer) prometheusEndpoint(w http.ResponseWriter, rcv *http.Request) {
+	if r.prom == nil {
+		http.NotFound(w, rcv)
+		return
+	}
+	r.prom.ServeHTTP(w, rcv)
+}
@@ -0,0 +1,95 @@
+package webtunnelserver
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepakkamesh/webtunnel/mocks"
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/mock/gomock"
+)
+
+func TestPrometheus(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIfce := mocks.NewMockInterface(mockCtrl)
+
+	ws, client := wsPair(t)
+	defer ws.Close()
+	defer client.Close()
+	ipam, _ := NewIPPam("192.168.0.0/24")
+	ipam.AcquireSpecificIP("192.168.0.1", struct{}{})
+	r := &WebTunnelServer{
+		ipam:            ipam,
+		ifce:            mockIfce,
+		clientNetPrefix: "192.168.0.0/24",
+		metrics:         &Metrics{},
+		conns:           make(map[string]*wc.WSWriter),
+		rtt:             newRTTTracker(),
+		loss:            newLossTracker(),
+	}
+	r.initPrometheus()
+	ip, _ := ipam.AcquireIP(ws)
+	ipam.SetIPActiveWithUserInfo(ip, "user", "laptop")
+
+	// A packet from the client fails to reach the interface.
+	out := createIPv4Pkt(net.ParseIP(ip).To4(), net.IP{1, 1, 1, 1})
+	mockIfce.EXPECT().Write(out).Return(0, fmt.Errorf("interface down"))
+	if err := r.processIncomingBinaryMessage(ip, out); err == nil {
+		t.Error("Expected tunnel write error")
+	}
+	// Two packets to the client.
+	in := createIPv4Pkt(net.IP{1, 1, 1, 1}, net.ParseIP(ip).To4())
+	r.forwardClient(in)
+	r.forwardClient(in)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 2; i++ {
+		if _, _, err := client.ReadMessage(); err != nil {
+			t.Fatalf("Expected packet at client: %v", err)
+		}
+	}
+	r.prom.ObserveHandshake(30 * time.Millisecond)
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		r.prometheusEndpoint(rec, httptest.NewRequest("GET", "/metrics", nil))
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+			t.Errorf("Unexpected content type %q", ct)
+		}
+		return rec.Body.String()
+	}
+	body := scrape()
+	for _, want := range []string{
+		"# TYPE webtunnel_server_bytes_total counter\n",
+		fmt.Sprintf("webtunnel_server_bytes_total{direction=\"in\"} %v\n", len(out)),
+		fmt.Sprintf("webtunnel_server_bytes_total{direction=\"out\"} %v\n", 2*len(in)),
+		"webtunnel_server_packets_total{direction=\"out\"} 2\n",
+		"webtunnel_server_sessions 1\n",
+		"webtunnel_server_ips_allocated 1\n",
+		"webtunnel_server_tun_write_errors_total 1\n",
+		"# TYPE webtunnel_server_handshake_latency_seconds histogram\n",
+		"webtunnel_server_handshake_latency_seconds_bucket{le=\"0.025\"} 0\n",
+		"webtunnel_server_handshake_latency_seconds_bucket{le=\"0.05\"} 1\n",
+		"webtunnel_server_handshake_latency_seconds_bucket{le=\"+Inf\"} 1\n",
+		"webtunnel_server_handshake_latency_seconds_count 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in metrics:\n%v", want, body)
+		}
+	}
+
+	r.releaseIP(ip)
+	if body := scrape(); !strings.Contains(body, "webtunnel_server_sessions 0\n") ||
+		!strings.Contains(body, "webtunnel_server_ips_allocated 0\n") {
+		t.Errorf("Expected no sessions after release:\n%v", body)
+	}
+
+	// The endpoint is built in.
+	if err := r.SetCustomHandler("/metrics", nil); err == nil {
+		t.Error("Expected error overriding /metrics")
+	}
+}
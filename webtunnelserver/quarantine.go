@@ -0,0 +1,152 @@
+package webtunnelserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+)
+
+// Interval between posture checks for a quarantined client.
+const defaultPostureRecheck = 30 * time.Second
+
+// PostureCheck decides whether the client on ip may leave quarantine.
+type PostureCheck func(ip, username, hostname string) bool
+
+// quarantine holds the quarantine policy and the set of quarantined client IPs.
+type quarantine struct {
+	routePrefix []string        // Remediation prefixes advertised while quarantined.
+	routeNets   []*net.IPNet    // Parsed remediation prefixes for ACL.
+	check       PostureCheck    // Posture check to release a client.
+	recheck     time.Duration   // Interval between posture checks.
+	ips         map[string]bool // Currently quarantined IPs.
+	lock        sync.Mutex
+}
+
+// SetQuarantine enables quarantine mode. Newly connected clients are only given the
+// remediationPrefix routes and their traffic is restricted to them until check passes,
+// after which the full route config is pushed in-band. This should be called prior to Start.
+func (r *WebTunnelServer) SetQuarantine(remediationPrefix []string, check PostureCheck) error {
+	if check == nil {
+		return fmt.Errorf("posture check is required")
+	}
+	var routeNets []*net.IPNet
+	for _, v := range remediationPrefix {
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return fmt.Errorf("invalid remediation prefix %v: %w", v, err)
+		}
+		routeNets = append(routeNets, n)
+	}
+	r.quarantine = &quarantine{
+		routePrefix: summarizeRoutes(routeNets),
+		routeNets:   routeNets,
+		check:       check,
+		recheck:     defaultPostureRecheck,
+		ips:         make(map[string]bool),
+	}
+	return nil
+}
+
+// NewWebhookPostureCheck returns a PostureCheck that POSTs the client details as JSON
+// to url. The client passes if the webhook answers with HTTP 200.
+func NewWebhookPostureCheck(url string, timeout time.Duration) PostureCheck {
+	client := &http.Client{Timeout: timeout}
+	return func(ip, username, hostname string) bool {
+		body, err := json.Marshal(map[string]string{
+			"ip":       ip,
+			"username": username,
+			"hostname": hostname,
+		})
+		if err != nil {
+			return false
+		}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			glog.Warningf("posture webhook failed for %v: %v", ip, err)
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}
+}
+
+// IsQuarantined returns true if the client on ip is restricted to remediation routes.
+func (r *WebTunnelServer) IsQuarantined(ip string) bool {
+	if r.quarantine == nil {
+		return false
+	}
+	r.quarantine.lock.Lock()
+	defer r.quarantine.lock.Unlock()
+	return r.quarantine.ips[ip]
+}
+
+// setQuarantined marks ip as quarantined or released.
+func (r *WebTunnelServer) setQuarantined(ip string, q bool) {
+	r.quarantine.lock.Lock()
+	defer r.quarantine.lock.Unlock()
+	if q {
+		r.quarantine.ips[ip] = true
+		return
+	}
+	delete(r.quarantine.ips, ip)
+}
+
+// isAllowed returns false if peer is not reachable by the quarantined client on ip.
+func (r *WebTunnelServer) isAllowed(ip string, peer net.IP) bool {
+	if !r.IsQuarantined(ip) {
+		return true
+	}
+	for _, n := range r.quarantine.routeNets {
+		if n.Contains(peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseQuarantine lifts the restriction on ip and pushes the full route config in-band.
+func (r *WebTunnelServer) releaseQuarantine(ws *wc.WSWriter, ip string) {
+	r.setQuarantined(ip, false)
+	if err := r.pushConfig(ws, ip, r.routePrefix); err != nil {
+		glog.Warningf("error sending config update to client %v: %v", ip, err)
+		return
+	}
+	glog.Infof("Client on %v released from quarantine", ip)
+}
+
+// pushConfig sends an updated client config advertising routes to the client on ip.
+func (r *WebTunnelServer) pushConfig(ws *wc.WSWriter, ip string, routes []string) error {
+	cfg, err := r.clientConfig(ip, routes)
+	if err != nil {
+		return err
+	}
+	if userinfo, err := r.ipam.GetUserinfo(ip); err == nil {
+		cfg.ServerInfo.Session = userinfo.Session
+	}
+	return ws.WriteEncoded(cfg)
+}
+
+// runPostureCheck checks the posture of the client on ip until it passes or the client
+// goes away and then pushes the full route config to the client.
+func (r *WebTunnelServer) runPostureCheck(ws *wc.WSWriter, ip, username, hostname string) {
+	for !r.isStopped.Load() {
+		// Stop if the IP is no longer held by this connection.
+		if data, err := r.ipam.GetData(ip); err != nil || data != ws {
+			r.setQuarantined(ip, false)
+			return
+		}
+		if r.quarantine.check(ip, username, hostname) {
+			r.releaseQuarantine(ws, ip)
+			return
+		}
+		glog.V(1).Infof("Client %s@%s on %v failed posture check", username, hostname, ip)
+		time.Sleep(r.quarantine.recheck)
+	}
+}
@@ -0,0 +1,40 @@
+package webtunnelserver
+
+import (
+	"net"
+	"testing"
+)
+
+func TestQuarantineACL(t *testing.T) {
+	r := &WebTunnelServer{}
+	if err := r.SetQuarantine([]string{"10.1.0.0/24"}, nil); err == nil {
+		t.Error("Expected error for missing posture check")
+	}
+	if err := r.SetQuarantine([]string{"10.1.0.0/33"}, func(string, string, string) bool { return true }); err == nil {
+		t.Error("Expected error for invalid prefix")
+	}
+	if err := r.SetQuarantine([]string{"10.1.0.0/24"}, func(string, string, string) bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+	r.setQuarantined("192.168.0.2", true)
+
+	testCases := []struct {
+		ip      string
+		peer    net.IP
+		allowed bool
+	}{
+		{"192.168.0.2", net.IP{10, 1, 0, 5}, true},    // Remediation subnet.
+		{"192.168.0.2", net.IP{172, 16, 0, 1}, false}, // Outside remediation subnet.
+		{"192.168.0.3", net.IP{172, 16, 0, 1}, true},  // Client not quarantined.
+	}
+	for _, tc := range testCases {
+		if v := r.isAllowed(tc.ip, tc.peer); v != tc.allowed {
+			t.Errorf("isAllowed(%v, %v) expected %v, got %v", tc.ip, tc.peer, tc.allowed, v)
+		}
+	}
+
+	r.setQuarantined("192.168.0.2", false)
+	if r.IsQuarantined("192.168.0.2") {
+		t.Error("Expected client released from quarantine")
+	}
+}
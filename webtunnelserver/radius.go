@@ -0,0 +1,434 @@
+package webtunnelserver
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// RADIUS packet codes (RFC 2865, RFC 2866).
+const (
+	radiusAccessRequest      = 1
+	radiusAccessAccept       = 2
+	radiusAccessReject       = 3
+	radiusAccountingRequest  = 4
+	radiusAccountingResponse = 5
+)
+
+// RADIUS attribute types.
+const (
+	attrUserName            = 1
+	attrUserPassword        = 2
+	attrFramedIPAddress     = 8
+	attrCallingStationID    = 31
+	attrNASIdentifier       = 32
+	attrAcctStatusType      = 40
+	attrAcctInputOctets     = 42
+	attrAcctOutputOctets    = 43
+	attrAcctSessionID       = 44
+	attrAcctSessionTime     = 46
+	attrAcctInputPackets    = 47
+	attrAcctOutputPackets   = 48
+	attrAcctInputGigawords  = 52
+	attrAcctOutputGigawords = 53
+)
+
+// Acct-Status-Type values.
+const (
+	acctStart   = 1
+	acctStop    = 2
+	acctInterim = 3
+)
+
+// RADIUS packet limits.
+const (
+	radiusHeaderLen  = 20
+	radiusMaxLen     = 4096
+	radiusMaxAttrLen = 253
+)
+
+// Defaults of RADIUSClient.
+const (
+	defaultRADIUSTimeout = 3 * time.Second
+	defaultNASID         = "webtunnel"
+)
+
+// radiusAttr is a RADIUS attribute.
+type radiusAttr struct {
+	typ byte
+	val []byte
+}
+
+// radiusPacket is a RADIUS request or response.
+type radiusPacket struct {
+	code  byte
+	id    byte
+	auth  [16]byte // Request or response authenticator.
+	attrs []radiusAttr
+}
+
+// add appends an attribute, truncating values longer than allowed.
+func (p *radiusPacket) add(typ byte, val []byte) {
+	if len(val) > radiusMaxAttrLen {
+		val = val[:radiusMaxAttrLen]
+	}
+	p.attrs = append(p.attrs, radiusAttr{typ, val})
+}
+
+// addUint32 appends an integer attribute.
+func (p *radiusPacket) addUint32(typ byte, v uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	p.add(typ, b)
+}
+
+// get returns the value of the first attribute of type typ, nil if absent.
+func (p *radiusPacket) get(typ byte) []byte {
+	for _, a := range p.attrs {
+		if a.typ == typ {
+			return a.val
+		}
+	}
+	return nil
+}
+
+// encode returns the wire format of p.
+func (p *radiusPacket) encode() ([]byte, error) {
+	b := make([]byte, radiusHeaderLen, radiusMaxLen)
+	b[0], b[1] = p.code, p.id
+	copy(b[4:radiusHeaderLen], p.auth[:])
+	for _, a := range p.attrs {
+		b = append(b, a.typ, byte(len(a.val)+2))
+		b = append(b, a.val...)
+	}
+	if len(b) > radiusMaxLen {
+		return nil, fmt.Errorf("RADIUS packet too large (%v bytes)", len(b))
+	}
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	return b, nil
+}
+
+// decodeRADIUS parses a RADIUS packet.
+func decodeRADIUS(b []byte) (*radiusPacket, error) {
+	if len(b) < radiusHeaderLen {
+		return nil, fmt.Errorf("short RADIUS packet")
+	}
+	n := int(binary.BigEndian.Uint16(b[2:4]))
+	if n < radiusHeaderLen || n > len(b) {
+		return nil, fmt.Errorf("invalid RADIUS length %v", n)
+	}
+	p := &radiusPacket{code: b[0], id: b[1]}
+	copy(p.auth[:], b[4:radiusHeaderLen])
+	for a := b[radiusHeaderLen:n]; len(a) > 0; {
+		if len(a) < 2 || a[1] < 2 || int(a[1]) > len(a) {
+			return nil, fmt.Errorf("malformed RADIUS attribute")
+		}
+		p.attrs = append(p.attrs, radiusAttr{a[0], a[2:a[1]]})
+		a = a[a[1]:]
+	}
+	return p, nil
+}
+
+// RADIUSClient sends requests to a RADIUS server. Use separate clients for the
+// authentication (usually port 1812) and accounting (usually port 1813) servers.
+type RADIUSClient struct {
+	Addr    string        // Server host:port.
+	Secret  []byte        // Shared secret.
+	NASID   string        // NAS-Identifier sent with every request, "webtunnel" if empty.
+	Timeout time.Duration // Time to wait for a response per attempt, 3s if zero.
+	Retries int           // Retransmissions after the first attempt.
+	id      byte          // Identifier of the last request.
+	lock    sync.Mutex
+}
+
+// nextID returns the identifier of a new request.
+func (c *RADIUSClient) nextID() byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.id++
+	return c.id
+}
+
+// nasID returns the NAS-Identifier of requests.
+func (c *RADIUSClient) nasID() []byte {
+	if c.NASID == "" {
+		return []byte(defaultNASID)
+	}
+	return []byte(c.NASID)
+}
+
+// exchange sends p and returns the verified response. Access-Requests must carry a
+// random request authenticator; it is computed for Accounting-Requests.
+func (c *RADIUSClient) exchange(p *radiusPacket) (*radiusPacket, error) {
+	p.id = c.nextID()
+	p.add(attrNASIdentifier, c.nasID())
+	b, err := p.encode()
+	if err != nil {
+		return nil, err
+	}
+	if p.code == radiusAccountingRequest {
+		h := md5.New()
+		h.Write(b)
+		h.Write(c.Secret)
+		copy(p.auth[:], h.Sum(nil))
+		copy(b[4:radiusHeaderLen], p.auth[:])
+	}
+
+	conn, err := net.Dial("udp", c.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to RADIUS server %v: %w", c.Addr, err)
+	}
+	defer conn.Close()
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultRADIUSTimeout
+	}
+	buf := make([]byte, radiusMaxLen)
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		if _, err := conn.Write(b); err != nil {
+			return nil, fmt.Errorf("error sending to RADIUS server %v: %w", c.Addr, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break // Timeout, retransmit.
+			}
+			resp, err := decodeRADIUS(buf[:n])
+			if err != nil || resp.id != p.id {
+				continue
+			}
+			if !c.verify(buf[:n], p.auth) {
+				glog.Warningf("dropping RADIUS response from %v with invalid authenticator", c.Addr)
+				continue
+			}
+			return resp, nil
+		}
+	}
+	return nil, fmt.Errorf("no response from RADIUS server %v", c.Addr)
+}
+
+// verify returns true if the response authenticator of the raw response b is valid for
+// the request authenticator reqAuth.
+func (c *RADIUSClient) verify(b []byte, reqAuth [16]byte) bool {
+	n := binary.BigEndian.Uint16(b[2:4])
+	h := md5.New()
+	h.Write(b[:4])
+	h.Write(reqAuth[:])
+	h.Write(b[radiusHeaderLen:n])
+	h.Write(c.Secret)
+	return subtle.ConstantTimeCompare(h.Sum(nil), b[4:radiusHeaderLen]) == 1
+}
+
+// hidePassword returns the User-Password attribute value of password (RFC 2865 5.2).
+func hidePassword(password, secret []byte, reqAuth [16]byte) []byte {
+	n := (len(password) + 15) / 16 * 16
+	if n == 0 {
+		n = 16
+	}
+	out := make([]byte, n)
+	copy(out, password)
+	prev := reqAuth[:]
+	for i := 0; i < n; i += 16 {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(prev)
+		sum := h.Sum(nil)
+		for j := 0; j < 16; j++ {
+			out[i+j] ^= sum[j]
+		}
+		prev = out[i : i+16]
+	}
+	return out
+}
+
+// NewRADIUSAuthenticator returns an Authenticator that checks the HTTP basic auth
+// credentials of the handshake with a RADIUS Access-Request (PAP).
+func NewRADIUSAuthenticator(c *RADIUSClient) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (string, error) {
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			return "", fmt.Errorf("no credentials")
+		}
+		p := &radiusPacket{code: radiusAccessRequest}
+		if _, err := rand.Read(p.auth[:]); err != nil {
+			return "", err
+		}
+		p.add(attrUserName, []byte(username))
+		p.add(attrUserPassword, hidePassword([]byte(password), c.Secret, p.auth))
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			p.add(attrCallingStationID, []byte(host))
+		}
+		resp, err := c.exchange(p)
+		if err != nil {
+			return "", err
+		}
+		switch resp.code {
+		case radiusAccessAccept:
+			return username, nil
+		case radiusAccessReject:
+			return "", fmt.Errorf("access rejected for %v", username)
+		default:
+			return "", fmt.Errorf("unexpected RADIUS response code %v", resp.code)
+		}
+	})
+}
+
+// acctSession is the accounting state of a client session.
+type acctSession struct {
+	id        string    // Acct-Session-Id.
+	username  string    // Client username.
+	hostname  string    // Client hostname.
+	start     time.Time // Session start.
+	inOctets  uint64    // Bytes received from the client.
+	outOctets uint64    // Bytes sent to the client.
+	inPkts    uint64    // Packets received from the client.
+	outPkts   uint64    // Packets sent to the client.
+}
+
+// radiusAccounting sends accounting records of client sessions to a RADIUS server.
+type radiusAccounting struct {
+	client   *RADIUSClient
+	interim  time.Duration           // Interim-Update interval, 0 disables.
+	sessions map[string]*acctSession // Sessions by client IP.
+	lock     sync.Mutex
+}
+
+// SetRADIUSAccounting sends Start and Stop accounting records for client sessions to the
+// RADIUS server of c, with Interim-Update records every interim (0 disables). This should
+// be called prior to Start.
+func (r *WebTunnelServer) SetRADIUSAccounting(c *RADIUSClient, interim time.Duration) error {
+	if c == nil || c.Addr == "" {
+		return fmt.Errorf("no RADIUS accounting server")
+	}
+	if interim < 0 {
+		return fmt.Errorf("invalid interim interval %v", interim)
+	}
+	r.acct = &radiusAccounting{
+		client:   c,
+		interim:  interim,
+		sessions: make(map[string]*acctSession),
+	}
+	r.AddIPEventListener(r.acct.ipEvent)
+	return nil
+}
+
+// ipEvent starts and stops session accounting as client IPs are assigned and released.
+// Records are sent in the background so IPAM is never blocked by the RADIUS server.
+func (a *radiusAccounting) ipEvent(ev IPEvent) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	switch ev.Type {
+	case IPAssigned:
+		if _, ok := a.sessions[ev.IP]; ok {
+			return
+		}
+		// The session ID correlates accounting with the server logs.
+		id := ev.SessionID
+		if id == "" {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		s := &acctSession{id: id, username: ev.Username, hostname: ev.Hostname, start: ev.Time}
+		a.sessions[ev.IP] = s
+		p := a.record(acctStart, ev.IP, *s, ev.Time)
+		go a.send(p)
+	case IPReleased:
+		s, ok := a.sessions[ev.IP]
+		if !ok {
+			return
+		}
+		delete(a.sessions, ev.IP)
+		p := a.record(acctStop, ev.IP, *s, ev.Time)
+		go a.send(p)
+	}
+}
+
+// count adds a packet of n bytes to the session of ip.
+func (a *radiusAccounting) count(ip string, dir Direction, n int) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	s, ok := a.sessions[ip]
+	if !ok {
+		return
+	}
+	if dir == FromClient {
+		s.inOctets += uint64(n)
+		s.inPkts++
+	} else {
+		s.outOctets += uint64(n)
+		s.outPkts++
+	}
+}
+
+// record returns the accounting request of type status for session s on ip at now.
+func (a *radiusAccounting) record(status uint32, ip string, s acctSession, now time.Time) *radiusPacket {
+	p := &radiusPacket{code: radiusAccountingRequest}
+	p.addUint32(attrAcctStatusType, status)
+	p.add(attrAcctSessionID, []byte(s.id))
+	p.add(attrUserName, []byte(s.username))
+	p.add(attrCallingStationID, []byte(s.hostname))
+	if v4 := net.ParseIP(ip).To4(); v4 != nil {
+		p.add(attrFramedIPAddress, v4)
+	}
+	if status == acctStart {
+		return p
+	}
+	p.addUint32(attrAcctSessionTime, uint32(now.Sub(s.start)/time.Second))
+	p.addUint32(attrAcctInputOctets, uint32(s.inOctets))
+	p.addUint32(attrAcctInputGigawords, uint32(s.inOctets>>32))
+	p.addUint32(attrAcctOutputOctets, uint32(s.outOctets))
+	p.addUint32(attrAcctOutputGigawords, uint32(s.outOctets>>32))
+	p.addUint32(attrAcctInputPackets, uint32(s.inPkts))
+	p.addUint32(attrAcctOutputPackets, uint32(s.outPkts))
+	return p
+}
+
+// send sends an accounting request. Failures are logged.
+func (a *radiusAccounting) send(p *radiusPacket) {
+	resp, err := a.client.exchange(p)
+	if err != nil {
+		glog.Warningf("RADIUS accounting for session %s failed: %v", p.get(attrAcctSessionID), err)
+		return
+	}
+	if resp.code != radiusAccountingResponse {
+		glog.Warningf("unexpected RADIUS accounting response code %v", resp.code)
+	}
+}
+
+// processRADIUSInterim sends Interim-Update records of all sessions every interim interval.
+func (r *WebTunnelServer) processRADIUSInterim() {
+	if r.acct == nil || r.acct.interim == 0 {
+		return
+	}
+	for {
+		time.Sleep(r.acct.interim)
+		if r.isStopped.Load() {
+			glog.V(1).Info("Exiting RADIUS interim accounting routine")
+			return
+		}
+		now := time.Now()
+		var records []*radiusPacket
+		r.acct.lock.Lock()
+		for ip, s := range r.acct.sessions {
+			records = append(records, r.acct.record(acctInterim, ip, *s, now))
+		}
+		r.acct.lock.Unlock()
+		for _, p := range records {
+			r.acct.send(p)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package webtunnelserver
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeRADIUS is a RADIUS server accepting one user and all accounting requests.
+type fakeRADIUS struct {
+	conn    net.PacketConn
+	secret  []byte
+	records chan *radiusPacket // Verified accounting requests.
+}
+
+func newFakeRADIUS(t *testing.T, secret string) *fakeRADIUS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRADIUS{conn: conn, secret: []byte(secret), records: make(chan *radiusPacket, 10)}
+	go f.serve()
+	return f
+}
+
+func (f *fakeRADIUS) serve() {
+	buf := make([]byte, radiusMaxLen)
+	for {
+		n, addr, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req, err := decodeRADIUS(buf[:n])
+		if err != nil {
+			continue
+		}
+		resp := &radiusPacket{id: req.id}
+		switch req.code {
+		case radiusAccessRequest:
+			resp.code = radiusAccessReject
+			pw := hidePassword(req.get(attrUserPassword), f.secret, req.auth) // XOR is its own inverse for one block.
+			if string(req.get(attrUserName)) == "alice" && string(bytes.TrimRight(pw, "\x00")) == "wonderland" {
+				resp.code = radiusAccessAccept
+			}
+		case radiusAccountingRequest:
+			// Verify the request authenticator.
+			b := append([]byte(nil), buf[:n]...)
+			copy(b[4:radiusHeaderLen], make([]byte, 16))
+			sum := md5.Sum(append(b, f.secret...))
+			if !bytes.Equal(sum[:], req.auth[:]) {
+				continue
+			}
+			f.records <- req
+			resp.code = radiusAccountingResponse
+		}
+		b, _ := resp.encode()
+		h := md5.New()
+		h.Write(b[:4])
+		h.Write(req.auth[:])
+		h.Write(b[radiusHeaderLen:])
+		h.Write(f.secret)
+		copy(b[4:radiusHeaderLen], h.Sum(nil))
+		f.conn.WriteTo(b, addr)
+	}
+}
+
+func TestRADIUSAuthenticator(t *testing.T) {
+	f := newFakeRADIUS(t, "s3cret")
+	defer f.conn.Close()
+
+	auth := NewRADIUSAuthenticator(&RADIUSClient{Addr: f.conn.LocalAddr().String(), Secret: []byte("s3cret"), Timeout: time.Second})
+	req := httptest.NewRequest("GET", "/ws", nil)
+	if _, err := auth.Authenticate(req); err == nil {
+		t.Error("Expected request without credentials refused")
+	}
+	req.SetBasicAuth("alice", "wonderland")
+	if u, err := auth.Authenticate(req); err != nil || u != "alice" {
+		t.Errorf("Expected alice accepted, got %v %v", u, err)
+	}
+	req.SetBasicAuth("alice", "rabbit")
+	if _, err := auth.Authenticate(req); err == nil {
+		t.Error("Expected wrong password rejected")
+	}
+
+	// A server with another secret fails response verification.
+	auth = NewRADIUSAuthenticator(&RADIUSClient{Addr: f.conn.LocalAddr().String(), Secret: []byte("other"), Timeout: 100 * time.Millisecond})
+	req.SetBasicAuth("alice", "wonderland")
+	if _, err := auth.Authenticate(req); err == nil {
+		t.Error("Expected response with invalid authenticator dropped")
+	}
+}
+
+func TestRADIUSAccounting(t *testing.T) {
+	f := newFakeRADIUS(t, "s3cret")
+	defer f.conn.Close()
+
+	ipam, err := NewIPPam("192.168.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &WebTunnelServer{ipam: ipam}
+	if err := r.SetRADIUSAccounting(&RADIUSClient{Addr: f.conn.LocalAddr().String(), Secret: []byte("s3cret")}, 0); err != nil {
+		t.Fatal(err)
+	}
+	uint32Attr := func(p *radiusPacket, typ byte) uint32 {
+		v := p.get(typ)
+		if len(v) != 4 {
+			t.Fatalf("Missing attribute %v", typ)
+		}
+		return binary.BigEndian.Uint32(v)
+	}
+	next := func() *radiusPacket {
+		select {
+		case p := <-f.records:
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for accounting record")
+		}
+		return nil
+	}
+
+	ip, _ := ipam.AcquireIP(nil)
+	ipam.SetIPActiveWithUserInfo(ip, "alice", "laptop")
+	start := next()
+	if uint32Attr(start, attrAcctStatusType) != acctStart || string(start.get(attrUserName)) != "alice" {
+		t.Errorf("Unexpected start record %+v", start)
+	}
+	if !net.IP(start.get(attrFramedIPAddress)).Equal(net.ParseIP(ip)) {
+		t.Errorf("Expected framed IP %v, got %v", ip, net.IP(start.get(attrFramedIPAddress)))
+	}
+
+	r.acct.count(ip, FromClient, 100)
+	r.acct.count(ip, FromClient, 50)
+	r.acct.count(ip, ToClient, 1000)
+	r.acct.count("192.168.0.99", ToClient, 1000) // Unknown session.
+	ipam.ReleaseIP(ip)
+
+	stop := next()
+	if uint32Attr(stop, attrAcctStatusType) != acctStop {
+		t.Fatalf("Expected stop record, got %v", uint32Attr(stop, attrAcctStatusType))
+	}
+	if !bytes.Equal(stop.get(attrAcctSessionID), start.get(attrAcctSessionID)) {
+		t.Error("Expected the same session ID in start and stop records")
+	}
+	if v := uint32Attr(stop, attrAcctInputOctets); v != 150 {
+		t.Errorf("Expected 150 input octets, got %v", v)
+	}
+	if v := uint32Attr(stop, attrAcctOutputOctets); v != 1000 {
+		t.Errorf("Expected 1000 output octets, got %v", v)
+	}
+	if uint32Attr(stop, attrAcctInputPackets) != 2 || uint32Attr(stop, attrAcctOutputPackets) != 1 {
+		t.Error("Unexpected packet counts")
+	}
+}
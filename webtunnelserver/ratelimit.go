@@ -0,0 +1,83 @@
+package webtunnelserver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows rate tokens per second with up to burst tokens saved.
+type tokenBucket struct {
+	tokens float64   // Available tokens.
+	last   time.Time // Time tokens were last refilled.
+}
+
+// packetLimiter holds the per client packet rate limit state.
+type packetLimiter struct {
+	rate    float64                 // Packets per second.
+	burst   float64                 // Maximum burst in packets.
+	buckets map[string]*tokenBucket // Token bucket per client IP.
+	lock    sync.Mutex
+}
+
+// SetPacketRateLimit limits each client to pps packets per second with bursts of up to
+// burst packets, protecting the gateway from floods of small packets. Packets above the
+// limit are dropped and counted in Metrics.RateLimited. This should be called prior to Start.
+func (r *WebTunnelServer) SetPacketRateLimit(pps, burst int) error {
+	if pps <= 0 {
+		return fmt.Errorf("packet rate must be positive")
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	r.pktLimiter = &packetLimiter{
+		rate:    float64(pps),
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+	return nil
+}
+
+// allowPacket returns false if the client on ip exceeded its packet rate.
+func (r *WebTunnelServer) allowPacket(ip string) bool {
+	l := r.pktLimiter
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+
+	l.lock.Lock()
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	allow := b.tokens >= 1
+	if allow {
+		b.tokens--
+	}
+	l.lock.Unlock()
+
+	if !allow {
+		r.metricsLock.Lock()
+		r.metrics.RateLimited++
+		r.metricsLock.Unlock()
+	}
+	return allow
+}
+
+// releaseRateLimit removes the limiter state of a disconnected client.
+func (r *WebTunnelServer) releaseRateLimit(ip string) {
+	l := r.pktLimiter
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	delete(l.buckets, ip)
+	l.lock.Unlock()
+}
@@ -0,0 +1,37 @@
+package webtunnelserver
+
+import "testing"
+
+func TestPacketRateLimit(t *testing.T) {
+	r := &WebTunnelServer{metrics: &Metrics{}}
+	if !r.allowPacket("192.168.0.2") {
+		t.Error("Expected packet allowed with no limit")
+	}
+	if err := r.SetPacketRateLimit(0, 10); err == nil {
+		t.Error("Expected error for zero packet rate")
+	}
+	if err := r.SetPacketRateLimit(1, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	// Burst is allowed, then packets are dropped until tokens refill.
+	for i := 0; i < 5; i++ {
+		if !r.allowPacket("192.168.0.2") {
+			t.Fatalf("Expected burst packet %v allowed", i)
+		}
+	}
+	if r.allowPacket("192.168.0.2") {
+		t.Error("Expected packet over burst dropped")
+	}
+	if !r.allowPacket("192.168.0.3") {
+		t.Error("Expected other client unaffected")
+	}
+	if r.metrics.RateLimited != 1 {
+		t.Errorf("Expected 1 rate limited packet, got %v", r.metrics.RateLimited)
+	}
+
+	r.releaseRateLimit("192.168.0.2")
+	if !r.allowPacket("192.168.0.2") {
+		t.Error("Expected packet allowed after release")
+	}
+}
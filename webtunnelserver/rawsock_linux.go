@@ -0,0 +1,114 @@
+//go:build rawsock
+
+package webtunnelserver
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/songgao/water"
+)
+
+// packetOutgoing is the AF_PACKET packet type of locally sent frames.
+const packetOutgoing = 4
+
+// rawSocketInterface is an experimental data path that exchanges IP packets directly
+// with a dedicated network interface over an AF_PACKET socket instead of a TUN device.
+type rawSocketInterface struct {
+	fd      int
+	name    string
+	ifindex int
+	nextHop net.HardwareAddr // MAC of the next hop for packets sent to the network.
+}
+
+// UseRawSocket switches the server data path from TUN to an AF_PACKET socket bound
+// to the preconfigured interface ifName. Packets are sent to nextHop (eg. the MAC of
+// the upstream router). This must be called prior to NewWebTunnelServer.
+func UseRawSocket(ifName string, nextHop net.HardwareAddr) error {
+	if len(nextHop) != 6 {
+		return fmt.Errorf("invalid next hop MAC %v", nextHop)
+	}
+	if _, err := net.InterfaceByName(ifName); err != nil {
+		return err
+	}
+	NewWaterInterface = func(water.Config) (wc.Interface, error) {
+		return newRawSocketInterface(ifName, nextHop)
+	}
+	// The interface is configured by the administrator.
+	InitTunnel = func(string, string, string) error { return nil }
+	return nil
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func newRawSocketInterface(ifName string, nextHop net.HardwareAddr) (wc.Interface, error) {
+	ifi, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil, err
+	}
+	proto := htons(syscall.ETH_P_IP)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, int(proto))
+	if err != nil {
+		return nil, fmt.Errorf("error opening packet socket %w", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: proto, Ifindex: ifi.Index}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("error binding packet socket to %v %w", ifName, err)
+	}
+	return &rawSocketInterface{
+		fd:      fd,
+		name:    ifName,
+		ifindex: ifi.Index,
+		nextHop: nextHop,
+	}, nil
+}
+
+// Read reads the next IP packet received on the interface.
+func (s *rawSocketInterface) Read(p []byte) (int, error) {
+	for {
+		n, sa, err := syscall.Recvfrom(s.fd, p, 0)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return 0, err
+		}
+		// Skip packets sent by this host.
+		if ll, ok := sa.(*syscall.SockaddrLinklayer); ok && ll.Pkttype == packetOutgoing {
+			continue
+		}
+		return n, nil
+	}
+}
+
+// Write sends the IP packet p to the next hop.
+func (s *rawSocketInterface) Write(p []byte) (int, error) {
+	sa := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_IP),
+		Ifindex:  s.ifindex,
+		Halen:    uint8(len(s.nextHop)),
+	}
+	copy(sa.Addr[:], s.nextHop)
+	if err := syscall.Sendto(s.fd, p, 0, sa); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the packet socket.
+func (s *rawSocketInterface) Close() error {
+	return syscall.Close(s.fd)
+}
+
+// IsTUN returns true; packets are exchanged at layer 3.
+func (s *rawSocketInterface) IsTUN() bool { return true }
+
+// IsTAP returns false; packets are exchanged at layer 3.
+func (s *rawSocketInterface) IsTAP() bool { return false }
+
+// Name returns the interface name.
+func (s *rawSocketInterface) Name() string { return s.name }
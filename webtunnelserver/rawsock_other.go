@@ -0,0 +1,13 @@
+//go:build !rawsock || !linux
+
+package webtunnelserver
+
+import (
+	"fmt"
+	"net"
+)
+
+// UseRawSocket is only available on Linux builds with the rawsock tag.
+func UseRawSocket(ifName string, nextHop net.HardwareAddr) error {
+	return fmt.Errorf("raw socket data path requires a linux build with -tags rawsock")
+}
@@ -0,0 +1,179 @@
+package webtunnelserver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+)
+
+// ReaddressTimeout (Overridable) is how long a moved client has to apply its new IP before
+// the move is cancelled and the session stays on its current IP.
+var ReaddressTimeout = 30 * time.Second
+
+// sessionMove is a session waiting for the client to apply its new IP.
+type sessionMove struct {
+	newIP string
+	ws    *wc.WSWriter
+	timer *time.Timer // Cancels the move on timeout.
+}
+
+// sessionMoves holds the pending moves keyed by the current IP of the session.
+type sessionMoves struct {
+	pending map[string]*sessionMove
+	lock    sync.Mutex
+}
+
+/*
+MoveSession moves the live session on ip to newIP, or to a free IP of the pool if newIP is
+empty, eg. when renumbering pools. The client is sent its new config in-band and, once it
+reconfigured its interface and acknowledged, the session state moves over and ip is
+released without a disconnect. Port forwards to ip are removed. Clients that don't apply
+the new IP within ReaddressTimeout keep ip. Reserved IPs are refused as newIP. It returns
+the new IP.
+*/
+func (r *WebTunnelServer) MoveSession(ip, newIP string) (string, error) {
+	data, err := r.ipam.GetData(ip)
+	if err != nil {
+		return "", fmt.Errorf("client %v not connected: %w", ip, err)
+	}
+	ws, ok := data.(*wc.WSWriter)
+	if !ok {
+		return "", fmt.Errorf("client %v not connected", ip)
+	}
+	userinfo, err := r.ipam.GetUserinfo(ip)
+	if err != nil {
+		return "", err
+	}
+
+	r.moves.lock.Lock()
+	defer r.moves.lock.Unlock()
+	if _, ok := r.moves.pending[ip]; ok {
+		return "", fmt.Errorf("move of %v already pending", ip)
+	}
+	if newIP == "" {
+		if newIP, err = r.ipam.AcquireIP(ws); err != nil {
+			return "", err
+		}
+	} else if err := r.ipam.AcquireSpecificIP(newIP, ws); err != nil {
+		return "", err
+	}
+
+	routes := r.routePrefix
+	if r.IsQuarantined(ip) {
+		routes = r.quarantine.routePrefix
+	}
+	cfg, err := r.clientConfig(newIP, routes)
+	if err != nil {
+		r.ipam.ReleaseIP(newIP)
+		return "", err
+	}
+	cfg.ServerInfo.Session = userinfo.Session
+	cfg.ServerInfo.SessionID = r.sessionID(ip)
+	cfg.MovedFrom = ip
+	if err := ws.WriteEncoded(cfg); err != nil {
+		r.ipam.ReleaseIP(newIP)
+		return "", fmt.Errorf("error sending config to %v: %w", ip, err)
+	}
+
+	if r.moves.pending == nil {
+		r.moves.pending = make(map[string]*sessionMove)
+	}
+	to := newIP
+	r.moves.pending[ip] = &sessionMove{
+		newIP: newIP,
+		ws:    ws,
+		timer: time.AfterFunc(ReaddressTimeout, func() { r.cancelMove(ip, to) }),
+	}
+	glog.Infof("Moving session of %s@%s from %v to %v", userinfo.Username, userinfo.Hostname, ip, newIP)
+	return newIP, nil
+}
+
+// completeMove moves the session state of ws from ip to the new IP acknowledged by the
+// client, then releases ip. It returns the new IP.
+func (r *WebTunnelServer) completeMove(ws *wc.WSWriter, ip, ack string) (string, error) {
+	r.moves.lock.Lock()
+	m, ok := r.moves.pending[ip]
+	if !ok || m.ws != ws || m.newIP != ack {
+		r.moves.lock.Unlock()
+		return "", fmt.Errorf("no pending move to %v", ack)
+	}
+	m.timer.Stop()
+	delete(r.moves.pending, ip)
+	r.moves.lock.Unlock()
+
+	if err := r.ipam.MoveIP(ip, m.newIP); err != nil {
+		return "", err
+	}
+	r.moveSessionState(ip, m.newIP, ws)
+	r.releaseIP(ip)
+	glog.Infof("Session on %v moved to %v", ip, m.newIP)
+	return m.newIP, nil
+}
+
+// moveSessionState moves the connection and the per session state worth keeping from
+// oldIP to newIP.
+func (r *WebTunnelServer) moveSessionState(oldIP, newIP string, ws *wc.WSWriter) {
+	r.connMapLock.Lock()
+	r.conns[newIP] = ws
+	if v, ok := r.clientVersions[oldIP]; ok {
+		r.clientVersions[newIP] = v
+	}
+	if id, ok := r.sessionIDs[oldIP]; ok {
+		r.sessionIDs[newIP] = id
+	}
+	if caps, ok := r.capabilities[oldIP]; ok {
+		r.capabilities[newIP] = caps
+	}
+	r.connMapLock.Unlock()
+
+	if r.IsQuarantined(oldIP) {
+		r.setQuarantined(newIP, true)
+	}
+	r.subnets.move(oldIP, newIP)
+	r.moveAgentSession(oldIP, newIP)
+	if r.site != nil {
+		r.site.lock.Lock()
+		if last, ok := r.site.peers[oldIP]; ok {
+			r.site.peers[newIP] = last
+		}
+		r.site.lock.Unlock()
+	}
+	k := &r.keepalives
+	k.lock.Lock()
+	if d, ok := k.intervals[oldIP]; ok {
+		k.intervals[newIP] = d
+		k.next[newIP] = k.next[oldIP]
+	}
+	k.lock.Unlock()
+}
+
+// cancelMove releases newIP if the client on ip did not apply it in time.
+func (r *WebTunnelServer) cancelMove(ip, newIP string) {
+	r.moves.lock.Lock()
+	m, ok := r.moves.pending[ip]
+	if !ok || m.newIP != newIP {
+		r.moves.lock.Unlock()
+		return
+	}
+	delete(r.moves.pending, ip)
+	r.moves.lock.Unlock()
+	r.ipam.ReleaseIP(newIP)
+	glog.Warningf("Client on %v did not apply new IP %v, move cancelled", ip, newIP)
+}
+
+// releaseMove cancels the pending move of a disconnected client.
+func (r *WebTunnelServer) releaseMove(ip string) {
+	r.moves.lock.Lock()
+	m, ok := r.moves.pending[ip]
+	if ok {
+		m.timer.Stop()
+		delete(r.moves.pending, ip)
+	}
+	r.moves.lock.Unlock()
+	if ok {
+		r.ipam.ReleaseIP(m.newIP)
+	}
+}
@@ -0,0 +1,94 @@
+package webtunnelserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/gorilla/websocket"
+)
+
+func TestMoveSession(t *testing.T) {
+	r, err := NewWebTunnelServer("127.0.0.1:0", "192.168.0.1", "255.255.255.0", "192.168.0.0/24",
+		nil, []string{"1.1.1.0/24"}, false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(r.wsEndpoint))
+	defer srv.Close()
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.WriteMessage(websocket.TextMessage, []byte("getConfig user host"))
+	cfg := &wc.ClientConfig{}
+	if err := c.ReadJSON(cfg); err != nil {
+		t.Fatal(err)
+	}
+	ip := cfg.IP
+	waitFor := func(cond func() bool) bool {
+		for i := 0; i < 100 && !cond(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return cond()
+	}
+
+	if _, err := r.MoveSession("192.168.0.99", ""); err == nil {
+		t.Error("Expected error moving an unknown session")
+	}
+	if err := r.ipam.Reserve("alice", "192.168.0.60"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.MoveSession(ip, "192.168.0.60"); err == nil {
+		t.Error("Expected error moving to the reserved IP of another identity")
+	}
+
+	// Without an acknowledgement the move is cancelled.
+	ReaddressTimeout = 50 * time.Millisecond
+	newIP, err := r.MoveSession(ip, "192.168.0.50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReadJSON(cfg); err != nil || cfg.IP != newIP || cfg.MovedFrom != ip {
+		t.Fatalf("Expected config moving %v to %v, got %+v %v", ip, newIP, cfg, err)
+	}
+	if !waitFor(func() bool { _, err := r.ipam.GetData(newIP); return err != nil }) {
+		t.Error("Expected new IP released after timeout")
+	}
+	if _, ok := r.DumpAllocations()[ip]; !ok {
+		t.Error("Expected session kept on its IP")
+	}
+
+	// The acknowledged move keeps the session and connection on the new IP.
+	ReaddressTimeout = 5 * time.Second
+	if newIP, err = r.MoveSession(ip, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.MoveSession(ip, ""); err == nil {
+		t.Error("Expected error with a move already pending")
+	}
+	if err := c.ReadJSON(cfg); err != nil || cfg.MovedFrom != ip {
+		t.Fatalf("Expected config moving %v, got %+v %v", ip, cfg, err)
+	}
+	session := cfg.ServerInfo.Session
+	c.WriteMessage(websocket.TextMessage, []byte(wc.ReaddressAckPrefix+newIP))
+	if !waitFor(func() bool { _, ok := r.DumpAllocations()[ip]; return !ok }) {
+		t.Fatal("Expected old IP released")
+	}
+	if found, ok := r.ipam.FindSession(session); !ok || found != newIP {
+		t.Errorf("Expected session on %v, got %v", newIP, found)
+	}
+	if u := r.DumpAllocations()[newIP]; u == nil || u.Username != "user" {
+		t.Errorf("Expected user info moved, got %+v", u)
+	}
+	r.connMapLock.Lock()
+	_, oldConn := r.conns[ip]
+	r.connMapLock.Unlock()
+	if oldConn {
+		t.Error("Expected connection removed from old IP")
+	}
+}
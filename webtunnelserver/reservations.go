@@ -0,0 +1,75 @@
+package webtunnelserver
+
+import (
+	"context"
+	"net/http"
+)
+
+// CertIdentityPrefix prefixes the common name of a client certificate in IP reservations,
+// eg. "cert:laptop-42". Other identities are usernames.
+const CertIdentityPrefix = "cert:"
+
+/*
+SetIPReservations loads the static IP reservations of file, a JSON object of identity to
+tunnel IP (eg. {"alice": "192.168.0.10", "cert:laptop-42": "192.168.0.11"}), and saves the
+reservations changed with ReserveIP and UnreserveIP to it. Clients presenting a client
+certificate verified by the TLS config (see SetTLSConfig) with a reserved common name, or
+authenticated (see SetAuthenticator) as a username with a reservation, always receive the
+reserved IP; the certificate takes precedence. Usernames merely claimed in config requests are not
+verified and never receive a reserved IP. Reserved IPs are not handed to other clients.
+Clients fall back to a dynamic IP if their reserved IP is in use by another of their
+sessions. This should be called prior to Start.
+*/
+func (r *WebTunnelServer) SetIPReservations(file string) error {
+	if err := r.ipam.LoadReservations(file); err != nil {
+		return err
+	}
+	r.reservationsFile = file
+	return nil
+}
+
+// ReserveIP reserves the tunnel IP ip for identity, a username or CertIdentityPrefix and a
+// certificate common name. Connected clients keep their IP until they reconnect.
+func (r *WebTunnelServer) ReserveIP(identity, ip string) error {
+	return r.ipam.Reserve(identity, ip)
+}
+
+// UnreserveIP removes the IP reservation of identity.
+func (r *WebTunnelServer) UnreserveIP(identity string) error {
+	return r.ipam.Unreserve(identity)
+}
+
+// IPReservations returns the reserved tunnel IP of each identity.
+func (r *WebTunnelServer) IPReservations() map[string]string {
+	return r.ipam.Reservations()
+}
+
+// identities returns the identities of the connection known before its config request,
+// the client certificate first. Certificates count only if the TLS config verified them.
+func identities(ctx context.Context, rcv *http.Request) []string {
+	var ids []string
+	if rcv.TLS != nil && len(rcv.TLS.VerifiedChains) > 0 {
+		if cn := rcv.TLS.VerifiedChains[0][0].Subject.CommonName; cn != "" {
+			ids = append(ids, CertIdentityPrefix+cn)
+		}
+	}
+	if u := authUser(ctx); u != "" {
+		ids = append(ids, u)
+	}
+	return ids
+}
+
+// identitiesKey is the context key of the verified identities of a connection.
+type identitiesKey struct{}
+
+// withIdentities returns ctx carrying the identities of rcv, see connIdentities.
+func withIdentities(ctx context.Context, rcv *http.Request) context.Context {
+	return context.WithValue(ctx, identitiesKey{}, identities(ctx, rcv))
+}
+
+// connIdentities returns the verified identities of the connection of ctx, the client
+// certificate first.
+func connIdentities(ctx context.Context) []string {
+	ids, _ := ctx.Value(identitiesKey{}).([]string)
+	return ids
+}
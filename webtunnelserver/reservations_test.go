@@ -0,0 +1,114 @@
+package webtunnelserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/gorilla/websocket"
+)
+
+func TestIPReservations(t *testing.T) {
+	r, err := NewWebTunnelServer("127.0.0.1:0", "192.168.0.1", "255.255.255.0", "192.168.0.0/24",
+		nil, []string{"1.1.1.0/24"}, false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "reservations.json")
+	os.WriteFile(file, []byte(`{"alice": "192.168.0.50"}`), 0600)
+	if err := r.SetIPReservations(file); err != nil {
+		t.Fatal(err)
+	}
+	// Bearer tokens authenticate their username, handshakes without one are anonymous.
+	r.SetAuthenticator(AuthenticatorFunc(func(rcv *http.Request) (string, error) {
+		token, _ := bearerToken(rcv)
+		return token, nil
+	}))
+	srv := httptest.NewServer(http.HandlerFunc(r.wsEndpoint))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	connect := func(token, user string) string {
+		t.Helper()
+		var h http.Header
+		if token != "" {
+			h = http.Header{"Authorization": {"Bearer " + token}}
+		}
+		c, _, err := websocket.DefaultDialer.Dial(url, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		if err := c.WriteMessage(websocket.TextMessage, []byte("getConfig "+user+" host")); err != nil {
+			t.Fatal(err)
+		}
+		cfg := &wc.ClientConfig{}
+		if err := c.ReadJSON(cfg); err != nil {
+			t.Fatal(err)
+		}
+		return cfg.IP
+	}
+
+	// Claimed usernames are not verified and get dynamic IPs.
+	if ip := connect("", "alice"); ip == "192.168.0.50" {
+		t.Error("Expected reserved IP not given to a claimed username")
+	}
+	if ip := connect("alice", "alice"); ip != "192.168.0.50" {
+		t.Errorf("Expected reserved IP of alice, got %v", ip)
+	}
+	r.connMapLock.Lock()
+	_, ok := r.conns["192.168.0.50"]
+	sessions := len(r.sessionIDs)
+	r.connMapLock.Unlock()
+	if !ok || sessions != 2 {
+		t.Errorf("Expected session state on the reserved IP, got %v sessions", sessions)
+	}
+	// Other users and a second session of alice get dynamic IPs.
+	if ip := connect("bob", "alice"); ip == "192.168.0.50" {
+		t.Error("Expected reserved IP not given to bob")
+	}
+	if ip := connect("alice", "alice"); ip == "192.168.0.50" {
+		t.Error("Expected reserved IP in use not given twice")
+	}
+
+	// Reservations are saved to the file.
+	if err := r.ReserveIP(CertIdentityPrefix+"laptop", "192.168.0.60"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ReserveIP("carol", "10.0.0.1"); err == nil {
+		t.Error("Expected reservation outside the client network refused")
+	}
+	if err := r.UnreserveIP("alice"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"cert:laptop": "192.168.0.60"}
+	if got := r.IPReservations(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected reservations %v, got %v", want, got)
+	}
+	data, _ := os.ReadFile(file)
+	if !strings.Contains(string(data), "cert:laptop") || strings.Contains(string(data), "alice") {
+		t.Errorf("Unexpected reservations file %s", data)
+	}
+
+	// The client certificate comes before the username.
+	rcv := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "laptop"}}
+	rcv.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	ctx := context.WithValue(context.Background(), authUserKey{}, "dave")
+	if got := identities(ctx, rcv); !reflect.DeepEqual(got, []string{"dave"}) {
+		t.Errorf("Expected unverified certificate ignored, got %v", got)
+	}
+	rcv.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	if got := identities(ctx, rcv); !reflect.DeepEqual(got, []string{"cert:laptop", "dave"}) {
+		t.Errorf("Unexpected identities %v", got)
+	}
+}
@@ -0,0 +1,152 @@
+package webtunnelserver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// Close reason sent to a connection whose session was taken over by a new client process.
+const closeReasonResumed = "session resumed elsewhere"
+
+// tokenOwner is the identity a session token was issued to.
+type tokenOwner struct {
+	ids     string    // Verified identities of the connection, see connIdentities.
+	user    string    // Username of the session, authenticated or claimed.
+	expires time.Time // Expiry of the token, zero while its session is active.
+}
+
+// sessionTokens holds the owners of the session tokens issued to clients. Tokens of ended
+// sessions are kept as long as their parked sequence state, so reconnecting clients
+// continue their session.
+type sessionTokens struct {
+	owners map[string]tokenOwner
+	lock   sync.Mutex
+}
+
+// owner returns the token owner of the connection of ctx authenticated or claiming user.
+func owner(ctx context.Context, user string) tokenOwner {
+	return tokenOwner{ids: strings.Join(connIdentities(ctx), " "), user: user}
+}
+
+// issue records token as issued to o, active until ended if expires is zero.
+func (t *sessionTokens) issue(token string, o tokenOwner, expires time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	if t.owners == nil {
+		t.owners = make(map[string]tokenOwner)
+	}
+	for k, v := range t.owners {
+		if !v.expires.IsZero() && now.After(v.expires) {
+			delete(t.owners, k)
+		}
+	}
+	o.expires = expires
+	t.owners[token] = o
+}
+
+// end starts the expiry of token as its session ended.
+func (t *sessionTokens) end(token string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if o, ok := t.owners[token]; ok && o.expires.IsZero() {
+		o.expires = time.Now().Add(seqParkTime)
+		t.owners[token] = o
+	}
+}
+
+// belongsTo returns true if token was issued by the server to o and has not expired. The
+// username is only compared if user is not empty.
+func (t *sessionTokens) belongsTo(token string, o tokenOwner) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	v, ok := t.owners[token]
+	if !ok || (!v.expires.IsZero() && time.Now().After(v.expires)) {
+		return false
+	}
+	return v.ids == o.ids && (o.user == "" || v.user == o.user)
+}
+
+// endSessionToken starts the expiry of the session token of ip, unless another session
+// continues it.
+func (r *WebTunnelServer) endSessionToken(ip string) {
+	userinfo, err := r.ipam.GetUserinfo(ip)
+	if err != nil || userinfo.Session == "" {
+		return
+	}
+	if other, ok := r.ipam.FindSession(userinfo.Session); ok && other != ip {
+		return
+	}
+	r.tokens.end(userinfo.Session)
+}
+
+// resumeSession hands the session token of req over from its current connection to ws,
+// which was allocated tempIP on upgrade. It returns the session IP that ws now owns. The
+// client keeps its IP, routes and per session state without being seen as disconnected.
+// The connection of ctx must have the identities the session was issued to. ctl is true
+// if the request was a control message.
+func (r *WebTunnelServer) resumeSession(ctx context.Context, ws *wc.WSWriter, tempIP string, req *wc.ConfigRequest, ctl bool) (string, error) {
+	session := req.Session
+	ip, ok := r.ipam.FindSession(session)
+	if !ok {
+		return "", fmt.Errorf("unknown session")
+	}
+	if !r.tokens.belongsTo(session, owner(ctx, "")) {
+		return "", fmt.Errorf("session of another identity")
+	}
+	if u := authUser(ctx); u != "" {
+		if userinfo, err := r.ipam.GetUserinfo(ip); err != nil || userinfo.Username != u {
+			return "", fmt.Errorf("session of another user")
+		}
+	}
+	data, err := r.ipam.GetData(ip)
+	if err != nil {
+		return "", err
+	}
+	old, _ := data.(*wc.WSWriter)
+
+	// Packets for the session IP go to the new connection from here on.
+	if err := r.ipam.SetData(ip, ws); err != nil {
+		return "", err
+	}
+	r.connMapLock.Lock()
+	r.conns[ip] = ws
+	r.connMapLock.Unlock()
+	// The connection continues the session ID of ip.
+	r.releaseIP(tempIP)
+
+	routes := r.routePrefix
+	if r.IsQuarantined(ip) {
+		routes = r.quarantine.routePrefix
+	}
+	cfg, err := r.clientConfig(ip, routes)
+	if err != nil {
+		return "", err
+	}
+	cfg.ServerInfo.Session = session
+	if err := r.writeConfig(ws, ip, cfg, req, ctl); err != nil {
+		glog.Warningf("error sending config to resumed client: %v", err)
+	}
+
+	if old != nil {
+		old.WriteControlMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, withSessionID(closeReasonResumed, r.sessionID(ip))))
+		old.Conn().Close()
+	}
+	glog.Infof("Session on %v resumed by new connection", ip)
+	return ip, nil
+}
+
+// ownsIP returns true if ws is the connection holding ip, whether or not it is marked in
+// use by getConfig yet. An IP released, eg. on lease expiry, is no longer owned.
+func (r *WebTunnelServer) ownsIP(ws *wc.WSWriter, ip string) bool {
+	a, ok := r.ipam.Lookup(ip)
+	return ok && a.Data == ws
+}
@@ -0,0 +1,77 @@
+package webtunnelserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/gorilla/websocket"
+)
+
+func TestSessionTokenOwner(t *testing.T) {
+	r, err := NewWebTunnelServer("127.0.0.1:0", "192.168.0.1", "255.255.255.0", "192.168.0.0/24",
+		nil, []string{"1.1.1.0/24"}, false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetAuthenticator(NewTokenAuthenticator(TokenVerifier(func(token string) (string, error) {
+		return token, nil
+	})))
+	srv := httptest.NewServer(http.HandlerFunc(r.wsEndpoint))
+	defer srv.Close()
+
+	dial := func(user, msg string) (*websocket.Conn, *wc.ClientConfig, error) {
+		t.Helper()
+		c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"),
+			http.Header{"Authorization": {"Bearer " + user}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.WriteMessage(websocket.TextMessage, []byte(msg))
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		cfg := &wc.ClientConfig{}
+		return c, cfg, c.ReadJSON(cfg)
+	}
+	alice, cfg, err := dial("alice", "getConfig alice laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	session := cfg.ServerInfo.Session
+
+	// Another user can't take over or continue the session with its token.
+	mallory, _, err := dial("mallory", "resume "+session)
+	if err == nil {
+		t.Error("Expected resume of the session of another user refused")
+	}
+	mallory.Close()
+	mallory, cfg, err = dial("mallory", "getConfig mallory pc "+session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mallory.Close()
+	if cfg.ServerInfo.Session == session {
+		t.Error("Expected a new token for the token of another user")
+	}
+	guest, cfg, err := dial("alice", "getConfig alice laptop forged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer guest.Close()
+	if cfg.ServerInfo.Session == "forged" {
+		t.Error("Expected a token not issued by the server replaced")
+	}
+
+	// The owner resumes its session on the same IP.
+	resumed, cfg, err := dial("alice", "resume "+session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	if cfg.IP != "192.168.0.2" || cfg.ServerInfo.Session != session {
+		t.Errorf("Expected session resumed on 192.168.0.2, got %v %v", cfg.IP, cfg.ServerInfo.Session)
+	}
+}
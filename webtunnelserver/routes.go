@@ -0,0 +1,167 @@
+package webtunnelserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// configChunkSize is the largest control message sent to clients in one piece. Larger
+// messages (eg. configs with many routes) are chunked for clients that support it.
+var configChunkSize = 16 << 10
+
+// ipv4Prefix is an IPv4 prefix as a masked address and mask length.
+type ipv4Prefix struct {
+	addr uint32
+	bits int
+}
+
+func (p ipv4Prefix) size() uint64 {
+	return 1 << (32 - p.bits)
+}
+
+func (p ipv4Prefix) String() string {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, p.addr)
+	return (&net.IPNet{IP: ip, Mask: net.CIDRMask(p.bits, 32)}).String()
+}
+
+// summarizeRoutes returns the smallest prefix list covering the same addresses as
+// nets: prefixes contained in another are dropped and adjacent sibling prefixes are
+// merged into their parent. Non IPv4 prefixes are kept unchanged.
+func summarizeRoutes(nets []*net.IPNet) []string {
+	var prefixes []ipv4Prefix
+	var out []string
+	for _, n := range nets {
+		ip := n.IP.To4()
+		bits, total := n.Mask.Size()
+		if ip == nil || total != 32 {
+			out = append(out, n.String())
+			continue
+		}
+		prefixes = append(prefixes, ipv4Prefix{binary.BigEndian.Uint32(ip.Mask(n.Mask)), bits})
+	}
+
+	sort.Slice(prefixes, func(i, j int) bool {
+		if prefixes[i].addr != prefixes[j].addr {
+			return prefixes[i].addr < prefixes[j].addr
+		}
+		return prefixes[i].bits < prefixes[j].bits
+	})
+
+	// Merge until no more changes; each pass works on a sorted list.
+	for changed := true; changed; {
+		changed = false
+		var merged []ipv4Prefix
+		for _, p := range prefixes {
+			if len(merged) > 0 {
+				last := &merged[len(merged)-1]
+				// Contained in the previous prefix.
+				if uint64(p.addr) < uint64(last.addr)+last.size() {
+					changed = true
+					continue
+				}
+				// Sibling of the previous prefix.
+				if p.bits == last.bits && p.bits > 0 && last.addr&(1<<(32-p.bits)) == 0 &&
+					uint64(p.addr) == uint64(last.addr)+last.size() {
+					last.bits--
+					changed = true
+					continue
+				}
+			}
+			merged = append(merged, p)
+		}
+		prefixes = merged
+	}
+
+	for _, p := range prefixes {
+		out = append(out, p.String())
+	}
+	return out
+}
+
+// RouteAnalysis is the result of validating the route and client prefixes at startup.
+type RouteAnalysis struct {
+	Configured []string // Route prefixes as configured.
+	Advertised []string // Summarized route prefixes advertised to clients.
+	ClientNet  string   // Client IP pool prefix.
+	Warnings   []string // Overlaps that are likely misconfigurations.
+}
+
+// parseRoutes parses the route and client pool prefixes, rejecting malformed or non
+// IPv4 CIDRs.
+func parseRoutes(routePrefix []string, clientNetPrefix string) ([]*net.IPNet, *net.IPNet, error) {
+	_, clientNet, err := net.ParseCIDR(clientNetPrefix)
+	if err != nil || clientNet.IP.To4() == nil {
+		return nil, nil, fmt.Errorf("invalid client network prefix %q", clientNetPrefix)
+	}
+	var routeNets []*net.IPNet
+	for _, v := range routePrefix {
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid route prefix %v: %w", v, err)
+		}
+		if n.IP.To4() == nil {
+			return nil, nil, fmt.Errorf("invalid route prefix %v: not IPv4", v)
+		}
+		routeNets = append(routeNets, n)
+	}
+	return routeNets, clientNet, nil
+}
+
+// overlaps returns true if a and b share any address.
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// analyzeRoutes checks routes for overlaps with the client pool and with the management
+// networks of the server, which would make clients route server or pool traffic via
+// the wrong path.
+func analyzeRoutes(routeNets []*net.IPNet, clientNet *net.IPNet, mgmtNets []*net.IPNet) RouteAnalysis {
+	a := RouteAnalysis{
+		Advertised: summarizeRoutes(routeNets),
+		ClientNet:  clientNet.String(),
+	}
+	for _, n := range routeNets {
+		a.Configured = append(a.Configured, n.String())
+		if overlaps(n, clientNet) {
+			a.Warnings = append(a.Warnings, fmt.Sprintf("route %v overlaps client network %v", n, clientNet))
+		}
+		for _, m := range mgmtNets {
+			if overlaps(n, m) {
+				a.Warnings = append(a.Warnings, fmt.Sprintf("route %v overlaps management network %v", n, m))
+			}
+		}
+	}
+	for i, n := range routeNets {
+		for _, o := range routeNets[i+1:] {
+			if overlaps(n, o) {
+				a.Warnings = append(a.Warnings, fmt.Sprintf("route %v overlaps route %v", n, o))
+			}
+		}
+	}
+	return a
+}
+
+// localNets returns the IPv4 networks of the non loopback interfaces of the server.
+func localNets() ([]*net.IPNet, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	var nets []*net.IPNet
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || n.IP.To4() == nil || n.IP.IsLoopback() {
+			continue
+		}
+		nets = append(nets, &net.IPNet{IP: n.IP.Mask(n.Mask), Mask: n.Mask})
+	}
+	return nets, nil
+}
+
+// RouteAnalysis returns the validation result of the route prefixes.
+func (r *WebTunnelServer) RouteAnalysis() RouteAnalysis {
+	return r.routeAnalysis
+}
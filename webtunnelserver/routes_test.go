@@ -0,0 +1,103 @@
+package webtunnelserver
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+)
+
+func TestSummarizeRoutes(t *testing.T) {
+	tests := []struct {
+		in   []string
+		want []string
+	}{
+		{[]string{"10.0.0.0/24", "10.0.1.0/24"}, []string{"10.0.0.0/23"}},
+		{[]string{"10.0.1.0/24", "10.0.0.0/24", "10.0.2.0/23"}, []string{"10.0.0.0/22"}},
+		{[]string{"10.0.0.0/8", "10.1.2.0/24", "192.168.0.0/16"}, []string{"10.0.0.0/8", "192.168.0.0/16"}},
+		{[]string{"10.0.1.0/24", "10.0.2.0/24"}, []string{"10.0.1.0/24", "10.0.2.0/24"}},
+		{[]string{"10.0.0.0/24", "10.0.0.0/24"}, []string{"10.0.0.0/24"}},
+		{[]string{"0.0.0.0/1", "128.0.0.0/1"}, []string{"0.0.0.0/0"}},
+	}
+	for _, tc := range tests {
+		var nets []*net.IPNet
+		for _, p := range tc.in {
+			_, n, err := net.ParseCIDR(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nets = append(nets, n)
+		}
+		if got := summarizeRoutes(nets); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("summarizeRoutes(%v) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestChunkAssembler(t *testing.T) {
+	var a wc.ChunkAssembler
+	chunks := []string{"chunk 7 1 3 wör", "chunk 7 0 3 hello ", "chunk 7 2 3 ld"}
+	for i, c := range chunks {
+		if !wc.IsChunk([]byte(c)) {
+			t.Fatalf("IsChunk(%q) = false", c)
+		}
+		msg, err := a.Add([]byte(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < len(chunks)-1 && msg != nil {
+			t.Fatalf("message complete after %v chunks", i+1)
+		}
+		if i == len(chunks)-1 && string(msg) != "hello wörld" {
+			t.Errorf("got %q want %q", msg, "hello wörld")
+		}
+	}
+
+	// A new message discards an incomplete one.
+	a.Add([]byte("chunk 8 0 2 stale"))
+	if msg, _ := a.Add([]byte("chunk 9 0 1 fresh")); string(msg) != "fresh" {
+		t.Errorf("got %q want fresh", msg)
+	}
+	if _, err := a.Add([]byte("chunk 10 2 2 x")); err == nil {
+		t.Error("expected error for chunk index out of range")
+	}
+	if wc.IsChunk([]byte(`{"ip":"192.168.0.2"}`)) {
+		t.Error("config detected as chunk")
+	}
+}
+
+func TestAnalyzeRoutes(t *testing.T) {
+	for _, tc := range []struct {
+		routes    []string
+		clientNet string
+	}{
+		{[]string{"10.0.0.0/33"}, "192.168.0.0/24"},
+		{[]string{"10.0.0.1"}, "192.168.0.0/24"},
+		{[]string{"fd00::/8"}, "192.168.0.0/24"},
+		{[]string{"10.0.0.0/8"}, "192.168.0/24"},
+	} {
+		if _, _, err := parseRoutes(tc.routes, tc.clientNet); err == nil {
+			t.Errorf("parseRoutes(%v, %v) expected error", tc.routes, tc.clientNet)
+		}
+	}
+
+	routeNets, clientNet, err := parseRoutes([]string{"192.168.0.0/16", "172.16.0.0/24", "172.16.0.128/25"}, "192.168.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, mgmt, _ := net.ParseCIDR("172.16.0.0/20")
+	a := analyzeRoutes(routeNets, clientNet, []*net.IPNet{mgmt})
+	want := []string{
+		"route 192.168.0.0/16 overlaps client network 192.168.1.0/24",
+		"route 172.16.0.0/24 overlaps management network 172.16.0.0/20",
+		"route 172.16.0.128/25 overlaps management network 172.16.0.0/20",
+		"route 172.16.0.0/24 overlaps route 172.16.0.128/25",
+	}
+	if !reflect.DeepEqual(a.Warnings, want) {
+		t.Errorf("Got warnings %q want %q", a.Warnings, want)
+	}
+	if !reflect.DeepEqual(a.Advertised, []string{"172.16.0.0/24", "192.168.0.0/16"}) {
+		t.Errorf("Got advertised routes %v", a.Advertised)
+	}
+}
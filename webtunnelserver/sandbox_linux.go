@@ -0,0 +1,179 @@
+//go:build amd64 || arm64
+
+package webtunnelserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/golang/glog"
+)
+
+const (
+	prSetNoNewPrivs = 38
+	oPath           = 0x200000 // O_PATH, same on amd64 and arm64
+
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTSync = 1
+	seccompRetKillProcess  = 0x80000000
+	seccompRetErrno        = 0x00050000
+	seccompRetLog          = 0x7ffc0000
+	seccompRetAllow        = 0x7fff0000
+
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+	landlockRulePathBeneath  = 1
+
+	// Landlock ABI v1 filesystem access rights.
+	landlockAccessFSExecute  = 1 << 0
+	landlockAccessFSReadFile = 1 << 2
+	landlockAccessFSReadDir  = 1 << 3
+	landlockAccessFSAll      = 1<<13 - 1
+)
+
+// SandboxOptions configures the restrictions applied by ApplySandbox.
+type SandboxOptions struct {
+	Seccomp       bool     // Restrict syscalls to those needed by the packet loops.
+	SeccompAction string   // Action on other syscalls: "errno" (default), "kill" or "log".
+	Landlock      bool     // Restrict filesystem access to the paths below.
+	ReadPaths     []string // Paths allowed read only access with Landlock.
+	WritePaths    []string // Paths allowed read write access with Landlock (eg. log dir).
+}
+
+// ApplySandbox restricts the server process after initialization, reducing the blast
+// radius of a bug in the packet path. It must be called after the TUN interface is set up,
+// the server socket is bound (see Listen) and privileges are dropped, and applies to all
+// threads of the process. Restrictions cannot be lifted.
+func ApplySandbox(opts SandboxOptions) error {
+	if !opts.Seccomp && !opts.Landlock {
+		return nil
+	}
+	if _, _, e := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); e != 0 {
+		return fmt.Errorf("error setting no_new_privs %w", e)
+	}
+	if opts.Landlock {
+		if err := applyLandlock(opts.ReadPaths, opts.WritePaths); err != nil {
+			return err
+		}
+		glog.Info("Landlock filesystem restrictions applied")
+	}
+	if opts.Seccomp {
+		if err := applySeccomp(opts.SeccompAction); err != nil {
+			return err
+		}
+		glog.Info("Seccomp syscall filter applied")
+	}
+	return nil
+}
+
+// applyLandlock denies filesystem access except below the given paths.
+func applyLandlock(readPaths, writePaths []string) error {
+	handled := uint64(landlockAccessFSAll)
+	ruleset, _, e := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&handled)), unsafe.Sizeof(handled), 0)
+	if e != 0 {
+		return fmt.Errorf("landlock not supported %w", e)
+	}
+	defer syscall.Close(int(ruleset))
+
+	addRule := func(path string, access uint64) error {
+		fd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("error opening %v %w", path, err)
+		}
+		defer syscall.Close(fd)
+		// struct landlock_path_beneath_attr is packed: u64 allowed_access, s32 parent_fd.
+		var attr [12]byte
+		binary.LittleEndian.PutUint64(attr[0:], access)
+		binary.LittleEndian.PutUint32(attr[8:], uint32(fd))
+		if _, _, e := syscall.Syscall6(sysLandlockAddRule, ruleset, landlockRulePathBeneath,
+			uintptr(unsafe.Pointer(&attr[0])), 0, 0, 0); e != 0 {
+			return fmt.Errorf("error adding landlock rule for %v %s", path, e)
+		}
+		return nil
+	}
+	for _, p := range readPaths {
+		if err := addRule(p, landlockAccessFSReadFile|landlockAccessFSReadDir); err != nil {
+			return err
+		}
+	}
+	for _, p := range writePaths {
+		if err := addRule(p, landlockAccessFSAll&^landlockAccessFSExecute); err != nil {
+			return err
+		}
+	}
+
+	if _, _, e := syscall.AllThreadsSyscall(sysLandlockRestrictSelf, ruleset, 0, 0); e != 0 {
+		return fmt.Errorf("error applying landlock %w", e)
+	}
+	return nil
+}
+
+// applySeccomp installs a seccomp-bpf allow list filter on all threads.
+func applySeccomp(action string) error {
+	var defaultAction uint32
+	switch action {
+	case "", "errno":
+		defaultAction = seccompRetErrno | uint32(syscall.EPERM)
+	case "kill":
+		defaultAction = seccompRetKillProcess
+	case "log":
+		defaultAction = seccompRetLog
+	default:
+		return fmt.Errorf("unknown seccomp action %v", action)
+	}
+
+	stmt := func(code uint16, k uint32) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, K: k}
+	}
+	jeq := func(k uint32, jt, jf uint8) syscall.SockFilter {
+		return syscall.SockFilter{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: jt, Jf: jf, K: k}
+	}
+
+	// struct seccomp_data: int nr; __u32 arch; ...
+	filter := []syscall.SockFilter{
+		stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, 4),
+		jeq(auditArch, 1, 0),
+		stmt(syscall.BPF_RET|syscall.BPF_K, seccompRetKillProcess),
+		stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, 0),
+	}
+	for _, nr := range append(commonSyscalls, archSyscalls...) {
+		filter = append(filter, jeq(uint32(nr), 0, 1), stmt(syscall.BPF_RET|syscall.BPF_K, seccompRetAllow))
+	}
+	filter = append(filter, stmt(syscall.BPF_RET|syscall.BPF_K, defaultAction))
+
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if _, _, e := syscall.RawSyscall(sysSeccomp, seccompSetModeFilter, seccompFilterFlagTSync, uintptr(unsafe.Pointer(&prog))); e != 0 {
+		return fmt.Errorf("error applying seccomp filter %w", e)
+	}
+	return nil
+}
+
+// commonSyscalls are needed by the Go runtime, networking and the packet loops.
+var commonSyscalls = []uintptr{
+	syscall.SYS_READ, syscall.SYS_WRITE, syscall.SYS_CLOSE, syscall.SYS_FSTAT, syscall.SYS_LSEEK,
+	syscall.SYS_MMAP, syscall.SYS_MPROTECT, syscall.SYS_MUNMAP, syscall.SYS_BRK, syscall.SYS_MADVISE,
+	syscall.SYS_MREMAP, syscall.SYS_MINCORE, syscall.SYS_RT_SIGACTION, syscall.SYS_RT_SIGPROCMASK,
+	syscall.SYS_RT_SIGRETURN, syscall.SYS_SIGALTSTACK, syscall.SYS_IOCTL, syscall.SYS_PREAD64,
+	syscall.SYS_PWRITE64, syscall.SYS_READV, syscall.SYS_WRITEV, syscall.SYS_SCHED_YIELD,
+	syscall.SYS_SCHED_GETAFFINITY, syscall.SYS_DUP, syscall.SYS_DUP3, syscall.SYS_NANOSLEEP,
+	syscall.SYS_CLOCK_GETTIME, syscall.SYS_CLOCK_NANOSLEEP, syscall.SYS_GETPID, syscall.SYS_GETTID,
+	syscall.SYS_TGKILL, syscall.SYS_KILL, syscall.SYS_SOCKET, syscall.SYS_CONNECT, syscall.SYS_ACCEPT,
+	syscall.SYS_ACCEPT4, syscall.SYS_SENDTO, syscall.SYS_RECVFROM, syscall.SYS_SENDMSG,
+	syscall.SYS_RECVMSG, syscall.SYS_SHUTDOWN, syscall.SYS_BIND, syscall.SYS_LISTEN,
+	syscall.SYS_GETSOCKNAME, syscall.SYS_GETPEERNAME, syscall.SYS_SETSOCKOPT, syscall.SYS_GETSOCKOPT,
+	syscall.SYS_CLONE, syscall.SYS_EXIT, syscall.SYS_EXIT_GROUP, syscall.SYS_WAIT4, syscall.SYS_UNAME,
+	syscall.SYS_FCNTL, syscall.SYS_FSYNC, syscall.SYS_GETDENTS64, syscall.SYS_GETCWD,
+	syscall.SYS_FUTEX, syscall.SYS_SET_ROBUST_LIST, syscall.SYS_EPOLL_CREATE1, syscall.SYS_EPOLL_CTL,
+	syscall.SYS_EPOLL_PWAIT, syscall.SYS_OPENAT, syscall.SYS_PIPE2, syscall.SYS_EVENTFD2,
+	syscall.SYS_PRLIMIT64, syscall.SYS_RESTART_SYSCALL, syscall.SYS_GETUID, syscall.SYS_GETEUID,
+	syscall.SYS_GETGID, syscall.SYS_GETEGID, syscall.SYS_FACCESSAT, syscall.SYS_READLINKAT,
+	syscall.SYS_TIMER_CREATE, syscall.SYS_TIMER_SETTIME, syscall.SYS_TIMER_DELETE,
+	syscall.SYS_SETITIMER, syscall.SYS_PRCTL, syscall.SYS_RT_SIGTIMEDWAIT, syscall.SYS_UNLINKAT,
+	syscall.SYS_RENAMEAT, syscall.SYS_MKDIRAT, syscall.SYS_FCHMOD, syscall.SYS_FTRUNCATE,
+}
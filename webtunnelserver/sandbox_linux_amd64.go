@@ -0,0 +1,20 @@
+package webtunnelserver
+
+import "syscall"
+
+const (
+	auditArch  = 0xc000003e // AUDIT_ARCH_X86_64
+	sysSeccomp = 317
+)
+
+// archSyscalls are the amd64 specific syscalls of the seccomp allow list.
+var archSyscalls = []uintptr{
+	syscall.SYS_ARCH_PRCTL, syscall.SYS_EPOLL_WAIT, syscall.SYS_POLL, syscall.SYS_SELECT,
+	syscall.SYS_OPEN, syscall.SYS_STAT, syscall.SYS_LSTAT, syscall.SYS_NEWFSTATAT,
+	syscall.SYS_READLINK, syscall.SYS_DUP2, syscall.SYS_PIPE, syscall.SYS_TIME,
+	318, // getrandom
+	332, // statx
+	334, // rseq
+	435, // clone3
+	441, // epoll_pwait2
+}
@@ -0,0 +1,17 @@
+package webtunnelserver
+
+import "syscall"
+
+const (
+	auditArch  = 0xc00000b7 // AUDIT_ARCH_AARCH64
+	sysSeccomp = 277
+)
+
+// archSyscalls are the arm64 specific syscalls of the seccomp allow list.
+var archSyscalls = []uintptr{
+	syscall.SYS_FSTATAT, syscall.SYS_GETRANDOM, syscall.SYS_PPOLL, syscall.SYS_PSELECT6,
+	291, // statx
+	293, // rseq
+	435, // clone3
+	441, // epoll_pwait2
+}
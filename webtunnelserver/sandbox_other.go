@@ -0,0 +1,22 @@
+//go:build !linux || (!amd64 && !arm64)
+
+package webtunnelserver
+
+import "fmt"
+
+// SandboxOptions configures the restrictions applied by ApplySandbox.
+type SandboxOptions struct {
+	Seccomp       bool     // Restrict syscalls to those needed by the packet loops.
+	SeccompAction string   // Action on other syscalls: "errno" (default), "kill" or "log".
+	Landlock      bool     // Restrict filesystem access to the paths below.
+	ReadPaths     []string // Paths allowed read only access with Landlock.
+	WritePaths    []string // Paths allowed read write access with Landlock (eg. log dir).
+}
+
+// ApplySandbox is only supported on linux amd64 and arm64.
+func ApplySandbox(opts SandboxOptions) error {
+	if !opts.Seccomp && !opts.Landlock {
+		return nil
+	}
+	return fmt.Errorf("sandbox not supported on this platform")
+}
@@ -0,0 +1,118 @@
+package webtunnelserver
+
+import (
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// Interval between access window checks of connected clients.
+const defaultScheduleInterval = time.Minute
+
+// Close reason sent to clients outside their access window.
+const closeReasonOutsideWindow = "outside access window"
+
+// AccessWindow is a recurring time of day range in which access is allowed.
+type AccessWindow struct {
+	Days     []time.Weekday // Days the window starts on, empty for every day.
+	Start    time.Duration  // Start as offset from midnight.
+	End      time.Duration  // End as offset from midnight. If before Start the window spans midnight.
+	Location *time.Location // Time zone of the window, nil for local time.
+}
+
+// Contains returns true if t is inside the window.
+func (a AccessWindow) Contains(t time.Time) bool {
+	if a.Location != nil {
+		t = t.In(a.Location)
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	if a.Start <= a.End {
+		return a.onDay(t.Weekday()) && offset >= a.Start && offset < a.End
+	}
+	// Window spanning midnight: late part of today or early part of a window started yesterday.
+	if offset >= a.Start {
+		return a.onDay(t.Weekday())
+	}
+	return offset < a.End && a.onDay((t.Weekday()+6)%7)
+}
+
+// onDay returns true if the window starts on day d.
+func (a AccessWindow) onDay(d time.Weekday) bool {
+	if len(a.Days) == 0 {
+		return true
+	}
+	for _, v := range a.Days {
+		if v == d {
+			return true
+		}
+	}
+	return false
+}
+
+// AccessSchedule returns the access windows of a user, eg. by looking up the groups of
+// username. No windows means access is not restricted.
+type AccessSchedule func(username, hostname string) []AccessWindow
+
+// SetAccessSchedule restricts clients to their access windows. Connections outside a window
+// are refused and connected clients are disconnected when their window ends, with the close
+// reason "outside access window". This should be called prior to Start.
+func (r *WebTunnelServer) SetAccessSchedule(s AccessSchedule) {
+	r.schedule = s
+}
+
+// inAccessWindow returns true if username may connect at t.
+func (r *WebTunnelServer) inAccessWindow(username, hostname string, t time.Time) bool {
+	if r.schedule == nil {
+		return true
+	}
+	windows := r.schedule(username, hostname)
+	if len(windows) == 0 {
+		return true
+	}
+	for _, w := range windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// closeOutsideWindow disconnects a client with the access window close reason.
+func closeOutsideWindow(ws *wc.WSWriter, id string) {
+	ws.WriteControlMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, withSessionID(closeReasonOutsideWindow, id)))
+	ws.Conn().Close()
+}
+
+// processAccessSchedule disconnects clients whose access window has ended.
+func (r *WebTunnelServer) processAccessSchedule() {
+	if r.schedule == nil {
+		return
+	}
+	for {
+		if r.isStopped.Load() {
+			glog.V(1).Info("Exiting access schedule routine")
+			return
+		}
+		now := time.Now()
+		for ip, u := range r.ipam.DumpAllocations() {
+			if r.inAccessWindow(u.Username, u.Hostname, now) {
+				continue
+			}
+			data, err := r.ipam.GetData(ip)
+			if err != nil {
+				continue
+			}
+			ws, ok := data.(*wc.WSWriter)
+			if !ok {
+				continue
+			}
+			glog.Infof("Disconnecting %s@%s on %v outside access window", u.Username, u.Hostname, ip)
+			closeOutsideWindow(ws, r.sessionID(ip))
+		}
+		time.Sleep(defaultScheduleInterval)
+	}
+}
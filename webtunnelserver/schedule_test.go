@@ -0,0 +1,55 @@
+package webtunnelserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccessWindow(t *testing.T) {
+	// Monday 2021-01-04.
+	at := func(day, hour int) time.Time { return time.Date(2021, 1, 3+day, hour, 30, 0, 0, time.UTC) }
+	officeHours := AccessWindow{
+		Days:     []time.Weekday{time.Monday, time.Tuesday},
+		Start:    9 * time.Hour,
+		End:      17 * time.Hour,
+		Location: time.UTC,
+	}
+	nightShift := AccessWindow{Start: 22 * time.Hour, End: 6 * time.Hour, Days: []time.Weekday{time.Monday}, Location: time.UTC}
+
+	testCases := []struct {
+		w    AccessWindow
+		t    time.Time
+		want bool
+	}{
+		{officeHours, at(1, 10), true},  // Monday morning.
+		{officeHours, at(1, 8), false},  // Before start.
+		{officeHours, at(1, 17), false}, // After end.
+		{officeHours, at(3, 10), false}, // Wednesday.
+		{nightShift, at(1, 23), true},   // Monday night.
+		{nightShift, at(2, 5), true},    // Early Tuesday, window started Monday.
+		{nightShift, at(3, 5), false},   // Early Wednesday, no window Tuesday.
+		{nightShift, at(2, 12), false},  // Tuesday noon.
+	}
+	for _, tc := range testCases {
+		if v := tc.w.Contains(tc.t); v != tc.want {
+			t.Errorf("Contains(%v) expected %v, got %v", tc.t, tc.want, v)
+		}
+	}
+
+	r := &WebTunnelServer{}
+	if !r.inAccessWindow("contractor", "laptop", at(3, 10)) {
+		t.Error("Expected access without schedule")
+	}
+	r.SetAccessSchedule(func(username, hostname string) []AccessWindow {
+		if username == "contractor" {
+			return []AccessWindow{officeHours}
+		}
+		return nil
+	})
+	if r.inAccessWindow("contractor", "laptop", at(3, 10)) {
+		t.Error("Expected contractor refused outside window")
+	}
+	if !r.inAccessWindow("staff", "laptop", at(3, 10)) {
+		t.Error("Expected unrestricted user allowed")
+	}
+}
@@ -0,0 +1,73 @@
+package webtunnelserver
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// newSessionID returns a random (version 4) UUID.
+func newSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// withSessionID appends the session ID to a close reason so the client can report it.
+func withSessionID(reason, id string) string {
+	if id == "" {
+		return reason
+	}
+	return reason + " (session " + id + ")"
+}
+
+// setSessionID records the session ID of the connection on ip.
+func (r *WebTunnelServer) setSessionID(ip, id string) {
+	r.connMapLock.Lock()
+	defer r.connMapLock.Unlock()
+	if r.sessionIDs == nil {
+		r.sessionIDs = make(map[string]string)
+	}
+	r.sessionIDs[ip] = id
+}
+
+// sessionID returns the session ID of the connection on ip, empty if unknown.
+func (r *WebTunnelServer) sessionID(ip string) string {
+	r.connMapLock.Lock()
+	defer r.connMapLock.Unlock()
+	return r.sessionIDs[ip]
+}
+
+// SessionID returns the ID the session on ip is logged under. The ID is given to the
+// client in the handshake, its config and close reasons.
+func (r *WebTunnelServer) SessionID(ip string) (string, error) {
+	if id := r.sessionID(ip); id != "" {
+		return id, nil
+	}
+	return "", fmt.Errorf("no session on %v", ip)
+}
+
+// FindSessionID returns the IP of the session with ID id, eg. reported by a user.
+func (r *WebTunnelServer) FindSessionID(id string) (string, bool) {
+	r.connMapLock.Lock()
+	defer r.connMapLock.Unlock()
+	for ip, sid := range r.sessionIDs {
+		if sid == id {
+			return ip, true
+		}
+	}
+	return "", false
+}
+
+// sessionIDSnapshot returns the session IDs keyed by client IP. It must not be called
+// with metricsLock held.
+func (r *WebTunnelServer) sessionIDSnapshot() map[string]string {
+	r.connMapLock.Lock()
+	defer r.connMapLock.Unlock()
+	m := make(map[string]string)
+	for ip, id := range r.sessionIDs {
+		m[ip] = id
+	}
+	return m
+}
@@ -0,0 +1,66 @@
+package webtunnelserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/gorilla/websocket"
+)
+
+func TestSessionID(t *testing.T) {
+	r, err := NewWebTunnelServer("127.0.0.1:0", "192.168.0.1", "255.255.255.0", "192.168.0.0/24",
+		nil, []string{"1.1.1.0/24"}, false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan IPEvent, 10)
+	r.AddIPEventListener(func(ev IPEvent) { events <- ev })
+	srv := httptest.NewServer(http.HandlerFunc(r.wsEndpoint))
+	defer srv.Close()
+
+	c, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	id := resp.Header.Get(wc.SessionIDHeader)
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Fatalf("Expected UUID session ID, got %q", id)
+	}
+	c.WriteMessage(websocket.TextMessage, []byte("getConfig user host"))
+	cfg := &wc.ClientConfig{}
+	if err := c.ReadJSON(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ServerInfo.SessionID != id {
+		t.Errorf("Expected session ID %v in config, got %v", id, cfg.ServerInfo.SessionID)
+	}
+	if ev := <-events; ev.SessionID != id {
+		t.Errorf("Expected session ID %v in IP event, got %+v", id, ev)
+	}
+	if got, err := r.SessionID(cfg.IP); err != nil || got != id {
+		t.Errorf("Expected session ID %v, got %v %v", id, got, err)
+	}
+	if ip, ok := r.FindSessionID(id); !ok || ip != cfg.IP {
+		t.Errorf("Expected session %v on %v, got %v", id, cfg.IP, ip)
+	}
+	if m := r.GetMetrics(); m.SessionIDs[cfg.IP] != id {
+		t.Errorf("Expected session ID in metrics, got %v", m.SessionIDs)
+	}
+
+	// Close reasons carry the session ID.
+	r.SetBanPolicy(BanPolicy{})
+	r.Ban("user", "test", time.Minute)
+	_, _, err = c.ReadMessage()
+	if ce, ok := err.(*websocket.CloseError); !ok || !strings.Contains(ce.Text, id) {
+		t.Errorf("Expected close reason with session ID, got %v", err)
+	}
+	if ev := <-events; ev.Type != IPReleased || ev.SessionID != id {
+		t.Errorf("Expected release with session ID %v, got %+v", id, ev)
+	}
+}
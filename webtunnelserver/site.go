@@ -0,0 +1,167 @@
+package webtunnelserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// SitePolicy returns true if the site gateway username@hostname may route prefix via its
+// session.
+type SitePolicy func(username, hostname string, prefix *net.IPNet) bool
+
+// siteToSite tracks the site gateways connected to the server.
+type siteToSite struct {
+	policy   SitePolicy           // Prefix policy.
+	deadPeer time.Duration        // Time without keepalive after which a peer is dead, 0 disables.
+	peers    map[string]time.Time // Last keepalive per site gateway IP.
+	lock     sync.Mutex
+}
+
+// SetSiteToSite accepts prefix advertisements from site gateway clients (see the client
+// SetSiteToSite). Prefixes allowed by policy are routed to the gateway session like client
+// subnets (see SetClientSubnets) and the server route prefixes are returned as the local
+// prefixes of the server. Site gateways are sent keepalives and those not answering for
+// deadPeer (0 disables) have their routes withdrawn and are disconnected. This should be
+// called prior to Start.
+func (r *WebTunnelServer) SetSiteToSite(policy SitePolicy, deadPeer time.Duration) error {
+	if policy == nil {
+		return fmt.Errorf("no site policy")
+	}
+	if deadPeer < 0 {
+		return fmt.Errorf("invalid dead peer interval %v", deadPeer)
+	}
+	r.site = &siteToSite{policy: policy, deadPeer: deadPeer, peers: make(map[string]time.Time)}
+	return nil
+}
+
+// processSiteAdvert routes the prefixes advertised by the site gateway on ip and responds
+// with the accepted prefixes and the local prefixes of the server.
+func (r *WebTunnelServer) processSiteAdvert(ws *wc.WSWriter, ip string, msg []byte) {
+	advert := &wc.SiteAdvert{}
+	if err := wc.DecodeControl(ws.Codec(), msg, advert); err != nil {
+		glog.Warningf("invalid site advertisement from %v: %v", ip, err)
+		return
+	}
+	ack := &wc.SiteAck{Prefixes: r.routePrefix}
+	u, err := r.ipam.GetUserinfo(ip)
+	if r.site == nil || err != nil || r.IsQuarantined(ip) {
+		// Site-to-site disabled or the client has no config yet.
+		ack.Rejected = advert.Prefixes
+		ack.Prefixes = nil
+	} else {
+		for _, p := range advert.Prefixes {
+			_, n, err := net.ParseCIDR(p)
+			switch {
+			case err != nil || n.IP.To4() == nil:
+				err = fmt.Errorf("invalid prefix %q", p)
+			case !r.site.policy(u.Username, u.Hostname, n):
+				err = fmt.Errorf("prefix %v not allowed by policy", n)
+			default:
+				err = r.routeSubnet(ip, n)
+			}
+			if err != nil {
+				glog.Warningf("site prefix of %s@%s refused: %v", u.Username, u.Hostname, err)
+				ack.Rejected = append(ack.Rejected, p)
+				continue
+			}
+			ack.Accepted = append(ack.Accepted, n.String())
+		}
+		r.site.lock.Lock()
+		r.site.peers[ip] = time.Now()
+		r.site.lock.Unlock()
+		glog.Infof("Site gateway %s@%s on %v routes %v", u.Username, u.Hostname, ip, ack.Accepted)
+	}
+	b, err := wc.EncodeControl(ws.Codec(), ack)
+	if err != nil {
+		glog.Warningf("error encoding site ack: %v", err)
+		return
+	}
+	if err := ws.WriteControlMessage(websocket.TextMessage, append([]byte(wc.SiteAckPrefix), b...)); err != nil {
+		glog.Warningf("error sending site ack to %v: %v", ip, err)
+	}
+}
+
+// siteAlive records a keepalive answer from ip.
+func (r *WebTunnelServer) siteAlive(ip string) {
+	if r.site == nil {
+		return
+	}
+	r.site.lock.Lock()
+	defer r.site.lock.Unlock()
+	if _, ok := r.site.peers[ip]; ok {
+		r.site.peers[ip] = time.Now()
+	}
+}
+
+// releaseSitePeer stops tracking the site gateway on ip.
+func (r *WebTunnelServer) releaseSitePeer(ip string) {
+	if r.site == nil {
+		return
+	}
+	r.site.lock.Lock()
+	delete(r.site.peers, ip)
+	r.site.lock.Unlock()
+}
+
+// deadSitePeers returns and stops tracking the site gateways without keepalive answers
+// since deadPeer before now.
+func (r *WebTunnelServer) deadSitePeers(now time.Time) (dead, alive []string) {
+	r.site.lock.Lock()
+	defer r.site.lock.Unlock()
+	for ip, last := range r.site.peers {
+		if now.Sub(last) > r.site.deadPeer {
+			delete(r.site.peers, ip)
+			dead = append(dead, ip)
+			continue
+		}
+		alive = append(alive, ip)
+	}
+	return dead, alive
+}
+
+// processSitePeers sends keepalives to site gateways and withdraws the routes of dead ones.
+func (r *WebTunnelServer) processSitePeers() {
+	if r.site == nil || r.site.deadPeer == 0 {
+		return
+	}
+	interval := r.site.deadPeer / 3
+	for {
+		time.Sleep(interval)
+		if r.isStopped.Load() {
+			glog.V(1).Info("Exiting site peer routine")
+			return
+		}
+		dead, alive := r.deadSitePeers(time.Now())
+		for _, ip := range dead {
+			glog.Warningf("Site gateway on %v is dead, withdrawing its routes", ip)
+			r.releaseClientSubnets(ip)
+			if data, err := r.ipam.GetData(ip); err == nil {
+				if ws, ok := data.(*wc.WSWriter); ok {
+					ws.Conn().Close()
+				}
+			}
+		}
+		for _, ip := range alive {
+			data, err := r.ipam.GetData(ip)
+			if err != nil {
+				continue
+			}
+			ws, ok := data.(*wc.WSWriter)
+			if !ok {
+				continue
+			}
+			buf := make([]byte, binary.MaxVarintLen64)
+			binary.PutVarint(buf, time.Now().UTC().UnixNano())
+			if err := ws.Conn().WriteControl(websocket.PingMessage, buf, time.Now().Add(interval)); err != nil {
+				glog.Warningf("issue sending keepalive to site gateway %v: %v", ip, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package webtunnelserver
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepakkamesh/webtunnel/mocks"
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/mock/gomock"
+	"github.com/gorilla/websocket"
+)
+
+func TestSiteToSite(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIfce := mocks.NewMockInterface(mockCtrl)
+	mockIfce.EXPECT().Name().Return("tun0").AnyTimes()
+
+	routes := map[string]bool{}
+	defer func(add, del func(string, string) error) { AddTunnelRoute, DeleteTunnelRoute = add, del }(AddTunnelRoute, DeleteTunnelRoute)
+	AddTunnelRoute = func(ifce, subnet string) error {
+		routes[subnet] = true
+		return nil
+	}
+	DeleteTunnelRoute = func(ifce, subnet string) error {
+		delete(routes, subnet)
+		return nil
+	}
+
+	ws, client := wsPair(t)
+	defer ws.Close()
+	defer client.Close()
+
+	ipam, _ := NewIPPam("192.168.0.0/24")
+	ip, _ := ipam.AcquireIP(ws)
+	r := &WebTunnelServer{ifce: mockIfce, ipam: ipam, clientNetPrefix: "192.168.0.0/24", routePrefix: []string{"172.16.0.0/16"}}
+
+	readAck := func() *wc.SiteAck {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, msg, err := client.ReadMessage()
+		if err != nil || !bytes.HasPrefix(msg, []byte(wc.SiteAckPrefix)) {
+			t.Fatalf("Expected site ack, got %q %v", msg, err)
+		}
+		ack := &wc.SiteAck{}
+		if err := wc.DecodeControl(ws.Codec(), msg[len(wc.SiteAckPrefix):], ack); err != nil {
+			t.Fatalf("Invalid ack: %v", err)
+		}
+		return ack
+	}
+	advert, _ := wc.EncodeControl(ws.Codec(), &wc.SiteAdvert{Prefixes: []string{"10.1.0.0/16", "10.9.0.0/16", "192.168.0.128/25", "bogus"}})
+
+	// Site-to-site disabled.
+	r.processSiteAdvert(ws, ip, advert)
+	if ack := readAck(); len(ack.Accepted) != 0 || len(ack.Rejected) != 4 || ack.Prefixes != nil {
+		t.Errorf("Expected all prefixes rejected, got %+v", ack)
+	}
+
+	r.SetSiteToSite(func(username, hostname string, prefix *net.IPNet) bool {
+		return hostname == "branch" && prefix.String() != "10.9.0.0/16"
+	}, 30*time.Millisecond)
+	ipam.SetIPActiveWithUserInfo(ip, "router", "branch")
+	r.processSiteAdvert(ws, ip, advert)
+	ack := readAck()
+	if !reflect.DeepEqual(ack.Accepted, []string{"10.1.0.0/16"}) || len(ack.Rejected) != 3 {
+		t.Errorf("Unexpected accepted %v rejected %v", ack.Accepted, ack.Rejected)
+	}
+	if !reflect.DeepEqual(ack.Prefixes, []string{"172.16.0.0/16"}) {
+		t.Errorf("Expected server prefixes, got %v", ack.Prefixes)
+	}
+	if !routes["10.1.0.0/16"] || len(routes) != 1 {
+		t.Errorf("Expected site prefix routed, got %v", routes)
+	}
+
+	// Keepalive answers keep the peer alive, silence kills it.
+	now := time.Now()
+	r.siteAlive(ip)
+	if dead, alive := r.deadSitePeers(now.Add(10 * time.Millisecond)); len(dead) != 0 || len(alive) != 1 {
+		t.Errorf("Expected peer alive, got dead %v alive %v", dead, alive)
+	}
+	if dead, _ := r.deadSitePeers(now.Add(time.Second)); !reflect.DeepEqual(dead, []string{ip}) {
+		t.Errorf("Expected peer %v dead, got %v", ip, dead)
+	}
+	if dead, alive := r.deadSitePeers(now.Add(time.Second)); len(dead)+len(alive) != 0 {
+		t.Error("Expected dead peer no longer tracked")
+	}
+}
+
+// wsPair returns the server writer and the client end of a websocket connection.
+func wsPair(t *testing.T) (*wc.WSWriter, *websocket.Conn) {
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		c, err := (&websocket.Upgrader{}).Upgrade(rw, req, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %v", err)
+			return
+		}
+		conns <- c
+	}))
+	t.Cleanup(srv.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	return wc.NewWSWriter(<-conns, nil), client
+}
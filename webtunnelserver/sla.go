@@ -0,0 +1,298 @@
+package webtunnelserver
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SLAReconnectWindow (Overridable) Time after an unplanned disconnect counted as downtime
+// while the client reconnects. Clients back later are assumed to have gone offline.
+var SLAReconnectWindow = 5 * time.Minute
+
+// SLAWeeks (Overridable) Number of weekly summaries kept, including the current week.
+var SLAWeeks = 12
+
+// SLAGrouping selects what SLA summaries are computed for.
+type SLAGrouping string
+
+const (
+	SLAByUser    SLAGrouping = "user"    // Per authenticated or claimed username.
+	SLAByNetwork SLAGrouping = "network" // Per remote network of the clients (IPv4 /24, IPv6 /48).
+)
+
+// SLASummary is the tunnel reliability of a user or network over a week.
+type SLASummary struct {
+	Key          string        `json:"key"`          // Username or remote network.
+	Week         time.Time     `json:"week"`         // Start of the week, Monday 00:00 UTC.
+	Sessions     int           `json:"sessions"`     // Connections established.
+	Reconnects   int           `json:"reconnects"`   // Unplanned disconnects, ie. not closed by the client.
+	Connected    time.Duration `json:"connected"`    // Time connected.
+	Downtime     time.Duration `json:"downtime"`     // Time reconnecting after unplanned disconnects, up to SLAReconnectWindow each.
+	Availability float64       `json:"availability"` // Connected time over connected and down time, 1 if neither.
+	MTBD         time.Duration `json:"mtbd"`         // Mean connected time between unplanned disconnects, 0 if none.
+}
+
+// slaConn is an open connection tracked for SLA reporting.
+type slaConn struct {
+	user    string
+	network string
+	since   time.Time // Start of the span not accounted yet.
+}
+
+// slaKey identifies a weekly summary.
+type slaKey struct {
+	by   SLAGrouping
+	key  string
+	week time.Time
+}
+
+// slaTracker accounts the connected and down time of clients.
+type slaTracker struct {
+	conns map[string]*slaConn    // Open connections by client IP.
+	down  map[slaKey]time.Time   // Unplanned disconnects awaiting a reconnect, week unset.
+	weeks map[slaKey]*SLASummary // Weekly summaries.
+	lock  sync.Mutex
+}
+
+/*
+SetSLATracking accounts the connected time, unplanned disconnects and reconnect downtime
+of clients per user and remote network, summarized weekly by SLAReport. A disconnect is
+unplanned unless the client closed the websocket; the time until the client of the same
+user or network reconnects, up to SLAReconnectWindow, counts as downtime. This should be
+called prior to Start.
+*/
+func (r *WebTunnelServer) SetSLATracking() {
+	r.sla = &slaTracker{
+		conns: make(map[string]*slaConn),
+		down:  make(map[slaKey]time.Time),
+		weeks: make(map[slaKey]*SLASummary),
+	}
+	r.ipam.AddListener(func(ev IPEvent) {
+		switch ev.Type {
+		case IPAssigned:
+			r.sla.connect(ev.IP, ev.Username, ev.Time)
+		case IPReleased:
+			// Released without a disconnect, eg. moved to a new IP.
+			r.sla.disconnect(ev.IP, true, ev.Time)
+		}
+	})
+}
+
+// SLAReport returns the weekly summaries grouped by by, latest week first, including the
+// time of the connections still open.
+func (r *WebTunnelServer) SLAReport(by SLAGrouping) ([]SLASummary, error) {
+	if r.sla == nil {
+		return nil, fmt.Errorf("SLA tracking disabled")
+	}
+	if by != SLAByUser && by != SLAByNetwork {
+		return nil, fmt.Errorf("invalid SLA grouping %q", by)
+	}
+	return r.sla.report(by, time.Now()), nil
+}
+
+// slaRemote records the remote address of the connection of the client on ip.
+func (r *WebTunnelServer) slaRemote(ip, remote string) {
+	if r.sla == nil {
+		return
+	}
+	r.sla.lock.Lock()
+	defer r.sla.lock.Unlock()
+	if c, ok := r.sla.conns[ip]; ok {
+		c.network = remoteNetwork(remote)
+		return
+	}
+	// The IP is assigned after the handshake.
+	r.sla.conns[ip] = &slaConn{network: remoteNetwork(remote)}
+}
+
+// slaDisconnect records the end of the connection of the client on ip. planned is true if
+// the client closed it.
+func (r *WebTunnelServer) slaDisconnect(ip string, planned bool) {
+	if r.sla != nil {
+		r.sla.disconnect(ip, planned, time.Now())
+	}
+}
+
+// connect opens the connection of user on ip at now, ending the downtime of its user
+// and network.
+func (t *slaTracker) connect(ip, user string, now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	c, ok := t.conns[ip]
+	if !ok || !c.since.IsZero() {
+		c = &slaConn{}
+		t.conns[ip] = c
+	}
+	c.user, c.since = user, now
+	for _, k := range c.keys() {
+		if d, ok := t.down[k]; ok {
+			t.addDowntime(k, d, now)
+			delete(t.down, k)
+		}
+		t.summary(k, now).Sessions++
+	}
+}
+
+// disconnect closes the connection on ip at now.
+func (t *slaTracker) disconnect(ip string, planned bool, now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	c, ok := t.conns[ip]
+	if !ok {
+		return
+	}
+	delete(t.conns, ip)
+	if c.since.IsZero() {
+		return
+	}
+	for _, k := range c.keys() {
+		t.addSpan(k, c.since, now, func(s *SLASummary, d time.Duration) { s.Connected += d })
+		if !planned {
+			t.summary(k, now).Reconnects++
+			t.down[k] = now
+		}
+	}
+}
+
+// report returns the summaries grouped by by at now, latest week first.
+func (t *slaTracker) report(by SLAGrouping, now time.Time) []SLASummary {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	// Clients that did not reconnect in time are offline.
+	for k, d := range t.down {
+		if now.Sub(d) >= SLAReconnectWindow {
+			t.addDowntime(k, d, now)
+			delete(t.down, k)
+		}
+	}
+	t.prune(now)
+
+	sums := make(map[slaKey]SLASummary)
+	for k, s := range t.weeks {
+		if k.by == by {
+			sums[k] = *s
+		}
+	}
+	// Open connections count up to now without being accounted.
+	for _, c := range t.conns {
+		if c.since.IsZero() {
+			continue
+		}
+		for _, k := range c.keys() {
+			if k.by != by {
+				continue
+			}
+			forWeeks(c.since, now, func(week time.Time, d time.Duration) {
+				wk := slaKey{k.by, k.key, week}
+				s, ok := sums[wk]
+				if !ok {
+					s = SLASummary{Key: k.key, Week: week}
+				}
+				s.Connected += d
+				sums[wk] = s
+			})
+		}
+	}
+
+	var out []SLASummary
+	for _, s := range sums {
+		s.Availability = 1
+		if total := s.Connected + s.Downtime; total > 0 {
+			s.Availability = float64(s.Connected) / float64(total)
+		}
+		if s.Reconnects > 0 {
+			s.MTBD = s.Connected / time.Duration(s.Reconnects)
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Week.Equal(out[j].Week) {
+			return out[i].Week.After(out[j].Week)
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
+
+// keys returns the grouping keys of the connection with the week unset.
+func (c *slaConn) keys() []slaKey {
+	keys := []slaKey{{by: SLAByUser, key: c.user}}
+	if c.network != "" {
+		keys = append(keys, slaKey{by: SLAByNetwork, key: c.network})
+	}
+	return keys
+}
+
+// summary returns the summary of k for the week of t.
+func (t *slaTracker) summary(k slaKey, at time.Time) *SLASummary {
+	k.week = weekStart(at)
+	s, ok := t.weeks[k]
+	if !ok {
+		s = &SLASummary{Key: k.key, Week: k.week}
+		t.weeks[k] = s
+	}
+	return s
+}
+
+// addDowntime accounts the downtime of k after the unplanned disconnect at from, up to
+// SLAReconnectWindow.
+func (t *slaTracker) addDowntime(k slaKey, from, to time.Time) {
+	if to.Sub(from) > SLAReconnectWindow {
+		to = from.Add(SLAReconnectWindow)
+	}
+	t.addSpan(k, from, to, func(s *SLASummary, d time.Duration) { s.Downtime += d })
+}
+
+// addSpan adds the time from from to to, split by week, to the summaries of k with add.
+func (t *slaTracker) addSpan(k slaKey, from, to time.Time, add func(*SLASummary, time.Duration)) {
+	forWeeks(from, to, func(week time.Time, d time.Duration) {
+		add(t.summary(k, week), d)
+	})
+}
+
+// prune drops the summaries older than SLAWeeks.
+func (t *slaTracker) prune(now time.Time) {
+	oldest := weekStart(now).AddDate(0, 0, -7*(SLAWeeks-1))
+	for k := range t.weeks {
+		if k.week.Before(oldest) {
+			delete(t.weeks, k)
+		}
+	}
+}
+
+// forWeeks calls f with the start of each week from from to to and the time of the span
+// in it.
+func forWeeks(from, to time.Time, f func(week time.Time, d time.Duration)) {
+	for from.Before(to) {
+		week := weekStart(from)
+		end := week.AddDate(0, 0, 7)
+		if end.After(to) {
+			end = to
+		}
+		f(week, end.Sub(from))
+		from = end
+	}
+}
+
+// weekStart returns the start of the week of t, Monday 00:00 UTC.
+func weekStart(t time.Time) time.Time {
+	t = t.UTC()
+	day := (int(t.Weekday()) + 6) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-day, 0, 0, 0, 0, time.UTC)
+}
+
+// remoteNetwork returns the network of a remote host:port, the /24 of IPv4 addresses and
+// the /48 of IPv6 addresses.
+func remoteNetwork(remote string) string {
+	ip := net.ParseIP(remoteHost(remote))
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
@@ -0,0 +1,68 @@
+package webtunnelserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSLAReport(t *testing.T) {
+	ipam, _ := NewIPPam("192.168.0.0/24")
+	r := &WebTunnelServer{ipam: ipam}
+	if _, err := r.SLAReport(SLAByUser); err == nil {
+		t.Error("Expected error with tracking disabled")
+	}
+	r.SetSLATracking()
+	if _, err := r.SLAReport("device"); err == nil {
+		t.Error("Expected error for invalid grouping")
+	}
+
+	// Connections open on the handshake and are assigned on config.
+	ip, _ := ipam.AcquireIP(nil)
+	r.trackSession(ip, "203.0.113.7:5000")
+	ipam.SetIPActiveWithUserInfo(ip, "alice", "laptop")
+	if s, _ := r.SLAReport(SLAByNetwork); len(s) != 1 || s[0].Key != "203.0.113.0/24" || s[0].Sessions != 1 {
+		t.Errorf("Expected open session of the network, got %+v", s)
+	}
+	r.slaDisconnect(ip, true)
+
+	// Sunday 22:00 UTC, the week ends in two hours.
+	start := time.Date(2026, 10, 18, 22, 0, 0, 0, time.UTC)
+	sla := &slaTracker{conns: map[string]*slaConn{}, down: map[slaKey]time.Time{}, weeks: map[slaKey]*SLASummary{}}
+	sla.conns["192.168.0.2"] = &slaConn{network: "198.51.100.0/24"}
+	sla.connect("192.168.0.2", "bob", start)
+	// Drops after an hour and reconnects a minute later.
+	sla.disconnect("192.168.0.2", false, start.Add(time.Hour))
+	sla.connect("192.168.0.3", "bob", start.Add(time.Hour+time.Minute))
+	// Drops again over the week boundary and is back too late to count it all.
+	sla.disconnect("192.168.0.3", false, start.Add(119*time.Minute))
+	sla.connect("192.168.0.4", "bob", start.Add(3*time.Hour))
+	// Leaves on purpose.
+	sla.disconnect("192.168.0.4", true, start.Add(4*time.Hour))
+
+	got := sla.report(SLAByUser, start.Add(5*time.Hour))
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 weeks, got %+v", got)
+	}
+	want := []SLASummary{{
+		Key: "bob", Week: time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC), Sessions: 1,
+		Connected: time.Hour, Downtime: 4 * time.Minute,
+		Availability: float64(time.Hour) / float64(time.Hour+4*time.Minute),
+	}, {
+		Key: "bob", Week: time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC), Sessions: 2, Reconnects: 2,
+		Connected: 118 * time.Minute, Downtime: 2 * time.Minute, MTBD: 59 * time.Minute,
+		Availability: float64(118*time.Minute) / float64(120*time.Minute),
+	}}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Week %v: got %+v want %+v", i, got[i], want[i])
+		}
+	}
+	if n := sla.report(SLAByNetwork, start.Add(5*time.Hour)); len(n) != 1 || n[0].Key != "198.51.100.0/24" || n[0].Connected != time.Hour {
+		t.Errorf("Expected network of the first connection, got %+v", n)
+	}
+
+	// Old weeks are dropped.
+	if got := sla.report(SLAByUser, start.AddDate(0, 0, 7*SLAWeeks+1)); len(got) != 0 {
+		t.Errorf("Expected old weeks pruned, got %+v", got)
+	}
+}
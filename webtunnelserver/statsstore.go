@@ -0,0 +1,430 @@
+package webtunnelserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	defaultStatsInterval = time.Minute // Time between samples of sessions.
+	statsFilePrefix      = "stats-"    // Prefix of the daily files of the store.
+	statsFileSuffix      = ".jsonl"    // Suffix of the daily files of the store.
+	statsDayLayout       = "2006-01-02"
+)
+
+// StatsPolicy configures the session statistics store.
+type StatsPolicy struct {
+	Dir       string        // Directory of the store, holding a file of samples per day (UTC).
+	Interval  time.Duration // Time between samples of each session, defaultStatsInterval if 0.
+	Retention time.Duration // Age after which samples are deleted, 0 keeps them.
+}
+
+// StatsSample is the traffic of a client session over a sample interval.
+type StatsSample struct {
+	Time       time.Time `json:"time"`
+	IP         string    `json:"ip"`
+	SessionID  string    `json:"sessionid,omitempty"`
+	Username   string    `json:"username"`
+	Hostname   string    `json:"hostname"`
+	BytesIn    uint64    `json:"bytesIn"`          // Bytes received from the client.
+	BytesOut   uint64    `json:"bytesOut"`         // Bytes sent to the client.
+	PacketsIn  uint64    `json:"packetsIn"`        // Packets received from the client.
+	PacketsOut uint64    `json:"packetsOut"`       // Packets sent to the client.
+	Closed     bool      `json:"closed,omitempty"` // Last sample of the session.
+}
+
+// TalkerStats is the traffic of a user over a period.
+type TalkerStats struct {
+	Username   string `json:"username"`
+	BytesIn    uint64 `json:"bytesIn"`
+	BytesOut   uint64 `json:"bytesOut"`
+	PacketsIn  uint64 `json:"packetsIn"`
+	PacketsOut uint64 `json:"packetsOut"`
+	Sessions   int    `json:"sessions"` // Sessions closed during the period.
+}
+
+// statsStore samples the traffic of client sessions into daily files.
+type statsStore struct {
+	policy   StatsPolicy
+	sessions map[string]*StatsSample // Traffic since the last sample by client IP.
+	lock     sync.Mutex              // Lock for sessions.
+	fileLock sync.Mutex              // Lock for the files.
+}
+
+/*
+SetStatsStore keeps the traffic of client sessions in the embedded store p.Dir, sampled
+every p.Interval and kept for p.Retention, so small deployments get traffic history
+without an external metrics stack. The top talkers and the history of a user are
+served by the admin API (see SetAdminAPI) on /api/v1/stats/top (eg. ?hours=24&n=10) and
+/api/v1/stats/user (eg. ?name=alice&hours=24), see TopTalkers and UserHistory. Samples are
+appended to a JSON lines file per day, so retention deletes whole files and the store
+needs no database dependency. This should be called prior to Start.
+*/
+func (r *WebTunnelServer) SetStatsStore(p StatsPolicy) error {
+	if p.Dir == "" {
+		return fmt.Errorf("no stats directory")
+	}
+	if p.Interval < 0 || p.Retention < 0 {
+		return fmt.Errorf("invalid stats interval %v or retention %v", p.Interval, p.Retention)
+	}
+	if p.Interval == 0 {
+		p.Interval = defaultStatsInterval
+	}
+	if err := os.MkdirAll(p.Dir, 0700); err != nil {
+		return fmt.Errorf("error creating stats directory %w", err)
+	}
+	r.stats = &statsStore{policy: p, sessions: make(map[string]*StatsSample)}
+	r.AddIPEventListener(r.stats.ipEvent)
+	return nil
+}
+
+// ipEvent starts sampling sessions as client IPs are assigned and stores their last
+// sample as they are released.
+func (s *statsStore) ipEvent(ev IPEvent) {
+	switch ev.Type {
+	case IPAssigned:
+		s.lock.Lock()
+		if _, ok := s.sessions[ev.IP]; !ok {
+			s.sessions[ev.IP] = &StatsSample{IP: ev.IP, SessionID: ev.SessionID, Username: ev.Username,
+				Hostname: ev.Hostname}
+		}
+		s.lock.Unlock()
+	case IPReleased:
+		s.lock.Lock()
+		sample, ok := s.sessions[ev.IP]
+		delete(s.sessions, ev.IP)
+		s.lock.Unlock()
+		if !ok {
+			return
+		}
+		sample.Time = ev.Time
+		sample.Closed = true
+		if err := s.append([]StatsSample{*sample}); err != nil {
+			glog.Warningf("error storing stats of %v: %v", ev.IP, err)
+		}
+	}
+}
+
+// count adds a packet of n bytes to the session of ip.
+func (s *statsStore) count(ip string, dir Direction, n int) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sample, ok := s.sessions[ip]
+	if !ok {
+		return
+	}
+	if dir == FromClient {
+		sample.BytesIn += uint64(n)
+		sample.PacketsIn++
+	} else {
+		sample.BytesOut += uint64(n)
+		sample.PacketsOut++
+	}
+}
+
+// sample returns the traffic of the sessions with traffic since the last sample at now
+// and resets their counters.
+func (s *statsStore) sample(now time.Time) []StatsSample {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var samples []StatsSample
+	for _, sample := range s.sessions {
+		if sample.PacketsIn == 0 && sample.PacketsOut == 0 {
+			continue
+		}
+		sample.Time = now
+		samples = append(samples, *sample)
+		sample.BytesIn, sample.BytesOut, sample.PacketsIn, sample.PacketsOut = 0, 0, 0, 0
+	}
+	return samples
+}
+
+// dayFile returns the file of the samples of the day of t.
+func (s *statsStore) dayFile(t time.Time) string {
+	return filepath.Join(s.policy.Dir, statsFilePrefix+t.UTC().Format(statsDayLayout)+statsFileSuffix)
+}
+
+// append stores samples in the files of their days.
+func (s *statsStore) append(samples []StatsSample) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+	byFile := make(map[string][]StatsSample)
+	for _, sample := range samples {
+		f := s.dayFile(sample.Time)
+		byFile[f] = append(byFile[f], sample)
+	}
+	for name, samples := range byFile {
+		f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(f)
+		enc := json.NewEncoder(w)
+		for i := range samples {
+			if err := enc.Encode(&samples[i]); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// days returns the days of the files of the store in order.
+func (s *statsStore) days() ([]time.Time, error) {
+	entries, err := os.ReadDir(s.policy.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var days []time.Time
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, statsFilePrefix) || !strings.HasSuffix(name, statsFileSuffix) {
+			continue
+		}
+		day, err := time.Parse(statsDayLayout, strings.TrimSuffix(strings.TrimPrefix(name, statsFilePrefix), statsFileSuffix))
+		if err != nil {
+			continue
+		}
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days, nil
+}
+
+// scan calls f for each stored sample taken at or after since.
+func (s *statsStore) scan(since time.Time, f func(StatsSample)) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+	days, err := s.days()
+	if err != nil {
+		return err
+	}
+	first := since.UTC().Truncate(24 * time.Hour)
+	for _, day := range days {
+		if day.Before(first) {
+			continue
+		}
+		if err := s.scanFile(s.dayFile(day), since, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanFile calls f for each sample of the file name taken at or after since. Malformed
+// lines, eg. of a write cut short by a crash, are skipped.
+func (s *statsStore) scanFile(name string, since time.Time, f func(StatsSample)) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	sc := bufio.NewScanner(file)
+	for sc.Scan() {
+		var sample StatsSample
+		if err := json.Unmarshal(sc.Bytes(), &sample); err != nil {
+			continue
+		}
+		if sample.Time.Before(since) {
+			continue
+		}
+		f(sample)
+	}
+	return sc.Err()
+}
+
+// prune deletes the files of the days older than the retention at now.
+func (s *statsStore) prune(now time.Time) error {
+	if s.policy.Retention == 0 {
+		return nil
+	}
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+	days, err := s.days()
+	if err != nil {
+		return err
+	}
+	for _, day := range days {
+		// A day is kept while any of its samples is within the retention.
+		if now.Sub(day.Add(24*time.Hour)) <= s.policy.Retention {
+			continue
+		}
+		if err := os.Remove(s.dayFile(day)); err != nil {
+			return err
+		}
+		glog.V(1).Infof("Deleted stats of %v", day.Format(statsDayLayout))
+	}
+	return nil
+}
+
+// processStats routinely stores the traffic of the sessions and deletes expired samples.
+func (r *WebTunnelServer) processStats() {
+	if r.stats == nil {
+		return
+	}
+	for {
+		time.Sleep(r.stats.policy.Interval)
+		if r.isStopped.Load() {
+			glog.V(1).Info("Exiting stats routine")
+			return
+		}
+		now := time.Now()
+		if err := r.stats.append(r.stats.sample(now)); err != nil {
+			glog.Warningf("error storing session stats: %v", err)
+		}
+		if err := r.stats.prune(now); err != nil {
+			glog.Warningf("error deleting expired session stats: %v", err)
+		}
+	}
+}
+
+// TopTalkers returns the n users with the most traffic since since, most first. Traffic
+// not yet sampled is included.
+func (r *WebTunnelServer) TopTalkers(since time.Time, n int) ([]TalkerStats, error) {
+	if r.stats == nil {
+		return nil, fmt.Errorf("stats store not enabled")
+	}
+	users := make(map[string]*TalkerStats)
+	add := func(sample StatsSample) {
+		t, ok := users[sample.Username]
+		if !ok {
+			t = &TalkerStats{Username: sample.Username}
+			users[sample.Username] = t
+		}
+		t.BytesIn += sample.BytesIn
+		t.BytesOut += sample.BytesOut
+		t.PacketsIn += sample.PacketsIn
+		t.PacketsOut += sample.PacketsOut
+		if sample.Closed {
+			t.Sessions++
+		}
+	}
+	if err := r.stats.scan(since, add); err != nil {
+		return nil, err
+	}
+	r.stats.lock.Lock()
+	for _, sample := range r.stats.sessions {
+		add(*sample)
+	}
+	r.stats.lock.Unlock()
+
+	talkers := make([]TalkerStats, 0, len(users))
+	for _, t := range users {
+		talkers = append(talkers, *t)
+	}
+	sort.Slice(talkers, func(i, j int) bool {
+		ti, tj := talkers[i].BytesIn+talkers[i].BytesOut, talkers[j].BytesIn+talkers[j].BytesOut
+		if ti != tj {
+			return ti > tj
+		}
+		return talkers[i].Username < talkers[j].Username
+	})
+	if n > 0 && len(talkers) > n {
+		talkers = talkers[:n]
+	}
+	return talkers, nil
+}
+
+// UserHistory returns the stored samples of the sessions of username since since, oldest
+// first.
+func (r *WebTunnelServer) UserHistory(username string, since time.Time) ([]StatsSample, error) {
+	if r.stats == nil {
+		return nil, fmt.Errorf("stats store not enabled")
+	}
+	var samples []StatsSample
+	err := r.stats.scan(since, func(sample StatsSample) {
+		if sample.Username == username {
+			samples = append(samples, sample)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+	return samples, nil
+}
+
+// statsSince returns the start of the period of the hours query parameter, 24 by default.
+func statsSince(rcv *http.Request) (time.Time, error) {
+	hours := 24
+	if v := rcv.URL.Query().Get("hours"); v != "" {
+		h, err := strconv.Atoi(v)
+		if err != nil || h <= 0 {
+			return time.Time{}, fmt.Errorf("invalid hours %q", v)
+		}
+		hours = h
+	}
+	return time.Now().Add(-time.Duration(hours) * time.Hour), nil
+}
+
+// statsTopEndpoint serves the top talkers as JSON.
+func (r *WebTunnelServer) statsTopEndpoint(w http.ResponseWriter, rcv *http.Request) {
+	if !allowMethods(w, rcv, http.MethodGet) {
+		return
+	}
+	since, err := statsSince(rcv)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n := 10
+	if v := rcv.URL.Query().Get("n"); v != "" {
+		if n, err = strconv.Atoi(v); err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("invalid n %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	talkers, err := r.TopTalkers(since, n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(talkers)
+}
+
+// statsUserEndpoint serves the history of a user as JSON.
+func (r *WebTunnelServer) statsUserEndpoint(w http.ResponseWriter, rcv *http.Request) {
+	if !allowMethods(w, rcv, http.MethodGet) {
+		return
+	}
+	name := rcv.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "no user name", http.StatusBadRequest)
+		return
+	}
+	since, err := statsSince(rcv)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	samples, err := r.UserHistory(name, since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(samples)
+}
@@ -0,0 +1,129 @@
+package webtunnelserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsStore(t *testing.T) {
+	ipam, _ := NewIPPam("192.168.0.0/24")
+	r := &WebTunnelServer{ipam: ipam}
+	if err := r.SetStatsStore(StatsPolicy{}); err == nil {
+		t.Error("Expected error without directory")
+	}
+	dir := t.TempDir()
+	if err := r.SetStatsStore(StatsPolicy{Dir: dir, Retention: 48 * time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	connect := func(user string) string {
+		ip, _ := ipam.AcquireIP(struct{}{})
+		ipam.SetIPActiveWithUserInfo(ip, user, user+"-laptop")
+		return ip
+	}
+	alice, bob := connect("alice"), connect("bob")
+
+	// Samples older than the retention are deleted with their day.
+	now := time.Now()
+	old := now.Add(-96 * time.Hour)
+	if err := r.stats.append([]StatsSample{{Time: old, Username: "bob", BytesIn: 1 << 30}}); err != nil {
+		t.Fatal(err)
+	}
+	r.stats.count(alice, FromClient, 100)
+	r.stats.count(alice, ToClient, 1000)
+	r.stats.count(bob, FromClient, 50)
+	if err := r.stats.append(r.stats.sample(now)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.stats.prune(now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(r.stats.dayFile(old)); !os.IsNotExist(err) {
+		t.Errorf("Expected expired day deleted, got %v", err)
+	}
+
+	// The last sample is stored when the session closes.
+	r.stats.count(bob, ToClient, 70)
+	ipam.ReleaseIP(bob)
+	r.stats.count(alice, FromClient, 10) // Not sampled yet.
+
+	talkers, err := r.TopTalkers(now.Add(-24*time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TalkerStats{
+		{Username: "alice", BytesIn: 110, BytesOut: 1000, PacketsIn: 2, PacketsOut: 1},
+		{Username: "bob", BytesIn: 50, BytesOut: 70, PacketsIn: 1, PacketsOut: 1, Sessions: 1},
+	}
+	if len(talkers) != len(want) || talkers[0] != want[0] || talkers[1] != want[1] {
+		t.Errorf("Expected top talkers %+v, got %+v", want, talkers)
+	}
+
+	history, err := r.UserHistory("bob", old.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].BytesIn != 50 || history[1].BytesOut != 70 || !history[1].Closed ||
+		history[1].Hostname != "bob-laptop" {
+		t.Errorf("Unexpected history of bob %+v", history)
+	}
+
+	// Query endpoints.
+	rec := httptest.NewRecorder()
+	r.statsTopEndpoint(rec, httptest.NewRequest(http.MethodGet, "/stats/top?hours=24&n=1", nil))
+	var got []TalkerStats
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil || len(got) != 1 || got[0].Username != "alice" {
+		t.Errorf("Unexpected top talkers %+v %v", got, err)
+	}
+	rec = httptest.NewRecorder()
+	r.statsUserEndpoint(rec, httptest.NewRequest(http.MethodGet, "/stats/user?name=bob", nil))
+	var samples []StatsSample
+	if err := json.NewDecoder(rec.Body).Decode(&samples); err != nil || len(samples) != 2 {
+		t.Errorf("Unexpected history %+v %v", samples, err)
+	}
+	for url, h := range map[string]http.HandlerFunc{
+		"/stats/top?hours=-1": r.statsTopEndpoint,
+		"/stats/top?n=x":      r.statsTopEndpoint,
+		"/stats/user":         r.statsUserEndpoint,
+	} {
+		rec = httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected bad request for %v, got %v", url, rec.Code)
+		}
+	}
+
+	// Stats are only served by the admin API to authenticated admins.
+	r.mux = http.NewServeMux()
+	r.registerHandlers()
+	rec = httptest.NewRecorder()
+	r.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats/top", nil))
+	if rec.Code == http.StatusOK && strings.Contains(rec.Body.String(), "alice") {
+		t.Error("Expected stats not served without the admin API")
+	}
+	auth := NewTokenAuthenticator(TokenVerifier(func(token string) (string, error) {
+		if token != "secret" {
+			return "", fmt.Errorf("invalid token")
+		}
+		return "ops", nil
+	}))
+	if err := r.SetAdminAPI(AdminAPI{Auth: auth}); err != nil {
+		t.Fatal(err)
+	}
+	for token, code := range map[string]int{"": http.StatusUnauthorized, "secret": http.StatusOK} {
+		rcv := httptest.NewRequest(http.MethodGet, AdminPrefix+"stats/top", nil)
+		if token != "" {
+			rcv.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec = httptest.NewRecorder()
+		r.adminHandler().ServeHTTP(rec, rcv)
+		if rec.Code != code {
+			t.Errorf("Expected %v for stats with token %q, got %v", code, token, rec.Code)
+		}
+	}
+}
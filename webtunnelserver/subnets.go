@@ -0,0 +1,162 @@
+package webtunnelserver
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// ClientSubnets returns the subnets behind a client (eg. a branch office LAN) by username
+// and hostname. No subnets means the client is a single host.
+type ClientSubnets func(username, hostname string) []string
+
+// clientSubnet is a subnet routed to a client session.
+type clientSubnet struct {
+	net *net.IPNet // Subnet behind the client.
+	ip  string     // Tunnel IP of the client.
+}
+
+// subnetTable holds the subnets of connected clients.
+type subnetTable struct {
+	subnets []clientSubnet
+	lock    sync.Mutex
+}
+
+// SetClientSubnets enables site-to-site style routing to subnets behind clients. When a
+// client connects, a route for each of its subnets is added to the tunnel interface and
+// packets to them are sent to the client session. The routes are removed on disconnect.
+// This should be called prior to Start.
+func (r *WebTunnelServer) SetClientSubnets(f ClientSubnets) {
+	r.clientSubnets = f
+}
+
+// GetClientSubnets returns the subnets routed to clients keyed by subnet, with the tunnel
+// IP of the client as value.
+func (r *WebTunnelServer) GetClientSubnets() map[string]string {
+	r.subnets.lock.Lock()
+	defer r.subnets.lock.Unlock()
+	m := make(map[string]string)
+	for _, s := range r.subnets.subnets {
+		m[s.net.String()] = s.ip
+	}
+	return m
+}
+
+// addClientSubnets routes the subnets of the client on ip to its session. Invalid or
+// conflicting subnets are logged and skipped.
+func (r *WebTunnelServer) addClientSubnets(ip, username, hostname string) {
+	if r.clientSubnets == nil {
+		return
+	}
+	for _, s := range r.clientSubnets(username, hostname) {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil || n.IP.To4() == nil {
+			glog.Warningf("invalid subnet %q for %s@%s", s, username, hostname)
+			continue
+		}
+		if err := r.routeSubnet(ip, n); err != nil {
+			glog.Warningf("subnet of %s@%s not routed: %v", username, hostname, err)
+			continue
+		}
+	}
+}
+
+// routeSubnet adds a route for n to the tunnel interface and sends packets to it to the
+// client session on ip.
+func (r *WebTunnelServer) routeSubnet(ip string, n *net.IPNet) error {
+	for _, clientNet := range r.clientNets() {
+		if overlaps(n, clientNet) {
+			return fmt.Errorf("%v overlaps the client network %v", n, clientNet)
+		}
+	}
+	added, err := r.subnets.add(n, ip)
+	if err != nil || !added {
+		return err
+	}
+	if err := AddTunnelRoute(r.ifce.Name(), n.String()); err != nil {
+		r.subnets.remove(n)
+		return fmt.Errorf("unable to route %v to %v: %w", n, ip, err)
+	}
+	glog.Infof("Routing subnet %v to %v", n, ip)
+	return nil
+}
+
+// releaseClientSubnets removes the subnet routes of the client on ip.
+func (r *WebTunnelServer) releaseClientSubnets(ip string) {
+	for _, n := range r.subnets.release(ip) {
+		if err := DeleteTunnelRoute(r.ifce.Name(), n.String()); err != nil {
+			glog.Warningf("unable to remove route to subnet %v: %v", n, err)
+		}
+	}
+}
+
+// add routes n to the client on ip unless it overlaps a subnet of another client. It
+// returns false if n is already routed to ip.
+func (t *subnetTable) add(n *net.IPNet, ip string) (bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, s := range t.subnets {
+		if s.ip == ip && s.net.String() == n.String() {
+			return false, nil
+		}
+		if overlaps(s.net, n) {
+			return false, fmt.Errorf("%v overlaps %v routed to %v", n, s.net, s.ip)
+		}
+	}
+	t.subnets = append(t.subnets, clientSubnet{net: n, ip: ip})
+	return true, nil
+}
+
+// remove removes the subnet n.
+func (t *subnetTable) remove(n *net.IPNet) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for i, s := range t.subnets {
+		if s.net == n {
+			t.subnets = append(t.subnets[:i], t.subnets[i+1:]...)
+			return
+		}
+	}
+}
+
+// release removes and returns the subnets of the client on ip.
+func (t *subnetTable) release(ip string) []*net.IPNet {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var removed []*net.IPNet
+	kept := t.subnets[:0]
+	for _, s := range t.subnets {
+		if s.ip == ip {
+			removed = append(removed, s.net)
+			continue
+		}
+		kept = append(kept, s)
+	}
+	t.subnets = kept
+	return removed
+}
+
+// move routes the subnets of the client on oldIP to newIP.
+func (t *subnetTable) move(oldIP, newIP string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for i := range t.subnets {
+		if t.subnets[i].ip == oldIP {
+			t.subnets[i].ip = newIP
+		}
+	}
+}
+
+// lookup returns the tunnel IP of the client owning the subnet containing dst.
+func (t *subnetTable) lookup(dst net.IP) (string, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, s := range t.subnets {
+		if s.net.Contains(dst) {
+			return s.ip, true
+		}
+	}
+	return "", false
+}
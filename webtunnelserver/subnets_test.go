@@ -0,0 +1,72 @@
+package webtunnelserver
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/deepakkamesh/webtunnel/mocks"
+	"github.com/golang/mock/gomock"
+)
+
+func TestClientSubnets(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIfce := mocks.NewMockInterface(mockCtrl)
+	mockIfce.EXPECT().Name().Return("tun0").AnyTimes()
+
+	routes := map[string]bool{}
+	defer func(add, del func(string, string) error) { AddTunnelRoute, DeleteTunnelRoute = add, del }(AddTunnelRoute, DeleteTunnelRoute)
+	AddTunnelRoute = func(ifce, subnet string) error {
+		routes[subnet] = true
+		return nil
+	}
+	DeleteTunnelRoute = func(ifce, subnet string) error {
+		delete(routes, subnet)
+		return nil
+	}
+
+	r := &WebTunnelServer{ifce: mockIfce, clientNetPrefix: "192.168.0.0/24"}
+	r.SetClientSubnets(func(username, hostname string) []string {
+		switch hostname {
+		case "branch1":
+			return []string{"10.1.0.0/16", "10.2.0.0/24", "bogus", "192.168.0.128/25"}
+		case "branch2":
+			return []string{"10.2.0.128/25", "10.3.0.0/16"}
+		}
+		return nil
+	})
+	r.addClientSubnets("192.168.0.2", "router", "branch1")
+	r.addClientSubnets("192.168.0.2", "router", "branch1") // Config requested again.
+	r.addClientSubnets("192.168.0.3", "router", "branch2")
+	r.addClientSubnets("192.168.0.4", "alice", "laptop")
+
+	// Invalid subnets, subnets in the client network and overlaps are skipped.
+	want := map[string]string{"10.1.0.0/16": "192.168.0.2", "10.2.0.0/24": "192.168.0.2", "10.3.0.0/16": "192.168.0.3"}
+	if got := r.GetClientSubnets(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected subnets %v, got %v", want, got)
+	}
+	var installed []string
+	for k := range routes {
+		installed = append(installed, k)
+	}
+	sort.Strings(installed)
+	if !reflect.DeepEqual(installed, []string{"10.1.0.0/16", "10.2.0.0/24", "10.3.0.0/16"}) {
+		t.Errorf("Unexpected tunnel routes %v", installed)
+	}
+	if ip, ok := r.subnets.lookup(net.IP{10, 2, 0, 200}); !ok || ip != "192.168.0.2" {
+		t.Errorf("Expected 10.2.0.200 routed to 192.168.0.2, got %v %v", ip, ok)
+	}
+	if _, ok := r.subnets.lookup(net.IP{10, 4, 0, 1}); ok {
+		t.Error("Expected no client for 10.4.0.1")
+	}
+
+	r.releaseClientSubnets("192.168.0.2")
+	if len(routes) != 1 || !routes["10.3.0.0/16"] {
+		t.Errorf("Expected routes of released client removed, got %v", routes)
+	}
+	if _, ok := r.subnets.lookup(net.IP{10, 1, 0, 1}); ok {
+		t.Error("Expected subnet released")
+	}
+}
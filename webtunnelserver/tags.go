@@ -0,0 +1,82 @@
+package webtunnelserver
+
+// TagSession adds admin tags (eg. "incident-1234") to the session on ip. Tags are
+// included in IP events and metrics.
+func (r *WebTunnelServer) TagSession(ip string, tags ...string) error {
+	return r.ipam.UpdateTags(ip, tags, nil)
+}
+
+// UntagSession removes admin tags from the session on ip.
+func (r *WebTunnelServer) UntagSession(ip string, tags ...string) error {
+	return r.ipam.UpdateTags(ip, nil, tags)
+}
+
+// SetSessionNote sets the admin note of the session on ip.
+func (r *WebTunnelServer) SetSessionNote(ip, note string) error {
+	return r.ipam.SetNote(ip, note)
+}
+
+// SessionTags returns the admin tags and note of the session on ip.
+func (r *WebTunnelServer) SessionTags(ip string) ([]string, string, error) {
+	u, err := r.ipam.GetUserinfo(ip)
+	if err != nil {
+		return nil, "", err
+	}
+	return append([]string(nil), u.Tags...), u.Note, nil
+}
+
+// TagUser adds admin tags (eg. "vip") to username. They are added to the current and
+// future sessions of the user.
+func (r *WebTunnelServer) TagUser(username string, tags ...string) {
+	r.ipam.UpdateUserTags(username, tags, nil)
+}
+
+// UntagUser removes admin tags from username and its current sessions.
+func (r *WebTunnelServer) UntagUser(username string, tags ...string) {
+	r.ipam.UpdateUserTags(username, nil, tags)
+}
+
+// UserTags returns the admin tags of username.
+func (r *WebTunnelServer) UserTags(username string) []string {
+	return r.ipam.GetUserTags(username)
+}
+
+// sessionTags returns the admin tags of each tagged session keyed by client IP.
+func (r *WebTunnelServer) sessionTags() map[string][]string {
+	m := make(map[string][]string)
+	for ip, u := range r.ipam.DumpAllocations() {
+		if len(u.Tags) > 0 {
+			m[ip] = append([]string(nil), u.Tags...)
+		}
+	}
+	return m
+}
+
+// SessionLabels returns the labels the auth backend attached to the session on ip.
+func (r *WebTunnelServer) SessionLabels(ip string) (Labels, error) {
+	u, err := r.ipam.GetUserinfo(ip)
+	if err != nil {
+		return nil, err
+	}
+	return copyLabels(u.Labels), nil
+}
+
+// sessionLabels returns the auth backend labels of each labelled session keyed by client IP.
+func (r *WebTunnelServer) sessionLabels() map[string]Labels {
+	m := make(map[string]Labels)
+	for ip, u := range r.ipam.DumpAllocations() {
+		if len(u.Labels) > 0 {
+			m[ip] = copyLabels(u.Labels)
+		}
+	}
+	return m
+}
+
+// copyLabels returns a copy of labels.
+func copyLabels(labels Labels) Labels {
+	c := make(Labels, len(labels))
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,53 @@
+package webtunnelserver
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTags(t *testing.T) {
+	ipam, err := NewIPPam("192.168.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []IPEvent
+	ipam.AddListener(func(ev IPEvent) { events = append(events, ev) })
+	r := &WebTunnelServer{ipam: ipam}
+
+	// User tags apply to new sessions.
+	r.TagUser("alice", "vip")
+	ip, _ := ipam.AcquireIP(nil)
+	ipam.SetIPActiveWithUserInfo(ip, "alice", "laptop")
+	if err := r.TagSession(ip, "incident-1234", "vip"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetSessionNote(ip, "investigating"); err != nil {
+		t.Fatal(err)
+	}
+	tags, note, err := r.SessionTags(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tags, []string{"incident-1234", "vip"}) || note != "investigating" {
+		t.Errorf("Unexpected session tags %v note %q", tags, note)
+	}
+
+	// Removing a user tag removes it from current sessions.
+	r.UntagUser("alice", "vip")
+	if tags, _, _ := r.SessionTags(ip); !reflect.DeepEqual(tags, []string{"incident-1234"}) {
+		t.Errorf("Expected vip removed, got %v", tags)
+	}
+	if tags := r.sessionTags()[ip]; !reflect.DeepEqual(tags, []string{"incident-1234"}) {
+		t.Errorf("Expected tags in metrics, got %v", tags)
+	}
+
+	ipam.ReleaseIP(ip)
+	if len(events) != 2 || !reflect.DeepEqual(events[0].Tags, []string{"vip"}) ||
+		!reflect.DeepEqual(events[1].Tags, []string{"incident-1234"}) {
+		t.Errorf("Expected tags in events, got %+v", events)
+	}
+	if err := r.TagSession(ip, "x"); !errors.Is(err, ErrIPNotAllocated) {
+		t.Errorf("Expected ErrIPNotAllocated, got %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package webtunnelserver
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+)
+
+func TestTCPOptions(t *testing.T) {
+	r := &WebTunnelServer{serverIPPort: "127.0.0.1:0"}
+	for _, o := range []wc.TCPOptions{
+		{KeepAlive: -1, KeepAliveCount: 3},
+		{KeepAlive: time.Millisecond},
+		{KeepAliveCount: -1},
+		{Congestion: "bogus"},
+	} {
+		if err := r.SetTCPOptions(o); err == nil {
+			t.Errorf("Expected error for options %+v", o)
+		}
+	}
+	if err := r.SetTCPOptions(wc.TCPOptions{KeepAlive: 20 * time.Second, KeepAliveInterval: 5 * time.Second, KeepAliveCount: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.listener.Close()
+
+	c, err := net.Dial("tcp", r.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn, err := r.listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The options replace the keepalive defaults of the Go runtime.
+	raw, _ := conn.(*net.TCPConn).SyscallConn()
+	got := map[int]int{}
+	raw.Control(func(fd uintptr) {
+		for _, opt := range []int{syscall.TCP_KEEPIDLE, syscall.TCP_KEEPINTVL, syscall.TCP_KEEPCNT} {
+			got[opt], _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, opt)
+		}
+	})
+	if got[syscall.TCP_KEEPIDLE] != 20 || got[syscall.TCP_KEEPINTVL] != 5 || got[syscall.TCP_KEEPCNT] != 3 {
+		t.Errorf("Unexpected keepalive idle %v interval %v count %v", got[syscall.TCP_KEEPIDLE], got[syscall.TCP_KEEPINTVL], got[syscall.TCP_KEEPCNT])
+	}
+}
@@ -0,0 +1,131 @@
+package webtunnelserver
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// TLSOptions hardens the HTTPS listener. Zero values keep the Go defaults.
+type TLSOptions struct {
+	MinVersion       uint16        // Minimum TLS version (eg. tls.VersionTLS13).
+	CurvePreferences []tls.CurveID // Key exchange curves in preference order.
+	CipherSuites     []uint16      // TLS 1.2 cipher suites; TLS 1.3 suites are not configurable.
+	OCSPStaple       []byte        // DER OCSP response stapled to the server certificate.
+	TicketRotation   time.Duration // Session ticket key rotation interval.
+	RequireSNI       []string      // Reject ClientHellos without one of these server names.
+}
+
+// Number of session ticket keys kept so tickets issued before a rotation still resume.
+const ticketKeyCount = 2
+
+// SetTLSConfig sets the base config of the HTTPS listener (eg. to enable encrypted client
+// hello keys or client certificates). The certificate files are added if the config has no
+// certificates; set GetCertificate to manage rotation externally instead. This should be
+// called prior to Start.
+func (r *WebTunnelServer) SetTLSConfig(cfg *tls.Config) {
+	r.baseTLSConfig = cfg
+}
+
+// SetTLSOptions sets the TLS hardening options applied on top of the config set with
+// SetTLSConfig. This should be called prior to Start.
+func (r *WebTunnelServer) SetTLSOptions(o TLSOptions) error {
+	if o.MinVersion != 0 && (o.MinVersion < tls.VersionTLS10 || o.MinVersion > tls.VersionTLS13) {
+		return fmt.Errorf("invalid minimum TLS version %#x", o.MinVersion)
+	}
+	if o.TicketRotation < 0 {
+		return fmt.Errorf("invalid ticket rotation %v", o.TicketRotation)
+	}
+	supported := map[uint16]bool{}
+	for _, c := range tls.CipherSuites() {
+		supported[c.ID] = true
+	}
+	for _, id := range o.CipherSuites {
+		if !supported[id] {
+			return fmt.Errorf("unsupported cipher suite %v", tls.CipherSuiteName(id))
+		}
+	}
+	r.tlsOptions = o
+	return nil
+}
+
+// buildTLSConfig returns the listener config from the base config, cert and options.
+func (r *WebTunnelServer) buildTLSConfig(cert tls.Certificate) *tls.Config {
+	cfg := &tls.Config{}
+	if r.baseTLSConfig != nil {
+		cfg = r.baseTLSConfig.Clone()
+	}
+	o := r.tlsOptions
+	if r.acme != nil {
+		cfg.GetCertificate = r.acme.getCertificate
+		if r.acme.cfg.Challenge == ACMETLSALPN01 {
+			cfg.NextProtos = append(cfg.NextProtos, acmeALPNProto)
+		}
+	} else if len(cfg.Certificates) == 0 && cfg.GetCertificate == nil {
+		// Served through GetCertificate so renewed certificates are picked up.
+		r.certs = newCertStore(cert, o.OCSPStaple)
+		cfg.GetCertificate = r.certs.getCertificate
+	}
+	if o.OCSPStaple != nil {
+		cfg.Certificates = append([]tls.Certificate(nil), cfg.Certificates...)
+		for i := range cfg.Certificates {
+			cfg.Certificates[i].OCSPStaple = o.OCSPStaple
+		}
+	}
+	if o.MinVersion != 0 {
+		cfg.MinVersion = o.MinVersion
+	}
+	if len(o.CurvePreferences) > 0 {
+		cfg.CurvePreferences = o.CurvePreferences
+	}
+	if len(o.CipherSuites) > 0 {
+		cfg.CipherSuites = o.CipherSuites
+	}
+	if len(o.RequireSNI) > 0 {
+		names := map[string]bool{}
+		for _, n := range o.RequireSNI {
+			names[n] = true
+		}
+		next := cfg.GetConfigForClient
+		cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if !names[hello.ServerName] {
+				glog.Warningf("rejecting ClientHello from %v with SNI %q", hello.Conn.RemoteAddr(), hello.ServerName)
+				return nil, fmt.Errorf("unexpected server name %q", hello.ServerName)
+			}
+			if next != nil {
+				return next(hello)
+			}
+			return nil, nil
+		}
+	}
+	return cfg
+}
+
+// processTicketRotation replaces the session ticket key of cfg every rotation interval.
+func (r *WebTunnelServer) processTicketRotation(cfg *tls.Config) {
+	interval := r.tlsOptions.TicketRotation
+	if interval == 0 {
+		return
+	}
+	var keys [][32]byte
+	for {
+		if r.isStopped.Load() {
+			glog.V(1).Info("Exiting ticket rotation routine")
+			return
+		}
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			glog.Errorf("unable to generate session ticket key: %v", err)
+		} else {
+			keys = append([][32]byte{key}, keys...)
+			if len(keys) > ticketKeyCount {
+				keys = keys[:ticketKeyCount]
+			}
+			cfg.SetSessionTicketKeys(keys)
+		}
+		time.Sleep(interval)
+	}
+}
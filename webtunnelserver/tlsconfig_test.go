@@ -0,0 +1,92 @@
+package webtunnelserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCert returns a self signed certificate for name.
+func testCert(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// handshake connects a client with serverName and maxVersion to a server using cfg.
+func handshake(cfg *tls.Config, serverName string, maxVersion uint16) (tls.ConnectionState, error) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	srv := tls.Server(s, cfg)
+	go srv.Handshake()
+	cli := tls.Client(c, &tls.Config{ServerName: serverName, InsecureSkipVerify: true, MaxVersion: maxVersion})
+	err := cli.Handshake()
+	return cli.ConnectionState(), err
+}
+
+func TestTLSOptions(t *testing.T) {
+	r := &WebTunnelServer{}
+	if err := r.SetTLSOptions(TLSOptions{MinVersion: 0x0200}); err == nil {
+		t.Error("Expected error for invalid TLS version")
+	}
+	if err := r.SetTLSOptions(TLSOptions{CipherSuites: []uint16{0xffff}}); err == nil {
+		t.Error("Expected error for unsupported cipher suite")
+	}
+	staple := []byte{1, 2, 3}
+	if err := r.SetTLSOptions(TLSOptions{
+		MinVersion: tls.VersionTLS13,
+		OCSPStaple: staple,
+		RequireSNI: []string{"vpn.example.com"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := r.buildTLSConfig(testCert(t, "vpn.example.com"))
+
+	state, err := handshake(cfg, "vpn.example.com", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != tls.VersionTLS13 || string(state.OCSPResponse) != string(staple) {
+		t.Errorf("Expected TLS 1.3 with OCSP staple, got %#x %v", state.Version, state.OCSPResponse)
+	}
+	if _, err := handshake(cfg, "other.example.com", 0); err == nil {
+		t.Error("Expected ClientHello with unexpected SNI rejected")
+	}
+	if _, err := handshake(cfg, "vpn.example.com", tls.VersionTLS12); err == nil {
+		t.Error("Expected TLS 1.2 rejected")
+	}
+
+	// Certificates of an injected config are kept.
+	base := &tls.Config{Certificates: []tls.Certificate{testCert(t, "base.example.com")}}
+	r.SetTLSConfig(base)
+	r.SetTLSOptions(TLSOptions{})
+	cfg = r.buildTLSConfig(testCert(t, "vpn.example.com"))
+	state, err = handshake(cfg, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := state.PeerCertificates[0].Subject.CommonName; cn != "base.example.com" {
+		t.Errorf("Expected injected certificate, got %v", cn)
+	}
+}
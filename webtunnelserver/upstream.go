@@ -0,0 +1,356 @@
+package webtunnelserver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+// Default time between reconnects to the next gateway.
+const defaultUpstreamRetry = 5 * time.Second
+
+// UpstreamConfig is the next gateway client traffic is chained to.
+type UpstreamConfig struct {
+	URL       string        // Websocket URL of the next gateway, eg. wss://egress.example.com/ws.
+	Username  string        // Basic auth user on the next gateway, empty if none.
+	Password  string        // Basic auth password on the next gateway.
+	Hostname  string        // Name of this gateway in the nested session, the OS hostname if empty.
+	Prefixes  []string      // Destinations egressing via the next gateway, all if empty.
+	TLSConfig *tls.Config   // TLS config for wss URLs, nil for the defaults.
+	Retry     time.Duration // Time between reconnects, defaultUpstreamRetry if 0.
+}
+
+// upstream is the nested session to the next gateway.
+type upstream struct {
+	cfg        UpstreamConfig
+	prefixes   []*net.IPNet // Parsed cfg.Prefixes, nil for all destinations.
+	clientNets []*net.IPNet // Client networks advertised to the next gateway.
+	ws         *wc.WSWriter // Writer of the session, nil while disconnected.
+	ip         string       // Tunnel IP assigned by the next gateway, empty while disconnected.
+	lock       sync.Mutex
+}
+
+/*
+SetUpstream chains client sessions to the next webtunnel gateway: the server opens a
+nested session to cfg.URL and sends it the client packets to cfg.Prefixes instead of
+writing them to the local interface, so clients connect to a regional gateway while their
+traffic egresses from the network of the next one. The client network of this server is
+advertised to the next gateway as a site (see SetSiteToSite, which the next gateway must
+enable for the hostname of this server), so client addresses are kept end to end and the
+answers are routed back. The client networks of chained gateways must not overlap.
+
+While the nested session is down chained packets are dropped rather than egressing
+locally, and the server reconnects every cfg.Retry. This should be called prior to Start.
+*/
+func (r *WebTunnelServer) SetUpstream(cfg UpstreamConfig) error {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+		return fmt.Errorf("invalid upstream URL %q", cfg.URL)
+	}
+	up := &upstream{cfg: cfg}
+	for _, p := range r.ipam.Prefixes() {
+		_, clientNet, err := net.ParseCIDR(p)
+		if err != nil {
+			return fmt.Errorf("invalid client network prefix %q", p)
+		}
+		up.clientNets = append(up.clientNets, clientNet)
+	}
+	for _, p := range cfg.Prefixes {
+		_, n, err := net.ParseCIDR(p)
+		if err != nil || n.IP.To4() == nil {
+			return fmt.Errorf("invalid upstream prefix %q", p)
+		}
+		up.prefixes = append(up.prefixes, n)
+	}
+	if up.cfg.Hostname == "" {
+		if up.cfg.Hostname, err = os.Hostname(); err != nil {
+			return fmt.Errorf("error getting hostname %w", err)
+		}
+	}
+	if up.cfg.Retry <= 0 {
+		up.cfg.Retry = defaultUpstreamRetry
+	}
+	r.upstream = up
+	return nil
+}
+
+// processUpstream keeps the nested session to the next gateway up and delivers the
+// packets it sends to the clients.
+func (r *WebTunnelServer) processUpstream() {
+	if r.upstream == nil {
+		return
+	}
+	for {
+		if r.isStopped.Load() {
+			glog.V(1).Info("Exiting upstream routine")
+			return
+		}
+		conn, err := r.connectUpstream()
+		if err != nil {
+			glog.Warningf("error connecting to next gateway %v: %v", r.upstream.cfg.URL, err)
+			time.Sleep(r.upstream.cfg.Retry)
+			continue
+		}
+		err = r.readUpstream(conn)
+		r.upstream.lock.Lock()
+		r.upstream.ws.Close()
+		r.upstream.ws = nil
+		r.upstream.ip = ""
+		r.upstream.lock.Unlock()
+		conn.Close()
+		if r.isStopped.Load() {
+			continue
+		}
+		glog.Warningf("session to next gateway %v lost: %v", r.upstream.cfg.URL, err)
+		time.Sleep(r.upstream.cfg.Retry)
+	}
+}
+
+// connectUpstream opens the nested session and has the next gateway route the client
+// network to it.
+func (r *WebTunnelServer) connectUpstream() (*websocket.Conn, error) {
+	up := r.upstream
+	header := http.Header{}
+	if up.cfg.Username != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(up.cfg.Username + ":" + up.cfg.Password))
+		header.Set("Authorization", "Basic "+cred)
+	}
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		TLSClientConfig:  up.cfg.TLSConfig,
+		HandshakeTimeout: 30 * time.Second,
+	}
+	conn, _, err := dialer.Dial(up.cfg.URL, header)
+	if err != nil {
+		return nil, err
+	}
+	ws := wc.NewWSWriter(conn, nil)
+	// The handshake must complete in time, the session has no traffic yet.
+	conn.SetReadDeadline(time.Now().Add(dialer.HandshakeTimeout))
+
+	user := up.cfg.Username
+	if user == "" {
+		user = "gateway"
+	}
+	if err := ws.WriteControlMessage(websocket.TextMessage, []byte("getConfig "+user+" "+up.cfg.Hostname)); err != nil {
+		return abortUpstream(conn, ws, err)
+	}
+	cfg := &wc.ClientConfig{}
+	if err := readUpstreamMessage(conn, ws.Codec(), "", cfg); err != nil {
+		return abortUpstream(conn, ws, fmt.Errorf("error reading config %w", err))
+	}
+
+	advert := up.advert()
+	if err := writeSiteAdvert(ws, advert); err != nil {
+		return abortUpstream(conn, ws, err)
+	}
+	ack := &wc.SiteAck{}
+	if err := readUpstreamMessage(conn, ws.Codec(), wc.SiteAckPrefix, ack); err != nil {
+		return abortUpstream(conn, ws, fmt.Errorf("error reading site ack %w", err))
+	}
+	if len(ack.Accepted) != len(advert.Prefixes) {
+		return abortUpstream(conn, ws, fmt.Errorf("next gateway refused to route %v", ack.Rejected))
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	up.lock.Lock()
+	up.ws = ws
+	up.ip = cfg.IP
+	up.lock.Unlock()
+	glog.Infof("Chained to next gateway %v as %v", up.cfg.URL, cfg.IP)
+	return conn, nil
+}
+
+// advert returns the advertisement of the client networks.
+func (up *upstream) advert() *wc.SiteAdvert {
+	up.lock.Lock()
+	defer up.lock.Unlock()
+	advert := &wc.SiteAdvert{}
+	for _, n := range up.clientNets {
+		advert.Prefixes = append(advert.Prefixes, n.String())
+	}
+	return advert
+}
+
+// isClientNet returns true if ip is in a client network.
+func (up *upstream) isClientNet(ip net.IP) bool {
+	up.lock.Lock()
+	defer up.lock.Unlock()
+	for _, n := range up.clientNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSiteAdvert sends advert to the next gateway.
+func writeSiteAdvert(ws *wc.WSWriter, advert *wc.SiteAdvert) error {
+	b, err := wc.EncodeControl(ws.Codec(), advert)
+	if err != nil {
+		return err
+	}
+	return ws.WriteControlMessage(websocket.TextMessage, append([]byte(wc.SiteAdvertPrefix), b...))
+}
+
+// advertiseUpstream adds the client network n, eg. a pool expansion, to the networks
+// routed back by the next gateway and advertises them again if connected.
+func (r *WebTunnelServer) advertiseUpstream(n *net.IPNet) {
+	up := r.upstream
+	if up == nil {
+		return
+	}
+	up.lock.Lock()
+	up.clientNets = append(up.clientNets, n)
+	ws := up.ws
+	up.lock.Unlock()
+	if ws == nil {
+		return // Advertised on reconnect.
+	}
+	if err := writeSiteAdvert(ws, up.advert()); err != nil {
+		glog.Warningf("error advertising %v to next gateway: %v", n, err)
+	}
+}
+
+// abortUpstream closes a nested session that failed to come up and returns err.
+func abortUpstream(conn *websocket.Conn, ws *wc.WSWriter, err error) (*websocket.Conn, error) {
+	ws.Close()
+	conn.Close()
+	return nil, err
+}
+
+// readUpstreamMessage reads the next text message starting with prefix into v,
+// skipping other messages.
+func readUpstreamMessage(conn *websocket.Conn, codec wc.Codec, prefix string, v any) error {
+	var chunks wc.ChunkAssembler
+	for {
+		mt, msg, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if mt != websocket.TextMessage {
+			continue
+		}
+		if wc.IsChunk(msg) {
+			if msg, err = chunks.Add(msg); err != nil || msg == nil {
+				continue
+			}
+		}
+		if !bytes.HasPrefix(msg, []byte(prefix)) {
+			continue
+		}
+		return wc.DecodeControl(codec, msg[len(prefix):], v)
+	}
+}
+
+// readUpstream delivers the packets from the next gateway to the clients until the
+// session fails.
+func (r *WebTunnelServer) readUpstream(conn *websocket.Conn) error {
+	r.upstream.lock.Lock()
+	codec := r.upstream.ws.Codec()
+	r.upstream.lock.Unlock()
+	for {
+		mt, pkt, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if mt == websocket.TextMessage && bytes.HasPrefix(pkt, []byte(wc.SiteAckPrefix)) {
+			r.processUpstreamAck(codec, pkt[len(wc.SiteAckPrefix):])
+			continue
+		}
+		if mt != websocket.BinaryMessage {
+			continue
+		}
+		// Only the client networks are routed to the session.
+		if len(pkt) < 20 || !r.upstream.isClientNet(net.IP(pkt[16:20])) {
+			glog.V(2).Info("dropping packet from next gateway outside the client network")
+			continue
+		}
+		wc.PrintPacketIPv4(pkt, "Server <- Upstream")
+		r.updateMetricsForPacket(len(pkt))
+		r.forwardClient(pkt)
+	}
+}
+
+// processUpstreamAck logs the client networks the next gateway refused to route after
+// they were advertised again.
+func (r *WebTunnelServer) processUpstreamAck(codec wc.Codec, msg []byte) {
+	ack := &wc.SiteAck{}
+	if err := wc.DecodeControl(codec, msg, ack); err != nil {
+		glog.Warningf("invalid site ack from next gateway: %v", err)
+		return
+	}
+	if len(ack.Rejected) > 0 {
+		glog.Errorf("next gateway refused to route %v", ack.Rejected)
+	}
+}
+
+// chainPacket sends a packet from a client to the next gateway and returns true if its
+// destination is chained, false if it egresses locally.
+func (r *WebTunnelServer) chainPacket(pkt []byte) bool {
+	up := r.upstream
+	if up == nil {
+		return false
+	}
+	dst := net.IP(pkt[16:20])
+	if up.isClientNet(dst) {
+		return false
+	}
+	if r.clientSubnets != nil || r.site != nil {
+		if _, ok := r.subnets.lookup(dst); ok {
+			return false
+		}
+	}
+	if up.prefixes != nil {
+		chained := false
+		for _, n := range up.prefixes {
+			if n.Contains(dst) {
+				chained = true
+				break
+			}
+		}
+		if !chained {
+			return false
+		}
+	}
+
+	up.lock.Lock()
+	ws := up.ws
+	up.lock.Unlock()
+	if ws == nil {
+		glog.V(2).Infof("dropping packet to %v, next gateway disconnected", dst)
+		r.metricsLock.Lock()
+		r.metrics.UpstreamDropped++
+		r.metricsLock.Unlock()
+		return true
+	}
+	wc.PrintPacketIPv4(pkt, "Server -> Upstream")
+	if err := ws.WriteDataMessage(websocket.BinaryMessage, pkt); err != nil {
+		glog.V(2).Infof("error writing to next gateway: %v", err)
+		return true
+	}
+	r.updateMetricsForPacket(len(pkt))
+	r.updateRouteMetrics(dst, len(pkt))
+	return true
+}
+
+// upstreamIP returns the tunnel IP of the nested session, empty if disconnected.
+func (r *WebTunnelServer) upstreamIP() string {
+	if r.upstream == nil {
+		return ""
+	}
+	r.upstream.lock.Lock()
+	defer r.upstream.lock.Unlock()
+	return r.upstream.ip
+}
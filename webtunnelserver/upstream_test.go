@@ -0,0 +1,136 @@
+package webtunnelserver
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/gorilla/websocket"
+)
+
+func TestUpstream(t *testing.T) {
+	// Next gateway routing the advertised client network to the nested session.
+	handshake := make(chan string, 2)
+	chained := make(chan []byte, 1)
+	next := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		c, err := (&websocket.Upgrader{}).Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, msg, _ := c.ReadMessage()
+		handshake <- string(msg)
+		c.WriteJSON(&wc.ClientConfig{IP: "10.8.0.5", GWIp: "10.8.0.1", Netmask: "255.255.255.0"})
+		_, msg, _ = c.ReadMessage()
+		handshake <- string(msg)
+		advert := &wc.SiteAdvert{}
+		wc.DecodeControl(wc.JSONCodec{}, msg[len(wc.SiteAdvertPrefix):], advert)
+		ack, _ := wc.EncodeControl(wc.JSONCodec{}, &wc.SiteAck{Accepted: advert.Prefixes})
+		c.WriteMessage(websocket.TextMessage, append([]byte(wc.SiteAckPrefix), ack...))
+		for {
+			mt, pkt, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if mt == websocket.TextMessage {
+				handshake <- string(pkt) // Advertised again.
+			}
+			if mt == websocket.BinaryMessage {
+				chained <- pkt
+				c.WriteMessage(websocket.BinaryMessage, createIPv4Pkt(net.IP{8, 8, 8, 8}, pkt[12:16]))
+			}
+		}
+	}))
+	defer next.Close()
+
+	ws, client := wsPair(t)
+	defer ws.Close()
+	defer client.Close()
+	ipam, _ := NewIPPam("192.168.0.0/24")
+	ip, _ := ipam.AcquireIP(ws)
+	ipam.SetIPActiveWithUserInfo(ip, "user", "laptop")
+	r := &WebTunnelServer{ipam: ipam, clientNetPrefix: "192.168.0.0/24", metrics: &Metrics{}, conns: make(map[string]*wc.WSWriter)}
+
+	if err := r.SetUpstream(UpstreamConfig{URL: "http://next"}); err == nil {
+		t.Error("Expected error for non websocket URL")
+	}
+	if err := r.SetUpstream(UpstreamConfig{URL: "ws://next/ws", Prefixes: []string{"bogus"}}); err == nil {
+		t.Error("Expected error for invalid prefix")
+	}
+	if err := r.SetUpstream(UpstreamConfig{
+		URL:      "ws" + strings.TrimPrefix(next.URL, "http") + "/ws",
+		Hostname: "regional",
+		Prefixes: []string{"8.8.0.0/16"},
+	}); err != nil {
+		t.Fatalf("SetUpstream failed: %v", err)
+	}
+
+	// Chained packets are dropped rather than egressing locally until connected.
+	out := createIPv4Pkt(net.ParseIP(ip).To4(), net.IP{8, 8, 8, 8})
+	if !r.chainPacket(out) {
+		t.Error("Expected packet chained")
+	}
+	if r.metrics.UpstreamDropped != 1 {
+		t.Errorf("Expected dropped packet counted, got %v", r.metrics.UpstreamDropped)
+	}
+
+	conn, err := r.connectUpstream()
+	if err != nil {
+		t.Fatalf("connectUpstream failed: %v", err)
+	}
+	go r.readUpstream(conn)
+	defer conn.Close()
+	if got := <-handshake; got != "getConfig gateway regional" {
+		t.Errorf("Unexpected config request %q", got)
+	}
+	if got := <-handshake; !strings.Contains(got, "192.168.0.0/24") {
+		t.Errorf("Expected client network advertised, got %q", got)
+	}
+	if got := r.upstreamIP(); got != "10.8.0.5" {
+		t.Errorf("Expected upstream IP, got %q", got)
+	}
+
+	// Packets to other destinations and to clients egress locally.
+	for _, dst := range []net.IP{{1, 1, 1, 1}, {192, 168, 0, 9}} {
+		if r.chainPacket(createIPv4Pkt(net.ParseIP(ip).To4(), dst)) {
+			t.Errorf("Expected packet to %v not chained", dst)
+		}
+	}
+
+	// Chained packets keep the client source and answers reach the client.
+	if !r.chainPacket(out) {
+		t.Error("Expected packet chained")
+	}
+	select {
+	case got := <-chained:
+		if !bytes.Equal(got, out) {
+			t.Errorf("Got chained packet %x want %x", got, out)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected packet at next gateway")
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := createIPv4Pkt(net.IP{8, 8, 8, 8}, net.ParseIP(ip).To4())
+	if _, got, err := client.ReadMessage(); err != nil || !bytes.Equal(got, reply) {
+		t.Errorf("Expected answer at client, got %x %v", got, err)
+	}
+
+	// Client networks brought online later, eg. by pool expansion, are advertised again.
+	r.advertiseUpstream(&net.IPNet{IP: net.IP{10, 9, 0, 0}, Mask: net.CIDRMask(29, 32)})
+	select {
+	case got := <-handshake:
+		if !strings.Contains(got, "192.168.0.0/24") || !strings.Contains(got, "10.9.0.0/29") {
+			t.Errorf("Expected both client networks advertised, got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected advertisement at next gateway")
+	}
+	if r.chainPacket(createIPv4Pkt(net.ParseIP(ip).To4(), net.IP{10, 9, 0, 2})) {
+		t.Error("Expected packet to the new client network not chained")
+	}
+}
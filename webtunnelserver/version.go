@@ -0,0 +1,55 @@
+package webtunnelserver
+
+import (
+	"net/http"
+
+	"github.com/deepakkamesh/webtunnel/webtunnelcommon/version"
+	"github.com/golang/glog"
+)
+
+// SetMinClientVersion refuses handshakes from clients older than min (eg. 1.4.0) with
+// 426 Upgrade Required and an actionable message. Development builds of the client are
+// always accepted. This should be called prior to Start.
+func (r *WebTunnelServer) SetMinClientVersion(min string) error {
+	if _, err := version.Parse(min); err != nil {
+		return err
+	}
+	r.minClientVersion = min
+	return nil
+}
+
+// checkClientVersion refuses the handshake if the client version is too old.
+func (r *WebTunnelServer) checkClientVersion(w http.ResponseWriter, rcv *http.Request) bool {
+	err := version.Check("server", "client", rcv.Header.Get(version.Header), r.minClientVersion)
+	if err == nil {
+		return true
+	}
+	glog.Warningf("refused client %v: %v", rcv.RemoteAddr, err)
+	http.Error(w, err.Error(), http.StatusUpgradeRequired)
+	return false
+}
+
+// setClientVersion records the version reported by the client on ip.
+func (r *WebTunnelServer) setClientVersion(ip, v string) {
+	r.connMapLock.Lock()
+	defer r.connMapLock.Unlock()
+	if r.clientVersions == nil {
+		r.clientVersions = make(map[string]string)
+	}
+	if v == "" {
+		v = "unknown"
+	}
+	r.clientVersions[ip] = v
+}
+
+// clientVersionSnapshot returns the client versions keyed by IP. It must not be called
+// with metricsLock held.
+func (r *WebTunnelServer) clientVersionSnapshot() map[string]string {
+	r.connMapLock.Lock()
+	defer r.connMapLock.Unlock()
+	m := make(map[string]string)
+	for ip, v := range r.clientVersions {
+		m[ip] = v
+	}
+	return m
+}
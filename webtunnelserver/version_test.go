@@ -0,0 +1,54 @@
+package webtunnelserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/deepakkamesh/webtunnel/webtunnelcommon/version"
+)
+
+func TestClientVersion(t *testing.T) {
+	for _, tc := range []struct {
+		v    string
+		want version.Semver
+		err  bool
+	}{
+		{"1.4.2", version.Semver{Major: 1, Minor: 4, Patch: 2}, false},
+		{"v2.1", version.Semver{Major: 2, Minor: 1}, false},
+		{"1.5.0-rc1+abc", version.Semver{Major: 1, Minor: 5}, false},
+		{"1.x", version.Semver{}, true},
+		{"1.2.3.4", version.Semver{}, true},
+	} {
+		got, err := version.Parse(tc.v)
+		if (err != nil) != tc.err || (!tc.err && got != tc.want) {
+			t.Errorf("Parse(%q) = %v %v, want %v", tc.v, got, err, tc.want)
+		}
+	}
+
+	r := &WebTunnelServer{}
+	if err := r.SetMinClientVersion("latest"); err == nil {
+		t.Error("Expected error for invalid version")
+	}
+	r.SetMinClientVersion("1.4")
+	for v, ok := range map[string]bool{"1.4.0": true, "2.0.0": true, "dev": true, "1.3.9": false, "": false} {
+		req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		if v != "" {
+			req.Header.Set(version.Header, v)
+		}
+		rec := httptest.NewRecorder()
+		if got := r.checkClientVersion(rec, req); got != ok {
+			t.Errorf("Client %q accepted %v, want %v", v, got, ok)
+		}
+		if !ok && (rec.Code != http.StatusUpgradeRequired || !strings.Contains(rec.Body.String(), "server requires client >= 1.4.0")) {
+			t.Errorf("Unexpected refusal of %q: %v %q", v, rec.Code, rec.Body.String())
+		}
+	}
+
+	r.setClientVersion("10.0.0.2", "1.4.0")
+	r.setClientVersion("10.0.0.3", "")
+	if m := r.clientVersionSnapshot(); m["10.0.0.2"] != "1.4.0" || m["10.0.0.3"] != "unknown" {
+		t.Errorf("Unexpected client versions %v", m)
+	}
+}
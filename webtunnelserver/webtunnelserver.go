@@ -5,19 +5,26 @@ See examples for implementation.
 package webtunnelserver
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/deepakkamesh/webtunnel/ipam"
 	wc "github.com/deepakkamesh/webtunnel/webtunnelcommon"
+	"github.com/deepakkamesh/webtunnel/webtunnelcommon/metrics"
+	"github.com/deepakkamesh/webtunnel/webtunnelcommon/version"
 	"github.com/golang/glog"
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"github.com/gorilla/websocket"
 	"github.com/songgao/water"
 )
@@ -28,39 +35,162 @@ var InitTunnel = initializeTunnel
 // NewWaterInterface (Overridable) New initialized water interface.
 var NewWaterInterface = wc.NewWaterInterface
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  4096,
-	WriteBufferSize: 4096,
-}
+// AddTunnelRoute (Overridable) Route a subnet into the tunnel interface.
+var AddTunnelRoute = addTunnelRoute
+
+// DeleteTunnelRoute (Overridable) Remove a route added with AddTunnelRoute.
+var DeleteTunnelRoute = deleteTunnelRoute
+
+// ManagementNets (Overridable) returns the networks of the server itself, checked for
+// overlaps with the advertised routes.
+var ManagementNets = localNets
+
+// Minimum IPv4 header length.
+const ipv4HeaderLen = 20
+
+// Time Stop waits for HTTP requests in progress and for each client close message.
+const (
+	shutdownTimeout = 10 * time.Second
+	closeTimeout    = time.Second
+)
 
 // Metrics is the system metrics structure.
 type Metrics struct {
-	Users    int // Total connected users.
-	MaxUsers int // Maximum users supported by endpoint.
-	Packets  int // total packets.
-	Bytes    int // bytes pushed.
+	Users            int                     // Total connected users.
+	MaxUsers         int                     // Maximum users supported by endpoint.
+	Packets          int                     // total packets.
+	Bytes            int                     // bytes pushed.
+	Routes           map[string]RouteMetrics // Traffic per configured route prefix.
+	RateLimited      int                     // Packets dropped by the per client packet rate limit.
+	ShedSessions     int                     // Sessions refused while overloaded.
+	ShedPackets      int                     // Low priority packets dropped while overloaded.
+	Latency          map[string]LatencyStats // Keepalive RTT per client IP.
+	Loss             map[string]wc.LossStats // Data frame loss and reordering per client IP.
+	Tags             map[string][]string     // Admin tags per client IP, for metric labels.
+	Labels           map[string]Labels       // Auth backend labels per client IP, for metric labels.
+	Malformed        int                     // Packets dropped with invalid IPv4 headers.
+	NonIPv4          int                     // Packets of other IP versions (eg. IPv6) dropped.
+	IPOptions        int                     // Packets with IPv4 options.
+	Fragments        int                     // IPv4 fragments.
+	NestedTunnels    int                     // IPIP and GRE packets.
+	FragsReassembled int                     // Datagrams reassembled from fragments.
+	FragsDropped     int                     // Fragments dropped by policy, timeout or limits.
+	Version          string                  // Server version.
+	PoolUtilization  float64                 // Fraction of the client IP pool allocated.
+	PoolLevel        PoolLevel               // Client IP pool utilization alarm level.
+	PoolRejected     int                     // Sessions refused while the IP pool is critical.
+	ClientNets       []string                // Client network prefixes online, including pool expansions.
+	HandshakeRefused int                     // Messages refused as out of order for the handshake.
+	ImpairDropped    int                     // Packets dropped by a configured impairment.
+	PacingDropped    int                     // Packets to clients dropped by pacing.
+	Bandwidth        map[string]float64      // Estimated downstream bytes per second per paced client IP.
+	CertExpiry       time.Time               // Expiry of the HTTPS certificate, zero if unknown.
+	CertReloads      int                     // Renewed or ACME issued HTTPS certificates loaded since start.
+	Banned           int                     // Handshakes and sessions refused by the ban list.
+	ClientVersions   map[string]string       // Client version per client IP.
+	SessionIDs       map[string]string       // Session ID per client IP, to correlate metrics with logs.
+	P2POffers        int                     // Direct paths offered to pairs of clients.
+	P2PPaths         int                     // Direct paths established by clients.
+	P2PFailures      int                     // Direct paths refused or failed, relayed via the server.
+	UpstreamIP       string                  // Tunnel IP of the session to the next gateway, empty while disconnected.
+	UpstreamDropped  int                     // Chained packets dropped while the next gateway was disconnected.
+	NATBindings      int                     // Egress NAT bindings of client flows, if NAT is monitored.
+	NATPortUsage     float64                 // Highest fraction of an egress IP port pool bound, if NAT is monitored.
+	DNSUpstreams     []UpstreamStats         // Upstream statistics of the DNS forwarder, nil if none.
+	DeadPeers        int                     // Sessions closed for leaving a ping unanswered.
+	LeasesExpired    int                     // Sessions closed as their IP lease expired.
+	AgentDenied      int                     // Packets of agent sessions dropped outside their allowed destinations.
+}
+
+// RouteMetrics is the traffic seen for an advertised route prefix (both directions).
+type RouteMetrics struct {
+	Packets int // total packets.
+	Bytes   int // bytes pushed.
 }
 
 // WebTunnelServer represents a webtunnel server struct.
 type WebTunnelServer struct {
-	serverIPPort       string                     // IP Port for binding on server.
-	ifce               wc.Interface               // Tunnel interface handle.
-	conns              map[string]*websocket.Conn // Websocket connection.
-	routePrefix        []string                   // Route prefix for client config.
-	tunNetmask         string                     // Netmask for clients.
-	clientNetPrefix    string                     // IP range for clients.
-	gwIP               string                     // Tunnel IP address of server.
-	ipam               *IPPam                     // Client IP Address manager.
-	httpsKeyFile       string                     // Key file for HTTPS.
-	httpsCertFile      string                     // Cert file for HTTPS.
-	Error              chan error                 // Channel to handle error from goroutine.
-	dnsIPs             []string                   // DNS server IPs.
-	metrics            *Metrics                   // Metrics.
-	secure             bool                       // Start Server with https.
-	customHTTPHandlers map[string]http.Handler    // Array of custom HTTP handlers.
-	metricsLock        sync.Mutex                 // Mutex for metrics write
-	connMapLock        sync.Mutex                 // Mutex for Connection Map
-	isStopped          bool                       // Flag to signal server should shutdown
+	serverIPPort       string                  // IP Port for binding on server.
+	ifce               wc.Interface            // Tunnel interface handle.
+	conns              map[string]*wc.WSWriter // Websocket connection writers.
+	routePrefix        []string                // Route prefix for client config.
+	routeNets          []*net.IPNet            // Parsed route prefix for metrics.
+	tunNetmask         string                  // Netmask for clients.
+	clientNetPrefix    string                  // IP range for clients.
+	gwIP               string                  // Tunnel IP address of server.
+	ipam               ipam.Manager            // Client IP Address manager.
+	httpsKeyFile       string                  // Key file for HTTPS.
+	httpsCertFile      string                  // Cert file for HTTPS.
+	Error              chan error              // Channel to handle error from goroutine.
+	dnsIPs             []string                // DNS server IPs.
+	metrics            *Metrics                // Metrics.
+	secure             bool                    // Start Server with https.
+	customHTTPHandlers map[string]http.Handler // Array of custom HTTP handlers.
+	metricsLock        sync.Mutex              // Mutex for metrics write
+	connMapLock        sync.Mutex              // Mutex for Connection Map
+	isStopped          atomic.Bool             // Flag to signal server should shutdown
+	quarantine         *quarantine             // Quarantine policy, nil if disabled.
+	posturePolicy      PosturePolicy           // Device posture policy, nil if disabled.
+	obfs               *wc.ObfuscationPolicy   // Data frame obfuscation, nil if disabled.
+	instanceID         string                  // Gateway instance ID for load balancer affinity.
+	serverList         *wc.ServerList          // Gateways advertised on /servers.
+	tracer             wc.Tracer               // Tracer for handshake and control operations.
+	copyDSCP           bool                    // Copy inner DSCP to websocket connections.
+	listener           net.Listener            // Server socket.
+	tlsConfig          *tls.Config             // HTTPS config with loaded certificates.
+	certs              *certStore              // Certificate loaded from files, nil if injected.
+	acme               *acmeManager            // ACME certificate management, nil if disabled.
+	baseTLSConfig      *tls.Config             // User supplied HTTPS config, nil for defaults.
+	tlsOptions         TLSOptions              // HTTPS hardening options.
+	pktLimiter         *packetLimiter          // Per client packet rate limit, nil if disabled.
+	inspector          PacketInspector         // Packet inspection hook, nil if disabled.
+	mirror             io.Writer               // Tap for packets mirrored by the inspector.
+	connTrack          *connTrack              // Per session flow tables, nil if disabled.
+	forwards           portForwards            // Reverse tunnels to client ports.
+	shedder            *loadShedder            // Load shedding watermarks, nil if disabled.
+	rtt                *rttTracker             // Keepalive RTT stats per session.
+	loss               *lossTracker            // Data frame loss stats per session.
+	tokens             sessionTokens           // Owners of the issued session tokens.
+	schedule           AccessSchedule          // Access windows per user, nil if unrestricted.
+	routeAnalysis      RouteAnalysis           // Route validation result at startup.
+	blockNested        bool                    // Drop IPIP and GRE packets.
+	fragPolicy         FragmentPolicy          // Handling of IPv4 fragments.
+	frags              *fragReassembler        // Fragment reassembly, nil unless reassembling.
+	auth               Authenticator           // Handshake authentication, nil if disabled.
+	acct               *radiusAccounting       // RADIUS accounting, nil if disabled.
+	clientSubnets      ClientSubnets           // Subnets behind clients, nil if disabled.
+	subnets            subnetTable             // Subnets routed to connected clients.
+	site               *siteToSite             // Site gateways, nil if site-to-site is disabled.
+	captures           captureTable            // Session captures streamed to sinks.
+	keepalives         keepaliveTable          // Ping intervals negotiated by clients.
+	ipLeases           bool                    // Expire the IPs of clients not heard from.
+	minClientVersion   string                  // Oldest client version accepted, empty for any.
+	clientVersions     map[string]string       // Version reported by each client IP.
+	sessionIDs         map[string]string       // Session ID of each client IP, for logs and support.
+	capabilities       map[string][]string     // Control capabilities accepted for each client IP.
+	clientReports      map[string]clientReport // Last metrics report of each client IP.
+	impair             impairments             // Latency, jitter and loss added for testing.
+	landing            LandingPage             // Response on / and paths without a handler.
+	mux                *http.ServeMux          // Handlers of the server.
+	httpServer         *http.Server            // HTTP server for clients and handlers.
+	pacing             *pacers                 // Downstream pacing, nil if disabled.
+	moves              sessionMoves            // Sessions waiting for the client to apply a new IP.
+	bans               *banList                // Offences and bans of misbehaving clients, nil if disabled.
+	leases             *configLeases           // Configs fetched out-of-band, nil if disabled.
+	dnsRoutes          []wc.DNSRoute           // Split DNS map sent to clients, nil if disabled.
+	p2p                *p2pBroker              // Peer-to-peer broker, nil if disabled.
+	upstream           *upstream               // Next gateway client traffic is chained to, nil if disabled.
+	nat                *natMonitor             // Egress NAT table sampler, nil if disabled.
+	tcpOpts            *wc.TCPOptions          // Options of the client TCP connections, nil for OS defaults.
+	bufferSize         int                     // Websocket buffer size holding a data frame whole.
+	dns                *DNSForwarder           // DNS forwarder run with the server, nil if none.
+	sla                *slaTracker             // Connected and down time of clients, nil if disabled.
+	expansion          *poolExpansion          // Secondary client network, nil if the pool does not expand.
+	stats              *statsStore             // Session statistics store, nil if disabled.
+	reservationsFile   string                  // File of the IP reservations, empty if none.
+	admin              *adminAPI               // Admin REST API, nil if disabled.
+	agents             *agentPolicy            // Restricted sessions of automation agents, nil if disabled.
+	prom               *metrics.Tunnel         // Collectors served on /metrics.
 }
 
 /*
@@ -87,13 +217,30 @@ httpsCertFile: HTTPS Cert file for secured connections.
 func NewWebTunnelServer(serverIPPort, gwIP, tunNetmask, clientNetPrefix string, dnsIPs []string,
 	routePrefix []string, secure bool, httpsKeyFile string, httpsCertFile string) (*WebTunnelServer, error) {
 
+	routeNets, clientNet, err := parseRoutes(routePrefix, clientNetPrefix)
+	if err != nil {
+		return nil, err
+	}
+	mgmtNets, err := ManagementNets()
+	if err != nil {
+		glog.Warningf("unable to get management networks: %v", err)
+	}
+	analysis := analyzeRoutes(routeNets, clientNet, mgmtNets)
+	for _, w := range analysis.Warnings {
+		glog.Warning(w)
+	}
+	// Advertise the summarized routes to keep the client config and DHCP options small.
+	if len(analysis.Advertised) < len(routePrefix) {
+		glog.Infof("Summarized %v route prefixes to %v", len(routePrefix), len(analysis.Advertised))
+	}
+
 	// Create TUN interface and initialize it.
 	ifce, err := NewWaterInterface(water.Config{
 		DeviceType: water.TUN,
 	})
 
 	if err != nil {
-		return nil, fmt.Errorf("error creating TUN int %s", err)
+		return nil, fmt.Errorf("error creating TUN int %w", err)
 	}
 	if err := InitTunnel(ifce.Name(), gwIP, tunNetmask); err != nil {
 		return nil, err
@@ -108,13 +255,21 @@ func NewWebTunnelServer(serverIPPort, gwIP, tunNetmask, clientNetPrefix string,
 		return nil, err
 	}
 
-	metrics := &Metrics{}
+	instanceID, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("could not get hostname: %w", err)
+	}
+
+	metrics := &Metrics{Routes: make(map[string]RouteMetrics)}
 	metrics.MaxUsers = getMaxUsers(clientNetPrefix)
-	return &WebTunnelServer{
+	bufferSize, _ := wc.FrameBufferSize(wc.MaxPacketSize, nil)
+	mux := http.NewServeMux()
+	r := &WebTunnelServer{
 		serverIPPort:       serverIPPort,
 		ifce:               ifce,
-		conns:              make(map[string]*websocket.Conn),
-		routePrefix:        routePrefix,
+		conns:              make(map[string]*wc.WSWriter),
+		routePrefix:        analysis.Advertised,
+		routeNets:          routeNets,
 		tunNetmask:         tunNetmask,
 		clientNetPrefix:    clientNetPrefix,
 		gwIP:               gwIP,
@@ -126,19 +281,81 @@ func NewWebTunnelServer(serverIPPort, gwIP, tunNetmask, clientNetPrefix string,
 		metrics:            metrics,
 		secure:             secure,
 		customHTTPHandlers: make(map[string]http.Handler),
-		isStopped:          false,
-	}, nil
+		instanceID:         instanceID,
+		tracer:             wc.NopTracer{},
+		rtt:                newRTTTracker(),
+		loss:               newLossTracker(),
+		routeAnalysis:      analysis,
+		mux:                mux,
+		httpServer:         &http.Server{Handler: mux},
+		bufferSize:         bufferSize,
+	}
+	r.initPrometheus()
+	r.registerBuiltins()
+	return r, nil
 }
 
-// SetCustomHandler sets any custom http end point handler. This should be called prior to Start.
+// SetCustomHandler sets any custom http end point handler. A handler for / replaces the
+// landing page (see SetLandingPage). The built-in endpoints cannot be overridden. This
+// should be called prior to Start.
 func (r *WebTunnelServer) SetCustomHandler(endpoint string, h http.Handler) error {
-	if endpoint == "/ws" {
-		return fmt.Errorf("cannot override ws handler")
+	for _, e := range builtinEndpoints {
+		if endpoint == e {
+			return fmt.Errorf("cannot override %v handler", e)
+		}
+	}
+	if endpoint == "/version" && r.landing.ShowVersion {
+		return fmt.Errorf("cannot override version handler")
+	}
+	if strings.HasPrefix(endpoint, AdminPrefix) && r.admin != nil && r.admin.cfg.Addr == "" {
+		return fmt.Errorf("cannot override admin API handler")
 	}
 	r.customHTTPHandlers[endpoint] = h
 	return nil
 }
 
+// SetObfuscation sets the padding and timing obfuscation policy for data frames sent
+// to clients. The websocket buffers grow to hold padded frames whole. This should be
+// called prior to Start.
+func (r *WebTunnelServer) SetObfuscation(p *wc.ObfuscationPolicy) error {
+	size, err := wc.FrameBufferSize(wc.MaxPacketSize, p)
+	if err != nil {
+		return fmt.Errorf("invalid obfuscation policy %w", err)
+	}
+	r.obfs = p
+	r.bufferSize = size
+	return nil
+}
+
+// SetCopyDSCP enables copying the DSCP of tunneled packets to the websocket TCP
+// connections for QoS-aware networks. This should be called prior to Start.
+func (r *WebTunnelServer) SetCopyDSCP(enable bool) {
+	r.copyDSCP = enable
+}
+
+// SetTCPOptions sets the keepalive timers and congestion control of the client TCP
+// connections, eg. bbr for long fat networks. This should be called prior to Listen.
+func (r *WebTunnelServer) SetTCPOptions(o wc.TCPOptions) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	r.tcpOpts = &o
+	return nil
+}
+
+// SetDNSForwarder runs d with the server: it is started by Start and stopped by Stop,
+// and the statistics of its upstreams are reported in the metrics until then. This
+// should be called prior to Start.
+func (r *WebTunnelServer) SetDNSForwarder(d *DNSForwarder) {
+	r.dns = d
+}
+
+// SetTracer sets the tracer for the upgrade, IP allocation and config operations. The
+// trace ID propagated by the client in the handshake headers is continued.
+func (r *WebTunnelServer) SetTracer(t wc.Tracer) {
+	r.tracer = t
+}
+
 // Start the webtunnel server.
 // All processing functions are goroutines
 // The user of Webtunnel must wait on the r.Error
@@ -156,42 +373,191 @@ func (r *WebTunnelServer) Start() {
 	// Routinely sends Ping packets to the Websocket interface.
 	// Used to calculate clients average latency.
 	go r.processPings()
+
+	// Samples resource usage for load shedding.
+	go r.processWatermarks()
+
+	// Disconnects clients outside their access window.
+	go r.processAccessSchedule()
+
+	// Sends interim accounting records.
+	go r.processRADIUSInterim()
+
+	// Sends keepalives to site gateways and withdraws routes of dead ones.
+	go r.processSitePeers()
+
+	// Obtains and renews the ACME certificate.
+	go r.processACME()
+
+	// Learns the public UDP addresses of clients for peer-to-peer paths.
+	go r.processRendezvous()
+
+	// Keeps the session to the next gateway of chained traffic up.
+	go r.processUpstream()
+
+	// Samples the egress NAT table for port exhaustion.
+	go r.processNATMonitor()
+
+	// Releases the IPs of expired leases.
+	go r.processIPLeases()
+
+	// Stores the traffic of sessions.
+	go r.processStats()
+
+	// Serves the admin API on its own listener.
+	r.startAdmin()
+
+	// Answers the DNS queries of clients.
+	if r.dns != nil {
+		r.dns.Start()
+	}
 }
 
 func (r *WebTunnelServer) serveClients() {
 	// Start the HTTP Server.
-	http.HandleFunc("/", r.httpEndpoint)
-	http.HandleFunc("/ws", r.wsEndpoint)
-	http.HandleFunc("/metrichealthz", r.healthEndpoint)
-	http.HandleFunc("/metricvarz", r.metricEndpoint)
+	r.registerHandlers()
 
-	// Start the custom handlers.
-	for e, h := range r.customHTTPHandlers {
-		http.Handle(e, h)
+	if r.listener == nil {
+		if err := r.Listen(); err != nil {
+			log.Fatal(err)
+		}
 	}
-
+	srv := r.httpServer
+	if srv.TLSConfig == nil {
+		srv.TLSConfig = r.tlsConfig
+	}
+	var err error
 	if r.secure {
-		log.Fatal(http.ListenAndServeTLS(r.serverIPPort, r.httpsCertFile, r.httpsKeyFile, nil))
+		err = srv.ServeTLS(r.listener, "", "")
 	} else {
-		log.Fatal(http.ListenAndServe(r.serverIPPort, nil))
+		err = srv.Serve(r.listener)
+	}
+	// Stop shuts the server down.
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
 	}
 }
 
-// Stop the webtunnel server gracefully.
-// All Websocket connections with peer will be terminated
-// The tun interface handle will be closed
-//
-//	and this will eventually send nil to r.Error to let
-//
-// the Server Caller that the whole serving process is ended
+// Listen binds the server socket and loads the HTTPS certificates. It is called by
+// Start if needed; call it before DropPrivileges to bind privileged ports as root.
+func (r *WebTunnelServer) Listen() error {
+	if r.secure && r.acme != nil {
+		r.tlsConfig = r.buildTLSConfig(tls.Certificate{})
+		go r.processTicketRotation(r.tlsConfig)
+		if r.acme.cfg.Challenge == ACMEHTTP01 {
+			l, err := net.Listen("tcp", r.acme.cfg.HTTPAddr)
+			if err != nil {
+				return fmt.Errorf("error listening for ACME challenges %w", err)
+			}
+			r.acme.listener = l
+		}
+	} else if r.secure {
+		mod, err := certModTime(r.httpsCertFile, r.httpsKeyFile)
+		if err != nil {
+			return fmt.Errorf("error loading certificate %w", err)
+		}
+		cert, err := tls.LoadX509KeyPair(r.httpsCertFile, r.httpsKeyFile)
+		if err != nil {
+			return fmt.Errorf("error loading certificate %w", err)
+		}
+		r.tlsConfig = r.buildTLSConfig(cert)
+		go r.processTicketRotation(r.tlsConfig)
+		if r.certs != nil {
+			r.certs.modTime = mod
+			// Picks up renewed certificate files and warns before expiry.
+			go r.processCertReload()
+		}
+	}
+	l, err := net.Listen("tcp", r.serverIPPort)
+	if err != nil {
+		return err
+	}
+	if r.tcpOpts != nil {
+		l = &wc.TCPOptionsListener{Listener: l, Options: *r.tcpOpts, OnError: func(c net.Conn, err error) {
+			glog.Warningf("error setting TCP options for %v: %v", c.RemoteAddr(), err)
+		}}
+	}
+	r.listener = l
+	return nil
+}
+
+/*
+Stop the webtunnel server gracefully. New connections are refused and the HTTP server
+and DNS forwarder are shut down, waiting up to shutdownTimeout for requests and queries
+in progress. Client websockets
+are closed with a normal closure and their IPs released, and the tun interface is
+closed, which eventually sends nil to r.Error to let the caller know the whole serving
+process is ended.
+*/
 func (r *WebTunnelServer) Stop() {
+	if r.isStopped.Load() {
+		return
+	}
 	glog.V(1).Info("Shutting down Server gracefully")
-	r.isStopped = true
+	r.isStopped.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if r.httpServer != nil {
+		if err := r.httpServer.Shutdown(ctx); err != nil {
+			glog.Warningf("error shutting down HTTP server: %v", err)
+		}
+	}
+	r.stopAdmin(ctx)
+	r.metricsLock.Lock()
+	dns := r.dns
+	r.dns = nil
+	r.metricsLock.Unlock()
+	if dns != nil {
+		if err := dns.Stop(ctx); err != nil {
+			glog.Warningf("DNS queries abandoned at shutdown: %v", err)
+		}
+	}
+
+	r.connMapLock.Lock()
+	conns := make(map[string]*wc.WSWriter, len(r.conns))
+	for ip, ws := range r.conns {
+		conns[ip] = ws
+	}
+	r.connMapLock.Unlock()
+	for ip, ws := range conns {
+		r.sendDisconnect(ws, ip, "server shutting down")
+		// Released first so the reader of the connection does not report an error.
+		r.slaDisconnect(ip, false)
+		r.releaseIP(ip)
+		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "server shutting down")
+		if err := ws.Conn().WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeTimeout)); err != nil {
+			glog.V(1).Infof("error closing websocket of %v: %v", ip, err)
+		}
+		ws.Close()
+		ws.Conn().Close()
+	}
+	glog.V(1).Infof("Closed %v client connections", len(conns))
+
+	if r.p2p != nil {
+		r.p2p.conn.Close()
+	}
+	if r.upstream != nil {
+		r.upstream.lock.Lock()
+		if r.upstream.ws != nil {
+			r.upstream.ws.Conn().Close()
+		}
+		r.upstream.lock.Unlock()
+	}
+	if r.ifce != nil {
+		if err := r.ifce.Close(); err != nil {
+			glog.Errorf("interface close issue when shutting down: %v", err)
+		}
+	}
 }
 
-// PongHandler handles the pong messages from a client
+// PongHandler handles the pong messages from a client and records the RTT of the ping.
 func (r *WebTunnelServer) PongHandler(ip string) func(string) error {
 	return func(aStr string) error {
+		r.rtt.pongReceived(ip, time.Now())
+		r.keepalivePonged(ip)
+		r.renewIPLease(ip)
+		r.siteAlive(ip)
 		bt := []byte(aStr)
 		val, _ := binary.Varint(bt)
 		glog.V(2).Infof("Client %v answered, nano diff is %v", ip, val)
@@ -200,33 +566,49 @@ func (r *WebTunnelServer) PongHandler(ip string) func(string) error {
 }
 
 // processPings() processes the websocket pings sent from the server to the client
-// Those are used to measure the latency seen with the clients.
+// at the interval negotiated by each client (see processKeepalive).
 func (r *WebTunnelServer) processPings() {
-	// Small delay before sending pings
 	glog.Info("Pings processing routine active")
-	time.Sleep(60 * time.Second)
 	for {
-		if r.isStopped {
+		time.Sleep(time.Second)
+		if r.isStopped.Load() {
 			glog.V(1).Info("Exiting Ping routine")
 			return
 		}
-		glog.V(1).Info("Iterating among connections for Pings")
+		now := time.Now()
+		dead := 0
 		r.connMapLock.Lock()
-		for ip, wsConn := range r.conns {
+		for ip, ws := range r.conns {
+			// Closing the connection ends the read loop, which releases the IP.
+			if r.peerDead(ip, now) {
+				glog.Warningf("client %v left a ping unanswered for %v, closing session", ip, r.keepalives.timeout)
+				dead++
+				ws.Conn().Close()
+				continue
+			}
+			if !r.pingDue(ip, now) {
+				continue
+			}
 			// Send ping (Pong handler was setup soon after when wsConn was created)
 			buf := make([]byte, binary.MaxVarintLen64)
-			tV := time.Now().UTC().UnixNano()
+			tV := now.UTC().UnixNano()
 			binary.PutVarint(buf, tV)
+			r.rtt.pingSent(ip, now)
+			r.keepalivePinged(ip, now)
 			// pings sent have a deadline of 5 seconds
-			if err := wsConn.WriteControl(websocket.PingMessage, buf, time.Now().Add(time.Duration(5*time.Second))); err != nil {
+			if err := ws.Conn().WriteControl(websocket.PingMessage, buf, time.Now().Add(time.Duration(5*time.Second))); err != nil {
 				glog.Warningf("issue sending ping to %v, reason: %v", ip, err)
 			} else {
 				glog.V(2).Infof("Ping sent to %v", ip)
 			}
 		}
 		r.connMapLock.Unlock()
-		glog.V(1).Info("Waiting 60 seconds before next ping batch")
-		time.Sleep(60 * time.Second)
+		// metricsLock is taken after connMapLock is released, GetMetrics takes them the other way.
+		if dead > 0 {
+			r.metricsLock.Lock()
+			r.metrics.DeadPeers += dead
+			r.metricsLock.Unlock()
+		}
 	}
 }
 
@@ -235,95 +617,282 @@ func (r *WebTunnelServer) processPings() {
 // relevant client via the appropriate websocket connection.
 func (r *WebTunnelServer) processTUNPacket() {
 	defer func() { r.Error <- nil }()
-	pkt := make([]byte, 2048)
+	pkt := make([]byte, wc.MaxPacketSize)
 	var oPkt []byte
 
 	for {
-		if r.isStopped {
+		if r.isStopped.Load() {
 			glog.V(1).Info("Exiting TUN interface routine")
-			err := r.ifce.Close()
-			if err != nil {
-				glog.Errorf("interface close issue when shutting TUN process: %v", err)
-			}
 			return
 		}
 
 		n, err := r.ifce.Read(pkt)
 		if err != nil {
-			r.Error <- fmt.Errorf("error reading from tunnel %s", err)
+			// Stop closes the interface.
+			if r.isStopped.Load() {
+				continue
+			}
+			r.prom.TUNReadError()
+			r.Error <- fmt.Errorf("error reading from tunnel %w", err)
 		}
 		oPkt = pkt[:n]
 
 		r.updateMetricsForPacket(n)
+		r.forwardClient(oPkt)
+	}
+}
 
-		// Get dst IP and corresponding websocket connection.
-		packet := gopacket.NewPacket(oPkt, layers.LayerTypeIPv4, gopacket.Default)
-		ip, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
-		ipDest := ip.DstIP.String()
-		data, err := r.ipam.GetData(ipDest) // data is the connection object linked to the IP
-		if err != nil {
-			glog.Warningf("unsolicited packet for IP:%v, cause: %v", ipDest, err)
-			continue
+// forwardClient sends a packet from the network to the session of its destination.
+func (r *WebTunnelServer) forwardClient(oPkt []byte) {
+	n := len(oPkt)
+
+	// Get dst IP and corresponding websocket connection.
+	var ok bool
+	if oPkt, ok = r.checkIPv4("tunnel", oPkt); !ok {
+		return
+	}
+	ip, ok := parseIPHeader(oPkt)
+	if !ok {
+		if ip, ok = decodeIPHeader(oPkt); !ok {
+			return
+		}
+	}
+	ipDest := ip.dst.String()
+	// Packets to a subnet behind a client go to its session.
+	if r.clientSubnets != nil || r.site != nil {
+		if owner, ok := r.subnets.lookup(ip.dst); ok {
+			ipDest = owner
 		}
+	}
+	r.updateRouteMetrics(ip.src, n)
+	data, err := r.ipam.GetData(ipDest) // data is the connection object linked to the IP
+	if err != nil {
+		glog.Warningf("unsolicited packet for IP:%v, cause: %v", ipDest, err)
+		return
+	}
 
-		wc.PrintPacketIPv4(oPkt, "Server <- NetInterface")
+	if !r.isAllowed(ipDest, ip.src) {
+		glog.V(2).Infof("dropping packet to quarantined client %v", ipDest)
+		return
+	}
+	if r.shedPacket(ip.tos >> 2) {
+		glog.V(2).Infof("shedding low priority packet to %v", ipDest)
+		return
+	}
+	if !r.agentAllows(ipDest, ToClient, oPkt) {
+		return
+	}
+	if !r.inspectPacket(ipDest, ToClient, oPkt) {
+		return
+	}
+	r.trackPacket(ipDest, ToClient, oPkt)
+	r.acct.count(ipDest, ToClient, len(oPkt))
+	r.stats.count(ipDest, ToClient, len(oPkt))
+	r.admin.count(ipDest, ToClient, len(oPkt))
+	r.capturePacket(ipDest, oPkt)
 
-		ws := data.(*websocket.Conn)
-		r.connMapLock.Lock()
-		if _, ok := r.conns[ipDest]; !ok {
-			r.conns[ipDest] = ws
+	wc.PrintPacketIPv4(oPkt, "Server <- NetInterface")
+
+	ws := data.(*wc.WSWriter)
+	r.connMapLock.Lock()
+	if _, ok := r.conns[ipDest]; !ok {
+		r.conns[ipDest] = ws
+	}
+	r.connMapLock.Unlock()
+	if r.impairPacket(ipDest, oPkt, func(pkt []byte) { r.sendClient(ws, ipDest, pkt) }) {
+		return
+	}
+	r.sendClient(ws, ipDest, oPkt)
+}
+
+// writeClient sends a packet to the client on ipDest and returns the write error.
+func writeClient(ws *wc.WSWriter, ipDest string, pkt []byte, prom *metrics.Tunnel) error {
+	err := ws.WriteDataMessage(websocket.BinaryMessage, pkt)
+	if err == nil {
+		prom.CountPacket(metrics.Out, len(pkt))
+	} else {
+		// Don't log close errors.
+		if err == websocket.ErrCloseSent {
+			glog.V(2).Info("ErrCloseSent")
+			return err
 		}
-		r.connMapLock.Unlock()
-		if err := ws.WriteMessage(websocket.BinaryMessage, oPkt); err != nil {
-			// Ignore close errors.
-			if err == websocket.ErrCloseSent {
-				glog.V(2).Info("ErrCloseSent")
-				continue
-			}
-			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
-				glog.V(2).Info("writing to Closed or Shutting down Websocket")
-				continue
-			}
-			glog.Warningf("error writing to Websocket for ip: %s, %s", ipDest, err)
-			continue
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+			glog.V(2).Info("writing to Closed or Shutting down Websocket")
+			return err
 		}
+		glog.Warningf("error writing to Websocket for ip: %s, %s", ipDest, err)
+		prom.WSError()
 	}
+	return err
 }
 
 // releaseIP removes an ip from the connection tracking manager and connection map
 func (r *WebTunnelServer) releaseIP(ip string) {
+	r.parkSequence(ip)
+	r.endSessionToken(ip)
 	r.ipam.ReleaseIP(ip)
+	if r.quarantine != nil {
+		r.setQuarantined(ip, false)
+	}
+	r.releaseRateLimit(ip)
+	r.releaseConnTrack(ip)
+	r.releasePortForwards(ip)
+	r.rtt.release(ip)
+	r.loss.release(ip)
+	r.releaseClientSubnets(ip)
+	r.releaseSitePeer(ip)
+	r.releaseCapture(ip)
+	r.releaseKeepalive(ip)
+	r.releaseImpairment(ip)
+	r.releasePacing(ip)
+	r.releaseMove(ip)
+	r.releaseBanSession(ip)
+	r.releaseP2P(ip)
+	r.releaseAgentSession(ip)
+	r.slaDisconnect(ip, true)
 	r.connMapLock.Lock()
 	delete(r.conns, ip)
+	delete(r.clientVersions, ip)
+	delete(r.sessionIDs, ip)
+	delete(r.capabilities, ip)
+	delete(r.clientReports, ip)
 	r.connMapLock.Unlock()
 }
 
 // wsEndpoint defines HTTP Websocket Path and upgrades the HTTP connection.
 // Websocket packets are then processed as they arrive.
 func (r *WebTunnelServer) wsEndpoint(w http.ResponseWriter, rcv *http.Request) {
+	// Continue the trace started by the client or start a new one.
+	traceID, err := wc.ParseTraceParent(rcv.Header.Get(wc.TraceHeader))
+	if err != nil {
+		traceID = wc.NewTraceID()
+	}
+	ctx := wc.ContextWithTraceID(rcv.Context(), traceID)
+
+	// Refuse new sessions while overloaded.
+	if reason := r.overloadReason(); reason != "" {
+		r.shedEvent(ShedRejectSession, reason, rcv.RemoteAddr)
+		http.Error(w, "Server Overloaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Clients that fetched their config out-of-band already hold an IP.
+	lease := rcv.Header.Get(wc.LeaseHeader)
+
+	// Refuse new sessions while the IP pool is critical.
+	if lease == "" && r.ipam.RejectSessions() {
+		glog.Warningf("refused session from %v, IP pool critical", rcv.RemoteAddr)
+		r.metricsLock.Lock()
+		r.metrics.PoolRejected++
+		r.metricsLock.Unlock()
+		http.Error(w, "IP Pool Exhausted", http.StatusServiceUnavailable)
+		return
+	}
+
+	if !r.checkClientVersion(w, rcv) {
+		return
+	}
+
+	if r.isBanned(remoteHost(rcv.RemoteAddr)) {
+		glog.Warningf("refused session from banned %v", rcv.RemoteAddr)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	ctx, ok := r.authenticate(ctx, w, rcv)
+	if !ok {
+		return
+	}
+	ctx = withIdentities(ctx, rcv)
+	ctx = withTLSState(ctx, rcv)
+	if u := authUser(ctx); u != "" && r.isBanned(u) {
+		glog.Warningf("refused session of banned %v from %v", u, rcv.RemoteAddr)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if lease != "" && (r.leases == nil || !r.leases.valid(lease, authUser(ctx))) {
+		glog.Warningf("refused session from %v, unknown or expired config lease", rcv.RemoteAddr)
+		http.Error(w, "Config Lease Expired", http.StatusGone)
+		return
+	}
+
 	// Upgrade HTTP connection to a WebSocket connection.
-	conn, err := upgrader.Upgrade(w, rcv, nil)
+	_, span := r.tracer.Start(ctx, "upgrade")
+	span.SetAttribute("remote", rcv.RemoteAddr)
+	// Negotiate the control message codec with the client.
+	up := websocket.Upgrader{
+		ReadBufferSize:  r.bufferSize,
+		WriteBufferSize: r.bufferSize,
+		Subprotocols:    wc.CodecNames(),
+	}
+	respHeader := r.affinityHeader(rcv)
+	// Accept sequence numbered data frames if the client offers them.
+	sequenced := rcv.Header.Get(wc.SeqHeader) == "1"
+	if sequenced {
+		respHeader.Set(wc.SeqHeader, "1")
+		// Continue sequences across reconnects if the client does.
+		if rcv.Header.Get(wc.SeqDedupHeader) == "1" {
+			respHeader.Set(wc.SeqDedupHeader, "1")
+			ctx = withSeqDedup(ctx)
+		}
+	}
+	respHeader.Set(wc.MTUProbeHeader, "1")
+	respHeader.Set(wc.KeepaliveHeader, "1")
+	// Speak control messages if the client does.
+	if v := wc.NegotiateControl(rcv.Header.Get(wc.ControlHeader)); v > 0 {
+		respHeader.Set(wc.ControlHeader, strconv.Itoa(v))
+	}
+	respHeader.Set(version.Header, version.Version)
+	sessionID := newSessionID()
+	respHeader.Set(wc.SessionIDHeader, sessionID)
+	conn, err := up.Upgrade(w, rcv, respHeader)
+	span.End(err)
 	if err != nil {
 		glog.Errorf("Error upgrading to websocket: %s\n", err)
 		return
 	}
 	defer conn.Close()
+	upgraded := time.Now()
+	conn.SetReadLimit(wc.MaxMessageSize)
+	ws := wc.NewWSWriter(conn, r.obfs)
+	defer ws.Close()
+	if err := ws.SetDSCPCopy(r.copyDSCP); err != nil {
+		glog.Warningf("unable to copy DSCP: %v", err)
+	}
+	ws.SetSequencing(sequenced)
+	if rcv.Header.Get(wc.ChunkHeader) == "1" {
+		ws.SetChunking(configChunkSize)
+	}
 
 	// Get IP and add to ip management.
-	ip, err := r.ipam.AcquireIP(conn)
+	_, span = r.tracer.Start(ctx, "ipAllocation")
+	var ip string
+	if lease != "" {
+		ip, err = r.claimLease(ws, lease, authUser(ctx))
+	} else {
+		ip, err = r.ipam.AcquireIPFor(ws, identities(ctx, rcv)...)
+	}
+	span.SetAttribute("ip", ip)
+	span.End(err)
 	if err != nil {
 		glog.Errorf("Error acquiring IP:%v", err)
 		return
 	}
 
-	glog.V(1).Infof("New connection from %s", ip)
+	glog.V(1).Infof("New connection from %s session %s", ip, sessionID)
+	r.setClientVersion(ip, rcv.Header.Get(version.Header))
+	r.setSessionID(ip, sessionID)
+	r.trackSession(ip, rcv.RemoteAddr)
 
 	// Create Pong Handler to handle Pings
 	conn.SetPongHandler(r.PongHandler(ip))
 
+	// Clients must request their config before the handshake timeout.
+	hs := &connHandshake{}
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+
 	// Process websocket packet.
 	for {
-		if r.isStopped {
+		if r.isStopped.Load() {
 			glog.V(1).Infof("Exiting websocket processing for ip: %v", ip)
 			return
 		}
@@ -331,102 +900,339 @@ func (r *WebTunnelServer) wsEndpoint(w http.ResponseWriter, rcv *http.Request) {
 		if err != nil {
 			userinfo, _ := r.ipam.GetUserinfo(ip)
 
+			// The session may have been resumed by another connection.
+			if !r.ownsIP(ws, ip) {
+				glog.V(1).Infof("connection closed after session handover or release of %s", ip)
+				return
+			}
+			graceful := websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+			if !graceful {
+				r.prom.WSError()
+			}
+			r.slaDisconnect(ip, graceful)
 			r.releaseIP(ip)
 
-			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
-				glog.V(1).Infof("connection gracefuly closed for %s", ip)
+			if hs.state == handshakeNew {
+				glog.Warningf("connection from %v session %v closed before config: %v", rcv.RemoteAddr, sessionID, err)
+				return
+			}
+			if graceful {
+				glog.V(1).Infof("connection gracefuly closed for %s session %s", ip, sessionID)
 				return
 			}
-			glog.Warningf("error reading from websocket, client info: %s@%s client ip: %s, origin:%s, reason: %s",
-				userinfo.username, userinfo.hostname, ip, rcv.RemoteAddr, err)
+			glog.Warningf("error reading from websocket, client info: %s@%s client ip: %s, origin:%s, session: %s, reason: %s",
+				userinfo.Username, userinfo.Hostname, ip, rcv.RemoteAddr, sessionID, err)
 			return
 		}
+		r.renewIPLease(ip)
+
+		// Control messages are decoded once for the handshake check and processing.
+		var ctl *wc.ControlMessage
+		if mt == websocket.TextMessage && wc.IsControlMessage(message) {
+			if ctl, err = wc.ParseControlMessage(ws.Codec(), message); err != nil {
+				r.refuse(hs, ws, ip, mt, err)
+				continue
+			}
+		}
+		if err := hs.check(mt, textVerb(message, ctl)); err != nil {
+			r.refuse(hs, ws, ip, mt, err)
+			continue
+		}
 
 		switch mt {
 		case websocket.TextMessage: // Config or Command message.
-			err := r.processIncomingTextMessage(conn, ip, message)
-			if err != nil {
-				r.Error <- fmt.Errorf("fatal error processing Config/Command message %s", err)
+			req := configRequest(message, ctl)
+			// A replacement client process takes over an existing session.
+			if req != nil && req.Resume {
+				newIP, err := r.resumeSession(ctx, ws, ip, req, ctl != nil)
+				if err != nil {
+					glog.Warningf("resume from %v session %v refused: %v", rcv.RemoteAddr, sessionID, err)
+					ws.WriteControlMessage(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.ClosePolicyViolation, withSessionID(err.Error(), sessionID)))
+					r.releaseIP(ip)
+					return
+				}
+				ip = newIP
+				sessionID = r.sessionID(ip)
+				conn.SetPongHandler(r.PongHandler(ip))
+				r.setClientVersion(ip, rcv.Header.Get(version.Header))
+				r.trackSession(ip, rcv.RemoteAddr)
+				r.loss.newStream(ip)
+				hs.configured(ws)
+				r.prom.ObserveHandshake(time.Since(upgraded))
+				continue
+			}
+			// The client applied the new IP of its session.
+			if strings.HasPrefix(string(message), wc.ReaddressAckPrefix) {
+				newIP, err := r.completeMove(ws, ip, string(message[len(wc.ReaddressAckPrefix):]))
+				if err != nil {
+					glog.Warningf("readdress of %v not completed: %v", ip, err)
+					continue
+				}
+				ip = newIP
+				conn.SetPongHandler(r.PongHandler(ip))
+				r.trackSession(ip, rcv.RemoteAddr)
+				continue
+			}
+			if req != nil {
+				if err := r.processConfigRequest(ctx, ws, ip, req, ctl != nil); err != nil {
+					r.Error <- fmt.Errorf("fatal error processing Config message %w", err)
+				}
+				hs.configured(ws)
+				r.prom.ObserveHandshake(time.Since(upgraded))
+				continue
+			}
+			if ctl != nil {
+				r.processControl(ws, ip, ctl)
+				continue
+			}
+			if err := r.processIncomingTextMessage(ctx, ws, ip, message); err != nil {
+				r.Error <- fmt.Errorf("fatal error processing Command message %w", err)
 			}
 		case websocket.BinaryMessage: // Packet message.
-			err := r.processIncomingBinaryMessage(message)
+			err := r.processIncomingBinaryMessage(ip, message)
 			if err != nil {
-				r.Error <- fmt.Errorf("fatal error writing Binary message to tunnel %s", err)
+				r.Error <- fmt.Errorf("fatal error writing Binary message to tunnel %w", err)
 			}
+		default:
+			glog.Warningf("Unexpected message type %v from %v", mt, ip)
 		}
 
 	}
 }
 
-// processIncomingTextMessage process Config and Command packets coming from the websocket
+// processIncomingTextMessage process Command packets coming from the websocket
 // since it is assumed we are receiving IP packets we just send them directly
 // to the tun interface for the OS to route those
-func (r *WebTunnelServer) processIncomingTextMessage(conn *websocket.Conn, ip string, message []byte) error {
-	msg := strings.Split(string(message), " ")
-	if msg[0] == "getConfig" {
-		var username, hostname string
-		if len(msg) != 3 {
-			glog.Warningf("Cannot process username and hostname - using defaults")
-			username = "guest"
-			hostname = "workstation"
-		} else {
-			username = msg[1]
-			hostname = msg[2]
-		}
+func (r *WebTunnelServer) processIncomingTextMessage(ctx context.Context, ws *wc.WSWriter, ip string, message []byte) (err error) {
+	if strings.HasPrefix(string(message), wc.SiteAdvertPrefix) {
+		r.processSiteAdvert(ws, ip, message[len(wc.SiteAdvertPrefix):])
+		return nil
+	}
 
-		serverHostname, err := os.Hostname()
-		if err != nil {
-			// hostname failing should be fatal
-			return fmt.Errorf("could not get hostname: %v", err)
-		}
+	if strings.HasPrefix(string(message), wc.P2PPrefix) {
+		r.processP2P(ws, ip, message[len(wc.P2PPrefix):])
+		return nil
+	}
 
-		glog.Infof("Config request from %s@%s", username, hostname)
+	if strings.HasPrefix(string(message), "keepalive ") {
+		r.processKeepalive(ws, ip, message)
+		return nil
+	}
+
+	if strings.HasPrefix(string(message), "mtuprobe ") {
+		r.processMTUProbe(ws, ip, message)
+		return nil
+	}
 
-		cfg := &wc.ClientConfig{
-			IP:          ip,
-			Netmask:     r.tunNetmask,
-			RoutePrefix: r.routePrefix,
-			GWIp:        r.gwIP,
-			DNS:         r.dnsIPs,
-			ServerInfo:  &wc.ServerInfo{Hostname: serverHostname},
+	glog.V(2).Infof("ignoring unknown command %q from %v", textVerb(message, nil), ip)
+	return nil
+}
+
+// processConfigRequest answers the config request of a new connection or a reconnecting
+// client with its config and activates the IP. ctl is true if the request was a control
+// message and is answered with one.
+func (r *WebTunnelServer) processConfigRequest(ctx context.Context, ws *wc.WSWriter, ip string, req *wc.ConfigRequest, ctl bool) (err error) {
+	_, span := r.tracer.Start(ctx, "config")
+	span.SetAttribute("ip", ip)
+	defer func() { span.End(err) }()
+
+	username, hostname := req.Username, req.Hostname
+	if username == "" || hostname == "" {
+		glog.Warningf("Cannot process username and hostname - using defaults")
+		username = "guest"
+		hostname = "workstation"
+	}
+	// The authenticated identity takes precedence over the claimed one.
+	if u := authUser(ctx); u != "" {
+		if username != u {
+			glog.V(1).Infof("client on %v claimed username %v, authenticated as %v", ip, username, u)
 		}
-		if err := conn.WriteJSON(cfg); err != nil {
-			// An issue here should not be fatal but logged.
-			glog.Warningf("error sending config to client: %v", err)
-			return nil
+		username = u
+	}
+	// Reconnecting clients present their session token, continued only if the server
+	// issued it to the same identity.
+	session := newSessionToken()
+	reconnect := false
+	if req.Session != "" {
+		if r.tokens.belongsTo(req.Session, owner(ctx, username)) {
+			session, reconnect = req.Session, true
+		} else {
+			glog.Warningf("client %s@%s on %v presented an unknown session token", username, hostname, ip)
 		}
-		// Mark IP as in use so packets can be send to it. This is needed to avoid deadlock condition
-		// when a client disconnects but still packets are available in buffer for its ip and a new
-		// client acquires its ip it cannot get the config as the TUN writer is still busy trying to send
-		// packets to it.
-		// An issue here should not be fatal but logged.
-		if err := r.ipam.SetIPActiveWithUserInfo(ip, username, hostname); err != nil {
-			glog.Warningf("unable to mark IP %v in use", ip)
+	}
+
+	glog.Infof("Config request from %s@%s session %s", username, hostname, r.sessionID(ip))
+	if r.isBanned(username) {
+		glog.Warningf("Client %s@%s on %v refused, banned", username, hostname, ip)
+		closeBanned(ws, r.sessionID(ip))
+		return nil
+	}
+	if !r.inAccessWindow(username, hostname, time.Now()) {
+		glog.Warningf("Client %s@%s on %v refused outside access window", username, hostname, ip)
+		closeOutsideWindow(ws, r.sessionID(ip))
+		return nil
+	}
+
+	quarantined := r.quarantine != nil
+	var posture *wc.Posture
+	if r.posturePolicy != nil {
+		var level AccessLevel
+		level, posture = r.checkPosture(ctx, ip, req)
+		switch level {
+		case AccessDeny:
+			glog.Warningf("Client %s@%s on %v denied by posture policy", username, hostname, ip)
+			closePostureDenied(ws, r.sessionID(ip))
 			return nil
+		case AccessFull:
+			quarantined = false
 		}
 	}
+
+	routes := r.routePrefix
+	if quarantined {
+		routes = r.quarantine.routePrefix
+		r.setQuarantined(ip, true)
+	}
+	if s := agentRestriction(ctx); s != nil {
+		r.startAgentSession(ip, s)
+	}
+	cfg, err := r.clientConfig(ip, routes)
+	if err != nil {
+		// hostname failing should be fatal
+		return err
+	}
+	cfg.ServerInfo.Session = session
+	if reconnect && seqDedup(ctx) {
+		cfg.ServerInfo.SeqContinued = r.continueSequence(ws, ip, session)
+	}
+	if err := r.writeConfig(ws, ip, cfg, req, ctl); err != nil {
+		// An issue here should not be fatal but logged.
+		glog.Warningf("error sending config to client: %v", err)
+		return nil
+	}
+	// Mark IP as in use so packets can be send to it. This is needed to avoid deadlock condition
+	// when a client disconnects but still packets are available in buffer for its ip and a new
+	// client acquires its ip it cannot get the config as the TUN writer is still busy trying to send
+	// packets to it.
+	// An issue here should not be fatal but logged.
+	if err := r.ipam.SetIPActiveWithLabels(ip, username, hostname, authLabels(ctx)); err != nil {
+		glog.Warningf("unable to mark IP %v in use", ip)
+		return nil
+	}
+	r.ipam.SetSession(ip, session)
+	if posture != nil {
+		r.ipam.SetPosture(ip, posture)
+	}
+	r.tokens.issue(session, owner(ctx, username), time.Time{})
+	// Pinged from now on, even without traffic to the client.
+	r.connMapLock.Lock()
+	r.conns[ip] = ws
+	r.connMapLock.Unlock()
+	r.addClientSubnets(ip, username, hostname)
+	if quarantined {
+		go r.runPostureCheck(ws, ip, username, hostname)
+	}
 	return nil
 }
 
+// clientConfig returns the client configuration for ip advertising routes.
+func (r *WebTunnelServer) clientConfig(ip string, routes []string) (*wc.ClientConfig, error) {
+	serverHostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("could not get hostname: %w", err)
+	}
+	netmask, gwIP := r.clientNetmask(ip)
+	cfg := &wc.ClientConfig{
+		IP:          ip,
+		Netmask:     netmask,
+		RoutePrefix: routes,
+		GWIp:        gwIP,
+		DNS:         r.dnsIPs,
+		DNSRoutes:   r.dnsRoutes,
+		ServerInfo: &wc.ServerInfo{Hostname: serverHostname, Instance: r.instanceID, Version: version.Version,
+			SessionID: r.sessionID(ip)},
+	}
+	// Agents only get routes to their allowed destinations and no DNS.
+	if s := r.agentSession(ip); s != nil {
+		cfg.RoutePrefix, cfg.DNS, cfg.DNSRoutes = s.routes, nil, nil
+	}
+	return cfg, nil
+}
+
 // processIncomingBinaryMessage process Binary packets coming from the websocket
 // since it is assumed we are receiving IP packets we just send them directly
 // to the tun interface for the OS to route those
-func (r *WebTunnelServer) processIncomingBinaryMessage(message []byte) error {
+func (r *WebTunnelServer) processIncomingBinaryMessage(ip string, message []byte) error {
+	if seq, pkt, ok := wc.ParseSeqFrame(message); ok {
+		if !r.loss.record(ip, seq) {
+			glog.V(2).Infof("dropping duplicate frame %v from %v", seq, ip)
+			return nil
+		}
+		message = pkt
+	} else if !r.loss.unsequenced(ip) {
+		glog.V(2).Infof("dropping unsequenced frame from %v", ip)
+		return nil
+	}
+	// Remove obfuscation padding and drop dummy frames.
+	if message = wc.StripPadding(message); message == nil {
+		return nil
+	}
+	r.prom.CountPacket(metrics.In, len(message))
 	wc.PrintPacketIPv4(message, "Server <- Websocket")
-	n, err := r.ifce.Write(message)
+	if !r.allowPacket(ip) {
+		glog.V(2).Infof("dropping packet from %v over packet rate limit", ip)
+		return nil
+	}
+	message, ok := r.checkIPv4(ip, message)
+	if !ok {
+		return nil
+	}
+	if !r.checkSource(ip, message) {
+		return nil
+	}
+	if !r.isAllowed(ip, net.IP(message[16:20])) {
+		glog.V(2).Infof("dropping packet from quarantined client %v", ip)
+		return nil
+	}
+	if !r.agentAllows(ip, FromClient, message) {
+		return nil
+	}
+	if !r.inspectPacket(ip, FromClient, message) {
+		return nil
+	}
+	r.trackPacket(ip, FromClient, message)
+	r.acct.count(ip, FromClient, len(message))
+	r.stats.count(ip, FromClient, len(message))
+	r.admin.count(ip, FromClient, len(message))
+	r.capturePacket(ip, message)
+	if r.impairPacket(ip, message, func(pkt []byte) {
+		if err := r.writeTunnel(pkt); err != nil {
+			r.Error <- fmt.Errorf("fatal error writing Binary message to tunnel %w", err)
+		}
+	}) {
+		return nil
+	}
+	return r.writeTunnel(message)
+}
+
+// writeTunnel sends a packet from a client to the tunnel interface.
+func (r *WebTunnelServer) writeTunnel(pkt []byte) error {
+	// Chained traffic egresses via the next gateway.
+	if r.chainPacket(pkt) {
+		return nil
+	}
+	n, err := r.ifce.Write(pkt)
 	if err != nil {
-		return fmt.Errorf("error writing to tunnel %s", err)
+		r.prom.TUNWriteError()
+		return fmt.Errorf("error writing to tunnel %w", err)
 	}
 
 	r.updateMetricsForPacket(n)
+	r.updateRouteMetrics(net.IP(pkt[16:20]), n)
 	return nil
 }
 
-// httpEndpoint defines the HTTP / Path. The "Sender" will send an initial request to this URL.
-func (r *WebTunnelServer) httpEndpoint(w http.ResponseWriter, rcv *http.Request) {
-	fmt.Fprint(w, "OK")
-}
-
 // healthEndpoint
 func (r *WebTunnelServer) healthEndpoint(w http.ResponseWriter, rcv *http.Request) {
 	m := r.GetMetrics()
@@ -442,10 +1248,46 @@ func (r *WebTunnelServer) metricEndpoint(w http.ResponseWriter, rcv *http.Reques
 	fmt.Fprint(w, r.GetMetrics())
 }
 
-// GetMetrics returns the current server metrics.
+// GetMetrics returns a snapshot of the current server metrics.
 func (r *WebTunnelServer) GetMetrics() *Metrics {
-	r.metrics.Users = r.ipam.GetAllocatedCount() - 3 // 3 Ips are alllocated for net/gw/router
-	return r.metrics
+	// connMapLock is never taken under metricsLock.
+	versions := r.clientVersionSnapshot()
+	sessionIDs := r.sessionIDSnapshot()
+	r.metricsLock.Lock()
+	defer r.metricsLock.Unlock()
+	clientNets := r.ipam.Prefixes()
+	r.metrics.Users = r.ipam.GetAllocatedCount() - 3*len(clientNets) // 3 Ips are alllocated for net/gw/router
+	m := *r.metrics
+	m.Routes = make(map[string]RouteMetrics)
+	for k, v := range r.metrics.Routes {
+		m.Routes[k] = v
+	}
+	m.Latency = r.rtt.snapshot()
+	m.Loss = r.loss.snapshot()
+	m.Bandwidth = r.bandwidthSnapshot()
+	m.Tags = r.sessionTags()
+	m.Labels = r.sessionLabels()
+	m.Version = version.Version
+	m.PoolUtilization, m.PoolLevel = r.ipam.Utilization()
+	m.ClientNets = clientNets
+	m.ClientVersions = versions
+	m.SessionIDs = sessionIDs
+	m.UpstreamIP = r.upstreamIP()
+	m.NATBindings, m.NATPortUsage = r.natSummary()
+	if r.dns != nil {
+		m.DNSUpstreams = r.dns.UpstreamStats()
+	}
+	certs := r.certs
+	if r.acme != nil {
+		certs = r.acme.certs
+	}
+	if certs != nil {
+		m.CertExpiry = certs.expiry()
+		certs.lock.Lock()
+		m.CertReloads = certs.reloads
+		certs.lock.Unlock()
+	}
+	return &m
 }
 
 // DumpAllocations returns IP allocations information.
@@ -463,11 +1305,54 @@ func (r *WebTunnelServer) updateMetricsForPacket(n int) {
 	r.metricsLock.Unlock()
 }
 
+// updateRouteMetrics accounts n bytes to the first route prefix containing ip.
+func (r *WebTunnelServer) updateRouteMetrics(ip net.IP, n int) {
+	for _, rn := range r.routeNets {
+		if !rn.Contains(ip) {
+			continue
+		}
+		r.metricsLock.Lock()
+		m := r.metrics.Routes[rn.String()]
+		m.Bytes += n
+		m.Packets++
+		r.metrics.Routes[rn.String()] = m
+		r.metricsLock.Unlock()
+		return
+	}
+}
+
+// GetRouteMetrics returns a copy of the traffic counters per advertised route prefix.
+func (r *WebTunnelServer) GetRouteMetrics() map[string]RouteMetrics {
+	r.metricsLock.Lock()
+	defer r.metricsLock.Unlock()
+	routes := make(map[string]RouteMetrics)
+	for k, v := range r.metrics.Routes {
+		routes[k] = v
+	}
+	return routes
+}
+
 // ResetMetrics resets the metrics on the server.
 func (r *WebTunnelServer) ResetMetrics() {
 	r.metricsLock.Lock()
 	r.metrics.Users = 0
 	r.metrics.Packets = 0
 	r.metrics.Bytes = 0
+	r.metrics.Routes = make(map[string]RouteMetrics)
+	r.metrics.RateLimited = 0
+	r.metrics.ShedSessions = 0
+	r.metrics.ShedPackets = 0
+	r.metrics.Malformed = 0
+	r.metrics.NonIPv4 = 0
+	r.metrics.IPOptions = 0
+	r.metrics.Fragments = 0
+	r.metrics.NestedTunnels = 0
+	r.metrics.FragsReassembled = 0
+	r.metrics.FragsDropped = 0
+	r.metrics.HandshakeRefused = 0
+	r.metrics.ImpairDropped = 0
+	r.metrics.PacingDropped = 0
+	r.metrics.DeadPeers = 0
+	r.metrics.LeasesExpired = 0
 	r.metricsLock.Unlock()
 }
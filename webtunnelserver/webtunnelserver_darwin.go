@@ -5,3 +5,11 @@ import "fmt"
 func initializeTunnel(ifceName, tunIP, tunNetmask string) error {
 	return fmt.Errorf("not implemented")
 }
+
+func addTunnelRoute(ifceName, subnet string) error {
+	return fmt.Errorf("not implemented")
+}
+
+func deleteTunnelRoute(ifceName, subnet string) error {
+	return fmt.Errorf("not implemented")
+}
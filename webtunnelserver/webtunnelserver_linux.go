@@ -8,7 +8,21 @@ import (
 func initializeTunnel(ifceName, tunIP, tunNetmask string) error {
 	cmd := exec.Command("/sbin/ifconfig", ifceName, tunIP, "netmask", tunNetmask, "up")
 	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("error setting ip on tun %s", err)
+		return fmt.Errorf("error setting ip on tun %w", err)
+	}
+	return nil
+}
+
+func addTunnelRoute(ifceName, subnet string) error {
+	if out, err := exec.Command("ip", "route", "replace", subnet, "dev", ifceName).CombinedOutput(); err != nil {
+		return fmt.Errorf("error adding route %v %w %s", subnet, err, out)
+	}
+	return nil
+}
+
+func deleteTunnelRoute(ifceName, subnet string) error {
+	if out, err := exec.Command("ip", "route", "del", subnet, "dev", ifceName).CombinedOutput(); err != nil {
+		return fmt.Errorf("error deleting route %v %w %s", subnet, err, out)
 	}
 	return nil
 }
@@ -3,7 +3,9 @@ package webtunnelserver
 import (
 	"flag"
 	"net"
+	"net/http"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -39,6 +41,7 @@ func TestServer(t *testing.T) {
 	mockInterface.EXPECT().IsTAP().Return(false).AnyTimes()
 	var server *WebTunnelServer
 	var c *websocket.Conn
+	var session string
 	t.Run("ServerInit", func(t *testing.T) {
 		var err error
 		server, err = NewWebTunnelServer("127.0.0.1:8811", "192.168.0.1",
@@ -75,17 +78,21 @@ func TestServer(t *testing.T) {
 		allocations := server.DumpAllocations()
 		data := allocations["192.168.0.2"]
 
-		if data.username != "user" {
-			t.Errorf("Expected user, got: %v", data.username)
+		if data.Username != "user" {
+			t.Errorf("Expected user, got: %v", data.Username)
 		}
 
-		if data.hostname != "hostname" {
-			t.Errorf("Expected hostname, got: %v", data.hostname)
+		if data.Hostname != "hostname" {
+			t.Errorf("Expected hostname, got: %v", data.Hostname)
 		}
 
 		if cfg.IP != "192.168.0.2" {
 			t.Errorf("config failed want 192.168.0.2, got %s", cfg.IP)
 		}
+		if cfg.ServerInfo.Instance == "" {
+			t.Error("Expected instance ID in config")
+		}
+		session = cfg.ServerInfo.Session
 	})
 
 	t.Run("PacketHandling", func(t *testing.T) {
@@ -101,7 +108,13 @@ func TestServer(t *testing.T) {
 		}
 
 		// Test packet from client -> server.
-		mockInterface.EXPECT().Write([]byte{1, 3, 3}).Return(1, nil).Times(1)
+		out := createIPv4Pkt(net.IP{192, 168, 0, 2}, net.IP{1, 1, 1, 1})
+		mockInterface.EXPECT().Write(out).Return(len(out), nil).Times(1)
+		if err = c.WriteMessage(websocket.BinaryMessage, out); err != nil {
+			t.Error(err)
+		}
+
+		// Malformed packets are dropped and counted.
 		if err = c.WriteMessage(websocket.BinaryMessage, []byte{1, 3, 3}); err != nil {
 			t.Error(err)
 		}
@@ -114,6 +127,81 @@ func TestServer(t *testing.T) {
 		if metric.Users != 1 {
 			t.Errorf("Users expected: 1, got: %v", metric.Users)
 		}
+		if rm := server.GetRouteMetrics()["1.1.1.0/24"]; rm.Packets == 0 {
+			t.Errorf("Route packets expected > 0, got: %v", rm.Packets)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if m := server.GetMetrics(); m.Malformed != 1 {
+			t.Errorf("Malformed expected: 1, got: %v", m.Malformed)
+		}
+	})
+
+	t.Run("SessionResume", func(t *testing.T) {
+		u := url.URL{Scheme: "ws", Host: "127.0.0.1:8811", Path: "/ws"}
+		c2, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c2.WriteMessage(websocket.TextMessage, []byte("resume "+session)); err != nil {
+			t.Error(err)
+		}
+		cfg := &wc.ClientConfig{}
+		if err := c2.ReadJSON(cfg); err != nil {
+			t.Fatal(err)
+		}
+		if cfg.IP != "192.168.0.2" || cfg.ServerInfo.Session != session {
+			t.Errorf("Expected resumed session on 192.168.0.2, got %v %v", cfg.IP, cfg.ServerInfo.Session)
+		}
+
+		// The old connection is closed with the resume reason.
+		for {
+			if _, _, err = c.ReadMessage(); err != nil {
+				break
+			}
+		}
+		if ce, ok := err.(*websocket.CloseError); !ok || !strings.HasPrefix(ce.Text, closeReasonResumed) {
+			t.Errorf("Expected close with %q, got %v", closeReasonResumed, err)
+		}
+		c.Close()
+		c = c2
+		time.Sleep(100 * time.Millisecond)
+		if users := server.GetMetrics().Users; users != 1 {
+			t.Errorf("Users expected: 1 after resume, got: %v", users)
+		}
+	})
+
+	t.Run("GobCodec", func(t *testing.T) {
+		u := url.URL{Scheme: "ws", Host: "127.0.0.1:8811", Path: "/ws"}
+		d := *websocket.DefaultDialer
+		d.Subprotocols = []string{wc.GobCodec{}.Name()}
+		// Gob is only negotiated once registered.
+		if names := wc.CodecNames(); len(names) != 1 || names[0] != (wc.JSONCodec{}).Name() {
+			t.Errorf("Expected only JSON registered by default, got %v", names)
+		}
+		wc.RegisterCodec(wc.GobCodec{})
+		c2, _, err := d.Dial(u.String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c2.Close()
+		if p := c2.Subprotocol(); p != (wc.GobCodec{}).Name() {
+			t.Fatalf("Expected subprotocol %v, got %q", wc.GobCodec{}.Name(), p)
+		}
+		if err := c2.WriteMessage(websocket.TextMessage, []byte("getConfig user2 hostname2")); err != nil {
+			t.Error(err)
+		}
+		_, msg, err := c2.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := &wc.ClientConfig{}
+		if err := wc.DecodeControl(wc.GobCodec{}, msg, cfg); err != nil {
+			t.Fatal(err)
+		}
+		if cfg.IP != "192.168.0.3" {
+			t.Errorf("config failed want 192.168.0.3, got %s", cfg.IP)
+		}
+		c2.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 	})
 
 	t.Run("CloseConnectionAndStopServer", func(t *testing.T) {
@@ -145,13 +233,63 @@ func TestServer(t *testing.T) {
 	}
 }
 
+func TestStop(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockInterface := mocks.NewMockInterface(mockCtrl)
+
+	ws, client := wsPair(t)
+	defer client.Close()
+	ipam, _ := NewIPPam("192.168.0.0/24")
+	ip, _ := ipam.AcquireIP(ws)
+	ipam.SetIPActiveWithUserInfo(ip, "user", "laptop")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &WebTunnelServer{
+		ipam:       ipam,
+		ifce:       mockInterface,
+		metrics:    &Metrics{},
+		conns:      map[string]*wc.WSWriter{ip: ws},
+		httpServer: &http.Server{},
+		listener:   l,
+		rtt:        newRTTTracker(),
+		loss:       newLossTracker(),
+	}
+	served := make(chan error, 1)
+	go func() { served <- r.httpServer.Serve(l) }()
+	time.Sleep(100 * time.Millisecond)
+
+	mockInterface.EXPECT().Close()
+	r.Stop()
+	r.Stop()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := client.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("Expected normal closure, got %v", err)
+	}
+	if _, err := ipam.GetData(ip); err == nil {
+		t.Errorf("Expected %v released", ip)
+	}
+	if len(r.conns) != 0 {
+		t.Errorf("Expected no connections, got %v", r.conns)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("Expected HTTP server closed, got %v", err)
+	}
+}
+
 func createIPv4Pkt(srcIP net.IP, dstIP net.IP) []byte {
 	buf := gopacket.NewSerializeBuffer()
-	opts := gopacket.SerializeOptions{}
+	opts := gopacket.SerializeOptions{FixLengths: true}
 	gopacket.SerializeLayers(buf, opts,
 		&layers.IPv4{
-			SrcIP: srcIP,
-			DstIP: dstIP,
+			Version:  4,
+			IHL:      5,
+			Protocol: layers.IPProtocolTCP,
+			SrcIP:    srcIP,
+			DstIP:    dstIP,
 		},
 		&layers.TCP{},
 		gopacket.Payload([]byte{1, 2, 3, 4}))